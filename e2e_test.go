@@ -0,0 +1,662 @@
+package main
+
+// The end-to-end tests run the bootstrap binary in a sandbox: a test root
+// (BOOTSTRAP_TEST_ROOT) with its own /etc/os-release, a temporary HOME, and
+// a PATH holding nothing but fake commands, which record how they were run
+// and answer with canned output. Nothing on the machine running the tests
+// is touched, and no network is needed.
+
+import (
+	"encoding/json"
+	"errors"
+	"io/fs"
+	"os"
+	"os/exec"
+	"path"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"sync"
+	"syscall"
+	"testing"
+
+	"github.com/sparkleHazard/bootstrap/internal/platform"
+	"github.com/sparkleHazard/bootstrap/internal/platform/platformtest"
+	"github.com/sparkleHazard/bootstrap/internal/report"
+)
+
+var (
+	e2eBinaryOnce sync.Once
+	e2eBinaryPath string
+	e2eBinaryErr  error
+)
+
+// e2eBinary builds bootstrap once for all the end-to-end tests.
+func e2eBinary(t *testing.T) string {
+	t.Helper()
+	if testing.Short() {
+		t.Skip("end-to-end test; skipped with -short")
+	}
+	if runtime.GOOS != "linux" {
+		t.Skip("the sandbox's fake commands stand in for a Linux host's")
+	}
+	e2eBinaryOnce.Do(func() {
+		dir, err := os.MkdirTemp("", "bootstrap-e2e-")
+		if err != nil {
+			e2eBinaryErr = err
+			return
+		}
+		e2eBinaryPath = filepath.Join(dir, "bootstrap")
+		out, err := exec.Command(filepath.Join(runtime.GOROOT(), "bin", "go"), "build", "-buildvcs=false", "-o", e2eBinaryPath, ".").CombinedOutput()
+		if err != nil {
+			e2eBinaryErr = errors.New("go build: " + err.Error() + "\n" + string(out))
+		}
+	})
+	if e2eBinaryErr != nil {
+		t.Fatal(e2eBinaryErr)
+	}
+	return e2eBinaryPath
+}
+
+// sandbox is a host for an end-to-end run.
+type sandbox struct {
+	t     *testing.T
+	host  *platformtest.Host
+	dir   string
+	root  string // BOOTSTRAP_TEST_ROOT
+	home  string
+	bin   string   // the only directory on PATH
+	avail string   // a directory per package apt-get can install
+	log   string   // the fake commands' invocations
+	key   string   // an SSH private key for the fake commands to hand out
+	env   []string // added to the runs' environment
+}
+
+// newSandbox returns a host with osRelease as its /etc/os-release and
+// apt-get, sudo and ssh-keygen installed. apt-get installs the packages
+// added with pkg.
+func newSandbox(t *testing.T, osRelease string) *sandbox {
+	t.Helper()
+	h := platformtest.NewHost(t, osRelease)
+	s := &sandbox{
+		t:     t,
+		host:  h,
+		dir:   h.Dir,
+		root:  h.Root,
+		home:  h.Home,
+		bin:   h.Bin,
+		avail: filepath.Join(h.Dir, "avail"),
+		log:   filepath.Join(h.Dir, "commands.log"),
+		key:   h.Key,
+	}
+	if err := os.Mkdir(s.avail, 0o755); err != nil {
+		t.Fatal(err)
+	}
+
+	// The package manager: "apt-get install" copies a package's commands
+	// onto PATH.
+	s.fake("apt-get", `while [ "$1" = -o ]; do shift 2; done
+case "$1" in
+install)
+	shift
+	for p in "$@"; do
+		case "$p" in -*) continue ;; esac
+		[ -d "$FAKE_AVAIL/$p" ] || { echo "E: Unable to locate package $p" >&2; exit 100; }
+		for f in "$FAKE_AVAIL/$p"/*; do /bin/cp "$f" "$FAKE_BIN/"; done
+	done ;;
+--version) echo "apt 2.6.1 (amd64)" ;;
+esac`)
+	s.fake("dpkg-query", `exit 1`)
+	// sudo runs the command as it is, and is not recorded itself, so that
+	// the commands are the same whoever runs the tests.
+	s.writeExecutable("bin/sudo", "#!/bin/sh\nwhile [ \"${1#-}\" != \"$1\" ]; do shift; done\n[ $# -eq 0 ] || \"$@\"\n")
+	// ssh-keygen writes the private key with mode 0600, as the real one does.
+	s.fake("ssh-keygen", `for a; do [ "$prev" = -f ] && dest=$a; prev=$a; done
+/bin/cp "$FAKE_KEY" "$dest" && /bin/chmod 600 "$dest"`)
+	for pkg, cmds := range map[string][]string{
+		"curl":    {"curl"},
+		"rsync":   {"rsync"},
+		"jq":      {"jq"},
+		"python3": {"python3"},
+		"ansible": {"ansible", "ansible-playbook", "ansible-pull"},
+	} {
+		for _, c := range cmds {
+			s.pkg(pkg, c, "")
+		}
+	}
+	// git answers for the checkout ansible-pull leaves.
+	s.pkg("git", "git", `case "$*" in *"rev-parse HEAD") echo 0123456789abcdef0123456789abcdef01234567 ;; esac`)
+	// rsync fetches the key to its last argument.
+	s.pkg("rsync", "rsync", `for a; do dest=$a; done
+/bin/cp "$FAKE_KEY" "$dest"`)
+	return s
+}
+
+// writeFile writes a file at the path relative to the sandbox.
+func (s *sandbox) writeFile(rel, content string) {
+	s.t.Helper()
+	if err := os.WriteFile(filepath.Join(s.dir, rel), []byte(content), 0o644); err != nil {
+		s.t.Fatal(err)
+	}
+}
+
+// writeExecutable writes an executable file at the path relative to the
+// sandbox.
+func (s *sandbox) writeExecutable(rel, content string) {
+	s.t.Helper()
+	path := filepath.Join(s.dir, rel)
+	if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+		s.t.Fatal(err)
+	}
+	if err := os.WriteFile(path, []byte(content), 0o755); err != nil {
+		s.t.Fatal(err)
+	}
+}
+
+// fakeScript returns a fake command name that records its invocation and
+// then runs the shell script body. Only the shell's builtins are on its
+// PATH, which is the sandbox's. The log separates an invocation's arguments
+// with \x1f and ends it with \x1e, as an argument may span lines.
+func fakeScript(name, body string) string {
+	return "#!/bin/sh\n{ printf %s " + name + `; printf '\037%s' "$@"; printf '\036'; } >> "$FAKE_LOG"` + "\n" + body + "\n"
+}
+
+// fake installs the fake command name.
+func (s *sandbox) fake(name, body string) {
+	s.writeExecutable(filepath.Join("bin", name), fakeScript(name, body))
+}
+
+// pkg makes the fake command name part of the package pkg, which apt-get
+// installs.
+func (s *sandbox) pkg(pkg, name, body string) {
+	s.writeExecutable(filepath.Join("avail", pkg, name), fakeScript(name, body))
+}
+
+// fakeGitHub installs gh, installed and logged in, and ssh, with which
+// GitHub accepts the key once it has been uploaded.
+func (s *sandbox) fakeGitHub() {
+	s.fake("gh", `case "$*" in
+"api -H Accept: application/vnd.github+json -H X-GitHub-Api-Version: 2022-11-28 /user/keys") echo '[]' ;;
+*"--method POST"*) : > "$FAKE_BIN/../uploaded" ;;
+esac`)
+	s.fake("ssh", `if [ -e "$FAKE_BIN/../uploaded" ]; then
+	echo "Hi octocat! You've successfully authenticated, but GitHub does not provide shell access."
+else
+	echo "git@github.com: Permission denied (publickey)." >&2
+fi
+exit 1`)
+}
+
+// run runs bootstrap in the sandbox with args after the settings every run
+// needs there, and returns its exit code and output.
+func (s *sandbox) run(args ...string) (int, string) {
+	s.t.Helper()
+	args = append([]string{
+		"--no-progress",
+		"--log-target", "console",
+		"--skip-clock-check",
+		"--skip-space-check",
+		"--skip-locale-setup",
+		"--keyserver", "rsync://127.0.0.1/keys/id_ecdsa_github",
+		"--retry-attempts", "1",
+		"--result-file", filepath.Join(s.root, "result.json"),
+	}, args...)
+	cmd := exec.Command(e2eBinary(s.t), args...)
+	cmd.Env = append(s.host.Env(),
+		"LANG=C.UTF-8",
+		"FAKE_LOG="+s.log,
+		"FAKE_BIN="+s.bin,
+		"FAKE_AVAIL="+s.avail,
+		"FAKE_KEY="+s.key,
+	)
+	cmd.Env = append(cmd.Env, s.env...)
+	out, err := cmd.CombinedOutput()
+	var exit *exec.ExitError
+	if err != nil && !errors.As(err, &exit) {
+		s.t.Fatal(err)
+	}
+	return cmd.ProcessState.ExitCode(), string(out)
+}
+
+// commands returns the fake commands' invocations, in order.
+func (s *sandbox) commands() []string {
+	s.t.Helper()
+	data, err := os.ReadFile(s.log)
+	if err != nil && !os.IsNotExist(err) {
+		s.t.Fatal(err)
+	}
+	cmds := strings.Split(strings.TrimSuffix(string(data), "\x1e"), "\x1e")
+	for i, c := range cmds {
+		cmds[i] = strings.ReplaceAll(c, "\x1f", " ")
+	}
+	return cmds
+}
+
+// result returns the run's result file.
+func (s *sandbox) result() report.Result {
+	s.t.Helper()
+	data, err := os.ReadFile(filepath.Join(s.root, "result.json"))
+	if err != nil {
+		s.t.Fatal(err)
+	}
+	var res report.Result
+	if err := json.Unmarshal(data, &res); err != nil {
+		s.t.Fatal(err)
+	}
+	return res
+}
+
+// wantCommands checks that the commands run were want, each command's line
+// starting with its entry.
+func wantCommands(t *testing.T, got, want []string) {
+	t.Helper()
+	ok := len(got) == len(want)
+	for i := 0; ok && i < len(want); i++ {
+		ok = strings.HasPrefix(got[i], want[i])
+	}
+	if !ok {
+		t.Errorf("commands run:\n  %s\nwant:\n  %s", strings.Join(got, "\n  "), strings.Join(want, "\n  "))
+	}
+}
+
+// wantSummary checks that the step summary at the end of output shows each
+// step in steps ("STEP STATUS") as it does.
+func wantSummary(t *testing.T, output string, steps ...string) {
+	t.Helper()
+	_, summary, ok := strings.Cut(output, "Step summary:")
+	if !ok {
+		t.Fatalf("no step summary in the output:\n%s", output)
+	}
+	rows := map[string]string{}
+	for _, line := range strings.Split(summary, "\n") {
+		if _, row, ok := strings.Cut(line, "]   "); ok {
+			if f := strings.Fields(row); len(f) >= 2 {
+				rows[f[0]] = f[1]
+			}
+		}
+	}
+	for _, s := range steps {
+		step, status, _ := strings.Cut(s, " ")
+		if rows[step] != status {
+			t.Errorf("step summary shows %s as %q, want %q:\n%s", step, rows[step], status, summary)
+		}
+	}
+}
+
+// installCommands are the commands a fresh host runs to install the
+// prerequisites every role has.
+var installCommands = []string{
+	"apt-get --version",
+	"apt-get -o DPkg::Lock::Timeout=300 update",
+	"apt-get -o DPkg::Lock::Timeout=300 install -y curl",
+	"apt-get -o DPkg::Lock::Timeout=300 install -y git",
+	"apt-get -o DPkg::Lock::Timeout=300 install -y rsync",
+	"apt-get -o DPkg::Lock::Timeout=300 install -y jq",
+	"apt-get -o DPkg::Lock::Timeout=300 install -y python3",
+	"apt-get -o DPkg::Lock::Timeout=300 install -y ansible",
+	"ansible-playbook --version",
+}
+
+func TestE2EDebianBase(t *testing.T) {
+	s := newSandbox(t, platformtest.DebianRelease)
+	code, out := s.run("--role", "base")
+	if code != platform.ExitOK {
+		t.Fatalf("exit code %d, want %d:\n%s", code, platform.ExitOK, out)
+	}
+	wantSummary(t, out,
+		"install-sudo already-installed",
+		"install-curl installed",
+		"install-ansible installed",
+		"install-gh not-needed",
+		"fetch-key ok",
+		"ansible-pull ok",
+		"total success",
+	)
+	wantCommands(t, s.commands(), append(installCommands,
+		"rsync -avz --chmod=F600 rsync://127.0.0.1/keys/id_ecdsa_github ",
+		"ansible-pull --extra-vars ",
+		"git -C "+filepath.Join(s.home, ".ansible", "pull")+"/",
+	))
+	pull := s.commands()[len(s.commands())-2]
+	for _, arg := range []string{"--extra-vars host_role=base", "-U git@github.com:sparkleHazard/ansible.git", "--private-key " + filepath.Join(s.home, ".ssh", "id_ecdsa_github")} {
+		if !strings.Contains(pull, arg) {
+			t.Errorf("ansible-pull was not given %s: %s", arg, pull)
+		}
+	}
+
+	res := s.result()
+	if res.Status != "success" || res.OS != "debian" || res.AnsibleCommit != "0123456789abcdef0123456789abcdef01234567" {
+		t.Errorf("result: status %q, OS %q, commit %q", res.Status, res.OS, res.AnsibleCommit)
+	}
+	key, err := os.ReadFile(filepath.Join(s.home, ".ssh", "id_ecdsa_github"))
+	if want, _ := os.ReadFile(s.key); err != nil || string(key) != string(want) {
+		t.Errorf("the fetched key was not installed: %v", err)
+	}
+}
+
+func TestE2EKeyserver(t *testing.T) {
+	s := newSandbox(t, platformtest.DebianRelease)
+	s.fakeGitHub()
+	code, out := s.run("--role", "keyserver")
+	if code != platform.ExitOK {
+		t.Fatalf("exit code %d, want %d:\n%s", code, platform.ExitOK, out)
+	}
+	wantSummary(t, out,
+		"install-gh already-installed",
+		"gh-auth ok",
+		"github-key ok",
+		"ansible-pull ok",
+		"total success",
+	)
+	keyPath := filepath.Join(s.home, ".ssh", "id_ecdsa_github")
+	wantCommands(t, s.commands(), append(installCommands,
+		"gh auth status",
+		"ssh-keygen -t ecdsa -b 521 -f "+keyPath+" -N  -q -C ",
+		"ssh -T -o BatchMode=yes -o StrictHostKeyChecking=no -i "+keyPath+" git@github.com",
+		"gh api -H Accept: application/vnd.github+json -H X-GitHub-Api-Version: 2022-11-28 /user/keys",
+		"gh api --method POST -H Accept: application/vnd.github+json -H X-GitHub-Api-Version: 2022-11-28 /user/keys -f key=ecdsa-sha2-nistp256 ",
+		"ansible-pull --extra-vars ",
+		"git -C ",
+	))
+	if !strings.Contains(s.commands()[len(s.commands())-2], "--extra-vars host_role=keyserver") {
+		t.Errorf("ansible-pull was not run for the keyserver role: %s", s.commands()[len(s.commands())-2])
+	}
+	if _, err := os.Stat(keyPath + ".pub"); err != nil {
+		t.Errorf("no public key beside the generated key: %v", err)
+	}
+}
+
+func TestE2EAnsibleFailure(t *testing.T) {
+	s := newSandbox(t, platformtest.DebianRelease)
+	s.pkg("ansible", "ansible-pull", `printf '%s\n' \
+	'TASK [base : install packages] ***' \
+	'fatal: [localhost]: FAILED! => {"changed": false, "msg": "No package matching nonexistent is available"}' \
+	'' \
+	'PLAY RECAP ***' \
+	'localhost                  : ok=3    changed=1    unreachable=0    failed=1    skipped=0    rescued=0    ignored=0'
+exit 2`)
+	code, out := s.run("--role", "base")
+	if code != platform.ExitFailure {
+		t.Fatalf("exit code %d, want %d:\n%s", code, platform.ExitFailure, out)
+	}
+	wantSummary(t, out,
+		"fetch-key ok",
+		"ansible-pull failed",
+		"total failed",
+	)
+	if !strings.Contains(out, "Bootstrap failed: ansible-pull failed: exit status 2") {
+		t.Errorf("the failure was not reported:\n%s", out)
+	}
+	wantCommands(t, s.commands(), append(installCommands,
+		"rsync ",
+		"ansible-pull --extra-vars ",
+		"git -C ",
+	))
+
+	res := s.result()
+	if res.Status != "failed" || res.ExitCode != platform.ExitFailure || res.FailedStep != "ansible-pull" {
+		t.Errorf("result: status %q, exit code %d, failed step %q", res.Status, res.ExitCode, res.FailedStep)
+	}
+	if r := res.AnsibleRecap; r == nil || r.Failed != 1 || r.Changed != 1 {
+		t.Errorf("result has the recap %+v, want failed=1 changed=1", r)
+	}
+	// A failed run is not a bootstrapped host.
+	if _, err := os.Stat(filepath.Join(s.root, "var", "lib", "bootstrap", platform.SuccessMarkerName)); !os.IsNotExist(err) {
+		t.Errorf("the failed run left a success marker: %v", err)
+	}
+}
+
+// fileModes are the modes of the files a run creates in the sandbox, by
+// pattern relative to it, as the Files and Permissions table of the README
+// documents them. Every file is the run's user's.
+var fileModes = []struct {
+	pattern string
+	mode    os.FileMode
+}{
+	{"home/.ssh", fs.ModeDir | 0o700},
+	{"home/.ssh/id_ecdsa_github", 0o600},
+	{"home/.ssh/id_ecdsa_github.pub", 0o644},
+	{"home/.ssh/provisioning", fs.ModeDir | 0o700},
+	{"home/.ssh/provisioning/id_ecdsa_staging", 0o600},
+	{"root/var/lib", fs.ModeDir | 0o755},
+	{"root/var/lib/bootstrap", fs.ModeDir | 0o755},
+	{"root/var/lib/bootstrap/*", 0o644},
+	{"root/var/lock/bootstrap.lock", 0o600},
+	{"root/result.json", 0o644},
+	{"root/transcript.jsonl", 0o600},
+	{"tmp/bootstrap-*.lock", 0o600},
+	{"tmp/bootstrap-*", fs.ModeDir | 0o700},
+	{"tmp/bootstrap-*/*", 0o600},
+}
+
+func TestE2EFileModes(t *testing.T) {
+	for _, tt := range []struct {
+		name string
+		args []string
+	}{
+		{"base", []string{"--role", "base", "--key-path", ".ssh/provisioning/id_ecdsa_staging"}},
+		{"keyserver", []string{"--role", "keyserver"}},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			s := newSandbox(t, platformtest.DebianRelease)
+			s.fakeGitHub()
+			// Only what the run creates is checked, not the sandbox, nor
+			// what apt-get and gh's fakes add to it.
+			before := map[string]bool{}
+			s.walk(func(rel string, fi os.FileInfo) { before[rel] = true })
+			code, out := s.run(append(tt.args, "--transcript", filepath.Join(s.root, "transcript.jsonl"))...)
+			if code != platform.ExitOK {
+				t.Fatalf("exit code %d, want %d:\n%s", code, platform.ExitOK, out)
+			}
+			s.walk(func(rel string, fi os.FileInfo) {
+				if before[rel] || strings.HasPrefix(rel, "bin/") || rel == "commands.log" || rel == "uploaded" {
+					return
+				}
+				want, ok := os.FileMode(0), false
+				for _, m := range fileModes {
+					if match, _ := path.Match(m.pattern, rel); match {
+						want, ok = m.mode, true
+						break
+					}
+				}
+				switch {
+				case !ok:
+					t.Errorf("%s (%v) is not in the table of file modes", rel, fi.Mode())
+				case fi.Mode() != want:
+					t.Errorf("%s has mode %v, want %v", rel, fi.Mode(), want)
+				}
+				if st, ok := fi.Sys().(*syscall.Stat_t); ok && int(st.Uid) != os.Getuid() {
+					t.Errorf("%s is owned by uid %d, want the run's user, %d", rel, st.Uid, os.Getuid())
+				}
+			})
+		})
+	}
+}
+
+// walk calls fn for each file and directory in the sandbox, with its path
+// relative to it.
+func (s *sandbox) walk(fn func(rel string, fi os.FileInfo)) {
+	s.t.Helper()
+	err := filepath.WalkDir(s.dir, func(p string, d fs.DirEntry, err error) error {
+		if err != nil || p == s.dir {
+			return err
+		}
+		fi, err := d.Info()
+		if err != nil {
+			return err
+		}
+		rel, _ := filepath.Rel(s.dir, p)
+		fn(filepath.ToSlash(rel), fi)
+		return nil
+	})
+	if err != nil {
+		s.t.Fatal(err)
+	}
+}
+
+func TestE2EErrorPaths(t *testing.T) {
+	for _, tt := range []struct {
+		name  string
+		setup func(s *sandbox)
+		args  []string
+		code  int
+		// failed is the failed step, and msg what the run says of it.
+		failed string
+		msg    string
+		// noResult is for the runs that end before there is one to write.
+		noResult bool
+	}{
+		{
+			name:   "package not found",
+			setup:  func(s *sandbox) { os.RemoveAll(filepath.Join(s.avail, "jq")) },
+			code:   platform.ExitFailure,
+			failed: "install-jq",
+			msg:    "Bootstrap failed: installing jq: apt-get install -y jq failed: exit status 100",
+		},
+		{
+			name: "key refused by the keyserver",
+			setup: func(s *sandbox) {
+				s.pkg("rsync", "rsync", `echo "@ERROR: auth failed on module keys" >&2
+exit 5`)
+			},
+			code:   platform.ExitFailure,
+			failed: "fetch-key",
+			msg:    "Bootstrap failed: unable to fetch GitHub SSH private key: rsync failed after 1 attempts: exit status 5",
+		},
+		{
+			name: "unsupported OS",
+			setup: func(s *sandbox) {
+				s.writeFile("root/etc/os-release", "NAME=\"Plan 9\"\nID=plan9\n")
+			},
+			code:   platform.ExitFailure,
+			failed: "install-curl",
+			msg:    `Bootstrap failed: unsupported OS "plan9" for automatic installation of curl`,
+		},
+		{
+			name:     "invalid setting",
+			args:     []string{"--timesync-daemon", "ntpd"},
+			code:     platform.ExitConfig,
+			msg:      `Configuration error: timesync-daemon "ntpd" must be auto, chrony or timesyncd`,
+			noResult: true,
+		},
+		{
+			name: "another run holds the lock",
+			setup: func(s *sandbox) {
+				f, err := os.OpenFile(filepath.Join(s.root, "var", "lock", "bootstrap.lock"), os.O_RDWR|os.O_CREATE, 0o600)
+				if err != nil {
+					s.t.Fatal(err)
+				}
+				s.t.Cleanup(func() { f.Close() })
+				if err := syscall.Flock(int(f.Fd()), syscall.LOCK_EX|syscall.LOCK_NB); err != nil {
+					s.t.Fatal(err)
+				}
+			},
+			args:     []string{"--lock-wait", "0s"},
+			code:     platform.ExitLocked,
+			msg:      "Bootstrap failed: another bootstrap is already running",
+			noResult: true,
+		},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			s := newSandbox(t, platformtest.DebianRelease)
+			if tt.setup != nil {
+				tt.setup(s)
+			}
+			code, out := s.run(append([]string{"--role", "base"}, tt.args...)...)
+			if code != tt.code {
+				t.Fatalf("exit code %d, want %d:\n%s", code, tt.code, out)
+			}
+			if !strings.Contains(out, tt.msg) {
+				t.Errorf("the run did not report %q:\n%s", tt.msg, out)
+			}
+			if _, err := os.Stat(filepath.Join(s.root, "var", "lib", "bootstrap", platform.SuccessMarkerName)); !os.IsNotExist(err) {
+				t.Errorf("the failed run left a success marker: %v", err)
+			}
+			if tt.noResult {
+				if _, err := os.Stat(filepath.Join(s.root, "result.json")); !os.IsNotExist(err) {
+					t.Errorf("the run wrote a result file: %v", err)
+				}
+				return
+			}
+			wantSummary(t, out, tt.failed+" failed", "total failed")
+			res := s.result()
+			if res.Status != "failed" || res.ExitCode != tt.code || res.FailedStep != tt.failed || res.Error == "" {
+				t.Errorf("result: status %q, exit code %d, failed step %q, error %q", res.Status, res.ExitCode, res.FailedStep, res.Error)
+			}
+		})
+	}
+}
+
+func TestE2ENoTempLeftovers(t *testing.T) {
+	const vaultPass = "correct horse battery staple"
+	for _, tt := range []struct {
+		name  string
+		setup func(s *sandbox)
+		code  int
+	}{
+		{"success", nil, platform.ExitOK},
+		{"install fails", func(s *sandbox) { os.RemoveAll(filepath.Join(s.avail, "jq")) }, platform.ExitFailure},
+		// The key is in the work directory when rsync fails.
+		{"key fetch fails", func(s *sandbox) {
+			s.pkg("rsync", "rsync", `for a; do dest=$a; done
+/bin/cp "$FAKE_KEY" "$dest"
+echo "rsync error: some files could not be transferred (code 23)" >&2
+exit 23`)
+		}, platform.ExitFailure},
+		// ansible-pull fails with the vault password client in the work
+		// directory.
+		{"ansible-pull fails", func(s *sandbox) { s.pkg("ansible", "ansible-pull", "exit 2") }, platform.ExitFailure},
+		{"interrupted", func(s *sandbox) {
+			// Until the run stops it.
+			s.pkg("ansible", "ansible-pull", `kill -INT $PPID
+exec /bin/sleep 10`)
+		}, platform.ExitInterrupted},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			s := newSandbox(t, platformtest.DebianRelease)
+			if err := os.Mkdir(filepath.Join(s.dir, "creds"), 0o700); err != nil {
+				t.Fatal(err)
+			}
+			s.writeFile("creds/vault-pass", vaultPass)
+			s.env = append(s.env, "CREDENTIALS_DIRECTORY="+filepath.Join(s.dir, "creds"))
+			if tt.setup != nil {
+				tt.setup(s)
+			}
+			code, out := s.run("--role", "base")
+			if code != tt.code {
+				t.Fatalf("exit code %d, want %d:\n%s", code, tt.code, out)
+			}
+
+			// The run's lock is in /var/lock, so nothing of it is left in
+			// TMPDIR at all.
+			entries, err := os.ReadDir(filepath.Join(s.dir, "tmp"))
+			if err != nil {
+				t.Fatal(err)
+			}
+			for _, e := range entries {
+				t.Errorf("the run left %s in TMPDIR", e.Name())
+			}
+			// Nor is the key or the vault password anywhere but where they
+			// belong.
+			key, err := os.ReadFile(s.key)
+			if err != nil {
+				t.Fatal(err)
+			}
+			s.walk(func(rel string, fi os.FileInfo) {
+				if !fi.Mode().IsRegular() || rel == "key" || rel == "creds/vault-pass" || rel == "home/.ssh/id_ecdsa_github" {
+					return
+				}
+				data, err := os.ReadFile(filepath.Join(s.dir, rel))
+				if err != nil {
+					t.Fatal(err)
+				}
+				if strings.Contains(string(data), string(key)) {
+					t.Errorf("%s holds the private key", rel)
+				}
+				if strings.Contains(string(data), vaultPass) {
+					t.Errorf("%s holds the vault password", rel)
+				}
+			})
+		})
+	}
+}
@@ -1,3 +1,11 @@
 module github.com/sparkleHazard/bootstrap
 
 go 1.23.5
+
+require (
+	filippo.io/age v1.2.1
+	golang.org/x/crypto v0.33.0
+	golang.org/x/term v0.29.0
+)
+
+require golang.org/x/sys v0.30.0 // indirect
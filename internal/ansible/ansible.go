@@ -0,0 +1,414 @@
+// Package ansible prepares and runs ansible-pull: the checkout, the
+// inventory, signed tags, two-phase and drift runs, and the ansible user.
+package ansible
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"github.com/sparkleHazard/bootstrap/internal/config"
+	"github.com/sparkleHazard/bootstrap/internal/github"
+	"github.com/sparkleHazard/bootstrap/internal/platform"
+	"github.com/sparkleHazard/bootstrap/internal/secrets"
+	"github.com/sparkleHazard/bootstrap/internal/service"
+	"github.com/sparkleHazard/bootstrap/internal/sshkeys"
+)
+
+// EnsureAnsible checks if ansible-playbook is installed and installs it if not.
+func (r *Runner) EnsureAnsible(ctx context.Context, osID string) error {
+	_, err := exec.LookPath("ansible-playbook")
+	if err == nil {
+		if r.cfg.Verbose {
+			r.sys.Log("Ansible is already installed.")
+		}
+		return nil
+	}
+	r.sys.Log("Ansible not found. Installing...")
+	out := &platform.TailBuffer{Max: platform.InstallOutputMax}
+	if !r.sys.CanEscalate && osID != "darwin" {
+		r.sys.Log("No sudo available; installing Ansible for this user with pip...")
+		if err := r.sys.RunCmdTee(ctx, out, "pip", "install", "--user", "ansible"); err != nil {
+			return fmt.Errorf("installing ansible: pip install --user ansible failed: %w", err)
+		}
+		r.sys.RecordIrreversible("installed ansible with pip --user")
+		return r.verifyAnsible(ctx, out)
+	}
+	switch osID {
+	case "ubuntu", "debian":
+		if err = r.sys.RefreshPackageIndex(ctx, "apt-get"); err == nil {
+			err = r.sys.RunPkgCmdTee(ctx, out, "apt-get", "install", "-y", "ansible")
+		}
+	case "fedora":
+		err = r.sys.RunPkgCmdTee(ctx, out, "dnf", "install", "-y", "ansible")
+	case "centos", "redhat":
+		if err = r.sys.EnsureEPEL(ctx); err == nil {
+			err = r.sys.RunPkgCmdTee(ctx, out, "yum", "install", "-y", "ansible")
+		}
+	case "darwin":
+		if err = r.sys.RunCmdTee(ctx, out, "brew", "install", "ansible"); err != nil {
+			err = fmt.Errorf("brew install ansible failed: %w", err)
+		}
+	default:
+		r.sys.Log("Falling back to pip-based Ansible installation...")
+		if err = r.sys.RunCmdTee(ctx, out, "pip", "install", "--user", "ansible"); err != nil {
+			err = fmt.Errorf("pip install --user ansible failed: %w", err)
+		}
+	}
+	if err != nil {
+		return fmt.Errorf("installing ansible: %w", err)
+	}
+	r.sys.RecordIrreversible("installed ansible")
+	return r.verifyAnsible(ctx, out)
+}
+
+// verifyAnsible checks that the Ansible install left a working
+// ansible-playbook. pip --user puts it in ~/.local/bin, which is often not on
+// PATH yet, so that directory is added when the binary is found there; it
+// must then actually run, since a pip install can leave a broken shebang.
+func (r *Runner) verifyAnsible(ctx context.Context, out *platform.TailBuffer) error {
+	if _, err := exec.LookPath("ansible-playbook"); err != nil {
+		if homeDir, herr := r.sys.Host.HomeDir(); herr == nil {
+			binDir := filepath.Join(homeDir, ".local", "bin")
+			if platform.FileExists(filepath.Join(binDir, "ansible-playbook")) {
+				r.sys.Log("Adding " + binDir + " to PATH for the pip-installed Ansible.")
+				os.Setenv("PATH", binDir+string(os.PathListSeparator)+os.Getenv("PATH"))
+			}
+		}
+	}
+	if err := platform.VerifyInstalled("ansible-playbook", out); err != nil {
+		return err
+	}
+	if output, err := r.sys.NewCommand(ctx, "ansible-playbook", "--version").CombinedOutput(); err != nil {
+		msg := fmt.Sprintf("ansible-playbook was installed but does not run: %v", err)
+		if tail := strings.TrimSpace(string(output)); tail != "" {
+			msg += "\n" + tail
+		}
+		return errors.New(msg)
+	}
+	return nil
+}
+
+// pullOutcome is what RunAnsiblePull did: the ansible-pull step's status,
+// the ref and commit of the ansible repository it checked out, and what the
+// check run of --detect-drift or --two-phase and the playbook's PLAY RECAP
+// showed. Status is empty when the run failed before ansible-pull could.
+type pullOutcome struct {
+	Status   string
+	Ref      string
+	RefFrom  string
+	Commit   string
+	Approval *Approval
+	Drift    *DriftReport
+	Recap    *Recap
+}
+
+// RunAnsiblePull runs ansible-pull with the appropriate key, vault, etc.
+// staged is the checkout the steps before it inspected and sig the
+// signature --require-signed-tag verified, if any: the commit applied must
+// be theirs. The outcome is returned whether or not the run failed.
+func (r *Runner) RunAnsiblePull(ctx context.Context, staged *StagedCheckout, sig *SignatureInfo) (*pullOutcome, error) {
+	p := &pullOutcome{}
+	homeDir, err := r.sys.Host.HomeDir()
+	if err != nil {
+		return p, fmt.Errorf("unable to find home directory for ansible-pull: %w", err)
+	}
+	keyPath, err := r.keys.GithubKeyPath(r.sys.Host)
+	if err != nil {
+		return p, err
+	}
+	vaultPath, cleanup, err := r.secrets.VaultPasswordFile(ctx, homeDir)
+	if err != nil {
+		return p, err
+	}
+	defer cleanup()
+
+	// The name --hostname set, or the one the host already had.
+	host, _ := os.Hostname()
+
+	inventory, err := r.inventoryArg(ctx)
+	if err != nil {
+		return p, err
+	}
+
+	r.sys.Log("Running ansible-pull...")
+	args := []string{
+		"-U", r.cfg.RepoURL,
+		"-i", inventory,
+		"--extra-vars", fmt.Sprintf("host_role=%s", r.cfg.Role),
+		"--extra-vars", fmt.Sprintf("host_name=%s", host),
+		"--private-key", keyPath,
+		"--accept-host-key",
+		"--submodules",
+		"--vault-password-file", vaultPath,
+		r.cfg.AnsibleSite,
+	}
+	ref, from := r.cfg.EffectiveAnsibleRef()
+	p.Ref, p.RefFrom = ref, from
+	if ref != "" {
+		args = append([]string{"--checkout", ref}, args...)
+	}
+	checkout := ansiblePullDir(homeDir, host)
+	args = append([]string{"--directory", checkout}, args...)
+	// Drift is checked for whether or not the repository changed.
+	onlyIfChanged := r.cfg.OnlyIfChanged && !r.cfg.DetectDrift
+	if onlyIfChanged {
+		// A pinned commit that is already checked out never changes, so
+		// there is nothing to fetch either.
+		if head, _ := r.checkoutHead(ctx, checkout); r.cfg.AnsibleRef != "" && commitMatches(head, r.cfg.AnsibleRef) {
+			r.sys.Log("The ansible repository is already at " + head + "; not running the playbook.")
+			p.Commit = head
+			p.Status = "unchanged"
+			return p, nil
+		}
+	}
+	depthArgs, cloned, err := r.prepareCheckout(ctx, checkout, keyPath)
+	if err != nil {
+		p.Status = "failed"
+		return p, err
+	}
+	args = append(depthArgs, args...)
+	// A checkout cloned just now is news to ansible-pull's change check.
+	if onlyIfChanged && !cloned {
+		args = append([]string{"--only-if-changed"}, args...)
+	}
+	if len(r.cfg.ExtraVars) > 0 {
+		// As JSON, a value keeps its spaces and quotes.
+		vars, err := json.Marshal(r.cfg.ExtraVars)
+		if err != nil {
+			return p, err
+		}
+		args = append([]string{"--extra-vars", string(vars)}, args...)
+	}
+	if r.sys.PythonInterpreter != "" {
+		args = append([]string{"--extra-vars", "ansible_python_interpreter=" + r.sys.PythonInterpreter}, args...)
+	}
+	if r.sys.GatheredFacts != nil {
+		facts, err := platform.FactsExtraVars(r.sys.GatheredFacts)
+		if err != nil {
+			return p, err
+		}
+		args = append([]string{"--extra-vars", facts}, args...)
+	}
+	if method := r.sys.BecomeMethod(); method != "" {
+		args = append([]string{"--become-method", method}, args...)
+	}
+	if r.cfg.DetectDrift {
+		drift, err := r.detectDrift(ctx, args)
+		p.Drift = drift
+		p.Commit, _ = r.checkoutHead(ctx, checkout)
+		switch {
+		case err == nil:
+			p.Status = "no-drift"
+		case errors.Is(err, ErrDrift):
+			p.Status = "drift"
+		default:
+			p.Status = "failed"
+		}
+		return p, err
+	}
+	if r.cfg.TwoPhase {
+		a, apply, err := r.checkThenConfirm(ctx, args, checkout)
+		p.Approval = a
+		if err != nil {
+			p.Status = "failed"
+			if errors.Is(err, ErrDeclined) {
+				p.Status = "declined"
+			}
+			return p, err
+		}
+		if !apply {
+			p.Commit, _ = r.checkoutHead(ctx, checkout)
+			p.Status = "unchanged"
+			return p, nil
+		}
+		// Apply what was approved, even if the ref has moved since.
+		args = approvedRunArgs(args, p.Approval.Commit)
+	}
+	r.sys.RecordIrreversible("changes made by the playbook")
+	out := &platform.TailBuffer{Max: ansibleOutputMax}
+	err = r.sys.RunCmdTee(ctx, out, "ansible-pull", args...)
+	p.Recap = parseAnsibleRecap(out.Bytes())
+	head, herr := r.checkoutHead(ctx, checkout)
+	p.Commit = head
+	if err != nil {
+		p.Status = "failed"
+		return p, fmt.Errorf("ansible-pull failed: %w", err)
+	}
+	// What was verified must be what was applied: a signed tag that was
+	// moved in between is refused.
+	if sig != nil && head != sig.Commit {
+		p.Status = "failed"
+		return p, fmt.Errorf("%w: ansible-pull applied commit %s, not %s of the verified %s %s", ErrSignature, platform.DashIfEmpty(head), sig.Commit, sig.Kind, sig.Ref)
+	}
+	if a := p.Approval; a != nil && head != a.Commit {
+		p.Status = "failed"
+		return p, fmt.Errorf("ansible-pull applied commit %s, not %s, which the check run checked", platform.DashIfEmpty(head), a.Commit)
+	}
+	if staged != nil && head != staged.Commit {
+		p.Status = "failed"
+		return p, fmt.Errorf("ansible-pull applied commit %s, not %s, which was checked before it; the ref moved in between", platform.DashIfEmpty(head), staged.Commit)
+	}
+	if r.cfg.AnsibleRef != "" {
+		if herr != nil {
+			p.Status = "failed"
+			return p, fmt.Errorf("cannot verify that commit %s was applied: %w", r.cfg.AnsibleRef, herr)
+		}
+		if !commitMatches(head, r.cfg.AnsibleRef) {
+			p.Status = "failed"
+			return p, fmt.Errorf("ansible-pull applied commit %s, not the pinned %s", head, r.cfg.AnsibleRef)
+		}
+		r.sys.Log("Verified that commit " + head + " was applied.")
+	}
+	p.Status = "ok"
+	return p, nil
+}
+
+// gitSSHEnv returns the environment for git to reach the ansible
+// repository over SSH with the GitHub key at keyPath, accepting a new host
+// key as ansible-pull's --accept-host-key does.
+func gitSSHEnv(keyPath string) []string {
+	return []string{"GIT_SSH_COMMAND=ssh -i " + platform.ShellQuote(keyPath) + " -o IdentitiesOnly=yes -o BatchMode=yes -o StrictHostKeyChecking=accept-new"}
+}
+
+// prepareCheckout readies the checkout in dir for --clone-depth and returns
+// the ansible-pull arguments for it, and whether it cloned the repository.
+// ansible-pull itself only clones with depth 1 (its default) or fully
+// (--full): depth 0 is passed on as --full, and for a greater depth the
+// repository is cloned here first and ansible-pull given --full, so that it
+// fetches into that clone instead of making it shallower. A pinned
+// ansible-ref that is not in a shallow checkout is fetched, deepening it
+// as far as needed.
+func (r *Runner) prepareCheckout(ctx context.Context, dir, keyPath string) ([]string, bool, error) {
+	depth := r.cfg.CloneDepth
+	if depth == 0 {
+		return []string{"--full"}, false, nil
+	}
+	env := append(os.Environ(), gitSSHEnv(keyPath)...)
+	cloned := false
+	if depth > 1 && !platform.FileExists(filepath.Join(dir, ".git")) {
+		args := []string{"clone", "--quiet", "--depth", strconv.Itoa(depth)}
+		if ref, from := r.cfg.EffectiveAnsibleRef(); ref != "" && from != "ansible-ref" {
+			args = append(args, "--branch", ref)
+		}
+		args = append(args, r.cfg.RepoURL, dir)
+		r.sys.Log(fmt.Sprintf("Cloning the ansible repository with depth %d...", depth))
+		err := r.sys.Retry(ctx, platform.NewRetryPolicy(r.cfg), "cloning the ansible repository", func() error {
+			os.RemoveAll(dir)
+			cmd := r.sys.NewCommand(ctx, "git", args...)
+			cmd.Env = env
+			if out, err := cmd.CombinedOutput(); err != nil {
+				return fmt.Errorf("git clone failed: %s", platform.LastLine(out, err))
+			}
+			return nil
+		})
+		if err != nil {
+			return nil, false, err
+		}
+		cloned = true
+	}
+	if r.cfg.AnsibleRef != "" && platform.FileExists(filepath.Join(dir, ".git")) {
+		if err := r.fetchPinnedCommit(ctx, dir, env, depth); err != nil {
+			return nil, false, err
+		}
+	}
+	if depth > 1 {
+		return []string{"--full"}, cloned, nil
+	}
+	return nil, cloned, nil
+}
+
+// fetchPinnedCommit makes sure the ansible-ref commit is in the checkout in
+// dir: fetched by its SHA, which GitHub allows for a full one, with depth,
+// or else by fetching the whole history.
+func (r *Runner) fetchPinnedCommit(ctx context.Context, dir string, env []string, depth int) error {
+	has := func() bool {
+		return r.sys.NewCommand(ctx, "git", "-C", dir, "cat-file", "-e", r.cfg.AnsibleRef+"^{commit}").Run() == nil
+	}
+	if has() {
+		return nil
+	}
+	r.sys.Log(fmt.Sprintf("Commit %s is not in the checkout at depth %d; deepening it...", r.cfg.AnsibleRef, depth))
+	git := func(args ...string) error {
+		cmd := r.sys.NewCommand(ctx, "git", append([]string{"-C", dir}, args...)...)
+		cmd.Env = env
+		if out, err := cmd.CombinedOutput(); err != nil {
+			return fmt.Errorf("git %s failed: %s", args[0], platform.LastLine(out, err))
+		}
+		return nil
+	}
+	if len(r.cfg.AnsibleRef) == 40 {
+		if git("fetch", "--quiet", "--depth", strconv.Itoa(depth), "origin", r.cfg.AnsibleRef) == nil && has() {
+			return nil
+		}
+	}
+	unshallow := "--unshallow"
+	if !platform.FileExists(filepath.Join(dir, ".git", "shallow")) {
+		unshallow = "--tags"
+	}
+	if err := r.sys.Retry(ctx, platform.NewRetryPolicy(r.cfg), "deepening the ansible checkout", func() error {
+		return git("fetch", "--quiet", unshallow, "origin")
+	}); err != nil {
+		return err
+	}
+	if !has() {
+		return fmt.Errorf("commit %s, the ansible-ref, is not in %s", r.cfg.AnsibleRef, r.cfg.RepoURL)
+	}
+	return nil
+}
+
+// CommitSHARegex matches a full or abbreviated commit SHA for ansible-ref.
+var CommitSHARegex = regexp.MustCompile(`^[0-9a-fA-F]{7,40}$`)
+
+// ansiblePullDir returns the checkout of the ansible repository that
+// ansible-pull is given as --directory: its own default, given explicitly
+// so that the commit it checked out can be read afterwards.
+func ansiblePullDir(homeDir, host string) string {
+	return filepath.Join(homeDir, ".ansible", "pull", host)
+}
+
+// checkoutHead returns the full SHA of the commit checked out in dir.
+func (r *Runner) checkoutHead(ctx context.Context, dir string) (string, error) {
+	out, err := r.sys.CmdOutput(ctx, "git", "-C", dir, "rev-parse", "HEAD")
+	if err != nil {
+		return "", fmt.Errorf("git rev-parse HEAD in %s: %w", dir, err)
+	}
+	return strings.TrimSpace(string(out)), nil
+}
+
+// commitMatches reports whether the full SHA head is the commit that sha,
+// full or abbreviated, names.
+func commitMatches(head, sha string) bool {
+	return head != "" && strings.HasPrefix(head, strings.ToLower(sha))
+}
+
+// DescribeAnsibleRef describes the ref EffectiveAnsibleRef returned, for the
+// summary and config validate.
+func DescribeAnsibleRef(ref, from string) string {
+	if ref == "" {
+		return "default branch"
+	}
+	return ref + " (" + from + ")"
+}
+
+// Runner checks out the playbook repository and runs ansible-pull.
+type Runner struct {
+	cfg      *config.Config
+	sys      *platform.System
+	secrets  *secrets.Store
+	services *service.Manager
+	keys     *sshkeys.Manager
+	github   *github.Client
+}
+
+// NewRunner returns the ansible runner of a run on sys.
+func NewRunner(sys *platform.System, secrets *secrets.Store, services *service.Manager, keys *sshkeys.Manager, github *github.Client) *Runner {
+	return &Runner{cfg: sys.Config, sys: sys, secrets: secrets, services: services, keys: keys, github: github}
+}
@@ -0,0 +1,110 @@
+package ansible
+
+import (
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/sparkleHazard/bootstrap/internal/config"
+	"github.com/sparkleHazard/bootstrap/internal/platform/platformtest"
+	"github.com/sparkleHazard/bootstrap/internal/secrets"
+	"github.com/sparkleHazard/bootstrap/internal/sshkeys"
+)
+
+func TestRunAnsiblePullArgs(t *testing.T) {
+	host, err := os.Hostname()
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		name    string
+		cfg     config.Config
+		python  string
+		doas    bool // doas is the only escalation tool on PATH
+		fail    bool // ansible-pull fails
+		want    string
+		wantErr string
+	}{
+		{
+			name: "defaults",
+			cfg:  config.Config{CloneDepth: 1},
+			want: "--directory HOME/.ansible/pull/HOST " +
+				"-U git@github.com:example/ansible.git -i localhost, --extra-vars host_role=web --extra-vars host_name=HOST " +
+				"--private-key HOME/.ssh/id_ecdsa_github --accept-host-key --submodules --vault-password-file HOME/.vault_pass ansible/site.yml",
+		},
+		{
+			name: "full clone of a branch",
+			cfg:  config.Config{CloneDepth: 0, AnsibleBranch: "staging"},
+			want: "--full --directory HOME/.ansible/pull/HOST --checkout staging " +
+				"-U git@github.com:example/ansible.git -i localhost, --extra-vars host_role=web --extra-vars host_name=HOST " +
+				"--private-key HOME/.ssh/id_ecdsa_github --accept-host-key --submodules --vault-password-file HOME/.vault_pass ansible/site.yml",
+		},
+		{
+			name:   "everything prepended",
+			cfg:    config.Config{CloneDepth: 1, OnlyIfChanged: true, Inventory: "/etc/ansible/hosts", ExtraVars: config.ExtraVars{"env": "prod east"}},
+			python: "/usr/bin/python3",
+			doas:   true,
+			want: `--become-method doas --extra-vars ansible_python_interpreter=/usr/bin/python3 --extra-vars {"env":"prod east"} --only-if-changed ` +
+				"--directory HOME/.ansible/pull/HOST " +
+				"-U git@github.com:example/ansible.git -i /etc/ansible/hosts --extra-vars host_role=web --extra-vars host_name=HOST " +
+				"--private-key HOME/.ssh/id_ecdsa_github --accept-host-key --submodules --vault-password-file HOME/.vault_pass ansible/site.yml",
+		},
+		{
+			name: "ansible-pull fails",
+			cfg:  config.Config{CloneDepth: 1},
+			fail: true,
+			want: "--directory HOME/.ansible/pull/HOST " +
+				"-U git@github.com:example/ansible.git -i localhost, --extra-vars host_role=web --extra-vars host_name=HOST " +
+				"--private-key HOME/.ssh/id_ecdsa_github --accept-host-key --submodules --vault-password-file HOME/.vault_pass ansible/site.yml",
+			wantErr: "ansible-pull failed: exit status 2",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			bin := t.TempDir()
+			t.Setenv("PATH", bin)
+			if tt.doas {
+				if err := os.WriteFile(filepath.Join(bin, "doas"), nil, 0755); err != nil {
+					t.Fatal(err)
+				}
+			}
+			cfg := tt.cfg
+			cfg.RepoURL = "git@github.com:example/ansible.git"
+			cfg.Role = "web"
+			cfg.AnsibleSite = "ansible/site.yml"
+			cfg.VaultPassFile = ".vault_pass"
+			sys, runner, _ := platformtest.NewSystem(t, &cfg)
+			sys.PythonInterpreter = tt.python
+			runner.Respond = func(cmd string) (string, error) {
+				if tt.fail && strings.HasPrefix(cmd, "ansible-pull ") {
+					return "", errors.New("exit status 2")
+				}
+				return "", nil
+			}
+			store := secrets.NewStore(sys)
+			r := NewRunner(sys, store, nil, sshkeys.NewManager(sys, store, nil), nil)
+
+			p, err := r.RunAnsiblePull(context.Background(), nil, nil)
+			if tt.wantErr == "" && err != nil || tt.wantErr != "" && (err == nil || err.Error() != tt.wantErr) {
+				t.Errorf("RunAnsiblePull = %v, want error %q", err, tt.wantErr)
+			}
+			if wantStatus := map[bool]string{false: "ok", true: "failed"}[tt.fail]; p.Status != wantStatus {
+				t.Errorf("status = %q, want %q", p.Status, wantStatus)
+			}
+			home, _ := sys.Host.HomeDir()
+			want := "ansible-pull " + strings.NewReplacer("HOME", home, "HOST", host).Replace(tt.want)
+			var pulls []string
+			for _, cmd := range runner.Commands() {
+				if strings.HasPrefix(cmd, "ansible-pull ") {
+					pulls = append(pulls, cmd)
+				}
+			}
+			if len(pulls) != 1 || pulls[0] != want {
+				t.Errorf("ran:\n  %s\nwant:\n  %s", strings.Join(pulls, "\n  "), want)
+			}
+		})
+	}
+}
@@ -0,0 +1,262 @@
+package ansible
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"os/user"
+	"path/filepath"
+	"strings"
+	"text/template"
+	"time"
+
+	"github.com/sparkleHazard/bootstrap/internal/platform"
+	"github.com/sparkleHazard/bootstrap/internal/secrets"
+)
+
+// UserRecordName is the file in the state directory recording what
+// --create-ansible-user set up, for clean.
+const UserRecordName = "ansible-user.json"
+
+// defaultAnsibleSudoers is the sudoers rule for the account, unless
+// --ansible-sudoers-template names another. ansible's become runs each task
+// as "/bin/sh -c ...", so a rule narrower than a root shell breaks it; a
+// template can narrow it for a playbook that becomes only for known
+// commands.
+const defaultAnsibleSudoers = `# Installed by bootstrap for {{.User}}, which runs the playbook.
+Defaults:{{.User}} !requiretty
+{{.User}} ALL=(root) NOPASSWD: ALL
+`
+
+// ansibleUserRecord is the content of UserRecordName.
+type ansibleUserRecord struct {
+	User      string    `json:"user"`
+	Home      string    `json:"home"`
+	Created   bool      `json:"created"` // the account did not exist before
+	Sudoers   string    `json:"sudoers"`
+	Files     []string  `json:"files"` // installed into its home
+	UpdatedAt time.Time `json:"updated_at"`
+}
+
+// ansibleSudoersPath is the sudoers drop-in for the account name.
+func ansibleSudoersPath(name string) string {
+	return "/etc/sudoers.d/bootstrap-" + name
+}
+
+// Sudoers renders the sudoers rule for name from the template file,
+// or the default one.
+func Sudoers(templateFile, name string) ([]byte, error) {
+	text := defaultAnsibleSudoers
+	if templateFile != "" {
+		data, err := os.ReadFile(templateFile)
+		if err != nil {
+			return nil, err
+		}
+		text = string(data)
+	}
+	tmpl, err := template.New(filepath.Base(templateFile)).Option("missingkey=error").Parse(text)
+	if err != nil {
+		return nil, err
+	}
+	var b bytes.Buffer
+	if err := tmpl.Execute(&b, struct{ User string }{name}); err != nil {
+		return nil, err
+	}
+	return b.Bytes(), nil
+}
+
+// EnsureAnsibleUser implements --create-ansible-user: it creates the system
+// account and its home if missing, installs the GitHub key and the vault
+// password file into the home, owned by the account, and grants it the
+// sudoers rule. Each part is left alone when it is already in place. It
+// returns the step's status: "created", "updated" or "unchanged".
+func (r *Runner) EnsureAnsibleUser(ctx context.Context, osID string) (string, error) {
+	name := string(r.cfg.CreateAnsibleUser)
+	if osID == "darwin" {
+		return "", errors.New("create-ansible-user is not supported on macOS")
+	}
+	if !r.sys.CanEscalate {
+		return "", errors.New("create-ansible-user needs root, or sudo or doas")
+	}
+	status := "unchanged"
+	rec := ansibleUserRecord{User: name, Sudoers: ansibleSudoersPath(name)}
+	if prev, err := r.ReadAnsibleUserRecord(); err == nil && prev.User == name {
+		rec.Created = prev.Created
+	}
+
+	u, err := user.Lookup(name)
+	if err != nil {
+		r.sys.Log("Creating system user " + name + "...")
+		home := "/var/lib/" + name
+		if err := r.sys.RunCmdSudo(ctx, "useradd", "--system", "--user-group", "--create-home",
+			"--home-dir", home, "--shell", "/bin/sh", "--comment", "bootstrap playbook runs", name); err != nil {
+			return "", fmt.Errorf("useradd %s failed: %w", name, err)
+		}
+		r.sys.RecordUndo("remove user "+name, func(ctx context.Context) error {
+			return r.sys.RunCmdSudo(ctx, "userdel", "--remove", name)
+		})
+		if u, err = user.Lookup(name); err != nil {
+			return "", fmt.Errorf("cannot look up user %s after creating it: %w", name, err)
+		}
+		rec.Created = true
+		status = "created"
+	}
+	rec.Home = u.HomeDir
+
+	homeDir, err := r.sys.Host.HomeDir()
+	if err != nil {
+		return "", fmt.Errorf("unable to determine home directory: %w", err)
+	}
+	keySrc, err := r.keys.GithubKeyPath(r.sys.Host)
+	if err != nil {
+		return "", err
+	}
+	// The key goes where the same --key-path puts it in the user's home.
+	keyRel, err := filepath.Rel(homeDir, keySrc)
+	if err != nil || strings.HasPrefix(keyRel, "..") {
+		keyRel = filepath.Join(".ssh", filepath.Base(keySrc))
+	}
+	keyDest := filepath.Join(u.HomeDir, keyRel)
+
+	// The home of an account that existed may be missing, as for nobody;
+	// one that exists is left as it is.
+	var dirs []string
+	for d := filepath.Dir(keyRel); d != "."; d = filepath.Dir(d) {
+		dirs = append([]string{filepath.Join(u.HomeDir, d)}, dirs...)
+	}
+	if _, err := os.Stat(u.HomeDir); errors.Is(err, os.ErrNotExist) {
+		dirs = append([]string{u.HomeDir}, dirs...)
+	}
+	if len(dirs) > 0 {
+		if err := r.sys.RunCmdSudo(ctx, "install", append([]string{"-d", "-o", u.Uid, "-g", u.Gid, "-m", "0700"}, dirs...)...); err != nil {
+			return "", fmt.Errorf("creating %s failed: %w", dirs[len(dirs)-1], err)
+		}
+		if err := r.sys.RestoreContexts(ctx, true, dirs...); err != nil {
+			return "", err
+		}
+	}
+	files := []struct {
+		src, dest string
+		mode      os.FileMode
+	}{
+		{keySrc, keyDest, 0600},
+		{keySrc + ".pub", keyDest + ".pub", 0644},
+	}
+	if src := secrets.VaultPassSource(r.cfg); src != nil {
+		r.sys.Log("The vault password is read from " + src.String() + " at run time; not installing a vault password file for " + name + ".")
+	} else {
+		files = append(files, struct {
+			src, dest string
+			mode      os.FileMode
+		}{filepath.Join(homeDir, r.cfg.VaultPassFile), filepath.Join(u.HomeDir, r.cfg.VaultPassFile), 0600})
+	}
+	for _, f := range files {
+		if !platform.FileExists(f.src) {
+			r.sys.Log("Warning: " + f.src + " does not exist; not installing it for " + name + ".")
+			continue
+		}
+		changed, err := r.installOwnedFile(ctx, f.src, f.dest, u, f.mode)
+		if err != nil {
+			return "", err
+		}
+		if changed && status == "unchanged" {
+			status = "updated"
+		}
+		rec.Files = append(rec.Files, f.dest)
+	}
+
+	rule, err := Sudoers(r.cfg.AnsibleSudoersTemplate, name)
+	if err != nil {
+		return "", fmt.Errorf("ansible-sudoers-template: %w", err)
+	}
+	sudoers := r.sys.Host.Path(rec.Sudoers)
+	existed := platform.FileExists(sudoers)
+	changed, err := r.installSudoers(ctx, sudoers, rule)
+	if err != nil {
+		return "", err
+	}
+	if changed {
+		if status == "unchanged" {
+			status = "updated"
+		}
+		if !existed {
+			r.sys.RecordUndo("remove "+rec.Sudoers, func(ctx context.Context) error {
+				return r.sys.RunCmdSudo(ctx, "rm", "-f", sudoers)
+			})
+		}
+	}
+
+	rec.UpdatedAt = time.Now()
+	if err := r.writeAnsibleUserRecord(ctx, &rec); err != nil {
+		return "", err
+	}
+	if status != "unchanged" {
+		r.sys.Log("System user " + name + " is set up to run the playbook.")
+	}
+	return status, nil
+}
+
+// installOwnedFile copies src to dest, owned by u with mode, unless dest
+// already has that content. It reports whether it copied.
+func (r *Runner) installOwnedFile(ctx context.Context, src, dest string, u *user.User, mode os.FileMode) (bool, error) {
+	data, err := os.ReadFile(src)
+	if err != nil {
+		return false, err
+	}
+	return r.sys.WriteFile(ctx, dest, data, mode, u.Uid+":"+u.Gid)
+}
+
+// installSudoers installs the sudoers drop-in at dest after visudo has
+// accepted it, since a broken drop-in disables sudo for everyone.
+func (r *Runner) installSudoers(ctx context.Context, dest string, rule []byte) (bool, error) {
+	dir, err := r.sys.RunWorkDir()
+	if err != nil {
+		return false, err
+	}
+	tmp := filepath.Join(dir, filepath.Base(dest))
+	if _, err := r.sys.WriteFile(ctx, tmp, rule, 0600, ""); err != nil {
+		return false, err
+	}
+	defer os.Remove(tmp)
+	if err := r.sys.RunCmdSudo(ctx, "visudo", "-c", "-q", "-f", tmp); err != nil {
+		return false, fmt.Errorf("visudo rejected the sudoers rule for %s: %w", dest, err)
+	}
+	return r.sys.WriteFile(ctx, dest, rule, 0440, platform.RootOwner)
+}
+
+// ReadAnsibleUserRecord reads what --create-ansible-user last set up.
+func (r *Runner) ReadAnsibleUserRecord() (*ansibleUserRecord, error) {
+	dir, err := r.sys.StateDir()
+	if err != nil {
+		return nil, err
+	}
+	data, err := os.ReadFile(filepath.Join(dir, UserRecordName))
+	if err != nil {
+		return nil, err
+	}
+	var rec ansibleUserRecord
+	if err := json.Unmarshal(data, &rec); err != nil {
+		return nil, err
+	}
+	return &rec, nil
+}
+
+// writeAnsibleUserRecord records rec in the state directory.
+func (r *Runner) writeAnsibleUserRecord(ctx context.Context, rec *ansibleUserRecord) error {
+	dir, err := r.sys.StateDir()
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return err
+	}
+	data, err := json.MarshalIndent(rec, "", "  ")
+	if err != nil {
+		return err
+	}
+	_, err = r.sys.WriteFile(ctx, filepath.Join(dir, UserRecordName), append(data, '\n'), 0644, "")
+	return err
+}
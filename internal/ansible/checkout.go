@@ -0,0 +1,136 @@
+package ansible
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"github.com/sparkleHazard/bootstrap/internal/platform"
+)
+
+// StagedCheckout is the ansible repository, checked out at the ref to
+// apply in the run's work directory before ansible-pull runs, for the steps
+// that inspect what it is about to apply: --require-signed-tag,
+// --syntax-check-first and an --inventory within it.
+type StagedCheckout struct {
+	dir string
+	// Commit is the full SHA checked out, which ansible-pull must then
+	// apply too.
+	Commit string
+}
+
+// StageCheckout clones the ansible repository at the ref EffectiveAnsibleRef
+// returns, with --clone-depth, into the run's work directory, with its
+// submodules.
+func (r *Runner) StageCheckout(ctx context.Context) (*StagedCheckout, error) {
+	work, err := r.sys.RunWorkDir()
+	if err != nil {
+		return nil, err
+	}
+	keyPath, err := r.keys.GithubKeyPath(r.sys.Host)
+	if err != nil {
+		return nil, err
+	}
+	env := append(os.Environ(), gitSSHEnv(keyPath)...)
+	dir := filepath.Join(work, "ansible-checkout")
+
+	args := []string{"clone", "--quiet"}
+	if r.cfg.CloneDepth > 0 {
+		args = append(args, "--depth", strconv.Itoa(r.cfg.CloneDepth))
+	}
+	ref, from := r.cfg.EffectiveAnsibleRef()
+	if ref != "" && from != "ansible-ref" {
+		args = append(args, "--branch", ref)
+	}
+	args = append(args, r.cfg.RepoURL, dir)
+	r.sys.Log("Fetching the ansible repository at " + DescribeAnsibleRef(ref, from) + "...")
+	err = r.sys.Retry(ctx, platform.NewRetryPolicy(r.cfg), "fetching the ansible repository", func() error {
+		os.RemoveAll(dir)
+		cmd := r.sys.NewCommand(ctx, "git", args...)
+		cmd.Env = env
+		if out, err := cmd.CombinedOutput(); err != nil {
+			return fmt.Errorf("git clone failed: %s", platform.LastLine(out, err))
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	git := func(args ...string) error {
+		cmd := r.sys.NewCommand(ctx, "git", append([]string{"-C", dir}, args...)...)
+		cmd.Env = env
+		if out, err := cmd.CombinedOutput(); err != nil {
+			return fmt.Errorf("git %s failed: %s", args[0], platform.LastLine(out, err))
+		}
+		return nil
+	}
+	if r.cfg.AnsibleRef != "" {
+		if err := r.fetchPinnedCommit(ctx, dir, env, r.cfg.CloneDepth); err != nil {
+			return nil, err
+		}
+		if err := git("checkout", "--quiet", "--detach", r.cfg.AnsibleRef); err != nil {
+			return nil, err
+		}
+	}
+	if err := git("submodule", "update", "--quiet", "--init", "--recursive"); err != nil {
+		return nil, err
+	}
+	commit, err := r.checkoutHead(ctx, dir)
+	if err != nil {
+		return nil, err
+	}
+	return &StagedCheckout{dir: dir, Commit: commit}, nil
+}
+
+// SyntaxCheck implements --syntax-check-first: ansible-playbook
+// --syntax-check of the playbook in co, with the inventory and variables
+// ansible-pull gives it, and, with --verbose, its --list-tasks. It returns
+// the parse error, if any, with ansible-playbook's output.
+func (r *Runner) SyntaxCheck(ctx context.Context, co *StagedCheckout) error {
+	homeDir, err := r.sys.Host.HomeDir()
+	if err != nil {
+		return err
+	}
+	vaultPath, cleanup, err := r.secrets.VaultPasswordFile(ctx, homeDir)
+	if err != nil {
+		return err
+	}
+	defer cleanup()
+	inventory, err := r.inventoryArg(ctx)
+	if err != nil {
+		return err
+	}
+	host, _ := os.Hostname()
+	args := []string{
+		"-i", inventory,
+		"--extra-vars", "host_role=" + r.cfg.Role,
+		"--extra-vars", "host_name=" + host,
+		"--vault-password-file", vaultPath,
+		filepath.Join(co.dir, r.cfg.AnsibleSite),
+	}
+	// Run from the checkout, as ansible-pull does, for its ansible.cfg.
+	check := func(mode string) ([]byte, error) {
+		cmd := r.sys.NewCommand(ctx, "ansible-playbook", append([]string{mode}, args...)...)
+		cmd.Dir = co.dir
+		return cmd.CombinedOutput()
+	}
+	r.sys.Log("Checking the syntax of " + r.cfg.AnsibleSite + "...")
+	if out, err := check("--syntax-check"); err != nil {
+		msg := strings.TrimSpace(string(out))
+		if msg == "" {
+			msg = err.Error()
+		}
+		return errors.New("the playbook's syntax check failed:\n" + msg)
+	}
+	if r.cfg.Verbose {
+		if out, err := check("--list-tasks"); err == nil {
+			r.sys.Log("Tasks of " + r.cfg.AnsibleSite + ":\n" + strings.TrimRight(string(out), "\n"))
+		}
+	}
+	return nil
+}
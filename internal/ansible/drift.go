@@ -0,0 +1,74 @@
+package ansible
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/sparkleHazard/bootstrap/internal/platform"
+)
+
+// ErrDrift is returned by a --detect-drift run whose check run found
+// changes the playbook would make; it exits with platform.ExitDrift.
+var ErrDrift = errors.New("the host has drifted from the playbook")
+
+// DriftReport is the outcome of --detect-drift's check run, recorded in the
+// result.
+type DriftReport struct {
+	// Pending is whether the check run found changes to make.
+	Pending bool `json:"pending"`
+	// Recap and ChangedTasks are the check run's PLAY RECAP and the names
+	// of the tasks it reported as changed.
+	Recap        *Recap   `json:"recap,omitempty"`
+	ChangedTasks []string `json:"changed_tasks,omitempty"`
+}
+
+// Summary describes the pending changes in one line, for notifications.
+func (d *DriftReport) Summary() string {
+	if d == nil || !d.Pending {
+		return ""
+	}
+	s := fmt.Sprintf("%d task(s) would change", d.Recap.Changed)
+	if len(d.ChangedTasks) > 0 {
+		s += ": " + strings.Join(d.ChangedTasks, ", ")
+	}
+	return s
+}
+
+// detectDrift implements --detect-drift: it runs ansible-pull with args in
+// check mode with diffs and returns what would change. It fails with
+// ErrDrift, exiting with platform.ExitDrift, when there are changes pending, and as
+// any run would when the check run itself fails.
+func (r *Runner) detectDrift(ctx context.Context, args []string) (*DriftReport, error) {
+	r.sys.Log("Running the playbook in check mode to detect drift (--detect-drift)...")
+	recap, changed, err := r.checkRun(ctx, args)
+	d := &DriftReport{Recap: recap, ChangedTasks: changed}
+	if err != nil {
+		return d, fmt.Errorf("the check run failed: %w", err)
+	}
+	// A check run that reports nothing has not shown that nothing drifted.
+	if recap == nil {
+		return d, errors.New("the check run printed no PLAY RECAP; cannot tell whether the host drifted")
+	}
+	if recap.Changed == 0 {
+		r.sys.Log("No drift: the playbook has nothing to change.")
+		return d, nil
+	}
+	d.Pending = true
+	r.sys.Log(changeDigest(recap, changed))
+	return d, platform.WithExitCode(platform.ExitDrift, fmt.Errorf("%w: %s", ErrDrift, d.Summary()))
+}
+
+// CheckExistingKey makes sure the GitHub key a drift check uses is in
+// place: --detect-drift never fetches, generates or rotates it.
+func (r *Runner) CheckExistingKey() error {
+	keyPath, err := r.keys.GithubKeyPath(r.sys.Host)
+	if err != nil {
+		return err
+	}
+	if !platform.FileExists(keyPath) {
+		return fmt.Errorf("--detect-drift uses the GitHub key already on the host, and there is none at %s; bootstrap the host first", keyPath)
+	}
+	return nil
+}
@@ -0,0 +1,79 @@
+package ansible
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+
+	"github.com/sparkleHazard/bootstrap/internal/config"
+)
+
+// defaultInventory is the inventory the playbook runs with unless
+// --inventory or --generate-inventory says otherwise: localhost, in no
+// group.
+const defaultInventory = "localhost,"
+
+// generatedInventoryName is the file in the run's work directory that
+// --generate-inventory writes.
+const generatedInventoryName = "inventory.ini"
+
+// invalidGroupChars are the characters ansible does not accept in a group
+// name, which a role's group has replaced with '_'.
+var invalidGroupChars = regexp.MustCompile(`[^A-Za-z0-9_]`)
+
+// roleGroup returns the group --generate-inventory puts localhost into for
+// role: its name, with the characters ansible does not allow replaced.
+func roleGroup(role string) string {
+	return invalidGroupChars.ReplaceAllString(role, "_")
+}
+
+// inventoryArg returns the inventory to give the playbook with -i: the
+// --inventory host list or path, which ansible-pull resolves in its
+// checkout, an inventory written with --generate-inventory, or
+// defaultInventory.
+func (r *Runner) inventoryArg(ctx context.Context) (string, error) {
+	switch {
+	case r.cfg.Inventory != "":
+		return r.cfg.Inventory, nil
+	case r.cfg.GenerateInventory:
+		return r.writeGeneratedInventory(ctx)
+	}
+	return defaultInventory, nil
+}
+
+// writeGeneratedInventory writes an INI inventory with localhost, run
+// locally, in the group of the role to the run's work directory, and
+// returns its path.
+func (r *Runner) writeGeneratedInventory(ctx context.Context) (string, error) {
+	work, err := r.sys.RunWorkDir()
+	if err != nil {
+		return "", err
+	}
+	var b strings.Builder
+	b.WriteString("# Generated by bootstrap --generate-inventory for role " + r.cfg.Role + ".\n")
+	fmt.Fprintf(&b, "[%s]\nlocalhost ansible_connection=local\n", roleGroup(r.cfg.Role))
+	path := filepath.Join(work, generatedInventoryName)
+	if _, err := r.sys.WriteFile(ctx, path, []byte(b.String()), 0644, ""); err != nil {
+		return "", err
+	}
+	return path, nil
+}
+
+// CheckInventory makes sure the --inventory path exists: within the staged
+// checkout co for a path in the repository, or on the host for an absolute
+// one.
+func (r *Runner) CheckInventory(co *StagedCheckout) error {
+	if p := r.cfg.RepoInventory(); p != "" {
+		if _, err := os.Stat(filepath.Join(co.dir, p)); err != nil {
+			return fmt.Errorf("inventory %s does not exist in %s at commit %s", r.cfg.Inventory, r.cfg.RepoURL, co.Commit)
+		}
+		return nil
+	}
+	if _, err := os.Stat(r.cfg.Inventory); err != nil && !config.InlineInventory(r.cfg.Inventory) {
+		return fmt.Errorf("inventory %s does not exist", r.cfg.Inventory)
+	}
+	return nil
+}
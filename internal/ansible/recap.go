@@ -0,0 +1,97 @@
+package ansible
+
+import (
+	"bufio"
+	"bytes"
+	"regexp"
+	"slices"
+	"strconv"
+	"strings"
+)
+
+// ansibleOutputMax is how much of ansible-pull's output is kept to find the
+// PLAY RECAP in, which comes at the very end.
+const ansibleOutputMax = 64 * 1024
+
+// Recap is the PLAY RECAP of a playbook run, summed over its hosts
+// (for ansible-pull, normally just localhost).
+type Recap struct {
+	Ok          int `json:"ok"`
+	Changed     int `json:"changed"`
+	Unreachable int `json:"unreachable"`
+	Failed      int `json:"failed"`
+	Skipped     int `json:"skipped"`
+	Rescued     int `json:"rescued"`
+	Ignored     int `json:"ignored"`
+}
+
+// recapCountRegex matches one "name=count" field of a PLAY RECAP host line.
+var recapCountRegex = regexp.MustCompile(`\b([a-z]+)=(\d+)`)
+
+// parseAnsibleRecap returns the recap in the ansible-playbook output out,
+// or nil if out has none. Should out hold several, the last one counts.
+func parseAnsibleRecap(out []byte) *Recap {
+	var recap *Recap
+	inRecap := false
+	scanner := bufio.NewScanner(bytes.NewReader(out))
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if strings.HasPrefix(line, "PLAY RECAP") {
+			recap, inRecap = &Recap{}, true
+			continue
+		}
+		if !inRecap {
+			continue
+		}
+		// host : ok=3 changed=1 unreachable=0 failed=0 ...
+		_, counts, ok := strings.Cut(line, " : ")
+		if !ok {
+			// The recap ends at the first line that is not a host's.
+			inRecap = line == ""
+			continue
+		}
+		for _, m := range recapCountRegex.FindAllStringSubmatch(counts, -1) {
+			n, _ := strconv.Atoi(m[2])
+			switch m[1] {
+			case "ok":
+				recap.Ok += n
+			case "changed":
+				recap.Changed += n
+			case "unreachable":
+				recap.Unreachable += n
+			case "failed":
+				recap.Failed += n
+			case "skipped":
+				recap.Skipped += n
+			case "rescued":
+				recap.Rescued += n
+			case "ignored":
+				recap.Ignored += n
+			}
+		}
+	}
+	return recap
+}
+
+// taskHeaderRegex matches the header ansible-playbook prints before each
+// task or handler: "TASK [role : name] ***".
+var taskHeaderRegex = regexp.MustCompile(`^(?:TASK|RUNNING HANDLER) \[(.*)\]`)
+
+// changedTasks returns the names of the tasks the ansible-playbook output
+// out reports as changed, in order and each once.
+func changedTasks(out []byte) []string {
+	var tasks []string
+	current := ""
+	scanner := bufio.NewScanner(bytes.NewReader(out))
+	for scanner.Scan() {
+		line := scanner.Text()
+		if m := taskHeaderRegex.FindStringSubmatch(line); m != nil {
+			current = m[1]
+			continue
+		}
+		if strings.HasPrefix(line, "changed: [") && current != "" && !slices.Contains(tasks, current) {
+			tasks = append(tasks, current)
+		}
+	}
+	return tasks
+}
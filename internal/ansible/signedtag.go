@@ -0,0 +1,102 @@
+package ansible
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+
+	"github.com/sparkleHazard/bootstrap/internal/platform"
+)
+
+// ErrSignature is wrapped by the error --require-signed-tag fails the run
+// with when the ref to apply is unsigned, or its signature does not verify
+// against the trusted signers.
+var ErrSignature = errors.New("signature verification failed")
+
+// SignatureInfo records the signature --require-signed-tag verified.
+type SignatureInfo struct {
+	// Ref is the tag or commit verified, and Kind "tag" or "commit".
+	Ref  string `json:"ref"`
+	Kind string `json:"kind"`
+	// Signer is who signed it, as git reported: the principal from the
+	// allowed signers file, or the GPG user ID.
+	Signer string `json:"signer"`
+	// Commit is the full SHA of the commit the ref resolved to, which
+	// ansible-pull must then apply.
+	Commit string `json:"commit"`
+}
+
+// Patterns for the signer in git verify-tag's and verify-commit's output,
+// for SSH and GPG signatures.
+var (
+	sshSignerRegex = regexp.MustCompile(`Good "git" signature for (.+?) with`)
+	gpgSignerRegex = regexp.MustCompile(`Good signature from "([^"]+)"`)
+)
+
+// VerifySignedRef implements --require-signed-tag. It verifies the
+// signature of the ref to apply in the staged checkout co: the tag
+// ansible-branch or role-branch names, or the commit ansible-ref pins,
+// against the allowed-signers file or the gpg-keyring.
+func (r *Runner) VerifySignedRef(ctx context.Context, co *StagedCheckout) (*SignatureInfo, error) {
+	ref, _ := r.cfg.EffectiveAnsibleRef()
+	info := &SignatureInfo{Ref: ref, Kind: "tag"}
+	if r.cfg.AnsibleRef != "" {
+		info.Kind = "commit"
+	}
+	dir := co.dir
+	var env []string
+	args := []string{"-C", dir}
+	if r.cfg.AllowedSignersFile != "" {
+		args = append(args, "-c", "gpg.ssh.allowedSignersFile="+r.cfg.AllowedSignersFile)
+	} else {
+		// The keyring is imported into a GnuPG home of its own, so that only
+		// its keys are trusted.
+		work, err := r.sys.RunWorkDir()
+		if err != nil {
+			return nil, err
+		}
+		home := filepath.Join(work, "gnupg")
+		if err := os.MkdirAll(home, 0700); err != nil {
+			return nil, err
+		}
+		env = []string{"GNUPGHOME=" + home}
+		cmd := r.sys.NewCommand(ctx, "gpg", "--batch", "--quiet", "--import", r.cfg.GPGKeyring)
+		cmd.Env = append(os.Environ(), env...)
+		if out, err := cmd.CombinedOutput(); err != nil {
+			return nil, fmt.Errorf("importing gpg-keyring %s failed: %s", r.cfg.GPGKeyring, platform.LastLine(out, err))
+		}
+	}
+	target := ref
+	if info.Kind == "tag" {
+		target = "refs/tags/" + ref
+		cmd := r.sys.NewCommand(ctx, "git", "-C", dir, "cat-file", "-t", target)
+		if out, err := cmd.Output(); err != nil {
+			return nil, fmt.Errorf("%w: %s is not a tag of %s", ErrSignature, ref, r.cfg.RepoURL)
+		} else if strings.TrimSpace(string(out)) != "tag" {
+			return nil, fmt.Errorf("%w: tag %s is a lightweight tag, which cannot be signed", ErrSignature, ref)
+		}
+	}
+	cmd := r.sys.NewCommand(ctx, "git", append(args, "verify-"+info.Kind, target)...)
+	cmd.Env = append(os.Environ(), env...)
+	out, err := cmd.CombinedOutput()
+	if err != nil {
+		return nil, fmt.Errorf("%w: %s %s: %s", ErrSignature, info.Kind, ref, platform.LastLine(out, err))
+	}
+	for _, re := range []*regexp.Regexp{sshSignerRegex, gpgSignerRegex} {
+		if m := re.FindSubmatch(out); m != nil {
+			info.Signer = string(m[1])
+			break
+		}
+	}
+	commit, err := r.sys.CmdOutput(ctx, "git", "-C", dir, "rev-parse", target+"^{commit}")
+	if err != nil {
+		return nil, fmt.Errorf("resolving %s %s: %w", info.Kind, ref, err)
+	}
+	info.Commit = strings.TrimSpace(string(commit))
+	r.sys.Log(fmt.Sprintf("Verified the signature of %s %s (commit %s) by %s.", info.Kind, ref, info.Commit, platform.DashIfEmpty(info.Signer)))
+	return info, nil
+}
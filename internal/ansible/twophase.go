@@ -0,0 +1,136 @@
+package ansible
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/sparkleHazard/bootstrap/internal/platform"
+)
+
+// ErrDeclined is returned when the changes the check run of --two-phase
+// found were not approved.
+var ErrDeclined = errors.New("the playbook's pending changes were declined")
+
+// checkOutputMax is how much of the check run's output --two-phase keeps to
+// find the changed tasks in, which are spread over all of it.
+const checkOutputMax = 1 << 20
+
+// Approval is the outcome of --two-phase's check run and the decision on
+// it, recorded in the result.
+type Approval struct {
+	// Decision is "approved", "declined" or "nothing-to-do".
+	Decision string `json:"decision"`
+	// By is who decided: "user NAME" on the terminal, or "--auto-approve".
+	By string `json:"by,omitempty"`
+	// Recap and ChangedTasks are the check run's PLAY RECAP and the names
+	// of the tasks it reported as changed.
+	Recap        *Recap   `json:"recap,omitempty"`
+	ChangedTasks []string `json:"changed_tasks,omitempty"`
+	// Commit is the commit of the ansible repository the check run
+	// checked, which the real run is pinned to.
+	Commit string `json:"commit,omitempty"`
+}
+
+// checkThenConfirm implements --two-phase: it runs ansible-pull with args in
+// check mode with diffs, logs a digest of what would change and asks for
+// approval, unless --auto-approve gives it. It reports whether to go on
+// with the real run, which is not needed when nothing would change, and
+// returns the check run and the decision on it, whether or not it fails. The
+// commit checked out in checkout by the check run is its Commit, for the
+// real run to apply exactly that.
+func (r *Runner) checkThenConfirm(ctx context.Context, args []string, checkout string) (*Approval, bool, error) {
+	r.sys.Log("Running the playbook in check mode first (--two-phase)...")
+	recap, changed, err := r.checkRun(ctx, args)
+	a := &Approval{Recap: recap, ChangedTasks: changed}
+	if err != nil {
+		return a, false, fmt.Errorf("the check run failed: %w", err)
+	}
+	if a.Commit, err = r.checkoutHead(ctx, checkout); err != nil {
+		return a, false, fmt.Errorf("cannot tell which commit the check run checked: %w", err)
+	}
+	if a.Recap == nil || a.Recap.Changed == 0 {
+		r.sys.Log("The check run found nothing to change.")
+		a.Decision = "nothing-to-do"
+		return a, false, nil
+	}
+
+	r.sys.Log(changeDigest(a.Recap, a.ChangedTasks))
+	r.sys.Log("Checked commit " + a.Commit + " of the ansible repository.")
+
+	switch {
+	case r.cfg.AutoApprove:
+		a.Decision, a.By = "approved", "--auto-approve"
+		r.sys.Log("Applying them (--auto-approve).")
+	case !platform.StdinIsTerminal():
+		a.Decision = "declined"
+		return a, false, fmt.Errorf("%w: not on a terminal to confirm them; pass --auto-approve", ErrDeclined)
+	default:
+		a.By = "user " + platform.DashIfEmpty(r.invokingName())
+		if !r.confirmApply() {
+			a.Decision = "declined"
+			return a, false, ErrDeclined
+		}
+		a.Decision = "approved"
+	}
+	r.sys.Log(fmt.Sprintf("Changes %s by %s.", a.Decision, a.By))
+	return a, true, nil
+}
+
+// checkRun runs ansible-pull with args in check mode with diffs, its output
+// going to the log like the real run's, and returns the PLAY RECAP, if it
+// got that far, and the names of the tasks reported as changed.
+func (r *Runner) checkRun(ctx context.Context, args []string) (*Recap, []string, error) {
+	out := &platform.TailBuffer{Max: checkOutputMax}
+	err := r.sys.RunCmdTee(ctx, out, "ansible-pull", append([]string{"--check", "--diff"}, args...)...)
+	return parseAnsibleRecap(out.Bytes()), changedTasks(out.Bytes()), err
+}
+
+// approvedRunArgs returns the ansible-pull args for the real run after an
+// approved check run of commit: --checkout is set to commit, replacing any
+// --checkout they have, and --only-if-changed is dropped, since the check
+// run has already pulled the change the real run is there to apply.
+func approvedRunArgs(args []string, commit string) []string {
+	out := []string{"--checkout", commit}
+	for i := 0; i < len(args); i++ {
+		switch args[i] {
+		case "--checkout":
+			i++
+		case "--only-if-changed":
+		default:
+			out = append(out, args[i])
+		}
+	}
+	return out
+}
+
+// changeDigest describes the changes a check run found: how many tasks
+// would change, and which.
+func changeDigest(recap *Recap, tasks []string) string {
+	var b strings.Builder
+	fmt.Fprintf(&b, "The check run would change %d task(s):", recap.Changed)
+	for _, t := range tasks {
+		b.WriteString("\n  " + t)
+	}
+	return b.String()
+}
+
+// invokingName returns the name of the user running bootstrap, through
+// sudo or doas or not.
+func (r *Runner) invokingName() string {
+	if u, err := r.sys.TargetUser(); err == nil {
+		return u.Username
+	}
+	return ""
+}
+
+// confirmApply asks on the terminal whether to apply the pending changes.
+func (r *Runner) confirmApply() bool {
+	fmt.Fprint(r.sys.ConsoleStdout, "Apply these changes? [y/N] ")
+	line, _ := bufio.NewReader(os.Stdin).ReadString('\n')
+	a := strings.ToLower(strings.TrimSpace(line))
+	return a == "y" || a == "yes"
+}
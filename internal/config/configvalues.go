@@ -0,0 +1,650 @@
+package config
+
+import (
+	"errors"
+	"fmt"
+	"maps"
+	"net"
+	"net/netip"
+	"net/url"
+	"path/filepath"
+	"regexp"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"filippo.io/age"
+)
+
+// ageRecipients is a repeatable flag.Value collecting --age-recipient
+// public keys. An entry may list several, comma-separated.
+type ageRecipients []string
+
+func (a *ageRecipients) Set(s string) error {
+	for _, part := range strings.Split(s, ",") {
+		part = strings.TrimSpace(part)
+		if part == "" {
+			continue
+		}
+		if _, err := age.ParseX25519Recipient(part); err != nil {
+			return fmt.Errorf("%q is not an age recipient (age1...): %w", part, err)
+		}
+		*a = append(*a, part)
+	}
+	return nil
+}
+
+func (a *ageRecipients) String() string {
+	if a == nil {
+		return ""
+	}
+	return strings.Join(*a, ",")
+}
+
+// ansibleUser is the value of --create-ansible-user. As a bare flag it
+// names DefaultAnsibleUser; given a name, that account.
+type ansibleUser string
+
+func (a *ansibleUser) IsBoolFlag() bool { return true }
+
+func (a *ansibleUser) Set(v string) error {
+	if v == "" {
+		*a = ""
+		return nil
+	}
+	if b, err := strconv.ParseBool(v); err == nil {
+		*a = ""
+		if b {
+			*a = DefaultAnsibleUser
+		}
+		return nil
+	}
+	if !ansibleUserRegex.MatchString(v) {
+		return fmt.Errorf("%q is not a valid user name", v)
+	}
+	*a = ansibleUser(v)
+	return nil
+}
+
+func (a *ansibleUser) String() string {
+	if a == nil {
+		return ""
+	}
+	return string(*a)
+}
+
+// byteSize is a flag.Value holding a size in bytes. It accepts plain byte
+// counts and binary (KiB, MiB, GiB, TiB) or decimal (KB, MB, GB, TB) suffixes;
+// a bare K, M, G or T is binary.
+type byteSize uint64
+
+func (b *byteSize) Set(s string) error {
+	s = strings.TrimSpace(s)
+	mult := uint64(1)
+	for _, u := range byteSizeUnits {
+		if strings.HasSuffix(strings.ToUpper(s), strings.ToUpper(u.suffix)) {
+			s = strings.TrimSpace(s[:len(s)-len(u.suffix)])
+			mult = u.mult
+			break
+		}
+	}
+	n, err := strconv.ParseFloat(s, 64)
+	if err != nil || n < 0 {
+		return fmt.Errorf("invalid size %q", s)
+	}
+	*b = byteSize(n * float64(mult))
+	return nil
+}
+
+func (b *byteSize) String() string {
+	if b == nil {
+		return "0"
+	}
+	return FormatBytes(uint64(*b))
+}
+
+// caCertSources is a repeatable flag.Value collecting --ca-cert entries,
+// "PATH" or "URL[#sha256=DIGEST]". A plain http URL must carry the digest.
+type caCertSources []CACertSource
+
+func (c *caCertSources) Set(s string) error {
+	s = strings.TrimSpace(s)
+	src := CACertSource{Src: s}
+	if u, digest, ok := strings.Cut(s, "#sha256="); ok {
+		if !SHA256Regex.MatchString(digest) {
+			return fmt.Errorf("%q: sha256 must be a hex SHA-256 digest", s)
+		}
+		src = CACertSource{Src: u, SHA256: strings.ToLower(digest)}
+	}
+	switch {
+	case src.IsURL():
+		if u, err := url.Parse(src.Src); err != nil || u.Host == "" {
+			return fmt.Errorf("%q is not a valid URL", src.Src)
+		}
+		if strings.HasPrefix(src.Src, "http://") && src.SHA256 == "" {
+			return fmt.Errorf("%q: an http URL needs #sha256=DIGEST", src.Src)
+		}
+	case !filepath.IsAbs(src.Src):
+		return fmt.Errorf("%q is neither an absolute path nor an http(s) URL", src.Src)
+	}
+	*c = append(*c, src)
+	return nil
+}
+
+func (c *caCertSources) String() string {
+	if c == nil {
+		return ""
+	}
+	return strings.Join(c.Entries(), ", ")
+}
+
+// Entries returns each entry as the flag was given it.
+func (c *caCertSources) Entries() []string {
+	var out []string
+	for _, s := range *c {
+		out = append(out, s.String())
+	}
+	return out
+}
+
+// CIDRList is a repeatable flag.Value collecting --allow-cidr prefixes. An
+// entry may list several, comma-separated, and a bare address stands for
+// just that address.
+type CIDRList []netip.Prefix
+
+func (l *CIDRList) Set(s string) error {
+	for _, part := range strings.Split(s, ",") {
+		part = strings.TrimSpace(part)
+		if part == "" {
+			continue
+		}
+		if !strings.Contains(part, "/") {
+			addr, err := netip.ParseAddr(part)
+			if err != nil {
+				return fmt.Errorf("%q is not an address or CIDR prefix", part)
+			}
+			*l = append(*l, netip.PrefixFrom(addr, addr.BitLen()))
+			continue
+		}
+		prefix, err := netip.ParsePrefix(part)
+		if err != nil {
+			return fmt.Errorf("%q is not an address or CIDR prefix", part)
+		}
+		*l = append(*l, prefix.Masked())
+	}
+	return nil
+}
+
+func (l *CIDRList) String() string {
+	if l == nil {
+		return ""
+	}
+	parts := make([]string, len(*l))
+	for i, p := range *l {
+		parts[i] = p.String()
+	}
+	return strings.Join(parts, ",")
+}
+
+// Allows reports whether addr is in the list. An empty list allows every
+// address.
+func (l CIDRList) Allows(addr netip.Addr) bool {
+	if len(l) == 0 {
+		return true
+	}
+	addr = addr.Unmap()
+	for _, p := range l {
+		if p.Contains(addr) {
+			return true
+		}
+	}
+	return false
+}
+
+// driftTimer is the value of --enable-drift-timer. As a bare flag it is
+// DefaultDriftSchedule; given a value, that systemd calendar event.
+type driftTimer string
+
+func (d *driftTimer) IsBoolFlag() bool { return true }
+
+func (d *driftTimer) Set(v string) error {
+	if v == "" {
+		*d = ""
+		return nil
+	}
+	if b, err := strconv.ParseBool(v); err == nil {
+		*d = ""
+		if b {
+			*d = DefaultDriftSchedule
+		}
+		return nil
+	}
+	if strings.TrimSpace(v) == "" || strings.ContainsAny(v, "\n\r") {
+		return fmt.Errorf("%q is not a systemd calendar event", v)
+	}
+	*d = driftTimer(strings.TrimSpace(v))
+	return nil
+}
+
+func (d *driftTimer) String() string {
+	if d == nil {
+		return ""
+	}
+	return string(*d)
+}
+
+// ExtraPrereqs is a repeatable flag.Value collecting --extra-prereq
+// entries, "PKG[,KEY=NAME...]" with KEY an OS ID or package manager.
+type ExtraPrereqs []ExtraPrereq
+
+func (e *ExtraPrereqs) Set(s string) error {
+	fields := strings.Split(strings.TrimSpace(s), ",")
+	p := ExtraPrereq{Name: strings.TrimSpace(fields[0]), Names: map[string]string{}}
+	if p.Name == "" {
+		return errors.New("empty package name")
+	}
+	if !packageNameRegex.MatchString(p.Name) {
+		return fmt.Errorf("%q is not a package name", p.Name)
+	}
+	for _, f := range fields[1:] {
+		k, v, ok := strings.Cut(strings.TrimSpace(f), "=")
+		if !ok || k == "" {
+			return fmt.Errorf("%q is not KEY=NAME", f)
+		}
+		if v != "-" && !packageNameRegex.MatchString(v) {
+			return fmt.Errorf("%q is not a package name", v)
+		}
+		p.Names[k] = v
+	}
+	*e = append(*e, p)
+	return nil
+}
+
+func (e *ExtraPrereqs) String() string {
+	if e == nil {
+		return ""
+	}
+	var parts []string
+	for _, p := range *e {
+		parts = append(parts, p.String())
+	}
+	return strings.Join(parts, "; ")
+}
+
+// Entries returns each entry as the flag was given it.
+func (e *ExtraPrereqs) Entries() []string {
+	var out []string
+	for _, p := range *e {
+		out = append(out, p.String())
+	}
+	return out
+}
+
+// roleBranches is a repeatable flag.Value collecting --role-branch
+// entries, "ROLE=REF", each the ref of the ansible repository ROLE checks
+// out.
+type roleBranches map[string]string
+
+func (r *roleBranches) Set(s string) error {
+	role, ref, ok := strings.Cut(strings.TrimSpace(s), "=")
+	role, ref = strings.TrimSpace(role), strings.TrimSpace(ref)
+	if !ok || !RoleNameRegex.MatchString(role) {
+		return errors.New(`must be "ROLE=REF"`)
+	}
+	if !ValidGitRef(ref) {
+		return fmt.Errorf("%s: %q is not a git ref", role, ref)
+	}
+	if *r == nil {
+		*r = roleBranches{}
+	}
+	(*r)[role] = ref
+	return nil
+}
+
+func (r *roleBranches) String() string {
+	if r == nil {
+		return ""
+	}
+	return strings.Join(r.Entries(), ", ")
+}
+
+// Entries returns each role's entry as the flag was given it.
+func (r *roleBranches) Entries() []string {
+	var out []string
+	for _, role := range slices.Sorted(maps.Keys(*r)) {
+		out = append(out, role+"="+(*r)[role])
+	}
+	return out
+}
+
+// ExtraVars is a repeatable flag.Value collecting --extra-var entries,
+// "NAME=VALUE", each a variable the playbook gets as a string. A later
+// entry for a name replaces an earlier one.
+type ExtraVars map[string]string
+
+func (e *ExtraVars) Set(s string) error {
+	name, value, ok := strings.Cut(strings.TrimSpace(s), "=")
+	name, value = strings.TrimSpace(name), strings.TrimSpace(value)
+	if !ok {
+		return errors.New(`must be "NAME=VALUE"`)
+	}
+	if !extraVarNameRegex.MatchString(name) {
+		return fmt.Errorf("%q is not a variable name", name)
+	}
+	if name == "host_role" || name == "host_name" {
+		return fmt.Errorf("%s is set from the role and the host's name", name)
+	}
+	if strings.ContainsAny(value, "\n\r") {
+		return fmt.Errorf("%s: the value must be a single line", name)
+	}
+	if *e == nil {
+		*e = ExtraVars{}
+	}
+	(*e)[name] = value
+	return nil
+}
+
+func (e *ExtraVars) String() string {
+	if e == nil {
+		return ""
+	}
+	return strings.Join(e.Entries(), ", ")
+}
+
+// Entries returns each variable's entry as the flag was given it.
+func (e *ExtraVars) Entries() []string {
+	var out []string
+	for _, name := range slices.Sorted(maps.Keys(*e)) {
+		out = append(out, name+"="+(*e)[name])
+	}
+	return out
+}
+
+// hookPaths is a repeatable flag.Value collecting --pre-hook or --post-hook
+// paths.
+type hookPaths []string
+
+func (h *hookPaths) Set(s string) error {
+	s = strings.TrimSpace(s)
+	if !filepath.IsAbs(s) {
+		return fmt.Errorf("%q is not an absolute path", s)
+	}
+	*h = append(*h, s)
+	return nil
+}
+
+func (h *hookPaths) String() string {
+	if h == nil {
+		return ""
+	}
+	return strings.Join(*h, ", ")
+}
+
+// Entries returns each path as the flag was given it.
+func (h *hookPaths) Entries() []string {
+	return slices.Clone(*h)
+}
+
+// ntpServers is a repeatable flag.Value collecting --ntp-server hosts. An
+// entry may list several, comma-separated.
+type ntpServers []string
+
+func (n *ntpServers) Set(s string) error {
+	for _, part := range strings.Split(s, ",") {
+		part = strings.TrimSpace(part)
+		if part == "" {
+			continue
+		}
+		if !ValidHostname(part) && net.ParseIP(part) == nil {
+			return fmt.Errorf("%q is not a host name or address", part)
+		}
+		*n = append(*n, part)
+	}
+	return nil
+}
+
+func (n *ntpServers) String() string {
+	if n == nil {
+		return ""
+	}
+	return strings.Join(*n, ",")
+}
+
+// Entries returns each server on its own.
+func (n *ntpServers) Entries() []string {
+	return slices.Clone(*n)
+}
+
+// postRebootCmds is a repeatable flag.Value collecting --post-reboot-cmd
+// entries in order. An entry is "[user:]command".
+type postRebootCmds []postRebootCmd
+
+func (p *postRebootCmds) Set(s string) error {
+	var c postRebootCmd
+	s = strings.TrimSpace(s)
+	if m := postRebootUserRegex.FindStringSubmatch(s); m != nil {
+		c.User, s = m[1], strings.TrimSpace(m[2])
+	}
+	if s == "" {
+		return errors.New("empty command")
+	}
+	c.Cmd = s
+	*p = append(*p, c)
+	return nil
+}
+
+func (p *postRebootCmds) String() string {
+	if p == nil {
+		return ""
+	}
+	return strings.Join(p.Entries(), "; ")
+}
+
+// Entries returns each command as the flag was given it.
+func (p *postRebootCmds) Entries() []string {
+	var out []string
+	for _, c := range *p {
+		if c.User != "" {
+			out = append(out, c.User+":"+c.Cmd)
+		} else {
+			out = append(out, c.Cmd)
+		}
+	}
+	return out
+}
+
+// rolePrereqs is a repeatable flag.Value collecting --role-prereqs entries,
+// "ROLE=ITEM ...", each replacing ROLE's prerequisites with the ITEMs: names
+// from BuiltinPrereqs, and packages in --extra-prereq's syntax.
+type rolePrereqs map[string][]string
+
+func (r *rolePrereqs) Set(s string) error {
+	role, list, ok := strings.Cut(strings.TrimSpace(s), "=")
+	role = strings.TrimSpace(role)
+	if !ok || !RoleNameRegex.MatchString(role) {
+		return errors.New(`must be "ROLE=ITEM ..."`)
+	}
+	items := strings.Fields(list)
+	for _, item := range items {
+		if slices.Contains(BuiltinPrereqs, item) {
+			continue
+		}
+		var p ExtraPrereqs
+		if err := p.Set(item); err != nil {
+			return fmt.Errorf("%s: %w", role, err)
+		}
+	}
+	if *r == nil {
+		*r = rolePrereqs{}
+	}
+	(*r)[role] = items
+	return nil
+}
+
+func (r *rolePrereqs) String() string {
+	if r == nil {
+		return ""
+	}
+	return strings.Join(r.Entries(), "; ")
+}
+
+// Entries returns each role's entry as the flag was given it.
+func (r *rolePrereqs) Entries() []string {
+	var out []string
+	for _, role := range slices.Sorted(maps.Keys(*r)) {
+		out = append(out, role+"="+strings.Join((*r)[role], " "))
+	}
+	return out
+}
+
+// skipIfBootstrapped is the value of --skip-if-bootstrapped. As a bare flag
+// it enables skipping regardless of the marker's age; given a duration it
+// only skips when the marker is younger than that.
+type skipIfBootstrapped struct {
+	Enabled bool
+	MaxAge  time.Duration
+}
+
+func (s *skipIfBootstrapped) IsBoolFlag() bool { return true }
+
+func (s *skipIfBootstrapped) Set(v string) error {
+	if b, err := strconv.ParseBool(v); err == nil {
+		*s = skipIfBootstrapped{Enabled: b}
+		return nil
+	}
+	d, err := time.ParseDuration(v)
+	if err != nil || d <= 0 {
+		return fmt.Errorf("must be true, false, or a positive duration")
+	}
+	*s = skipIfBootstrapped{Enabled: true, MaxAge: d}
+	return nil
+}
+
+func (s *skipIfBootstrapped) String() string {
+	if s == nil || !s.Enabled {
+		return "false"
+	}
+	if s.MaxAge > 0 {
+		return s.MaxAge.String()
+	}
+	return "true"
+}
+
+// DefaultAnsibleUser is the account --create-ansible-user creates when
+// given no name.
+const DefaultAnsibleUser = "ansible"
+
+// ansibleUserRegex matches the account names useradd accepts everywhere.
+var ansibleUserRegex = regexp.MustCompile(`^[a-z_][a-z0-9_-]{0,31}$`)
+
+// extraVarNameRegex matches the names ansible accepts for a variable.
+var extraVarNameRegex = regexp.MustCompile(`^[A-Za-z_][A-Za-z0-9_]*$`)
+
+// ValidGitRef reports whether ref can name a branch, tag or commit: git
+// rejects the rest, and one starting with '-' would be taken for an option.
+func ValidGitRef(ref string) bool {
+	return ref != "" && !strings.HasPrefix(ref, "-") && !strings.ContainsAny(ref, " \t\n~^:?*[\\") &&
+		!strings.Contains(ref, "..") && !strings.Contains(ref, "@{")
+}
+
+var byteSizeUnits = []struct {
+	suffix string
+	mult   uint64
+}{
+	{"TiB", 1 << 40}, {"GiB", 1 << 30}, {"MiB", 1 << 20}, {"KiB", 1 << 10},
+	{"TB", 1e12}, {"GB", 1e9}, {"MB", 1e6}, {"KB", 1e3},
+	{"T", 1 << 40}, {"G", 1 << 30}, {"M", 1 << 20}, {"K", 1 << 10},
+	{"B", 1},
+}
+
+// FormatBytes renders n using the largest binary unit that keeps it >= 1.
+func FormatBytes(n uint64) string {
+	for _, u := range []struct {
+		suffix string
+		mult   uint64
+	}{{"TiB", 1 << 40}, {"GiB", 1 << 30}, {"MiB", 1 << 20}, {"KiB", 1 << 10}} {
+		if n >= u.mult {
+			return fmt.Sprintf("%.1f%s", float64(n)/float64(u.mult), u.suffix)
+		}
+	}
+	return strconv.FormatUint(n, 10) + "B"
+}
+
+// SHA256Regex matches a hex-encoded SHA-256 digest.
+var SHA256Regex = regexp.MustCompile(`^[0-9a-fA-F]{64}$`)
+
+// CACertSource is one --ca-cert: a file, or a URL with the SHA-256 the
+// download must have.
+type CACertSource struct {
+	Src    string
+	SHA256 string
+}
+
+func (s CACertSource) String() string {
+	if s.SHA256 == "" {
+		return s.Src
+	}
+	return s.Src + "#sha256=" + s.SHA256
+}
+
+// IsURL reports whether s is fetched rather than read.
+func (s CACertSource) IsURL() bool {
+	return strings.HasPrefix(s.Src, "https://") || strings.HasPrefix(s.Src, "http://")
+}
+
+// packageNameRegex matches the package names --extra-prereq accepts.
+var packageNameRegex = regexp.MustCompile(`^[A-Za-z0-9][A-Za-z0-9+._@/-]*$`)
+
+// ExtraPrereq is one --extra-prereq: a package, with the names it has on
+// other systems.
+type ExtraPrereq struct {
+	Name string
+	// Names maps an OS ID (e.g. fedora) or package manager (apt-get, dnf,
+	// yum, brew) to the package's name there; "-" means there is none.
+	Names map[string]string
+}
+
+func (p ExtraPrereq) String() string {
+	parts := []string{p.Name}
+	for _, k := range slices.Sorted(maps.Keys(p.Names)) {
+		parts = append(parts, k+"="+p.Names[k])
+	}
+	return strings.Join(parts, ",")
+}
+
+// ValidHostname reports whether name is an RFC 1123 host name.
+func ValidHostname(name string) bool {
+	if name == "" || len(name) > 253 {
+		return false
+	}
+	for _, label := range strings.Split(name, ".") {
+		if !hostnameLabelRegex.MatchString(label) {
+			return false
+		}
+	}
+	return true
+}
+
+// BuiltinPrereqs are the prerequisites bootstrap knows how to install, in
+// the order a run installs them: sudo first, since the others need it, and
+// python before the ansible that runs on it.
+var BuiltinPrereqs = []string{"sudo", "curl", "git", "rsync", "jq", "python", "ansible", "gh"}
+
+var RoleNameRegex = regexp.MustCompile(`^[A-Za-z0-9][A-Za-z0-9_.-]*$`)
+
+// DefaultDriftSchedule is the schedule of a bare --enable-drift-timer.
+const DefaultDriftSchedule = "hourly"
+
+// postRebootCmd is one --post-reboot-cmd entry.
+type postRebootCmd struct {
+	User string // empty for the target user
+	Cmd  string
+}
+
+// postRebootUserRegex matches an entry starting with a user name prefix.
+var postRebootUserRegex = regexp.MustCompile(`^([a-z_][a-z0-9_.-]*):(.*)$`)
+
+// hostnameLabelRegex matches one dot-separated label of an RFC 1123 host
+// name: letters, digits and hyphens, not starting or ending with a hyphen.
+var hostnameLabelRegex = regexp.MustCompile(`^[A-Za-z0-9]([A-Za-z0-9-]{0,61}[A-Za-z0-9])?$`)
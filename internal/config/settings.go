@@ -0,0 +1,407 @@
+// Package config holds the settings of a bootstrap run and the flag value
+// types they are parsed with.
+package config
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Config holds every setting that controls a bootstrap run. Values are
+// layered in order: built-in defaults, config file, environment, flags.
+type Config struct {
+	ConfigFile      string
+	Role            string
+	Hostname        string
+	Verbose         bool
+	RunMiseInstall  bool
+	Keyserver       string
+	RepoURL         string
+	VaultPassFile   string
+	VaultPassOp     string
+	VaultPassBw     string
+	GithubTokenBw   string
+	BwPasswordFile  string
+	VaultPassPass   string
+	GithubTokenPass string
+	KeyPath         string
+	KeyStdin        bool
+	KeyB64Env       string
+	AnsibleSite     string
+	MiseCmd         string
+	ResultFile      string
+	Transcript      string
+	HealthcheckURL  string
+	Pushgateway     string
+	ReportURL       string
+	ReportToken     string
+	ReportTokenFile string
+	ErrorReportDSN  string
+	NotifyNtfy      string
+
+	UploadFailureLogs string
+
+	HostnameFromMetadata bool
+
+	Locale          string
+	SkipLocaleSetup bool
+	NoSELinuxFixup  bool
+	PythonApt       bool
+
+	CreateAnsibleUser      ansibleUser
+	AnsibleSudoersTemplate string
+
+	CheckUpdate      bool
+	StrictIntegrity  bool
+	InstallSelf      bool
+	InstallRerunUnit bool
+
+	NotifyEmail          string
+	NotifyEmailOnSuccess bool
+	NotifyTest           bool
+	SMTPHost             string
+	SMTPPort             int
+	SMTPTLS              string
+	SMTPUser             string
+	SMTPPassword         string
+	SMTPFrom             string
+
+	PackageLockTimeout time.Duration
+	ForceRefresh       bool
+	PackageIndexMaxAge time.Duration
+
+	RetryAttempts     int
+	RetryInitialDelay time.Duration
+	RetryMaxDelay     time.Duration
+	RetryMultiplier   float64
+
+	NetworkWait time.Duration
+
+	SkipSpaceCheck bool
+	MinFreeRoot    byteSize
+	MinFreeVar     byteSize
+	MinFreeTmp     byteSize
+	MinFreeHome    byteSize
+
+	SkipClockCheck bool
+	ClockCheckURL  string
+	MaxClockSkew   time.Duration
+	FixClock       bool
+
+	CACerts    caCertSources
+	CACheckURL string
+
+	EnsureTimesync bool
+	TimesyncDaemon string
+	NTPServers     ntpServers
+
+	LockWait time.Duration
+
+	SkipIfBootstrapped skipIfBootstrapped
+	Force              bool
+
+	Escalation string
+
+	KeepGoing bool
+
+	HomebrewInstallerURL string
+	HomebrewInstallerSHA string
+
+	GhKeyringFingerprint string
+
+	Offline    bool
+	AllowHosts string
+
+	RollbackOnFailure bool
+
+	MisePath      string
+	MiseUnitMode  string
+	MiseUnitScope string
+
+	PostRebootCmds postRebootCmds
+
+	ExtraPrereqs ExtraPrereqs
+	RolePrereqs  rolePrereqs
+
+	PreHooks  hookPaths
+	PostHooks hookPaths
+	HooksDir  string
+
+	KeyserverPin string
+
+	KeyserverFallback string
+
+	WaitForKeyserver     bool
+	KeyserverWaitTimeout time.Duration
+	MdnsTimeout          time.Duration
+	MdnsAdvertise        bool
+
+	ServeAddr string
+	ServeDir  string
+	ServeCert string
+	ServeKey  string
+
+	ServeTokensFile    string
+	ServeAuditLog      string
+	ServeAuditMaxSize  byteSize
+	BootstrapToken     string
+	BootstrapTokenFile string
+
+	AllowCIDRs CIDRList
+	TrustProxy bool
+
+	SetupRsyncd bool
+
+	AgeIdentityFile string
+	AgeRecipients   ageRecipients
+
+	ForceKeyRegen bool
+
+	CredentialVaultPass   string
+	CredentialGithubToken string
+
+	VaultAddr            string
+	VaultRoleID          string
+	VaultSecretID        string
+	VaultPassHashicorp   string
+	GithubTokenHashicorp string
+
+	VaultPassSSM string
+	KeySSM       string
+
+	AnsibleBranch string
+	RoleBranches  roleBranches
+
+	AnsibleRef    string
+	OnlyIfChanged bool
+	CloneDepth    int
+
+	RequireSignedTag   bool
+	AllowedSignersFile string
+	GPGKeyring         string
+
+	SyntaxCheckFirst bool
+	TwoPhase         bool
+	AutoApprove      bool
+
+	DetectDrift bool
+	DriftTimer  driftTimer
+
+	Inventory         string
+	GenerateInventory bool
+
+	ExtraVars ExtraVars
+
+	NoReboot    bool
+	Quiet       bool
+	LogTarget   string
+	NoProgress  bool
+	RebootDelay time.Duration
+	Yes         bool
+	RunMiseNow  bool
+
+	InstallMise      bool
+	MiseInstallerURL string
+	MiseInstallerSHA string
+}
+
+// ConfigHash identifies the settings that determine what a run provisions.
+// Changing any of them invalidates the success marker.
+func (c *Config) ConfigHash() string {
+	h := sha256.New()
+	for _, kv := range [][2]string{
+		{"role", c.Role},
+		{"repo-url", c.RepoURL},
+		{"ansible-site", c.AnsibleSite},
+		{"keyserver", c.Keyserver},
+		{"vault-pass-file", c.VaultPassFile},
+		{"mise-install", strconv.FormatBool(c.RunMiseInstall)},
+		{"mise-cmd", c.MiseCmd},
+	} {
+		fmt.Fprintf(h, "%s=%s\n", kv[0], kv[1])
+	}
+	// Only hashed when set, so that markers from before they existed still
+	// match.
+	if ref, _ := c.EffectiveAnsibleRef(); ref != "" {
+		fmt.Fprintf(h, "ansible-ref=%s\n", ref)
+	}
+	if c.Inventory != "" {
+		fmt.Fprintf(h, "inventory=%s\n", c.Inventory)
+	}
+	if c.GenerateInventory {
+		fmt.Fprintf(h, "generate-inventory=true\n")
+	}
+	for _, entry := range c.ExtraVars.Entries() {
+		fmt.Fprintf(h, "extra-var=%s\n", entry)
+	}
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+// EffectiveAnsibleRef returns the ref of the ansible repository to check out and
+// where it came from: ansible-ref or ansible-branch if set, else the role's
+// role-branch, else "" for the repository's default branch.
+func (c *Config) EffectiveAnsibleRef() (ref, from string) {
+	if c.AnsibleRef != "" {
+		return c.AnsibleRef, "ansible-ref"
+	}
+	if c.AnsibleBranch != "" {
+		return c.AnsibleBranch, "ansible-branch"
+	}
+	if ref, ok := c.RoleBranches[c.Role]; ok {
+		return ref, "role-branch"
+	}
+	return "", ""
+}
+
+// EffectiveVaultAddr returns the address of HashiCorp Vault: vault-addr, or
+// VAULT_ADDR like the vault CLI.
+func (c *Config) EffectiveVaultAddr() string {
+	if c.VaultAddr != "" {
+		return strings.TrimSuffix(c.VaultAddr, "/")
+	}
+	return strings.TrimSuffix(os.Getenv("VAULT_ADDR"), "/")
+}
+
+// RepoInventory returns the --inventory path within the ansible repository,
+// or "" when --inventory is unset, a host list or an absolute path.
+func (c *Config) RepoInventory() string {
+	if c.Inventory == "" || InlineInventory(c.Inventory) || filepath.IsAbs(c.Inventory) {
+		return ""
+	}
+	return filepath.Clean(c.Inventory)
+}
+
+// KeyserverURL returns the parsed keyserver location. For --keyserver auto it
+// is discovered, the one discovery found, or else --keyserver-fallback.
+// With --age-identity-file, its path has AgeSuffix.
+func (c *Config) KeyserverURL(discovered string) (*url.URL, error) {
+	s := c.Keyserver
+	if s == KeyserverAuto {
+		s = c.KeyserverFallback
+		if discovered != "" {
+			s = discovered
+		}
+		if s == "" {
+			return nil, errors.New("keyserver auto: no keyserver discovered and no keyserver-fallback set")
+		}
+	}
+	u, err := ParseKeyserver(s)
+	if err != nil {
+		return nil, err
+	}
+	// With an age identity the key is fetched encrypted, as published
+	// with --age-recipient.
+	if c.AgeIdentityFile != "" && !strings.HasSuffix(u.Path, AgeSuffix) {
+		u.Path += AgeSuffix
+	}
+	return u, nil
+}
+
+// AllowedHosts returns the entries of --allow-hosts: hostnames, optionally
+// with a port, or domain suffixes starting with ".".
+func (c *Config) AllowedHosts() []string {
+	var hosts []string
+	for _, h := range strings.Split(c.AllowHosts, ",") {
+		if h = strings.TrimSpace(h); h != "" {
+			hosts = append(hosts, strings.ToLower(h))
+		}
+	}
+	return hosts
+}
+
+// HostAllowed reports whether host may be contacted. Outside --offline mode
+// every host is allowed; in it, only the allowlisted hosts and keyserver,
+// the keyserver's host name, which is always internal.
+func (c *Config) HostAllowed(host, keyserver string) bool {
+	if !c.Offline {
+		return true
+	}
+	host = strings.ToLower(host)
+	if keyserver != "" && strings.EqualFold(keyserver, host) {
+		return true
+	}
+	for _, entry := range c.AllowedHosts() {
+		if h, _, err := net.SplitHostPort(entry); err == nil {
+			entry = h
+		}
+		if entry == host || (strings.HasPrefix(entry, ".") && strings.HasSuffix(host, entry)) {
+			return true
+		}
+	}
+	return false
+}
+
+// OfflineEndpoints returns the allowlisted host:port entries, which the
+// network preflight checks in --offline mode in place of public endpoints.
+func (c *Config) OfflineEndpoints() []string {
+	var eps []string
+	for _, entry := range c.AllowedHosts() {
+		if _, _, err := net.SplitHostPort(entry); err == nil {
+			eps = append(eps, entry)
+		}
+	}
+	return eps
+}
+
+// ProvidedKeySource names where --key-stdin, --key-b64-env or --key-ssm
+// provide the GitHub key, or returns "" when it is fetched from the keyserver.
+func (c *Config) ProvidedKeySource() string {
+	switch {
+	case c.KeyStdin:
+		return "stdin"
+	case c.KeyB64Env != "":
+		return "env " + c.KeyB64Env
+	case c.KeySSM != "":
+		return "SSM " + c.KeySSM
+	}
+	return ""
+}
+
+// InlineInventory reports whether inv is a host list, as ansible takes it
+// when it has a comma, rather than the path of an inventory.
+func InlineInventory(inv string) bool {
+	return strings.Contains(inv, ",")
+}
+
+// AgeSuffix is appended to the name of a key encrypted with age, on the
+// keyserver and in the location a client fetches it from.
+const AgeSuffix = ".age"
+
+// KeyserverAuto is the --keyserver value that discovers the keyserver over
+// mDNS.
+const KeyserverAuto = "auto"
+
+// ParseKeyserver parses the keyserver setting, which may omit the rsync://
+// scheme.
+func ParseKeyserver(s string) (*url.URL, error) {
+	s = keyserverURL(s)
+	u, err := url.Parse(s)
+	if err != nil {
+		return nil, fmt.Errorf("keyserver: %v", err)
+	}
+	if u.Scheme != "rsync" && u.Scheme != "https" {
+		return nil, fmt.Errorf("keyserver: unsupported scheme %q", u.Scheme)
+	}
+	if u.Hostname() == "" {
+		return nil, fmt.Errorf("keyserver %q has no host", s)
+	}
+	return u, nil
+}
+
+// keyserverURL returns the keyserver setting with the rsync:// scheme added
+// when it was omitted.
+func keyserverURL(s string) string {
+	if !strings.Contains(s, "://") {
+		return "rsync://" + s
+	}
+	return s
+}
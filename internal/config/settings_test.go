@@ -0,0 +1,49 @@
+package config
+
+import "testing"
+
+func TestConfigHash(t *testing.T) {
+	base := &Config{Role: "base", RepoURL: "git@github.com:example/ansible.git"}
+	want := base.ConfigHash()
+	if got := (&Config{Role: "base", RepoURL: base.RepoURL}).ConfigHash(); got != want {
+		t.Fatalf("ConfigHash of the same settings = %s, want %s", got, want)
+	}
+
+	// Each of these changes what ansible-pull applies, so it must not
+	// match the marker of a run without it.
+	for name, change := range map[string]func(c *Config){
+		"ansible-ref":        func(c *Config) { c.AnsibleRef = "v1.2.0" },
+		"inventory":          func(c *Config) { c.Inventory = "inventories/prod/hosts.yml" },
+		"generate-inventory": func(c *Config) { c.GenerateInventory = true },
+		"extra-var": func(c *Config) {
+			if err := c.ExtraVars.Set("env=prod"); err != nil {
+				t.Fatal(err)
+			}
+		},
+	} {
+		c := &Config{Role: base.Role, RepoURL: base.RepoURL}
+		change(c)
+		if c.ConfigHash() == want {
+			t.Errorf("setting %s does not change ConfigHash", name)
+		}
+	}
+
+	a, b := &Config{Role: "base"}, &Config{Role: "base"}
+	for _, v := range []string{"a=1", "b=2"} {
+		if err := a.ExtraVars.Set(v); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for _, v := range []string{"b=2", "a=1"} {
+		if err := b.ExtraVars.Set(v); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if a.ConfigHash() != b.ConfigHash() {
+		t.Error("ConfigHash depends on the order of the --extra-var entries")
+	}
+	b.ExtraVars["a"] = "2"
+	if a.ConfigHash() == b.ConfigHash() {
+		t.Error("ConfigHash does not change with an --extra-var's value")
+	}
+}
@@ -0,0 +1,132 @@
+package github
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+
+	"github.com/sparkleHazard/bootstrap/internal/platform"
+)
+
+const (
+	// ghKeyringURL serves the key that signs the GitHub CLI apt repository.
+	ghKeyringURL = "https://cli.github.com/packages/githubcli-archive-keyring.gpg"
+
+	// ghKeyringPath is where the verified keyring is installed for apt's
+	// signed-by option.
+	ghKeyringPath = "/usr/share/keyrings/githubcli-archive-keyring.gpg"
+
+	// ghSourcesPath is the apt source entry for the GitHub CLI repository.
+	ghSourcesPath = "/etc/apt/sources.list.d/github-cli.list"
+)
+
+// FingerprintRegex matches an OpenPGP v4 fingerprint once spaces are removed.
+var FingerprintRegex = regexp.MustCompile(`^[0-9A-F]{40}$`)
+
+// NormalizeFingerprint upper-cases fp and drops the spaces it is usually
+// printed with.
+func NormalizeFingerprint(fp string) string {
+	return strings.ToUpper(strings.ReplaceAll(fp, " ", ""))
+}
+
+// installGhKeyring downloads the GitHub CLI signing key, dearmors it if it
+// was served ASCII-armored, and installs it at ghKeyringPath only if every
+// key in it has the fingerprint cfg.GhKeyringFingerprint. Checking every key
+// matters: apt trusts all keys in a signed-by keyring, so one extra key would
+// let its holder sign packages.
+func (c *Client) installGhKeyring(ctx context.Context) error {
+	dir, err := c.sys.RunWorkDir()
+	if err != nil {
+		return err
+	}
+	raw := filepath.Join(dir, "githubcli-archive-keyring.download")
+	if err := c.sys.DownloadFile(ctx, ghKeyringURL, raw, "the gh package"); err != nil {
+		return fmt.Errorf("unable to download the GitHub CLI keyring: %w", err)
+	}
+	keyring := raw
+	data, err := os.ReadFile(raw)
+	if err != nil {
+		return err
+	}
+	if bytes.HasPrefix(bytes.TrimSpace(data), []byte("-----BEGIN PGP")) {
+		keyring = filepath.Join(dir, "githubcli-archive-keyring.gpg")
+		if err := c.sys.RunCmd(ctx, "gpg", "--batch", "--yes", "--dearmor", "-o", keyring, raw); err != nil {
+			return fmt.Errorf("unable to dearmor the GitHub CLI keyring: %w", err)
+		}
+	}
+
+	fprs, err := c.keyringFingerprints(ctx, keyring)
+	if err != nil {
+		return fmt.Errorf("unable to read the GitHub CLI keyring: %w", err)
+	}
+	want := NormalizeFingerprint(c.cfg.GhKeyringFingerprint)
+	if len(fprs) == 0 {
+		return fmt.Errorf("GitHub CLI keyring from %s contains no keys", ghKeyringURL)
+	}
+	for _, fpr := range fprs {
+		if fpr != want {
+			return fmt.Errorf("GitHub CLI keyring from %s contains key %s, expected only %s; not installing it (set gh-keyring-fingerprint if GitHub rotated its key)",
+				ghKeyringURL, fpr, want)
+		}
+	}
+	if c.cfg.Verbose {
+		c.sys.Log("GitHub CLI keyring fingerprint verified: " + want)
+	}
+	keyringData, err := os.ReadFile(keyring)
+	if err != nil {
+		return err
+	}
+	if _, err := c.sys.WriteFile(ctx, c.sys.Host.Path(ghKeyringPath), keyringData, 0644, platform.RootOwner); err != nil {
+		c.sys.RunCmdSudo(ctx, "rm", "-f", c.sys.Host.Path(ghKeyringPath))
+		return fmt.Errorf("error installing GitHub CLI key: %w", err)
+	}
+	c.sys.RecordUndo("remove the GitHub CLI apt keyring and source", func(ctx context.Context) error {
+		c.removeGhAptSource(ctx)
+		return nil
+	})
+	return nil
+}
+
+// keyringFingerprints returns the primary key fingerprints in the keyring
+// file at path, as reported by gpg without importing anything.
+func (c *Client) keyringFingerprints(ctx context.Context, path string) ([]string, error) {
+	out, err := c.sys.CmdOutput(ctx, "gpg", "--batch", "--with-colons", "--show-keys", path)
+	if err != nil {
+		return nil, fmt.Errorf("gpg --show-keys failed: %w", err)
+	}
+	// Each "pub" record is followed by the primary key's "fpr" record;
+	// those after "sub" records belong to subkeys.
+	var fprs []string
+	primary := false
+	scanner := bufio.NewScanner(bytes.NewReader(out))
+	for scanner.Scan() {
+		fields := strings.Split(scanner.Text(), ":")
+		switch fields[0] {
+		case "pub", "sec":
+			primary = true
+		case "sub", "ssb":
+			primary = false
+		case "fpr":
+			if primary && len(fields) > 9 {
+				fprs = append(fprs, NormalizeFingerprint(fields[9]))
+			}
+			primary = false
+		}
+	}
+	return fprs, nil
+}
+
+// removeGhAptSource deletes the GitHub CLI keyring and apt source entry
+// after a failed install, so a half-configured repository does not break
+// later apt-get runs.
+func (c *Client) removeGhAptSource(ctx context.Context) {
+	if err := c.sys.RunCmdSudo(ctx, "rm", "-f", c.sys.Host.Path(ghSourcesPath), c.sys.Host.Path(ghKeyringPath)); err != nil {
+		c.sys.Log("Warning: unable to remove the GitHub CLI apt source: " + err.Error())
+	}
+	c.sys.InvalidatePackageIndex("apt-get")
+}
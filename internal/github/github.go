@@ -0,0 +1,437 @@
+// Package github registers the deploy key with GitHub through gh.
+package github
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/sparkleHazard/bootstrap/internal/config"
+	"github.com/sparkleHazard/bootstrap/internal/platform"
+	"github.com/sparkleHazard/bootstrap/internal/secrets"
+	"github.com/sparkleHazard/bootstrap/internal/sshkeys"
+	"golang.org/x/crypto/ssh"
+)
+
+// EnsureGh checks if the GitHub CLI is installed and installs it if not.
+func (c *Client) EnsureGh(ctx context.Context, osID string) error {
+	_, err := exec.LookPath("gh")
+	if err == nil {
+		if c.cfg.Verbose {
+			c.sys.Log("GitHub CLI (gh) is already installed.")
+		}
+		return nil
+	}
+	c.sys.Log("GitHub CLI not found. Installing...")
+	out := &platform.TailBuffer{Max: platform.InstallOutputMax}
+	if c.cfg.Offline && osID != "darwin" {
+		return c.ensureGhOffline(ctx, osID, out)
+	}
+	switch osID {
+	case "darwin":
+		if err = c.sys.RunCmdTee(ctx, out, "brew", "install", "gh"); err != nil {
+			err = fmt.Errorf("brew install gh failed: %w", err)
+		}
+	case "ubuntu", "debian":
+		if err := c.installGhKeyring(ctx); err != nil {
+			return err
+		}
+		archBytes, archErr := c.sys.CmdOutput(ctx, "dpkg", "--print-architecture")
+		if archErr != nil {
+			c.removeGhAptSource(ctx)
+			return fmt.Errorf("failed to detect architecture: %w", archErr)
+		}
+		arch := strings.TrimSpace(string(archBytes))
+		debRepoLine := fmt.Sprintf("deb [arch=%s signed-by=%s] https://cli.github.com/packages stable main", arch, ghKeyringPath)
+		if err := c.sys.RunCmdSudo(ctx, "bash", "-c", fmt.Sprintf("echo '%s' > %s", debRepoLine, c.sys.Host.Path(ghSourcesPath))); err != nil {
+			c.removeGhAptSource(ctx)
+			return fmt.Errorf("error adding the GitHub CLI apt repository: %w", err)
+		}
+		c.sys.InvalidatePackageIndex("apt-get")
+		if err = c.sys.RefreshPackageIndex(ctx, "apt-get"); err == nil {
+			err = c.sys.RunPkgCmdTee(ctx, out, "apt-get", "install", "-y", "gh")
+		}
+		if err != nil {
+			c.removeGhAptSource(ctx)
+		}
+	case "fedora":
+		if err = c.sys.RunPkgCmd(ctx, "dnf", "config-manager", "--add-repo", "https://cli.github.com/packages/rpm/gh-cli.repo"); err == nil {
+			err = c.sys.RunPkgCmdTee(ctx, out, "dnf", "install", "-y", "gh")
+		}
+	case "centos", "redhat":
+		if err = c.sys.RunCmdSudo(ctx, "yum-config-manager", "--add-repo", "https://cli.github.com/packages/rpm/gh-cli.repo"); err != nil {
+			err = fmt.Errorf("yum-config-manager --add-repo failed: %w", err)
+		} else {
+			err = c.sys.RunPkgCmdTee(ctx, out, "yum", "install", "-y", "gh")
+		}
+	default:
+		return fmt.Errorf("unsupported OS %q for GitHub CLI installation; please install gh manually", osID)
+	}
+	if err != nil {
+		return fmt.Errorf("installing gh: %w", err)
+	}
+	c.sys.RecordIrreversible("installed gh")
+	return platform.VerifyInstalled("gh", out)
+}
+
+// ensureGhOffline installs gh in --offline mode from the package
+// repositories the host already has configured, without adding GitHub's.
+func (c *Client) ensureGhOffline(ctx context.Context, osID string, out *platform.TailBuffer) error {
+	var err error
+	switch osID {
+	case "ubuntu", "debian":
+		if err = c.sys.RefreshPackageIndex(ctx, "apt-get"); err == nil {
+			err = c.sys.RunPkgCmdTee(ctx, out, "apt-get", "install", "-y", "gh")
+		}
+	case "fedora":
+		err = c.sys.RunPkgCmdTee(ctx, out, "dnf", "install", "-y", "gh")
+	case "centos", "redhat":
+		err = c.sys.RunPkgCmdTee(ctx, out, "yum", "install", "-y", "gh")
+	default:
+		return fmt.Errorf("unsupported OS %q for GitHub CLI installation; please install gh manually", osID)
+	}
+	if err == nil {
+		err = platform.VerifyInstalled("gh", out)
+	}
+	if err != nil {
+		return fmt.Errorf("offline mode: gh is not available from the configured package mirrors; mirror the GitHub CLI repository or pre-install gh: %w", err)
+	}
+	c.sys.RecordIrreversible("installed gh")
+	return nil
+}
+
+// EnsureGhAuth checks if gh auth status is successful; if not, prompts for a token.
+// A token from a secret source is used instead, whether or not gh is signed in.
+func (c *Client) EnsureGhAuth(ctx context.Context) error {
+	if src := secrets.GithubTokenSource(c.cfg); src != nil {
+		token, err := c.secrets.ReadSecret(ctx, "the GitHub token", src)
+		if err != nil {
+			return err
+		}
+		os.Setenv("GH_TOKEN", token)
+		if err := c.sys.NewCommand(ctx, "gh", "auth", "status").Run(); err != nil {
+			return fmt.Errorf("GitHub CLI authentication failed with the token from %s: %w", src, err)
+		}
+		return nil
+	}
+	err := c.sys.NewCommand(ctx, "gh", "auth", "status").Run()
+	if err == nil {
+		if c.cfg.Verbose {
+			c.sys.Log("GitHub CLI is already authenticated.")
+		}
+		return nil
+	}
+	c.sys.Log("GitHub CLI is not authenticated.")
+	fmt.Fprint(c.sys.ConsoleStdout, "Please enter your GitHub Personal Access Token: ")
+	reader := bufio.NewReader(os.Stdin)
+	token, _ := reader.ReadString('\n')
+	token = strings.TrimSpace(token)
+	if token == "" {
+		return errors.New("no GitHub token provided")
+	}
+	os.Setenv("GH_TOKEN", token)
+	if err := c.sys.NewCommand(ctx, "gh", "auth", "status").Run(); err != nil {
+		return fmt.Errorf("GitHub CLI authentication failed even after setting GH_TOKEN: %w", err)
+	}
+	return nil
+}
+
+// ManageSSHKeyForGitHub generates an ECDSA SSH key if it doesn't exist and ensures it's registered with GitHub.
+func (c *Client) ManageSSHKeyForGitHub(ctx context.Context) error {
+	keyPath, err := c.keys.GithubKeyPath(c.sys.Host)
+	if err != nil {
+		return err
+	}
+	if _, err := os.Stat(keyPath); os.IsNotExist(err) {
+		c.sys.Log("Generating new ECDSA key pair for GitHub...")
+		if err := c.generateKeyPair(ctx, keyPath); err != nil {
+			return err
+		}
+		c.sys.RecordUndo("remove generated key pair "+keyPath, func(context.Context) error {
+			if err := os.Remove(keyPath); err != nil && !os.IsNotExist(err) {
+				return err
+			}
+			if err := os.Remove(keyPath + ".pub"); err != nil && !os.IsNotExist(err) {
+				return err
+			}
+			return nil
+		})
+	} else if c.cfg.ForceKeyRegen {
+		return c.regenerateGitHubKey(ctx, keyPath)
+	} else {
+		if c.cfg.Verbose {
+			c.sys.Log("ECDSA key pair already exists at " + keyPath)
+		}
+	}
+	publicKey, err := c.syncPublicKey(ctx, keyPath)
+	if err != nil {
+		return err
+	}
+
+	if c.cfg.Offline {
+		c.sys.Log("Offline mode: not checking or uploading " + keyPath + ".pub to GitHub; register it separately.")
+		return nil
+	}
+
+	// Test SSH access to GitHub using the local key.
+	if c.githubAcceptsKey(ctx, keyPath) {
+		c.sys.Log("SSH key is accepted by GitHub.")
+		return nil
+	}
+	c.sys.Log("SSH key access denied. Attempting to update GitHub keys...")
+
+	// Attempt to remove old key with "keyserver" title.
+	var outList []byte
+	err = c.sys.Retry(ctx, platform.NewRetryPolicy(c.cfg), "GitHub key listing", func() error {
+		var err error
+		outList, err = c.sys.CmdOutput(ctx, "gh", "api", "-H", "Accept: application/vnd.github+json",
+			"-H", "X-GitHub-Api-Version: 2022-11-28",
+			"/user/keys")
+		return err
+	})
+	if err == nil {
+		keyID := findKeyIDForTitle(string(outList), "keyserver")
+		if keyID != "" {
+			c.sys.Log("Deleting old GitHub key with ID: " + keyID)
+			c.sys.RecordIrreversible("deleted GitHub key " + keyID)
+			c.DeleteGitHubKey(ctx, keyID)
+		}
+	}
+
+	c.sys.Log("Adding new SSH key to GitHub...")
+	c.sys.RecordIrreversible("uploaded the SSH key to GitHub")
+	if err := c.uploadGitHubKey(ctx, publicKey); err != nil {
+		c.sys.Log("Failed to add new SSH key to GitHub: " + err.Error())
+	}
+	return nil
+}
+
+// regenerateGitHubKey implements --force-key-regen: it replaces the key
+// pair at keyPath with a new one, backing the old pair up beside it first.
+// The new key is uploaded and must authenticate to GitHub before it takes
+// the old one's place; only then is the old key removed from GitHub. If it
+// does not, the new key is withdrawn again, and the old pair and its
+// registration are left as they were, so that the keyserver cannot lock
+// itself out.
+func (c *Client) regenerateGitHubKey(ctx context.Context, keyPath string) error {
+	oldPub, err := c.syncPublicKey(ctx, keyPath)
+	if err != nil {
+		return err
+	}
+	backup := keyPath + ".bak-" + time.Now().Format("20060102-150405")
+	for _, f := range []struct {
+		src, dest string
+		mode      os.FileMode
+	}{{keyPath, backup, 0600}, {keyPath + ".pub", backup + ".pub", 0644}} {
+		data, err := os.ReadFile(f.src)
+		if err != nil {
+			return fmt.Errorf("backing up the key pair: %w", err)
+		}
+		if _, err := c.sys.WriteFile(ctx, f.dest, data, f.mode, ""); err != nil {
+			return fmt.Errorf("backing up the key pair: %w", err)
+		}
+	}
+	c.sys.Log("Backed up the current key pair to " + backup)
+
+	newKey := keyPath + ".new"
+	discard := func() {
+		os.Remove(newKey)
+		os.Remove(newKey + ".pub")
+	}
+	discard() // left by an interrupted regeneration
+	c.sys.Log("Generating new ECDSA key pair for GitHub...")
+	if err := c.generateKeyPair(ctx, newKey); err != nil {
+		return err
+	}
+	newPub, err := derivePublicKey(newKey)
+	if err != nil {
+		discard()
+		return err
+	}
+	c.sys.Log("Adding the new SSH key to GitHub...")
+	if err := c.uploadGitHubKey(ctx, newPub); err != nil {
+		discard()
+		return fmt.Errorf("uploading the new key to GitHub failed: %w; the current key is unchanged", err)
+	}
+	c.sys.RecordIrreversible("uploaded a new SSH key to GitHub")
+	err = c.sys.Retry(ctx, platform.NewRetryPolicy(c.cfg), "GitHub SSH check of the new key", func() error {
+		if !c.githubAcceptsKey(ctx, newKey) {
+			return errors.New("GitHub does not accept the new key")
+		}
+		return nil
+	})
+	if err != nil {
+		if id, lerr := c.registeredKeyID(ctx, newPub); lerr == nil && id != "" {
+			c.DeleteGitHubKey(ctx, id)
+		}
+		discard()
+		return fmt.Errorf("%w; the current key and its registration on GitHub are unchanged", err)
+	}
+
+	if err := os.Rename(newKey+".pub", keyPath+".pub"); err != nil {
+		return err
+	}
+	if err := os.Rename(newKey, keyPath); err != nil {
+		return err
+	}
+	c.sys.RecordIrreversible("replaced the GitHub key pair at " + keyPath + " (the old pair is at " + backup + ")")
+	c.sys.Log("New SSH key is accepted by GitHub and installed at " + keyPath + ".")
+
+	id, err := c.registeredKeyID(ctx, oldPub)
+	switch {
+	case err != nil:
+		c.sys.Log("Warning: could not look up the old key on GitHub to remove it: " + err.Error())
+	case id == "":
+		c.sys.Log("The old key was not registered with GitHub.")
+	default:
+		c.sys.Log("Deleting the old GitHub key with ID: " + id)
+		if err := c.DeleteGitHubKey(ctx, id); err != nil {
+			c.sys.Log("Warning: deleting the old GitHub key " + id + " failed: " + err.Error())
+		} else {
+			c.sys.RecordIrreversible("deleted the old GitHub key " + id)
+		}
+	}
+	return nil
+}
+
+// generateKeyPair generates an ECDSA key pair without a passphrase at path
+// and path.pub.
+func (c *Client) generateKeyPair(ctx context.Context, path string) error {
+	if err := c.sys.RunCmd(ctx, "ssh-keygen", "-t", "ecdsa", "-b", "521", "-f", path, "-N", "", "-q", "-C", ""); err != nil {
+		return fmt.Errorf("failed to generate SSH key: %w", err)
+	}
+	return c.sys.RestoreContexts(ctx, false, filepath.Dir(path), path, path+".pub")
+}
+
+// derivePublicKey returns the public key of the private key at keyPath, in
+// authorized_keys format.
+func derivePublicKey(keyPath string) (string, error) {
+	data, err := os.ReadFile(keyPath)
+	if err != nil {
+		return "", fmt.Errorf("failed to read private key: %w", err)
+	}
+	signer, err := ssh.ParsePrivateKey(data)
+	if err != nil {
+		return "", fmt.Errorf("%s is not a usable private key: %w", keyPath, err)
+	}
+	return string(ssh.MarshalAuthorizedKey(signer.PublicKey())), nil
+}
+
+// syncPublicKey returns the public key of the private key at keyPath. If
+// keyPath.pub is missing or holds a different key, as when only the
+// private key was restored from a backup, it is rewritten from the private
+// key: the .pub file is never trusted on its own.
+func (c *Client) syncPublicKey(ctx context.Context, keyPath string) (string, error) {
+	pub, err := derivePublicKey(keyPath)
+	if err != nil {
+		return "", err
+	}
+	onDisk, err := os.ReadFile(keyPath + ".pub")
+	if err != nil && !os.IsNotExist(err) {
+		return "", fmt.Errorf("failed to read public key: %w", err)
+	}
+	if sameAuthorizedKey(string(onDisk), pub) {
+		return pub, nil
+	}
+	if err != nil {
+		c.sys.Log(keyPath + ".pub is missing; writing it from the private key.")
+	} else {
+		c.sys.Log(keyPath + ".pub does not match the private key; rewriting it from the private key.")
+	}
+	if _, err := c.sys.WriteFile(ctx, keyPath+".pub", []byte(pub), 0644, ""); err != nil {
+		return "", fmt.Errorf("error writing public key: %w", err)
+	}
+	if err := c.sys.RestoreContexts(ctx, false, filepath.Dir(keyPath), keyPath+".pub"); err != nil {
+		return "", err
+	}
+	return pub, nil
+}
+
+// sameAuthorizedKey reports whether a and b, in authorized_keys format,
+// are the same key, whatever their comments.
+func sameAuthorizedKey(a, b string) bool {
+	fa, fb := strings.Fields(a), strings.Fields(b)
+	return len(fa) >= 2 && len(fb) >= 2 && fa[0] == fb[0] && fa[1] == fb[1]
+}
+
+// githubAcceptsKey reports whether GitHub accepts the private key at
+// keyPath over SSH.
+func (c *Client) githubAcceptsKey(ctx context.Context, keyPath string) bool {
+	out, _ := c.sys.NewCommand(ctx, "ssh", "-T", "-o", "BatchMode=yes", "-o", "StrictHostKeyChecking=no", "-i", keyPath, "git@github.com").CombinedOutput()
+	return strings.Contains(strings.ToLower(string(out)), "successfully authenticated")
+}
+
+// uploadGitHubKey registers publicKey with the GitHub account gh is logged
+// in to, titled "keyserver".
+func (c *Client) uploadGitHubKey(ctx context.Context, publicKey string) error {
+	return c.sys.Retry(ctx, platform.NewRetryPolicy(c.cfg), "GitHub key upload", func() error {
+		return c.sys.NewCommand(ctx, "gh", "api", "--method", "POST", "-H", "Accept: application/vnd.github+json",
+			"-H", "X-GitHub-Api-Version: 2022-11-28",
+			"/user/keys", "-f", "key="+publicKey, "-f", "title=keyserver").Run()
+	})
+}
+
+// DeleteGitHubKey removes the key with id from the account gh is logged in
+// to.
+func (c *Client) DeleteGitHubKey(ctx context.Context, id string) error {
+	return c.sys.NewCommand(ctx, "gh", "api", "--method", "DELETE", "-H", "Accept: application/vnd.github+json",
+		"-H", "X-GitHub-Api-Version: 2022-11-28", "/user/keys/"+id).Run()
+}
+
+// registeredKeyID returns the ID under which the account gh is logged in to
+// has publicKey, whatever its title, or "" if it does not have it.
+func (c *Client) registeredKeyID(ctx context.Context, publicKey string) (string, error) {
+	if len(strings.Fields(publicKey)) < 2 {
+		return "", errors.New("not a public key")
+	}
+	out, err := c.sys.CmdOutput(ctx, "gh", "api", "-H", "Accept: application/vnd.github+json",
+		"-H", "X-GitHub-Api-Version: 2022-11-28", "/user/keys")
+	if err != nil {
+		return "", fmt.Errorf("gh api /user/keys: %w", err)
+	}
+	var registered []struct {
+		ID  int64  `json:"id"`
+		Key string `json:"key"`
+	}
+	if err := json.Unmarshal(out, &registered); err != nil {
+		return "", fmt.Errorf("gh api /user/keys: %w", err)
+	}
+	for _, k := range registered {
+		if sameAuthorizedKey(k.Key, publicKey) {
+			return fmt.Sprint(k.ID), nil
+		}
+	}
+	return "", nil
+}
+
+// findKeyIDForTitle is a helper to parse JSON from `gh api /user/keys` output
+// and return the `.id` for a given `.title`.
+func findKeyIDForTitle(jsonStr, title string) string {
+	idRegex := regexp.MustCompile(`"id":\s*([0-9]+).*?"title":\s*"` + regexp.QuoteMeta(title) + `"`)
+	matches := idRegex.FindStringSubmatch(jsonStr)
+	if len(matches) >= 2 {
+		return matches[1]
+	}
+	return ""
+}
+
+// Client registers the deploy key with GitHub through gh.
+type Client struct {
+	cfg     *config.Config
+	sys     *platform.System
+	secrets *secrets.Store
+	keys    *sshkeys.Manager
+}
+
+// NewClient returns the GitHub client of a run on sys.
+func NewClient(sys *platform.System, secrets *secrets.Store, keys *sshkeys.Manager) *Client {
+	return &Client{cfg: sys.Config, sys: sys, secrets: secrets, keys: keys}
+}
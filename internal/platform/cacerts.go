@@ -0,0 +1,381 @@
+package platform
+
+import (
+	"context"
+	"crypto/sha1"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/hex"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/sparkleHazard/bootstrap/internal/config"
+)
+
+// CACertsRecordName is the file in the state directory recording the
+// certificates --ca-cert installed, for clean.
+const CACertsRecordName = "ca-certs.json"
+
+// MacSystemKeychain is the keychain --ca-cert trusts certificates in on
+// macOS.
+const MacSystemKeychain = "/Library/Keychains/System.keychain"
+
+// caCertCheckTimeout bounds the TLS connection that checks the installed
+// certificates.
+const caCertCheckTimeout = 10 * time.Second
+
+// caCertsRecord is the content of CACertsRecordName: every certificate
+// --ca-cert has installed on the host, by this run and earlier ones.
+type caCertsRecord struct {
+	Certs     []installedCACert `json:"certs"`
+	UpdatedAt time.Time         `json:"updated_at"`
+}
+
+// installedCACert is a certificate in the trust store: its file on Linux,
+// its SHA-1 in the system keychain on macOS, which is how security(1)
+// finds it.
+type installedCACert struct {
+	Subject string `json:"subject"`
+	Path    string `json:"path,omitempty"`
+	SHA1    string `json:"sha1,omitempty"`
+}
+
+// caTrustStore is where osID keeps the certificates it trusts besides its
+// own: the directory certificates are added to, the command that rebuilds
+// the bundle from it, and that bundle.
+type caTrustStore struct {
+	dir    string
+	Update []string
+	bundle string
+}
+
+// CATrustStoreFor returns osID's trust store, or false if it is not a Linux
+// one bootstrap knows.
+func CATrustStoreFor(osID string) (caTrustStore, bool) {
+	switch osID {
+	case "debian", "ubuntu":
+		return caTrustStore{"/usr/local/share/ca-certificates", []string{"update-ca-certificates"}, "/etc/ssl/certs/ca-certificates.crt"}, true
+	case "fedora", "centos", "redhat":
+		return caTrustStore{"/etc/pki/ca-trust/source/anchors", []string{"update-ca-trust", "extract"}, "/etc/pki/tls/certs/ca-bundle.crt"}, true
+	}
+	return caTrustStore{}, false
+}
+
+// InstallCACerts implements --ca-cert: it adds each certificate to the
+// system trust store the way osID does, leaves those already there alone,
+// and then checks, with a TLS connection to --ca-check-url that trusts only
+// the rebuilt store, that it works. It returns the step's status,
+// "installed" or "unchanged".
+func (s *System) InstallCACerts(ctx context.Context, osID string) (string, error) {
+	var certs []*x509.Certificate
+	for _, src := range s.Config.CACerts {
+		c, err := s.loadCACert(ctx, src)
+		if err != nil {
+			return "", err
+		}
+		for _, cert := range c {
+			if !slices.ContainsFunc(certs, cert.Equal) {
+				certs = append(certs, cert)
+			}
+		}
+	}
+	if !s.CanEscalate {
+		return "", errors.New("ca-cert needs root, or sudo or doas")
+	}
+
+	rec, _ := s.ReadCACertsRecord()
+	if rec == nil {
+		rec = &caCertsRecord{}
+	}
+	var changed bool
+	var err error
+	if osID == "darwin" {
+		changed, err = s.trustMacCACerts(ctx, certs, rec)
+	} else {
+		changed, err = s.trustLinuxCACerts(ctx, osID, certs, rec)
+	}
+	if err != nil {
+		return "", err
+	}
+	rec.UpdatedAt = time.Now()
+	if err := s.writeCACertsRecord(ctx, rec); err != nil {
+		return "", err
+	}
+	s.extraRoots = certs
+
+	if s.Config.CACheckURL != "" {
+		var roots *x509.CertPool // macOS: the keychain, through the platform verifier
+		if store, ok := CATrustStoreFor(osID); ok {
+			data, err := s.Host.ReadFile(store.bundle)
+			if err != nil {
+				return "", fmt.Errorf("reading %s: %w", store.bundle, err)
+			}
+			bundle, _ := parseCerts(data)
+			for _, c := range certs {
+				if !slices.ContainsFunc(bundle, c.Equal) {
+					return "", fmt.Errorf("%s is not in %s after %s", certSubject(c), store.bundle, strings.Join(store.Update, " "))
+				}
+			}
+			roots = x509.NewCertPool()
+			roots.AppendCertsFromPEM(data)
+		}
+		if err := checkCATrust(ctx, s.Config.CACheckURL, roots); err != nil {
+			return "", fmt.Errorf("TLS to %s still fails with the installed certificates: %w", s.Config.CACheckURL, err)
+		}
+		s.Log("TLS to " + s.Config.CACheckURL + " verifies with the system trust store.")
+	}
+	if changed {
+		return "installed", nil
+	}
+	return "unchanged", nil
+}
+
+// loadCACert reads or downloads src and returns its certificates, PEM or
+// a single DER one.
+func (s *System) loadCACert(ctx context.Context, src config.CACertSource) ([]*x509.Certificate, error) {
+	path := src.Src
+	if src.IsURL() {
+		dir, err := s.RunWorkDir()
+		if err != nil {
+			return nil, err
+		}
+		path = filepath.Join(dir, "ca-cert-download")
+		if err := s.DownloadFile(ctx, src.Src, path, "the CA certificate"); err != nil {
+			return nil, fmt.Errorf("ca-cert: downloading %s failed: %w", src.Src, err)
+		}
+		defer os.Remove(path)
+		if src.SHA256 != "" {
+			if err := verifySHA256(path, src.SHA256); err != nil {
+				return nil, fmt.Errorf("ca-cert %s: %w", src.Src, err)
+			}
+		}
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("ca-cert: %w", err)
+	}
+	certs, err := parseCerts(data)
+	if err != nil {
+		return nil, fmt.Errorf("ca-cert %s: %w", src.Src, err)
+	}
+	return certs, nil
+}
+
+// parseCerts returns the certificates in data, PEM or DER.
+func parseCerts(data []byte) ([]*x509.Certificate, error) {
+	var certs []*x509.Certificate
+	for rest := data; ; {
+		var block *pem.Block
+		block, rest = pem.Decode(rest)
+		if block == nil {
+			break
+		}
+		if block.Type != "CERTIFICATE" {
+			continue
+		}
+		c, err := x509.ParseCertificate(block.Bytes)
+		if err != nil {
+			return nil, err
+		}
+		certs = append(certs, c)
+	}
+	if len(certs) > 0 {
+		return certs, nil
+	}
+	c, err := x509.ParseCertificate(data)
+	if err != nil {
+		return nil, errors.New("no PEM or DER certificate found")
+	}
+	return []*x509.Certificate{c}, nil
+}
+
+// pemCert returns c PEM-encoded.
+func pemCert(c *x509.Certificate) []byte {
+	return pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: c.Raw})
+}
+
+// certSubject names c in messages and the record.
+func certSubject(c *x509.Certificate) string {
+	if c.Subject.CommonName != "" {
+		return c.Subject.CommonName
+	}
+	return c.Subject.String()
+}
+
+// trustLinuxCACerts installs each certificate as a file of its own in the
+// trust store's directory, named after its fingerprint, and rebuilds the
+// bundle if any was new. It reports whether it changed anything.
+func (s *System) trustLinuxCACerts(ctx context.Context, osID string, certs []*x509.Certificate, rec *caCertsRecord) (bool, error) {
+	store, ok := CATrustStoreFor(osID)
+	if !ok {
+		return false, fmt.Errorf("installing CA certificates is not supported on %s", osID)
+	}
+	if _, err := exec.LookPath(store.Update[0]); err != nil {
+		if err := s.EnsureExtraPrereq(ctx, osID, config.ExtraPrereq{Name: "ca-certificates"}); err != nil {
+			return false, err
+		}
+	}
+	if err := s.RunCmdSudo(ctx, "mkdir", "-p", s.Host.Path(store.dir)); err != nil {
+		return false, err
+	}
+	changed := false
+	for _, c := range certs {
+		sum := sha256.Sum256(c.Raw)
+		dest := filepath.Join(store.dir, "bootstrap-"+hex.EncodeToString(sum[:8])+".crt")
+		path := s.Host.Path(dest)
+		existed := FileExists(path)
+		wrote, err := s.WriteFile(ctx, path, pemCert(c), 0644, RootOwner)
+		if err != nil {
+			return false, err
+		}
+		if wrote {
+			changed = true
+		}
+		if wrote && !existed {
+			s.RecordUndo("remove "+dest, func(ctx context.Context) error {
+				if err := s.RunCmdSudo(ctx, "rm", "-f", path); err != nil {
+					return err
+				}
+				return s.RunCmdSudo(ctx, store.Update[0], store.Update[1:]...)
+			})
+		}
+		if !slices.ContainsFunc(rec.Certs, func(ic installedCACert) bool { return ic.Path == dest }) {
+			rec.Certs = append(rec.Certs, installedCACert{Subject: certSubject(c), Path: dest})
+		}
+	}
+	if changed {
+		s.Log("Rebuilding the trust store with " + strings.Join(store.Update, " ") + "...")
+		if err := s.RunCmdSudo(ctx, store.Update[0], store.Update[1:]...); err != nil {
+			return false, fmt.Errorf("%s failed: %w", strings.Join(store.Update, " "), err)
+		}
+	}
+	return changed, nil
+}
+
+// trustMacCACerts adds each certificate not already in the system keychain
+// to it, trusted as a root. It reports whether it changed anything.
+func (s *System) trustMacCACerts(ctx context.Context, certs []*x509.Certificate, rec *caCertsRecord) (bool, error) {
+	out, err := s.CmdOutput(ctx, "security", "find-certificate", "-a", "-Z", MacSystemKeychain)
+	if err != nil {
+		return false, fmt.Errorf("listing %s failed: %w", MacSystemKeychain, err)
+	}
+	dir, err := s.RunWorkDir()
+	if err != nil {
+		return false, err
+	}
+	changed := false
+	for _, c := range certs {
+		sum := sha1.Sum(c.Raw)
+		hash := strings.ToUpper(hex.EncodeToString(sum[:]))
+		if !strings.Contains(string(out), "SHA-1 hash: "+hash) {
+			tmp := filepath.Join(dir, hash+".pem")
+			if _, err := s.WriteFile(ctx, tmp, pemCert(c), 0600, ""); err != nil {
+				return false, err
+			}
+			s.Log("Trusting " + certSubject(c) + " in the system keychain...")
+			if err := s.RunCmdSudo(ctx, "security", "add-trusted-cert", "-d", "-r", "trustRoot", "-k", MacSystemKeychain, tmp); err != nil {
+				return false, fmt.Errorf("security add-trusted-cert %s failed: %w", certSubject(c), err)
+			}
+			s.RecordUndo("remove "+certSubject(c)+" from the system keychain", func(ctx context.Context) error {
+				return s.RunCmdSudo(ctx, "security", "delete-certificate", "-Z", hash, "-t", MacSystemKeychain)
+			})
+			changed = true
+		}
+		if !slices.ContainsFunc(rec.Certs, func(ic installedCACert) bool { return ic.SHA1 == hash }) {
+			rec.Certs = append(rec.Certs, installedCACert{Subject: certSubject(c), SHA1: hash})
+		}
+	}
+	return changed, nil
+}
+
+// RootCAs returns the roots bootstrap's own TLS clients verify against:
+// nil, for the system's, unless --ca-cert installed certificates this run,
+// which are added to them.
+func (s *System) RootCAs() *x509.CertPool {
+	if len(s.extraRoots) == 0 {
+		return nil
+	}
+	pool, err := x509.SystemCertPool()
+	if err != nil {
+		pool = x509.NewCertPool()
+	}
+	for _, c := range s.extraRoots {
+		pool.AddCert(c)
+	}
+	return pool
+}
+
+// checkCATrust makes a HEAD request to rawURL verifying the server's
+// certificate against roots, or the platform verifier if nil, at a time in
+// its validity window, since the clock may not be set yet.
+func checkCATrust(ctx context.Context, rawURL string, roots *x509.CertPool) error {
+	client := &http.Client{
+		Timeout: caCertCheckTimeout,
+		Transport: &http.Transport{
+			Proxy: http.ProxyFromEnvironment,
+			TLSClientConfig: &tls.Config{
+				InsecureSkipVerify: true,
+				VerifyConnection:   verifyIgnoringTime(roots),
+			},
+		},
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodHead, rawURL, nil)
+	if err != nil {
+		return err
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		var ue *url.Error
+		if errors.As(err, &ue) {
+			err = ue.Err
+		}
+		return err
+	}
+	resp.Body.Close()
+	return nil
+}
+
+// ReadCACertsRecord reads what --ca-cert has installed.
+func (s *System) ReadCACertsRecord() (*caCertsRecord, error) {
+	dir, err := s.StateDir()
+	if err != nil {
+		return nil, err
+	}
+	data, err := os.ReadFile(filepath.Join(dir, CACertsRecordName))
+	if err != nil {
+		return nil, err
+	}
+	var rec caCertsRecord
+	if err := json.Unmarshal(data, &rec); err != nil {
+		return nil, err
+	}
+	return &rec, nil
+}
+
+// writeCACertsRecord records rec in the state directory.
+func (s *System) writeCACertsRecord(ctx context.Context, rec *caCertsRecord) error {
+	dir, err := s.StateDir()
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return err
+	}
+	data, err := json.MarshalIndent(rec, "", "  ")
+	if err != nil {
+		return err
+	}
+	_, err = s.WriteFile(ctx, filepath.Join(dir, CACertsRecordName), append(data, '\n'), 0644, "")
+	return err
+}
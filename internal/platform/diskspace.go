@@ -0,0 +1,106 @@
+package platform
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"syscall"
+
+	"github.com/sparkleHazard/bootstrap/internal/config"
+)
+
+// spaceRequirement is a minimum amount of free space for the filesystem
+// holding path.
+type spaceRequirement struct {
+	path string
+	min  uint64
+}
+
+// fsUsage is the free space of a filesystem and the largest minimum of the
+// checked paths on it.
+type fsUsage struct {
+	Paths []string
+	Free  uint64
+	Min   uint64
+}
+
+// CheckDiskSpace fails when any of /, /var, /tmp or the home directory has
+// less free space than its configured minimum. Paths on the same filesystem
+// are checked once against the largest of their minimums.
+func (s *System) CheckDiskSpace() error {
+	if s.Config.SkipSpaceCheck {
+		s.Log("Skipping disk space check.")
+		return nil
+	}
+	s.Log("Checking free disk space...")
+	usage, err := s.DiskUsage()
+	if err != nil {
+		return err
+	}
+
+	var short []string
+	for _, u := range usage {
+		paths := strings.Join(u.Paths, ", ")
+		if u.Free < u.Min {
+			line := fmt.Sprintf("%s: %s free, need %s (short by %s)", paths, config.FormatBytes(u.Free), config.FormatBytes(u.Min), config.FormatBytes(u.Min-u.Free))
+			s.Log("  [fail] " + line)
+			short = append(short, line)
+		} else if s.Config.Verbose {
+			s.Log(fmt.Sprintf("  [ok]   %s: %s free, need %s", paths, config.FormatBytes(u.Free), config.FormatBytes(u.Min)))
+		}
+	}
+	if len(short) > 0 {
+		return errors.New("insufficient disk space: " + strings.Join(short, "; "))
+	}
+	return nil
+}
+
+// DiskUsage measures the filesystems holding /, /var, /tmp and the home
+// directory, in that order, each once.
+func (s *System) DiskUsage() ([]*fsUsage, error) {
+	homeDir, err := s.Host.HomeDir()
+	if err != nil {
+		return nil, fmt.Errorf("unable to determine home directory: %w", err)
+	}
+	reqs := []spaceRequirement{
+		{"/", uint64(s.Config.MinFreeRoot)},
+		{"/var", uint64(s.Config.MinFreeVar)},
+		{"/tmp", uint64(s.Config.MinFreeTmp)},
+		{homeDir, uint64(s.Config.MinFreeHome)},
+	}
+	var order []*fsUsage
+	byDev := map[uint64]*fsUsage{}
+	for _, r := range reqs {
+		path := existingParent(r.path)
+		var st syscall.Stat_t
+		if err := syscall.Stat(path, &st); err != nil {
+			return nil, fmt.Errorf("unable to stat %s: %w", path, err)
+		}
+		dev := uint64(st.Dev)
+		u, ok := byDev[dev]
+		if !ok {
+			var sfs syscall.Statfs_t
+			if err := syscall.Statfs(path, &sfs); err != nil {
+				return nil, fmt.Errorf("unable to check free space on %s: %w", path, err)
+			}
+			u = &fsUsage{Free: uint64(sfs.Bavail) * uint64(sfs.Bsize)}
+			byDev[dev] = u
+			order = append(order, u)
+		}
+		u.Paths = append(u.Paths, r.path)
+		u.Min = max(u.Min, r.min)
+	}
+	return order, nil
+}
+
+// existingParent returns path or its nearest ancestor that exists.
+func existingParent(path string) string {
+	for {
+		if _, err := os.Stat(path); err == nil || path == filepath.Dir(path) {
+			return path
+		}
+		path = filepath.Dir(path)
+	}
+}
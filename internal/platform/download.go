@@ -0,0 +1,113 @@
+package platform
+
+import (
+	"context"
+	"crypto/sha256"
+	"crypto/tls"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// DownloadFile fetches url to dest with curl, retrying per the --retry-*
+// policy. In --offline mode only allowlisted hosts may be contacted; artifact
+// names what to pre-stage otherwise.
+func (s *System) DownloadFile(ctx context.Context, url, dest, artifact string) error {
+	if err := s.CheckOfflineURL(url, artifact); err != nil {
+		return err
+	}
+	return s.Retry(ctx, NewRetryPolicy(s.Config), "download "+url, func() error {
+		return s.RunCmd(ctx, "curl", "-fsSL", "-o", dest, url)
+	})
+}
+
+// scriptPreviewLines is how much of an installer script is shown in verbose
+// mode before it runs.
+const scriptPreviewLines = 10
+
+// fetchInstallerScript downloads name's install script from url into the
+// run's working directory and checks it against the hex SHA-256 want,
+// returning its path. Nothing may execute it until the digest matches; with
+// an empty want (the shaSetting setting is unset) the script is refused, and
+// the error names the digest of what was downloaded for review.
+func (s *System) fetchInstallerScript(ctx context.Context, name, url, want, shaSetting string) (string, error) {
+	dir, err := s.RunWorkDir()
+	if err != nil {
+		return "", err
+	}
+	script := filepath.Join(dir, strings.ToLower(name)+"-install.sh")
+	if err := s.DownloadFile(ctx, url, script, name); err != nil {
+		return "", fmt.Errorf("unable to download the %s installer: %w", name, err)
+	}
+	if want == "" {
+		sum, err := fileSHA256(script)
+		os.Remove(script)
+		if err != nil {
+			return "", err
+		}
+		return "", fmt.Errorf("refusing to run the %s installer from %s unverified: %s is not set; review the script, whose SHA-256 is %s, and set %s to its digest",
+			name, url, shaSetting, sum, shaSetting)
+	}
+	if err := verifySHA256(script, want); err != nil {
+		return "", fmt.Errorf("refusing to run the %s installer: %w; if upstream changed it, review the new script and update %s", name, err, shaSetting)
+	}
+	if s.Config.Verbose {
+		if data, err := os.ReadFile(script); err == nil {
+			lines := strings.SplitN(string(data), "\n", scriptPreviewLines+1)
+			s.Log(name + " installer from " + url + " begins:\n" +
+				strings.Join(lines[:min(len(lines), scriptPreviewLines)], "\n"))
+		}
+	}
+	return script, nil
+}
+
+// fileSHA256 returns the hex-encoded SHA-256 digest of the file at path.
+func fileSHA256(path string) (string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+	h := sha256.New()
+	if _, err := io.Copy(h, f); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+// verifySHA256 checks that the file at path has the hex digest want.
+func verifySHA256(path, want string) error {
+	got, err := fileSHA256(path)
+	if err != nil {
+		return err
+	}
+	if !strings.EqualFold(got, want) {
+		return fmt.Errorf("%s has SHA-256 %s, expected %s", path, got, want)
+	}
+	return nil
+}
+
+// SendNotifyRequest is doNotifyRequest for callers that need the response,
+// whose body they must close.
+func (s *System) SendNotifyRequest(req *http.Request) (*http.Response, error) {
+	req.Header.Set("User-Agent", "bootstrap/"+ToolVersion())
+	client := &http.Client{Transport: &http.Transport{
+		Proxy:           http.ProxyFromEnvironment,
+		TLSClientConfig: &tls.Config{RootCAs: s.RootCAs()},
+	}}
+	resp, err := client.Do(req)
+	if err != nil {
+		var ue *url.Error
+		if errors.As(err, &ue) {
+			err = ue.Err
+		}
+		return nil, err
+	}
+	return resp, nil
+}
@@ -0,0 +1,271 @@
+package platform
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"os/exec"
+	"strings"
+	"time"
+)
+
+// EscalationModes are the accepted values of --escalation.
+var EscalationModes = []string{"auto", "sudo", "doas", "none"}
+
+// sudoKeepaliveInterval is how often cached credentials are refreshed. It is
+// well under sudo's default five-minute timestamp timeout.
+const sudoKeepaliveInterval = 2 * time.Minute
+
+// EscalationTool returns the escalation tool selected by cfg.Escalation:
+// for "auto", sudo if installed, otherwise doas if installed, otherwise "".
+func (s *System) EscalationTool() string {
+	switch s.Config.Escalation {
+	case "none":
+		return ""
+	case "auto":
+		for _, tool := range []string{"sudo", "doas"} {
+			if _, err := exec.LookPath(tool); err == nil {
+				return tool
+			}
+		}
+		return ""
+	}
+	if _, err := exec.LookPath(s.Config.Escalation); err != nil {
+		return ""
+	}
+	return s.Config.Escalation
+}
+
+// EscalationArgs returns the arguments that run a no-op through tool,
+// either without ever prompting or prompting once on the terminal.
+func EscalationArgs(tool string, interactive bool) []string {
+	switch {
+	case tool == "sudo" && interactive:
+		return []string{"-v"}
+	case tool == "sudo":
+		return []string{"-n", "true"}
+	case interactive:
+		// doas has no equivalent of sudo -v; authenticating for a no-op
+		// primes its persist timestamp where that is configured.
+		return []string{"true"}
+	default:
+		return []string{"-n", "true"}
+	}
+}
+
+// CheckPrivileges verifies up front that privileged commands will work, so
+// a missing sudoers or doas.conf entry is reported clearly instead of
+// failing deep inside a package install. When not root it runs a no-op
+// through the escalation tool without prompting and, with a terminal, once
+// with a password prompt. Without escalation the run continues only if
+// nothing it needs to do requires root; otherwise it fails with
+// ExitPrivileges.
+func (s *System) CheckPrivileges(ctx context.Context, osID string) error {
+	if s.Host.EUID() == 0 {
+		s.CanEscalate = true
+		return nil
+	}
+	s.EscalationCmd = s.EscalationTool()
+	if s.EscalationCmd != "" {
+		if s.NewCommand(ctx, s.EscalationCmd, EscalationArgs(s.EscalationCmd, false)...).Run() == nil {
+			s.CanEscalate = true
+		} else if StdinIsTerminal() {
+			s.Log(s.EscalationCmd + " needs a password; authenticating once up front...")
+			resume := s.Console.pause()
+			s.CanEscalate = s.RunCmd(ctx, s.EscalationCmd, EscalationArgs(s.EscalationCmd, true)...) == nil
+			resume()
+		}
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+	}
+	if s.CanEscalate {
+		if s.Config.Verbose {
+			s.Log("Using " + s.EscalationCmd + " for privileged commands.")
+		}
+		s.startSudoKeepalive(ctx)
+		return nil
+	}
+
+	needs := s.PrivilegedWork(ctx, osID)
+	if len(needs) == 0 {
+		s.Log("Warning: no working sudo or doas; continuing unprivileged since everything that needs root is already in place.")
+		s.EscalationCmd = ""
+		return nil
+	}
+	name := "this user"
+	if u := os.Getenv("USER"); u != "" {
+		name = u
+	}
+	tool := s.EscalationCmd
+	switch {
+	case tool != "":
+	case s.Config.Escalation == "sudo" || s.Config.Escalation == "doas":
+		tool = s.Config.Escalation + " (not installed)"
+	default:
+		tool = "sudo or doas"
+	}
+	return WithExitCode(ExitPrivileges, fmt.Errorf(
+		"%s cannot use %s, but this run needs root for: %s; grant %s escalation rights or run bootstrap as root",
+		name, tool, strings.Join(needs, ", "), name))
+}
+
+// PrivilegedWork lists the parts of this run that would need root on osID.
+// The packages are those of the role's prerequisites, as ResolvePrereqs
+// returns them, that are not installed yet.
+func (s *System) PrivilegedWork(ctx context.Context, osID string) []string {
+	var needs []string
+	if osID == "darwin" {
+		// Homebrew installs packages as the user; only its installer needs sudo.
+		if _, err := exec.LookPath("brew"); err != nil {
+			needs = append(needs, "installing Homebrew")
+		}
+		return needs
+	}
+	builtins, extras := ResolvePrereqs(s.Config, s.Config.Role)
+	for _, name := range builtins {
+		var missing bool
+		switch name {
+		case "sudo":
+			// Without escalation, there is nothing to install it with.
+			continue
+		case "python":
+			_, err := exec.LookPath("python3")
+			missing = err != nil
+		case "ansible":
+			_, err := exec.LookPath("ansible-playbook")
+			_, pipErr := exec.LookPath("pip")
+			missing = err != nil && pipErr != nil
+		default:
+			_, err := exec.LookPath(name)
+			missing = err != nil
+		}
+		if missing {
+			needs = append(needs, "installing "+name)
+		}
+	}
+	for _, p := range extras {
+		if pkg := prereqPackage(p, osID); pkg != "" && !s.packageInstalled(ctx, osID, pkg) {
+			needs = append(needs, "installing "+p.Name)
+		}
+	}
+	if s.Config.RunMiseInstall {
+		needs = append(needs, "installing the mise systemd unit")
+	}
+	if s.Config.SetupRsyncd {
+		needs = append(needs, "setting up the rsync daemon")
+	}
+	return needs
+}
+
+// startSudoKeepalive refreshes the escalation tool's cached credentials in
+// the background until ctx is done, so a long brew or ansible step does not
+// leave a later privileged call blocked on a password prompt nobody sees.
+// It is a no-op for root, without an escalation tool, and after the first
+// call.
+func (s *System) startSudoKeepalive(ctx context.Context) {
+	if s.Host.EUID() == 0 || s.EscalationCmd == "" {
+		return
+	}
+	s.sudoKeepaliveOnce.Do(func() {
+		tool := s.EscalationCmd
+		// -n never prompts: a refresh either succeeds silently or fails
+		// right away. sudo -v extends the timestamp; doas has no such
+		// command, but a no-op still detects revoked rights.
+		args := []string{"-n", "-v"}
+		if tool == "doas" {
+			args = EscalationArgs(tool, false)
+		}
+		go func() {
+			ticker := time.NewTicker(sudoKeepaliveInterval)
+			defer ticker.Stop()
+			failing := false
+			for {
+				select {
+				case <-ctx.Done():
+					return
+				case <-ticker.C:
+				}
+				err := s.NewCommand(ctx, tool, args...).Run()
+				if ctx.Err() != nil {
+					return
+				}
+				if err != nil && !failing {
+					s.Log("Warning: unable to refresh " + tool + " credentials (" + err.Error() + "); the next privileged command may prompt for a password.")
+				} else if err == nil && failing {
+					s.Log(tool + " credentials refreshed again.")
+				}
+				failing = err != nil
+			}
+		}()
+	})
+}
+
+// invokingUser returns the user who ran bootstrap on h through sudo or
+// doas, or "" if it was not run that way.
+func invokingUser(h *HostEnv) string {
+	if u := h.getenv("SUDO_USER"); u != "" {
+		return u
+	}
+	return h.getenv("DOAS_USER")
+}
+
+// BecomeMethod returns the --become-method to pass to ansible, or "" to use
+// ansible's default (sudo).
+func (s *System) BecomeMethod() string {
+	if _, err := exec.LookPath("sudo"); err == nil && s.Config.Escalation != "doas" {
+		return ""
+	}
+	if _, err := exec.LookPath("doas"); err == nil {
+		return "doas"
+	}
+	return ""
+}
+
+// EnsureEscalation makes sure a privilege escalation tool is available,
+// installing sudo only when neither sudo nor doas exists. Even as root one
+// is needed, since playbooks using "become" run through it.
+func (s *System) EnsureEscalation(ctx context.Context, osID string) error {
+	if s.Config.Escalation == "none" {
+		return nil
+	}
+	for _, tool := range []string{"sudo", "doas"} {
+		if _, err := exec.LookPath(tool); err == nil {
+			if s.Config.Verbose {
+				s.Log(tool + " is already installed.")
+			}
+			return nil
+		}
+	}
+	if s.Host.EUID() != 0 {
+		// Only root could install it; CheckPrivileges already decided the
+		// run can proceed without it.
+		s.Log("Neither sudo nor doas found; continuing unprivileged.")
+		return nil
+	}
+	s.Log("Neither sudo nor doas found. Attempting to install sudo...")
+	out := &TailBuffer{Max: InstallOutputMax}
+	var err error
+	switch osID {
+	case "ubuntu", "debian":
+		if err = s.RefreshPackageIndex(ctx, "apt-get"); err == nil {
+			err = s.RunPkgCmdTee(ctx, out, "apt-get", "install", "-y", "sudo")
+		}
+	case "fedora":
+		err = s.RunPkgCmdTee(ctx, out, "dnf", "install", "-y", "sudo")
+	case "centos", "redhat":
+		err = s.RunPkgCmdTee(ctx, out, "yum", "install", "-y", "sudo")
+	case "darwin":
+		s.Log("Warning: Installing sudo on macOS via Homebrew (if needed).")
+		if err = s.RunCmdTee(ctx, out, "brew", "install", "sudo"); err != nil {
+			err = fmt.Errorf("brew install sudo failed: %w", err)
+		}
+	default:
+		return fmt.Errorf("unsupported OS %q for automatic sudo installation; install sudo manually", osID)
+	}
+	if err != nil {
+		return fmt.Errorf("installing sudo: %w", err)
+	}
+	s.RecordIrreversible("installed sudo")
+	return VerifyInstalled("sudo", out)
+}
@@ -0,0 +1,175 @@
+package platform_test
+
+import (
+	"context"
+	"os"
+	"os/user"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+
+	"github.com/sparkleHazard/bootstrap/internal/config"
+	"github.com/sparkleHazard/bootstrap/internal/platform"
+	"github.com/sparkleHazard/bootstrap/internal/platform/platformtest"
+)
+
+func TestEscalationArgs(t *testing.T) {
+	for _, tt := range []struct {
+		tool        string
+		interactive bool
+		want        []string
+	}{
+		{"sudo", false, []string{"-n", "true"}},
+		{"sudo", true, []string{"-v"}},
+		{"doas", false, []string{"-n", "true"}},
+		// doas has no -v.
+		{"doas", true, []string{"true"}},
+	} {
+		if got := platform.EscalationArgs(tt.tool, tt.interactive); !slices.Equal(got, tt.want) {
+			t.Errorf("EscalationArgs(%q, %v) = %q, want %q", tt.tool, tt.interactive, got, tt.want)
+		}
+	}
+}
+
+// pathWith makes PATH a directory holding only the commands names, each of
+// which appends its name and arguments, space-separated, to a log file in
+// the directory, which pathWith returns.
+func pathWith(t *testing.T, names ...string) string {
+	t.Helper()
+	dir := t.TempDir()
+	log := filepath.Join(dir, "commands.log")
+	for _, name := range names {
+		script := "#!/bin/sh\necho " + name + ` "$@" >> ` + log + "\n"
+		if err := os.WriteFile(filepath.Join(dir, name), []byte(script), 0755); err != nil {
+			t.Fatal(err)
+		}
+	}
+	t.Setenv("PATH", dir)
+	return log
+}
+
+func TestEscalationToolAndBecomeMethod(t *testing.T) {
+	for _, tt := range []struct {
+		escalation string
+		installed  []string
+		tool       string
+		become     string
+	}{
+		{"auto", []string{"sudo", "doas"}, "sudo", ""},
+		{"auto", []string{"doas"}, "doas", "doas"},
+		{"auto", nil, "", ""},
+		{"sudo", []string{"sudo", "doas"}, "sudo", ""},
+		// ansible still becomes root with the one there is.
+		{"sudo", []string{"doas"}, "", "doas"},
+		{"doas", []string{"sudo", "doas"}, "doas", "doas"},
+		{"doas", []string{"sudo"}, "", ""},
+		{"none", []string{"sudo", "doas"}, "", ""},
+	} {
+		t.Run(tt.escalation+" with "+strings.Join(tt.installed, ","), func(t *testing.T) {
+			pathWith(t, tt.installed...)
+			sys, _, _ := platformtest.NewSystem(t, &config.Config{Escalation: tt.escalation})
+			if got := sys.EscalationTool(); got != tt.tool {
+				t.Errorf("EscalationTool = %q, want %q", got, tt.tool)
+			}
+			if got := sys.BecomeMethod(); got != tt.become {
+				t.Errorf("BecomeMethod = %q, want %q", got, tt.become)
+			}
+		})
+	}
+}
+
+func TestRunCmdSudo(t *testing.T) {
+	for _, tt := range []struct {
+		name string
+		euid int
+		tool string
+		want string
+	}{
+		{"sudo", 1000, "sudo", "sudo apt-get install -y jq"},
+		{"doas", 1000, "doas", "doas apt-get install -y jq"},
+		{"no escalation tool", 1000, "", "apt-get install -y jq"},
+		{"root", 0, "sudo", "apt-get install -y jq"},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			log := pathWith(t, "sudo", "doas", "apt-get")
+			sys, _, _ := platformtest.NewSystem(t, &config.Config{Escalation: "auto"})
+			sys.SetRunner(platform.ExecRunner(sys))
+			sys.Host.EUID = func() int { return tt.euid }
+			sys.EscalationCmd = tt.tool
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+
+			if err := sys.RunCmdSudo(ctx, "apt-get", "install", "-y", "jq"); err != nil {
+				t.Fatal(err)
+			}
+			// The fake escalation tools only record the command, so the
+			// log holds the first command run.
+			data, err := os.ReadFile(log)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got := strings.TrimSpace(string(data)); got != tt.want {
+				t.Errorf("ran %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestCommandAsUser(t *testing.T) {
+	bob := &user.User{Uid: "4242", Gid: "4343", Username: "bob", HomeDir: "/home/bob"}
+	if cur, err := user.Current(); err == nil && cur.Uid == bob.Uid {
+		t.Skip("the tests' user is the target user")
+	}
+	const script = "mise install"
+	for _, tt := range []struct {
+		name    string
+		euid    int
+		tool    string
+		want    []string
+		wantErr string
+	}{
+		{"sudo", 1000, "sudo", []string{"sudo", "-H", "-u", "bob", "/bin/sh", "-lc", script}, ""},
+		// doas has no -H: it sets the target user's HOME itself.
+		{"doas", 1000, "doas", []string{"doas", "-u", "bob", "/bin/sh", "-lc", script}, ""},
+		{"no escalation tool", 1000, "", nil, "cannot run commands as bob without sudo or doas"},
+		{"root", 0, "sudo", []string{"/bin/sh", "-lc", script}, ""},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			sys, _, _ := platformtest.NewSystem(t, &config.Config{})
+			sys.Host.EUID = func() int { return tt.euid }
+			sys.EscalationCmd = tt.tool
+
+			cmd, err := sys.CommandAsUser(context.Background(), bob, script)
+			if tt.wantErr != "" {
+				if err == nil || err.Error() != tt.wantErr {
+					t.Fatalf("CommandAsUser error = %v, want %q", err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !slices.Equal(cmd.Args, tt.want) {
+				t.Errorf("command %q, want %q", cmd.Args, tt.want)
+			}
+			cred := cmd.SysProcAttr
+			if tt.euid != 0 {
+				if cred != nil && cred.Credential != nil {
+					t.Errorf("the escalated command switches credentials itself: %+v", cred.Credential)
+				}
+				return
+			}
+			// As root the credentials are switched directly, with a clean
+			// environment for bob.
+			if cred == nil || cred.Credential == nil || cred.Credential.Uid != 4242 || cred.Credential.Gid != 4343 {
+				t.Errorf("credentials %+v, want uid 4242 and gid 4343", cred)
+			}
+			for _, env := range []string{"HOME=/home/bob", "USER=bob", "LOGNAME=bob"} {
+				if !slices.Contains(cmd.Env, env) {
+					t.Errorf("environment %q lacks %s", cmd.Env, env)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,50 @@
+package platform
+
+import "errors"
+
+// Process exit codes. main calls os.Exit exactly once with one of these.
+const (
+	ExitOK      = 0
+	ExitFailure = 1
+	ExitConfig  = 2
+	ExitLocked  = 3
+
+	// ExitDrift is a --detect-drift run that found changes pending.
+	ExitDrift = 4
+
+	// ExitPrivileges is sysexits' EX_NOPERM: the run needs root and neither
+	// is the process root nor can the user use sudo or doas.
+	ExitPrivileges = 77
+
+	// ExitInterrupted follows the shell convention of 128+SIGINT.
+	ExitInterrupted = 130
+)
+
+// ExitError attaches a specific process exit code to an error.
+type ExitError struct {
+	Code int
+	err  error
+}
+
+func (e *ExitError) Error() string { return e.err.Error() }
+func (e *ExitError) Unwrap() error { return e.err }
+
+// WithExitCode wraps err so that ExitCodeFor maps it to code.
+func WithExitCode(code int, err error) error {
+	if err == nil {
+		return nil
+	}
+	return &ExitError{Code: code, err: err}
+}
+
+// ExitCodeFor maps an error returned by a run to a process exit code.
+func ExitCodeFor(err error) int {
+	if err == nil {
+		return ExitOK
+	}
+	var ee *ExitError
+	if errors.As(err, &ee) {
+		return ee.Code
+	}
+	return ExitFailure
+}
@@ -0,0 +1,31 @@
+package platform_test
+
+import (
+	"errors"
+	"fmt"
+	"testing"
+
+	"github.com/sparkleHazard/bootstrap/internal/platform"
+)
+
+func TestExitCodeFor(t *testing.T) {
+	locked := platform.WithExitCode(platform.ExitLocked, errors.New("another bootstrap is already running"))
+	for _, tt := range []struct {
+		name string
+		err  error
+		want int
+	}{
+		{"no error", nil, platform.ExitOK},
+		{"plain error", errors.New("ansible-pull failed"), platform.ExitFailure},
+		{"with an exit code", locked, platform.ExitLocked},
+		{"wrapped", fmt.Errorf("lock: %w", locked), platform.ExitLocked},
+		{"joined", errors.Join(errors.New("installing jq"), platform.WithExitCode(platform.ExitPrivileges, errors.New("no sudo"))), platform.ExitPrivileges},
+		{"nil with an exit code", platform.WithExitCode(platform.ExitConfig, nil), platform.ExitOK},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := platform.ExitCodeFor(tt.err); got != tt.want {
+				t.Errorf("ExitCodeFor(%v) = %d, want %d", tt.err, got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,20 @@
+package platform
+
+import (
+	"context"
+	"os/user"
+)
+
+// The detection helpers, for the host matrix of the external tests.
+var (
+	InvokingUser = invokingUser
+	SelinuxMode  = selinuxMode
+)
+
+// CommandAsUser is commandAsUser, for the escalation tests.
+func (s *System) CommandAsUser(ctx context.Context, u *user.User, script string) (*Command, error) {
+	return s.commandAsUser(ctx, u, script)
+}
+
+// ExecRunner returns the runner that runs the commands of s on the host.
+func ExecRunner(s *System) Runner { return execRunner{s} }
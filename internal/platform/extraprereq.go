@@ -0,0 +1,55 @@
+package platform
+
+import (
+	"context"
+	"fmt"
+	"strings"
+
+	"github.com/sparkleHazard/bootstrap/internal/config"
+)
+
+// EnsureExtraPrereq installs p's package on osID unless the package manager
+// has it already. A package the package manager does not know fails with
+// its error.
+func (s *System) EnsureExtraPrereq(ctx context.Context, osID string, p config.ExtraPrereq) error {
+	pkg := prereqPackage(p, osID)
+	if pkg == "" {
+		if s.Config.Verbose {
+			s.Log(p.Name + " is not needed on " + osID + ".")
+		}
+		return nil
+	}
+	if s.packageInstalled(ctx, osID, pkg) {
+		if s.Config.Verbose {
+			s.Log(pkg + " is already installed.")
+		}
+		return nil
+	}
+	s.Log(fmt.Sprintf("%s is not installed. Installing...", pkg))
+	out := &TailBuffer{Max: InstallOutputMax}
+	if err := s.installPackage(ctx, osID, pkg, out); err != nil {
+		if tail := strings.TrimSpace(string(out.Bytes())); tail != "" {
+			return fmt.Errorf("%w; installer output:\n%s", err, tail)
+		}
+		return err
+	}
+	if !s.packageInstalled(ctx, osID, pkg) {
+		return fmt.Errorf("%s is still not installed after installation", pkg)
+	}
+	return nil
+}
+
+// prereqPackage returns p's package name on osID, or "" if it has none there.
+func prereqPackage(p config.ExtraPrereq, osID string) string {
+	name, ok := p.Names[osID]
+	if !ok {
+		name, ok = p.Names[packageManager(osID)]
+	}
+	if !ok {
+		return p.Name
+	}
+	if name == "-" {
+		return ""
+	}
+	return name
+}
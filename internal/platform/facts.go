@@ -0,0 +1,270 @@
+package platform
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/fs"
+	"net"
+	"os/exec"
+	"runtime"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/sparkleHazard/bootstrap/internal/config"
+)
+
+// factsTimeout bounds the commands GatherFacts falls back to.
+const factsTimeout = 10 * time.Second
+
+// HostFacts describes the machine a run is on, for the result file, the
+// playbook (as the bootstrap_facts extra-var) and "bootstrap facts". Facts
+// that cannot be determined are left empty.
+type HostFacts struct {
+	Kernel         string     `json:"kernel,omitempty"`
+	Arch           string     `json:"arch"`
+	CPUModel       string     `json:"cpu_model,omitempty"`
+	CPUCount       int        `json:"cpu_count"`
+	MemoryBytes    uint64     `json:"memory_bytes,omitempty"`
+	Virtualization string     `json:"virtualization"`
+	Firmware       string     `json:"firmware,omitempty"`
+	Vendor         string     `json:"vendor,omitempty"`
+	Product        string     `json:"product,omitempty"`
+	BIOSVersion    string     `json:"bios_version,omitempty"`
+	Disks          []diskFact `json:"disks,omitempty"`
+	NICs           []nicFact  `json:"nics,omitempty"`
+}
+
+// diskFact is a whole block device.
+type diskFact struct {
+	Name       string `json:"name"`
+	SizeBytes  uint64 `json:"size_bytes"`
+	Model      string `json:"model,omitempty"`
+	Rotational bool   `json:"rotational"`
+}
+
+// nicFact is a network interface other than loopback.
+type nicFact struct {
+	Name string `json:"name"`
+	MAC  string `json:"mac,omitempty"`
+	Up   bool   `json:"up"`
+}
+
+// dmiVirtualization maps a DMI vendor or product name to the type
+// systemd-detect-virt reports for it.
+var dmiVirtualization = []struct{ match, virt string }{
+	{"KVM", "kvm"},
+	{"QEMU", "qemu"},
+	{"VMware", "vmware"},
+	{"VirtualBox", "oracle"},
+	{"innotek", "oracle"},
+	{"Xen", "xen"},
+	{"Amazon EC2", "amazon"},
+	{"Google Compute Engine", "google"},
+	{"Parallels", "parallels"},
+	{"Bochs", "bochs"},
+	{"Virtual Machine", "microsoft"},
+}
+
+// GatherFacts collects h's facts from /proc, /sys and its DMI tables, and
+// falls back to commands (sysctl on macOS, systemd-detect-virt) only for
+// what those do not tell.
+func (s *System) GatherFacts(ctx context.Context, h *HostEnv, osID string) *HostFacts {
+	ctx, cancel := context.WithTimeout(ctx, factsTimeout)
+	defer cancel()
+	f := &HostFacts{Arch: runtime.GOARCH, CPUCount: runtime.NumCPU()}
+	f.NICs = nicFacts()
+	if osID == "darwin" {
+		f.Kernel = s.sysctlValue(ctx, "kern.osrelease")
+		f.CPUModel = s.sysctlValue(ctx, "machdep.cpu.brand_string")
+		f.MemoryBytes, _ = strconv.ParseUint(s.sysctlValue(ctx, "hw.memsize"), 10, 64)
+		f.Product = s.sysctlValue(ctx, "hw.model")
+		f.Vendor, f.Firmware = "Apple Inc.", "efi"
+		f.Virtualization = "none"
+		if s.sysctlValue(ctx, "kern.hv_vmm_present") == "1" {
+			f.Virtualization = "vm"
+		}
+		return f
+	}
+
+	f.Kernel = readFact(h, "/proc/sys/kernel/osrelease")
+	f.CPUModel = cpuModel(h)
+	f.MemoryBytes = memTotal(h)
+	f.Vendor = readFact(h, "/sys/class/dmi/id/sys_vendor")
+	f.Product = readFact(h, "/sys/class/dmi/id/product_name")
+	f.BIOSVersion = readFact(h, "/sys/class/dmi/id/bios_version")
+	if _, err := fs.Stat(h.fs, "sys/firmware/efi"); err == nil {
+		f.Firmware = "efi"
+	} else if f.Vendor != "" {
+		f.Firmware = "bios"
+	}
+	f.Disks = diskFacts(h)
+	f.Virtualization = s.virtualization(ctx, h, f)
+	return f
+}
+
+// readFact returns the trimmed content of the file at p on h, or "".
+func readFact(h *HostEnv, p string) string {
+	data, err := h.ReadFile(p)
+	if err != nil {
+		return ""
+	}
+	return strings.TrimSpace(string(data))
+}
+
+// sysctlValue returns the value of the sysctl name, or "".
+func (s *System) sysctlValue(ctx context.Context, name string) string {
+	out, err := s.CmdOutput(ctx, "sysctl", "-n", name)
+	if err != nil {
+		return ""
+	}
+	return strings.TrimSpace(string(out))
+}
+
+// cpuModel returns the CPU's name from /proc/cpuinfo, which x86 gives as
+// "model name" and ARM as "Model" or "Hardware".
+func cpuModel(h *HostEnv) string {
+	data, _ := h.ReadFile("/proc/cpuinfo")
+	found := map[string]string{}
+	for _, line := range strings.Split(string(data), "\n") {
+		k, v, ok := strings.Cut(line, ":")
+		k = strings.TrimSpace(k)
+		if ok && found[k] == "" {
+			found[k] = strings.TrimSpace(v)
+		}
+	}
+	for _, k := range []string{"model name", "Model", "Hardware"} {
+		if found[k] != "" {
+			return found[k]
+		}
+	}
+	return ""
+}
+
+// memTotal returns MemTotal from /proc/meminfo, in bytes.
+func memTotal(h *HostEnv) uint64 {
+	data, _ := h.ReadFile("/proc/meminfo")
+	for _, line := range strings.Split(string(data), "\n") {
+		if rest, ok := strings.CutPrefix(line, "MemTotal:"); ok {
+			kb, _ := strconv.ParseUint(strings.TrimSuffix(strings.TrimSpace(rest), " kB"), 10, 64)
+			return kb * 1024
+		}
+	}
+	return 0
+}
+
+// diskFacts lists the block devices in /sys/block, leaving out loop, RAM
+// and device-mapper devices, which are not disks.
+func diskFacts(h *HostEnv) []diskFact {
+	entries, _ := fs.ReadDir(h.fs, "sys/block")
+	var disks []diskFact
+	for _, e := range entries {
+		name := e.Name()
+		if strings.HasPrefix(name, "loop") || strings.HasPrefix(name, "ram") ||
+			strings.HasPrefix(name, "zram") || strings.HasPrefix(name, "dm-") {
+			continue
+		}
+		dir := "/sys/block/" + name
+		sectors, _ := strconv.ParseUint(readFact(h, dir+"/size"), 10, 64)
+		disks = append(disks, diskFact{
+			Name:       name,
+			SizeBytes:  sectors * 512, // always 512-byte sectors
+			Model:      readFact(h, dir+"/device/model"),
+			Rotational: readFact(h, dir+"/queue/rotational") == "1",
+		})
+	}
+	return disks
+}
+
+// nicFacts lists the network interfaces other than loopback, by name.
+func nicFacts() []nicFact {
+	ifaces, _ := net.Interfaces()
+	var nics []nicFact
+	for _, i := range ifaces {
+		if i.Flags&net.FlagLoopback != 0 {
+			continue
+		}
+		nics = append(nics, nicFact{Name: i.Name, MAC: i.HardwareAddr.String(), Up: i.Flags&net.FlagUp != 0})
+	}
+	sort.Slice(nics, func(a, b int) bool { return nics[a].Name < nics[b].Name })
+	return nics
+}
+
+// virtualization returns the type of container or virtual machine h is,
+// named as systemd-detect-virt names it, "none" on bare metal: from the
+// files container runtimes leave and the DMI names, and only when those do
+// not tell but the CPU reports a hypervisor, from systemd-detect-virt.
+func (s *System) virtualization(ctx context.Context, h *HostEnv, f *HostFacts) string {
+	if FileExists(h.Path("/.dockerenv")) {
+		return "docker"
+	}
+	if FileExists(h.Path("/run/.containerenv")) {
+		return "podman"
+	}
+	if c := readFact(h, "/run/systemd/container"); c != "" {
+		return c
+	}
+	for _, v := range dmiVirtualization {
+		if strings.Contains(f.Vendor, v.match) || strings.Contains(f.Product, v.match) {
+			return v.virt
+		}
+	}
+	cpuinfo, _ := h.ReadFile("/proc/cpuinfo")
+	if !strings.Contains(string(cpuinfo), " hypervisor") {
+		return "none"
+	}
+	if _, err := exec.LookPath("systemd-detect-virt"); err == nil {
+		out, _ := s.CmdOutput(ctx, "systemd-detect-virt")
+		if v := strings.TrimSpace(string(out)); v != "" {
+			return v
+		}
+	}
+	return "vm"
+}
+
+// Lines returns f as "name: value" lines, for the log and for "bootstrap
+// facts" without --json.
+func (f *HostFacts) Lines() []string {
+	out := []string{
+		"kernel: " + DashIfEmpty(f.Kernel),
+		"arch: " + f.Arch,
+		fmt.Sprintf("cpu: %d x %s", f.CPUCount, DashIfEmpty(f.CPUModel)),
+		"memory: " + bytesFact(f.MemoryBytes),
+		"virtualization: " + f.Virtualization,
+		"firmware: " + DashIfEmpty(f.Firmware),
+		"system: " + DashIfEmpty(strings.TrimSpace(f.Vendor+" "+f.Product)),
+		"bios-version: " + DashIfEmpty(f.BIOSVersion),
+	}
+	for _, d := range f.Disks {
+		kind := "ssd"
+		if d.Rotational {
+			kind = "hdd"
+		}
+		out = append(out, fmt.Sprintf("disk %s: %s %s %s", d.Name, bytesFact(d.SizeBytes), kind, DashIfEmpty(d.Model)))
+	}
+	for _, n := range f.NICs {
+		state := "down"
+		if n.Up {
+			state = "up"
+		}
+		out = append(out, fmt.Sprintf("nic %s: %s %s", n.Name, DashIfEmpty(n.MAC), state))
+	}
+	return out
+}
+
+// bytesFact formats a size fact, "-" if it is unknown.
+func bytesFact(n uint64) string {
+	if n == 0 {
+		return "-"
+	}
+	return config.FormatBytes(n)
+}
+
+// FactsExtraVars returns the facts as the JSON --extra-vars that give the
+// playbook bootstrap_facts.
+func FactsExtraVars(f *HostFacts) (string, error) {
+	data, err := json.Marshal(map[string]*HostFacts{"bootstrap_facts": f})
+	return string(data), err
+}
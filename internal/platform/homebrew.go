@@ -0,0 +1,143 @@
+package platform
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+)
+
+// brewCandidates are where the Homebrew installer puts brew: Apple Silicon,
+// Intel macOS, and Linux (system-wide, then per-user).
+var brewCandidates = []string{
+	"/opt/homebrew/bin/brew",
+	"/usr/local/bin/brew",
+	"/home/linuxbrew/.linuxbrew/bin/brew",
+	"~/.linuxbrew/bin/brew",
+}
+
+// findBrew returns the path of the brew binary, looking on PATH and then at
+// the installer's default locations, or "" if none exists.
+func (s *System) findBrew() string {
+	if p, err := exec.LookPath("brew"); err == nil {
+		return p
+	}
+	homeDir, _ := s.Host.HomeDir()
+	for _, p := range brewCandidates {
+		if rest, ok := strings.CutPrefix(p, "~/"); ok {
+			if homeDir == "" {
+				continue
+			}
+			p = filepath.Join(homeDir, rest)
+		}
+		if FileExists(p) {
+			return p
+		}
+	}
+	return ""
+}
+
+// LoadBrewEnv locates brew and applies the environment from
+// "brew shellenv" (PATH, HOMEBREW_PREFIX, ...) to this process, so that
+// brew and the packages it installs are found by later steps and every
+// child command, even when the installer just ran and the shell profile has
+// not been re-read. It is a no-op if brew is not installed.
+func (s *System) LoadBrewEnv(ctx context.Context) error {
+	brew := s.findBrew()
+	if brew == "" {
+		return nil
+	}
+	// shellenv prints shell code (it refers to the existing $PATH), so let
+	// a shell evaluate it and report the resulting environment.
+	out, err := s.NewCommand(ctx, "/bin/sh", "-c", `eval "$("$0" shellenv)" && env`, brew).Output()
+	if err != nil {
+		return fmt.Errorf("%s shellenv failed: %w", brew, err)
+	}
+	scanner := bufio.NewScanner(bytes.NewReader(out))
+	for scanner.Scan() {
+		k, v, ok := strings.Cut(scanner.Text(), "=")
+		if !ok {
+			continue
+		}
+		if strings.HasPrefix(k, "HOMEBREW_") || k == "PATH" || k == "MANPATH" || k == "INFOPATH" {
+			if os.Getenv(k) != v {
+				os.Setenv(k, v)
+			}
+		}
+	}
+	s.BrewPrefix = os.Getenv("HOMEBREW_PREFIX")
+	if s.BrewPrefix == "" {
+		s.BrewPrefix = filepath.Dir(filepath.Dir(brew))
+	}
+	if s.Config.Verbose {
+		s.Log("Using Homebrew at " + s.BrewPrefix)
+	}
+	return nil
+}
+
+// fetchHomebrewInstaller downloads and verifies the Homebrew install
+// script, returning its path.
+func (s *System) fetchHomebrewInstaller(ctx context.Context) (string, error) {
+	return s.fetchInstallerScript(ctx, "Homebrew", s.Config.HomebrewInstallerURL, s.Config.HomebrewInstallerSHA, "homebrew-installer-sha")
+}
+
+// FileExists reports whether path exists and is not a directory.
+func FileExists(path string) bool {
+	fi, err := os.Stat(path)
+	return err == nil && !fi.IsDir()
+}
+
+// EnsureHomebrew ensures Homebrew is installed on macOS and that brew is on
+// PATH for the rest of the run.
+func (s *System) EnsureHomebrew(ctx context.Context) error {
+	if s.findBrew() != "" {
+		if s.Config.Verbose {
+			s.Log("Homebrew is already installed.")
+		}
+		return s.LoadBrewEnv(ctx)
+	}
+	s.Log("Homebrew is not installed. Attempting to install Homebrew...")
+
+	// Pre-cache sudo credentials.
+	resume := s.Console.pause()
+	err := s.RunCmd(ctx, "sudo", "-v")
+	resume()
+	if err != nil {
+		return fmt.Errorf("failed to get sudo credentials: %w", err)
+	}
+	// The installer runs for a long time and calls sudo itself.
+	s.startSudoKeepalive(ctx)
+
+	script, err := s.fetchHomebrewInstaller(ctx)
+	if err != nil {
+		return err
+	}
+	// NONINTERACTIVE and CI suppress the installer's prompts.
+	cmd := s.NewCommand(ctx, "/bin/bash", script)
+	cmd.Env = append(os.Environ(), "NONINTERACTIVE=1", "CI=1")
+	cmd.Stdout = s.CommandStdout
+	cmd.Stderr = s.CommandStderr
+	s.RecordIrreversible("ran the Homebrew installer")
+	if err := cmd.Run(); err != nil {
+		s.Log("Please ensure your user has the necessary sudo privileges and try again, or install Homebrew manually.")
+		return fmt.Errorf("failed to install Homebrew: %w", err)
+	}
+
+	// The installer only edits shell profiles, so brew is not yet on this
+	// process's PATH.
+	if s.findBrew() == "" {
+		return errors.New("Homebrew installer finished but brew was not found in any standard location")
+	}
+	if err := s.LoadBrewEnv(ctx); err != nil {
+		return err
+	}
+	if err := s.RunCmd(ctx, "brew", "--version"); err != nil {
+		return fmt.Errorf("Homebrew installed but brew --version failed: %w", err)
+	}
+	return nil
+}
@@ -0,0 +1,94 @@
+package platform
+
+import (
+	"errors"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// TestRootEnv names a directory that, for end-to-end tests, stands in for
+// the root of the filesystem: /etc/os-release, /etc/passwd and the machine
+// ID are read from it, and the state directory, the lock, systemd units and
+// the other system files bootstrap writes are kept inside it. The network
+// preflight, which the fake commands standing in for the network's clients
+// make moot, is skipped. It is meant for a sandbox test run with a
+// temporary HOME and fake commands on PATH, never for provisioning.
+const TestRootEnv = EnvPrefix + "TEST_ROOT"
+
+// HostEnv is what bootstrap's detection logic sees of the host: its files,
+// its environment, the effective uid and the home directory. NewHostEnv
+// returns the real host; NewHostEnvFS, over a directory tree (fstest.MapFS,
+// os.DirFS) and a map of variables, describes any other without needing
+// one.
+type HostEnv struct {
+	root    string // the test root, or "" for /
+	fs      fs.FS  // the host's root directory, paths without the leading /
+	getenv  func(key string) string
+	EUID    func() int
+	HomeDir func() (string, error)
+}
+
+// NewHostEnv returns the real host with its root directory at root, or at
+// / if root is "".
+func NewHostEnv(root string) *HostEnv {
+	dir := root
+	if dir == "" {
+		dir = "/"
+	}
+	return &HostEnv{
+		root:    root,
+		fs:      os.DirFS(dir),
+		getenv:  os.Getenv,
+		EUID:    os.Geteuid,
+		HomeDir: os.UserHomeDir,
+	}
+}
+
+// NewHostEnvFS returns a host whose root directory is fsys, whose
+// environment is env and whose effective uid is euid, such as a CentOS 7
+// root without sudo entered through sudo by bob. Its home directory is $HOME,
+// as os.UserHomeDir has it, and Path leaves paths as they are.
+func NewHostEnvFS(fsys fs.FS, env map[string]string, euid int) *HostEnv {
+	return &HostEnv{
+		fs:     fsys,
+		getenv: func(key string) string { return env[key] },
+		EUID:   func() int { return euid },
+		HomeDir: func() (string, error) {
+			if home := env["HOME"]; home != "" {
+				return home, nil
+			}
+			return "", errors.New("$HOME is not defined")
+		},
+	}
+}
+
+// ReadFile reads the file at the absolute path p on h.
+func (h *HostEnv) ReadFile(p string) ([]byte, error) {
+	return fs.ReadFile(h.fs, strings.TrimPrefix(p, "/"))
+}
+
+// Path returns where the absolute path p is on h: p itself, or p inside
+// the test root.
+func (h *HostEnv) Path(p string) string {
+	if h.root == "" {
+		return p
+	}
+	return filepath.Join(h.root, p)
+}
+
+// SystemdRunning reports whether systemd is h's init system, by the
+// directory it creates at boot, as sd_booted(3) does.
+func (h *HostEnv) SystemdRunning() bool {
+	fi, err := fs.Stat(h.fs, "run/systemd/system")
+	return err == nil && fi.IsDir()
+}
+
+// DefaultConfigPath is read when neither --config nor BOOTSTRAP_CONFIG is set.
+// A missing file at this path is not an error.
+const DefaultConfigPath = "/etc/bootstrap/bootstrap.conf"
+
+// EnvPrefix is prepended to the upper-cased flag name to form the environment
+// variable that overrides it (e.g. --repo-url becomes BOOTSTRAP_REPO_URL).
+const EnvPrefix = "BOOTSTRAP_"
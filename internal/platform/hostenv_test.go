@@ -0,0 +1,131 @@
+package platform_test
+
+import (
+	"context"
+	"io/fs"
+	"path/filepath"
+	"strings"
+	"testing"
+	"testing/fstest"
+
+	"github.com/sparkleHazard/bootstrap/internal/config"
+	"github.com/sparkleHazard/bootstrap/internal/platform"
+	"github.com/sparkleHazard/bootstrap/internal/platform/platformtest"
+)
+
+func TestHostEnvMatrix(t *testing.T) {
+	systemd := &fstest.MapFile{Mode: fs.ModeDir | 0755}
+	tests := []struct {
+		name    string
+		files   fstest.MapFS
+		env     map[string]string
+		euid    int
+		sudo    bool // sudo is on PATH
+		os      string
+		invoker string
+		systemd bool
+		selinux string
+		home    string
+		// The commands EnsureEscalation runs, and the error it returns.
+		install []string
+		wantErr string
+	}{
+		{
+			name:    "CentOS 7 with no sudo, running under sudo from user bob",
+			files:   fstest.MapFS{"etc/os-release": {Data: []byte("NAME=\"CentOS Linux\"\nID=\"centos\"\nVERSION_ID=\"7\"\n")}, "run/systemd/system": systemd},
+			env:     map[string]string{"SUDO_USER": "bob", "HOME": "/root"},
+			euid:    0,
+			os:      "centos",
+			invoker: "bob",
+			systemd: true,
+			home:    "/root",
+			install: []string{"sudo yum install -y sudo"},
+		},
+		{
+			name:  "Debian 12 as root in a container",
+			files: fstest.MapFS{"etc/os-release": {Data: []byte("PRETTY_NAME=\"Debian GNU/Linux 12 (bookworm)\"\nID=debian\n")}},
+			env:   map[string]string{"HOME": "/root"},
+			sudo:  true,
+			os:    "debian",
+			home:  "/root",
+		},
+		{
+			name:    "Ubuntu through doas from alice",
+			files:   fstest.MapFS{"etc/os-release": {Data: []byte("ID=ubuntu\nID_LIKE=debian\n")}, "run/systemd/system": systemd},
+			env:     map[string]string{"DOAS_USER": "alice", "HOME": "/root"},
+			sudo:    true,
+			os:      "ubuntu",
+			invoker: "alice",
+			systemd: true,
+			home:    "/root",
+		},
+		{
+			name:  "macOS as a user without sudo",
+			files: fstest.MapFS{"System/Library/CoreServices/SystemVersion.plist": {Data: []byte("<plist/>")}, "etc/os-release": {Data: []byte("ID=debian\n")}},
+			env:   map[string]string{"HOME": "/Users/carol"},
+			euid:  501,
+			os:    "darwin",
+			home:  "/Users/carol",
+		},
+		{
+			name:    "Fedora enforcing SELinux",
+			files:   fstest.MapFS{"etc/os-release": {Data: []byte("ID=fedora\nVERSION_ID=40\n")}, "sys/fs/selinux/enforce": {Data: []byte("1")}, "run/systemd/system": systemd},
+			env:     map[string]string{"HOME": "/home/dave"},
+			euid:    1000,
+			sudo:    true,
+			os:      "fedora",
+			systemd: true,
+			selinux: "enforcing",
+			home:    "/home/dave",
+		},
+		{
+			name:    "no os-release or HOME, as root without sudo",
+			files:   fstest.MapFS{"sys/fs/selinux/enforce": {Data: []byte("0\n")}},
+			selinux: "permissive",
+			os:      "unknown",
+			wantErr: `unsupported OS "unknown" for automatic sudo installation`,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			h := platform.NewHostEnvFS(tt.files, tt.env, tt.euid)
+			if got := platform.DetectOS(h); got != tt.os {
+				t.Errorf("DetectOS = %q, want %q", got, tt.os)
+			}
+			if got := platform.InvokingUser(h); got != tt.invoker {
+				t.Errorf("invokingUser = %q, want %q", got, tt.invoker)
+			}
+			if got := h.SystemdRunning(); got != tt.systemd {
+				t.Errorf("SystemdRunning = %t, want %t", got, tt.systemd)
+			}
+			if got := platform.SelinuxMode(h); got != tt.selinux {
+				t.Errorf("selinuxMode = %q, want %q", got, tt.selinux)
+			}
+			if home, err := h.HomeDir(); home != tt.home || (err != nil) != (tt.home == "") {
+				t.Errorf("HomeDir = %q, %v; want %q", home, err, tt.home)
+			}
+
+			bin := t.TempDir()
+			t.Setenv("PATH", bin)
+			if tt.sudo {
+				writeExecutable(t, filepath.Join(bin, "sudo"))
+			}
+			sys := platform.NewSystem(&config.Config{Escalation: "auto"}, h)
+			runner := &platformtest.Runner{Respond: func(cmd string) (string, error) {
+				if strings.HasSuffix(cmd, " install -y sudo") {
+					writeExecutable(t, filepath.Join(bin, "sudo"))
+				}
+				return "", nil
+			}}
+			sys.SetRunner(runner)
+			sys.SetLogger(&platformtest.Logger{})
+			err := sys.EnsureEscalation(context.Background(), platform.DetectOS(h))
+			if tt.wantErr == "" && err != nil || tt.wantErr != "" && (err == nil || !strings.Contains(err.Error(), tt.wantErr)) {
+				t.Errorf("EnsureEscalation = %v, want error %q", err, tt.wantErr)
+			}
+			if got := runner.Commands(); strings.Join(got, "\n") != strings.Join(tt.install, "\n") {
+				t.Errorf("EnsureEscalation ran:\n  %s\nwant:\n  %s", strings.Join(got, "\n  "), strings.Join(tt.install, "\n  "))
+			}
+		})
+	}
+}
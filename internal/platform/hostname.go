@@ -0,0 +1,201 @@
+package platform
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"os/exec"
+	"strings"
+	"time"
+
+	"github.com/sparkleHazard/bootstrap/internal/config"
+)
+
+// MetadataTimeout bounds each request to a cloud metadata service, which
+// answers at once where there is one.
+const MetadataTimeout = 2 * time.Second
+
+// MetadataBase is the link-local address of the EC2, GCE, Azure and
+// OpenStack metadata services.
+const MetadataBase = "http://169.254.169.254"
+
+// shortHostname returns the first label of name.
+func shortHostname(name string) string {
+	short, _, _ := strings.Cut(name, ".")
+	return short
+}
+
+// SetHostname implements --hostname and --hostname-from-metadata, setting
+// the host name before anything keys off it. It returns the step's status:
+// "set", "unchanged" or "skipped".
+func (s *System) SetHostname(ctx context.Context, osID string) (string, error) {
+	name := s.Config.Hostname
+	if s.Config.HostnameFromMetadata {
+		var err error
+		if name, err = metadataHostname(ctx); err != nil {
+			return "", err
+		}
+		s.Log("The metadata service names this host " + name + ".")
+	}
+	if name == "" {
+		return "skipped", nil
+	}
+	current, _ := os.Hostname()
+	if current == name {
+		if s.Config.Verbose {
+			s.Log("Hostname is already " + name + ".")
+		}
+		return "unchanged", nil
+	}
+	s.Log(fmt.Sprintf("Setting hostname to %s (was %s)...", name, DashIfEmpty(current)))
+	if err := s.applyHostname(ctx, osID, name); err != nil {
+		return "", err
+	}
+	if current != "" {
+		s.RecordUndo("restore hostname "+current, func(ctx context.Context) error {
+			return s.applyHostname(ctx, osID, current)
+		})
+	}
+	return "set", nil
+}
+
+// applyHostname sets the host name to name: with scutil on macOS, with
+// hostnamectl under systemd, and otherwise by writing /etc/hostname and
+// setting the running kernel's with sysctl. On Debian and Ubuntu it also
+// points the 127.0.1.1 entry of /etc/hosts at it, so that sudo can resolve
+// the new name.
+func (s *System) applyHostname(ctx context.Context, osID, name string) error {
+	switch {
+	case osID == "darwin":
+		for _, kv := range [][2]string{{"HostName", name}, {"LocalHostName", shortHostname(name)}, {"ComputerName", shortHostname(name)}} {
+			if err := s.RunCmdSudo(ctx, "scutil", "--set", kv[0], kv[1]); err != nil {
+				return fmt.Errorf("scutil --set %s failed: %w", kv[0], err)
+			}
+		}
+		return nil
+	case s.hasSystemdHostnamectl():
+		if err := s.RunCmdSudo(ctx, "hostnamectl", "set-hostname", name); err != nil {
+			return fmt.Errorf("hostnamectl set-hostname failed: %w", err)
+		}
+	default:
+		if _, err := s.WriteFile(ctx, s.Host.Path("/etc/hostname"), []byte(name+"\n"), 0644, RootOwner); err != nil {
+			return err
+		}
+		if err := s.RunCmdSudo(ctx, "sysctl", "-w", "kernel.hostname="+name); err != nil {
+			return fmt.Errorf("sysctl kernel.hostname failed: %w", err)
+		}
+	}
+	if osID == "debian" || osID == "ubuntu" {
+		return s.updateEtcHosts(ctx, name)
+	}
+	return nil
+}
+
+// hasSystemdHostnamectl reports whether hostnamectl is installed and
+// systemd is running to answer it.
+func (s *System) hasSystemdHostnamectl() bool {
+	if _, err := exec.LookPath("hostnamectl"); err != nil {
+		return false
+	}
+	return s.Host.SystemdRunning()
+}
+
+// updateEtcHosts replaces the 127.0.1.1 entry of /etc/hosts, which Debian's
+// installer maps to the host name, with one for name, adding it if there is
+// none.
+func (s *System) updateEtcHosts(ctx context.Context, name string) error {
+	data, err := s.Host.ReadFile("/etc/hosts")
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		return err
+	}
+	entry := "127.0.1.1\t" + name
+	if short := shortHostname(name); short != name {
+		entry += " " + short
+	}
+	var lines []string
+	found := false
+	for _, line := range strings.Split(strings.TrimRight(string(data), "\n"), "\n") {
+		if f := strings.Fields(line); len(f) > 0 && f[0] == "127.0.1.1" {
+			if !found {
+				lines = append(lines, entry)
+			}
+			found = true
+			continue
+		}
+		lines = append(lines, line)
+	}
+	if !found {
+		lines = append(lines, entry)
+	}
+	_, err = s.WriteFile(ctx, s.Host.Path("/etc/hosts"), []byte(strings.Join(lines, "\n")+"\n"), 0644, RootOwner)
+	return err
+}
+
+// metadataHostname asks the cloud metadata service for this instance's
+// host name, trying GCE, Azure and then EC2 (whose API OpenStack also
+// serves), and checks that the answer is a valid host name.
+func metadataHostname(ctx context.Context) (string, error) {
+	client := &http.Client{
+		Timeout: MetadataTimeout,
+		// The metadata service is link-local; a proxy cannot reach it.
+		Transport: &http.Transport{Proxy: nil},
+	}
+	get := func(path string, header http.Header) (string, error) {
+		req, err := http.NewRequestWithContext(ctx, http.MethodGet, MetadataBase+path, nil)
+		if err != nil {
+			return "", err
+		}
+		req.Header = header
+		resp, err := client.Do(req)
+		if err != nil {
+			return "", err
+		}
+		defer resp.Body.Close()
+		if resp.StatusCode != http.StatusOK {
+			return "", fmt.Errorf("HTTP %d", resp.StatusCode)
+		}
+		body, err := io.ReadAll(io.LimitReader(resp.Body, 1024))
+		return strings.TrimSpace(string(body)), err
+	}
+
+	var errs []error
+	name, err := get("/computeMetadata/v1/instance/hostname", http.Header{"Metadata-Flavor": {"Google"}})
+	if err == nil {
+		return checkMetadataHostname(name)
+	}
+	errs = append(errs, fmt.Errorf("GCE: %w", err))
+	name, err = get("/metadata/instance/compute/name?api-version=2021-02-01&format=text", http.Header{"Metadata": {"true"}})
+	if err == nil {
+		return checkMetadataHostname(name)
+	}
+	errs = append(errs, fmt.Errorf("Azure: %w", err))
+	// IMDSv2 needs a session token; OpenStack and IMDSv1 answer without.
+	header := http.Header{}
+	if req, err := http.NewRequestWithContext(ctx, http.MethodPut, MetadataBase+"/latest/api/token", nil); err == nil {
+		req.Header.Set("X-aws-ec2-metadata-token-ttl-seconds", "60")
+		if resp, err := client.Do(req); err == nil {
+			token, _ := io.ReadAll(io.LimitReader(resp.Body, 1024))
+			resp.Body.Close()
+			if resp.StatusCode == http.StatusOK {
+				header.Set("X-aws-ec2-metadata-token", string(token))
+			}
+		}
+	}
+	name, err = get("/latest/meta-data/local-hostname", header)
+	if err == nil {
+		return checkMetadataHostname(name)
+	}
+	errs = append(errs, fmt.Errorf("EC2: %w", err))
+	return "", fmt.Errorf("no cloud metadata service answered with a host name: %w", errors.Join(errs...))
+}
+
+// checkMetadataHostname returns name if it is a valid host name.
+func checkMetadataHostname(name string) (string, error) {
+	if !config.ValidHostname(name) {
+		return "", fmt.Errorf("the metadata service's host name %q is not a valid RFC 1123 host name", name)
+	}
+	return name, nil
+}
@@ -0,0 +1,128 @@
+package platform
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// journalSocket is where journald receives entries in its native protocol.
+const journalSocket = "/run/systemd/journal/socket"
+
+// LogTargets are the values of --log-target: journald when stdout is
+// connected to the journal (as for a systemd service), the console, or
+// journald regardless.
+var LogTargets = []string{"auto", "console", "journald"}
+
+// JournalFields are extra fields of a journal entry, by name.
+type JournalFields map[string]string
+
+type journalLogger struct {
+	mu   sync.Mutex
+	conn *net.UnixConn // nil unless logging to journald
+	role string
+	step string
+}
+
+// OpenJournal connects to journald if --log-target selects it. Where
+// journald is not running, messages go to the console as usual.
+func (s *System) OpenJournal() {
+	s.Journal.role = s.Config.Role
+	switch s.Config.LogTarget {
+	case "console":
+		return
+	case "auto":
+		if !stdoutIsJournal() {
+			return
+		}
+	}
+	conn, err := net.DialUnix("unixgram", nil, &net.UnixAddr{Name: s.Host.Path(journalSocket), Net: "unixgram"})
+	if err != nil {
+		return
+	}
+	s.Journal.conn = conn
+}
+
+// stdoutIsJournal reports whether stdout is the stream systemd connected to
+// the journal, which it names in $JOURNAL_STREAM as device:inode.
+func stdoutIsJournal() bool {
+	dev, ino, ok := strings.Cut(os.Getenv("JOURNAL_STREAM"), ":")
+	if !ok {
+		return false
+	}
+	var st syscall.Stat_t
+	if err := syscall.Fstat(int(os.Stdout.Fd()), &st); err != nil {
+		return false
+	}
+	return dev == strconv.FormatUint(uint64(st.Dev), 10) && ino == strconv.FormatUint(uint64(st.Ino), 10)
+}
+
+// SetStep makes step the BOOTSTRAP_STEP of the entries that follow.
+func (j *journalLogger) SetStep(step string) {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	j.step = step
+}
+
+// Send writes msg with fields, which may set its PRIORITY, to the journal.
+// It reports false, having sent nothing, unless journald is the log target
+// and accepted the entry.
+func (j *journalLogger) Send(msg string, fields JournalFields) bool {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	if j.conn == nil {
+		return false
+	}
+	var b bytes.Buffer
+	writeJournalField(&b, "MESSAGE", msg)
+	if _, ok := fields["PRIORITY"]; !ok {
+		writeJournalField(&b, "PRIORITY", strconv.Itoa(journalPriority(msg)))
+	}
+	writeJournalField(&b, "SYSLOG_IDENTIFIER", "bootstrap")
+	writeJournalField(&b, "BOOTSTRAP_ROLE", j.role)
+	if j.step != "" {
+		writeJournalField(&b, "BOOTSTRAP_STEP", j.step)
+	}
+	for _, k := range SortedKeys(fields) {
+		writeJournalField(&b, k, fields[k])
+	}
+	_, err := j.conn.Write(b.Bytes())
+	return err == nil
+}
+
+// writeJournalField appends a field in journald's native format: KEY=value
+// on a line, or, for a value spanning lines, KEY on a line followed by the
+// value's length as a little-endian uint64 and the value itself.
+func writeJournalField(b *bytes.Buffer, key, value string) {
+	if !strings.Contains(value, "\n") {
+		fmt.Fprintf(b, "%s=%s\n", key, value)
+		return
+	}
+	b.WriteString(key + "\n")
+	binary.Write(b, binary.LittleEndian, uint64(len(value)))
+	b.WriteString(value + "\n")
+}
+
+// journalPriority returns the syslog priority of a message: err for a
+// failure, warning for a warning, and info otherwise.
+func journalPriority(msg string) int {
+	switch {
+	case strings.HasPrefix(msg, "Bootstrap failed"), strings.HasPrefix(msg, "Configuration error"):
+		return 3
+	case strings.HasPrefix(msg, "Warning"):
+		return 4
+	}
+	return 6
+}
+
+// DurationMS formats d in milliseconds for DURATION_MS.
+func DurationMS(d time.Duration) string {
+	return strconv.FormatInt(d.Milliseconds(), 10)
+}
@@ -0,0 +1,161 @@
+package platform
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"regexp"
+	"strings"
+)
+
+// LocaleRegex matches the UTF-8 locales --locale accepts: a language and
+// territory, or C, with a UTF-8 codeset.
+var LocaleRegex = regexp.MustCompile(`^([a-z]{2,3}_[A-Z]{2}|C)\.(UTF-8|utf8)$`)
+
+// fallbackLocale is used when the configured locale cannot be generated;
+// current glibc always has it.
+const fallbackLocale = "C.UTF-8"
+
+// normalizeLocale returns name as "locale -a" lists it: the codeset lower
+// case without hyphens (en_US.UTF-8 is listed as en_US.utf8).
+func normalizeLocale(name string) string {
+	lang, codeset, ok := strings.Cut(name, ".")
+	if !ok {
+		return name
+	}
+	return lang + "." + strings.ReplaceAll(strings.ToLower(codeset), "-", "")
+}
+
+// activeLocale returns the locale that governs character handling, as
+// setlocale(3) picks it from the environment.
+func activeLocale() string {
+	for _, v := range []string{"LC_ALL", "LC_CTYPE", "LANG"} {
+		if l := os.Getenv(v); l != "" {
+			return l
+		}
+	}
+	return ""
+}
+
+// isUTF8Locale reports whether the locale name has a UTF-8 codeset.
+func isUTF8Locale(name string) bool {
+	_, codeset, _ := strings.Cut(name, ".")
+	return normalizeLocale("x."+codeset) == "x.utf8"
+}
+
+// availableLocales returns the locales "locale -a" lists, normalized.
+func (s *System) availableLocales(ctx context.Context) map[string]bool {
+	out, err := s.CmdOutput(ctx, "locale", "-a")
+	if err != nil {
+		return nil
+	}
+	locales := map[string]bool{}
+	for _, l := range strings.Fields(string(out)) {
+		locales[normalizeLocale(l)] = true
+	}
+	return locales
+}
+
+// SetupLocale makes sure the commands the run executes, ansible-pull above
+// all, get a UTF-8 locale: cfg.Locale, generated if it is missing, or else
+// C.UTF-8. The locale is exported as LANG and LC_ALL for those commands;
+// the host's default locale is not changed. A locale that cannot be set up
+// is warned about and never fails the run. It returns the step's status.
+func (s *System) SetupLocale(ctx context.Context, osID string) string {
+	if s.Config.SkipLocaleSetup {
+		s.Log("Skipping locale setup.")
+		return "skipped"
+	}
+	active := activeLocale()
+	available := s.availableLocales(ctx)
+	// macOS ships every locale.
+	if isUTF8Locale(active) && (osID == "darwin" || available[normalizeLocale(active)]) {
+		if s.Config.Verbose {
+			s.Log("Locale " + active + " is UTF-8 and available.")
+		}
+		return "ok"
+	}
+
+	status := "enabled"
+	if !available[normalizeLocale(s.Config.Locale)] {
+		s.Log("Locale " + s.Config.Locale + " is not available; generating it...")
+		if err := s.generateLocale(ctx, osID, s.Config.Locale); err != nil {
+			s.Log("Warning: generating locale " + s.Config.Locale + " failed: " + err.Error())
+		}
+		available = s.availableLocales(ctx)
+		status = "generated"
+	}
+	chosen := s.Config.Locale
+	if !available[normalizeLocale(chosen)] {
+		if !available[normalizeLocale(fallbackLocale)] {
+			s.Log(fmt.Sprintf("Warning: neither %s nor %s is available; ansible may warn about the locale (%s).", s.Config.Locale, fallbackLocale, DashIfEmpty(active)))
+			return "unavailable"
+		}
+		s.Log(fmt.Sprintf("Warning: %s is not available; using %s.", s.Config.Locale, fallbackLocale))
+		chosen, status = fallbackLocale, "fallback"
+	}
+	s.Log(fmt.Sprintf("Using locale %s (was %s).", chosen, DashIfEmpty(active)))
+	os.Setenv("LANG", chosen)
+	os.Setenv("LC_ALL", chosen)
+	return status
+}
+
+// generateLocale compiles name: through /etc/locale.gen and locale-gen on
+// Debian and Ubuntu, installing the locales package if need be, and with
+// localedef, or else the language's glibc langpack, on Fedora and EL.
+func (s *System) generateLocale(ctx context.Context, osID, name string) error {
+	lang, _, _ := strings.Cut(name, ".")
+	switch osID {
+	case "debian", "ubuntu":
+		if !FileExists(s.Host.Path("/usr/sbin/locale-gen")) {
+			if err := s.RefreshPackageIndex(ctx, "apt-get"); err != nil {
+				return err
+			}
+			if err := s.RunPkgCmd(ctx, "apt-get", "install", "-y", "locales"); err != nil {
+				return fmt.Errorf("installing locales: %w", err)
+			}
+			s.RecordIrreversible("installed locales")
+		}
+		if err := s.enableLocaleGen(ctx, lang+".UTF-8"); err != nil {
+			return err
+		}
+		s.RecordIrreversible("generated locale " + name)
+		return s.RunCmdSudo(ctx, "locale-gen")
+	case "fedora", "centos", "redhat":
+		if s.RunCmdSudo(ctx, "localedef", "-i", lang, "-f", "UTF-8", name) == nil {
+			s.RecordIrreversible("generated locale " + name)
+			return nil
+		}
+		manager := "dnf"
+		if osID != "fedora" {
+			manager = "yum"
+		}
+		pkg := "glibc-langpack-" + strings.SplitN(lang, "_", 2)[0]
+		if err := s.RunPkgCmd(ctx, manager, "install", "-y", pkg); err != nil {
+			return fmt.Errorf("installing %s: %w", pkg, err)
+		}
+		s.RecordIrreversible("installed " + pkg)
+		return nil
+	}
+	return fmt.Errorf("generating locales is not supported on %s", osID)
+}
+
+// enableLocaleGen uncomments locale's line in /etc/locale.gen, or adds one,
+// so that locale-gen compiles it.
+func (s *System) enableLocaleGen(ctx context.Context, locale string) error {
+	want := locale + " UTF-8"
+	data, _ := s.Host.ReadFile("/etc/locale.gen")
+	var lines []string
+	found := false
+	for _, line := range strings.Split(strings.TrimRight(string(data), "\n"), "\n") {
+		if strings.TrimSpace(strings.TrimLeft(line, "# ")) == want {
+			line, found = want, true
+		}
+		lines = append(lines, line)
+	}
+	if !found {
+		lines = append(lines, want)
+	}
+	_, err := s.WriteFile(ctx, s.Host.Path("/etc/locale.gen"), []byte(strings.Join(lines, "\n")+"\n"), 0644, RootOwner)
+	return err
+}
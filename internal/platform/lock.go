@@ -0,0 +1,100 @@
+package platform
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"time"
+)
+
+// systemLockPath is the lock file used when running as root.
+const systemLockPath = "/var/lock/bootstrap.lock"
+
+// lockPollInterval is how often a held lock is retried while waiting.
+const lockPollInterval = time.Second
+
+// runLock is an exclusive flock held for the duration of a run. The kernel
+// releases it when the process exits, however that happens.
+type runLock struct {
+	f *os.File
+}
+
+// lockPath returns the lock file for this user: the system-wide path for
+// root, otherwise a per-user path under XDG_RUNTIME_DIR or the temp dir.
+func (s *System) lockPath() string {
+	if s.Host.EUID() == 0 {
+		if _, err := os.Stat(s.Host.Path(filepath.Dir(systemLockPath))); err == nil {
+			return s.Host.Path(systemLockPath)
+		}
+	}
+	dir := os.Getenv("XDG_RUNTIME_DIR")
+	if dir == "" {
+		dir = os.TempDir()
+	}
+	return filepath.Join(dir, fmt.Sprintf("bootstrap-%d.lock", s.Host.EUID()))
+}
+
+// AcquireRunLock takes the run lock, waiting up to cfg.LockWait for another
+// instance to release it. The holder's PID and start time are recorded in
+// the lock file and logged when the lock is busy.
+func (s *System) AcquireRunLock(ctx context.Context) (*runLock, error) {
+	path := s.lockPath()
+	// Outside XDG_RUNTIME_DIR the lock is in the shared temp dir, where
+	// another user could plant a symlink or a file of their own.
+	f, err := OpenFile(path, os.O_RDWR, 0600)
+	if err != nil {
+		return nil, fmt.Errorf("unable to open lock file %s: %w", path, err)
+	}
+
+	deadline := time.Now().Add(s.Config.LockWait)
+	logged := false
+	for {
+		err := syscall.Flock(int(f.Fd()), syscall.LOCK_EX|syscall.LOCK_NB)
+		if err == nil {
+			break
+		}
+		if !errors.Is(err, syscall.EWOULDBLOCK) {
+			f.Close()
+			return nil, fmt.Errorf("unable to lock %s: %w", path, err)
+		}
+		holder := lockHolder(path)
+		if time.Now().After(deadline) {
+			f.Close()
+			return nil, WithExitCode(ExitLocked, fmt.Errorf("another bootstrap is already running (%s)", holder))
+		}
+		if !logged {
+			s.Log(fmt.Sprintf("Another bootstrap is running (%s); waiting up to %s for it to finish...", holder, s.Config.LockWait))
+			logged = true
+		}
+		select {
+		case <-ctx.Done():
+			f.Close()
+			return nil, ctx.Err()
+		case <-time.After(lockPollInterval):
+		}
+	}
+
+	if err := f.Truncate(0); err == nil {
+		fmt.Fprintf(f, "pid=%d\nstarted=%s\n", os.Getpid(), time.Now().Format(time.RFC3339))
+	}
+	return &runLock{f: f}, nil
+}
+
+// lockHolder describes the process recorded in the lock file at path.
+func lockHolder(path string) string {
+	data, err := os.ReadFile(path)
+	if err != nil || len(data) == 0 {
+		return "holder unknown"
+	}
+	return strings.Join(strings.Fields(string(data)), ", ")
+}
+
+// Release truncates the holder record and drops the lock.
+func (l *runLock) Release() {
+	l.f.Truncate(0)
+	l.f.Close()
+}
@@ -0,0 +1,95 @@
+package platform
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// SystemStateDir holds bootstrap's persistent state when running as root.
+const SystemStateDir = "/var/lib/bootstrap"
+
+// SuccessMarkerName is the file, within StateDir, written after a fully
+// successful run.
+const SuccessMarkerName = "last-success.json"
+
+// successMarker records a fully successful run.
+type successMarker struct {
+	ConfigHash string    `json:"config_hash"`
+	Version    string    `json:"version"`
+	Role       string    `json:"role"`
+	FinishedAt time.Time `json:"finished_at"`
+
+	// AnsibleCommit is the commit of the ansible repository applied.
+	AnsibleCommit string `json:"ansible_commit,omitempty"`
+}
+
+// StateDir returns the directory for persistent state: SystemStateDir for
+// root, otherwise $XDG_STATE_HOME/bootstrap or ~/.local/state/bootstrap.
+func (s *System) StateDir() (string, error) {
+	if s.Host.EUID() == 0 {
+		return s.Host.Path(SystemStateDir), nil
+	}
+	if dir := os.Getenv("XDG_STATE_HOME"); dir != "" {
+		return filepath.Join(dir, "bootstrap"), nil
+	}
+	homeDir, err := s.Host.HomeDir()
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(homeDir, ".local", "state", "bootstrap"), nil
+}
+
+// AlreadyBootstrapped reports whether a success marker matching hash, that
+// of the current configuration, exists and, if cfg.SkipIfBootstrapped.MaxAge
+// is set, is recent enough. The reason is suitable for logging either way.
+func (s *System) AlreadyBootstrapped(hash string) (bool, string) {
+	dir, err := s.StateDir()
+	if err != nil {
+		return false, "Unable to determine state directory: " + err.Error()
+	}
+	path := filepath.Join(dir, SuccessMarkerName)
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return false, "No success marker at " + path
+	}
+	var m successMarker
+	if err := json.Unmarshal(data, &m); err != nil {
+		return false, fmt.Sprintf("Ignoring unreadable success marker %s: %v", path, err)
+	}
+	if m.ConfigHash != hash {
+		return false, "Configuration changed since the last successful run"
+	}
+	age := time.Since(m.FinishedAt)
+	if maxAge := s.Config.SkipIfBootstrapped.MaxAge; maxAge > 0 && age > maxAge {
+		return false, fmt.Sprintf("Last successful run was %s ago (max %s)", age.Round(time.Second), maxAge)
+	}
+	return true, fmt.Sprintf("Host was bootstrapped %s ago by %s with the same configuration", age.Round(time.Second), m.Version)
+}
+
+// WriteSuccessMarker records a successful run finished at t, which applied
+// commit of the ansible repository, with hash, that of its configuration.
+func (s *System) WriteSuccessMarker(ctx context.Context, t time.Time, commit, hash string) error {
+	dir, err := s.StateDir()
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return err
+	}
+	data, err := json.MarshalIndent(successMarker{
+		ConfigHash:    hash,
+		Version:       ToolVersion(),
+		Role:          s.Config.Role,
+		FinishedAt:    t,
+		AnsibleCommit: commit,
+	}, "", "  ")
+	if err != nil {
+		return err
+	}
+	_, err = s.WriteFile(ctx, filepath.Join(dir, SuccessMarkerName), append(data, '\n'), 0644, "")
+	return err
+}
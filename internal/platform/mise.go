@@ -0,0 +1,187 @@
+package platform
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"os/exec"
+	"os/user"
+	"path/filepath"
+	"strings"
+)
+
+// miseLocations are where mise is commonly installed besides the Homebrew
+// prefix: the official installer's per-user directory, then system-wide.
+// A leading "~/" is the target user's home directory.
+var miseLocations = []string{
+	"~/.local/bin/mise",
+	"/usr/local/bin/mise",
+	"/opt/homebrew/bin/mise",
+	"/home/linuxbrew/.linuxbrew/bin/mise",
+}
+
+// findMise returns the absolute path of the mise binary for u: --mise-path
+// if set, else where EnsureMise put it, else mise on u's login PATH, else
+// the first of the Homebrew prefix and miseLocations that exists.
+func (s *System) findMise(ctx context.Context, u *user.User) (string, error) {
+	if s.Config.MisePath != "" {
+		if !FileExists(s.Config.MisePath) {
+			return "", fmt.Errorf("mise-path %s does not exist", s.Config.MisePath)
+		}
+		return s.Config.MisePath, nil
+	}
+	if s.installedMise != "" {
+		return s.installedMise, nil
+	}
+	if cmd, err := s.commandAsUser(ctx, u, "command -v mise"); err == nil {
+		if out, err := cmd.Output(); err == nil {
+			if p := strings.TrimSpace(string(out)); filepath.IsAbs(p) && FileExists(p) {
+				return p, nil
+			}
+		}
+	}
+	var checked []string
+	candidates := miseLocations
+	if s.BrewPrefix != "" {
+		candidates = append([]string{filepath.Join(s.BrewPrefix, "bin", "mise")}, candidates...)
+	}
+	for _, p := range candidates {
+		if rest, ok := strings.CutPrefix(p, "~/"); ok {
+			p = filepath.Join(u.HomeDir, rest)
+		}
+		if FileExists(p) {
+			return p, nil
+		}
+		checked = append(checked, p)
+	}
+	return "", fmt.Errorf("mise not found for user %s on their PATH or in %s; install it or set --mise-path",
+		u.Username, strings.Join(checked, ", "))
+}
+
+// EnsureMise installs mise for the target user unless findMise already
+// locates it. Homebrew is used when present, otherwise the official install
+// script, verified against --mise-installer-sha. Both run as the target user,
+// never as root, so mise ends up in that user's prefix.
+func (s *System) EnsureMise(ctx context.Context) error {
+	u, err := s.TargetUser()
+	if err != nil {
+		return err
+	}
+	if p, err := s.findMise(ctx, u); err == nil {
+		if s.Config.Verbose {
+			s.Log("mise is already installed at " + p)
+		}
+		s.installedMise = p
+		return nil
+	}
+
+	var cmd *Command
+	if brew := s.findBrew(); brew != "" {
+		s.Log("Installing mise for " + u.Username + " with Homebrew...")
+		cmd, err = s.commandAsUser(ctx, u, ShellQuote(brew)+" install mise")
+		if err != nil {
+			return err
+		}
+	} else {
+		s.Log("Installing mise for " + u.Username + " with the official installer...")
+		script, err := s.fetchInstallerScript(ctx, "mise", s.Config.MiseInstallerURL, s.Config.MiseInstallerSHA, "mise-installer-sha")
+		if err != nil {
+			return err
+		}
+		// The script is in our private working directory, which the target
+		// user cannot read, so hand it over on stdin.
+		f, err := os.Open(script)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		cmd, err = s.commandAsUser(ctx, u, "sh -s")
+		if err != nil {
+			return err
+		}
+		cmd.Stdin = f
+	}
+	cmd.Stdout = s.CommandStdout
+	cmd.Stderr = s.CommandStderr
+	s.RecordIrreversible("installed mise for " + u.Username)
+	if err := cmd.Run(); err != nil {
+		return fmt.Errorf("installing mise for %s failed: %w", u.Username, err)
+	}
+	p, err := s.findMise(ctx, u)
+	if err != nil {
+		return fmt.Errorf("mise installer finished, but %w", err)
+	}
+	s.installedMise = p
+	s.Log("mise installed at " + p)
+	return nil
+}
+
+// ShellQuote quotes s for use as a single word in a /bin/sh command line.
+func ShellQuote(s string) string {
+	return "'" + strings.ReplaceAll(s, "'", `'\''`) + "'"
+}
+
+// resolveMiseCmd returns cfg.MiseCmd resolved with ResolveCmd.
+func (s *System) resolveMiseCmd(ctx context.Context, u *user.User) (string, error) {
+	return s.ResolveCmd(ctx, u, s.Config.MiseCmd)
+}
+
+// ResolveCmd returns cmdLine with a bare program name replaced by its
+// absolute path, since the systemd unit it goes into does not have the
+// user's PATH. mise itself is located with findMise and must exist; other
+// programs are looked up in the Homebrew prefix and then PATH.
+func (s *System) ResolveCmd(ctx context.Context, u *user.User, cmdLine string) (string, error) {
+	prog, rest, _ := strings.Cut(cmdLine, " ")
+	if strings.Contains(prog, "/") {
+		return cmdLine, nil
+	}
+	path := ""
+	if prog == "mise" {
+		p, err := s.findMise(ctx, u)
+		if err != nil {
+			return "", err
+		}
+		path = p
+	}
+	if path == "" && s.BrewPrefix != "" {
+		if p := filepath.Join(s.BrewPrefix, "bin", prog); FileExists(p) {
+			path = p
+		}
+	}
+	if path == "" {
+		if p, err := exec.LookPath(prog); err == nil {
+			path = p
+		}
+	}
+	if path == "" {
+		return cmdLine, nil
+	}
+	if rest == "" {
+		return path, nil
+	}
+	return path + " " + rest, nil
+}
+
+// RunMiseNow runs the mise command in the foreground as the target user,
+// instead of deferring it to a unit that runs after a reboot.
+func (s *System) RunMiseNow(ctx context.Context) error {
+	u, err := s.TargetUser()
+	if err != nil {
+		return err
+	}
+	miseCmd, err := s.resolveMiseCmd(ctx, u)
+	if err != nil {
+		return err
+	}
+	s.Log("Running " + miseCmd + " as " + u.Username + "...")
+	cmd, err := s.commandAsUser(ctx, u, miseCmd)
+	if err != nil {
+		return err
+	}
+	cmd.Stdout = s.CommandStdout
+	cmd.Stderr = s.CommandStderr
+	if err := cmd.Run(); err != nil {
+		return fmt.Errorf("%s failed: %w", miseCmd, err)
+	}
+	return nil
+}
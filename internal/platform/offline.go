@@ -0,0 +1,25 @@
+package platform
+
+import (
+	"fmt"
+	"net/url"
+)
+
+// AllowKeyserver makes host, the keyserver's, one --offline allows.
+func (s *System) AllowKeyserver(host string) {
+	s.KeyserverHost = host
+}
+
+// CheckOfflineURL returns an error naming what must be pre-staged if
+// --offline is set and rawURL's host is not allowlisted.
+func (s *System) CheckOfflineURL(rawURL, artifact string) error {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return err
+	}
+	if s.Config.HostAllowed(u.Hostname(), s.KeyserverHost) {
+		return nil
+	}
+	return fmt.Errorf("offline mode: %s would be downloaded from %s, which is not in allow-hosts; pre-stage %s or allowlist a mirror",
+		artifact, u.Hostname(), artifact)
+}
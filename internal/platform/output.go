@@ -0,0 +1,136 @@
+package platform
+
+import (
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// stepOutputMax is how much of the current step's output StepOutput keeps.
+const stepOutputMax = 16 * 1024
+
+// runOutputMax is how much of the whole run's output RunOutput keeps.
+const runOutputMax = 64 * 1024
+
+// quietOutputLines is how much of the failed step's output --quiet shows.
+const quietOutputLines = 50
+
+// commandWriter passes a child command's output to terminal, unless
+// --quiet, keeping it in StepOutput either way.
+type commandWriter struct {
+	terminal io.Writer
+	sys      *System
+}
+
+func (w commandWriter) Write(p []byte) (int, error) {
+	w.sys.StepOutput.Write(p)
+	w.sys.RunOutput.Write(p)
+	if w.sys.Config.Quiet {
+		return len(p), nil
+	}
+	return w.terminal.Write(p)
+}
+
+// ShowStepOutput prints the end of the failed step's output, which --quiet
+// kept off the terminal.
+func (s *System) ShowStepOutput(step string) {
+	out := strings.TrimRight(s.StepOutput.String(), "\n")
+	if out == "" {
+		return
+	}
+	lines := strings.Split(out, "\n")
+	if len(lines) > quietOutputLines {
+		lines = lines[len(lines)-quietOutputLines:]
+	}
+	fmt.Fprintf(s.ConsoleStdout, "--- last %d lines of output from %s ---\n%s\n---\n", len(lines), DashIfEmpty(step), strings.Join(lines, "\n"))
+}
+
+// syncTail is a TailBuffer that is safe for concurrent use, as by a
+// command's stdout and stderr.
+type syncTail struct {
+	mu   sync.Mutex
+	tail TailBuffer
+}
+
+func (s *syncTail) Write(p []byte) (int, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.tail.Write(p)
+}
+
+// Reset discards the retained output.
+func (s *syncTail) Reset() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.tail.buf = nil
+}
+
+// String returns the retained output.
+func (s *syncTail) String() string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return string(s.tail.Bytes())
+}
+
+// Logger receives the messages a run logs, with the fields that go with
+// them in the journal, e.g. "BOOTSTRAP_STATUS".
+type Logger interface {
+	Log(msg string, fields map[string]string)
+}
+
+// SetLogger has the run's messages go to l rather than to the terminal or
+// journald. They are kept in StepOutput either way.
+func (s *System) SetLogger(l Logger) {
+	s.logger = l
+}
+
+// Log prints a timestamped message to stdout, or sends it to journald when
+// that is the log target, and keeps it in StepOutput.
+func (s *System) Log(msg string) {
+	s.LogFields(msg, nil)
+}
+
+// LogFields is log, attaching fields to the message's journal entry.
+func (s *System) LogFields(msg string, fields JournalFields) {
+	now := time.Now().Format("2006-01-02 15:04:05")
+	line := fmt.Sprintf("[%s] %s\n", now, msg)
+	if s.logger != nil {
+		s.logger.Log(msg, fields)
+	} else if !s.Journal.Send(msg, fields) {
+		fmt.Fprint(s.ConsoleStdout, line)
+	}
+	s.StepOutput.Write([]byte(line))
+	s.RunOutput.Write([]byte(line))
+}
+
+// SortedKeys returns the keys of m in order, for output that does not
+// change from run to run.
+func SortedKeys[V any](m map[string]V) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// DashIfEmpty returns s, or "-" for an empty table cell.
+func DashIfEmpty(s string) string {
+	if s == "" {
+		return "-"
+	}
+	return s
+}
+
+// LastLine returns the last non-empty line of out, or err's message if
+// there is none.
+func LastLine(out []byte, err error) string {
+	lines := strings.Split(strings.TrimSpace(string(out)), "\n")
+	if l := strings.TrimSpace(lines[len(lines)-1]); l != "" {
+		return l
+	}
+	return err.Error()
+}
@@ -0,0 +1,331 @@
+package platform
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"os/exec"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// pkgLockPollInterval is how often a package command is retried while
+// another process holds the package manager lock.
+const pkgLockPollInterval = 10 * time.Second
+
+// pkgLockRegex matches the messages apt, dpkg, dnf, and yum print when
+// another process holds their lock.
+var pkgLockRegex = regexp.MustCompile(`(?i)could not get lock|unable to acquire the dpkg frontend lock|waiting for process with pid|another app is currently holding the yum lock`)
+
+// dpkgInterruptedRegex matches the message apt and dpkg print when an
+// earlier dpkg run was interrupted, leaving packages half-configured. No
+// one holds the lock then, so waiting does not help; "dpkg --configure -a"
+// does.
+var dpkgInterruptedRegex = regexp.MustCompile(`(?i)dpkg was interrupted`)
+
+// RunPkgCmd runs a package manager command with sudo, waiting up to
+// cfg.PackageLockTimeout for the package manager lock when another process
+// (typically unattended-upgrades on a freshly booted host) holds it.
+func (s *System) RunPkgCmd(ctx context.Context, name string, args ...string) error {
+	return s.RunPkgCmdTee(ctx, nil, name, args...)
+}
+
+// RunPkgCmdTee is RunPkgCmd, additionally copying the command's output to
+// capture when it is non-nil. If apt or dpkg reports an interrupted earlier
+// dpkg run, "dpkg --configure -a" is run once to finish it and the command
+// is retried.
+func (s *System) RunPkgCmdTee(ctx context.Context, capture io.Writer, name string, args ...string) error {
+	// apt that waits for the lock itself needs no polling.
+	aptWaits := name == "apt-get" && s.aptSupportsLockTimeout(ctx)
+	repaired := false
+	deadline := time.Now().Add(s.Config.PackageLockTimeout)
+	for {
+		out := &TailBuffer{Max: 64 * 1024}
+		var w io.Writer = out
+		if capture != nil {
+			w = io.MultiWriter(out, capture)
+		}
+		var err error
+		if aptWaits {
+			secs := int(s.Config.PackageLockTimeout.Seconds())
+			lockArgs := append([]string{"-o", fmt.Sprintf("DPkg::Lock::Timeout=%d", secs)}, args...)
+			err = s.runCmdSudoTee(ctx, w, name, lockArgs...)
+		} else {
+			err = s.runCmdSudoTee(ctx, w, name, args...)
+		}
+		if err != nil && dpkgInterruptedRegex.Match(out.Bytes()) {
+			if repaired {
+				return fmt.Errorf("%s %s failed: dpkg still reports an interrupted run after \"dpkg --configure -a\": %w",
+					name, strings.Join(args, " "), err)
+			}
+			repaired = true
+			s.Log("An earlier dpkg run was interrupted; running dpkg --configure -a to finish it...")
+			if cerr := s.runCmdSudoTee(ctx, capture, "dpkg", "--configure", "-a"); cerr != nil {
+				return fmt.Errorf("%s %s failed because an earlier dpkg run was interrupted, and dpkg --configure -a failed: %w",
+					name, strings.Join(args, " "), cerr)
+			}
+			continue
+		}
+		if err == nil || aptWaits || !pkgLockRegex.Match(out.Bytes()) {
+			return pkgCmdError(err, name, args)
+		}
+		remaining := time.Until(deadline)
+		if remaining <= 0 {
+			return fmt.Errorf("%s lock still held after %s: %w", name, s.Config.PackageLockTimeout, err)
+		}
+		s.Log(fmt.Sprintf("%s lock is held by another process; retrying in %s (%s left)...",
+			name, pkgLockPollInterval, remaining.Round(time.Second)))
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(min(pkgLockPollInterval, remaining)):
+		}
+	}
+}
+
+// pkgCmdError names the package manager command in a non-nil err from it.
+func pkgCmdError(err error, name string, args []string) error {
+	if err == nil {
+		return nil
+	}
+	return fmt.Errorf("%s %s failed: %w", name, strings.Join(args, " "), err)
+}
+
+// InstallOutputMax bounds how much package manager output is kept for
+// attaching to an installation failure.
+const InstallOutputMax = 4 * 1024
+
+// VerifyInstalled checks that cmdName is on PATH after an installation
+// attempt, returning an error carrying the installer's captured output if
+// it is still missing.
+func VerifyInstalled(cmdName string, out *TailBuffer) error {
+	if _, err := exec.LookPath(cmdName); err == nil {
+		return nil
+	}
+	msg := fmt.Sprintf("%s is still not on PATH after installation", cmdName)
+	if tail := strings.TrimSpace(string(out.Bytes())); tail != "" {
+		msg += "; installer output:\n" + tail
+	}
+	return errors.New(msg)
+}
+
+// aptListsDir is where apt stores downloaded package indexes; its mtime
+// changes whenever apt-get update rewrites them.
+const aptListsDir = "/var/lib/apt/lists"
+
+// RefreshPackageIndex refreshes the package index for manager ("apt-get",
+// "dnf", or "yum") at most once per run. For apt the refresh is also skipped
+// when the index was updated within cfg.PackageIndexMaxAge, unless
+// --force-refresh is set.
+func (s *System) RefreshPackageIndex(ctx context.Context, manager string) error {
+	if s.refreshedIndexes[manager] {
+		return nil
+	}
+	if manager == "apt-get" && !s.Config.ForceRefresh {
+		if fi, err := os.Stat(s.Host.Path(aptListsDir)); err == nil {
+			if age := time.Since(fi.ModTime()); age < s.Config.PackageIndexMaxAge {
+				if s.Config.Verbose {
+					s.Log(fmt.Sprintf("apt package index is %s old; skipping apt-get update.", age.Round(time.Second)))
+				}
+				s.refreshedIndexes[manager] = true
+				return nil
+			}
+		}
+	}
+
+	var err error
+	switch manager {
+	case "apt-get":
+		err = s.RunPkgCmd(ctx, "apt-get", "update")
+	default:
+		err = s.RunPkgCmd(ctx, manager, "makecache")
+	}
+	if err != nil {
+		return err
+	}
+	s.refreshedIndexes[manager] = true
+	return nil
+}
+
+// InvalidatePackageIndex forces the next RefreshPackageIndex for manager to
+// run, e.g. after a new repository has been added.
+func (s *System) InvalidatePackageIndex(manager string) {
+	delete(s.refreshedIndexes, manager)
+}
+
+// EnsureEPEL installs epel-release with yum once per run and refreshes the
+// metadata cache so packages from the new repository are visible.
+func (s *System) EnsureEPEL(ctx context.Context) error {
+	if s.epelInstalled {
+		return nil
+	}
+	if err := s.RunPkgCmd(ctx, "yum", "install", "-y", "epel-release"); err != nil {
+		return err
+	}
+	s.epelInstalled = true
+	s.InvalidatePackageIndex("yum")
+	return s.RefreshPackageIndex(ctx, "yum")
+}
+
+// aptSupportsLockTimeout reports whether the installed apt understands
+// DPkg::Lock::Timeout, which was added in apt 1.9.11.
+func (s *System) aptSupportsLockTimeout(ctx context.Context) bool {
+	s.aptLockTimeoutOnce.Do(func() {
+		out, err := s.CmdOutput(ctx, "apt-get", "--version")
+		if err != nil {
+			return
+		}
+		// The first line looks like "apt 2.4.5 (amd64)".
+		fields := strings.Fields(string(out))
+		if len(fields) < 2 {
+			return
+		}
+		s.aptLockTimeoutSupported = VersionAtLeast(fields[1], []int{1, 9, 11})
+		if s.Config.Verbose {
+			s.Log(fmt.Sprintf("apt %s supports DPkg::Lock::Timeout: %t", fields[1], s.aptLockTimeoutSupported))
+		}
+	})
+	return s.aptLockTimeoutSupported
+}
+
+// VersionAtLeast reports whether the dotted version v is >= want. Non-numeric
+// suffixes on a component (e.g. "11ubuntu1") are ignored.
+func VersionAtLeast(v string, want []int) bool {
+	parts := strings.Split(v, ".")
+	for i, w := range want {
+		if i >= len(parts) {
+			return false
+		}
+		digits := parts[i]
+		if end := strings.IndexFunc(digits, func(r rune) bool { return r < '0' || r > '9' }); end >= 0 {
+			digits = digits[:end]
+		}
+		n, err := strconv.Atoi(digits)
+		if err != nil {
+			return false
+		}
+		if n != w {
+			return n > w
+		}
+	}
+	return true
+}
+
+// TailBuffer is an io.Writer that retains only the last max bytes written.
+type TailBuffer struct {
+	Max int
+	buf []byte
+}
+
+func (t *TailBuffer) Write(p []byte) (int, error) {
+	t.buf = append(t.buf, p...)
+	if over := len(t.buf) - t.Max; over > 0 {
+		t.buf = t.buf[over:]
+	}
+	return len(p), nil
+}
+
+// Bytes returns the retained output.
+func (t *TailBuffer) Bytes() []byte { return t.buf }
+
+// DetectOS returns the ID of h's OS from /etc/os-release, or "darwin" for
+// macOS.
+func DetectOS(h *HostEnv) string {
+	if _, err := fs.Stat(h.fs, "System/Library/CoreServices/SystemVersion.plist"); err == nil {
+		return "darwin"
+	}
+	data, err := h.ReadFile("/etc/os-release")
+	if err != nil {
+		return "unknown"
+	}
+	for _, line := range strings.Split(string(data), "\n") {
+		if strings.HasPrefix(line, "ID=") {
+			return strings.Trim(strings.Split(line, "=")[1], `"`)
+		}
+	}
+	return "unknown"
+}
+
+// EnsureCommandInstalled checks if a command is installed and installs it if not.
+func (s *System) EnsureCommandInstalled(ctx context.Context, osID, cmdName string) error {
+	if _, err := exec.LookPath(cmdName); err == nil {
+		if s.Config.Verbose {
+			s.Log(cmdName + " is already installed.")
+		}
+		return nil
+	}
+	s.Log(fmt.Sprintf("%s is not installed. Installing...", cmdName))
+	if (osID == "centos" || osID == "redhat") && (cmdName == "jq" || cmdName == "rsync") {
+		if err := s.EnsureEPEL(ctx); err != nil {
+			return fmt.Errorf("installing %s: %w", cmdName, err)
+		}
+	}
+	out := &TailBuffer{Max: InstallOutputMax}
+	if err := s.installPackage(ctx, osID, cmdName, out); err != nil {
+		return err
+	}
+	return VerifyInstalled(cmdName, out)
+}
+
+// packageManager returns the package manager installPackage uses on osID,
+// or "".
+func packageManager(osID string) string {
+	switch osID {
+	case "ubuntu", "debian":
+		return "apt-get"
+	case "fedora":
+		return "dnf"
+	case "centos", "redhat":
+		return "yum"
+	case "darwin":
+		return "brew"
+	}
+	return ""
+}
+
+// installPackage installs pkg with osID's package manager, copying its
+// output to out.
+func (s *System) installPackage(ctx context.Context, osID, pkg string, out *TailBuffer) error {
+	var err error
+	switch manager := packageManager(osID); manager {
+	case "apt-get":
+		if err = s.RefreshPackageIndex(ctx, manager); err == nil {
+			err = s.RunPkgCmdTee(ctx, out, manager, "install", "-y", pkg)
+		}
+	case "dnf", "yum":
+		err = s.RunPkgCmdTee(ctx, out, manager, "install", "-y", pkg)
+	case "brew":
+		if err = s.RunCmdTee(ctx, out, "brew", "install", pkg); err != nil {
+			err = fmt.Errorf("brew install %s failed: %w", pkg, err)
+		}
+	default:
+		return fmt.Errorf("unsupported OS %q for automatic installation of %s", osID, pkg)
+	}
+	if err != nil {
+		return fmt.Errorf("installing %s: %w", pkg, err)
+	}
+	s.RecordIrreversible("installed " + pkg)
+	return nil
+}
+
+// packageInstalled reports whether osID's package manager has pkg
+// installed.
+func (s *System) packageInstalled(ctx context.Context, osID, pkg string) bool {
+	switch packageManager(osID) {
+	case "apt-get":
+		out, err := s.CmdOutput(ctx, "dpkg-query", "-W", "-f=${Status}", pkg)
+		return err == nil && strings.HasSuffix(strings.TrimSpace(string(out)), " installed")
+	case "dnf", "yum":
+		_, err := s.CmdOutput(ctx, "rpm", "-q", "--whatprovides", pkg)
+		return err == nil
+	case "brew":
+		_, err := s.CmdOutput(ctx, "brew", "list", "--versions", pkg)
+		return err == nil
+	}
+	return false
+}
@@ -0,0 +1,109 @@
+package platform_test
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/sparkleHazard/bootstrap/internal/config"
+	"github.com/sparkleHazard/bootstrap/internal/platform/platformtest"
+)
+
+func TestEnsureCommandInstalled(t *testing.T) {
+	tests := []struct {
+		name      string
+		osID, cmd string
+		apt       string // apt-get --version
+		onPath    bool   // the command is there before
+		installed bool   // the installer puts it on PATH
+		want      []string
+		wantErr   string
+	}{
+		{
+			name: "already installed", osID: "debian", cmd: "jq", onPath: true,
+		},
+		{
+			name: "debian apt waits for the lock", osID: "debian", cmd: "jq", apt: "apt 2.6.1 (amd64)", installed: true,
+			want: []string{
+				"apt-get --version",
+				"sudo apt-get -o DPkg::Lock::Timeout=60 update",
+				"sudo apt-get -o DPkg::Lock::Timeout=60 install -y jq",
+			},
+		},
+		{
+			name: "ubuntu apt before 1.9.11", osID: "ubuntu", cmd: "rsync", apt: "apt 1.6.12ubuntu0.2 (amd64)", installed: true,
+			want: []string{
+				"apt-get --version",
+				"sudo apt-get update",
+				"sudo apt-get install -y rsync",
+			},
+		},
+		{
+			name: "fedora", osID: "fedora", cmd: "jq", installed: true,
+			want: []string{"sudo dnf install -y jq"},
+		},
+		{
+			name: "centos jq needs EPEL", osID: "centos", cmd: "jq", installed: true,
+			want: []string{
+				"sudo yum install -y epel-release",
+				"sudo yum makecache",
+				"sudo yum install -y jq",
+			},
+		},
+		{
+			name: "redhat git", osID: "redhat", cmd: "git", installed: true,
+			want: []string{"sudo yum install -y git"},
+		},
+		{
+			name: "darwin", osID: "darwin", cmd: "jq", installed: true,
+			want: []string{"brew install jq"},
+		},
+		{
+			name: "unsupported OS", osID: "arch", cmd: "jq",
+			wantErr: `unsupported OS "arch" for automatic installation of jq`,
+		},
+		{
+			name: "still missing after installing", osID: "fedora", cmd: "jq",
+			want:    []string{"sudo dnf install -y jq"},
+			wantErr: "jq is still not on PATH after installation",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			bin := t.TempDir()
+			t.Setenv("PATH", bin)
+			if tt.onPath {
+				writeExecutable(t, filepath.Join(bin, tt.cmd))
+			}
+			sys, runner, _ := platformtest.NewSystem(t, &config.Config{PackageLockTimeout: time.Minute})
+			runner.Respond = func(cmd string) (string, error) {
+				if cmd == "apt-get --version" {
+					return tt.apt, nil
+				}
+				if tt.installed && strings.HasSuffix(cmd, " install -y "+tt.cmd) || cmd == "brew install "+tt.cmd {
+					writeExecutable(t, filepath.Join(bin, tt.cmd))
+				}
+				return "", nil
+			}
+
+			err := sys.EnsureCommandInstalled(context.Background(), tt.osID, tt.cmd)
+			if tt.wantErr == "" && err != nil || tt.wantErr != "" && (err == nil || !strings.Contains(err.Error(), tt.wantErr)) {
+				t.Errorf("EnsureCommandInstalled = %v, want error %q", err, tt.wantErr)
+			}
+			if got := runner.Commands(); strings.Join(got, "\n") != strings.Join(tt.want, "\n") {
+				t.Errorf("ran:\n  %s\nwant:\n  %s", strings.Join(got, "\n  "), strings.Join(tt.want, "\n  "))
+			}
+		})
+	}
+}
+
+// writeExecutable writes an empty executable at path.
+func writeExecutable(t *testing.T, path string) {
+	t.Helper()
+	if err := os.WriteFile(path, nil, 0755); err != nil {
+		t.Fatal(err)
+	}
+}
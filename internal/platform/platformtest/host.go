@@ -0,0 +1,101 @@
+package platformtest
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"encoding/pem"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/sparkleHazard/bootstrap/internal/platform"
+	"golang.org/x/crypto/ssh"
+)
+
+// DebianRelease is the /etc/os-release of Debian 12.
+const DebianRelease = `PRETTY_NAME="Debian GNU/Linux 12 (bookworm)"
+ID=debian
+VERSION_ID="12"
+`
+
+// Host is a host for a run in a temporary directory: a test root
+// (platform.TestRootEnv) with its /etc/os-release and /var/lock, a home
+// directory, a directory of commands to be the whole of PATH, one for
+// TMPDIR, and an SSH private key for fake commands to hand out.
+type Host struct {
+	Dir  string
+	Root string // root/, the test root
+	Home string // home/
+	Bin  string // bin/
+	Tmp  string // tmp/
+	Key  string // key, the private key's file
+}
+
+// NewHost returns a Host with osRelease as its /etc/os-release.
+func NewHost(t testing.TB, osRelease string) *Host {
+	t.Helper()
+	dir := t.TempDir()
+	h := &Host{
+		Dir:  dir,
+		Root: filepath.Join(dir, "root"),
+		Home: filepath.Join(dir, "home"),
+		Bin:  filepath.Join(dir, "bin"),
+		Tmp:  filepath.Join(dir, "tmp"),
+		Key:  filepath.Join(dir, "key"),
+	}
+	for _, d := range []string{filepath.Join(h.Root, "etc"), filepath.Join(h.Root, "var", "lock"), h.Home, h.Bin, h.Tmp} {
+		if err := os.MkdirAll(d, 0755); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := os.WriteFile(filepath.Join(h.Root, "etc", "os-release"), []byte(osRelease), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	priv, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	block, err := ssh.MarshalPrivateKey(priv, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(h.Key, pem.EncodeToMemory(block), 0644); err != nil {
+		t.Fatal(err)
+	}
+	return h
+}
+
+// Env returns the environment of a run on h: its PATH, HOME, TMPDIR and
+// test root.
+func (h *Host) Env() []string {
+	return []string{
+		"PATH=" + h.Bin,
+		"HOME=" + h.Home,
+		"TMPDIR=" + h.Tmp,
+		platform.TestRootEnv + "=" + h.Root,
+	}
+}
+
+// Setenv sets the environment of Env for the rest of the test, for a run
+// in the test's own process. XDG_RUNTIME_DIR is cleared, so that a run
+// that is not root's takes its lock in TMPDIR too.
+func (h *Host) Setenv(t testing.TB) {
+	t.Helper()
+	for _, kv := range h.Env() {
+		name, value, _ := strings.Cut(kv, "=")
+		t.Setenv(name, value)
+	}
+	t.Setenv("XDG_RUNTIME_DIR", "")
+}
+
+// Install writes the command name to h's PATH, a shell script running
+// body.
+func (h *Host) Install(t testing.TB, name, body string) {
+	t.Helper()
+	if err := os.WriteFile(filepath.Join(h.Bin, name), []byte("#!/bin/sh\n"+body+"\n"), 0755); err != nil {
+		t.Fatal(err)
+	}
+}
@@ -0,0 +1,108 @@
+// Package platformtest provides fakes of the platform package's hooks, the
+// Runner and the Logger, and a Host to run on, for the tests of the
+// packages built on it.
+package platformtest
+
+import (
+	"context"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/sparkleHazard/bootstrap/internal/config"
+	"github.com/sparkleHazard/bootstrap/internal/platform"
+)
+
+// Runner is a platform.Runner that records the commands it is given
+// instead of running them.
+type Runner struct {
+	// Respond, when set, returns the output and the error of the command
+	// line cmd, as Commands records it. Without it every command succeeds
+	// with no output.
+	Respond func(cmd string) (string, error)
+
+	mu       sync.Mutex
+	commands []string
+}
+
+// Run records the command and copies its output to capture.
+func (r *Runner) Run(ctx context.Context, capture io.Writer, name string, args ...string) error {
+	out, err := r.run(name, args)
+	if capture != nil {
+		io.WriteString(capture, out)
+	}
+	return err
+}
+
+// RunSudo records the command with a "sudo" in front of it.
+func (r *Runner) RunSudo(ctx context.Context, capture io.Writer, name string, args ...string) error {
+	return r.Run(ctx, capture, "sudo", append([]string{name}, args...)...)
+}
+
+// Output records the command and returns its output.
+func (r *Runner) Output(ctx context.Context, name string, args ...string) ([]byte, error) {
+	out, err := r.run(name, args)
+	return []byte(out), err
+}
+
+func (r *Runner) run(name string, args []string) (string, error) {
+	cmd := strings.Join(append([]string{name}, args...), " ")
+	r.mu.Lock()
+	r.commands = append(r.commands, cmd)
+	r.mu.Unlock()
+	if r.Respond == nil {
+		return "", nil
+	}
+	return r.Respond(cmd)
+}
+
+// Commands returns the command lines run so far, in order, each its name
+// and arguments joined by spaces.
+func (r *Runner) Commands() []string {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return append([]string(nil), r.commands...)
+}
+
+// Logger is a platform.Logger that keeps the messages it is given.
+type Logger struct {
+	mu   sync.Mutex
+	msgs []string
+}
+
+// Log keeps msg.
+func (l *Logger) Log(msg string, fields map[string]string) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.msgs = append(l.msgs, msg)
+}
+
+// Messages returns the messages logged so far, in order.
+func (l *Logger) Messages() []string {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return append([]string(nil), l.msgs...)
+}
+
+// NewSystem returns a System for cfg on a host rooted at a temporary
+// directory, run by uid 1000 whose home is the root's /home/user, with its
+// commands given to a Runner and its messages to a Logger.
+func NewSystem(t testing.TB, cfg *config.Config) (*platform.System, *Runner, *Logger) {
+	t.Helper()
+	root := t.TempDir()
+	home := filepath.Join(root, "home", "user")
+	if err := os.MkdirAll(home, 0700); err != nil {
+		t.Fatal(err)
+	}
+	host := platform.NewHostEnv(root)
+	host.EUID = func() int { return 1000 }
+	host.HomeDir = func() (string, error) { return home, nil }
+	sys := platform.NewSystem(cfg, host)
+	runner, logger := &Runner{}, &Logger{}
+	sys.SetRunner(runner)
+	sys.SetLogger(logger)
+	return sys, runner, logger
+}
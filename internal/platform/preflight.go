@@ -0,0 +1,244 @@
+package platform
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"net/url"
+	"os"
+	"regexp"
+	"strings"
+	"time"
+)
+
+// networkPollInterval is how often failing network checks are re-run while
+// waiting for the network to come up.
+const networkPollInterval = 5 * time.Second
+
+// DialTimeout bounds each TCP reachability check.
+const DialTimeout = 5 * time.Second
+
+// networkCheck is a single named network precondition.
+type networkCheck struct {
+	Name  string
+	Check func(ctx context.Context) error
+}
+
+// CheckNetwork verifies that the host has a default route, can resolve the
+// hosts this run depends on, and can reach their ports, waiting up to
+// cfg.NetworkWait for all checks to pass. Each check's outcome is logged
+// individually.
+func (s *System) CheckNetwork(ctx context.Context, osID string, keyserver *url.URL) error {
+	if s.Host.root != "" {
+		s.Log("Skipping the network preflight in the test root " + s.Host.root + ".")
+		return nil
+	}
+	checks := s.NetworkChecks(osID, keyserver)
+	s.Log("Checking network reachability...")
+
+	deadline := time.Now().Add(s.Config.NetworkWait)
+	lastErr := map[string]string{}
+	for {
+		var failed []string
+		for _, c := range checks {
+			err := c.Check(ctx)
+			msg := "ok"
+			if err != nil {
+				msg = err.Error()
+				failed = append(failed, c.Name+": "+msg)
+			}
+			if prev, seen := lastErr[c.Name]; !seen || prev != msg {
+				if err != nil {
+					s.Log(fmt.Sprintf("  [fail] %s: %s", c.Name, msg))
+				} else {
+					s.Log(fmt.Sprintf("  [ok]   %s", c.Name))
+				}
+			}
+			lastErr[c.Name] = msg
+		}
+		if len(failed) == 0 {
+			return nil
+		}
+		if time.Now().After(deadline) {
+			return fmt.Errorf("network preflight failed after waiting %s: %s", s.Config.NetworkWait, strings.Join(failed, "; "))
+		}
+		s.Log(fmt.Sprintf("Waiting for network (%d check(s) failing, %s left)...", len(failed), time.Until(deadline).Round(time.Second)))
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(networkPollInterval):
+		}
+	}
+}
+
+// NetworkChecks returns the checks relevant to the configured role, and of
+// keyserver, where the host fetches its key from, if not nil.
+func (s *System) NetworkChecks(osID string, keyserver *url.URL) []networkCheck {
+	checks := []networkCheck{{
+		Name:  "default route",
+		Check: func(ctx context.Context) error { return s.checkDefaultRoute(ctx, osID) },
+	}}
+
+	var endpoints []string
+	if host, err := RepoHost(s.Config.RepoURL); err == nil {
+		endpoints = append(endpoints, net.JoinHostPort(host, RepoPort(s.Config.RepoURL)))
+	}
+	if s.Config.Offline {
+		// GitHub is out of reach by design; check the internal hosts instead.
+		endpoints = append(endpoints, s.Config.OfflineEndpoints()...)
+	}
+	if s.Config.Role == "keyserver" && !s.Config.Offline {
+		// gh API calls and the ssh -T key test.
+		endpoints = append(endpoints, "api.github.com:443", "github.com:22")
+	} else if u := keyserver; u != nil {
+		port := u.Port()
+		if port == "" && u.Scheme == "https" {
+			port = "443"
+		} else if port == "" {
+			port = "873"
+		}
+		endpoints = append(endpoints, net.JoinHostPort(u.Hostname(), port))
+	}
+
+	seen := map[string]bool{}
+	for _, ep := range endpoints {
+		if seen[ep] {
+			continue
+		}
+		seen[ep] = true
+		host, _, _ := net.SplitHostPort(ep)
+		if net.ParseIP(host) == nil && !seen[host] {
+			seen[host] = true
+			checks = append(checks, networkCheck{
+				Name:  "DNS " + host,
+				Check: func(ctx context.Context) error { return s.checkDNS(ctx, host) },
+			})
+		}
+		checks = append(checks, networkCheck{
+			Name:  "TCP " + ep,
+			Check: func(ctx context.Context) error { return checkTCP(ctx, ep) },
+		})
+	}
+	return checks
+}
+
+// RepoPort returns the TCP port used to clone the git repository at s.
+func RepoPort(s string) string {
+	if !strings.Contains(s, "://") {
+		return "22" // scp-like syntax is always ssh
+	}
+	u, err := url.Parse(s)
+	if err != nil {
+		return "22"
+	}
+	if p := u.Port(); p != "" {
+		return p
+	}
+	switch u.Scheme {
+	case "https":
+		return "443"
+	case "http":
+		return "80"
+	case "git":
+		return "9418"
+	}
+	return "22"
+}
+
+// checkDefaultRoute reports an error when the host has no default route.
+func (s *System) checkDefaultRoute(ctx context.Context, osID string) error {
+	if osID == "darwin" {
+		if err := s.NewCommand(ctx, "route", "-n", "get", "default").Run(); err != nil {
+			return errors.New("no default route")
+		}
+		return nil
+	}
+	for _, path := range []string{"/proc/net/route", "/proc/net/ipv6_route"} {
+		ok, err := procHasDefaultRoute(path)
+		if err == nil && ok {
+			return nil
+		}
+	}
+	return errors.New("no default route")
+}
+
+// procHasDefaultRoute reports whether a /proc/net route table lists a
+// default (all-zero destination, zero prefix length) route.
+func procHasDefaultRoute(path string) (bool, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return false, err
+	}
+	defer f.Close()
+	ipv6 := strings.HasSuffix(path, "ipv6_route")
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if ipv6 {
+			// dest, dest prefix len, ..., device is the last field.
+			if len(fields) >= 10 && strings.Trim(fields[0], "0") == "" && fields[1] == "00" && fields[9] != "lo" {
+				return true, nil
+			}
+			continue
+		}
+		// Iface, Destination, Gateway, ...; the first line is a header.
+		if len(fields) >= 2 && fields[1] == "00000000" {
+			return true, nil
+		}
+	}
+	return false, scanner.Err()
+}
+
+// checkDNS resolves host.
+func (s *System) checkDNS(ctx context.Context, host string) error {
+	ctx, cancel := context.WithTimeout(ctx, DialTimeout)
+	defer cancel()
+	addrs, err := net.DefaultResolver.LookupHost(ctx, host)
+	if err != nil {
+		return fmt.Errorf("cannot resolve: %v", err)
+	}
+	if s.Config.Verbose {
+		s.Log(fmt.Sprintf("  %s resolves to %s", host, strings.Join(addrs, ", ")))
+	}
+	return nil
+}
+
+// checkTCP opens and immediately closes a TCP connection to addr.
+func checkTCP(ctx context.Context, addr string) error {
+	d := net.Dialer{Timeout: DialTimeout}
+	conn, err := d.DialContext(ctx, "tcp", addr)
+	if err != nil {
+		return fmt.Errorf("not reachable: %v", err)
+	}
+	return conn.Close()
+}
+
+// RepoHost returns the host of a git repository URL, rejecting schemes that
+// ansible-pull cannot clone from.
+func RepoHost(s string) (string, error) {
+	if !strings.Contains(s, "://") {
+		m := scpLikeRegex.FindStringSubmatch(s)
+		if m == nil {
+			return "", fmt.Errorf("repo-url %q is not a valid git URL", s)
+		}
+		return m[1], nil
+	}
+	u, err := url.Parse(s)
+	if err != nil {
+		return "", fmt.Errorf("repo-url: %v", err)
+	}
+	switch u.Scheme {
+	case "ssh", "git", "http", "https":
+	default:
+		return "", fmt.Errorf("repo-url: unsupported scheme %q", u.Scheme)
+	}
+	if u.Hostname() == "" {
+		return "", fmt.Errorf("repo-url %q has no host", s)
+	}
+	return u.Hostname(), nil
+}
+
+// scpLikeRegex matches scp-style git URLs such as git@github.com:owner/repo.git.
+var scpLikeRegex = regexp.MustCompile(`^(?:[^@/]+@)?([^:/]+):[^/]`)
@@ -0,0 +1,57 @@
+package platform
+
+import (
+	"slices"
+
+	"github.com/sparkleHazard/bootstrap/internal/config"
+)
+
+// keyserverOnlyPrereqs are needed only by the keyserver role: gh manages
+// the GitHub key, and brings an apt repository and keyring with it.
+var keyserverOnlyPrereqs = []string{"gh"}
+
+// defaultRolePrereqs returns the built-in prerequisites of role.
+func defaultRolePrereqs(role string) []string {
+	if role == "keyserver" {
+		return slices.Clone(config.BuiltinPrereqs)
+	}
+	var out []string
+	for _, p := range config.BuiltinPrereqs {
+		if !slices.Contains(keyserverOnlyPrereqs, p) {
+			out = append(out, p)
+		}
+	}
+	return out
+}
+
+// ResolvePrereqs returns the prerequisites of role: the built-in ones it
+// needs, in config.BuiltinPrereqs' order, and then the packages, its own from
+// --role-prereqs followed by every --extra-prereq.
+func ResolvePrereqs(c *config.Config, role string) ([]string, []config.ExtraPrereq) {
+	items, ok := c.RolePrereqs[role]
+	if !ok {
+		items = defaultRolePrereqs(role)
+	}
+	var builtins []string
+	for _, p := range config.BuiltinPrereqs {
+		if slices.Contains(items, p) {
+			builtins = append(builtins, p)
+		}
+	}
+	var extras config.ExtraPrereqs
+	for _, item := range items {
+		if !slices.Contains(config.BuiltinPrereqs, item) {
+			extras.Set(item) // validated by Set
+		}
+	}
+	return builtins, append(extras, c.ExtraPrereqs...)
+}
+
+// PrereqNames lists the prerequisites ResolvePrereqs returned.
+func PrereqNames(builtins []string, extras []config.ExtraPrereq) []string {
+	names := slices.Clone(builtins)
+	for _, p := range extras {
+		names = append(names, p.Name)
+	}
+	return names
+}
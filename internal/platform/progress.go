@@ -0,0 +1,122 @@
+package platform
+
+import (
+	"fmt"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/sparkleHazard/bootstrap/internal/config"
+	"golang.org/x/term"
+)
+
+// progressInterval is how often the progress line is redrawn.
+const progressInterval = 150 * time.Millisecond
+
+// progressQuietPeriod is how long the terminal must have been quiet before
+// the progress line is drawn, so that it stays out of the way of a child
+// command that is busy writing.
+const progressQuietPeriod = time.Second
+
+// spinnerFrames animate the progress line.
+var spinnerFrames = []string{"|", "/", "-", "\\"}
+
+type progressConsole struct {
+	enabled   bool // see progressEnabled
+	mu        sync.Mutex
+	once      sync.Once
+	step      string
+	start     time.Time
+	paused    int
+	drawn     bool      // the progress line is on screen
+	lastWrite time.Time // when other output last reached the terminal
+	midLine   bool      // that output did not end with a newline
+	frame     int
+}
+
+// consoleWriter writes to f, erasing the progress line first.
+type consoleWriter struct {
+	f       *os.File
+	console *progressConsole
+}
+
+func (w consoleWriter) Write(p []byte) (int, error) {
+	c := w.console
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.eraseLocked()
+	n, err := w.f.Write(p)
+	if n > 0 {
+		c.lastWrite = time.Now()
+		c.midLine = p[n-1] != '\n'
+	}
+	return n, err
+}
+
+// ProgressEnabled reports whether to draw the progress line: only on a
+// terminal, and not with --no-progress.
+func ProgressEnabled(c *config.Config) bool {
+	return !c.NoProgress && term.IsTerminal(int(os.Stdout.Fd()))
+}
+
+// SetStep shows step on the progress line, timed from now; "" hides the
+// line.
+func (c *progressConsole) SetStep(step string) {
+	if !c.enabled {
+		return
+	}
+	c.once.Do(func() { go c.animate() })
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.eraseLocked()
+	c.step, c.start = step, time.Now()
+}
+
+// pause hides the progress line until the returned function is called, for
+// a child command that prompts on the terminal itself, such as sudo.
+func (c *progressConsole) pause() (resume func()) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.eraseLocked()
+	c.paused++
+	return func() {
+		c.mu.Lock()
+		defer c.mu.Unlock()
+		c.paused--
+	}
+}
+
+// animate redraws the progress line until the process exits.
+func (c *progressConsole) animate() {
+	for range time.Tick(progressInterval) {
+		c.mu.Lock()
+		if c.step != "" && c.paused == 0 && !c.midLine && time.Since(c.lastWrite) >= progressQuietPeriod {
+			c.frame = (c.frame + 1) % len(spinnerFrames)
+			elapsed := time.Since(c.start).Round(time.Second)
+			fmt.Fprintf(os.Stdout, "\r%s %s (%s)\x1b[K", spinnerFrames[c.frame], c.step, elapsed)
+			c.drawn = true
+		}
+		c.mu.Unlock()
+	}
+}
+
+// eraseLocked erases the progress line if it is on screen. c.mu is held.
+func (c *progressConsole) eraseLocked() {
+	if c.drawn {
+		fmt.Fprint(os.Stdout, "\r\x1b[K")
+		c.drawn = false
+	}
+}
+
+// Lock holds the terminal for output written around the console, such as
+// the fleet's status table.
+func (c *progressConsole) Lock() { c.mu.Lock() }
+
+// Unlock releases the terminal held by Lock.
+func (c *progressConsole) Unlock() { c.mu.Unlock() }
+
+// WrittenSince reports whether other output reached the terminal after t.
+// The console is held with Lock.
+func (c *progressConsole) WrittenSince(t time.Time) bool {
+	return c.lastWrite.After(t)
+}
@@ -0,0 +1,44 @@
+package platform
+
+import (
+	"context"
+	"fmt"
+	"os/exec"
+)
+
+// EnsurePython makes sure there is a python3 for Ansible's modules,
+// installing it with the package manager if it is missing, and, with
+// --python-apt on Debian and Ubuntu, the python3-apt bindings the apt
+// modules need.
+func (s *System) EnsurePython(ctx context.Context, osID string) error {
+	if err := s.EnsureCommandInstalled(ctx, osID, "python3"); err != nil {
+		return err
+	}
+	path, err := exec.LookPath("python3")
+	if err != nil {
+		return fmt.Errorf("python3 was installed but is not on PATH: %w", err)
+	}
+	s.PythonInterpreter = path
+	if s.Config.Verbose {
+		s.Log("Using " + path + " as Ansible's Python interpreter.")
+	}
+	if !s.Config.PythonApt || (osID != "debian" && osID != "ubuntu") {
+		return nil
+	}
+	if s.RunCmd(ctx, path, "-c", "import apt") == nil {
+		return nil
+	}
+	s.Log("python3-apt is not installed. Installing...")
+	out := &TailBuffer{Max: InstallOutputMax}
+	if err := s.RefreshPackageIndex(ctx, "apt-get"); err != nil {
+		return fmt.Errorf("installing python3-apt: %w", err)
+	}
+	if err := s.RunPkgCmdTee(ctx, out, "apt-get", "install", "-y", "python3-apt"); err != nil {
+		return fmt.Errorf("installing python3-apt: %w", err)
+	}
+	s.RecordIrreversible("installed python3-apt")
+	if err := s.RunCmd(ctx, path, "-c", "import apt"); err != nil {
+		return fmt.Errorf("python3-apt was installed but %s cannot import it: %w", path, err)
+	}
+	return nil
+}
@@ -0,0 +1,47 @@
+package platform
+
+import (
+	"net/url"
+	"regexp"
+	"strings"
+)
+
+// Patterns of secrets that may turn up in command output.
+var (
+	privateKeyRegex   = regexp.MustCompile(`-----BEGIN [A-Z ]*PRIVATE KEY-----[\s\S]*?(-----END [A-Z ]*PRIVATE KEY-----|\z)`)
+	urlPasswordRegex  = regexp.MustCompile(`\b([a-z][a-z0-9+.-]*://[^/\s@:]*):[^/\s@]+@`)
+	bearerRegex       = regexp.MustCompile(`(?i)(authorization:\s*\w+|\bbearer)\s+\S+`)
+	secretAssignRegex = regexp.MustCompile(`(?i)\b([a-z_]*(?:password|passwd|secret|token|api[_-]?key)[a-z_]*["']?\s*[:=]\s*)("[^"]*"|'[^']*'|\S+)`)
+)
+
+// RedactSecrets returns s with the secrets the run knows of, private keys,
+// passwords in URLs and anything assigned to a password- or token-like name
+// replaced by [REDACTED].
+func (s *System) RedactSecrets(text string) string {
+	for _, v := range s.runSecrets {
+		if len(v) >= 4 {
+			text = strings.ReplaceAll(text, v, "[REDACTED]")
+		}
+	}
+	text = privateKeyRegex.ReplaceAllString(text, "[REDACTED PRIVATE KEY]")
+	text = urlPasswordRegex.ReplaceAllString(text, "${1}:[REDACTED]@")
+	text = bearerRegex.ReplaceAllString(text, "$1 [REDACTED]")
+	return secretAssignRegex.ReplaceAllString(text, "${1}[REDACTED]")
+}
+
+// RedactURL returns rawURL for a message, with its credentials and path
+// elided: only the scheme and host are kept, since the path may be a
+// secret too, such as a healthchecks.io check's UUID. A URL it cannot parse
+// is "the URL".
+func RedactURL(rawURL string) string {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return "the URL"
+	}
+	return u.Scheme + "://" + u.Host + "/..."
+}
+
+// AddSecret has RedactSecrets redact the secrets from now on.
+func (s *System) AddSecret(secrets ...string) {
+	s.runSecrets = append(s.runSecrets, secrets...)
+}
@@ -0,0 +1,93 @@
+package platform
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math/rand/v2"
+	"time"
+
+	"github.com/sparkleHazard/bootstrap/internal/config"
+)
+
+// RetryPolicy controls how often and how quickly a failing network step is
+// retried.
+type RetryPolicy struct {
+	Attempts     int
+	InitialDelay time.Duration
+	MaxDelay     time.Duration
+	Multiplier   float64
+}
+
+// NewRetryPolicy returns the retry policy configured by the --retry-* flags.
+func NewRetryPolicy(c *config.Config) RetryPolicy {
+	return RetryPolicy{
+		Attempts:     c.RetryAttempts,
+		InitialDelay: c.RetryInitialDelay,
+		MaxDelay:     c.RetryMaxDelay,
+		Multiplier:   c.RetryMultiplier,
+	}
+}
+
+// delay returns the jittered wait before retry number n (1-based). The
+// un-jittered delay grows geometrically from InitialDelay, capped at
+// MaxDelay; the returned value is drawn uniformly from its upper half so
+// that many clients started together spread out rather than retrying in
+// lockstep.
+func (p RetryPolicy) delay(n int) time.Duration {
+	d := float64(p.InitialDelay)
+	for i := 1; i < n; i++ {
+		d *= p.Multiplier
+		if d >= float64(p.MaxDelay) {
+			break
+		}
+	}
+	d = min(d, float64(p.MaxDelay))
+	half := d / 2
+	return time.Duration(half + rand.Float64()*half)
+}
+
+// PermanentError marks an error that retrying cannot fix.
+type PermanentError struct{ Err error }
+
+func (e *PermanentError) Error() string { return e.Err.Error() }
+func (e *PermanentError) Unwrap() error { return e.Err }
+
+// Permanent wraps err so that retry returns it immediately.
+func Permanent(err error) error {
+	if err == nil {
+		return nil
+	}
+	return &PermanentError{Err: err}
+}
+
+// Retry calls fn until it succeeds, returns a permanent error, the policy's
+// attempts are exhausted, or ctx is cancelled. desc names the operation in
+// log lines.
+func (s *System) Retry(ctx context.Context, p RetryPolicy, desc string, fn func() error) error {
+	var err error
+	for attempt := 1; ; attempt++ {
+		err = fn()
+		if err == nil {
+			return nil
+		}
+		var perm *PermanentError
+		if errors.As(err, &perm) {
+			return perm.Err
+		}
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+		if attempt >= p.Attempts {
+			return fmt.Errorf("%s failed after %d attempts: %w", desc, attempt, err)
+		}
+		wait := p.delay(attempt)
+		s.StepRetries.Add(1)
+		s.Log(fmt.Sprintf("%s failed (attempt %d/%d). Retrying in %s...", desc, attempt, p.Attempts, wait.Round(100*time.Millisecond)))
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(wait):
+		}
+	}
+}
@@ -0,0 +1,48 @@
+package platform
+
+import (
+	"context"
+	"time"
+)
+
+// rollbackTimeout bounds how long unwinding may take, since it runs after
+// the run's own context may already be cancelled.
+const rollbackTimeout = 2 * time.Minute
+
+// undoAction reverses one change made during the run.
+type undoAction struct {
+	desc string
+	undo func(ctx context.Context) error
+}
+
+// RecordUndo registers a reversible change; desc describes the reversal
+// (e.g. "remove /etc/apt/sources.list.d/github-cli.list").
+func (s *System) RecordUndo(desc string, undo func(ctx context.Context) error) {
+	s.UndoStack = append(s.UndoStack, undoAction{desc: desc, undo: undo})
+}
+
+// RecordIrreversible notes a change that --rollback-on-failure cannot undo,
+// so the failure report can list it.
+func (s *System) RecordIrreversible(desc string) {
+	s.Irreversible = append(s.Irreversible, desc)
+}
+
+// Rollback unwinds the undo stack in reverse order, logging each reversal,
+// and returns the reversals that succeeded and those that failed. It keeps
+// going past failures: a best-effort rollback should undo as much as it can.
+func (s *System) Rollback() (done, failed []string) {
+	ctx, cancel := context.WithTimeout(context.Background(), rollbackTimeout)
+	defer cancel()
+	for i := len(s.UndoStack) - 1; i >= 0; i-- {
+		a := s.UndoStack[i]
+		s.Log("Rolling back: " + a.desc)
+		if err := a.undo(ctx); err != nil {
+			s.Log("  failed: " + err.Error())
+			failed = append(failed, a.desc+": "+err.Error())
+			continue
+		}
+		done = append(done, a.desc)
+	}
+	s.UndoStack = nil
+	return done, failed
+}
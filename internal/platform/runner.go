@@ -0,0 +1,115 @@
+package platform
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"strings"
+	"time"
+)
+
+// Runner runs the commands of the provisioning steps. Every RunCmd*
+// helper and CmdOutput goes through the system's runner, so replacing it
+// with one that records the invocations exercises the steps' logic (the
+// installer per OS, the retries, the ansible-pull arguments) without
+// running anything.
+type Runner interface {
+	// Run runs name with args, streaming its output and copying it to
+	// capture when that is non-nil.
+	Run(ctx context.Context, capture io.Writer, name string, args ...string) error
+
+	// RunSudo is Run through the escalation tool, unless the process is
+	// already root or has no escalation tool.
+	RunSudo(ctx context.Context, capture io.Writer, name string, args ...string) error
+
+	// Output runs name with args and returns its standard output.
+	Output(ctx context.Context, name string, args ...string) ([]byte, error)
+}
+
+// execRunner is the runner that executes commands on the host.
+type execRunner struct{ sys *System }
+
+func (r execRunner) Run(ctx context.Context, capture io.Writer, name string, args ...string) error {
+	if r.sys.Config.Verbose {
+		r.sys.Log(fmt.Sprintf("Running: %s %s", name, strings.Join(args, " ")))
+	}
+	cmd := r.sys.NewCommand(ctx, name, args...)
+	cmd.Stdout = r.sys.CommandStdout
+	cmd.Stderr = r.sys.CommandStderr
+	if capture != nil {
+		cmd.Stdout = io.MultiWriter(r.sys.CommandStdout, capture)
+		cmd.Stderr = io.MultiWriter(r.sys.CommandStderr, capture)
+	}
+	start := time.Now()
+	err := cmd.Run()
+	if r.sys.Config.Verbose {
+		r.sys.Log(fmt.Sprintf("%s finished in %s.", r.sys.commandLabel(name, args), RoundDuration(time.Since(start))))
+	}
+	return err
+}
+
+func (r execRunner) RunSudo(ctx context.Context, capture io.Writer, name string, args ...string) error {
+	if r.sys.Host.EUID() != 0 && r.sys.EscalationCmd != "" {
+		r.sys.startSudoKeepalive(ctx)
+		newArgs := append([]string{name}, args...)
+		return r.Run(ctx, capture, r.sys.EscalationCmd, newArgs...)
+	}
+	return r.Run(ctx, capture, name, args...)
+}
+
+func (r execRunner) Output(ctx context.Context, name string, args ...string) ([]byte, error) {
+	return r.sys.NewCommand(ctx, name, args...).Output()
+}
+
+// SetRunner has the commands of the run go through r rather than run on
+// the host.
+func (s *System) SetRunner(r Runner) {
+	s.runner = r
+}
+
+// RunCmd runs a command on the host system, streaming its output.
+func (s *System) RunCmd(ctx context.Context, name string, args ...string) error {
+	return s.RunCmdTee(ctx, nil, name, args...)
+}
+
+// RunCmdTee is RunCmd, additionally copying the command's combined output to
+// capture when it is non-nil.
+func (s *System) RunCmdTee(ctx context.Context, capture io.Writer, name string, args ...string) error {
+	return s.runner.Run(ctx, capture, name, args...)
+}
+
+// RunCmdSudo wraps RunCmd in the escalation tool (sudo or doas) unless we
+// are already root.
+func (s *System) RunCmdSudo(ctx context.Context, name string, args ...string) error {
+	return s.runCmdSudoTee(ctx, nil, name, args...)
+}
+
+// runCmdSudoTee wraps RunCmdTee in the escalation tool unless we are
+// already root. Without an escalation tool the command runs unprivileged.
+func (s *System) runCmdSudoTee(ctx context.Context, capture io.Writer, name string, args ...string) error {
+	return s.runner.RunSudo(ctx, capture, name, args...)
+}
+
+// CmdOutput runs a command on the host system and returns its standard
+// output.
+func (s *System) CmdOutput(ctx context.Context, name string, args ...string) ([]byte, error) {
+	return s.runner.Output(ctx, name, args...)
+}
+
+// RoundDuration rounds d for display: to a tenth of a second under a
+// minute, otherwise to the second.
+func RoundDuration(d time.Duration) time.Duration {
+	if d < time.Minute {
+		return d.Round(100 * time.Millisecond)
+	}
+	return d.Round(time.Second)
+}
+
+// commandLabel names the program of a command line for the sub-timings
+// logged with --verbose, seeing through the escalation tool.
+func (s *System) commandLabel(name string, args []string) string {
+	if name == s.EscalationCmd && len(args) > 0 {
+		return args[0]
+	}
+	return name
+}
@@ -0,0 +1,49 @@
+package platform
+
+import (
+	"context"
+	"fmt"
+	"strings"
+)
+
+// selinuxMode returns "enforcing" or "permissive" as /sys/fs/selinux/enforce
+// tells, or "" where SELinux is disabled or absent.
+func selinuxMode(h *HostEnv) string {
+	switch readFact(h, "/sys/fs/selinux/enforce") {
+	case "1":
+		return "enforcing"
+	case "0":
+		return "permissive"
+	}
+	return ""
+}
+
+// RestoreContexts gives paths the SELinux contexts the policy assigns them,
+// with restorecon, as root if sudo is set. A file staged in the working
+// directory and moved into place keeps tmp_t, which sshd and systemd refuse
+// once SELinux enforces it. Where SELinux is permissive a failure is only
+// warned about; nothing is done where it is disabled, or with
+// --no-selinux-fixup.
+func (s *System) RestoreContexts(ctx context.Context, sudo bool, paths ...string) error {
+	if s.Config.NoSELinuxFixup || len(paths) == 0 {
+		return nil
+	}
+	mode := selinuxMode(s.Host)
+	if mode == "" {
+		return nil
+	}
+	run := s.RunCmd
+	if sudo {
+		run = s.RunCmdSudo
+	}
+	err := run(ctx, "restorecon", paths...)
+	if err == nil {
+		return nil
+	}
+	err = fmt.Errorf("restoring the SELinux contexts of %s failed: %w", strings.Join(paths, ", "), err)
+	if mode == "permissive" {
+		s.Log("Warning: " + err.Error())
+		return nil
+	}
+	return fmt.Errorf("%w (--no-selinux-fixup skips this)", err)
+}
@@ -0,0 +1,84 @@
+package platform
+
+import (
+	"context"
+	"os"
+	"os/exec"
+	"os/signal"
+	"syscall"
+	"time"
+
+	"golang.org/x/term"
+)
+
+// childWaitDelay is how long an interrupted child process is given to exit
+// after being signalled before it is killed outright.
+const childWaitDelay = 10 * time.Second
+
+// HandleSignals returns a context that is cancelled on the first SIGINT or
+// SIGTERM. A second signal exits the process immediately. The returned stop
+// function releases the signal handler.
+func (s *System) HandleSignals() (context.Context, func()) {
+	ctx, cancel := context.WithCancel(context.Background())
+	sigs := make(chan os.Signal, 2)
+	signal.Notify(sigs, os.Interrupt, syscall.SIGTERM)
+
+	done := make(chan struct{})
+	go func() {
+		select {
+		case sig := <-sigs:
+			s.ReceivedSignal.Store(sig)
+			s.Log("Received " + sig.String() + "; stopping (send again to exit immediately)...")
+			cancel()
+		case <-done:
+			return
+		}
+		select {
+		case sig := <-sigs:
+			s.Log("Received " + sig.String() + " again; exiting immediately.")
+			os.Exit(ExitInterrupted)
+		case <-done:
+		}
+	}()
+
+	return ctx, func() {
+		signal.Stop(sigs)
+		close(done)
+		cancel()
+	}
+}
+
+// NewCommand returns a command bound to ctx, and recorded in the
+// transcript. When ctx is cancelled the received signal is forwarded to the
+// child (and, when running without a terminal, to its whole process group),
+// and the child is killed if it has not exited within childWaitDelay.
+func (s *System) NewCommand(ctx context.Context, name string, args ...string) *Command {
+	cmd := exec.CommandContext(ctx, name, args...)
+	// A separate process group lets us signal everything the child spawns
+	// (apt-get -> dpkg, ansible-pull -> ansible-playbook), but a background
+	// group cannot read the terminal, which would break sudo's password
+	// prompt. Interactive Ctrl-C already reaches the whole foreground group.
+	ownGroup := !StdinIsTerminal()
+	if ownGroup {
+		cmd.SysProcAttr = &syscall.SysProcAttr{Setpgid: true}
+	}
+	cmd.Cancel = func() error {
+		sig := syscall.SIGTERM
+		if received, ok := s.ReceivedSignal.Load().(os.Signal); ok {
+			if ss, ok := received.(syscall.Signal); ok {
+				sig = ss
+			}
+		}
+		if ownGroup {
+			return syscall.Kill(-cmd.Process.Pid, sig)
+		}
+		return cmd.Process.Signal(sig)
+	}
+	cmd.WaitDelay = childWaitDelay
+	return &Command{Cmd: cmd, sys: s}
+}
+
+// StdinIsTerminal reports whether standard input is attached to a terminal.
+func StdinIsTerminal() bool {
+	return term.IsTerminal(int(os.Stdin.Fd()))
+}
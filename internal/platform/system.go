@@ -0,0 +1,159 @@
+// Package platform is the host a run provisions: running commands, with
+// privilege escalation where needed, installing packages, and the run's
+// console, journal, transcript, lock and state directory.
+package platform
+
+import (
+	"crypto/x509"
+	"io"
+	"os"
+	"sync"
+	"sync/atomic"
+
+	"github.com/sparkleHazard/bootstrap/internal/config"
+)
+
+// System is the host a run provisions, and the run's own plumbing: the
+// console and logs, the command runner, and what the steps have learned
+// about the host so far. The other units reach the host through it.
+type System struct {
+	// Config is the configuration of the run.
+	Config *config.Config
+
+	// Host is the host bootstrap runs on.
+	Host *HostEnv
+
+	// runner runs the commands of the steps; see RunCmd.
+	runner Runner
+
+	// logger, when set, receives the run's log messages in place of the
+	// terminal and the journal; see SetLogger.
+	logger Logger
+
+	// workDir is this run's private scratch directory, created on first
+	// use by RunWorkDir and removed by RemoveWorkDir when the run ends.
+	workDir string
+
+	// UndoStack holds the reversible changes made so far, oldest first.
+	UndoStack []undoAction
+
+	// Irreversible lists changes made so far that cannot be rolled back.
+	Irreversible []string
+
+	// EscalationCmd is the tool ("sudo" or "doas") RunCmdSudo prefixes
+	// commands with when not running as root, or "" if there is none. It
+	// is set by CheckPrivileges.
+	EscalationCmd string
+
+	// CanEscalate records whether privileged commands can be run, either
+	// because we are root or because EscalationCmd works for this user.
+	// It is set by CheckPrivileges.
+	CanEscalate bool
+
+	sudoKeepaliveOnce sync.Once
+
+	// GatheredFacts is what the facts step gathered, passed to the
+	// playbook; nil until then.
+	GatheredFacts *HostFacts
+
+	// PythonInterpreter is the python3 EnsurePython found, passed to the
+	// playbook as ansible_python_interpreter so that Ansible does not have
+	// to guess it; "" until then.
+	PythonInterpreter string
+
+	// BrewPrefix is the Homebrew prefix (e.g. /opt/homebrew) once brew has
+	// been located by LoadBrewEnv, or "".
+	BrewPrefix string
+
+	// installedMise is where EnsureMise found or installed mise, or "".
+	installedMise string
+
+	// extraRoots are the certificates --ca-cert installed during this run.
+	// Go caches the system roots the first time it verifies a
+	// certificate, so the clients bootstrap itself makes trust these
+	// through RootCAs rather than through the reloaded trust store.
+	extraRoots []*x509.Certificate
+
+	// KeyserverHost is the host name of the keyserver, once it is known,
+	// which --offline allows as internal.
+	KeyserverHost string
+
+	// refreshedIndexes records which package managers have had their index
+	// refreshed (or found fresh) during this run.
+	refreshedIndexes map[string]bool
+
+	// epelInstalled records whether epel-release has been installed this
+	// run.
+	epelInstalled bool
+
+	aptLockTimeoutOnce      sync.Once
+	aptLockTimeoutSupported bool
+
+	// Transcript, when --transcript is set, records every command the run
+	// executes; see command.
+	Transcript atomic.Pointer[transcriptWriter]
+
+	// Journal sends bootstrap's messages to journald as native entries,
+	// with the run's step, role and outcome as fields of their own, when
+	// journald is the log target.
+	Journal *journalLogger
+
+	// Console serializes what bootstrap and its child commands write to
+	// the terminal with the progress line: a single line naming the
+	// current step and how long it has been running, drawn in place while
+	// nothing else is being written and erased before anything else is.
+	Console *progressConsole
+
+	// StepOutput retains the tail of the current step's output:
+	// bootstrap's own log lines and the output of the commands it runs. It
+	// is emptied as the run enters each step, and sent, redacted, with
+	// error reports.
+	StepOutput *syncTail
+
+	// RunOutput retains the tail of the whole run's output, like
+	// StepOutput but across steps, for --upload-failure-logs.
+	RunOutput *syncTail
+
+	// ConsoleStdout and ConsoleStderr write to stdout and stderr through
+	// console. All of a run's terminal output must go through them.
+	ConsoleStdout, ConsoleStderr io.Writer
+
+	// CommandStdout and CommandStderr are where child commands' output
+	// goes: to the terminal, unless --quiet, and to StepOutput.
+	CommandStdout, CommandStderr io.Writer
+
+	// StepRetries counts the retries made in the current step, by retry
+	// and by the polls of WaitForKeyserver.
+	StepRetries atomic.Int64
+
+	// ReceivedSignal holds the first termination signal delivered to the
+	// process, so it can be forwarded to children as-is.
+	ReceivedSignal atomic.Value
+
+	// runSecrets are the secrets of this run, which RedactSecrets keeps
+	// out of error reports and the transcript: the tokens and passwords of
+	// the configuration, and those read from secret sources.
+	runSecrets []string
+}
+
+// NewSystem returns the system for a run on host with configuration cfg,
+// writing to the terminal.
+func NewSystem(cfg *config.Config, host *HostEnv) *System {
+	s := &System{
+		Config:           cfg,
+		Host:             host,
+		EscalationCmd:    "sudo",
+		CanEscalate:      host.EUID() == 0,
+		refreshedIndexes: map[string]bool{},
+		Journal:          &journalLogger{role: cfg.Role},
+		Console:          &progressConsole{enabled: ProgressEnabled(cfg)},
+		StepOutput:       &syncTail{tail: TailBuffer{Max: stepOutputMax}},
+		RunOutput:        &syncTail{tail: TailBuffer{Max: runOutputMax}},
+	}
+	s.runner = execRunner{sys: s}
+	s.ConsoleStdout = consoleWriter{f: os.Stdout, console: s.Console}
+	s.ConsoleStderr = consoleWriter{f: os.Stderr, console: s.Console}
+	s.CommandStdout = commandWriter{terminal: s.ConsoleStdout, sys: s}
+	s.CommandStderr = commandWriter{terminal: s.ConsoleStderr, sys: s}
+	return s
+}
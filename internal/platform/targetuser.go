@@ -0,0 +1,119 @@
+package platform
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"os/user"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"syscall"
+)
+
+// TargetUser returns the account that user-level setup (mise and its
+// one-shot unit) is for: the user who invoked bootstrap through sudo or
+// doas, or else the current user.
+func (s *System) TargetUser() (*user.User, error) {
+	name := invokingUser(s.Host)
+	if name == "" {
+		u, err := user.Current()
+		if err != nil {
+			return nil, fmt.Errorf("cannot determine current user: %w", err)
+		}
+		return u, nil
+	}
+	u, err := user.Lookup(name)
+	if err != nil {
+		return nil, fmt.Errorf("cannot look up user %s: %w", name, err)
+	}
+	return u, nil
+}
+
+// passwdFile is the account database LoginShell reads.
+const passwdFile = "/etc/passwd"
+
+// LoginShell returns u's login shell from /etc/passwd, or /bin/sh when it is
+// unset, a nologin placeholder, or not installed (os/user does not expose
+// the shell). It fails only if /bin/sh is missing too.
+func (s *System) LoginShell(u *user.User) (string, error) {
+	shell := ""
+	if data, err := s.Host.ReadFile(passwdFile); err == nil {
+		for _, line := range strings.Split(string(data), "\n") {
+			fields := strings.Split(line, ":")
+			if len(fields) == 7 && fields[0] == u.Username {
+				shell = fields[6]
+				break
+			}
+		}
+	}
+	switch filepath.Base(shell) {
+	case "", "nologin", "false", "true":
+		shell = ""
+	}
+	if shell != "" && FileExists(shell) {
+		return shell, nil
+	}
+	if !FileExists("/bin/sh") {
+		return "", fmt.Errorf("neither %s's login shell %q nor /bin/sh exists", u.Username, shell)
+	}
+	return "/bin/sh", nil
+}
+
+// commandAsUser returns a command running script with /bin/sh as a login
+// shell for u, so that u's PATH and profile apply. As root the credentials
+// are switched directly; otherwise the escalation tool's -u is used unless u
+// is already the current user.
+func (s *System) commandAsUser(ctx context.Context, u *user.User, script string) (*Command, error) {
+	if cur, err := user.Current(); err == nil && cur.Uid == u.Uid {
+		return s.NewCommand(ctx, "/bin/sh", "-lc", script), nil
+	}
+	if s.Host.EUID() != 0 {
+		if s.EscalationCmd == "" {
+			return nil, fmt.Errorf("cannot run commands as %s without sudo or doas", u.Username)
+		}
+		args := []string{"-u", u.Username, "/bin/sh", "-lc", script}
+		if s.EscalationCmd == "sudo" {
+			args = append([]string{"-H"}, args...)
+		}
+		return s.NewCommand(ctx, s.EscalationCmd, args...), nil
+	}
+
+	uid, err := strconv.ParseUint(u.Uid, 10, 32)
+	if err != nil {
+		return nil, fmt.Errorf("user %s has non-numeric uid %q", u.Username, u.Uid)
+	}
+	gid, err := strconv.ParseUint(u.Gid, 10, 32)
+	if err != nil {
+		return nil, fmt.Errorf("user %s has non-numeric gid %q", u.Username, u.Gid)
+	}
+	cmd := s.NewCommand(ctx, "/bin/sh", "-lc", script)
+	if cmd.SysProcAttr == nil {
+		cmd.SysProcAttr = &syscall.SysProcAttr{}
+	}
+	cmd.SysProcAttr.Credential = &syscall.Credential{Uid: uint32(uid), Gid: uint32(gid)}
+	if fi, err := os.Stat(u.HomeDir); err == nil && fi.IsDir() {
+		cmd.Dir = u.HomeDir
+	}
+	cmd.Env = []string{
+		"HOME=" + u.HomeDir,
+		"USER=" + u.Username,
+		"LOGNAME=" + u.Username,
+		"PATH=/usr/local/bin:/usr/bin:/bin:/usr/local/sbin:/usr/sbin:/sbin",
+	}
+	return cmd, nil
+}
+
+// RunAsUser runs script as u with commandAsUser, reading stdin if it is
+// non-nil and passing its output through.
+func (s *System) RunAsUser(ctx context.Context, u *user.User, script string, stdin io.Reader) error {
+	cmd, err := s.commandAsUser(ctx, u, script)
+	if err != nil {
+		return err
+	}
+	cmd.Stdin = stdin
+	cmd.Stdout = s.CommandStdout
+	cmd.Stderr = s.CommandStderr
+	return cmd.Run()
+}
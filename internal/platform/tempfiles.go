@@ -0,0 +1,151 @@
+package platform
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"syscall"
+)
+
+// RunWorkDir returns the run's scratch directory, creating it (mode 0700)
+// if needed. Temporary artifacts such as the fetched key belong here rather
+// than at fixed paths in /tmp, so they are private to this run and removed
+// with it.
+func (s *System) RunWorkDir() (string, error) {
+	if s.workDir != "" {
+		return s.workDir, nil
+	}
+	dir, err := os.MkdirTemp("", "bootstrap-")
+	if err != nil {
+		return "", fmt.Errorf("unable to create working directory: %w", err)
+	}
+	s.workDir = dir
+	return dir, nil
+}
+
+// RemoveWorkDir deletes the scratch directory and everything in it.
+func (s *System) RemoveWorkDir() {
+	if s.workDir == "" {
+		return
+	}
+	if err := os.RemoveAll(s.workDir); err != nil {
+		s.Log("Failed to remove working directory: " + err.Error())
+	}
+	s.workDir = ""
+}
+
+// HardenUmask adds 022 to the process umask, so that neither a file this
+// process creates without an explicit mode nor one a command it runs
+// creates is group- or world-writable, whatever umask it was started with.
+func HardenUmask() {
+	syscall.Umask(syscall.Umask(0) | 0o022)
+}
+
+// RootOwner is the owner WriteFile gives the system files bootstrap
+// installs.
+const RootOwner = "root:root"
+
+// WriteFile makes path a file with content data and mode, replacing it only
+// if its content or mode differs, and reports whether it did. The new file
+// is written beside path and renamed over it, so path is never partial or
+// briefly more open than mode, and a symlink at path is replaced rather than
+// followed. Without an owner the file is the run's user's; with one
+// ("USER:GROUP", as names or IDs) it is given that owner and installed with
+// the escalation tool, for files the run's user cannot write.
+func (s *System) WriteFile(ctx context.Context, path string, data []byte, mode os.FileMode, owner string) (bool, error) {
+	if owner != "" {
+		return s.writeFileAs(ctx, path, data, fmt.Sprintf("%04o", mode.Perm()), owner)
+	}
+	if fi, err := os.Lstat(path); err == nil && fi.Mode().IsRegular() && fi.Mode().Perm() == mode.Perm() {
+		if old, err := os.ReadFile(path); err == nil && bytes.Equal(old, data) {
+			return false, nil
+		}
+	}
+	f, err := os.CreateTemp(filepath.Dir(path), "."+filepath.Base(path)+".tmp-")
+	if err != nil {
+		return false, err
+	}
+	tmp := f.Name()
+	defer os.Remove(tmp) // no-op once renamed
+
+	if err := f.Chmod(mode.Perm()); err != nil {
+		f.Close()
+		return false, err
+	}
+	if _, err := f.Write(data); err != nil {
+		f.Close()
+		return false, err
+	}
+	if err := f.Sync(); err != nil {
+		f.Close()
+		return false, err
+	}
+	if err := f.Close(); err != nil {
+		return false, err
+	}
+	return true, os.Rename(tmp, path)
+}
+
+// OpenFile opens path, which is written to as the run goes, with flag
+// (os.O_TRUNC or os.O_APPEND, and os.O_RDWR or os.O_WRONLY), creating it with
+// mode. Unlike os.OpenFile it refuses a symlink at path, and a file another
+// user owns, such as one planted in a shared directory like /tmp; an
+// existing file is given mode.
+func OpenFile(path string, flag int, mode os.FileMode) (*os.File, error) {
+	f, err := os.OpenFile(path, flag|os.O_CREATE|syscall.O_NOFOLLOW, mode.Perm())
+	if err != nil {
+		return nil, err
+	}
+	fi, err := f.Stat()
+	if err == nil {
+		if st, ok := fi.Sys().(*syscall.Stat_t); ok && int(st.Uid) != os.Geteuid() {
+			err = fmt.Errorf("%s is owned by uid %d, not this user", path, st.Uid)
+		}
+	}
+	if err == nil && fi.Mode().Perm() != mode.Perm() {
+		err = f.Chmod(mode.Perm())
+	}
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+	return f, nil
+}
+
+// writeFileAs is WriteFile for a file with an owner, with mode in the
+// install command's octal.
+func (s *System) writeFileAs(ctx context.Context, dest string, data []byte, mode, owner string) (bool, error) {
+	dir, err := s.RunWorkDir()
+	if err != nil {
+		return false, err
+	}
+	tmp := filepath.Join(dir, filepath.Base(dest))
+	if _, err := s.WriteFile(ctx, tmp, data, 0600, ""); err != nil {
+		return false, err
+	}
+	defer os.Remove(tmp)
+
+	user, group, _ := strings.Cut(owner, ":")
+	if s.RunCmdSudo(ctx, "cmp", "-s", tmp, dest) == nil {
+		for _, a := range [][]string{{"chown", owner, dest}, {"chmod", mode, dest}} {
+			if err := s.RunCmdSudo(ctx, a[0], a[1:]...); err != nil {
+				return false, fmt.Errorf("%s %s failed: %w", a[0], dest, err)
+			}
+		}
+		return false, s.RestoreContexts(ctx, true, dest)
+	}
+	// A dotfile, which the directories bootstrap writes to (sudoers.d,
+	// systemd's and the trust stores') do not pick up.
+	staged := filepath.Join(filepath.Dir(dest), "."+filepath.Base(dest)+".bootstrap-new")
+	if err := s.RunCmdSudo(ctx, "install", "-o", user, "-g", group, "-m", mode, tmp, staged); err != nil {
+		return false, fmt.Errorf("install %s failed: %w", dest, err)
+	}
+	if err := s.RunCmdSudo(ctx, "mv", "-f", staged, dest); err != nil {
+		s.RunCmdSudo(ctx, "rm", "-f", staged)
+		return false, fmt.Errorf("replacing %s failed: %w", dest, err)
+	}
+	return true, s.RestoreContexts(ctx, true, dest)
+}
@@ -0,0 +1,334 @@
+package platform
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os/exec"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/sparkleHazard/bootstrap/internal/config"
+)
+
+// timesyncWait is how long EnsureTimesync waits for the daemon to
+// synchronise with a server.
+const timesyncWait = 60 * time.Second
+
+// chronyBlockStart and chronyBlockEnd enclose the server lines
+// --ntp-server adds to chrony.conf, so that later runs replace them.
+const (
+	chronyBlockStart = "# BEGIN bootstrap ntp-server"
+	chronyBlockEnd   = "# END bootstrap ntp-server"
+)
+
+// timesyncdDropIn is the timesyncd configuration --ntp-server installs.
+const timesyncdDropIn = "/etc/systemd/timesyncd.conf.d/bootstrap.conf"
+
+// defaultMacNTPServer is the server macOS syncs with unless --ntp-server
+// names another.
+const defaultMacNTPServer = "time.apple.com"
+
+// timesyncDaemon returns the time daemon --ensure-timesync sets up on osID:
+// the configured one, or with "auto" chrony, except on Debian and Ubuntu
+// without chrony, whose systemd ships systemd-timesyncd.
+func (s *System) timesyncDaemon(ctx context.Context, osID string) string {
+	if s.Config.TimesyncDaemon != "auto" {
+		return s.Config.TimesyncDaemon
+	}
+	if (osID == "debian" || osID == "ubuntu") && !s.packageInstalled(ctx, osID, "chrony") {
+		return "timesyncd"
+	}
+	return "chrony"
+}
+
+// EnsureTimesync implements --ensure-timesync: it installs and enables the
+// time daemon, points it at --ntp-server if given, has it step the clock
+// now, and fails unless the clock is then within --max-clock-skew of its
+// servers. It is a no-op for what is already in place. It returns the
+// step's status, "configured" or "unchanged", and the measured offset,
+// positive when the local clock is ahead.
+func (s *System) EnsureTimesync(ctx context.Context, osID string) (string, time.Duration, error) {
+	if osID == "darwin" {
+		return s.ensureMacTimesync(ctx)
+	}
+	if !s.CanEscalate {
+		return "", 0, errors.New("ensure-timesync needs root, or sudo or doas")
+	}
+	var changed bool
+	var err error
+	daemon := s.timesyncDaemon(ctx, osID)
+	switch daemon {
+	case "chrony":
+		changed, err = s.setupChrony(ctx, osID)
+	case "timesyncd":
+		changed, err = s.setupTimesyncd(ctx, osID)
+	default:
+		err = fmt.Errorf("unsupported timesync-daemon %q", daemon)
+	}
+	if err != nil {
+		return "", 0, err
+	}
+	offset, err := s.timesyncOffset(ctx, daemon)
+	if err != nil {
+		return "", 0, err
+	}
+	status := "unchanged"
+	if changed {
+		status = "configured"
+	}
+	return status, offset, s.checkOffset(offset)
+}
+
+// checkOffset fails if offset is beyond --max-clock-skew.
+func (s *System) checkOffset(offset time.Duration) error {
+	if Abs(offset) > s.Config.MaxClockSkew {
+		return fmt.Errorf("system clock is still off by %s after the time sync (allowed %s)", offset, s.Config.MaxClockSkew)
+	}
+	s.Log(fmt.Sprintf("System clock is synchronised, off by %s.", offset))
+	return nil
+}
+
+// setupChrony installs chrony, writes --ntp-server into chrony.conf and
+// makes sure chronyd runs and has stepped the clock. It reports whether it
+// changed anything.
+func (s *System) setupChrony(ctx context.Context, osID string) (bool, error) {
+	changed := false
+	if !s.packageInstalled(ctx, osID, "chrony") {
+		if err := s.EnsureExtraPrereq(ctx, osID, config.ExtraPrereq{Name: "chrony"}); err != nil {
+			return false, err
+		}
+		changed = true
+	}
+	conf := "/etc/chrony.conf"
+	service := "chronyd"
+	if osID == "debian" || osID == "ubuntu" {
+		conf, service = "/etc/chrony/chrony.conf", "chrony"
+	}
+	data, err := s.Host.ReadFile(conf)
+	if err != nil {
+		return false, fmt.Errorf("reading %s: %w", conf, err)
+	}
+	var servers []string
+	for _, server := range s.Config.NTPServers {
+		servers = append(servers, "server "+server+" iburst")
+	}
+	confChanged, err := s.WriteFile(ctx, s.Host.Path(conf), withManagedBlock(data, chronyBlockStart, chronyBlockEnd, servers), 0644, RootOwner)
+	if err != nil {
+		return false, err
+	}
+	restart := "start"
+	if confChanged {
+		restart, changed = "restart", true
+	}
+	if !s.serviceActive(ctx, service) {
+		changed = true
+	}
+	if err := s.enableService(ctx, service, restart); err != nil {
+		return false, err
+	}
+	s.Log("Waiting for chrony to synchronise...")
+	// Up to timesyncWait, polling every second, for any correction.
+	tries := strconv.Itoa(int(timesyncWait / time.Second))
+	if err := s.RunCmd(ctx, "chronyc", "waitsync", tries, "0", "0", "1"); err != nil {
+		return false, fmt.Errorf("chrony did not synchronise within %s: %w", timesyncWait, err)
+	}
+	if err := s.RunCmdSudo(ctx, "chronyc", "-a", "makestep"); err != nil {
+		return false, fmt.Errorf("chronyc makestep failed: %w", err)
+	}
+	return changed, nil
+}
+
+// setupTimesyncd installs systemd-timesyncd where it is a package of its
+// own, installs the --ntp-server drop-in, and turns on NTP through
+// timedatectl, which steps the clock once it has a server. It reports
+// whether it changed anything.
+func (s *System) setupTimesyncd(ctx context.Context, osID string) (bool, error) {
+	changed := false
+	if _, err := exec.LookPath("timedatectl"); err != nil || !s.Host.SystemdRunning() {
+		return false, errors.New("systemd-timesyncd needs systemd and timedatectl")
+	}
+	if (osID == "debian" || osID == "ubuntu") && !s.packageInstalled(ctx, osID, "systemd-timesyncd") {
+		if err := s.EnsureExtraPrereq(ctx, osID, config.ExtraPrereq{Name: "systemd-timesyncd"}); err != nil {
+			return false, err
+		}
+		changed = true
+	}
+	restart := "start"
+	if len(s.Config.NTPServers) > 0 {
+		dropIn := "[Time]\nNTP=" + strings.Join(s.Config.NTPServers, " ") + "\n"
+		if err := s.RunCmdSudo(ctx, "mkdir", "-p", s.Host.Path("/etc/systemd/timesyncd.conf.d")); err != nil {
+			return false, err
+		}
+		c, err := s.WriteFile(ctx, s.Host.Path(timesyncdDropIn), []byte(dropIn), 0644, RootOwner)
+		if err != nil {
+			return false, err
+		}
+		if c {
+			restart, changed = "restart", true
+		}
+	} else if FileExists(s.Host.Path(timesyncdDropIn)) {
+		if err := s.RunCmdSudo(ctx, "rm", "-f", s.Host.Path(timesyncdDropIn)); err != nil {
+			return false, err
+		}
+		restart, changed = "restart", true
+	}
+	if out, _ := s.CmdOutput(ctx, "timedatectl", "show", "-p", "NTP", "--value"); strings.TrimSpace(string(out)) != "yes" {
+		if err := s.RunCmdSudo(ctx, "timedatectl", "set-ntp", "true"); err != nil {
+			return false, fmt.Errorf("timedatectl set-ntp failed: %w", err)
+		}
+		changed = true
+	}
+	if !s.serviceActive(ctx, "systemd-timesyncd") {
+		changed = true
+	}
+	if err := s.enableService(ctx, "systemd-timesyncd", restart); err != nil {
+		return false, err
+	}
+	s.Log("Waiting for systemd-timesyncd to synchronise...")
+	deadline := time.Now().Add(timesyncWait)
+	for {
+		out, _ := s.CmdOutput(ctx, "timedatectl", "show", "-p", "NTPSynchronized", "--value")
+		if strings.TrimSpace(string(out)) == "yes" {
+			return changed, nil
+		}
+		if time.Now().After(deadline) {
+			return false, fmt.Errorf("systemd-timesyncd did not synchronise within %s", timesyncWait)
+		}
+		select {
+		case <-ctx.Done():
+			return false, ctx.Err()
+		case <-time.After(2 * time.Second):
+		}
+	}
+}
+
+// serviceActive reports whether the systemd service is running.
+func (s *System) serviceActive(ctx context.Context, service string) bool {
+	return s.RunCmd(ctx, "systemctl", "is-active", "--quiet", service) == nil
+}
+
+// enableService enables service and starts it, or with "restart"
+// restarts it.
+func (s *System) enableService(ctx context.Context, service, start string) error {
+	if err := s.RunCmdSudo(ctx, "systemctl", "enable", service); err != nil {
+		return fmt.Errorf("enabling %s failed: %w", service, err)
+	}
+	if err := s.RunCmdSudo(ctx, "systemctl", start, service); err != nil {
+		return fmt.Errorf("%s of %s failed: %w", start, service, err)
+	}
+	return nil
+}
+
+// withManagedBlock returns data with the lines between start and end
+// replaced by lines, appending the block if data has none, and removing it
+// if lines is empty.
+func withManagedBlock(data []byte, start, end string, lines []string) []byte {
+	var out []string
+	in := false
+	for _, line := range strings.Split(strings.TrimRight(string(data), "\n"), "\n") {
+		switch {
+		case line == start:
+			in = true
+		case line == end:
+			in = false
+		case !in:
+			out = append(out, line)
+		}
+	}
+	if len(lines) > 0 {
+		out = append(out, start)
+		out = append(out, lines...)
+		out = append(out, end)
+	}
+	return []byte(strings.Join(out, "\n") + "\n")
+}
+
+// timesyncOffset returns how far the local clock is ahead of the daemon's
+// servers: chrony's "System time" from chronyc tracking, or timesyncd's
+// last measured offset.
+func (s *System) timesyncOffset(ctx context.Context, daemon string) (time.Duration, error) {
+	if daemon == "chrony" {
+		out, err := s.CmdOutput(ctx, "chronyc", "tracking")
+		if err != nil {
+			return 0, fmt.Errorf("chronyc tracking failed: %w", err)
+		}
+		return parseChronyOffset(string(out))
+	}
+	out, err := s.CmdOutput(ctx, "timedatectl", "timesync-status")
+	if err != nil {
+		return 0, fmt.Errorf("timedatectl timesync-status failed: %w", err)
+	}
+	for _, line := range strings.Split(string(out), "\n") {
+		if v, ok := strings.CutPrefix(strings.TrimSpace(line), "Offset:"); ok {
+			return time.ParseDuration(strings.TrimSpace(v))
+		}
+	}
+	return 0, errors.New("timedatectl timesync-status reported no offset")
+}
+
+// parseChronyOffset parses the "System time : 0.000012 seconds fast of NTP
+// time" line of chronyc tracking.
+func parseChronyOffset(tracking string) (time.Duration, error) {
+	for _, line := range strings.Split(tracking, "\n") {
+		k, v, ok := strings.Cut(line, ":")
+		if !ok || strings.TrimSpace(k) != "System time" {
+			continue
+		}
+		f := strings.Fields(v)
+		if len(f) < 3 {
+			break
+		}
+		secs, err := strconv.ParseFloat(f[0], 64)
+		if err != nil {
+			break
+		}
+		if f[2] == "slow" {
+			secs = -secs
+		}
+		return time.Duration(secs * float64(time.Second)), nil
+	}
+	return 0, errors.New("chronyc tracking reported no system time offset")
+}
+
+// ensureMacTimesync turns on network time with systemsetup, pointed at the
+// first --ntp-server or time.apple.com, and steps the clock with sntp.
+func (s *System) ensureMacTimesync(ctx context.Context) (string, time.Duration, error) {
+	server := defaultMacNTPServer
+	if len(s.Config.NTPServers) > 0 {
+		server = s.Config.NTPServers[0]
+	}
+	status := "unchanged"
+	if out, _ := s.CmdOutput(ctx, "systemsetup", "-getnetworktimeserver"); !strings.HasSuffix(strings.TrimSpace(string(out)), " "+server) {
+		if err := s.RunCmdSudo(ctx, "systemsetup", "-setnetworktimeserver", server); err != nil {
+			return "", 0, fmt.Errorf("setting the network time server failed: %w", err)
+		}
+		status = "configured"
+	}
+	if out, _ := s.CmdOutput(ctx, "systemsetup", "-getusingnetworktime"); !strings.HasSuffix(strings.TrimSpace(string(out)), " On") {
+		if err := s.RunCmdSudo(ctx, "systemsetup", "-setusingnetworktime", "on"); err != nil {
+			return "", 0, fmt.Errorf("turning on network time failed: %w", err)
+		}
+		status = "configured"
+	}
+	if err := s.RunCmdSudo(ctx, "sntp", "-sS", server); err != nil {
+		return "", 0, fmt.Errorf("sntp -sS %s failed: %w", server, err)
+	}
+	out, err := s.CmdOutput(ctx, "sntp", server)
+	if err != nil {
+		return "", 0, fmt.Errorf("sntp %s failed: %w", server, err)
+	}
+	// "+0.001234 +/- 0.010 time.apple.com 17.253.14.251", the correction
+	// the local clock needs, so the negated offset.
+	f := strings.Fields(string(out))
+	secs, err := 0.0, errors.New("no offset")
+	if len(f) > 0 {
+		secs, err = strconv.ParseFloat(f[0], 64)
+	}
+	if err != nil {
+		return "", 0, fmt.Errorf("unexpected sntp output %q", strings.TrimSpace(string(out)))
+	}
+	offset := -time.Duration(secs * float64(time.Second))
+	return status, offset, s.checkOffset(offset)
+}
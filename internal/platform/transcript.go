@@ -0,0 +1,213 @@
+package platform
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"io"
+	"os"
+	"os/exec"
+	"sync"
+	"syscall"
+	"time"
+	"unicode/utf8"
+)
+
+// transcriptWriter writes the --transcript file: JSON lines, one record per
+// line, in the order things happened. A "transcript" record opens the file;
+// each command then has a "start" record, an "output" record for every
+// chunk of its stdout or stderr as it arrived, and an "end" record, all
+// sharing the command's id. Records are written as they happen, so a
+// command's output is never held in memory.
+type transcriptWriter struct {
+	mu     sync.Mutex
+	f      *os.File
+	enc    *json.Encoder
+	lastID int
+	sys    *System
+	err    error // the first write error, after which recording stops
+}
+
+// transcriptRecord is one line of the transcript.
+type transcriptRecord struct {
+	Type string    `json:"type"`
+	ID   int       `json:"id,omitempty"`
+	Time time.Time `json:"time"`
+
+	// "transcript": the bootstrap build and host that wrote it.
+	Version  string `json:"version,omitempty"`
+	Hostname string `json:"hostname,omitempty"`
+
+	// "start": the command line, redacted, and its working directory.
+	Argv []string `json:"argv,omitempty"`
+	Dir  string   `json:"dir,omitempty"`
+
+	// "output": which stream, and the bytes read from it; as text when
+	// they are valid UTF-8, otherwise base64-encoded.
+	Stream     string `json:"stream,omitempty"`
+	Data       string `json:"data,omitempty"`
+	DataBase64 []byte `json:"data_base64,omitempty"`
+
+	// "end": the exit code, or -1 with the signal that killed the command
+	// or the error that kept it from starting.
+	ExitCode        *int    `json:"exit_code,omitempty"`
+	Signal          string  `json:"signal,omitempty"`
+	Error           string  `json:"error,omitempty"`
+	DurationSeconds float64 `json:"duration_seconds,omitempty"`
+}
+
+// OpenTranscript creates (or truncates) the transcript at path, readable
+// only by its owner since commands' output may contain anything.
+func (s *System) OpenTranscript(path string) (*transcriptWriter, error) {
+	f, err := OpenFile(path, os.O_WRONLY|os.O_TRUNC, 0o600)
+	if err != nil {
+		return nil, err
+	}
+	t := &transcriptWriter{f: f, enc: json.NewEncoder(f), sys: s}
+	t.enc.SetEscapeHTML(false)
+	host, _ := os.Hostname()
+	t.write(&transcriptRecord{Type: "transcript", Time: time.Now(), Version: ToolVersion(), Hostname: host})
+	if t.err != nil {
+		f.Close()
+		return nil, t.err
+	}
+	return t, nil
+}
+
+// write appends rec to the transcript. A failure is logged once and stops
+// the recording; it never fails the run.
+func (t *transcriptWriter) write(rec *transcriptRecord) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.err != nil {
+		return
+	}
+	if err := t.enc.Encode(rec); err != nil {
+		t.err = err
+		t.sys.Log("Warning: the transcript is incomplete: " + err.Error())
+	}
+}
+
+// Close closes the transcript file. Commands still running are not
+// recorded further.
+func (t *transcriptWriter) Close() error {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	err := t.f.Close()
+	if t.err == nil {
+		t.err = os.ErrClosed
+	}
+	return err
+}
+
+// Command is an exec.Cmd that is recorded in the transcript when it runs.
+// NewCommand returns one; Run, Output and CombinedOutput are the ways to
+// run it.
+type Command struct {
+	*exec.Cmd
+	sys *System
+}
+
+// Run starts the command and waits for it, as exec.Cmd.Run does.
+func (c *Command) Run() error {
+	t := c.sys.Transcript.Load()
+	if t == nil {
+		return c.Cmd.Run()
+	}
+	t.mu.Lock()
+	t.lastID++
+	id := t.lastID
+	t.mu.Unlock()
+
+	argv := make([]string, len(c.Args))
+	for i, a := range c.Args {
+		argv[i] = c.sys.RedactSecrets(a)
+	}
+	dir := c.Dir
+	if dir == "" {
+		dir, _ = os.Getwd()
+	}
+	start := time.Now()
+	t.write(&transcriptRecord{Type: "start", ID: id, Time: start, Argv: argv, Dir: dir})
+
+	// Output the caller discards is recorded all the same.
+	var mu sync.Mutex
+	c.Stdout = &transcriptStream{t: t, id: id, name: "stdout", w: c.Stdout, mu: &mu}
+	c.Stderr = &transcriptStream{t: t, id: id, name: "stderr", w: c.Stderr, mu: &mu}
+	err := c.Cmd.Run()
+
+	end := &transcriptRecord{Type: "end", ID: id, Time: time.Now()}
+	end.DurationSeconds = end.Time.Sub(start).Seconds()
+	code := -1
+	if ps := c.ProcessState; ps != nil {
+		code = ps.ExitCode()
+		if ws, ok := ps.Sys().(syscall.WaitStatus); ok && ws.Signaled() {
+			end.Signal = ws.Signal().String()
+		}
+	}
+	end.ExitCode = &code
+	var exitErr *exec.ExitError
+	if err != nil && !errors.As(err, &exitErr) {
+		end.Error = c.sys.RedactSecrets(err.Error())
+	}
+	t.write(end)
+	return err
+}
+
+// Output runs the command and returns its standard output, as
+// exec.Cmd.Output does.
+func (c *Command) Output() ([]byte, error) {
+	if c.sys.Transcript.Load() == nil {
+		return c.Cmd.Output()
+	}
+	if c.Stdout != nil {
+		return nil, errors.New("exec: Stdout already set")
+	}
+	var out bytes.Buffer
+	c.Stdout = &out
+	err := c.Run()
+	return out.Bytes(), err
+}
+
+// CombinedOutput runs the command and returns its standard output and
+// standard error, as exec.Cmd.CombinedOutput does.
+func (c *Command) CombinedOutput() ([]byte, error) {
+	if c.sys.Transcript.Load() == nil {
+		return c.Cmd.CombinedOutput()
+	}
+	if c.Stdout != nil || c.Stderr != nil {
+		return nil, errors.New("exec: Stdout or Stderr already set")
+	}
+	var out bytes.Buffer
+	c.Stdout, c.Stderr = &out, &out
+	err := c.Run()
+	return out.Bytes(), err
+}
+
+// transcriptStream records what a command writes to one of its streams
+// before passing it on to w, if w is non-nil. mu, shared by the command's
+// streams, keeps them from writing to w at the same time, as they may
+// share it.
+type transcriptStream struct {
+	t    *transcriptWriter
+	id   int
+	name string
+	w    io.Writer
+	mu   *sync.Mutex
+}
+
+func (s *transcriptStream) Write(p []byte) (int, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	rec := &transcriptRecord{Type: "output", ID: s.id, Time: time.Now(), Stream: s.name}
+	if utf8.Valid(p) {
+		rec.Data = string(p)
+	} else {
+		rec.DataBase64 = p
+	}
+	s.t.write(rec)
+	if s.w == nil {
+		return len(p), nil
+	}
+	return s.w.Write(p)
+}
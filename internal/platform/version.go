@@ -0,0 +1,28 @@
+package platform
+
+import "runtime/debug"
+
+// version is the release version, set at build time with
+// -ldflags "-X github.com/sparkleHazard/bootstrap/internal/platform.version=v1.2.3".
+var version = ""
+
+// ToolVersion returns version, falling back to the module version or VCS
+// revision recorded by the Go toolchain, then "dev".
+func ToolVersion() string {
+	if version != "" {
+		return version
+	}
+	info, ok := debug.ReadBuildInfo()
+	if !ok {
+		return "dev"
+	}
+	if v := info.Main.Version; v != "" && v != "(devel)" {
+		return v
+	}
+	for _, s := range info.Settings {
+		if s.Key == "vcs.revision" && len(s.Value) >= 12 {
+			return "dev-" + s.Value[:12]
+		}
+	}
+	return "dev"
+}
@@ -0,0 +1,122 @@
+package release
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"os"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/sparkleHazard/bootstrap/internal/platform"
+	"github.com/sparkleHazard/bootstrap/internal/service"
+)
+
+// DownloadURL is where a release's assets are downloaded from, by
+// tag: DownloadURL + TAG + "/" + ASSET.
+const DownloadURL = "https://github.com/sparkleHazard/bootstrap/releases/download/"
+
+// cloudInitScriptPath is where the generated user-data writes the script
+// that installs and runs bootstrap.
+const cloudInitScriptPath = "/usr/local/sbin/bootstrap-cloud-init"
+
+// cloudInitAssets maps the machine names uname -m reports to the Linux
+// release binaries.
+var cloudInitAssets = []struct{ machine, asset string }{
+	{"x86_64", "bootstrap-linux-amd64"},
+	{"aarch64|arm64", "bootstrap-linux-arm64"},
+	{"armv7l", "bootstrap-linux-armv7l"},
+}
+
+// CloudRoleLookups are the shell commands that read the role from each
+// cloud's instance metadata, with %s standing for the tag or attribute
+// name. They print nothing if it is not set.
+var CloudRoleLookups = map[string]string{
+	"ec2": `token=$(curl -fsS -m 5 -X PUT -H 'X-aws-ec2-metadata-token-ttl-seconds: 300' http://169.254.169.254/latest/api/token || true)
+role=$(curl -fsS -m 5 -H "X-aws-ec2-metadata-token: $token" http://169.254.169.254/latest/meta-data/tags/instance/%s || true)`,
+	"gcp":   `role=$(curl -fsS -m 5 -H 'Metadata-Flavor: Google' http://metadata.google.internal/computeMetadata/v1/instance/attributes/%s || true)`,
+	"azure": `role=$(curl -fsS -m 5 -H 'Metadata: true' 'http://169.254.169.254/metadata/instance/compute/tags?api-version=2021-02-01&format=text' | tr ';' '\n' | sed -n 's/^%s://p' || true)`,
+}
+
+// genCloudInitFlags are the flags of gen-cloudinit itself, which are left
+// out of the generated config file.
+var genCloudInitFlags = []string{"release", "download-url", "sums", "cloud", "role-tag", "output", "base64"}
+
+// ReleaseSums returns the SHA256SUMS of the release at downloadURL, read
+// from sumsFile if it is set.
+func (u *Updater) ReleaseSums(ctx context.Context, downloadURL, sumsFile string) (string, error) {
+	if sumsFile != "" {
+		data, err := os.ReadFile(sumsFile)
+		return string(data), err
+	}
+	ctx, cancel := context.WithTimeout(ctx, 30*time.Second)
+	defer cancel()
+	var sums strings.Builder
+	if _, err := u.FetchRelease(ctx, downloadURL+"/"+ChecksumsAsset, &limitedWriter{w: &sums, n: 64 * 1024}); err != nil {
+		return "", err
+	}
+	return sums.String(), nil
+}
+
+// GenCloudInitSettings returns the effective configuration as config file
+// lines, as for rerun.conf but without gen-cloudinit's own flags.
+func GenCloudInitSettings(fs *flag.FlagSet) []string {
+	var out []string
+	for _, line := range strings.Split(strings.TrimSuffix(service.CaptureSettings(fs), "\n"), "\n") {
+		name, _, _ := strings.Cut(line, " = ")
+		if line != "" && !slices.Contains(genCloudInitFlags, name) {
+			out = append(out, line)
+		}
+	}
+	return out
+}
+
+// CloudInitScript returns the shell script that downloads release's
+// binary for the machine it runs on from downloadURL, checks it against
+// sums, installs it and runs it, with the role from the instance metadata
+// of cloud, if that sets roleTag.
+func CloudInitScript(release, downloadURL, sums, cloud, roleTag string) (string, error) {
+	var b strings.Builder
+	fmt.Fprintf(&b, "#!/bin/sh\n# Installs bootstrap %s and runs it once, from cloud-init.\nset -eu\n", release)
+	b.WriteString("case \"$(uname -m)\" in\n")
+	for _, a := range cloudInitAssets {
+		if sum := ChecksumFor(sums, a.asset); sum != "" {
+			fmt.Fprintf(&b, "%s) asset=%s sum=%s ;;\n", a.machine, a.asset, sum)
+		}
+	}
+	if !strings.Contains(b.String(), "asset=") {
+		return "", fmt.Errorf("%s of release %s lists no Linux binaries", ChecksumsAsset, release)
+	}
+	b.WriteString("*) echo \"bootstrap: release " + release + " has no binary for $(uname -m)\" >&2; exit 1 ;;\nesac\n")
+	fmt.Fprintf(&b, "tmp=$(mktemp)\ncurl -fsSL --retry 5 --retry-connrefused -o \"$tmp\" \"%s/$asset\"\n", downloadURL)
+	b.WriteString("echo \"$sum  $tmp\" | sha256sum -c -\n")
+	fmt.Fprintf(&b, "install -m 0755 \"$tmp\" %s\nrm -f \"$tmp\"\n", service.SystemBinPath)
+	b.WriteString("set --\n")
+	if lookup, ok := CloudRoleLookups[cloud]; ok {
+		fmt.Fprintf(&b, lookup+"\n", roleTag)
+		b.WriteString("if [ -n \"$role\" ]; then set -- --role \"$role\"; fi\n")
+	}
+	fmt.Fprintf(&b, "exec %s --config %s --yes \"$@\" </dev/null\n", service.SystemBinPath, platform.DefaultConfigPath)
+	return b.String(), nil
+}
+
+// CloudConfig returns the #cloud-config document that writes settings to
+// platform.DefaultConfigPath and script to cloudInitScriptPath, and runs the script.
+func CloudConfig(release string, settings []string, script string) string {
+	var b strings.Builder
+	b.WriteString("#cloud-config\n")
+	fmt.Fprintf(&b, "# Generated by bootstrap gen-cloudinit %s.\n", platform.ToolVersion())
+	b.WriteString("write_files:\n")
+	fmt.Fprintf(&b, "  - path: %s\n    owner: root:root\n    permissions: '0600'\n    content: |\n", platform.DefaultConfigPath)
+	fmt.Fprintf(&b, "      # bootstrap %s configuration, from bootstrap gen-cloudinit.\n", release)
+	for _, s := range settings {
+		b.WriteString("      " + s + "\n")
+	}
+	fmt.Fprintf(&b, "  - path: %s\n    owner: root:root\n    permissions: '0755'\n    content: |\n", cloudInitScriptPath)
+	for _, line := range strings.Split(strings.TrimSuffix(script, "\n"), "\n") {
+		b.WriteString("      " + line + "\n")
+	}
+	fmt.Fprintf(&b, "runcmd:\n  - [%s]\n", cloudInitScriptPath)
+	return b.String()
+}
@@ -0,0 +1,144 @@
+package release
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// integrityPrefix introduces the digest stamped into release binaries.
+const integrityPrefix = "bootstrap-integrity-sha256:"
+
+// integrityStamp is integrityPrefix followed by the SHA-256 of the binary
+// it is part of, computed with the digest itself zeroed, so that a binary
+// can check itself without a manifest alongside it. The release workflow
+// writes it into each binary after building it, with
+// "bootstrap verify --stamp FILE"; a development build keeps the zeros.
+var integrityStamp = integrityPrefix + "0000000000000000000000000000000000000000000000000000000000000000"
+
+// integrityReport is what VerifyIntegrity found out about the running
+// executable.
+type integrityReport struct {
+	Path     string
+	SHA256   string // of the file as it is, as listed in SHA256SUMS
+	Stamped  string // the digest stamped at build time; "" if unstamped
+	Computed string // the digest recomputed from the file
+}
+
+// OK reports whether the executable matches the digest stamped into it.
+func (r *integrityReport) OK() bool {
+	return r.Stamped != "" && r.Stamped == r.Computed
+}
+
+// problem describes why the executable failed verification, or "".
+func (r *integrityReport) problem() string {
+	switch {
+	case r.Stamped == "":
+		return "this is a development build with no stamped digest"
+	case !r.OK():
+		return fmt.Sprintf("%s is not the binary that was built: its digest is %s, but %s was stamped into it", r.Path, r.Computed, r.Stamped)
+	}
+	return ""
+}
+
+// VerifyIntegrity hashes the running executable and compares it with the
+// digest stamped into it.
+func VerifyIntegrity() (*integrityReport, error) {
+	exe, err := os.Executable()
+	if err != nil {
+		return nil, err
+	}
+	if exe, err = filepath.EvalSymlinks(exe); err != nil {
+		return nil, err
+	}
+	data, err := os.ReadFile(exe)
+	if err != nil {
+		return nil, err
+	}
+	sum := sha256.Sum256(data)
+	r := &integrityReport{Path: exe, SHA256: hex.EncodeToString(sum[:])}
+	digest := strings.TrimPrefix(integrityStamp, integrityPrefix)
+	if digest == unstampedDigest() {
+		return r, nil
+	}
+	r.Stamped = digest
+	i := bytes.Index(data, []byte(integrityStamp))
+	if i < 0 || bytes.Contains(data[i+1:], []byte(integrityStamp)) {
+		r.Computed = "(the stamp could not be located)"
+		return r, nil
+	}
+	r.Computed = stampedDigest(data, i+len(integrityPrefix))
+	return r, nil
+}
+
+// unstampedDigest is the digest of integrityStamp before stamping. It is
+// built at run time so that the binary holds the zeros only once.
+func unstampedDigest() string {
+	return strings.Repeat("0", sha256.Size*2)
+}
+
+// stampedDigest returns the SHA-256 of data with the digest at offset
+// zeroed, which is what stamping records.
+func stampedDigest(data []byte, offset int) string {
+	h := sha256.New()
+	h.Write(data[:offset])
+	h.Write([]byte(unstampedDigest()))
+	h.Write(data[offset+sha256.Size*2:])
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+// StampIntegrity writes the digest of the binary at path into its
+// integrityStamp.
+func (u *Updater) StampIntegrity(path string) (string, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return "", err
+	}
+	placeholder := []byte(integrityPrefix + unstampedDigest())
+	i := bytes.Index(data, placeholder)
+	if i < 0 {
+		return "", fmt.Errorf("%s has no unstamped integrity digest", path)
+	}
+	if bytes.Contains(data[i+1:], placeholder) {
+		return "", fmt.Errorf("%s has more than one integrity digest", path)
+	}
+	offset := i + len(integrityPrefix)
+	digest := stampedDigest(data, offset)
+	copy(data[offset:], digest)
+	st, err := os.Stat(path)
+	if err != nil {
+		return "", err
+	}
+	_, err = u.sys.WriteFile(context.Background(), path, data, st.Mode().Perm(), "")
+	return digest, err
+}
+
+// CheckIntegrity verifies the running executable at the start of a run. A
+// mismatch is warned about loudly, and, like a development build, fails the
+// run only with --strict-integrity.
+func (u *Updater) CheckIntegrity() error {
+	r, err := VerifyIntegrity()
+	if err != nil {
+		if u.cfg.StrictIntegrity {
+			return fmt.Errorf("integrity: %w", err)
+		}
+		u.sys.Log("Warning: could not verify bootstrap's own integrity: " + err.Error())
+		return nil
+	}
+	if r.OK() {
+		return nil
+	}
+	if u.cfg.StrictIntegrity {
+		return errors.New("integrity: " + r.problem())
+	}
+	if r.Stamped != "" {
+		u.sys.Log("Warning: INTEGRITY CHECK FAILED: " + r.problem() + ". The binary is stale or corrupted; replace it (bootstrap self-update) before trusting this run.")
+	}
+	return nil
+}
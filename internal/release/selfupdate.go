@@ -0,0 +1,275 @@
+// Package release deals with bootstrap's own releases: self-update, the
+// binary's integrity stamp and cloud-init user-data that installs one.
+package release
+
+import (
+	"bufio"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/sparkleHazard/bootstrap/internal/config"
+	"github.com/sparkleHazard/bootstrap/internal/platform"
+	"github.com/sparkleHazard/bootstrap/internal/service"
+)
+
+// releasesAPI is the GitHub API endpoint for bootstrap's latest release.
+const releasesAPI = "https://api.github.com/repos/sparkleHazard/bootstrap/releases/latest"
+
+// ChecksumsAsset is the release asset listing the SHA-256 of every binary,
+// in sha256sum's format.
+const ChecksumsAsset = "SHA256SUMS"
+
+// updateCheckTimeout bounds --check-update's query, and UpdateTimeout the
+// whole of self-update.
+const (
+	updateCheckTimeout = 5 * time.Second
+	UpdateTimeout      = 5 * time.Minute
+)
+
+// release is the part of a GitHub release that self-update uses.
+type release struct {
+	TagName string `json:"tag_name"`
+	Assets  []struct {
+		Name string `json:"name"`
+		URL  string `json:"browser_download_url"`
+	} `json:"assets"`
+}
+
+// assetURL returns the download URL of the asset called name, or "".
+func (r *release) assetURL(name string) string {
+	for _, a := range r.Assets {
+		if a.Name == name {
+			return a.URL
+		}
+	}
+	return ""
+}
+
+// releaseAssetName is the name of the release binary for this platform,
+// as the release workflow names it.
+func releaseAssetName() string {
+	arch := runtime.GOARCH
+	if arch == "arm" {
+		arch = "armv7l"
+	}
+	return "bootstrap-" + runtime.GOOS + "-" + arch
+}
+
+// CheckForUpdate implements --check-update, logging whether a newer
+// release exists. Failures are logged, never returned.
+func (u *Updater) CheckForUpdate(ctx context.Context) {
+	if !u.cfg.CheckUpdate {
+		return
+	}
+	ctx, cancel := context.WithTimeout(context.WithoutCancel(ctx), updateCheckTimeout)
+	defer cancel()
+	rel, err := u.LatestRelease(ctx)
+	if err != nil {
+		u.sys.Log("Warning: could not check for a newer release: " + err.Error())
+		return
+	}
+	current := platform.ToolVersion()
+	u.sys.Log(UpdateStatus(rel.TagName, current, VersionNewer(rel.TagName, current)))
+}
+
+// UpdateStatus describes how current compares to the latest release.
+func UpdateStatus(latest, current string, newer bool) string {
+	switch {
+	case newer:
+		return fmt.Sprintf("A newer release, %s, is available (this is %s); run \"bootstrap self-update\" to install it.", latest, current)
+	case latest == current:
+		return fmt.Sprintf("bootstrap %s is the latest release.", current)
+	}
+	return fmt.Sprintf("This is bootstrap %s; the latest release is %s.", current, latest)
+}
+
+// LatestRelease queries the GitHub API for the latest release.
+func (u *Updater) LatestRelease(ctx context.Context) (*release, error) {
+	if err := u.sys.CheckOfflineURL(releasesAPI, "the release"); err != nil {
+		return nil, err
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, releasesAPI, nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Accept", "application/vnd.github+json")
+	req.Header.Set("X-GitHub-Api-Version", "2022-11-28")
+	resp, err := u.sys.SendNotifyRequest(req)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", releasesAPI, err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("%s returned HTTP %d", releasesAPI, resp.StatusCode)
+	}
+	var rel release
+	if err := json.NewDecoder(io.LimitReader(resp.Body, 1<<20)).Decode(&rel); err != nil {
+		return nil, fmt.Errorf("%s: %w", releasesAPI, err)
+	}
+	if _, ok := ParseVersion(rel.TagName); !ok {
+		return nil, fmt.Errorf("the latest release has an unexpected tag %q", rel.TagName)
+	}
+	return &rel, nil
+}
+
+// InstallRelease downloads rel's binary for this platform, checks it
+// against the release's SHA256SUMS, and puts it in place of the running
+// executable.
+func (u *Updater) InstallRelease(ctx context.Context, rel *release) error {
+	name := releaseAssetName()
+	binURL, sumsURL := rel.assetURL(name), rel.assetURL(ChecksumsAsset)
+	if binURL == "" {
+		return fmt.Errorf("release %s has no %s binary", rel.TagName, name)
+	}
+	if sumsURL == "" {
+		return fmt.Errorf("release %s publishes no %s to verify %s against", rel.TagName, ChecksumsAsset, name)
+	}
+	var sums strings.Builder
+	if _, err := u.FetchRelease(ctx, sumsURL, &limitedWriter{w: &sums, n: 64 * 1024}); err != nil {
+		return err
+	}
+	want := ChecksumFor(sums.String(), name)
+	if want == "" {
+		return fmt.Errorf("%s of release %s does not list %s", ChecksumsAsset, rel.TagName, name)
+	}
+
+	// The copy --install-self made is the one to update, wherever this
+	// binary runs from.
+	exe := u.services.InstalledBinary()
+	if exe == "" {
+		var err error
+		if exe, err = os.Executable(); err != nil {
+			return err
+		}
+		if exe, err = filepath.EvalSymlinks(exe); err != nil {
+			return err
+		}
+	}
+	tmp, err := os.CreateTemp("", "bootstrap-update-*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	u.sys.Log(fmt.Sprintf("Downloading %s %s...", name, rel.TagName))
+	got, err := u.FetchRelease(ctx, binURL, tmp)
+	if cerr := tmp.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		return err
+	}
+	if !strings.EqualFold(got, want) {
+		return fmt.Errorf("%s has SHA-256 %s, but %s lists %s; not installing it", name, got, ChecksumsAsset, want)
+	}
+	u.sys.EscalationCmd = u.sys.EscalationTool()
+	return u.services.InstallBinary(ctx, tmp.Name(), exe)
+}
+
+// FetchRelease downloads the release asset at url to w, returning its
+// hex SHA-256.
+func (u *Updater) FetchRelease(ctx context.Context, url string, w io.Writer) (string, error) {
+	if err := u.sys.CheckOfflineURL(url, filepath.Base(url)); err != nil {
+		return "", err
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	if err != nil {
+		return "", err
+	}
+	resp, err := u.sys.SendNotifyRequest(req)
+	if err != nil {
+		return "", fmt.Errorf("downloading %s: %w", filepath.Base(url), err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("downloading %s: HTTP %d", filepath.Base(url), resp.StatusCode)
+	}
+	h := sha256.New()
+	if _, err := io.Copy(io.MultiWriter(w, h), resp.Body); err != nil {
+		return "", fmt.Errorf("downloading %s: %w", filepath.Base(url), err)
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+// ChecksumFor returns the digest sums, in sha256sum's format, lists for
+// name, or "".
+func ChecksumFor(sums, name string) string {
+	sc := bufio.NewScanner(strings.NewReader(sums))
+	for sc.Scan() {
+		fields := strings.Fields(sc.Text())
+		if len(fields) == 2 && strings.TrimPrefix(fields[1], "*") == name && config.SHA256Regex.MatchString(fields[0]) {
+			return fields[0]
+		}
+	}
+	return ""
+}
+
+// limitedWriter writes at most n bytes to w, failing after that.
+type limitedWriter struct {
+	w io.Writer
+	n int
+}
+
+func (l *limitedWriter) Write(p []byte) (int, error) {
+	if len(p) > l.n {
+		return 0, errors.New("response too large")
+	}
+	l.n -= len(p)
+	return l.w.Write(p)
+}
+
+// ParseVersion parses a release tag vMAJOR.MINOR.PATCH.
+func ParseVersion(v string) ([3]int, bool) {
+	var out [3]int
+	parts := strings.Split(strings.TrimPrefix(v, "v"), ".")
+	if !strings.HasPrefix(v, "v") || len(parts) != 3 {
+		return out, false
+	}
+	for i, p := range parts {
+		n, err := strconv.Atoi(p)
+		if err != nil || n < 0 {
+			return out, false
+		}
+		out[i] = n
+	}
+	return out, true
+}
+
+// VersionNewer reports whether release tag latest is newer than current.
+// A development build is never older than anything.
+func VersionNewer(latest, current string) bool {
+	l, ok1 := ParseVersion(latest)
+	c, ok2 := ParseVersion(current)
+	if !ok1 || !ok2 {
+		return false
+	}
+	for i := range l {
+		if l[i] != c[i] {
+			return l[i] > c[i]
+		}
+	}
+	return false
+}
+
+// Updater replaces the running binary with a release.
+type Updater struct {
+	cfg      *config.Config
+	sys      *platform.System
+	services *service.Manager
+}
+
+// NewUpdater returns the updater of a run on sys.
+func NewUpdater(sys *platform.System, services *service.Manager) *Updater {
+	return &Updater{cfg: sys.Config, sys: sys, services: services}
+}
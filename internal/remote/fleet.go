@@ -0,0 +1,362 @@
+package remote
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"sync"
+	"text/tabwriter"
+	"time"
+	"unicode"
+	"unicode/utf8"
+
+	"github.com/sparkleHazard/bootstrap/internal/platform"
+	"github.com/sparkleHazard/bootstrap/internal/report"
+	"golang.org/x/term"
+)
+
+// FleetFlags are the flags of "fleet" itself, which are left out of the
+// settings the hosts' runs get.
+var FleetFlags = []string{"hosts", "parallel", "fail-fast", "log-dir", "json", "jump", "ssh-identity", "accept-new-host-key", "ask-sudo-password", "binary"}
+
+// FleetReportName is the aggregate report "fleet" writes to its log
+// directory.
+const FleetReportName = "report.json"
+
+// FleetRedrawInterval is how often the status table of "fleet" is redrawn.
+const FleetRedrawInterval = 500 * time.Millisecond
+
+// terminalEscape matches the escape sequences, such as colors, that the
+// status table leaves out of a host's last line.
+var terminalEscape = regexp.MustCompile(`\x1b\[[0-9;?]*[A-Za-z]`)
+
+// FleetResult is the outcome of one host's run, in the aggregate report.
+type FleetResult struct {
+	Host string `json:"host"`
+	Role string `json:"role"`
+	// Status is the run's status from its result file ("success",
+	// "skipped", "drift", "interrupted" or "failed"), "failed" or
+	// "interrupted" when there is none, or "not-started".
+	Status          string  `json:"status"`
+	ExitCode        *int    `json:"exit_code,omitempty"`
+	FailedStep      string  `json:"failed_step,omitempty"`
+	Error           string  `json:"error,omitempty"`
+	DurationSeconds float64 `json:"duration_seconds,omitempty"`
+	Log             string  `json:"log,omitempty"`
+	ResultFile      string  `json:"result_file,omitempty"`
+}
+
+// Failed reports whether the host did not end up bootstrapped, or checked.
+func (r FleetResult) Failed() bool {
+	return r.Status != "success" && r.Status != "skipped" && r.Status != "drift"
+}
+
+// Summary describes r in one line for the progress log.
+func (r FleetResult) Summary() string {
+	s := r.Status
+	if r.ExitCode != nil {
+		s += fmt.Sprintf(" (exit %d)", *r.ExitCode)
+	}
+	if msg := r.ErrorText(); msg != "" {
+		s += ": " + msg
+	}
+	return s
+}
+
+// ErrorText returns the run's error, after the step that failed if known.
+func (r FleetResult) ErrorText() string {
+	if r.FailedStep != "" && r.Error != "" {
+		return r.FailedStep + ": " + r.Error
+	}
+	return r.Error
+}
+
+// FleetReport is the aggregate report of "fleet", written to the log
+// directory and printed by --json.
+type FleetReport struct {
+	HostsFile       string         `json:"hosts_file"`
+	StartedAt       time.Time      `json:"started_at"`
+	FinishedAt      time.Time      `json:"finished_at"`
+	DurationSeconds float64        `json:"duration_seconds"`
+	ExitCode        int            `json:"exit_code"`
+	Counts          map[string]int `json:"counts"`
+	Hosts           []FleetResult  `json:"hosts"`
+}
+
+// FleetHost is a host of the fleet while it runs: its entry, its log file,
+// and what the status table shows of it.
+type FleetHost struct {
+	FleetEntry
+	Settings string
+
+	mu     sync.Mutex
+	File   *os.File
+	State  string // "pending", "running", or the result's status
+	last   string // the last line of its log, or message logged
+	start  time.Time
+	Result FleetResult
+}
+
+// Write writes p to the host's log, keeping its last line for the status
+// table. The run's output and progress messages all go through it.
+func (h *FleetHost) Write(p []byte) (int, error) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	lines := strings.Split(strings.TrimSpace(string(p)), "\n")
+	if l := strings.TrimSpace(lines[len(lines)-1]); l != "" {
+		h.last = l
+	}
+	return h.File.Write(p)
+}
+
+// logf writes msg to the host's log, timestamped as log does.
+func (h *FleetHost) logf(msg string) {
+	fmt.Fprintf(h, "[%s] %s\n", time.Now().Format("2006-01-02 15:04:05"), msg)
+	h.mu.Lock()
+	h.last = msg
+	h.mu.Unlock()
+}
+
+// Fleet is a run of "fleet": the hosts, and how each is reached and run.
+type Fleet struct {
+	Hosts     []*FleetHost
+	LogDir    string
+	Jump      string
+	Identity  string
+	AcceptNew bool
+	Password  []byte
+	Binaries  *FleetBinaries
+	Remote    *Client
+
+	// Live is whether the status table is drawn on the terminal, and
+	// drawn how many lines of it are, as of drawnAt.
+	Live    bool
+	drawn   int
+	drawnAt time.Time
+	Started time.Time
+
+	mu       sync.Mutex
+	FailedBy string // the host whose failure stopped the rest, with --fail-fast
+}
+
+// StopFor records host as the host whose failure stops the rest, with
+// --fail-fast, unless another host's already did.
+func (f *Fleet) StopFor(host string) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.FailedBy == "" {
+		f.FailedBy = host
+	}
+}
+
+// FleetBinaries hands out the bootstrap binary for each platform, read or
+// downloaded once for the whole fleet.
+type FleetBinaries struct {
+	mu      sync.Mutex
+	Binary  string // --binary
+	ByAsset map[string]FleetBinary
+	Remote  *Client
+}
+
+type FleetBinary struct {
+	data []byte
+	name string
+}
+
+// get returns the binary for a goos/goarch host as RemoteBinary does,
+// logging a download with logf.
+func (b *FleetBinaries) get(ctx context.Context, goos, goarch, asset string, logf func(string)) ([]byte, string, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if bin, ok := b.ByAsset[asset]; ok {
+		return bin.data, bin.name, nil
+	}
+	data, name, err := b.Remote.RemoteBinary(ctx, goos, goarch, asset, b.Binary, logf)
+	if err != nil {
+		return nil, "", err
+	}
+	b.ByAsset[asset] = FleetBinary{data, name}
+	return data, name, nil
+}
+
+// Overrides returns the config lines of the entry's overrides of the
+// fleet's settings, which follow them in the host's config file.
+func (e *FleetEntry) Overrides(hostsFile string) string {
+	if e.Role == "" && len(e.extraVars) == 0 {
+		return ""
+	}
+	s := fmt.Sprintf("# Overrides from %s:%d.\n", hostsFile, e.line)
+	if e.Role != "" {
+		s += "role = " + e.Role + "\n"
+	}
+	for _, v := range e.extraVars.Entries() {
+		s += "extra-var = " + v + "\n"
+	}
+	return s
+}
+
+// RunHost runs bootstrap on h as "remote" would, with its output going to
+// its log file, and records the outcome in h.Result.
+func (f *Fleet) RunHost(ctx context.Context, h *FleetHost) {
+	h.mu.Lock()
+	h.State, h.start = "running", time.Now()
+	h.mu.Unlock()
+
+	jump := h.jump
+	if jump == "" {
+		jump = f.Jump
+	}
+	r := f.Remote.NewRemoteHost(h.Host, jump, f.Identity, f.AcceptNew)
+	r.log, r.stdout, r.stderr, r.prefix = h.logf, h, h, ""
+	resultFile := filepath.Join(f.LogDir, h.LogName()+".result.json")
+	// A result file from an earlier fleet run in the directory is not this
+	// one's.
+	os.Remove(resultFile)
+	run := Run{
+		Settings: h.Settings,
+		Binary: func(ctx context.Context, goos, goarch, asset string) ([]byte, string, error) {
+			return f.Binaries.get(ctx, goos, goarch, asset, h.logf)
+		},
+		ResultFile: resultFile,
+	}
+	if f.Password != nil {
+		run.Password = func() ([]byte, error) { return f.Password, nil }
+	}
+	code, err := r.Bootstrap(ctx, run)
+
+	res := h.Result
+	res.ExitCode = &code
+	res.DurationSeconds = time.Since(h.start).Seconds()
+	res.Log = h.File.Name()
+	if err != nil {
+		h.logf("Remote bootstrap of " + h.Host + " failed: " + err.Error())
+		res.Error = err.Error()
+	}
+	var rr report.Result
+	if data, rerr := os.ReadFile(resultFile); rerr == nil && json.Unmarshal(data, &rr) == nil {
+		res.ResultFile = resultFile
+		res.Status, res.FailedStep = rr.Status, rr.FailedStep
+		if res.Error == "" {
+			res.Error = rr.Error
+		}
+	}
+	if res.Status == "not-started" || res.Status == "" {
+		switch {
+		case code == platform.ExitInterrupted || ctx.Err() != nil:
+			res.Status = "interrupted"
+		case code == platform.ExitDrift:
+			res.Status = "drift"
+		default:
+			res.Status = "failed"
+		}
+	}
+	f.mu.Lock()
+	if f.FailedBy != "" && f.FailedBy != h.Host && ctx.Err() != nil && res.Error == "" {
+		res.Error = "stopped after " + f.FailedBy + " failed (--fail-fast)"
+	}
+	f.mu.Unlock()
+	h.logf("Finished: " + res.Summary())
+
+	h.mu.Lock()
+	h.Result, h.State = res, res.Status
+	h.mu.Unlock()
+}
+
+// Draw draws the status table on the terminal in place of the one drawn
+// before: a line on the fleet's progress, then one per host with its state,
+// how long it has run and the last line of its log, or its error once it
+// ended, cut to the terminal's width. When the hosts do not fit, only the running ones are listed.
+func (f *Fleet) Draw() {
+	width, height, err := term.GetSize(int(os.Stdout.Fd()))
+	if err != nil {
+		width, height = 80, 24
+	}
+	counts := map[string]int{}
+	var buf bytes.Buffer
+	w := tabwriter.NewWriter(&buf, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(w, "HOST\tROLE\tSTATUS\tTIME\tLAST")
+	// Beside the hosts, the table has the progress line, the header, and
+	// when cut short a line on the hosts left out.
+	shown := 0
+	tooMany := len(f.Hosts)+2 >= height
+	for _, h := range f.Hosts {
+		h.mu.Lock()
+		state, last, start := h.State, h.last, h.start
+		took := h.Result.DurationSeconds
+		if !start.IsZero() && state != "running" {
+			last = h.Result.ErrorText()
+		}
+		h.mu.Unlock()
+		counts[state]++
+		if tooMany && (state != "running" || shown+4 >= height) {
+			continue
+		}
+		elapsed := "-"
+		switch {
+		case state == "running":
+			elapsed = time.Since(start).Round(time.Second).String()
+		case !start.IsZero():
+			elapsed = time.Duration(took * float64(time.Second)).Round(time.Second).String()
+		}
+		last = strings.Map(func(r rune) rune {
+			if unicode.IsControl(r) {
+				return -1
+			}
+			return r
+		}, terminalEscape.ReplaceAllString(last, ""))
+		fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%s\n", h.Host, h.Result.Role, state, elapsed, platform.DashIfEmpty(last))
+		shown++
+	}
+	w.Flush()
+
+	done := len(f.Hosts) - counts["pending"] - counts["running"]
+	head := fmt.Sprintf("%d of %d host(s) done, %d running, %d pending", done, len(f.Hosts), counts["running"], counts["pending"])
+	if failed := done - counts["success"] - counts["skipped"] - counts["drift"]; failed > 0 {
+		head += fmt.Sprintf(", %d failed", failed)
+	}
+	head += " (" + time.Since(f.Started).Round(time.Second).String() + ")"
+	lines := append([]string{head}, strings.Split(strings.TrimSuffix(buf.String(), "\n"), "\n")...)
+	if shown < len(f.Hosts) {
+		lines = append(lines, fmt.Sprintf("... and %d more not running", len(f.Hosts)-shown))
+	}
+
+	var out strings.Builder
+	for _, l := range lines {
+		// A line that wrapped would throw off the redraw.
+		if utf8.RuneCountInString(l) >= width {
+			l = string([]rune(l)[:max(width-1, 0)])
+		}
+		out.WriteString(l + "\x1b[K\n")
+	}
+	f.Remote.sys.Console.Lock()
+	defer f.Remote.sys.Console.Unlock()
+	f.moveUpLocked()
+	fmt.Fprint(os.Stdout, out.String()+"\x1b[J")
+	f.drawn, f.drawnAt = len(lines), time.Now()
+}
+
+// Erase erases the status table, for the report to take its place.
+func (f *Fleet) Erase() {
+	if !f.Live {
+		return
+	}
+	f.Remote.sys.Console.Lock()
+	defer f.Remote.sys.Console.Unlock()
+	f.moveUpLocked()
+	fmt.Fprint(os.Stdout, "\x1b[J")
+	f.drawn = 0
+}
+
+// moveUpLocked moves the cursor to the start of the status table on the
+// terminal, unless something else was written below it since, which stays.
+// The console is held.
+func (f *Fleet) moveUpLocked() {
+	if f.drawn > 0 && !f.Remote.sys.Console.WrittenSince(f.drawnAt) {
+		fmt.Fprintf(os.Stdout, "\x1b[%dF", f.drawn)
+	}
+}
@@ -0,0 +1,255 @@
+package remote
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"github.com/sparkleHazard/bootstrap/internal/config"
+)
+
+// fleetHostKeys are the keys an entry of the --hosts file of "fleet" may
+// have.
+var fleetHostKeys = []string{"host", "role", "jump", "extra-vars"}
+
+// invalidLogNameChars are the characters of a host that its log file's name
+// has replaced with '_'.
+var invalidLogNameChars = regexp.MustCompile(`[^A-Za-z0-9._@-]`)
+
+// FleetEntry is a host of the --hosts file, with its overrides of the
+// fleet's settings.
+type FleetEntry struct {
+	Host      string
+	Role      string // role, if not the fleet's
+	jump      string // jump, if not the fleet's
+	extraVars config.ExtraVars
+	line      int // where the entry starts in the file
+}
+
+// LogName returns the name the host's files in the log directory start
+// with.
+func (e *FleetEntry) LogName() string {
+	return invalidLogNameChars.ReplaceAllString(e.Host, "_")
+}
+
+// ReadFleetHosts reads the --hosts file at path. It is YAML: a list with an
+// entry per host, either the host alone, [user@]host[:port], or a mapping
+// with the host under "host" and its own "role", "jump" and "extra-vars", a
+// mapping of variable names to values, for the host's run:
+//
+//	# hosts.yaml
+//	- web01.example.com
+//	- host: admin@db01.example.com:2222
+//	  role: database
+//	  jump: bastion.example.com
+//	  extra-vars:
+//	    pg_version: 16
+//
+// No more of YAML than this is understood: values are plain, single- or
+// double-quoted scalars, and # starts a comment. Anchors, tags, flow
+// collections and multi-line scalars are refused rather than misread.
+func ReadFleetHosts(path string) ([]FleetEntry, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("hosts: %w", err)
+	}
+	entries, err := parseFleetHosts(path, string(data))
+	if err != nil {
+		return nil, err
+	}
+	if len(entries) == 0 {
+		return nil, fmt.Errorf("%s lists no hosts", path)
+	}
+	hosts := map[string]int{}
+	logNames := map[string]string{}
+	for _, e := range entries {
+		switch {
+		case e.Host == "":
+			return nil, fmt.Errorf("%s:%d: the entry has no host", path, e.line)
+		case strings.HasPrefix(e.Host, "-") || strings.ContainsAny(e.Host, " \t"):
+			return nil, fmt.Errorf("%s:%d: invalid host %q", path, e.line, e.Host)
+		case e.Role != "" && !config.RoleNameRegex.MatchString(e.Role):
+			return nil, fmt.Errorf("%s:%d: role %q is not a valid role name", path, e.line, e.Role)
+		case strings.HasPrefix(e.jump, "-") || strings.ContainsAny(e.jump, " \t"):
+			return nil, fmt.Errorf("%s:%d: invalid jump host %q", path, e.line, e.jump)
+		}
+		if line, ok := hosts[e.Host]; ok {
+			return nil, fmt.Errorf("%s:%d: %s is already listed on line %d", path, e.line, e.Host, line)
+		}
+		hosts[e.Host] = e.line
+		// Hosts that differ only in characters a file name cannot have
+		// would share their log.
+		if other, ok := logNames[e.LogName()]; ok {
+			return nil, fmt.Errorf("%s:%d: %s and %s would share the log file %s.log", path, e.line, other, e.Host, e.LogName())
+		}
+		logNames[e.LogName()] = e.Host
+	}
+	return entries, nil
+}
+
+// parseFleetHosts parses data, the --hosts file at path, into its entries.
+func parseFleetHosts(path, data string) ([]FleetEntry, error) {
+	var entries []FleetEntry
+	// The indentation of the list's items, of the current entry's keys, and
+	// of the variables under its extra-vars; -1 while not yet known.
+	listIndent, keyIndent, varIndent := -1, -1, -1
+	mapping, inVars := false, false
+	for i, raw := range strings.Split(data, "\n") {
+		lineNo := i + 1
+		line := stripYAMLComment(strings.TrimRight(raw, " \t\r"))
+		text := strings.TrimLeft(line, " ")
+		if text == "" || line == "---" {
+			continue
+		}
+		if strings.HasPrefix(text, "\t") {
+			return nil, fmt.Errorf("%s:%d: indent with spaces, not tabs", path, lineNo)
+		}
+		indent := len(line) - len(text)
+		var err error
+		switch {
+		case listIndent < 0 || indent == listIndent:
+			if text != "-" && !strings.HasPrefix(text, "- ") {
+				return nil, fmt.Errorf(`%s:%d: expected a list of hosts, each entry starting with "- "`, path, lineNo)
+			}
+			listIndent = indent
+			entries = append(entries, FleetEntry{line: lineNo})
+			rest := strings.TrimLeft(text[1:], " ")
+			keyIndent, varIndent, mapping, inVars = -1, -1, true, false
+			if rest == "" {
+				break
+			}
+			keyIndent = indent + len(text) - len(rest)
+			if key, value, ok := yamlKeyValue(rest); ok {
+				inVars, err = entries[len(entries)-1].set(key, value)
+			} else {
+				mapping = false
+				entries[len(entries)-1].Host, err = yamlScalar(rest)
+			}
+		case inVars && indent > keyIndent && (varIndent < 0 || indent == varIndent):
+			varIndent = indent
+			name, value, ok := yamlKeyValue(text)
+			if !ok {
+				return nil, fmt.Errorf("%s:%d: expected NAME: VALUE under extra-vars", path, lineNo)
+			}
+			if value, err = yamlScalar(value); err == nil {
+				if err = entries[len(entries)-1].extraVars.Set(name + "=" + value); err != nil {
+					err = fmt.Errorf("extra-vars: %w", err)
+				}
+			}
+		case mapping && indent > listIndent && (keyIndent < 0 || indent == keyIndent):
+			keyIndent = indent
+			key, value, ok := yamlKeyValue(text)
+			if !ok {
+				return nil, fmt.Errorf("%s:%d: expected KEY: VALUE", path, lineNo)
+			}
+			varIndent = -1
+			inVars, err = entries[len(entries)-1].set(key, value)
+		default:
+			return nil, fmt.Errorf("%s:%d: unexpected indentation", path, lineNo)
+		}
+		if err != nil {
+			return nil, fmt.Errorf("%s:%d: %w", path, lineNo, err)
+		}
+	}
+	return entries, nil
+}
+
+// set sets the entry's key to the scalar value, and reports whether it is
+// extra-vars, whose variables follow on the lines below.
+func (e *FleetEntry) set(key, value string) (bool, error) {
+	if key == "extra-vars" {
+		if e.extraVars != nil {
+			return false, errors.New("extra-vars is given twice")
+		}
+		e.extraVars = config.ExtraVars{}
+		if v := strings.TrimSpace(value); v != "" && v != "{}" {
+			return false, errors.New("extra-vars must be a mapping, with a NAME: VALUE line for each variable below it")
+		}
+		return true, nil
+	}
+	var field *string
+	switch key {
+	case "host":
+		field = &e.Host
+	case "role":
+		field = &e.Role
+	case "jump":
+		field = &e.jump
+	default:
+		return false, fmt.Errorf("unknown key %q; an entry has %s", key, strings.Join(fleetHostKeys, ", "))
+	}
+	if *field != "" {
+		return false, fmt.Errorf("%s is given twice", key)
+	}
+	v, err := yamlScalar(value)
+	if err == nil && v == "" {
+		err = fmt.Errorf("%s has no value", key)
+	}
+	*field = v
+	return false, err
+}
+
+// yamlKeyValue splits s, "KEY: VALUE" or "KEY:", into its key and value.
+// It reports false for a scalar, such as a host with a port.
+func yamlKeyValue(s string) (key, value string, ok bool) {
+	if k, ok := strings.CutSuffix(s, ":"); ok && !strings.ContainsAny(k, `:"'`) {
+		return strings.TrimSpace(k), "", true
+	}
+	key, value, ok = strings.Cut(s, ": ")
+	if !ok || strings.ContainsAny(key, `"'`) {
+		return "", "", false
+	}
+	return strings.TrimSpace(key), strings.TrimSpace(value), true
+}
+
+// yamlScalar returns the value of the scalar s: plain, single-quoted, or
+// double-quoted with Go's escapes, which cover the ones YAML has in common
+// use. null and ~ are empty.
+func yamlScalar(s string) (string, error) {
+	s = strings.TrimSpace(s)
+	switch {
+	case strings.HasPrefix(s, `"`):
+		v, err := strconv.Unquote(s)
+		if err != nil {
+			return "", fmt.Errorf("invalid double-quoted string %s", s)
+		}
+		return v, nil
+	case strings.HasPrefix(s, "'"):
+		inner, ok := strings.CutSuffix(s[1:], "'")
+		if !ok || strings.Contains(strings.ReplaceAll(inner, "''", ""), "'") {
+			return "", fmt.Errorf("invalid single-quoted string %s", s)
+		}
+		return strings.ReplaceAll(inner, "''", "'"), nil
+	case s == "~" || s == "null":
+		return "", nil
+	case s != "" && strings.ContainsRune("[{&*!|>%@`", rune(s[0])):
+		return "", fmt.Errorf("%s: only plain and quoted scalars are supported; quote the value", s)
+	}
+	return s, nil
+}
+
+// stripYAMLComment returns line without its # comment, if any: a # at the
+// start of the line or after a space, outside quotes.
+func stripYAMLComment(line string) string {
+	var quote byte
+	for i := 0; i < len(line); i++ {
+		c := line[i]
+		atToken := i == 0 || line[i-1] == ' ' || line[i-1] == '\t'
+		switch {
+		case quote != 0:
+			if c == '\\' && quote == '"' {
+				i++
+			} else if c == quote {
+				quote = 0
+			}
+		case (c == '"' || c == '\'') && atToken:
+			quote = c
+		case c == '#' && atToken:
+			return strings.TrimRight(line[:i], " \t")
+		}
+	}
+	return line
+}
@@ -0,0 +1,480 @@
+// Package remote runs bootstrap on other hosts over SSH, one at a time or
+// as a fleet.
+package remote
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"runtime"
+	"slices"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/sparkleHazard/bootstrap/internal/config"
+	"github.com/sparkleHazard/bootstrap/internal/platform"
+	"github.com/sparkleHazard/bootstrap/internal/release"
+	"github.com/sparkleHazard/bootstrap/internal/report"
+	"github.com/sparkleHazard/bootstrap/internal/service"
+	"github.com/sparkleHazard/bootstrap/internal/sshkeys"
+	"golang.org/x/term"
+)
+
+// remoteCommandTimeout bounds each of the short SSH commands of "remote",
+// as opposed to the run itself.
+const remoteCommandTimeout = 2 * time.Minute
+
+// remoteStopWait is how long "remote", interrupted, waits for the remote
+// run to stop after signalling it, before dropping the connection.
+const remoteStopWait = 30 * time.Second
+
+// remotePIDPrefix marks the line the remote shell prints with its PID
+// before it becomes the run, which "remote" keeps to signal it.
+const remotePIDPrefix = "bootstrap-remote-pid="
+
+// Flags are the flags of "remote" itself, which are left out of the
+// settings the remote run gets.
+var Flags = []string{"jump", "ssh-identity", "accept-new-host-key", "ask-sudo-password", "binary"}
+
+// remoteProbeScript reports the remote host's platform, whether the login
+// is root, and if not whether sudo works without a password.
+const remoteProbeScript = `uname -s
+uname -m
+if [ "$(id -u)" = 0 ]; then
+	echo root
+elif ! command -v sudo >/dev/null 2>&1; then
+	echo no-sudo
+elif sudo -n true 2>/dev/null; then
+	echo sudo
+else
+	echo sudo-password
+fi
+`
+
+// remoteHost is the host "remote" runs bootstrap on, with the ssh options
+// to reach it.
+type remoteHost struct {
+	host string
+	args []string // ssh options, then the destination
+
+	// log takes the progress messages, and stdout and stderr the run's
+	// output, each line after prefix: the console's, with the host, unless
+	// "fleet" keeps them in the host's log file.
+	log            func(string)
+	stdout, stderr io.Writer
+	prefix         string
+	remote         *Client
+}
+
+// Run is what bootstrap runs with on a remote host.
+type Run struct {
+	// Settings are the lines of the run's config file.
+	Settings string
+	// Binary returns the bootstrap binary for a goos/goarch host and where
+	// it came from, as RemoteBinary does.
+	Binary func(ctx context.Context, goos, goarch, asset string) ([]byte, string, error)
+	// Password returns the sudo password to run under on a host whose sudo
+	// wants one; nil refuses such a host.
+	Password func() ([]byte, error)
+	// ResultFile, if set, is where the run's result file is copied back to.
+	ResultFile string
+}
+
+// NewRemoteHost returns the remote host for host, [user@]host[:port].
+// Host keys are checked against known_hosts: an unknown one is refused
+// unless AcceptNew, and a changed one always is. ssh never prompts.
+func (c *Client) NewRemoteHost(host, jump, identity string, acceptNew bool) *remoteHost {
+	strict := "yes"
+	if acceptNew {
+		strict = "accept-new"
+	}
+	args := []string{
+		"-o", "BatchMode=yes",
+		"-o", "ConnectTimeout=10",
+		"-o", "StrictHostKeyChecking=" + strict,
+		// A long step prints nothing for a while; keep the connection up.
+		"-o", "ServerAliveInterval=30",
+	}
+	if identity != "" {
+		args = append(args, "-i", identity)
+	}
+	if jump != "" {
+		args = append(args, "-J", jump)
+	}
+	target, port := sshkeys.SplitSSHPort(host)
+	if port != "" {
+		args = append(args, "-p", port)
+	}
+	return &remoteHost{
+		host:   host,
+		args:   append(args, target),
+		log:    c.sys.Log,
+		stdout: c.sys.ConsoleStdout,
+		stderr: c.sys.ConsoleStderr,
+		prefix: host + " | ",
+		remote: c,
+	}
+}
+
+// Settings returns the settings fs was given, for a remote run's
+// config file, without the flags of the command itself, exclude, and
+// result-file, which the remote run has its own of.
+func Settings(fs *flag.FlagSet, exclude []string) string {
+	var settings strings.Builder
+	for _, line := range strings.SplitAfter(service.CaptureSettings(fs), "\n") {
+		name, _, _ := strings.Cut(line, " = ")
+		if !slices.Contains(exclude, name) && name != "result-file" {
+			settings.WriteString(line)
+		}
+	}
+	return settings.String()
+}
+
+// command returns ssh running script on the host under sh -c.
+func (r *remoteHost) command(ctx context.Context, script string) *platform.Command {
+	return r.remote.sys.NewCommand(ctx, "ssh", append(r.args, "sh -c "+platform.ShellQuote(script))...)
+}
+
+// output runs script on the host with stdin, if any, and returns its
+// standard output. Errors carry ssh's or the script's last line of error
+// output, with advice for a host key ssh refused.
+func (r *remoteHost) output(ctx context.Context, script string, stdin io.Reader) ([]byte, error) {
+	ctx, cancel := context.WithTimeout(ctx, remoteCommandTimeout)
+	defer cancel()
+	cmd := r.command(ctx, script)
+	cmd.Stdin = stdin
+	var stderr bytes.Buffer
+	cmd.Stderr = &stderr
+	out, err := cmd.Output()
+	if err != nil {
+		return out, r.sshError(stderr.Bytes(), err)
+	}
+	return out, nil
+}
+
+// sshError describes the failure err of an ssh command whose error output
+// was stderr.
+func (r *remoteHost) sshError(stderr []byte, err error) error {
+	msg := string(stderr)
+	switch {
+	case strings.Contains(msg, "REMOTE HOST IDENTIFICATION HAS CHANGED"):
+		return fmt.Errorf("the host key of %s has changed since it was recorded in known_hosts; if the host was reinstalled, check the new key's fingerprint on its console and replace the old one with ssh-keygen -R", r.host)
+	case strings.Contains(msg, "Host key verification failed"):
+		return fmt.Errorf("the host key of %s is not in known_hosts; check its fingerprint (ssh-keyscan, against the host's console) and add it, or pass --accept-new-host-key to trust it on first use", r.host)
+	}
+	return errors.New(platform.LastLine(stderr, err))
+}
+
+// Bootstrap runs bootstrap on the host as run says and returns the remote
+// run's exit code: it probes the host, copies a binary for its platform and
+// the settings there, runs it, and copies its result file back.
+func (r *remoteHost) Bootstrap(ctx context.Context, run Run) (int, error) {
+	r.log("Connecting to " + r.host + "...")
+	out, err := r.output(ctx, remoteProbeScript, nil)
+	if err != nil {
+		return platform.ExitFailure, err
+	}
+	probe := strings.Fields(string(out))
+	if len(probe) != 3 {
+		return platform.ExitFailure, fmt.Errorf("unexpected answer to the probe: %q", out)
+	}
+	goos, goarch, asset, err := remotePlatform(probe[0], probe[1])
+	if err != nil {
+		return platform.ExitFailure, err
+	}
+
+	// A run as root needs nothing; with passwordless sudo, or none, the
+	// run escalates, or not, as it would on the host. Only a sudo that
+	// wants a password is dealt with here, by running the whole of
+	// bootstrap under sudo, as "sudo bootstrap" would on the host.
+	var password []byte
+	switch probe[2] {
+	case "sudo-password":
+		if run.Password == nil {
+			return platform.ExitPrivileges, fmt.Errorf("sudo on %s needs a password; pass --ask-sudo-password, log in as root, or allow the user passwordless sudo", r.host)
+		}
+		if password, err = run.Password(); err != nil {
+			return platform.ExitPrivileges, err
+		}
+		if err := r.checkSudoPassword(ctx, password); err != nil {
+			return platform.ExitPrivileges, err
+		}
+	case "no-sudo":
+		r.log("Warning: " + r.host + " has no sudo; the run continues only if it needs no root.")
+	}
+
+	data, name, err := run.Binary(ctx, goos, goarch, asset)
+	if err != nil {
+		return platform.ExitFailure, err
+	}
+	r.log(fmt.Sprintf("Copying %s (%s) to %s...", name, asset, r.host))
+	sum := sha256.Sum256(data)
+	out, err = r.output(ctx, `set -e
+umask 077
+d=$(mktemp -d "${TMPDIR:-/tmp}/bootstrap-remote.XXXXXX")
+cat > "$d/bootstrap"
+chmod 700 "$d/bootstrap"
+echo "$d"
+if command -v sha256sum >/dev/null 2>&1; then sha256sum "$d/bootstrap"; elif command -v shasum >/dev/null 2>&1; then shasum -a 256 "$d/bootstrap"; fi
+`, bytes.NewReader(data))
+	if err != nil {
+		return platform.ExitFailure, fmt.Errorf("copying the binary failed: %w", err)
+	}
+	lines := strings.Split(strings.TrimSpace(string(out)), "\n")
+	dir := lines[0]
+	defer func() {
+		ctx, cancel := context.WithTimeout(context.WithoutCancel(ctx), remoteCommandTimeout)
+		defer cancel()
+		if _, err := r.output(ctx, "rm -rf "+platform.ShellQuote(dir), nil); err != nil {
+			r.log("Warning: removing " + dir + " on " + r.host + " failed: " + err.Error())
+		}
+	}()
+	if len(lines) > 1 {
+		if got, _, _ := strings.Cut(lines[1], " "); !strings.EqualFold(got, hex.EncodeToString(sum[:])) {
+			return platform.ExitFailure, fmt.Errorf("the binary copied to %s is corrupt: SHA-256 %s, not %x", r.host, got, sum)
+		}
+	}
+
+	// The settings go in a config file only the remote user can read, not
+	// on a command line anyone on the host can see. Paths in them are the
+	// remote host's.
+	result := dir + "/result.json"
+	settings := "# Settings of bootstrap remote on " + report.HostnameOr("unknown host") + ".\n" + run.Settings
+	settings += "result-file = " + result + "\n"
+	if _, err := r.output(ctx, "umask 077; cat > "+platform.ShellQuote(dir+"/bootstrap.conf"), strings.NewReader(settings)); err != nil {
+		return platform.ExitFailure, fmt.Errorf("copying the settings failed: %w", err)
+	}
+
+	code, err := r.run(ctx, dir, password)
+	if err != nil {
+		return code, err
+	}
+	if run.ResultFile != "" {
+		ctx, cancel := context.WithTimeout(context.WithoutCancel(ctx), remoteCommandTimeout)
+		defer cancel()
+		data, err := r.output(ctx, "cat "+platform.ShellQuote(result), nil)
+		if err != nil {
+			r.log("Warning: the remote run wrote no result file: " + err.Error())
+		} else if _, err := r.remote.sys.WriteFile(ctx, run.ResultFile, data, 0644, ""); err != nil {
+			r.log("Warning: writing the result file failed: " + err.Error())
+		}
+	}
+	return code, nil
+}
+
+// AskSudoPassword asks for the sudo password on host on the terminal. It
+// goes to sudo -S on stdin over SSH, and is never put on a command line or
+// in a file.
+func AskSudoPassword(host string) ([]byte, error) {
+	fmt.Fprintf(os.Stderr, "sudo password on %s: ", host)
+	password, err := term.ReadPassword(int(os.Stdin.Fd()))
+	fmt.Fprintln(os.Stderr)
+	return password, err
+}
+
+// checkSudoPassword checks that sudo on the host accepts password.
+func (r *remoteHost) checkSudoPassword(ctx context.Context, password []byte) error {
+	stdin := bytes.NewReader(append(password, '\n'))
+	if _, err := r.output(ctx, "sudo -S -p '' true", stdin); err != nil {
+		return fmt.Errorf("sudo on %s did not accept the password: %w", r.host, err)
+	}
+	return nil
+}
+
+// run runs the binary in dir on the host with the settings there, under
+// sudo -S with password if it is set, streaming its output to the host's
+// writers, and returns its exit code. Interrupted, it stops the remote run
+// as a signal would stop a local one, and waits for it to finish.
+func (r *remoteHost) run(ctx context.Context, dir string, password []byte) (int, error) {
+	run := platform.ShellQuote(dir+"/bootstrap") + " --config=" + platform.ShellQuote(dir+"/bootstrap.conf")
+	if password != nil {
+		run = "sudo -S -p '' -- " + run
+	}
+	// Not bound to ctx, nor in the terminal's process group: an interrupt
+	// stops the remote run, whose last words should still arrive.
+	cmd := exec.Command("ssh", append(r.args, "sh -c "+platform.ShellQuote("echo "+remotePIDPrefix+"$$; exec "+run))...)
+	cmd.SysProcAttr = &syscall.SysProcAttr{Setpgid: true}
+	if password != nil {
+		cmd.Stdin = bytes.NewReader(append(password, '\n'))
+	}
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		return platform.ExitFailure, err
+	}
+	stderr, err := cmd.StderrPipe()
+	if err != nil {
+		return platform.ExitFailure, err
+	}
+	r.log("Running bootstrap on " + r.host + "...")
+	if err := cmd.Start(); err != nil {
+		return platform.ExitFailure, err
+	}
+	pid := make(chan string, 1)
+	streamed := make(chan struct{}, 2)
+	var sshErr platform.TailBuffer
+	sshErr.Max = platform.InstallOutputMax
+	go func() {
+		prefixLines(stdout, r.stdout, r.prefix, func(line string) bool {
+			if p, ok := strings.CutPrefix(line, remotePIDPrefix); ok {
+				pid <- p
+				return false
+			}
+			return true
+		})
+		streamed <- struct{}{}
+	}()
+	go func() {
+		prefixLines(io.TeeReader(stderr, &sshErr), r.stderr, r.prefix, nil)
+		streamed <- struct{}{}
+	}()
+
+	done := make(chan error, 1)
+	go func() {
+		<-streamed
+		<-streamed
+		done <- cmd.Wait()
+	}()
+	var werr error
+	select {
+	case werr = <-done:
+	case <-ctx.Done():
+		sig := "TERM"
+		if s, ok := r.remote.sys.ReceivedSignal.Load().(os.Signal); ok && s == os.Interrupt {
+			sig = "INT"
+		}
+		select {
+		case p := <-pid:
+			r.log("Stopping the run on " + r.host + "...")
+			sctx, cancel := context.WithTimeout(context.WithoutCancel(ctx), remoteCommandTimeout)
+			if _, err := r.output(sctx, "kill -"+sig+" "+p, nil); err != nil {
+				r.log("Warning: stopping the run on " + r.host + " failed: " + err.Error())
+			}
+			cancel()
+		default:
+		}
+		select {
+		case werr = <-done:
+		case <-time.After(remoteStopWait):
+			cmd.Process.Kill()
+			werr = <-done
+		}
+	}
+
+	var ee *exec.ExitError
+	switch {
+	case werr == nil:
+		return platform.ExitOK, nil
+	case errors.As(werr, &ee) && ee.ExitCode() == 255:
+		// ssh's own failure, or the run was killed without an exit code.
+		return platform.ExitFailure, fmt.Errorf("the SSH session ended without the run's exit code: %w", r.sshError(sshErr.Bytes(), werr))
+	case errors.As(werr, &ee) && ee.ExitCode() > 0:
+		return ee.ExitCode(), nil
+	}
+	return platform.ExitFailure, werr
+}
+
+// prefixLines copies each line from src to w with prefix, unless keep
+// returns false for it.
+func prefixLines(src io.Reader, w io.Writer, prefix string, keep func(string) bool) {
+	br := bufio.NewReader(src)
+	for {
+		line, err := br.ReadString('\n')
+		if line != "" {
+			line = strings.TrimSuffix(line, "\n")
+			if keep == nil || keep(line) {
+				fmt.Fprintln(w, prefix+line)
+			}
+		}
+		if err != nil {
+			return
+		}
+	}
+}
+
+// remotePlatform returns the GOOS and GOARCH of a host whose uname -s and
+// uname -m are kernel and machine, and the name the release binaries use
+// for the architecture.
+func remotePlatform(kernel, machine string) (goos, goarch, asset string, err error) {
+	switch kernel {
+	case "Linux":
+		goos = "linux"
+	case "Darwin":
+		goos = "darwin"
+	default:
+		return "", "", "", fmt.Errorf("bootstrap does not run on %s", kernel)
+	}
+	switch machine {
+	case "x86_64", "amd64":
+		goarch, asset = "amd64", "amd64"
+	case "aarch64", "arm64":
+		goarch, asset = "arm64", "arm64"
+	case "armv7l":
+		goarch, asset = "arm", "armv7l"
+	default:
+		return "", "", "", fmt.Errorf("bootstrap has no build for %s %s", kernel, machine)
+	}
+	return goos, goarch, "bootstrap-" + goos + "-" + asset, nil
+}
+
+// RemoteBinary returns the bootstrap binary to copy to a goos/goarch host,
+// and where it came from: binary if set, else this one when the platforms
+// match, else this release's asset, checked against its SHA256SUMS. A
+// download is logged with logf.
+func (c *Client) RemoteBinary(ctx context.Context, goos, goarch, asset, binary string, logf func(string)) ([]byte, string, error) {
+	if binary != "" {
+		data, err := os.ReadFile(binary)
+		return data, binary, err
+	}
+	if goos == runtime.GOOS && goarch == runtime.GOARCH {
+		exe, err := os.Executable()
+		if err != nil {
+			return nil, "", err
+		}
+		data, err := os.ReadFile(exe)
+		return data, "this binary", err
+	}
+	version := platform.ToolVersion()
+	if _, ok := release.ParseVersion(version); !ok {
+		return nil, "", fmt.Errorf("the host needs %s, and this development build (%s) cannot download it; pass --binary", asset, version)
+	}
+	downloadURL := release.DownloadURL + version
+	sums, err := c.updater.ReleaseSums(ctx, downloadURL, "")
+	if err != nil {
+		return nil, "", err
+	}
+	want := release.ChecksumFor(sums, asset)
+	if want == "" {
+		return nil, "", fmt.Errorf("%s of release %s does not list %s", release.ChecksumsAsset, version, asset)
+	}
+	logf(fmt.Sprintf("Downloading %s %s for %s...", asset, version, goos+"/"+goarch))
+	var buf bytes.Buffer
+	got, err := c.updater.FetchRelease(ctx, downloadURL+"/"+asset, &buf)
+	if err != nil {
+		return nil, "", err
+	}
+	if !strings.EqualFold(got, want) {
+		return nil, "", fmt.Errorf("%s has SHA-256 %s, but %s lists %s; not using it", asset, got, release.ChecksumsAsset, want)
+	}
+	return buf.Bytes(), asset + " " + version, nil
+}
+
+// Client runs bootstrap on other hosts over ssh.
+type Client struct {
+	cfg     *config.Config
+	sys     *platform.System
+	updater *release.Updater
+}
+
+// NewClient returns the client for running bootstrap on other hosts.
+func NewClient(sys *platform.System, updater *release.Updater) *Client {
+	return &Client{cfg: sys.Config, sys: sys, updater: updater}
+}
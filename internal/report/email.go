@@ -0,0 +1,202 @@
+package report
+
+import (
+	"context"
+	"crypto/tls"
+	"fmt"
+	"mime"
+	"net"
+	"net/mail"
+	"net/smtp"
+	"os"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/sparkleHazard/bootstrap/internal/platform"
+)
+
+// smtpTimeout bounds the whole SMTP conversation of one email.
+const smtpTimeout = 30 * time.Second
+
+// emailOutputLines is how many lines of the failing step's output a
+// failure email quotes.
+const emailOutputLines = 100
+
+// SMTPTLSModes are the values of --smtp-tls: STARTTLS on a plain
+// connection (submission, port 587), TLS from the start (port 465), or no
+// encryption at all.
+var SMTPTLSModes = []string{"starttls", "tls", "none"}
+
+// NotifyEmail emails the outcome of the finished run res to the
+// --notify-email recipients: always for a failure, for a success only with
+// --notify-email-on-success. Failures are logged, never returned.
+func (r *Reporter) NotifyEmail(ctx context.Context, res *Result) {
+	if r.cfg.NotifyEmail == "" {
+		return
+	}
+	ok := res.Status == "success" || res.Status == "skipped"
+	if ok && !r.cfg.NotifyEmailOnSuccess {
+		return
+	}
+	host := platform.DashIfEmpty(res.Hostname)
+	subject := fmt.Sprintf("bootstrap %s on %s", res.Status, host)
+	if err := r.SendEmail(ctx, subject, r.emailBody(res)); err != nil {
+		r.sys.Log("Warning: the notification email was not sent: " + err.Error())
+		return
+	}
+	r.sys.Log("Sent the notification email to " + r.cfg.NotifyEmail + ".")
+}
+
+// emailBody writes the plain-text message for res: a summary and, for a
+// failure, the end of the failing step's output, or for drift the tasks
+// that would change.
+func (r *Reporter) emailBody(res *Result) string {
+	var b strings.Builder
+	fmt.Fprintf(&b, "bootstrap %s on %s.\n\n", res.Status, platform.DashIfEmpty(res.Hostname))
+	w := tabwriter.NewWriter(&b, 0, 4, 2, ' ', 0)
+	fmt.Fprintf(w, "Host:\t%s\n", platform.DashIfEmpty(res.Hostname))
+	fmt.Fprintf(w, "Role:\t%s\n", res.Role)
+	fmt.Fprintf(w, "OS:\t%s\n", platform.DashIfEmpty(res.OS))
+	fmt.Fprintf(w, "Status:\t%s (exit code %d)\n", res.Status, res.ExitCode)
+	if res.FailedStep != "" {
+		fmt.Fprintf(w, "Failed step:\t%s\n", res.FailedStep)
+	}
+	fmt.Fprintf(w, "Duration:\t%s\n", time.Duration(res.DurationSeconds*float64(time.Second)).Round(time.Second))
+	fmt.Fprintf(w, "Version:\t%s\n", res.Version)
+	if res.Error != "" {
+		fmt.Fprintf(w, "Error:\t%s\n", r.sys.RedactSecrets(res.Error))
+	}
+	w.Flush()
+	if res.Status == "drift" {
+		fmt.Fprintf(&b, "\nThe playbook would change %d task(s):\n\n", res.Drift.Recap.Changed)
+		for _, t := range res.Drift.ChangedTasks {
+			fmt.Fprintf(&b, "  %s\n", t)
+		}
+		return b.String()
+	}
+	if res.Status == "success" || res.Status == "skipped" {
+		return b.String()
+	}
+	out := strings.TrimRight(r.sys.RedactSecrets(r.sys.StepOutput.String()), "\n")
+	if out == "" {
+		return b.String()
+	}
+	lines := strings.Split(out, "\n")
+	if len(lines) > emailOutputLines {
+		lines = lines[len(lines)-emailOutputLines:]
+	}
+	fmt.Fprintf(&b, "\nLast %d lines of output from %s:\n\n%s\n", len(lines), platform.DashIfEmpty(res.FailedStep), strings.Join(lines, "\n"))
+	return b.String()
+}
+
+// SendEmail sends a plain-text email to the --notify-email recipients
+// through --smtp-host. Errors never include the SMTP password.
+func (r *Reporter) SendEmail(ctx context.Context, subject, body string) error {
+	to, err := mail.ParseAddressList(r.cfg.NotifyEmail)
+	if err != nil {
+		return fmt.Errorf("notify-email: %w", err)
+	}
+	from := r.cfg.SMTPFrom
+	if from == "" {
+		from = "bootstrap@" + HostnameOr("localhost")
+	}
+	sender, err := mail.ParseAddress(from)
+	if err != nil {
+		return fmt.Errorf("smtp-from: %w", err)
+	}
+	if !r.cfg.HostAllowed(r.cfg.SMTPHost, r.sys.KeyserverHost) {
+		return fmt.Errorf("offline mode: %s is not in allow-hosts", r.cfg.SMTPHost)
+	}
+
+	ctx, cancel := context.WithTimeout(context.WithoutCancel(ctx), smtpTimeout)
+	defer cancel()
+	addr := net.JoinHostPort(r.cfg.SMTPHost, strconv.Itoa(r.cfg.SMTPPort))
+	tlsConfig := &tls.Config{ServerName: r.cfg.SMTPHost}
+	var conn net.Conn
+	if r.cfg.SMTPTLS == "tls" {
+		conn, err = (&tls.Dialer{Config: tlsConfig}).DialContext(ctx, "tcp", addr)
+	} else {
+		conn, err = (&net.Dialer{}).DialContext(ctx, "tcp", addr)
+	}
+	if err != nil {
+		return err
+	}
+	deadline, _ := ctx.Deadline()
+	conn.SetDeadline(deadline)
+	c, err := smtp.NewClient(conn, r.cfg.SMTPHost)
+	if err != nil {
+		conn.Close()
+		return fmt.Errorf("%s: %w", addr, err)
+	}
+	defer c.Close()
+	if err := c.Hello(HostnameOr("localhost")); err != nil {
+		return fmt.Errorf("%s: %w", addr, err)
+	}
+	if r.cfg.SMTPTLS == "starttls" {
+		if ok, _ := c.Extension("STARTTLS"); !ok {
+			return fmt.Errorf("%s does not offer STARTTLS; set --smtp-tls to tls or, on a trusted network, none", addr)
+		}
+		if err := c.StartTLS(tlsConfig); err != nil {
+			return fmt.Errorf("%s: STARTTLS: %w", addr, err)
+		}
+	}
+	if r.cfg.SMTPUser != "" {
+		if err := c.Auth(smtp.PlainAuth("", r.cfg.SMTPUser, r.cfg.SMTPPassword, r.cfg.SMTPHost)); err != nil {
+			return fmt.Errorf("%s: authenticating as %s: %w", addr, r.cfg.SMTPUser, err)
+		}
+	}
+	if err := c.Mail(sender.Address); err != nil {
+		return fmt.Errorf("%s: %w", addr, err)
+	}
+	var rcpts []string
+	for _, a := range to {
+		if err := c.Rcpt(a.Address); err != nil {
+			return fmt.Errorf("%s: recipient %s: %w", addr, a.Address, err)
+		}
+		rcpts = append(rcpts, a.String())
+	}
+	w, err := c.Data()
+	if err != nil {
+		return fmt.Errorf("%s: %w", addr, err)
+	}
+	headers := []string{
+		"From: " + sender.String(),
+		"To: " + strings.Join(rcpts, ", "),
+		"Subject: " + mime.QEncoding.Encode("utf-8", subject),
+		"Date: " + time.Now().Format(time.RFC1123Z),
+		"MIME-Version: 1.0",
+		"Content-Type: text/plain; charset=utf-8",
+		"Content-Transfer-Encoding: 8bit",
+		"Auto-Submitted: auto-generated",
+	}
+	// The DATA writer turns \n into CRLF and escapes leading dots.
+	if _, err := fmt.Fprintf(w, "%s\n\n%s", strings.Join(headers, "\n"), body); err != nil {
+		w.Close()
+		return fmt.Errorf("%s: %w", addr, err)
+	}
+	if err := w.Close(); err != nil {
+		return fmt.Errorf("%s: %w", addr, err)
+	}
+	// The message has been accepted; how QUIT goes does not matter.
+	c.Quit()
+	return nil
+}
+
+// HostnameOr returns the host name, or fallback if it is unknown.
+func HostnameOr(fallback string) string {
+	if h, err := os.Hostname(); err == nil && h != "" {
+		return h
+	}
+	return fallback
+}
+
+// IsLoopbackHost reports whether host is localhost or a loopback address.
+func IsLoopbackHost(host string) bool {
+	if host == "localhost" {
+		return true
+	}
+	ip := net.ParseIP(host)
+	return ip != nil && ip.IsLoopback()
+}
@@ -0,0 +1,215 @@
+package report
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"runtime"
+	"strings"
+	"time"
+
+	"github.com/sparkleHazard/bootstrap/internal/ansible"
+	"github.com/sparkleHazard/bootstrap/internal/platform"
+	"github.com/sparkleHazard/bootstrap/internal/secrets"
+	"github.com/sparkleHazard/bootstrap/internal/sshkeys"
+)
+
+// errorReportTimeout bounds sending an error report.
+const errorReportTimeout = 5 * time.Second
+
+// errorReportOutputMax is how much of the failing step's output an error
+// report carries.
+const errorReportOutputMax = 8 * 1024
+
+// sentryDSN is a parsed Sentry DSN, https://KEY@HOST[/PATH]/PROJECT.
+type sentryDSN struct {
+	key      string
+	envelope string // the project's envelope endpoint
+}
+
+// ParseSentryDSN parses a Sentry-compatible DSN.
+func ParseSentryDSN(dsn string) (*sentryDSN, error) {
+	u, err := url.Parse(dsn)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return nil, errors.New("must be an http:// or https:// URL")
+	}
+	if u.User == nil || u.User.Username() == "" {
+		return nil, errors.New("has no public key (https://KEY@host/PROJECT)")
+	}
+	path := strings.TrimSuffix(u.Path, "/")
+	i := strings.LastIndex(path, "/")
+	prefix, project := strings.Trim(path[:max(i, 0)], "/"), path[i+1:]
+	if project == "" {
+		return nil, errors.New("has no project ID (https://KEY@host/PROJECT)")
+	}
+	endpoint := u.Scheme + "://" + u.Host + "/"
+	if prefix != "" {
+		endpoint += prefix + "/"
+	}
+	return &sentryDSN{
+		key:      u.User.Username(),
+		envelope: endpoint + "api/" + project + "/envelope/",
+	}, nil
+}
+
+// SendErrorReport sends the failed run res, which stopped with err, as an
+// event to --error-report-dsn. Failures are logged, never returned.
+func (r *Reporter) SendErrorReport(ctx context.Context, res *Result, err error) {
+	if r.cfg.ErrorReportDSN == "" || res.Status != "failed" {
+		return
+	}
+	dsn, perr := ParseSentryDSN(r.cfg.ErrorReportDSN)
+	if perr != nil {
+		r.sys.Log("Warning: not sending the error report: error-report-dsn " + perr.Error())
+		return
+	}
+	if oerr := r.sys.CheckOfflineURL(dsn.envelope, "the error report"); oerr != nil {
+		r.sys.Log("Warning: not sending the error report: " + oerr.Error())
+		return
+	}
+	ctx, cancel := context.WithTimeout(context.WithoutCancel(ctx), errorReportTimeout)
+	defer cancel()
+
+	id := make([]byte, 16)
+	rand.Read(id)
+	eventID := hex.EncodeToString(id)
+	body, merr := sentryEnvelope(eventID, r.errorEvent(eventID, res, err))
+	if merr != nil {
+		r.sys.Log("Warning: error report: " + merr.Error())
+		return
+	}
+	req, rerr := http.NewRequestWithContext(ctx, http.MethodPost, dsn.envelope, bytes.NewReader(body))
+	if rerr != nil {
+		r.sys.Log("Warning: error report: invalid error-report-dsn")
+		return
+	}
+	req.Header.Set("Content-Type", "application/x-sentry-envelope")
+	req.Header.Set("X-Sentry-Auth", fmt.Sprintf("Sentry sentry_version=7, sentry_client=bootstrap/%s, sentry_key=%s", platform.ToolVersion(), dsn.key))
+	status, derr := r.doNotifyRequest(req)
+	if derr != nil {
+		r.sys.Log(fmt.Sprintf("Warning: sending the error report to %s failed: %v", platform.RedactURL(dsn.envelope), derr))
+		return
+	}
+	if status/100 != 2 {
+		r.sys.Log(fmt.Sprintf("Warning: sending the error report to %s returned HTTP %d", platform.RedactURL(dsn.envelope), status))
+		return
+	}
+	r.sys.Log("Sent error report " + eventID + ".")
+}
+
+// errorEvent builds the Sentry event for the failed run res. Go errors
+// carry no stack trace, so the failing step and the tail of its output
+// stand in for one.
+func (r *Reporter) errorEvent(eventID string, res *Result, err error) map[string]any {
+	category := errorCategory(err, res.FailedStep)
+	step := platform.DashIfEmpty(res.FailedStep)
+	return map[string]any{
+		"event_id":    eventID,
+		"timestamp":   res.FinishedAt.UTC().Format(time.RFC3339),
+		"platform":    "other",
+		"level":       "error",
+		"logger":      "bootstrap",
+		"release":     "bootstrap@" + res.Version,
+		"server_name": res.Hostname,
+		"exception": map[string]any{
+			"values": []map[string]any{{
+				"type":      category,
+				"value":     r.sys.RedactSecrets(res.Error),
+				"module":    step,
+				"mechanism": map[string]any{"type": "bootstrap", "handled": false},
+			}},
+		},
+		// Group by what failed where, not by the message, which names
+		// hosts and paths.
+		"fingerprint": []string{category, step},
+		"tags": map[string]string{
+			"category":  category,
+			"step":      step,
+			"role":      res.Role,
+			"os":        platform.DashIfEmpty(res.OS),
+			"arch":      runtime.GOARCH,
+			"exit_code": fmt.Sprint(res.ExitCode),
+		},
+		"contexts": map[string]any{
+			"os":     map[string]string{"name": platform.DashIfEmpty(res.OS), "type": "os"},
+			"device": map[string]string{"arch": runtime.GOARCH, "type": "device"},
+		},
+		"extra": map[string]any{
+			"steps":       res.Steps,
+			"output_tail": r.errorReportOutput(),
+		},
+	}
+}
+
+// sentryEnvelope wraps event in the envelope format Sentry's ingestion
+// endpoint takes: an envelope header line, then the item's header and
+// payload lines.
+func sentryEnvelope(eventID string, event map[string]any) ([]byte, error) {
+	payload, err := json.Marshal(event)
+	if err != nil {
+		return nil, err
+	}
+	header, _ := json.Marshal(map[string]string{"event_id": eventID, "sent_at": time.Now().UTC().Format(time.RFC3339)})
+	item, _ := json.Marshal(map[string]any{"type": "event", "length": len(payload)})
+	var b bytes.Buffer
+	for _, line := range [][]byte{header, item, payload} {
+		b.Write(line)
+		b.WriteByte('\n')
+	}
+	return b.Bytes(), nil
+}
+
+// errorCategory sorts the error a run stopped with into a category for
+// grouping error reports.
+func errorCategory(err error, step string) string {
+	var ee *platform.ExitError
+	switch {
+	case errors.Is(err, sshkeys.ErrUnauthorized):
+		return "unauthorized"
+	case errors.Is(err, sshkeys.ErrHostRefused):
+		return "host-refused"
+	case errors.Is(err, ansible.ErrDeclined):
+		return "declined"
+	case errors.Is(err, ansible.ErrSignature):
+		return "signature"
+	case errors.Is(err, sshkeys.ErrKeyDecrypt):
+		return "decrypt"
+	case errors.Is(err, secrets.ErrVaultAuth):
+		return "vault-auth"
+	case errors.Is(err, secrets.ErrSecretTool), errors.Is(err, secrets.ErrSecretAuth), errors.Is(err, secrets.ErrSecretNotFound):
+		return "secret"
+	case errors.Is(err, context.DeadlineExceeded):
+		return "timeout"
+	case errors.As(err, &ee) && ee.Code == platform.ExitPrivileges:
+		return "privileges"
+	case errors.As(err, &ee) && ee.Code == platform.ExitLocked:
+		return "locked"
+	}
+	switch {
+	case strings.HasPrefix(step, "install-") || step == "homebrew":
+		return "install"
+	case step == "ansible-pull" || step == "syntax-check":
+		return "playbook"
+	case step == "keyserver-discovery" || step == "keyserver-wait" || step == "fetch-key":
+		return "keyserver"
+	case step == "disk-space" || step == "network" || step == "clock" || step == "privileges":
+		return "preflight"
+	}
+	return "failure"
+}
+
+// errorReportOutput returns the tail of the failing step's output with
+// secrets redacted.
+func (r *Reporter) errorReportOutput() string {
+	out := r.sys.RedactSecrets(r.sys.StepOutput.String())
+	if len(out) > errorReportOutputMax {
+		out = out[len(out)-errorReportOutputMax:]
+	}
+	return out
+}
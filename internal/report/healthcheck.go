@@ -0,0 +1,67 @@
+package report
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/sparkleHazard/bootstrap/internal/platform"
+)
+
+// healthcheckTimeout bounds each ping, so that a monitoring outage never
+// holds up provisioning.
+const healthcheckTimeout = 5 * time.Second
+
+// healthcheckBodyMax is the most of the failure summary sent with a fail
+// ping; healthchecks.io keeps only the start of larger bodies anyway.
+const healthcheckBodyMax = 10000
+
+// PingHealthcheck pings --healthcheck-url in the healthchecks.io style:
+// kind "start" pings URL/start, "fail" URL/fail and "" URL itself, with
+// body, if any, as the request body. Failures are logged, never returned.
+func (r *Reporter) PingHealthcheck(ctx context.Context, kind, body string) {
+	if r.cfg.HealthcheckURL == "" {
+		return
+	}
+	u := strings.TrimSuffix(r.cfg.HealthcheckURL, "/")
+	if kind != "" {
+		u += "/" + kind
+	}
+	if err := r.sys.CheckOfflineURL(u, "the healthcheck ping"); err != nil {
+		r.sys.Log("Warning: not pinging the healthcheck: " + err.Error())
+		return
+	}
+	// The fail ping is sent after an interrupt, too.
+	ctx, cancel := context.WithTimeout(context.WithoutCancel(ctx), healthcheckTimeout)
+	defer cancel()
+
+	if len(body) > healthcheckBodyMax {
+		body = body[:healthcheckBodyMax]
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, u, strings.NewReader(body))
+	if err != nil {
+		r.sys.Log("Warning: healthcheck ping failed: invalid URL")
+		return
+	}
+	req.Header.Set("Content-Type", "text/plain; charset=utf-8")
+	status, err := r.doNotifyRequest(req)
+	if err != nil {
+		r.sys.Log(fmt.Sprintf("Warning: healthcheck ping to %s failed: %v", platform.RedactURL(u), err))
+		return
+	}
+	if status != http.StatusOK {
+		r.sys.Log(fmt.Sprintf("Warning: healthcheck ping to %s returned HTTP %d", platform.RedactURL(u), status))
+	} else if r.cfg.Verbose {
+		r.sys.Log("Pinged the healthcheck at " + platform.RedactURL(u))
+	}
+}
+
+// HealthcheckFailureBody summarizes the failed run res for the fail ping:
+// the error, then the full result as JSON.
+func HealthcheckFailureBody(res *Result) string {
+	data, _ := json.MarshalIndent(res, "", "  ")
+	return fmt.Sprintf("bootstrap %s (role %s): %s\n\n%s\n", res.Status, res.Role, res.Error, data)
+}
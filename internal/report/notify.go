@@ -0,0 +1,15 @@
+package report
+
+import "net/http"
+
+// doNotifyRequest sends req, one of the notifications at the end of a run,
+// and returns the response's status code. Unlike http.Client.Do's, its
+// error does not quote the URL, which for most such services is a secret.
+func (r *Reporter) doNotifyRequest(req *http.Request) (int, error) {
+	resp, err := r.sys.SendNotifyRequest(req)
+	if err != nil {
+		return 0, err
+	}
+	resp.Body.Close()
+	return resp.StatusCode, nil
+}
@@ -0,0 +1,115 @@
+package report
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/sparkleHazard/bootstrap/internal/platform"
+)
+
+// ntfyServer is where --notify-ntfy publishes a bare topic.
+const ntfyServer = "https://ntfy.sh/"
+
+// ntfyTimeout bounds publishing the notification.
+const ntfyTimeout = 5 * time.Second
+
+// NtfyTokenEnv holds the access token for a protected topic, kept out of
+// the config file and the process arguments.
+const NtfyTokenEnv = platform.EnvPrefix + "NTFY_TOKEN"
+
+// ntfyTopicRegex matches the topic names ntfy accepts.
+var ntfyTopicRegex = regexp.MustCompile(`^[-_A-Za-z0-9]{1,64}$`)
+
+// NtfyURL returns the URL to publish to for --notify-ntfy, which is either
+// a topic on ntfy.sh or the full URL of a topic on a self-hosted server.
+func NtfyURL(topicOrURL string) (string, error) {
+	if !strings.Contains(topicOrURL, "://") {
+		if !ntfyTopicRegex.MatchString(topicOrURL) {
+			return "", fmt.Errorf("%q is not a valid ntfy topic (letters, digits, - and _)", topicOrURL)
+		}
+		return ntfyServer + topicOrURL, nil
+	}
+	u, err := url.Parse(topicOrURL)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" || !ntfyTopicRegex.MatchString(strings.Trim(u.Path, "/")) {
+		return "", fmt.Errorf("%q must be a topic or an http:// or https:// URL of one, e.g. https://ntfy.example.com/mytopic", topicOrURL)
+	}
+	return topicOrURL, nil
+}
+
+// NotifyNtfy publishes the outcome of the finished run res to the
+// --notify-ntfy topic. Failures are logged, never returned.
+func (r *Reporter) NotifyNtfy(ctx context.Context, res *Result) {
+	if r.cfg.NotifyNtfy == "" {
+		return
+	}
+	u, err := NtfyURL(r.cfg.NotifyNtfy)
+	if err != nil {
+		r.sys.Log("Warning: not sending the ntfy notification: notify-ntfy " + err.Error())
+		return
+	}
+	if err := r.sys.CheckOfflineURL(u, "the ntfy notification"); err != nil {
+		r.sys.Log("Warning: not sending the ntfy notification: " + err.Error())
+		return
+	}
+	ctx, cancel := context.WithTimeout(context.WithoutCancel(ctx), ntfyTimeout)
+	defer cancel()
+
+	title, message, priority, tag := r.ntfyMessage(res)
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, u, strings.NewReader(message))
+	if err != nil {
+		r.sys.Log("Warning: ntfy notification failed: invalid URL")
+		return
+	}
+	req.Header.Set("Title", title)
+	req.Header.Set("Priority", priority)
+	req.Header.Set("Tags", tag)
+	if token := strings.TrimSpace(os.Getenv(NtfyTokenEnv)); token != "" {
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+	status, err := r.doNotifyRequest(req)
+	if err != nil {
+		r.sys.Log(fmt.Sprintf("Warning: ntfy notification to %s failed: %v", platform.RedactURL(u), err))
+		return
+	}
+	if status/100 != 2 {
+		r.sys.Log(fmt.Sprintf("Warning: ntfy notification to %s returned HTTP %d", platform.RedactURL(u), status))
+	} else if r.cfg.Verbose {
+		r.sys.Log("Sent the ntfy notification to " + platform.RedactURL(u))
+	}
+}
+
+// ntfyMessage returns the title, message, priority and tag of the
+// notification for res, the priority and tag following the outcome.
+func (r *Reporter) ntfyMessage(res *Result) (title, message, priority, tag string) {
+	host := res.Hostname
+	if host == "" {
+		host = "unknown host"
+	}
+	took := time.Duration(res.DurationSeconds * float64(time.Second)).Round(time.Second)
+	message = fmt.Sprintf("Role %s, %s after %s", res.Role, res.Status, took)
+	if res.FailedStep != "" {
+		message += " at step " + res.FailedStep
+	}
+	if res.Error != "" {
+		message += ": " + r.sys.RedactSecrets(res.Error)
+	}
+	switch res.Status {
+	case "success":
+		priority, tag = "default", "white_check_mark"
+	case "skipped":
+		priority, tag = "low", "fast_forward"
+	case "interrupted":
+		priority, tag = "default", "warning"
+	case "drift":
+		priority, tag = "high", "warning"
+	default:
+		priority, tag = "high", "x"
+	}
+	return host + ": bootstrap " + res.Status, message, priority, tag
+}
@@ -0,0 +1,139 @@
+package report
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/sparkleHazard/bootstrap/internal/platform"
+)
+
+// pushgatewayTimeout bounds the metrics push, which like the healthcheck
+// ping must never hold up provisioning.
+const pushgatewayTimeout = 5 * time.Second
+
+// pushgatewayJob is the job label the metrics are pushed under.
+const pushgatewayJob = "bootstrap"
+
+// Environment variables holding the Pushgateway's basic auth credentials,
+// kept out of the config file and the process arguments.
+const (
+	pushgatewayUserEnv     = platform.EnvPrefix + "PUSHGATEWAY_USER"
+	PushgatewayPasswordEnv = platform.EnvPrefix + "PUSHGATEWAY_PASSWORD"
+)
+
+// PushMetrics pushes the metrics of the finished run res to --pushgateway,
+// replacing those of this host's previous run. Failures are logged, never
+// returned.
+func (r *Reporter) PushMetrics(ctx context.Context, res *Result) {
+	if r.cfg.Pushgateway == "" {
+		return
+	}
+	host := res.Hostname
+	if host == "" {
+		host = "unknown"
+	}
+	u := strings.TrimSuffix(r.cfg.Pushgateway, "/") + "/metrics/job/" + pushgatewayJob + "/instance/" + url.PathEscape(host)
+	if err := r.sys.CheckOfflineURL(u, "the run's metrics"); err != nil {
+		r.sys.Log("Warning: not pushing metrics: " + err.Error())
+		return
+	}
+	// The metrics of an interrupted run are pushed, too.
+	ctx, cancel := context.WithTimeout(context.WithoutCancel(ctx), pushgatewayTimeout)
+	defer cancel()
+
+	// PUT replaces every metric of the group, so that steps this run did
+	// not reach do not keep the values of an earlier one.
+	req, err := http.NewRequestWithContext(ctx, http.MethodPut, u, bytes.NewReader(runMetrics(res)))
+	if err != nil {
+		r.sys.Log("Warning: pushing metrics failed: " + err.Error())
+		return
+	}
+	req.Header.Set("Content-Type", "text/plain; version=0.0.4")
+	if user := os.Getenv(pushgatewayUserEnv); user != "" {
+		req.SetBasicAuth(user, os.Getenv(PushgatewayPasswordEnv))
+	}
+	status, err := r.doNotifyRequest(req)
+	if err != nil {
+		r.sys.Log(fmt.Sprintf("Warning: pushing metrics to %s failed: %v", platform.RedactURL(u), err))
+		return
+	}
+	if status/100 != 2 {
+		r.sys.Log(fmt.Sprintf("Warning: pushing metrics to %s returned HTTP %d", platform.RedactURL(u), status))
+	} else if r.cfg.Verbose {
+		r.sys.Log("Pushed the run's metrics to " + platform.RedactURL(u))
+	}
+}
+
+// runMetrics renders res in the Prometheus text exposition format.
+func runMetrics(res *Result) []byte {
+	var b bytes.Buffer
+	metric := func(name, typ, help string) {
+		fmt.Fprintf(&b, "# HELP %s %s\n# TYPE %s %s\n", name, help, name, typ)
+	}
+
+	metric("bootstrap_run_info", "gauge", "Version, role and OS of the last bootstrap run.")
+	fmt.Fprintf(&b, "bootstrap_run_info{version=%s,role=%s,os=%s} 1\n",
+		labelValue(res.Version), labelValue(res.Role), labelValue(res.OS))
+	metric("bootstrap_run_success", "gauge", "Whether the last bootstrap run succeeded (or was skipped as already done).")
+	fmt.Fprintf(&b, "bootstrap_run_success %d\n", boolMetric(res.Status == "success" || res.Status == "skipped"))
+	metric("bootstrap_run_exit_code", "gauge", "Exit code of the last bootstrap run.")
+	fmt.Fprintf(&b, "bootstrap_run_exit_code %d\n", res.ExitCode)
+	metric("bootstrap_run_duration_seconds", "gauge", "How long the last bootstrap run took.")
+	fmt.Fprintf(&b, "bootstrap_run_duration_seconds %g\n", res.DurationSeconds)
+	metric("bootstrap_run_finished_timestamp_seconds", "gauge", "When the last bootstrap run finished, in Unix time.")
+	fmt.Fprintf(&b, "bootstrap_run_finished_timestamp_seconds %d\n", res.FinishedAt.Unix())
+
+	if len(res.Steps) > 0 {
+		metric("bootstrap_step_success", "gauge", "Whether each step of the last bootstrap run did not fail.")
+		for _, step := range platform.SortedKeys(res.Steps) {
+			fmt.Fprintf(&b, "bootstrap_step_success{step=%s} %d\n", labelValue(step), boolMetric(!StepFailed(res.Steps[step])))
+		}
+	}
+	if len(res.StepSeconds) > 0 {
+		metric("bootstrap_step_duration_seconds", "gauge", "How long each step of the last bootstrap run took.")
+		for _, step := range platform.SortedKeys(res.StepSeconds) {
+			fmt.Fprintf(&b, "bootstrap_step_duration_seconds{step=%s} %g\n", labelValue(step), res.StepSeconds[step])
+		}
+		metric("bootstrap_step_retries", "gauge", "How often each step of the last bootstrap run retried.")
+		for _, step := range platform.SortedKeys(res.StepSeconds) {
+			fmt.Fprintf(&b, "bootstrap_step_retries{step=%s} %d\n", labelValue(step), res.StepRetries[step])
+		}
+	}
+	if r := res.AnsibleRecap; r != nil {
+		metric("bootstrap_ansible_changed_total", "counter", "Tasks the playbook changed in the last bootstrap run.")
+		fmt.Fprintf(&b, "bootstrap_ansible_changed_total %d\n", r.Changed)
+		metric("bootstrap_ansible_failed_total", "counter", "Tasks that failed in the last bootstrap run's playbook.")
+		fmt.Fprintf(&b, "bootstrap_ansible_failed_total %d\n", r.Failed+r.Unreachable)
+	}
+	return b.Bytes()
+}
+
+// StepFailed reports whether a step status recorded in Result.Steps is
+// a failure.
+func StepFailed(status string) bool {
+	switch status {
+	case "failed", "timeout", "interrupted", "cancelled":
+		return true
+	}
+	return false
+}
+
+// labelValue quotes s as a Prometheus label value.
+func labelValue(s string) string {
+	r := strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+	return `"` + r.Replace(s) + `"`
+}
+
+// boolMetric returns 1 for true and 0 for false.
+func boolMetric(b bool) int {
+	if b {
+		return 1
+	}
+	return 0
+}
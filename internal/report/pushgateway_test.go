@@ -0,0 +1,162 @@
+package report
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"regexp"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/sparkleHazard/bootstrap/internal/ansible"
+	"github.com/sparkleHazard/bootstrap/internal/config"
+	"github.com/sparkleHazard/bootstrap/internal/platform/platformtest"
+)
+
+// The lines of the Prometheus text exposition format, version 0.0.4.
+var (
+	helpLineRegex   = regexp.MustCompile(`^# HELP ([a-zA-Z_:][a-zA-Z0-9_:]*) \S.*$`)
+	typeLineRegex   = regexp.MustCompile(`^# TYPE ([a-zA-Z_:][a-zA-Z0-9_:]*) (counter|gauge|histogram|summary|untyped)$`)
+	sampleLineRegex = regexp.MustCompile(`^([a-zA-Z_:][a-zA-Z0-9_:]*)(\{(?:[a-zA-Z_][a-zA-Z0-9_]*="(?:[^"\\\n]|\\[\\"n])*"(?:,|(?:\})))*)? (\S+)$`)
+)
+
+// checkExposition fails the test unless body is valid text exposition
+// format: every sample follows its metric's TYPE line, each metric is
+// described once, each series appears once and every value is a number.
+// It returns the samples by series.
+func checkExposition(t *testing.T, body string) map[string]string {
+	t.Helper()
+	if !strings.HasSuffix(body, "\n") {
+		t.Errorf("the body does not end in a newline")
+	}
+	typed := map[string]bool{}
+	helped := map[string]bool{}
+	samples := map[string]string{}
+	for i, line := range strings.Split(strings.TrimSuffix(body, "\n"), "\n") {
+		switch {
+		case strings.HasPrefix(line, "# HELP "):
+			m := helpLineRegex.FindStringSubmatch(line)
+			if m == nil || helped[m[1]] {
+				t.Errorf("line %d: bad or repeated HELP: %q", i+1, line)
+				continue
+			}
+			helped[m[1]] = true
+		case strings.HasPrefix(line, "# TYPE "):
+			m := typeLineRegex.FindStringSubmatch(line)
+			if m == nil || typed[m[1]] {
+				t.Errorf("line %d: bad or repeated TYPE: %q", i+1, line)
+				continue
+			}
+			typed[m[1]] = true
+		default:
+			m := sampleLineRegex.FindStringSubmatch(line)
+			if m == nil {
+				t.Errorf("line %d: not a sample: %q", i+1, line)
+				continue
+			}
+			if !typed[m[1]] {
+				t.Errorf("line %d: %s has no TYPE before it", i+1, m[1])
+			}
+			if _, err := strconv.ParseFloat(m[3], 64); err != nil {
+				t.Errorf("line %d: value %q is not a number", i+1, m[3])
+			}
+			series := m[1] + m[2]
+			if _, dup := samples[series]; dup {
+				t.Errorf("line %d: %s appears twice", i+1, series)
+			}
+			samples[series] = m[3]
+		}
+	}
+	return samples
+}
+
+func TestPushMetrics(t *testing.T) {
+	type push struct {
+		method, path, contentType, user, password string
+		auth                                      bool
+		body                                      string
+	}
+	pushes := make(chan push, 1)
+	status := http.StatusOK
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		code := status
+		body, _ := io.ReadAll(req.Body)
+		user, password, auth := req.BasicAuth()
+		pushes <- push{req.Method, req.URL.EscapedPath(), req.Header.Get("Content-Type"), user, password, auth, string(body)}
+		w.WriteHeader(code)
+	}))
+	defer srv.Close()
+	t.Setenv(pushgatewayUserEnv, "prom")
+	t.Setenv(PushgatewayPasswordEnv, "s3cret")
+
+	sys, _, logger := platformtest.NewSystem(t, &config.Config{Pushgateway: srv.URL + "/"})
+	r := NewReporter(sys, nil, nil, nil)
+	finished := time.Date(2026, 10, 15, 9, 30, 0, 0, time.UTC)
+	res := &Result{
+		Status:          "failed",
+		ExitCode:        1,
+		Role:            `web "east"`,
+		OS:              "debian",
+		Version:         "v1.4.0",
+		Hostname:        "web/1",
+		FinishedAt:      finished,
+		DurationSeconds: 42.5,
+		Steps:           map[string]string{"prereqs": "installed", "ansible-pull": "failed"},
+		StepSeconds:     map[string]float64{"prereqs": 12.25, "ansible-pull": 30},
+		StepRetries:     map[string]int{"prereqs": 2},
+		AnsibleRecap:    &ansible.Recap{Changed: 7, Failed: 1, Unreachable: 1},
+	}
+	r.PushMetrics(context.Background(), res)
+
+	var p push
+	select {
+	case p = <-pushes:
+	default:
+		t.Fatalf("nothing was pushed; logged %q", logger.Messages())
+	}
+	if p.method != http.MethodPut || p.path != "/metrics/job/bootstrap/instance/web%2F1" {
+		t.Errorf("pushed with %s %s, want PUT /metrics/job/bootstrap/instance/web%%2F1", p.method, p.path)
+	}
+	if p.contentType != "text/plain; version=0.0.4" {
+		t.Errorf("Content-Type = %q", p.contentType)
+	}
+	if !p.auth || p.user != "prom" || p.password != "s3cret" {
+		t.Errorf("basic auth = %q, %q, %t", p.user, p.password, p.auth)
+	}
+	samples := checkExposition(t, p.body)
+	want := map[string]string{
+		`bootstrap_run_info{version="v1.4.0",role="web \"east\"",os="debian"}`: "1",
+		`bootstrap_run_success`:                                "0",
+		`bootstrap_run_exit_code`:                              "1",
+		`bootstrap_run_duration_seconds`:                       "42.5",
+		`bootstrap_run_finished_timestamp_seconds`:             strconv.FormatInt(finished.Unix(), 10),
+		`bootstrap_step_success{step="ansible-pull"}`:          "0",
+		`bootstrap_step_success{step="prereqs"}`:               "1",
+		`bootstrap_step_duration_seconds{step="ansible-pull"}`: "30",
+		`bootstrap_step_duration_seconds{step="prereqs"}`:      "12.25",
+		`bootstrap_step_retries{step="ansible-pull"}`:          "0",
+		`bootstrap_step_retries{step="prereqs"}`:               "2",
+		`bootstrap_ansible_changed_total`:                      "7",
+		`bootstrap_ansible_failed_total`:                       "2",
+	}
+	for series, value := range want {
+		if samples[series] != value {
+			t.Errorf("%s = %q, want %q", series, samples[series], value)
+		}
+	}
+	if len(samples) != len(want) {
+		t.Errorf("pushed %d series, want %d:\n%s", len(samples), len(want), p.body)
+	}
+
+	// A push is best effort: a gateway that refuses it is only warned
+	// about.
+	status = http.StatusBadGateway
+	r.PushMetrics(context.Background(), res)
+	<-pushes
+	if msgs := logger.Messages(); len(msgs) == 0 || !strings.Contains(msgs[len(msgs)-1], "returned HTTP 502") {
+		t.Errorf("logged %q, want a warning about HTTP 502", msgs)
+	}
+}
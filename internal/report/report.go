@@ -0,0 +1,205 @@
+// Package report records the outcome of a run and sends it on: the result
+// file, report URL, healthchecks, metrics, ntfy, email and error reports.
+package report
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/sparkleHazard/bootstrap/internal/ansible"
+	"github.com/sparkleHazard/bootstrap/internal/config"
+	"github.com/sparkleHazard/bootstrap/internal/platform"
+	"github.com/sparkleHazard/bootstrap/internal/secrets"
+	"github.com/sparkleHazard/bootstrap/internal/sshkeys"
+)
+
+// reportTimeout bounds each attempt at delivering a report.
+const reportTimeout = 10 * time.Second
+
+// reportQueueMax is how many undelivered reports are kept for later runs;
+// beyond that the oldest are dropped.
+const reportQueueMax = 20
+
+// reportRetryPolicy retries a report only briefly: an endpoint that stays
+// unreachable gets the report from a later run instead.
+var reportRetryPolicy = platform.RetryPolicy{Attempts: 3, InitialDelay: 2 * time.Second, MaxDelay: 5 * time.Second, Multiplier: 2}
+
+// SendReport POSTs res, as written to --result-file, to --report-url. Any
+// reports earlier runs failed to deliver go first; a report that cannot be
+// delivered now is queued in the state directory for the next run.
+// Failures are logged, never returned.
+func (r *Reporter) SendReport(ctx context.Context, res *Result) {
+	if r.cfg.ReportURL == "" {
+		return
+	}
+	if err := r.sys.CheckOfflineURL(r.cfg.ReportURL, "the run report"); err != nil {
+		r.sys.Log("Warning: not sending the run report: " + err.Error())
+		return
+	}
+	token, err := r.ReportToken()
+	if err != nil {
+		r.sys.Log("Warning: not sending the run report: " + err.Error())
+		return
+	}
+	data, err := json.Marshal(res)
+	if err != nil {
+		r.sys.Log("Warning: run report: " + err.Error())
+		return
+	}
+	// The report of an interrupted run is sent, too.
+	ctx = context.WithoutCancel(ctx)
+
+	dir, err := r.reportQueueDir()
+	if err != nil {
+		r.sys.Log("Warning: run report queue: " + err.Error())
+	}
+	if dir != "" && !r.deliverQueuedReports(ctx, dir, token) {
+		// The endpoint is still unreachable; don't wait on it again.
+		r.queueReport(ctx, dir, res.StartedAt, data)
+		return
+	}
+	err = r.postReport(ctx, data, token)
+	var perm *platform.PermanentError
+	switch {
+	case err == nil:
+		if r.cfg.Verbose {
+			r.sys.Log("Sent the run report to " + platform.RedactURL(r.cfg.ReportURL))
+		}
+	case errors.As(err, &perm) || dir == "":
+		r.sys.Log("Warning: the run report was not delivered: " + err.Error())
+	default:
+		r.sys.Log("Warning: " + err.Error())
+		r.queueReport(ctx, dir, res.StartedAt, data)
+	}
+}
+
+// deliverQueuedReports sends the reports queued in dir, oldest first,
+// removing each once it is delivered or refused outright. It returns false
+// if the endpoint could not be reached, leaving the rest queued.
+func (r *Reporter) deliverQueuedReports(ctx context.Context, dir, token string) bool {
+	for _, path := range queuedReports(dir) {
+		data, err := os.ReadFile(path)
+		if err != nil {
+			r.sys.Log("Warning: queued run report: " + err.Error())
+			continue
+		}
+		err = r.postReport(ctx, data, token)
+		var perm *platform.PermanentError
+		switch {
+		case err == nil:
+			r.sys.Log("Delivered the queued run report " + filepath.Base(path) + ".")
+		case errors.As(err, &perm):
+			r.sys.Log("Warning: dropping the queued run report " + filepath.Base(path) + ": " + err.Error())
+		default:
+			r.sys.Log("Warning: " + err.Error())
+			return false
+		}
+		os.Remove(path)
+	}
+	return true
+}
+
+// postReport POSTs the report data, retrying briefly on network errors and
+// server errors. Any other refusal is a permanent error.
+func (r *Reporter) postReport(ctx context.Context, data []byte, token string) error {
+	return r.sys.Retry(ctx, reportRetryPolicy, "sending the run report to "+platform.RedactURL(r.cfg.ReportURL), func() error {
+		ctx, cancel := context.WithTimeout(ctx, reportTimeout)
+		defer cancel()
+		req, err := http.NewRequestWithContext(ctx, http.MethodPost, r.cfg.ReportURL, bytes.NewReader(data))
+		if err != nil {
+			return platform.Permanent(errors.New("invalid report-url"))
+		}
+		req.Header.Set("Content-Type", "application/json")
+		if token != "" {
+			req.Header.Set("Authorization", "Bearer "+token)
+		}
+		status, err := r.doNotifyRequest(req)
+		switch {
+		case err != nil:
+			return err
+		case status/100 == 2:
+			return nil
+		case status >= 500 || status == http.StatusTooManyRequests:
+			return fmt.Errorf("HTTP %d", status)
+		default:
+			return platform.Permanent(fmt.Errorf("%s refused the run report: HTTP %d", platform.RedactURL(r.cfg.ReportURL), status))
+		}
+	})
+}
+
+// ReportToken returns the bearer token for --report-url: --report-token, or
+// the contents of --report-token-file, or "".
+func (r *Reporter) ReportToken() (string, error) {
+	if r.cfg.ReportToken != "" || r.cfg.ReportTokenFile == "" {
+		return r.cfg.ReportToken, nil
+	}
+	data, err := os.ReadFile(r.cfg.ReportTokenFile)
+	if err != nil {
+		return "", fmt.Errorf("reading report-token-file: %w", err)
+	}
+	token := strings.TrimSpace(string(data))
+	if token == "" {
+		return "", fmt.Errorf("report-token-file %s is empty", r.cfg.ReportTokenFile)
+	}
+	return token, nil
+}
+
+// reportQueueDir returns the directory undelivered reports are queued in.
+func (r *Reporter) reportQueueDir() (string, error) {
+	dir, err := r.sys.StateDir()
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(dir, "report-queue"), nil
+}
+
+// queuedReports returns the reports queued in dir, oldest first.
+func queuedReports(dir string) []string {
+	paths, _ := filepath.Glob(filepath.Join(dir, "*.json"))
+	sort.Strings(paths)
+	return paths
+}
+
+// queueReport saves the report data of the run started at started in dir,
+// dropping the oldest queued reports past reportQueueMax.
+func (r *Reporter) queueReport(ctx context.Context, dir string, started time.Time, data []byte) {
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		r.sys.Log("Warning: queueing the run report: " + err.Error())
+		return
+	}
+	path := filepath.Join(dir, started.UTC().Format("20060102T150405.000000000Z")+".json")
+	if _, err := r.sys.WriteFile(ctx, path, data, 0600, ""); err != nil {
+		r.sys.Log("Warning: queueing the run report: " + err.Error())
+		return
+	}
+	r.sys.Log("Queued the run report in " + dir + " for the next run to deliver.")
+	if paths := queuedReports(dir); len(paths) > reportQueueMax {
+		for _, p := range paths[:len(paths)-reportQueueMax] {
+			os.Remove(p)
+		}
+	}
+}
+
+// Reporter sends the outcome of a run to where --healthcheck-url and the
+// other notification settings say.
+type Reporter struct {
+	cfg     *config.Config
+	sys     *platform.System
+	secrets *secrets.Store
+	keys    *sshkeys.Manager
+	ansible *ansible.Runner
+}
+
+// NewReporter returns the reporter of a run on sys.
+func NewReporter(sys *platform.System, secrets *secrets.Store, keys *sshkeys.Manager, ansible *ansible.Runner) *Reporter {
+	return &Reporter{cfg: sys.Config, sys: sys, secrets: secrets, keys: keys, ansible: ansible}
+}
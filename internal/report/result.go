@@ -0,0 +1,134 @@
+package report
+
+import (
+	"context"
+	"encoding/json"
+	"time"
+
+	"github.com/sparkleHazard/bootstrap/internal/ansible"
+	"github.com/sparkleHazard/bootstrap/internal/platform"
+	"github.com/sparkleHazard/bootstrap/internal/service"
+)
+
+// Result is the outcome of a run, written to --result-file as JSON.
+type Result struct {
+	Status     string    `json:"status"`
+	ExitCode   int       `json:"exit_code"`
+	Error      string    `json:"error,omitempty"`
+	FailedStep string    `json:"failed_step,omitempty"`
+	Role       string    `json:"role"`
+	OS         string    `json:"os,omitempty"`
+	StartedAt  time.Time `json:"started_at"`
+	FinishedAt time.Time `json:"finished_at"`
+
+	// DurationSeconds is FinishedAt - StartedAt, for consumers of
+	// --report-url that would rather not parse timestamps.
+	DurationSeconds float64 `json:"duration_seconds"`
+
+	// Hostname, MachineID and Version identify the machine and the
+	// bootstrap build that ran.
+	Hostname  string `json:"hostname,omitempty"`
+	MachineID string `json:"machine_id,omitempty"`
+	Version   string `json:"version"`
+
+	// Checks records the outcome of preflight checks by name, e.g.
+	// "clock": "ok".
+	Checks map[string]string `json:"checks,omitempty"`
+
+	// Steps records the status of provisioning steps by name, e.g.
+	// "install-jq": "failed" or "mise-service": "enabled". A prerequisite
+	// is "installed", "already-installed", "not-needed" for the role, or
+	// "failed".
+	Steps map[string]string `json:"steps,omitempty"`
+
+	// TimeOffsetSeconds is the clock's offset from its NTP servers that
+	// --ensure-timesync measured, positive when it is ahead.
+	TimeOffsetSeconds *float64 `json:"time_offset_seconds,omitempty"`
+
+	// Facts describes the machine, as gathered before provisioning.
+	Facts *platform.HostFacts `json:"facts,omitempty"`
+
+	// KeyPath is the GitHub private key the run fetched or generated and
+	// gave ansible-pull.
+	KeyPath string `json:"key_path,omitempty"`
+
+	// AnsibleRef is the ref of the ansible repository ansible-pull checked
+	// out, and AnsibleRefFrom where it came from: "ansible-branch" or
+	// "role-branch". Both are empty for the repository's default branch.
+	AnsibleRef     string `json:"ansible_ref,omitempty"`
+	AnsibleRefFrom string `json:"ansible_ref_from,omitempty"`
+
+	// AnsibleCommit is the full SHA of the commit of the ansible
+	// repository that was checked out for the playbook.
+	AnsibleCommit string `json:"ansible_commit,omitempty"`
+
+	// Signature is the signature --require-signed-tag verified.
+	Signature *ansible.SignatureInfo `json:"signature,omitempty"`
+
+	// Approval is --two-phase's check run and the decision on it.
+	Approval *ansible.Approval `json:"approval,omitempty"`
+
+	// Drift is --detect-drift's check run and the changes it found pending.
+	Drift *ansible.DriftReport `json:"drift,omitempty"`
+
+	// RolledBack lists the changes undone by --rollback-on-failure,
+	// RollbackFailed those it could not undo, and NotRolledBack the
+	// irreversible changes (package installs, playbook runs) it did not try.
+	RolledBack     []string `json:"rolled_back,omitempty"`
+	RollbackFailed []string `json:"rollback_failed,omitempty"`
+	NotRolledBack  []string `json:"not_rolled_back,omitempty"`
+
+	// PreviousPostReboot is the outcome, by unit ("mise-install",
+	// "post-reboot-1", ...), of the one-shot units' runs after an earlier
+	// bootstrap run's reboot, where there were any.
+	PreviousPostReboot map[string]*service.UnitOutcome `json:"previous_post_reboot,omitempty"`
+
+	// StepSeconds records how long each step took and StepRetries how many
+	// times its network operations were retried, by step name, e.g.
+	// "keyserver-wait".
+	StepSeconds map[string]float64 `json:"step_seconds,omitempty"`
+	StepRetries map[string]int     `json:"step_retries,omitempty"`
+
+	// AnsibleRecap totals the playbook's PLAY RECAP, where ansible-pull
+	// got as far as printing one.
+	AnsibleRecap *ansible.Recap `json:"ansible_recap,omitempty"`
+
+	// Staged is the checkout of the ansible repository that the steps
+	// before ansible-pull inspected, if any.
+	Staged *ansible.StagedCheckout `json:"-"`
+
+	// Step is the step the run is in, which becomes FailedStep should the
+	// run fail there, and StepStart when it began; see enter. StepOrder
+	// lists the steps in the order they ran.
+	Step      string    `json:"-"`
+	StepStart time.Time `json:"-"`
+	StepOrder []string  `json:"-"`
+}
+
+// StepStatus returns the status of step for the step summary: that of the
+// run for the step it failed in, what the step recorded, or "ok".
+func (res *Result) StepStatus(step string) string {
+	switch status := res.Steps[step]; {
+	case step == res.FailedStep:
+		return res.Status
+	case status == "":
+		return "ok"
+	default:
+		return status
+	}
+}
+
+// StepDuration returns how long step took.
+func (res *Result) StepDuration(step string) time.Duration {
+	return time.Duration(res.StepSeconds[step] * float64(time.Second))
+}
+
+// WriteResultFile writes res as indented JSON to path.
+func (r *Reporter) WriteResultFile(ctx context.Context, path string, res *Result) error {
+	data, err := json.MarshalIndent(res, "", "  ")
+	if err != nil {
+		return err
+	}
+	_, err = r.sys.WriteFile(ctx, path, append(data, '\n'), 0644, "")
+	return err
+}
@@ -0,0 +1,177 @@
+package report
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/sparkleHazard/bootstrap/internal/platform"
+)
+
+// uploadTimeout bounds the upload of a failed run's logs, so that it never
+// holds up the exit for long.
+const uploadTimeout = 5 * time.Second
+
+// gistAPI is where --upload-failure-logs=gist creates the gist.
+const gistAPI = "https://api.github.com/gists"
+
+// UploadTokenEnv holds a bearer token for a --upload-failure-logs paste
+// endpoint.
+const UploadTokenEnv = platform.EnvPrefix + "UPLOAD_TOKEN"
+
+// uploadResponseMax is how much of the upload's response is read.
+const uploadResponseMax = 64 * 1024
+
+// ParseUploadTarget checks a --upload-failure-logs value: gist, or the
+// http:// or https:// URL of a paste endpoint.
+func ParseUploadTarget(target string) error {
+	if target == "gist" {
+		return nil
+	}
+	u, err := url.Parse(target)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return fmt.Errorf("%q must be gist or an http:// or https:// paste URL", target)
+	}
+	return nil
+}
+
+// UploadFailureLogs uploads the redacted tail of a failed run's output and
+// its result to --upload-failure-logs, as a secret gist or to a paste
+// endpoint, and logs where they can be found. Failures are logged, never
+// returned.
+func (r *Reporter) UploadFailureLogs(ctx context.Context, res *Result) {
+	if r.cfg.UploadFailureLogs == "" || res.Status != "failed" {
+		return
+	}
+	result, err := json.MarshalIndent(res, "", "  ")
+	if err != nil {
+		r.sys.Log("Warning: the failure logs were not uploaded: " + err.Error())
+		return
+	}
+	output, resultJSON := r.sys.RedactSecrets(r.sys.RunOutput.String()), r.sys.RedactSecrets(string(result))+"\n"
+
+	ctx, cancel := context.WithTimeout(context.WithoutCancel(ctx), uploadTimeout)
+	defer cancel()
+	var where string
+	if r.cfg.UploadFailureLogs == "gist" {
+		where, err = r.uploadGist(ctx, res, output, resultJSON)
+	} else {
+		where, err = r.uploadPaste(ctx, r.cfg.UploadFailureLogs, output, resultJSON)
+	}
+	if err != nil {
+		r.sys.Log("Warning: the failure logs were not uploaded: " + err.Error())
+		return
+	}
+	r.sys.Log("Failure logs uploaded: " + where)
+}
+
+// uploadGist creates a secret gist of the output and result, with the token
+// in $GH_TOKEN or $GITHUB_TOKEN, and returns its URL.
+func (r *Reporter) uploadGist(ctx context.Context, res *Result, output, result string) (string, error) {
+	token := strings.TrimSpace(os.Getenv("GH_TOKEN"))
+	if token == "" {
+		token = strings.TrimSpace(os.Getenv("GITHUB_TOKEN"))
+	}
+	if token == "" {
+		return "", errors.New("a gist needs a GitHub token in GH_TOKEN or GITHUB_TOKEN")
+	}
+	if err := r.sys.CheckOfflineURL(gistAPI, "the failure log gist"); err != nil {
+		return "", err
+	}
+	type gistFile struct {
+		Content string `json:"content"`
+	}
+	body, err := json.Marshal(struct {
+		Description string              `json:"description"`
+		Public      bool                `json:"public"`
+		Files       map[string]gistFile `json:"files"`
+	}{
+		Description: fmt.Sprintf("bootstrap failure on %s at step %s", platform.DashIfEmpty(res.Hostname), platform.DashIfEmpty(res.FailedStep)),
+		Files: map[string]gistFile{
+			"bootstrap.log": {Content: output},
+			"result.json":   {Content: result},
+		},
+	})
+	if err != nil {
+		return "", err
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, gistAPI, bytes.NewReader(body))
+	if err != nil {
+		return "", err
+	}
+	req.Header.Set("Accept", "application/vnd.github+json")
+	req.Header.Set("X-GitHub-Api-Version", "2022-11-28")
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("Authorization", "Bearer "+token)
+	resp, data, err := r.doUploadRequest(req)
+	if err != nil {
+		return "", fmt.Errorf("%s: %w", gistAPI, err)
+	}
+	if resp.StatusCode != http.StatusCreated {
+		return "", fmt.Errorf("%s returned HTTP %d", gistAPI, resp.StatusCode)
+	}
+	var gist struct {
+		HTMLURL string `json:"html_url"`
+	}
+	if err := json.Unmarshal(data, &gist); err != nil || gist.HTMLURL == "" {
+		return "", fmt.Errorf("%s returned no gist URL", gistAPI)
+	}
+	return gist.HTMLURL, nil
+}
+
+// uploadPaste POSTs the output and result as plain text to the paste
+// endpoint at target, with the token in UploadTokenEnv if it is set, and
+// returns the paste's URL: the response's Location, or else the first line
+// of its body.
+func (r *Reporter) uploadPaste(ctx context.Context, target, output, result string) (string, error) {
+	if err := r.sys.CheckOfflineURL(target, "the failure log paste"); err != nil {
+		return "", err
+	}
+	body := output + "\n--- result ---\n" + result
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, target, strings.NewReader(body))
+	if err != nil {
+		return "", errors.New("invalid URL")
+	}
+	req.Header.Set("Content-Type", "text/plain; charset=utf-8")
+	if token := strings.TrimSpace(os.Getenv(UploadTokenEnv)); token != "" {
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+	resp, data, err := r.doUploadRequest(req)
+	if err != nil {
+		return "", fmt.Errorf("%s: %w", platform.RedactURL(target), err)
+	}
+	if resp.StatusCode/100 != 2 {
+		return "", fmt.Errorf("%s returned HTTP %d", platform.RedactURL(target), resp.StatusCode)
+	}
+	if loc, err := resp.Location(); err == nil {
+		return loc.String(), nil
+	}
+	first, _, _ := strings.Cut(strings.TrimSpace(string(data)), "\n")
+	if u, err := url.Parse(strings.TrimSpace(first)); err == nil && (u.Scheme == "http" || u.Scheme == "https") {
+		return u.String(), nil
+	}
+	return "", fmt.Errorf("%s did not return the paste's URL", platform.RedactURL(target))
+}
+
+// doUploadRequest sends req and returns the response, its body already read
+// (up to uploadResponseMax) and closed.
+func (r *Reporter) doUploadRequest(req *http.Request) (*http.Response, []byte, error) {
+	resp, err := r.sys.SendNotifyRequest(req)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer resp.Body.Close()
+	data, err := io.ReadAll(io.LimitReader(resp.Body, uploadResponseMax))
+	if err != nil {
+		return nil, nil, err
+	}
+	return resp, data, nil
+}
@@ -0,0 +1,279 @@
+package secrets
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"crypto/tls"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/sparkleHazard/bootstrap/internal/platform"
+)
+
+// ssmTimeout bounds each request to the SSM API.
+const ssmTimeout = 30 * time.Second
+
+// awsCredentials are the temporary credentials of the instance's IAM role.
+type awsCredentials struct {
+	AccessKeyID     string    `json:"AccessKeyId"`
+	SecretAccessKey string    `json:"SecretAccessKey"`
+	Token           string    `json:"Token"`
+	Expiration      time.Time `json:"Expiration"`
+}
+
+// ssmSecret is a parameter in AWS Systems Manager Parameter Store, read
+// with the instance's IAM role and decrypted if it is a SecureString. A
+// Secrets Manager secret is read as the parameter
+// /aws/reference/secretsmanager/NAME.
+type ssmSecret struct {
+	name string
+}
+
+func (s ssmSecret) String() string { return "AWS SSM (" + s.name + ")" }
+
+func (s ssmSecret) read(ctx context.Context, store *Store) (string, error) {
+	return store.SSMParameter(ctx, s.name)
+}
+
+// imdsRequest sends an IMDSv2 request to the instance metadata service and
+// returns the response body and status.
+func (s *Store) imdsRequest(ctx context.Context, method, path, token string) ([]byte, int, error) {
+	req, err := http.NewRequestWithContext(ctx, method, platform.MetadataBase+path, nil)
+	if err != nil {
+		return nil, 0, err
+	}
+	if token == "" {
+		req.Header.Set("X-aws-ec2-metadata-token-ttl-seconds", "300")
+	} else {
+		req.Header.Set("X-aws-ec2-metadata-token", token)
+	}
+	resp, err := s.imdsClient.Do(req)
+	if err != nil {
+		return nil, 0, err
+	}
+	defer resp.Body.Close()
+	data, err := io.ReadAll(io.LimitReader(resp.Body, 64<<10))
+	return data, resp.StatusCode, err
+}
+
+// awsInstanceCredentials returns the region and the credentials of the
+// instance's IAM role from the instance metadata service, fetching them
+// again when they are about to expire. AWS_REGION, if set, overrides the
+// instance's region.
+func (s *Store) awsInstanceCredentials(ctx context.Context) (string, *awsCredentials, error) {
+	if c := s.awsSession.creds; c != nil && time.Until(c.Expiration) > 5*time.Minute {
+		return s.awsSession.region, c, nil
+	}
+	notEC2 := func(err error) error {
+		return fmt.Errorf("%w: the EC2 instance metadata service did not answer (%v); SSM parameters can only be read on EC2 with an instance role, and IMDSv2 must be enabled, with a hop limit of 2 inside a container", ErrSecretTool, err)
+	}
+	data, status, err := s.imdsRequest(ctx, http.MethodPut, "/latest/api/token", "")
+	if err != nil {
+		return "", nil, notEC2(err)
+	}
+	if status != http.StatusOK {
+		return "", nil, notEC2(fmt.Errorf("HTTP %d", status))
+	}
+	token := string(data)
+
+	region := os.Getenv("AWS_REGION")
+	if region == "" {
+		data, status, err := s.imdsRequest(ctx, http.MethodGet, "/latest/meta-data/placement/region", token)
+		if err != nil || status != http.StatusOK {
+			return "", nil, notEC2(fmt.Errorf("cannot read the instance's region: %s", httpFailure(status, err)))
+		}
+		region = strings.TrimSpace(string(data))
+	}
+
+	data, status, err = s.imdsRequest(ctx, http.MethodGet, "/latest/meta-data/iam/security-credentials/", token)
+	if status == http.StatusNotFound {
+		return "", nil, fmt.Errorf("%w: this instance has no IAM role; attach an instance profile that may read the parameter", ErrSecretAuth)
+	}
+	if err != nil || status != http.StatusOK {
+		return "", nil, notEC2(fmt.Errorf("cannot read the instance's IAM role: %s", httpFailure(status, err)))
+	}
+	role, _, _ := strings.Cut(strings.TrimSpace(string(data)), "\n")
+	data, status, err = s.imdsRequest(ctx, http.MethodGet, "/latest/meta-data/iam/security-credentials/"+role, token)
+	if err != nil || status != http.StatusOK {
+		return "", nil, fmt.Errorf("%w: cannot read the credentials of IAM role %s: %s", ErrSecretAuth, role, httpFailure(status, err))
+	}
+	var creds awsCredentials
+	if err := json.Unmarshal(data, &creds); err != nil || creds.AccessKeyID == "" {
+		return "", nil, fmt.Errorf("%w: the instance metadata service returned no credentials for IAM role %s", ErrSecretAuth, role)
+	}
+	s.sys.AddSecret(creds.SecretAccessKey, creds.Token)
+	s.awsSession.region, s.awsSession.creds = region, &creds
+	return region, &creds, nil
+}
+
+// httpFailure describes a request that failed with err or, if it did not,
+// returned status.
+func httpFailure(status int, err error) string {
+	if err != nil {
+		return err.Error()
+	}
+	return fmt.Sprintf("HTTP %d", status)
+}
+
+// SSMParameter reads the parameter name from SSM Parameter Store with the
+// instance's IAM role, decrypting a SecureString. Throttling and server
+// errors are retried.
+func (s *Store) SSMParameter(ctx context.Context, name string) (string, error) {
+	region, creds, err := s.awsInstanceCredentials(ctx)
+	if err != nil {
+		return "", err
+	}
+	host := "ssm." + region + ".amazonaws.com"
+	if strings.HasPrefix(region, "cn-") {
+		host += ".cn"
+	}
+	endpoint := "https://" + host + "/"
+	if err := s.sys.CheckOfflineURL(endpoint, "the SSM parameter"); err != nil {
+		return "", err
+	}
+	body, err := json.Marshal(map[string]any{"Name": name, "WithDecryption": true})
+	if err != nil {
+		return "", err
+	}
+	client := &http.Client{
+		Timeout: ssmTimeout,
+		Transport: &http.Transport{
+			Proxy:           http.ProxyFromEnvironment,
+			TLSClientConfig: &tls.Config{RootCAs: s.sys.RootCAs()},
+		},
+	}
+	var value string
+	err = s.sys.Retry(ctx, platform.NewRetryPolicy(s.cfg), "SSM GetParameter", func() error {
+		req, err := http.NewRequestWithContext(ctx, http.MethodPost, endpoint, bytes.NewReader(body))
+		if err != nil {
+			return platform.Permanent(err)
+		}
+		req.Header.Set("Content-Type", "application/x-amz-json-1.1")
+		req.Header.Set("X-Amz-Target", "AmazonSSM.GetParameter")
+		req.Header.Set("User-Agent", "bootstrap/"+platform.ToolVersion())
+		signAWSRequest(req, body, "ssm", region, creds, time.Now())
+		resp, err := client.Do(req)
+		if err != nil {
+			var ue *url.Error
+			if errors.As(err, &ue) {
+				err = ue.Err
+			}
+			return fmt.Errorf("SSM in %s: %w", region, err)
+		}
+		defer resp.Body.Close()
+		data, err := io.ReadAll(io.LimitReader(resp.Body, 1<<20))
+		if err != nil {
+			return err
+		}
+		if resp.StatusCode == http.StatusOK {
+			var out struct {
+				Parameter struct {
+					Value string `json:"Value"`
+				} `json:"Parameter"`
+			}
+			if err := json.Unmarshal(data, &out); err != nil {
+				return platform.Permanent(fmt.Errorf("SSM returned an unreadable response: %w", err))
+			}
+			value = out.Parameter.Value
+			return nil
+		}
+		var awsErr struct {
+			Type    string `json:"__type"`
+			Message string `json:"message"`
+		}
+		json.Unmarshal(data, &awsErr)
+		// __type may be qualified, as in com.amazonaws.ssm#ParameterNotFound.
+		code := awsErr.Type[strings.LastIndex(awsErr.Type, "#")+1:]
+		switch {
+		case code == "ParameterNotFound" || code == "ParameterVersionNotFound":
+			return platform.Permanent(fmt.Errorf("%w: SSM parameter %s does not exist in %s", ErrSecretNotFound, name, region))
+		case code == "AccessDeniedException" || code == "UnrecognizedClientException" || strings.HasPrefix(code, "InvalidSignature") || code == "ExpiredTokenException":
+			return platform.Permanent(fmt.Errorf("%w: the instance's IAM role may not read SSM parameter %s (%s): %s", ErrSecretAuth, name, code, awsErr.Message))
+		case code == "ThrottlingException" || resp.StatusCode >= 500:
+			return fmt.Errorf("SSM returned HTTP %d %s", resp.StatusCode, code)
+		case code == "InvalidKeyId" || code == "KMSAccessDeniedException":
+			return platform.Permanent(fmt.Errorf("%w: SSM parameter %s cannot be decrypted with its KMS key (%s): %s", ErrSecretAuth, name, code, awsErr.Message))
+		}
+		return platform.Permanent(fmt.Errorf("SSM GetParameter %s failed: HTTP %d %s: %s", name, resp.StatusCode, code, awsErr.Message))
+	})
+	return value, err
+}
+
+// signAWSRequest signs req, whose body is body, for service in region with
+// AWS Signature Version 4, as of now.
+func signAWSRequest(req *http.Request, body []byte, service, region string, creds *awsCredentials, now time.Time) {
+	amzDate := now.UTC().Format("20060102T150405Z")
+	date := amzDate[:8]
+	req.Header.Set("X-Amz-Date", amzDate)
+	if creds.Token != "" {
+		req.Header.Set("X-Amz-Security-Token", creds.Token)
+	}
+
+	headers := map[string]string{"host": req.URL.Host}
+	for name, values := range req.Header {
+		lower := strings.ToLower(name)
+		if lower == "content-type" || lower == "host" || strings.HasPrefix(lower, "x-amz-") {
+			headers[lower] = strings.TrimSpace(strings.Join(values, ","))
+		}
+	}
+	names := make([]string, 0, len(headers))
+	for name := range headers {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	var canonicalHeaders strings.Builder
+	for _, name := range names {
+		canonicalHeaders.WriteString(name + ":" + headers[name] + "\n")
+	}
+	signedHeaders := strings.Join(names, ";")
+
+	path := req.URL.EscapedPath()
+	if path == "" {
+		path = "/"
+	}
+	bodySum := sha256.Sum256(body)
+	canonical := strings.Join([]string{
+		req.Method,
+		path,
+		req.URL.RawQuery,
+		canonicalHeaders.String(),
+		signedHeaders,
+		hex.EncodeToString(bodySum[:]),
+	}, "\n")
+
+	scope := date + "/" + region + "/" + service + "/aws4_request"
+	canonicalSum := sha256.Sum256([]byte(canonical))
+	toSign := "AWS4-HMAC-SHA256\n" + amzDate + "\n" + scope + "\n" + hex.EncodeToString(canonicalSum[:])
+
+	key := []byte("AWS4" + creds.SecretAccessKey)
+	for _, part := range []string{date, region, service, "aws4_request"} {
+		key = hmacSHA256(key, part)
+	}
+	signature := hex.EncodeToString(hmacSHA256(key, toSign))
+	req.Header.Set("Authorization", fmt.Sprintf("AWS4-HMAC-SHA256 Credential=%s/%s, SignedHeaders=%s, Signature=%s",
+		creds.AccessKeyID, scope, signedHeaders, signature))
+}
+
+func hmacSHA256(key []byte, data string) []byte {
+	h := hmac.New(sha256.New, key)
+	h.Write([]byte(data))
+	return h.Sum(nil)
+}
+
+// awsSession is what a run learned from the instance metadata service,
+// shared by every SSM read and held only in memory.
+type awsSession struct {
+	region string
+	creds  *awsCredentials
+}
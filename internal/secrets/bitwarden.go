@@ -0,0 +1,89 @@
+package secrets
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"os/exec"
+	"strings"
+
+	"github.com/sparkleHazard/bootstrap/internal/platform"
+)
+
+// bwSecret is the password of a Bitwarden (or Vaultwarden) item, read with
+// the bw CLI by the item's id or name. bw must be logged in, and either
+// unlocked with BW_SESSION or given the master password in
+// --bw-password-file.
+type bwSecret struct {
+	item string
+}
+
+func (s bwSecret) String() string { return "Bitwarden (" + s.item + ")" }
+
+func (s bwSecret) read(ctx context.Context, store *Store) (string, error) {
+	if _, err := exec.LookPath("bw"); err != nil {
+		return "", fmt.Errorf("%w: the Bitwarden CLI (bw) is not installed", ErrSecretTool)
+	}
+	session, err := store.bwUnlock(ctx)
+	if err != nil {
+		return "", err
+	}
+	out, stderr, err := store.secretCommandOutput(ctx, []string{"BW_SESSION=" + session}, "bw", "get", "password", s.item, "--nointeraction")
+	if err != nil {
+		msg := platform.LastLine(stderr, err)
+		switch {
+		case strings.Contains(msg, "Not found"):
+			return "", fmt.Errorf("%w: Bitwarden has no item %q, or it has no password", ErrSecretNotFound, s.item)
+		case strings.Contains(msg, "More than one result"):
+			return "", fmt.Errorf("%q matches more than one Bitwarden item; give the item's id instead", s.item)
+		case strings.Contains(strings.ToLower(msg), "locked"):
+			return "", fmt.Errorf("%w: the Bitwarden vault is locked: %s", ErrSecretAuth, msg)
+		}
+		return "", fmt.Errorf("bw get password %s failed: %s", s.item, msg)
+	}
+	return strings.TrimRight(string(out), "\r\n"), nil
+}
+
+// bwUnlock returns the session to read Bitwarden secrets with, unlocking
+// the vault with --bw-password-file if it is locked.
+func (s *Store) bwUnlock(ctx context.Context) (string, error) {
+	if s.bwSession != "" {
+		return s.bwSession, nil
+	}
+	session := os.Getenv("BW_SESSION")
+	out, stderr, err := s.secretCommandOutput(ctx, nil, "bw", "status", "--nointeraction")
+	if err != nil {
+		return "", fmt.Errorf("bw status failed: %s", platform.LastLine(stderr, err))
+	}
+	var status struct {
+		Status string `json:"status"`
+	}
+	if err := json.Unmarshal(out, &status); err != nil {
+		return "", fmt.Errorf("bw status: %w", err)
+	}
+	switch status.Status {
+	case "unlocked":
+	case "unauthenticated":
+		return "", fmt.Errorf("%w: bw is not logged in; run bw login, or bw login --apikey with BW_CLIENTID and BW_CLIENTSECRET set", ErrSecretAuth)
+	case "locked":
+		if s.cfg.BwPasswordFile == "" {
+			if session != "" {
+				return "", fmt.Errorf("%w: the Bitwarden vault is locked although BW_SESSION is set; the session may have expired, so set it again from bw unlock --raw", ErrSecretAuth)
+			}
+			return "", fmt.Errorf("%w: the Bitwarden vault is locked; set BW_SESSION from bw unlock --raw, or pass bw-password-file", ErrSecretAuth)
+		}
+		out, stderr, err := s.secretCommandOutput(ctx, nil, "bw", "unlock", "--passwordfile", s.cfg.BwPasswordFile, "--raw", "--nointeraction")
+		if err != nil {
+			return "", fmt.Errorf("%w: unlocking the Bitwarden vault with %s failed: %s", ErrSecretAuth, s.cfg.BwPasswordFile, platform.LastLine(stderr, err))
+		}
+		session = strings.TrimSpace(string(out))
+	default:
+		return "", fmt.Errorf("bw status reported %q", status.Status)
+	}
+	if session != "" {
+		s.sys.AddSecret(session)
+	}
+	s.bwSession = session
+	return session, nil
+}
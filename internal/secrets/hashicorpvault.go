@@ -0,0 +1,260 @@
+package secrets
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/sparkleHazard/bootstrap/internal/platform"
+)
+
+// ErrVaultAuth is wrapped by the error a read from HashiCorp Vault returns
+// when Vault rejected the AppRole login or the token.
+var ErrVaultAuth = errors.New("HashiCorp Vault authentication failed")
+
+// vaultTimeout bounds each request to HashiCorp Vault.
+const vaultTimeout = 30 * time.Second
+
+// vaultRenewBefore is how long before its lease ends the token is renewed.
+const vaultRenewBefore = time.Minute
+
+// vaultDefaultField is the field of the KV secret read when a
+// --vault-pass-hashicorp or --github-token-hashicorp path names none.
+const vaultDefaultField = "value"
+
+// vaultSecret is a field of a KV secret in HashiCorp Vault, read over the
+// HTTP API with a token from VAULT_TOKEN or an AppRole login. ref is the
+// secret's API path, with the field after a '#': secret/data/ansible#vault
+// for KV version 2, or secret/ansible#vault for version 1. flag is the
+// setting that named it, which errors refer to instead of the path.
+type vaultSecret struct {
+	flag, ref string
+}
+
+// String leaves out the path, which often says what the secret is for.
+func (s vaultSecret) String() string { return "HashiCorp Vault" }
+
+func (s vaultSecret) read(ctx context.Context, store *Store) (string, error) {
+	addr := store.cfg.EffectiveVaultAddr()
+	if addr == "" {
+		return "", fmt.Errorf("%w: %s needs vault-addr or VAULT_ADDR", ErrSecretTool, s.flag)
+	}
+	if err := store.sys.CheckOfflineURL(addr, "the "+s.flag+" secret"); err != nil {
+		return "", err
+	}
+	path, field, _ := strings.Cut(s.ref, "#")
+	if field == "" {
+		field = vaultDefaultField
+	}
+	token, err := store.vaultToken(ctx, addr)
+	if err != nil {
+		return "", err
+	}
+	var resp struct {
+		Data map[string]any `json:"data"`
+	}
+	if err := store.vaultRequest(ctx, addr, http.MethodGet, "/v1/"+strings.TrimPrefix(path, "/"), token, nil, &resp); err != nil {
+		if errors.Is(err, ErrSecretNotFound) {
+			return "", fmt.Errorf("%w: the secret %s names does not exist, or is deleted", ErrSecretNotFound, s.flag)
+		}
+		return "", err
+	}
+	data := resp.Data
+	// A KV version 2 secret has its fields under data.data, beside
+	// data.metadata.
+	if inner, ok := data["data"].(map[string]any); ok && data["metadata"] != nil {
+		data = inner
+	}
+	value, ok := data[field].(string)
+	if !ok {
+		return "", fmt.Errorf("%w: the secret %s names has no string field %q", ErrSecretNotFound, s.flag, field)
+	}
+	return value, nil
+}
+
+// vaultToken returns the token to read secrets with: the one this run
+// already has, renewed if its lease is about to end, or else one from an
+// AppRole login with vault-role-id and vault-secret-id, or else
+// VAULT_TOKEN.
+func (s *Store) vaultToken(ctx context.Context, addr string) (string, error) {
+	if s.vaultSession.token != "" {
+		if s.vaultSession.expires.IsZero() || time.Until(s.vaultSession.expires) > vaultRenewBefore {
+			return s.vaultSession.token, nil
+		}
+		if s.vaultSession.renewable {
+			if err := s.vaultRenewToken(ctx, addr); err == nil {
+				return s.vaultSession.token, nil
+			} else if s.cfg.Verbose {
+				s.sys.Log("Renewing the HashiCorp Vault token failed: " + err.Error())
+			}
+		}
+		s.vaultSession.token = ""
+	}
+	if s.cfg.VaultRoleID != "" {
+		if err := s.vaultLogin(ctx, addr); err != nil {
+			return "", err
+		}
+		return s.vaultSession.token, nil
+	}
+	token := os.Getenv("VAULT_TOKEN")
+	if token == "" {
+		return "", fmt.Errorf("%w: no credentials; set vault-role-id and vault-secret-id for an AppRole login, or VAULT_TOKEN", ErrVaultAuth)
+	}
+	s.sys.AddSecret(token)
+	s.vaultSession.token, s.vaultSession.expires, s.vaultSession.renewable = token, time.Time{}, false
+	return token, nil
+}
+
+// vaultAuth is the auth part of a response to a login or renewal.
+type vaultAuth struct {
+	ClientToken   string `json:"client_token"`
+	LeaseDuration int    `json:"lease_duration"`
+	Renewable     bool   `json:"renewable"`
+}
+
+// setVaultSession makes auth the token of this run.
+func (s *Store) setVaultSession(auth vaultAuth) {
+	s.sys.AddSecret(auth.ClientToken)
+	s.vaultSession.token = auth.ClientToken
+	s.vaultSession.renewable = auth.Renewable
+	s.vaultSession.expires = time.Time{}
+	if auth.LeaseDuration > 0 {
+		s.vaultSession.expires = time.Now().Add(time.Duration(auth.LeaseDuration) * time.Second)
+	}
+}
+
+// vaultLogin logs in to HashiCorp Vault with AppRole.
+func (s *Store) vaultLogin(ctx context.Context, addr string) error {
+	if s.cfg.VaultSecretID != "" {
+		s.sys.AddSecret(s.cfg.VaultSecretID)
+	}
+	body := map[string]string{"role_id": s.cfg.VaultRoleID, "secret_id": s.cfg.VaultSecretID}
+	var resp struct {
+		Auth vaultAuth `json:"auth"`
+	}
+	if err := s.vaultRequest(ctx, addr, http.MethodPost, "/v1/auth/approle/login", "", body, &resp); err != nil {
+		if errors.Is(err, ErrSecretNotFound) {
+			return fmt.Errorf("%w: AppRole auth is not enabled at auth/approle", ErrVaultAuth)
+		}
+		return err
+	}
+	if resp.Auth.ClientToken == "" {
+		return fmt.Errorf("%w: the AppRole login returned no token", ErrVaultAuth)
+	}
+	s.setVaultSession(resp.Auth)
+	if s.cfg.Verbose {
+		s.sys.Log("Logged in to HashiCorp Vault with AppRole.")
+	}
+	return nil
+}
+
+// vaultRenewToken renews the token of this run.
+func (s *Store) vaultRenewToken(ctx context.Context, addr string) error {
+	var resp struct {
+		Auth vaultAuth `json:"auth"`
+	}
+	if err := s.vaultRequest(ctx, addr, http.MethodPost, "/v1/auth/token/renew-self", s.vaultSession.token, map[string]string{}, &resp); err != nil {
+		return err
+	}
+	if resp.Auth.ClientToken == "" {
+		resp.Auth.ClientToken = s.vaultSession.token
+	}
+	s.setVaultSession(resp.Auth)
+	return nil
+}
+
+// vaultRequest sends a request to the HashiCorp Vault API at addr, with
+// body, if any, as JSON, and decodes the JSON response into out. Network
+// failures and server errors are retried; Vault rejecting the request is
+// not. 403, and 400 to a login (without token), wrap ErrVaultAuth, and 404
+// ErrSecretNotFound.
+func (s *Store) vaultRequest(ctx context.Context, addr, method, path, token string, body, out any) error {
+	var payload []byte
+	if body != nil {
+		var err error
+		if payload, err = json.Marshal(body); err != nil {
+			return err
+		}
+	}
+	client := &http.Client{
+		Timeout: vaultTimeout,
+		Transport: &http.Transport{
+			Proxy:           http.ProxyFromEnvironment,
+			TLSClientConfig: &tls.Config{RootCAs: s.sys.RootCAs()},
+		},
+	}
+	return s.sys.Retry(ctx, platform.NewRetryPolicy(s.cfg), "HashiCorp Vault request", func() error {
+		req, err := http.NewRequestWithContext(ctx, method, addr+path, bytes.NewReader(payload))
+		if err != nil {
+			return platform.Permanent(err)
+		}
+		req.Header.Set("User-Agent", "bootstrap/"+platform.ToolVersion())
+		if payload != nil {
+			req.Header.Set("Content-Type", "application/json")
+		}
+		if token != "" {
+			req.Header.Set("X-Vault-Token", token)
+		}
+		if ns := os.Getenv("VAULT_NAMESPACE"); ns != "" {
+			req.Header.Set("X-Vault-Namespace", ns)
+		}
+		resp, err := client.Do(req)
+		if err != nil {
+			// The URL is left out: it is the secret's path.
+			var ue *url.Error
+			if errors.As(err, &ue) {
+				err = ue.Err
+			}
+			return fmt.Errorf("HashiCorp Vault at %s: %w", platform.RedactURL(addr), err)
+		}
+		defer resp.Body.Close()
+		data, err := io.ReadAll(io.LimitReader(resp.Body, 1<<20))
+		if err != nil {
+			return err
+		}
+		switch {
+		case resp.StatusCode == http.StatusOK:
+			if err := json.Unmarshal(data, out); err != nil {
+				return platform.Permanent(fmt.Errorf("HashiCorp Vault returned an unreadable response: %w", err))
+			}
+			return nil
+		case resp.StatusCode == http.StatusForbidden, resp.StatusCode == http.StatusBadRequest && token == "":
+			return platform.Permanent(fmt.Errorf("%w (HTTP %d): %s", ErrVaultAuth, resp.StatusCode, vaultErrors(data)))
+		case resp.StatusCode == http.StatusNotFound:
+			return platform.Permanent(ErrSecretNotFound)
+		case resp.StatusCode >= 500 || resp.StatusCode == http.StatusTooManyRequests:
+			return fmt.Errorf("HashiCorp Vault returned HTTP %d: %s", resp.StatusCode, vaultErrors(data))
+		default:
+			return platform.Permanent(fmt.Errorf("HashiCorp Vault returned HTTP %d: %s", resp.StatusCode, vaultErrors(data)))
+		}
+	})
+}
+
+// vaultErrors returns the messages of a Vault error response.
+func vaultErrors(data []byte) string {
+	var resp struct {
+		Errors []string `json:"errors"`
+	}
+	if json.Unmarshal(data, &resp) != nil || len(resp.Errors) == 0 {
+		return "no details"
+	}
+	return strings.Join(resp.Errors, "; ")
+}
+
+// vaultSession is the token a run authenticates to HashiCorp Vault with,
+// shared by every vaultSecret and held only in memory. expires is zero for
+// a token whose lease is unknown, such as one from VAULT_TOKEN.
+type vaultSession struct {
+	token     string
+	expires   time.Time
+	renewable bool
+}
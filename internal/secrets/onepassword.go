@@ -0,0 +1,38 @@
+package secrets
+
+import (
+	"context"
+	"fmt"
+	"os/exec"
+	"strings"
+
+	"github.com/sparkleHazard/bootstrap/internal/platform"
+)
+
+// opSecret is a secret in 1Password, read with the op CLI by its secret
+// reference (op://vault/item/field). op is signed in either through the
+// desktop app or a session, or with a service account token in
+// OP_SERVICE_ACCOUNT_TOKEN.
+type opSecret struct {
+	ref string
+}
+
+func (s opSecret) String() string { return "1Password (" + s.ref + ")" }
+
+func (s opSecret) read(ctx context.Context, store *Store) (string, error) {
+	if _, err := exec.LookPath("op"); err != nil {
+		return "", fmt.Errorf("%w: the 1Password CLI (op) is not installed; install it, or use vault-pass-file", ErrSecretTool)
+	}
+	if _, stderr, err := store.secretCommandOutput(ctx, nil, "op", "whoami"); err != nil {
+		return "", fmt.Errorf("%w: op is not signed in (%s); set OP_SERVICE_ACCOUNT_TOKEN to a service account token, or run eval $(op signin)", ErrSecretAuth, platform.LastLine(stderr, err))
+	}
+	out, stderr, err := store.secretCommandOutput(ctx, nil, "op", "read", "--no-newline", s.ref)
+	if err != nil {
+		msg := platform.LastLine(stderr, err)
+		if strings.Contains(strings.ToLower(msg), "not found") || strings.Contains(msg, "isn't") {
+			return "", fmt.Errorf("%w: 1Password has no %s, or this account cannot see it: %s", ErrSecretNotFound, s.ref, msg)
+		}
+		return "", fmt.Errorf("op read %s failed: %s", s.ref, msg)
+	}
+	return string(out), nil
+}
@@ -0,0 +1,58 @@
+package secrets
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os/exec"
+	"strings"
+	"time"
+
+	"github.com/sparkleHazard/bootstrap/internal/platform"
+)
+
+// passTimeout bounds pass and gopass in a run that cannot answer a pinentry
+// prompt, in case gpg waits for a passphrase all the same.
+const passTimeout = 30 * time.Second
+
+// passSecret is the first line of an entry in a password store, read with
+// pass, or gopass if pass is not installed.
+type passSecret struct {
+	entry string
+}
+
+func (s passSecret) String() string { return "pass (" + s.entry + ")" }
+
+func (s passSecret) read(ctx context.Context, store *Store) (string, error) {
+	tool := "pass"
+	if _, err := exec.LookPath(tool); err != nil {
+		tool = "gopass"
+		if _, err := exec.LookPath(tool); err != nil {
+			return "", fmt.Errorf("%w: neither pass nor gopass is installed", ErrSecretTool)
+		}
+	}
+	var env []string
+	if !platform.StdinIsTerminal() {
+		// Nobody can answer pinentry: gpg fails at once unless gpg-agent
+		// has the passphrase cached.
+		env = append(env, "PASSWORD_STORE_GPG_OPTS=--batch --pinentry-mode=error")
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, passTimeout)
+		defer cancel()
+	}
+	out, stderr, err := store.secretCommandOutput(ctx, env, tool, "show", s.entry)
+	if err != nil {
+		msg := platform.LastLine(stderr, err)
+		switch {
+		case errors.Is(ctx.Err(), context.DeadlineExceeded):
+			return "", fmt.Errorf("%w: %s show %s did not finish within %s, probably waiting for the GPG passphrase; cache it in gpg-agent before a non-interactive run", ErrSecretAuth, tool, s.entry, passTimeout)
+		case strings.Contains(msg, "not in the password store"):
+			return "", fmt.Errorf("%w: the password store has no entry %s", ErrSecretNotFound, s.entry)
+		case strings.Contains(msg, "decryption failed") || strings.Contains(msg, "No secret key") || strings.Contains(strings.ToLower(msg), "pinentry"):
+			return "", fmt.Errorf("%w: gpg cannot decrypt %s without its passphrase (%s); cache it in gpg-agent, e.g. with gpg-preset-passphrase, before a non-interactive run", ErrSecretAuth, s.entry, msg)
+		}
+		return "", fmt.Errorf("%s show %s failed: %s", tool, s.entry, msg)
+	}
+	line, _, _ := strings.Cut(string(out), "\n")
+	return strings.TrimRight(line, "\r"), nil
+}
@@ -0,0 +1,265 @@
+// Package secrets reads the vault password and tokens a run needs from
+// the secret sources: files, the environment, password managers, AWS SSM
+// and HashiCorp Vault.
+package secrets
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/sparkleHazard/bootstrap/internal/config"
+	"github.com/sparkleHazard/bootstrap/internal/platform"
+)
+
+// Errors wrapped by a secretSource's read, so that each kind of failure
+// gets its own message and error category.
+var (
+	// ErrSecretTool means the source's command-line tool is not installed.
+	ErrSecretTool = errors.New("secret manager CLI not available")
+	// ErrSecretAuth means the tool is not signed in, or its credentials
+	// were rejected.
+	ErrSecretAuth = errors.New("secret manager authentication failed")
+	// ErrSecretNotFound means the named secret does not exist.
+	ErrSecretNotFound = errors.New("secret not found")
+)
+
+// secretSource is a secret manager that a secret is read from at run
+// time, instead of from a file in the home directory.
+type secretSource interface {
+	// String names the source and the secret in it, for logs and the
+	// step status. It never includes the secret.
+	String() string
+
+	// read returns the secret, signing in to the secret manager with
+	// store's session when it needs one.
+	read(ctx context.Context, store *Store) (string, error)
+}
+
+// vaultPassEnv passes the vault password read from a secret source to the
+// password client script ansible-pull runs; it is only set while
+// ansible-pull runs.
+const vaultPassEnv = "BOOTSTRAP_VAULT_PASSWORD"
+
+// vaultPassClient is the --vault-password-file script given to ansible-pull
+// when the vault password comes from a secret source, so that the password
+// is never written to disk.
+const vaultPassClient = "#!/bin/sh\nprintf '%s\\n' \"$" + vaultPassEnv + "\"\n"
+
+// secretCommandOutput runs a secret manager's CLI with args, and extra
+// environment variables env, and returns its standard output and error. Its
+// stdin is /dev/null, so that it fails rather than prompts. Unlike other
+// commands it is left out of the transcript, since its output is a secret.
+func (s *Store) secretCommandOutput(ctx context.Context, env []string, name string, args ...string) ([]byte, []byte, error) {
+	cmd := s.sys.NewCommand(ctx, name, args...)
+	if env != nil {
+		cmd.Env = append(os.Environ(), env...)
+	}
+	var stdout, stderr bytes.Buffer
+	cmd.Stdout, cmd.Stderr = &stdout, &stderr
+	err := cmd.Cmd.Run()
+	return stdout.Bytes(), stderr.Bytes(), err
+}
+
+// Option is a setting naming a secret in one secret manager. A new
+// backend implements secretSource and adds its settings to
+// VaultPassOptions and GithubTokenOptions.
+type Option struct {
+	Flag   string
+	Value  string
+	source func(name string) secretSource
+}
+
+// VaultPassOptions are the settings that read the vault password from a
+// secret manager instead of vault-pass-file.
+func VaultPassOptions(c *config.Config) []Option {
+	return []Option{
+		{"vault-pass-op", c.VaultPassOp, func(ref string) secretSource { return opSecret{ref: ref} }},
+		{"vault-pass-bw", c.VaultPassBw, func(item string) secretSource { return bwSecret{item: item} }},
+		{"vault-pass-pass", c.VaultPassPass, func(entry string) secretSource { return passSecret{entry: entry} }},
+		{"vault-pass-ssm", c.VaultPassSSM, func(name string) secretSource { return ssmSecret{name: name} }},
+		{"vault-pass-hashicorp", c.VaultPassHashicorp, func(ref string) secretSource { return vaultSecret{flag: "vault-pass-hashicorp", ref: ref} }},
+	}
+}
+
+// GithubTokenOptions are the settings that read the GitHub token the
+// keyserver role authenticates gh with from a secret manager.
+func GithubTokenOptions(c *config.Config) []Option {
+	return []Option{
+		{"github-token-bw", c.GithubTokenBw, func(item string) secretSource { return bwSecret{item: item} }},
+		{"github-token-pass", c.GithubTokenPass, func(entry string) secretSource { return passSecret{entry: entry} }},
+		{"github-token-hashicorp", c.GithubTokenHashicorp, func(ref string) secretSource { return vaultSecret{flag: "github-token-hashicorp", ref: ref} }},
+	}
+}
+
+// selectedSecret returns the source of the option that is set, or nil if
+// none is. ValidateSecretOptions makes sure there is at most one.
+func selectedSecret(opts []Option) secretSource {
+	for _, o := range opts {
+		if o.Value != "" {
+			return o.source(o.Value)
+		}
+	}
+	return nil
+}
+
+// ValidateSecretOptions reports more than one of opts being set.
+func ValidateSecretOptions(opts []Option) error {
+	var set []string
+	for _, o := range opts {
+		if o.Value != "" {
+			set = append(set, o.Flag)
+		}
+	}
+	if len(set) > 1 {
+		return fmt.Errorf("%s are mutually exclusive", strings.Join(set, " and "))
+	}
+	return nil
+}
+
+// VaultPassSource returns the source of the vault password: a systemd
+// credential if the run has one, else the secret manager configured, or
+// nil when it is read from vault-pass-file.
+func VaultPassSource(c *config.Config) secretSource {
+	if src := systemdCredential(c.CredentialVaultPass); src != nil {
+		return src
+	}
+	return selectedSecret(VaultPassOptions(c))
+}
+
+// GithubTokenSource returns the source of the GitHub token the keyserver
+// role authenticates gh with, like VaultPassSource, or nil when gh is
+// already signed in or the token is asked for.
+func GithubTokenSource(c *config.Config) secretSource {
+	if src := systemdCredential(c.CredentialGithubToken); src != nil {
+		return src
+	}
+	return selectedSecret(GithubTokenOptions(c))
+}
+
+// ReadSecret reads what, such as "the vault password", from src. The
+// secret is remembered for redaction, and never logged.
+func (s *Store) ReadSecret(ctx context.Context, what string, src secretSource) (string, error) {
+	s.sys.Log("Reading " + what + " from " + src.String() + "...")
+	secret, err := src.read(ctx, s)
+	if err != nil {
+		return "", fmt.Errorf("reading %s from %s: %w", what, src, err)
+	}
+	if secret == "" {
+		return "", fmt.Errorf("reading %s from %s: %w: it is empty", what, src, ErrSecretNotFound)
+	}
+	s.sys.AddSecret(secret)
+	return secret, nil
+}
+
+// ReadVaultPassword reads the vault password from the configured secret
+// source into VaultPassword, and returns the source's name for the
+// vault-pass step.
+func (s *Store) ReadVaultPassword(ctx context.Context) (string, error) {
+	src := VaultPassSource(s.cfg)
+	secret, err := s.ReadSecret(ctx, "the vault password", src)
+	if err != nil {
+		return "", err
+	}
+	s.VaultPassword = secret
+	return src.String(), nil
+}
+
+// VaultPasswordFile returns the --vault-password-file for ansible-pull: the
+// vault-pass-file in the home directory or, when the password came from a
+// secret source, a password client script in the run's work directory that
+// prints it from the environment. The returned function undoes what is
+// needed for the latter once ansible-pull has finished.
+func (s *Store) VaultPasswordFile(ctx context.Context, homeDir string) (string, func(), error) {
+	if s.VaultPassword == "" {
+		return filepath.Join(homeDir, s.cfg.VaultPassFile), func() {}, nil
+	}
+	dir, err := s.sys.RunWorkDir()
+	if err != nil {
+		return "", nil, err
+	}
+	script := filepath.Join(dir, "vault-pass-client")
+	if _, err := s.sys.WriteFile(ctx, script, []byte(vaultPassClient), 0700, ""); err != nil {
+		return "", nil, err
+	}
+	os.Setenv(vaultPassEnv, s.VaultPassword)
+	return script, func() {
+		os.Unsetenv(vaultPassEnv)
+		os.Remove(script)
+	}, nil
+}
+
+// credentialSecret is a credential systemd passed to this process in
+// $CREDENTIALS_DIRECTORY, with LoadCredential=, LoadCredentialEncrypted=
+// or SetCredential=.
+type credentialSecret struct {
+	name, path string
+}
+
+func (s credentialSecret) String() string { return "systemd credential " + s.name }
+
+func (s credentialSecret) read(ctx context.Context, store *Store) (string, error) {
+	data, err := os.ReadFile(s.path)
+	if err != nil {
+		return "", err
+	}
+	return strings.TrimRight(string(data), "\r\n"), nil
+}
+
+// systemdCredential returns the credential called name if systemd passed
+// this process one, or nil. Outside a unit, or where systemd is too old to
+// pass credentials, there is no $CREDENTIALS_DIRECTORY and the other
+// sources are used.
+func systemdCredential(name string) secretSource {
+	dir := os.Getenv("CREDENTIALS_DIRECTORY")
+	if dir == "" || name == "" {
+		return nil
+	}
+	path := filepath.Join(dir, name)
+	if !platform.FileExists(path) {
+		return nil
+	}
+	return credentialSecret{name: name, path: path}
+}
+
+// Store reads the run's secrets from the secret managers, signing in
+// to each at most once.
+type Store struct {
+	cfg *config.Config
+	sys *platform.System
+
+	// bwSession is the Bitwarden session the run reads secrets with:
+	// BW_SESSION or the one bwUnlock got with --bw-password-file, so that
+	// the vault is unlocked once for all of them.
+	bwSession string
+
+	awsSession   awsSession
+	vaultSession vaultSession
+
+	// VaultPassword is the vault password read from the configured secret
+	// source by ReadVaultPassword, held only in memory.
+	VaultPassword string
+
+	// imdsClient is the HTTP client for the instance metadata service.
+	// Outside EC2 nothing answers, and requests fail after platform.MetadataTimeout
+	// instead of hanging.
+	imdsClient *http.Client
+}
+
+// NewStore returns the secret store of a run on sys.
+func NewStore(sys *platform.System) *Store {
+	return &Store{
+		cfg: sys.Config,
+		sys: sys,
+		imdsClient: &http.Client{
+			Timeout: platform.MetadataTimeout,
+			// The metadata service is link-local; a proxy cannot reach it.
+			Transport: &http.Transport{Proxy: nil},
+		},
+	}
+}
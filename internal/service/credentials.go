@@ -0,0 +1,118 @@
+package service
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/sparkleHazard/bootstrap/internal/platform"
+)
+
+// credentialsDirName is the directory in the state directory holding the
+// credentials StoreRerunCredentials encrypts for the rerun unit.
+const credentialsDirName = "credentials"
+
+// systemdSupportsCredentials reports whether the installed systemd has
+// systemd-creds and LoadCredentialEncrypted=, added in systemd 250.
+func (m *Manager) systemdSupportsCredentials(ctx context.Context) bool {
+	out, err := m.sys.CmdOutput(ctx, "systemctl", "--version")
+	if err != nil {
+		return false
+	}
+	// The first line looks like "systemd 252 (252.22-1~deb12u1)".
+	fields := strings.Fields(string(out))
+	return len(fields) >= 2 && platform.VersionAtLeast(fields[1], []int{250})
+}
+
+// rerunCredentials returns the credentials stored for the rerun unit, by
+// name, as LoadCredentialEncrypted= lines.
+func (m *Manager) rerunCredentials(dir string) string {
+	var b strings.Builder
+	for _, name := range []string{m.cfg.CredentialVaultPass, m.cfg.CredentialGithubToken} {
+		path := filepath.Join(dir, credentialsDirName, name+".cred")
+		if name != "" && platform.FileExists(path) {
+			fmt.Fprintf(&b, "LoadCredentialEncrypted=%s:%s\n", name, path)
+		}
+	}
+	return b.String()
+}
+
+// StoreRerunCredentials encrypts the vault password and, on the keyserver
+// role, the GitHub token of this run with systemd-creds into the state
+// directory, where the rerun unit and the drift service load them from, and
+// reinstalls them to do so. The secrets go to systemd-creds on its stdin and are never
+// written in the clear. It returns the credentials step's status.
+func (m *Manager) StoreRerunCredentials(ctx context.Context) (string, error) {
+	if m.sys.Host.EUID() != 0 {
+		m.sys.Log("Not storing credentials for the rerun unit: systemd-creds needs root.")
+		return "skipped", nil
+	}
+	if !m.systemdSupportsCredentials(ctx) {
+		m.sys.Log("systemd is older than 250; the rerun unit reads the vault password from its usual source.")
+		return "unsupported", nil
+	}
+	vaultPass := m.secrets.VaultPassword
+	if homeDir, err := m.sys.Host.HomeDir(); err == nil && vaultPass == "" {
+		if data, err := os.ReadFile(filepath.Join(homeDir, m.cfg.VaultPassFile)); err == nil {
+			vaultPass = strings.TrimRight(string(data), "\r\n")
+		}
+	}
+	token := ""
+	if m.cfg.Role == "keyserver" {
+		token = os.Getenv("GH_TOKEN")
+	}
+	secrets := map[string]string{}
+	for name, secret := range map[string]string{
+		m.cfg.CredentialVaultPass:   vaultPass,
+		m.cfg.CredentialGithubToken: token,
+	} {
+		if name != "" && secret != "" {
+			secrets[name] = secret
+		}
+	}
+	if len(secrets) == 0 {
+		return "skipped", nil
+	}
+	dir, err := m.sys.StateDir()
+	if err != nil {
+		return "", err
+	}
+	credDir := filepath.Join(dir, credentialsDirName)
+	if err := os.MkdirAll(credDir, 0700); err != nil {
+		return "", err
+	}
+	for name, secret := range secrets {
+		path := filepath.Join(credDir, name+".cred")
+		cmd := m.sys.NewCommand(ctx, "systemd-creds", "encrypt", "--name="+name, "-", path+".new")
+		cmd.Stdin = strings.NewReader(secret + "\n")
+		if out, err := cmd.CombinedOutput(); err != nil {
+			os.Remove(path + ".new")
+			return "", fmt.Errorf("systemd-creds encrypt %s failed: %s", name, platform.LastLine(out, err))
+		}
+		if err := os.Rename(path+".new", path); err != nil {
+			return "", err
+		}
+	}
+	bin := m.InstalledBinary()
+	if bin == "" {
+		return "", errors.New("the binary --install-self installed is gone")
+	}
+	var units []string
+	if m.cfg.InstallRerunUnit {
+		if err := m.installRerunUnit(ctx, bin, dir); err != nil {
+			return "", err
+		}
+		units = append(units, filepath.Base(RerunUnitPath))
+	}
+	if m.cfg.DriftTimer != "" {
+		if err := m.installDriftTimer(ctx, bin, dir); err != nil {
+			return "", err
+		}
+		units = append(units, filepath.Base(DriftServicePath))
+	}
+	m.sys.Log(fmt.Sprintf("Stored %d credential(s) for %s in %s.", len(secrets), strings.Join(units, " and "), credDir))
+	return "stored", nil
+}
@@ -0,0 +1,145 @@
+package service
+
+import (
+	"context"
+	"fmt"
+	"os/exec"
+	"os/user"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/sparkleHazard/bootstrap/internal/platform"
+)
+
+// Units --enable-drift-timer installs: the timer runs the service, which
+// runs the installed binary with --detect-drift and the captured settings.
+const (
+	DriftServicePath = "/etc/systemd/system/bootstrap-drift.service"
+	DriftTimerPath   = "/etc/systemd/system/bootstrap-drift.timer"
+)
+
+// driftConfigName is the file in the state directory holding the settings
+// the drift service runs with.
+const driftConfigName = "drift.conf"
+
+// driftNotCaptured are the settings of rerun.conf left out of drift.conf,
+// as a drift check cannot use them.
+var driftNotCaptured = map[string]bool{
+	"two-phase": true,
+}
+
+// installDriftTimer writes this run's settings to drift.conf in dir and
+// installs and enables DriftTimerPath, which runs DriftServicePath, and so
+// bin --detect-drift with them, on the --enable-drift-timer schedule. It
+// can be run again: only what changed is rewritten, and a new schedule
+// takes effect at once. Drift the service finds fails it, and is reported
+// by the notifications in the captured settings.
+func (m *Manager) installDriftTimer(ctx context.Context, bin, dir string) error {
+	schedule := string(m.cfg.DriftTimer)
+	// Refuse a schedule systemd would reject, rather than install a timer
+	// that never fires.
+	if _, err := exec.LookPath("systemd-analyze"); err == nil {
+		if out, err := m.sys.CmdOutput(ctx, "systemd-analyze", "calendar", schedule); err != nil {
+			return fmt.Errorf("enable-drift-timer: %q is not a systemd calendar event: %s", schedule, platform.LastLine(out, err))
+		}
+	}
+
+	conf := filepath.Join(dir, driftConfigName)
+	header := fmt.Sprintf("# Captured by bootstrap %s on %s for %s.\n", platform.ToolVersion(), time.Now().Format(time.RFC3339), filepath.Base(DriftServicePath))
+	var settings strings.Builder
+	for _, line := range strings.SplitAfter(m.RunSettings, "\n") {
+		name, _, _ := strings.Cut(line, " = ")
+		if !driftNotCaptured[name] {
+			settings.WriteString(line)
+		}
+	}
+	// The settings may include tokens.
+	if _, err := m.sys.WriteFile(ctx, conf, []byte(header+settings.String()), 0600, ""); err != nil {
+		return err
+	}
+	if !m.hasRunNotification() {
+		m.sys.Log("Warning: no notification (notify-ntfy, notify-email, healthcheck-url, report-url) is configured; drift the timer finds will only show as a failed " + filepath.Base(DriftServicePath) + ".")
+	}
+
+	args := []string{bin, "--config=" + conf, "--detect-drift"}
+	for i, a := range args {
+		args[i] = SystemdQuote(a)
+	}
+	service := fmt.Sprintf(`[Unit]
+Description=Check that this host still matches its playbook, without changing it
+After=network-online.target
+Wants=network-online.target
+
+[Service]
+Type=oneshot
+ExecStart=%s
+%s`, strings.Join(args, " "), m.rerunCredentials(dir))
+	if m.sys.Host.EUID() != 0 {
+		u, err := user.Current()
+		if err != nil {
+			return err
+		}
+		service += "User=" + u.Username + "\n"
+	}
+	timer := fmt.Sprintf(`[Unit]
+Description=Check this host for drift from its playbook (%s)
+
+[Timer]
+OnCalendar=%s
+RandomizedDelaySec=5min
+Persistent=true
+
+[Install]
+WantedBy=timers.target
+`, schedule, schedule)
+
+	existed := platform.FileExists(m.sys.Host.Path(DriftTimerPath))
+	serviceChanged, err := m.sys.WriteFile(ctx, m.sys.Host.Path(DriftServicePath), []byte(service), 0644, platform.RootOwner)
+	if err != nil {
+		return err
+	}
+	timerChanged, err := m.sys.WriteFile(ctx, m.sys.Host.Path(DriftTimerPath), []byte(timer), 0644, platform.RootOwner)
+	if err != nil {
+		return err
+	}
+	if serviceChanged || timerChanged {
+		if err := m.sys.RunCmdSudo(ctx, "systemctl", "daemon-reload"); err != nil {
+			return fmt.Errorf("systemctl daemon-reload failed: %w", err)
+		}
+	}
+	name := filepath.Base(DriftTimerPath)
+	if err := m.sys.RunCmdSudo(ctx, "systemctl", "enable", "--now", name); err != nil {
+		return fmt.Errorf("systemctl enable --now %s failed: %w", name, err)
+	}
+	// A running timer keeps the schedule it was started with.
+	if timerChanged && existed {
+		if err := m.sys.RunCmdSudo(ctx, "systemctl", "restart", name); err != nil {
+			return fmt.Errorf("systemctl restart %s failed: %w", name, err)
+		}
+	}
+	if !existed {
+		m.sys.RecordUndo("remove "+DriftTimerPath+" and "+DriftServicePath, func(ctx context.Context) error {
+			m.sys.RunCmdSudo(ctx, "systemctl", "disable", "--now", name)
+			if err := m.sys.RunCmdSudo(ctx, "rm", "-f", m.sys.Host.Path(DriftTimerPath), m.sys.Host.Path(DriftServicePath)); err != nil {
+				return err
+			}
+			return m.sys.RunCmdSudo(ctx, "systemctl", "daemon-reload")
+		})
+	}
+	switch {
+	case !existed:
+		m.sys.Log("Enabled " + name + ": checking for drift " + schedule + ".")
+	case serviceChanged || timerChanged:
+		m.sys.Log("Updated " + name + ": checking for drift " + schedule + ".")
+	case m.cfg.Verbose:
+		m.sys.Log(name + " is already enabled: checking for drift " + schedule + ".")
+	}
+	return nil
+}
+
+// hasRunNotification reports whether the end of a run notifies anyone of
+// its outcome.
+func (m *Manager) hasRunNotification() bool {
+	return m.cfg.NotifyNtfy != "" || m.cfg.NotifyEmail != "" || m.cfg.HealthcheckURL != "" || m.cfg.ReportURL != ""
+}
@@ -0,0 +1,245 @@
+package service
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"os/user"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/sparkleHazard/bootstrap/internal/platform"
+)
+
+// SystemBinPath is where --install-self puts the binary when it can write
+// there, with root or through the escalation tool.
+const SystemBinPath = "/usr/local/bin/bootstrap"
+
+// RerunUnitPath is the unit --install-rerun-unit installs, which reruns the
+// installed binary with the captured settings when started.
+const RerunUnitPath = "/etc/systemd/system/bootstrap-rerun.service"
+
+// Files in the state directory: installRecordName records where
+// --install-self put the binary, and rerunConfigName holds the settings
+// the rerun unit runs with.
+const (
+	installRecordName = "installed.json"
+	rerunConfigName   = "rerun.conf"
+)
+
+// notCaptured are the settings left out of rerun.conf: the config file it
+// replaces, and those that only make sense for the run that set them.
+var notCaptured = map[string]bool{
+	"config":             true,
+	"install-self":       true,
+	"install-rerun-unit": true,
+	"enable-drift-timer": true,
+	"notify-test":        true,
+	"force":              true,
+	"force-key-regen":    true,
+	"key-stdin":          true,
+	"key-b64-env":        true,
+	"auto-approve":       true,
+	"detect-drift":       true,
+}
+
+// installRecord is the content of installRecordName.
+type installRecord struct {
+	Path        string    `json:"path"`
+	Version     string    `json:"version"`
+	InstalledAt time.Time `json:"installed_at"`
+}
+
+// CaptureSettings returns the settings fs was given by the config file, the
+// environment and the command line, as config file lines.
+func CaptureSettings(fs *flag.FlagSet) string {
+	var b strings.Builder
+	fs.Visit(func(f *flag.Flag) {
+		if notCaptured[f.Name] {
+			return
+		}
+		// A repeatable setting takes one line per entry.
+		if r, ok := f.Value.(interface{ Entries() []string }); ok {
+			for _, v := range r.Entries() {
+				fmt.Fprintf(&b, "%s = %s\n", f.Name, v)
+			}
+			return
+		}
+		fmt.Fprintf(&b, "%s = %s\n", f.Name, f.Value.String())
+	})
+	return b.String()
+}
+
+// InstalledBinary returns the path --install-self last installed the
+// binary at, if it is still there, or "".
+func (m *Manager) InstalledBinary() string {
+	dir, err := m.sys.StateDir()
+	if err != nil {
+		return ""
+	}
+	data, err := os.ReadFile(filepath.Join(dir, installRecordName))
+	if err != nil {
+		return ""
+	}
+	var rec installRecord
+	if json.Unmarshal(data, &rec) != nil || rec.Path == "" || !platform.FileExists(rec.Path) {
+		return ""
+	}
+	return rec.Path
+}
+
+// InstallSelf copies the running executable to SystemBinPath, or to
+// ~/.local/bin without root, and records where; with
+// --install-rerun-unit it also installs the rerun unit. It returns the
+// step's status: "installed" or "unchanged".
+func (m *Manager) InstallSelf(ctx context.Context) (string, error) {
+	exe, err := os.Executable()
+	if err != nil {
+		return "", err
+	}
+	if resolved, err := filepath.EvalSymlinks(exe); err == nil {
+		exe = resolved
+	}
+	dest := m.sys.Host.Path(SystemBinPath)
+	if !m.sys.CanEscalate {
+		homeDir, err := m.sys.Host.HomeDir()
+		if err != nil {
+			return "", fmt.Errorf("unable to determine home directory: %w", err)
+		}
+		dest = filepath.Join(homeDir, ".local", "bin", "bootstrap")
+	}
+
+	status := "unchanged"
+	data, err := os.ReadFile(exe)
+	if err != nil {
+		return "", err
+	}
+	if current, err := os.ReadFile(dest); err != nil || !bytes.Equal(current, data) {
+		m.sys.Log("Installing bootstrap at " + dest + "...")
+		if err := m.InstallBinary(ctx, exe, dest); err != nil {
+			return "", fmt.Errorf("installing %s failed: %w", dest, err)
+		}
+		status = "installed"
+	} else if m.cfg.Verbose {
+		m.sys.Log("bootstrap is already installed at " + dest + ".")
+	}
+
+	dir, err := m.sys.StateDir()
+	if err != nil {
+		return "", err
+	}
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return "", err
+	}
+	rec, err := json.MarshalIndent(installRecord{Path: dest, Version: platform.ToolVersion(), InstalledAt: time.Now()}, "", "  ")
+	if err != nil {
+		return "", err
+	}
+	if _, err := m.sys.WriteFile(ctx, filepath.Join(dir, installRecordName), append(rec, '\n'), 0644, ""); err != nil {
+		return "", err
+	}
+
+	if m.cfg.InstallRerunUnit {
+		if !m.sys.CanEscalate {
+			m.sys.Log("Warning: the rerun unit needs root; not installing it.")
+			return status, nil
+		}
+		if err := m.installRerunUnit(ctx, dest, dir); err != nil {
+			return "", err
+		}
+	}
+	if m.cfg.DriftTimer != "" {
+		if !m.sys.CanEscalate {
+			m.sys.Log("Warning: the drift timer needs root; not installing it.")
+			return status, nil
+		}
+		if err := m.installDriftTimer(ctx, dest, dir); err != nil {
+			return "", err
+		}
+	}
+	return status, nil
+}
+
+// installRerunUnit writes this run's settings to rerun.conf in dir and
+// installs RerunUnitPath, which runs bin with them when started. The unit
+// is not enabled: it runs only on demand, and never reboots the host.
+func (m *Manager) installRerunUnit(ctx context.Context, bin, dir string) error {
+	conf := filepath.Join(dir, rerunConfigName)
+	header := fmt.Sprintf("# Captured by bootstrap %s on %s for %s.\n", platform.ToolVersion(), time.Now().Format(time.RFC3339), filepath.Base(RerunUnitPath))
+	// The settings may include tokens.
+	if _, err := m.sys.WriteFile(ctx, conf, []byte(header+m.RunSettings), 0600, ""); err != nil {
+		return err
+	}
+	args := []string{bin, "--config=" + conf, "--no-reboot"}
+	for i, a := range args {
+		args[i] = SystemdQuote(a)
+	}
+	unit := fmt.Sprintf(`[Unit]
+Description=Rerun bootstrap with the settings of the run that installed it
+After=network-online.target
+Wants=network-online.target
+
+[Service]
+Type=oneshot
+ExecStart=%s
+%s`, strings.Join(args, " "), m.rerunCredentials(dir))
+	// A run by a user through sudo is rerun as that user, with their
+	// home directory and keys.
+	if m.sys.Host.EUID() != 0 {
+		u, err := user.Current()
+		if err != nil {
+			return err
+		}
+		unit += "User=" + u.Username + "\n"
+	}
+	changed, err := m.sys.WriteFile(ctx, m.sys.Host.Path(RerunUnitPath), []byte(unit), 0644, platform.RootOwner)
+	if err != nil {
+		return err
+	}
+	if changed {
+		if err := m.sys.RunCmdSudo(ctx, "systemctl", "daemon-reload"); err != nil {
+			return fmt.Errorf("systemctl daemon-reload failed: %w", err)
+		}
+		m.sys.RecordUndo("remove "+RerunUnitPath, func(ctx context.Context) error {
+			return m.sys.RunCmdSudo(ctx, "rm", "-f", m.sys.Host.Path(RerunUnitPath))
+		})
+	}
+	m.sys.Log("Run \"systemctl start " + filepath.Base(RerunUnitPath) + "\" to converge this host again.")
+	return nil
+}
+
+// InstallBinary puts a copy of the executable src at dest, atomically: the
+// copy is written next to dest and renamed over it, so that nothing ever
+// runs a partial binary. Where the directory is not writable, that is done
+// with the escalation tool.
+func (m *Manager) InstallBinary(ctx context.Context, src, dest string) error {
+	data, err := os.ReadFile(src)
+	if err != nil {
+		return err
+	}
+	dir := filepath.Dir(dest)
+	if err := os.MkdirAll(dir, 0755); err != nil && !errors.Is(err, os.ErrPermission) {
+		return err
+	}
+	_, err = m.sys.WriteFile(ctx, dest, data, 0755, "")
+	if !errors.Is(err, os.ErrPermission) || m.sys.Host.EUID() == 0 {
+		return err
+	}
+	if m.sys.EscalationCmd == "" {
+		return fmt.Errorf("%s is not writable and neither sudo nor doas is available", dir)
+	}
+	staged := filepath.Join(dir, ".bootstrap-update")
+	if err := m.sys.RunCmdSudo(ctx, "install", "-D", "-m", "0755", src, staged); err != nil {
+		return fmt.Errorf("copying the binary to %s failed: %w", dir, err)
+	}
+	if err := m.sys.RunCmdSudo(ctx, "mv", "-f", staged, dest); err != nil {
+		m.sys.RunCmdSudo(ctx, "rm", "-f", staged)
+		return fmt.Errorf("replacing %s failed: %w", dest, err)
+	}
+	return nil
+}
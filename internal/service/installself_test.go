@@ -0,0 +1,28 @@
+package service
+
+import (
+	"flag"
+	"testing"
+
+	"github.com/sparkleHazard/bootstrap/internal/config"
+)
+
+func TestCaptureSettingsRepeatable(t *testing.T) {
+	var c config.Config
+	fs := flag.NewFlagSet("bootstrap", flag.ContinueOnError)
+	fs.Var(&c.ExtraVars, "extra-var", "")
+	fs.StringVar(&c.Role, "role", "", "")
+	fs.Bool("force", false, "")
+	for _, arg := range []string{"--extra-var=b=2", "--extra-var=a=1", "--role=web", "--force"} {
+		if err := fs.Parse([]string{arg}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// Each entry of a repeatable setting takes a line of its own, and
+	// --force only makes sense for the run that gave it.
+	want := "extra-var = a=1\nextra-var = b=2\nrole = web\n"
+	if got := CaptureSettings(fs); got != want {
+		t.Errorf("CaptureSettings = %q, want %q", got, want)
+	}
+}
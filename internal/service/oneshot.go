@@ -0,0 +1,469 @@
+package service
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"os/exec"
+	"os/user"
+	"path/filepath"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/sparkleHazard/bootstrap/internal/platform"
+)
+
+// MiseUnitModes are the accepted values of --mise-unit-mode.
+var MiseUnitModes = []string{"flag", "self-remove"}
+
+// OneShot is a command run once, as user, by a systemd unit after the
+// reboot at the end of the run: 'mise install' and each --post-reboot-cmd.
+type OneShot struct {
+	name string // base name of the unit and its state files
+	Desc string // for logs and the unit's Description
+	step string // key in runResult.Steps
+	user *user.User
+	cmd  string // as configured; see resolveCmd
+	host *platform.HostEnv
+}
+
+func (o *OneShot) UnitName() string { return o.name + "-once.service" }
+
+// unitPath is where the unit file goes for scope.
+func (o *OneShot) unitPath(scope string) string {
+	if scope == "user" {
+		return filepath.Join(o.user.HomeDir, ".config", "systemd", "user", o.UnitName())
+	}
+	return o.host.Path("/etc/systemd/system/" + o.UnitName())
+}
+
+// stamp is created, in self-remove mode, once the unit has run
+// successfully; the unit's condition on it guarantees a single run even if
+// the cleanup after it fails.
+func (o *OneShot) stamp() string {
+	return o.host.Path(filepath.Join(platform.SystemStateDir, o.name+".done"))
+}
+
+// UnitStateDir is u's state directory, holding the files the units running
+// as u read and write.
+func UnitStateDir(u *user.User) string {
+	return filepath.Join(u.HomeDir, ".local", "state", "bootstrap")
+}
+
+// pendingFlag is the file whose presence arms the unit in flag mode.
+func (o *OneShot) pendingFlag() string {
+	return filepath.Join(UnitStateDir(o.user), o.name+".pending")
+}
+
+// LogFile collects the output of the unit's runs.
+func (o *OneShot) LogFile() string {
+	return filepath.Join(UnitStateDir(o.user), o.name+".log")
+}
+
+// resultFile is written after every run of the unit with systemd's
+// $SERVICE_RESULT and $EXIT_STATUS, e.g. "success 0" or "exit-code 1".
+func (o *OneShot) resultFile() string {
+	return filepath.Join(UnitStateDir(o.user), o.name+".result")
+}
+
+// PlannedOneShots returns the units a run sets up, in the order they run:
+// 'mise install' if withMise, then the --post-reboot-cmd entries. Entries
+// naming a user run as that user, the rest as the target user.
+func (m *Manager) PlannedOneShots(withMise bool) ([]*OneShot, error) {
+	target, err := m.sys.TargetUser()
+	if err != nil {
+		return nil, err
+	}
+	var shots []*OneShot
+	if withMise {
+		shots = append(shots, &OneShot{name: "mise-install", Desc: "mise install", step: "mise-service", user: target, cmd: m.cfg.MiseCmd, host: m.sys.Host})
+	}
+	for i, c := range m.cfg.PostRebootCmds {
+		u := target
+		if c.User != "" {
+			if u, err = user.Lookup(c.User); err != nil {
+				return nil, fmt.Errorf("post-reboot-cmd %q: %w", c.User+":"+c.Cmd, err)
+			}
+		}
+		name := fmt.Sprintf("post-reboot-%d", i+1)
+		shots = append(shots, &OneShot{name: name, Desc: fmt.Sprintf("post-reboot command %d", i+1), step: name + "-service", user: u, cmd: c.Cmd, host: m.sys.Host})
+	}
+	return shots, nil
+}
+
+// SetupPostReboot installs and enables a unit for each of shots, recording
+// each in steps, the statuses of the run's steps. Each unit is ordered After= the one before it that runs
+// under the same systemd manager, so that they run in order after the reboot.
+func (m *Manager) SetupPostReboot(ctx context.Context, shots []*OneShot, steps map[string]string) error {
+	// The playbook may just have installed Homebrew and mise.
+	if err := m.sys.LoadBrewEnv(ctx); err != nil {
+		m.sys.Log("Warning: " + err.Error())
+	}
+	last := map[string]string{}
+	for _, o := range shots {
+		if err := m.setupOneShot(ctx, o, last); err != nil {
+			steps[o.step] = "failed"
+			return fmt.Errorf("%s service setup failed: %w", o.Desc, err)
+		}
+		steps[o.step] = "enabled"
+	}
+	return nil
+}
+
+// setupOneShot installs and enables o's unit. last maps each systemd
+// manager ("system", or "user:" and a uid) to the unit last set up with it;
+// o's unit is ordered after that one and becomes the new entry.
+func (m *Manager) setupOneShot(ctx context.Context, o *OneShot, last map[string]string) error {
+	m.sys.Log("Setting up one-shot systemd service for '" + o.cmd + "' after reboot...")
+
+	cmdLine, err := m.sys.ResolveCmd(ctx, o.user, o.cmd)
+	if err != nil {
+		return err
+	}
+	if m.cfg.Verbose {
+		m.sys.Log("Using " + cmdLine + " for user " + o.user.Username)
+	}
+	execStart, err := m.unitExecStart(o.user, cmdLine)
+	if err != nil {
+		return err
+	}
+
+	// A user unit needs the user's manager running at boot; without
+	// lingering fall back to a system unit.
+	scope := m.cfg.MiseUnitScope
+	if scope == "user" {
+		if err := m.enableLinger(ctx, o.user); err != nil {
+			m.sys.Log("Warning: " + err.Error() + "; installing a system unit instead.")
+			scope = "system"
+		}
+	}
+	manager := scope
+	if scope == "user" {
+		manager = "user:" + o.user.Uid
+	}
+	content := m.renderUnit(o, cmdLine, execStart, scope, last[manager], m.systemdSupportsOneshotRestart(ctx))
+	if scope == "user" {
+		err = m.installUserUnit(ctx, o, content)
+	} else {
+		err = m.installSystemUnit(ctx, o, content)
+	}
+	if err != nil {
+		return err
+	}
+	last[manager] = o.UnitName()
+	return nil
+}
+
+// Restart policy of the one-shot units: right after boot the network is
+// often not up yet, so a failed run is retried a few times before it is
+// left for the next boot. The start limit interval must exceed burst times
+// the restart delay for the burst to be reachable.
+const (
+	unitRestartSec         = "30s"
+	unitStartLimitBurst    = 5
+	unitStartLimitInterval = "10min"
+
+	// unitStartTimeout bounds a single run; toolchain downloads are slow.
+	unitStartTimeout = "1h"
+)
+
+// systemdSupportsOneshotRestart reports whether the installed systemd
+// accepts Restart= on a Type=oneshot service, which was added in systemd
+// 244; older versions refuse to load such a unit.
+func (m *Manager) systemdSupportsOneshotRestart(ctx context.Context) bool {
+	m.oneshotRestartOnce.Do(func() {
+		out, err := m.sys.CmdOutput(ctx, "systemctl", "--version")
+		if err != nil {
+			return
+		}
+		// The first line looks like "systemd 252 (252.22-1~deb12u1)".
+		fields := strings.Fields(string(out))
+		if len(fields) < 2 {
+			return
+		}
+		m.oneshotRestartSupported = platform.VersionAtLeast(fields[1], []int{244})
+		if m.cfg.Verbose {
+			m.sys.Log(fmt.Sprintf("systemd %s supports Restart= for oneshot units: %t", fields[1], m.oneshotRestartSupported))
+		}
+	})
+	return m.oneshotRestartSupported
+}
+
+// renderUnit returns the unit file running execStart once as o's user, for
+// the given unit scope ("system" or "user"), ordered after the unit after
+// if it is not empty. With restart the unit is restarted on failure as
+// described at unitRestartSec.
+//
+// In flag mode (the default) the unit stays installed and enabled and only
+// runs while o.pendingFlag exists; its ExecStartPost removes the flag, so
+// there is nothing to disable or delete and it works on any systemd.
+// (systemd-run cannot do this: transient units do not survive a reboot.)
+//
+// In self-remove mode, which is system scope only, the unit disables and
+// deletes itself instead. systemd does not pass Exec lines through a shell,
+// so each cleanup command is its own ExecStartPost= line; they run in order,
+// as root ("+", systemd 231 and later) even though the service runs as the
+// user, and only after ExecStart succeeded. The unit does not daemon-reload
+// from inside its own run; the stale definition is gone by the next boot.
+//
+// The cleanup only happens once a run succeeds: ExecStartPost= lines are
+// skipped when ExecStart fails, including when it times out. A command
+// that still fails after the restarts is retried on the next boot. Each run
+// appends its output to o.LogFile, and, whether or not it succeeded,
+// records its outcome in o.resultFile for the next bootstrap run to report
+// (SERVICE_RESULT needs systemd 232, append: 240).
+func (m *Manager) renderUnit(o *OneShot, cmdLine, execStart, scope, after string, restart bool) string {
+	condition := "ConditionPathExists=" + systemdEscape(o.pendingFlag())
+	post := "ExecStartPost=/bin/rm -f " + SystemdQuote(o.pendingFlag()) + "\n"
+	if m.cfg.MiseUnitMode == "self-remove" {
+		condition = "ConditionPathExists=!" + systemdEscape(o.stamp())
+		post = fmt.Sprintf("ExecStartPost=+/bin/touch %s\nExecStartPost=+%s disable %s\nExecStartPost=+/bin/rm -f %s\n",
+			SystemdQuote(o.stamp()), SystemdQuote(SystemctlPath()), SystemdQuote(o.UnitName()), SystemdQuote(o.unitPath(scope)))
+	}
+	// A user unit runs as its owner, and the user manager has no
+	// multi-user.target.
+	userLine := "User=" + o.user.Username + "\n"
+	target := "multi-user.target"
+	if scope == "user" {
+		userLine = ""
+		target = "default.target"
+	}
+	// The user manager cannot order against the system's network targets.
+	ordering := "After=network-online.target\nWants=network-online.target\n"
+	if scope == "user" {
+		ordering = ""
+	}
+	if after != "" {
+		ordering += "After=" + after + "\n"
+	}
+	var limits, restartLines string
+	if restart {
+		limits = fmt.Sprintf("StartLimitIntervalSec=%s\nStartLimitBurst=%d\n", unitStartLimitInterval, unitStartLimitBurst)
+		restartLines = "Restart=on-failure\nRestartSec=" + unitRestartSec + "\n"
+	}
+	return fmt.Sprintf(`[Unit]
+Description=Run %s once after reboot
+%s%s%s
+
+[Service]
+Type=oneshot
+TimeoutStartSec=%s
+%s%sEnvironment=%s
+Environment=%s
+ExecStart=%s
+StandardOutput=append:%s
+StandardError=inherit
+%sExecStopPost=/bin/sh -c 'echo "$$SERVICE_RESULT $$EXIT_STATUS" > "$$1"' sh %s
+
+[Install]
+WantedBy=%s
+`, systemdEscape(o.Desc), ordering, limits, condition, unitStartTimeout, restartLines, userLine, systemdEnv("HOME", o.user.HomeDir), systemdEnv("PATH", m.unitPathEnv(cmdLine)), execStart,
+		systemdEscape(o.LogFile()), post, SystemdQuote(o.resultFile()), target)
+}
+
+// installSystemUnit installs content as o's system unit, enables it and
+// arms it. On failure the unit is removed again.
+func (m *Manager) installSystemUnit(ctx context.Context, o *OneShot, content string) error {
+	if m.cfg.MiseUnitMode == "self-remove" {
+		// A stamp from an earlier run would keep the new unit from running.
+		if err := m.sys.RunCmdSudo(ctx, "mkdir", "-p", filepath.Dir(o.stamp())); err != nil {
+			return fmt.Errorf("failed to create %s: %w", filepath.Dir(o.stamp()), err)
+		}
+		if err := m.sys.RunCmdSudo(ctx, "rm", "-f", o.stamp()); err != nil {
+			return fmt.Errorf("failed to remove %s: %w", o.stamp(), err)
+		}
+	}
+	servicePath := o.unitPath("system")
+	if _, err := m.sys.WriteFile(ctx, servicePath, []byte(content), 0644, platform.RootOwner); err != nil {
+		m.sys.RunCmdSudo(ctx, "rm", "-f", servicePath)
+		return fmt.Errorf("failed to install service file: %w", err)
+	}
+
+	// From here on a failure must not leave a half-installed unit behind,
+	// and the machine only reboots once the unit is verifiably enabled.
+	rollback := func(cause error) error {
+		m.sys.Log("Removing " + servicePath + " after failure...")
+		if err := m.sys.RunCmdSudo(ctx, "rm", "-f", servicePath); err != nil {
+			return fmt.Errorf("%w (and removing %s failed: %v)", cause, servicePath, err)
+		}
+		if err := m.sys.RunCmdSudo(ctx, "systemctl", "daemon-reload"); err != nil {
+			return fmt.Errorf("%w (unit removed, but systemctl daemon-reload failed: %v)", cause, err)
+		}
+		return fmt.Errorf("%w (unit removed)", cause)
+	}
+	if err := m.sys.RunCmdSudo(ctx, "systemctl", "daemon-reload"); err != nil {
+		return rollback(fmt.Errorf("systemctl daemon-reload failed: %w", err))
+	}
+	if err := m.sys.RunCmdSudo(ctx, "systemctl", "enable", o.UnitName()); err != nil {
+		return rollback(fmt.Errorf("systemctl enable %s failed: %w", o.UnitName(), err))
+	}
+	if err := m.sys.RunCmdSudo(ctx, "systemctl", "is-enabled", "--quiet", o.UnitName()); err != nil {
+		m.sys.RunCmdSudo(ctx, "systemctl", "disable", o.UnitName())
+		return rollback(fmt.Errorf("%s is not enabled after systemctl enable: %w", o.UnitName(), err))
+	}
+	if err := m.armUnit(ctx, o); err != nil {
+		m.sys.RunCmdSudo(ctx, "systemctl", "disable", o.UnitName())
+		return rollback(err)
+	}
+
+	m.sys.RecordUndo("disable and remove "+servicePath, func(ctx context.Context) error {
+		m.sys.RunCmdSudo(ctx, "systemctl", "disable", o.UnitName())
+		if m.cfg.MiseUnitMode == "flag" {
+			m.sys.RunCmdSudo(ctx, "rm", "-f", o.pendingFlag())
+		}
+		if err := m.sys.RunCmdSudo(ctx, "rm", "-f", servicePath); err != nil {
+			return err
+		}
+		return m.sys.RunCmdSudo(ctx, "systemctl", "daemon-reload")
+	})
+
+	m.sys.Log("One-shot service " + o.UnitName() + " created and enabled.")
+	return nil
+}
+
+// SystemctlPath returns the absolute path of systemctl, for places that do
+// not search PATH.
+func SystemctlPath() string {
+	if p, err := exec.LookPath("systemctl"); err == nil && filepath.IsAbs(p) {
+		return p
+	}
+	return "/bin/systemctl"
+}
+
+// armUnit prepares UnitStateDir for o's unit as o's user, who must own the
+// files in it: the log is emptied, the previous result removed and, in flag
+// mode, o.pendingFlag created.
+func (m *Manager) armUnit(ctx context.Context, o *OneShot) error {
+	script := "mkdir -p " + platform.ShellQuote(UnitStateDir(o.user)) +
+		" && : > " + platform.ShellQuote(o.LogFile()) +
+		" && rm -f " + platform.ShellQuote(o.resultFile())
+	if m.cfg.MiseUnitMode == "flag" {
+		script += " && touch " + platform.ShellQuote(o.pendingFlag())
+	}
+	if err := m.sys.RunAsUser(ctx, o.user, script, nil); err != nil {
+		return fmt.Errorf("failed to prepare %s: %w", UnitStateDir(o.user), err)
+	}
+	return nil
+}
+
+// unitLogTailLines is how much of a unit's log a failed run reports.
+const unitLogTailLines = 20
+
+// CheckPreviousOneShots reports the outcome of each unit's last run after
+// the reboot of an earlier bootstrap run, where there was one, and returns
+// them by unit. A failure is only a warning: this run sets the units up
+// again.
+func (m *Manager) CheckPreviousOneShots() map[string]*UnitOutcome {
+	shots, err := m.PlannedOneShots(true)
+	if err != nil {
+		return nil
+	}
+	var outcomes map[string]*UnitOutcome
+	for _, o := range shots {
+		outcome := PreviousOneShot(o)
+		if outcome == nil {
+			continue
+		}
+		if outcomes == nil {
+			outcomes = map[string]*UnitOutcome{}
+		}
+		outcomes[o.name] = outcome
+		when := outcome.FinishedAt.Format("2006-01-02 15:04:05")
+		if outcome.Result == "success" {
+			m.sys.Log("Previous " + o.Desc + ": success at " + when + ".")
+			continue
+		}
+		msg := fmt.Sprintf("Warning: previous %s failed at %s (%s, exit status %s)", o.Desc, when, outcome.Result, outcome.ExitStatus)
+		if logData, err := os.ReadFile(o.LogFile()); err == nil {
+			lines := strings.Split(strings.TrimRight(string(logData), "\n"), "\n")
+			if len(lines) > unitLogTailLines {
+				lines = lines[len(lines)-unitLogTailLines:]
+			}
+			if tail := strings.Join(lines, "\n"); tail != "" {
+				msg += "; last lines of " + o.LogFile() + ":\n" + tail
+			}
+		}
+		m.sys.Log(msg)
+	}
+	return outcomes
+}
+
+// PreviousOneShot returns the outcome of o's unit's last run, from its
+// result file, or nil if it has not run.
+func PreviousOneShot(o *OneShot) *UnitOutcome {
+	data, err := os.ReadFile(o.resultFile())
+	if err != nil {
+		return nil
+	}
+	var finished time.Time
+	if fi, err := os.Stat(o.resultFile()); err == nil {
+		finished = fi.ModTime()
+	}
+	result, status, _ := strings.Cut(strings.TrimSpace(string(data)), " ")
+	return &UnitOutcome{Result: result, ExitStatus: status, FinishedAt: finished}
+}
+
+// shellMetachars are characters that make a command line need a shell.
+const shellMetachars = "|&;<>()$`\\\"'*?[]#~"
+
+// unitExecStart returns the unit's ExecStart for cmdLine. A plain command
+// whose program is an absolute path runs directly, with its environment set
+// by Environment= lines; anything else, including arguments quoted because
+// they contain spaces, runs through u's login shell as a login shell, which
+// must exist.
+func (m *Manager) unitExecStart(u *user.User, cmdLine string) (string, error) {
+	prog, _, _ := strings.Cut(cmdLine, " ")
+	if filepath.IsAbs(prog) && !strings.ContainsAny(cmdLine, shellMetachars) {
+		if !platform.FileExists(prog) {
+			return "", fmt.Errorf("%s does not exist", prog)
+		}
+		return strings.ReplaceAll(cmdLine, "%", "%%"), nil
+	}
+	shell, err := m.sys.LoginShell(u)
+	if err != nil {
+		return "", err
+	}
+	return shell + " -l -c " + SystemdQuote(cmdLine), nil
+}
+
+// unitPathEnv returns the PATH for the unit: the directory of cmdLine's
+// program (where mise keeps its companions), the Homebrew prefix, and the
+// standard system directories.
+func (m *Manager) unitPathEnv(cmdLine string) string {
+	var dirs []string
+	if prog, _, _ := strings.Cut(cmdLine, " "); filepath.IsAbs(prog) {
+		dirs = append(dirs, filepath.Dir(prog))
+	}
+	if m.sys.BrewPrefix != "" {
+		dirs = append(dirs, filepath.Join(m.sys.BrewPrefix, "bin"))
+	}
+	dirs = append(dirs, "/usr/local/bin", "/usr/bin", "/bin")
+	return strings.Join(slices.Compact(dirs), ":")
+}
+
+// systemdEscape escapes the specifiers in s for use in a unit file value.
+// Only Exec lines expand variables, so "$" is left alone; see SystemdQuote.
+func systemdEscape(s string) string {
+	return strings.ReplaceAll(s, "%", "%%")
+}
+
+// systemdEnv returns the double-quoted NAME=value assignment of an
+// Environment= line, which keeps a value with spaces whole. Environment=
+// expands specifiers but not variables, so only % is doubled.
+func systemdEnv(name, value string) string {
+	return `"` + strings.NewReplacer(`\`, `\\`, `"`, `\"`, "%", "%%").Replace(name+"="+value) + `"`
+}
+
+// SystemdQuote returns s as a single double-quoted argument in a unit's
+// Exec line.
+func SystemdQuote(s string) string {
+	return `"` + strings.NewReplacer(`\`, `\\`, `"`, `\"`, "%", "%%", "$", "$$").Replace(s) + `"`
+}
+
+// UnitOutcome is how a run of a one-shot unit ended, as systemd reported it.
+type UnitOutcome struct {
+	Result     string    `json:"result"`
+	ExitStatus string    `json:"exit_status"`
+	FinishedAt time.Time `json:"finished_at"`
+}
@@ -0,0 +1,352 @@
+package service
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"os/user"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+
+	"github.com/sparkleHazard/bootstrap/internal/config"
+	"github.com/sparkleHazard/bootstrap/internal/platform"
+	"github.com/sparkleHazard/bootstrap/internal/platform/platformtest"
+)
+
+// newTestOneShot returns a Manager with cfg and a one-shot unit running cmd
+// as bob, on a host whose root and bob's home directory hold the characters
+// systemd expands or splits on.
+func newTestOneShot(t *testing.T, cfg *config.Config, cmd string) (*Manager, *OneShot) {
+	t.Helper()
+	host := platform.NewHostEnv(filepath.Join(t.TempDir(), `root 100% $HOME`))
+	sys := platform.NewSystem(cfg, host)
+	sys.SetRunner(&platformtest.Runner{})
+	sys.SetLogger(&platformtest.Logger{})
+	u := &user.User{Username: "bob", Uid: "1000", Gid: "1000", HomeDir: `/home/bob "the builder" 50%$off`}
+	return NewManager(sys, nil), &OneShot{name: "mise-install", Desc: "mise install", step: "mise-service", user: u, cmd: cmd, host: host}
+}
+
+// unitLines returns the values of the key= lines of unit, in order.
+func unitLines(unit, key string) []string {
+	var values []string
+	for _, line := range strings.Split(unit, "\n") {
+		if v, ok := strings.CutPrefix(line, key+"="); ok {
+			values = append(values, v)
+		}
+	}
+	return values
+}
+
+// unitWords splits the value of an Exec or Environment line into words as
+// systemd does: at spaces outside single or double quotes, with backslash
+// escapes in quotes, and "%%" standing for "%" and, where vars expands
+// variables as Exec lines do, "$$" for "$". It fails the test on a lone
+// "%" or "$" that systemd would expand.
+func unitWords(t *testing.T, value string, vars bool) []string {
+	t.Helper()
+	var words []string
+	var word strings.Builder
+	inWord := false
+	var quote byte
+	for i := 0; i < len(value); i++ {
+		c := value[i]
+		switch {
+		case quote == 0 && c == ' ':
+			if inWord {
+				words = append(words, word.String())
+				word.Reset()
+				inWord = false
+			}
+			continue
+		case quote == 0 && (c == '"' || c == '\''):
+			quote = c
+		case quote != 0 && c == quote:
+			quote = 0
+		case quote != 0 && c == '\\' && i+1 < len(value):
+			i++
+			word.WriteByte(value[i])
+		case c == '%' || c == '$' && vars:
+			if i+1 >= len(value) || value[i+1] != c {
+				t.Errorf("%q has an unescaped %c at %d", value, c, i)
+			}
+			i++
+			word.WriteByte(c)
+		default:
+			word.WriteByte(c)
+		}
+		inWord = true
+	}
+	if quote != 0 {
+		t.Errorf("%q has an unterminated quote", value)
+	}
+	if inWord {
+		words = append(words, word.String())
+	}
+	return words
+}
+
+// unescapeValue undoes systemdEscape, failing the test on a lone "%".
+func unescapeValue(t *testing.T, value string) string {
+	t.Helper()
+	var b strings.Builder
+	for i := 0; i < len(value); i++ {
+		c := value[i]
+		if c == '%' {
+			if i+1 >= len(value) || value[i+1] != c {
+				t.Errorf("%q has an unescaped %c at %d", value, c, i)
+			}
+			i++
+		}
+		b.WriteByte(c)
+	}
+	return b.String()
+}
+
+func TestRenderUnitQuoting(t *testing.T) {
+	for _, mode := range MiseUnitModes {
+		t.Run(mode, func(t *testing.T) {
+			m, o := newTestOneShot(t, &config.Config{MiseUnitMode: mode}, "mise install && mise reshim")
+			cmdLine := "mise install && mise reshim"
+			execStart, err := m.unitExecStart(o.user, cmdLine)
+			if err != nil {
+				t.Fatal(err)
+			}
+			unit := m.renderUnit(o, cmdLine, execStart, "system", "", true)
+
+			// systemd runs Exec lines without a shell, so an operator must
+			// be inside the argument of a shell's -c.
+			for _, key := range []string{"ExecStart", "ExecStartPost", "ExecStopPost"} {
+				for _, value := range unitLines(unit, key) {
+					words := unitWords(t, strings.TrimLeft(value, "+-@!:"), true)
+					for _, w := range words {
+						switch w {
+						case "&&", "||", ";", "|", ">", "<":
+							t.Errorf("%s=%s has a bare %s", key, value, w)
+						}
+					}
+				}
+			}
+			start := unitLines(unit, "ExecStart")
+			if len(start) != 1 {
+				t.Fatalf("ExecStart lines: %q", start)
+			}
+			if words := unitWords(t, start[0], true); len(words) != 4 || words[1] != "-l" || words[2] != "-c" || words[3] != cmdLine {
+				t.Errorf("ExecStart=%s runs %q, want the login shell -l -c %q", start[0], words, cmdLine)
+			}
+
+			env := map[string]string{}
+			for _, value := range unitLines(unit, "Environment") {
+				words := unitWords(t, value, false)
+				if len(words) != 1 || !strings.HasPrefix(value, `"`) {
+					t.Errorf("Environment=%s is not a single quoted assignment", value)
+					continue
+				}
+				name, v, _ := strings.Cut(words[0], "=")
+				env[name] = v
+			}
+			if env["HOME"] != o.user.HomeDir {
+				t.Errorf("HOME=%q, want %q", env["HOME"], o.user.HomeDir)
+			}
+			if !strings.HasSuffix(env["PATH"], ":/usr/local/bin:/usr/bin:/bin") && env["PATH"] != "/usr/local/bin:/usr/bin:/bin" {
+				t.Errorf("PATH=%q", env["PATH"])
+			}
+
+			conditions := unitLines(unit, "ConditionPathExists")
+			if len(conditions) != 1 {
+				t.Fatalf("ConditionPathExists lines: %q", conditions)
+			}
+			post := unitLines(unit, "ExecStartPost")
+			var removed []string
+			for _, value := range post {
+				if words := unitWords(t, strings.TrimLeft(value, "+"), true); words[0] == "/bin/rm" {
+					removed = append(removed, words[len(words)-1])
+				}
+			}
+			switch mode {
+			case "flag":
+				if got := unescapeValue(t, conditions[0]); got != o.pendingFlag() {
+					t.Errorf("ConditionPathExists=%s is on %q, want %q", conditions[0], got, o.pendingFlag())
+				}
+				if len(removed) != 1 || removed[0] != o.pendingFlag() {
+					t.Errorf("ExecStartPost removes %q, want %q", removed, o.pendingFlag())
+				}
+			case "self-remove":
+				if got := unescapeValue(t, conditions[0]); got != "!"+o.stamp() {
+					t.Errorf("ConditionPathExists=%s is on %q, want !%q", conditions[0], got, o.stamp())
+				}
+				if len(removed) != 1 || removed[0] != o.unitPath("system") {
+					t.Errorf("ExecStartPost removes %q, want %q", removed, o.unitPath("system"))
+				}
+				if words := unitWords(t, strings.TrimLeft(post[0], "+"), true); len(words) != 2 || words[0] != "/bin/touch" || words[1] != o.stamp() {
+					t.Errorf("ExecStartPost=%s, want the stamp %q touched", post[0], o.stamp())
+				}
+			}
+			for _, value := range unitLines(unit, "StandardOutput") {
+				if got := unescapeValue(t, value); got != "append:"+o.LogFile() {
+					t.Errorf("StandardOutput=%s appends to %q, want %q", value, got, o.LogFile())
+				}
+			}
+		})
+	}
+}
+
+// unitSection returns the lines of unit's [name] section.
+func unitSection(unit, name string) string {
+	_, rest, _ := strings.Cut(unit, "["+name+"]\n")
+	section, _, _ := strings.Cut(rest, "\n[")
+	return section
+}
+
+func TestRenderUnitRestartAndCleanup(t *testing.T) {
+	tests := []struct {
+		name    string
+		systemd string // systemctl --version; "" fails it
+		mode    string
+		scope   string
+		after   string
+		restart bool
+	}{
+		{name: "systemd 252", systemd: "systemd 252 (252.22-1~deb12u1)\n+PAM +AUDIT", mode: "flag", scope: "system", restart: true},
+		{name: "systemd 244", systemd: "systemd 244 (244.5-1)", mode: "self-remove", scope: "system", after: "mise-install-once.service", restart: true},
+		{name: "systemd 239", systemd: "systemd 239 (239-78.el8)", mode: "self-remove", scope: "system"},
+		{name: "no systemctl", mode: "flag", scope: "system"},
+		{name: "user unit", systemd: "systemd 255 (255.4-1ubuntu8)", mode: "flag", scope: "user", after: "post-reboot-1-once.service", restart: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			m, o := newTestOneShot(t, &config.Config{MiseUnitMode: tt.mode}, "/bin/true")
+			m.sys.SetRunner(&platformtest.Runner{Respond: func(cmd string) (string, error) {
+				if tt.systemd == "" {
+					return "", errors.New("exit status 127")
+				}
+				return tt.systemd, nil
+			}})
+			restart := m.systemdSupportsOneshotRestart(context.Background())
+			if restart != tt.restart {
+				t.Errorf("systemdSupportsOneshotRestart = %t, want %t", restart, tt.restart)
+			}
+			unit := m.renderUnit(o, "/bin/true", "/bin/true", tt.scope, tt.after, restart)
+			unitPart, service := unitSection(unit, "Unit"), unitSection(unit, "Service")
+
+			// Restart= on a oneshot unit makes systemd before 244 refuse
+			// the whole unit.
+			wantRestart := []string(nil)
+			if tt.restart {
+				wantRestart = []string{"on-failure"}
+			}
+			if got := unitLines(service, "Restart"); strings.Join(got, ",") != strings.Join(wantRestart, ",") {
+				t.Errorf("Restart=%q, want %q", got, wantRestart)
+			}
+			if got := len(unitLines(unitPart, "StartLimitBurst")) == 1; got != tt.restart {
+				t.Errorf("StartLimitBurst= in [Unit]: %t, want %t", got, tt.restart)
+			}
+
+			wantCondition := o.pendingFlag()
+			if tt.mode == "self-remove" {
+				wantCondition = "!" + o.stamp()
+			}
+			if got := unitLines(unitPart, "ConditionPathExists"); len(got) != 1 || unescapeValue(t, got[0]) != wantCondition {
+				t.Errorf("ConditionPathExists=%q, want %q", got, wantCondition)
+			}
+
+			// The user manager cannot order against the system's targets.
+			var wantAfter, wantWants []string
+			if tt.scope == "system" {
+				wantAfter, wantWants = []string{"network-online.target"}, []string{"network-online.target"}
+			}
+			if tt.after != "" {
+				wantAfter = append(wantAfter, tt.after)
+			}
+			if got := unitLines(unitPart, "After"); strings.Join(got, ",") != strings.Join(wantAfter, ",") {
+				t.Errorf("After=%q, want %q", got, wantAfter)
+			}
+			if got := unitLines(unitPart, "Wants"); strings.Join(got, ",") != strings.Join(wantWants, ",") {
+				t.Errorf("Wants=%q, want %q", got, wantWants)
+			}
+			wantedBy := map[string]string{"system": "multi-user.target", "user": "default.target"}[tt.scope]
+			if got := unitLines(unitSection(unit, "Install"), "WantedBy"); len(got) != 1 || got[0] != wantedBy {
+				t.Errorf("WantedBy=%q, want %s", got, wantedBy)
+			}
+
+			// The cleanup is ExecStartPost=, which systemd skips when
+			// ExecStart fails; ExecStopPost= runs either way and only
+			// records the result.
+			post := unitLines(service, "ExecStartPost")
+			wantPost := 1
+			if tt.mode == "self-remove" {
+				wantPost = 3
+			}
+			if len(post) != wantPost {
+				t.Errorf("ExecStartPost=%q, want %d lines", post, wantPost)
+			}
+			stop := unitLines(service, "ExecStopPost")
+			if len(stop) != 1 || !strings.Contains(stop[0], "$$SERVICE_RESULT") || strings.Contains(stop[0], "rm ") || strings.Contains(stop[0], "disable") {
+				t.Errorf("ExecStopPost=%q, want only the result recorded", stop)
+			}
+		})
+	}
+}
+
+// TestRenderUnitVerify has systemd load the units, with systemd-analyze
+// verify where it is installed, and sh check the syntax of the scripts
+// their Exec lines run.
+func TestRenderUnitVerify(t *testing.T) {
+	analyze, err := exec.LookPath("systemd-analyze")
+	if err != nil {
+		t.Skip("systemd-analyze is not installed")
+	}
+	tests := []struct {
+		mode    string
+		scope   string
+		restart bool
+	}{
+		{"flag", "system", true},
+		{"self-remove", "system", true},
+		{"self-remove", "system", false},
+		{"flag", "user", true},
+	}
+	for _, tt := range tests {
+		t.Run(fmt.Sprintf("%s %s restart=%t", tt.mode, tt.scope, tt.restart), func(t *testing.T) {
+			cmdLine := "mise install && mise reshim"
+			m, o := newTestOneShot(t, &config.Config{MiseUnitMode: tt.mode}, cmdLine)
+			execStart, err := m.unitExecStart(o.user, cmdLine)
+			if err != nil {
+				t.Fatal(err)
+			}
+			unit := m.renderUnit(o, cmdLine, execStart, tt.scope, "post-reboot-1-once.service", tt.restart)
+			path := filepath.Join(t.TempDir(), o.UnitName())
+			if err := os.WriteFile(path, []byte(unit), 0644); err != nil {
+				t.Fatal(err)
+			}
+
+			cmd := exec.Command(analyze, "verify", path)
+			if tt.scope == "user" {
+				// The user manager it starts needs a runtime directory.
+				cmd = exec.Command(analyze, "--user", "verify", path)
+				cmd.Env = append(os.Environ(), "XDG_RUNTIME_DIR="+t.TempDir())
+			}
+			// A setting systemd cannot parse is only warned about and
+			// ignored, so a valid unit is one verify says nothing of.
+			if out, err := cmd.CombinedOutput(); err != nil || len(out) > 0 {
+				t.Errorf("systemd-analyze verify: %v\n%s\nof the unit:\n%s", err, out, unit)
+			}
+
+			for _, key := range []string{"ExecStart", "ExecStartPost", "ExecStopPost"} {
+				for _, value := range unitLines(unit, key) {
+					words := unitWords(t, strings.TrimLeft(value, "+"), true)
+					c := slices.Index(words, "-c")
+					if filepath.Base(words[0]) != "sh" || c < 0 || c+1 >= len(words) {
+						continue
+					}
+					if out, err := exec.Command("/bin/sh", "-n", "-c", words[c+1]).CombinedOutput(); err != nil {
+						t.Errorf("%s=%s runs a script sh cannot parse: %v\n%s", key, value, err, out)
+					}
+				}
+			}
+		})
+	}
+}
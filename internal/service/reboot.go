@@ -0,0 +1,69 @@
+package service
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/sparkleHazard/bootstrap/internal/platform"
+)
+
+// rebootConfirmTimeout is how long the interactive reboot prompt waits for
+// an answer before cancelling the reboot.
+const rebootConfirmTimeout = 10 * time.Second
+
+// rebootMessage is the wall message logged-in users see.
+const rebootMessage = "bootstrap: rebooting for mise install"
+
+// RebootHost reboots the machine at the end of a successful run, after the
+// result file has been written, and returns the outcome for the reboot
+// step. On a
+// terminal it first asks for confirmation unless --yes is set; it then
+// waits --reboot-delay, during which Ctrl-C aborts, and schedules the reboot
+// with shutdown so logged-in users are warned.
+func (m *Manager) RebootHost(ctx context.Context) string {
+	if platform.StdinIsTerminal() && !m.cfg.Yes && !m.confirmReboot(ctx) {
+		m.sys.Log("Reboot cancelled; reboot manually to run mise-install-once.service.")
+		return "cancelled"
+	}
+
+	m.sys.Log(fmt.Sprintf("*** WARNING: scheduling a reboot of this host (shutdown -r +1) in %s; press Ctrl-C to abort. ***", m.cfg.RebootDelay))
+	select {
+	case <-ctx.Done():
+		m.sys.Log("Reboot aborted; reboot manually to run mise-install-once.service.")
+		return "cancelled"
+	case <-time.After(m.cfg.RebootDelay):
+	}
+
+	if err := m.sys.RunCmdSudo(ctx, "shutdown", "-r", "+1", rebootMessage); err != nil {
+		m.sys.Log("Failed to schedule the reboot: " + err.Error() + "; reboot manually to run mise-install-once.service.")
+		return "failed"
+	}
+	m.sys.Log("Reboot scheduled in 1 minute (cancel with: shutdown -c).")
+	return "scheduled"
+}
+
+// confirmReboot asks on the terminal whether to reboot. No answer within
+// rebootConfirmTimeout, or anything but yes, cancels.
+func (m *Manager) confirmReboot(ctx context.Context) bool {
+	fmt.Fprintf(m.sys.ConsoleStdout, "Reboot now to run mise install? [y/N] (cancelling in %s) ", rebootConfirmTimeout)
+	answer := make(chan string, 1)
+	go func() {
+		line, _ := bufio.NewReader(os.Stdin).ReadString('\n')
+		answer <- strings.ToLower(strings.TrimSpace(line))
+	}()
+	select {
+	case a := <-answer:
+		return a == "y" || a == "yes"
+	case <-time.After(rebootConfirmTimeout):
+		fmt.Fprintln(m.sys.ConsoleStdout)
+		m.sys.Log("No answer.")
+		return false
+	case <-ctx.Done():
+		fmt.Fprintln(m.sys.ConsoleStdout)
+		return false
+	}
+}
@@ -0,0 +1,32 @@
+// Package service installs the systemd and launchd units bootstrap leaves
+// behind: the one-shot units run after a reboot, the rerun unit, the drift
+// timer and the installed binary.
+package service
+
+import (
+	"sync"
+
+	"github.com/sparkleHazard/bootstrap/internal/config"
+	"github.com/sparkleHazard/bootstrap/internal/platform"
+	"github.com/sparkleHazard/bootstrap/internal/secrets"
+)
+
+// Manager installs the systemd and launchd units a run leaves
+// behind: the post-reboot one-shots, the drift timer and the rerun unit.
+type Manager struct {
+	cfg     *config.Config
+	sys     *platform.System
+	secrets *secrets.Store
+
+	// RunSettings are the settings of this run that did not come from the
+	// defaults, as config file lines; see CaptureSettings.
+	RunSettings string
+
+	oneshotRestartOnce      sync.Once
+	oneshotRestartSupported bool
+}
+
+// NewManager returns the service manager of a run on sys.
+func NewManager(sys *platform.System, secrets *secrets.Store) *Manager {
+	return &Manager{cfg: sys.Config, sys: sys, secrets: secrets}
+}
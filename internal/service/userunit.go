@@ -0,0 +1,135 @@
+package service
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os/exec"
+	"os/user"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/sparkleHazard/bootstrap/internal/platform"
+)
+
+// lingerDir holds a file per user whose systemd user manager logind starts
+// at boot rather than at the first login.
+const lingerDir = "/var/lib/systemd/linger"
+
+// userManagerWait is how long enableLinger waits for the user manager to
+// come up once lingering is enabled.
+const userManagerWait = 15 * time.Second
+
+// userRuntimeDir is u's XDG_RUNTIME_DIR, where its user manager listens.
+func userRuntimeDir(u *user.User) string {
+	return "/run/user/" + u.Uid
+}
+
+// enableLinger enables lingering for u, so that its user manager, and the
+// user unit, start at boot without a login, and waits for the manager's bus
+// socket to appear. If the manager does not come up, lingering is switched
+// back off when this call turned it on.
+func (m *Manager) enableLinger(ctx context.Context, u *user.User) error {
+	if _, err := exec.LookPath("loginctl"); err != nil {
+		return errors.New("loginctl not found, so lingering cannot be enabled for " + u.Username)
+	}
+	enabled := false
+	if !platform.FileExists(m.sys.Host.Path(filepath.Join(lingerDir, u.Username))) {
+		if err := m.sys.RunCmdSudo(ctx, "loginctl", "enable-linger", u.Username); err != nil {
+			return fmt.Errorf("loginctl enable-linger %s failed: %w", u.Username, err)
+		}
+		enabled = true
+	}
+
+	bus := filepath.Join(userRuntimeDir(u), "bus")
+	deadline := time.Now().Add(userManagerWait)
+	for !platform.FileExists(bus) {
+		if time.Now().After(deadline) {
+			if enabled {
+				m.sys.RunCmdSudo(ctx, "loginctl", "disable-linger", u.Username)
+			}
+			return fmt.Errorf("the systemd user manager for %s did not start within %s (no %s)", u.Username, userManagerWait, bus)
+		}
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(500 * time.Millisecond):
+		}
+	}
+	if enabled {
+		m.sys.RecordUndo("disable lingering for "+u.Username, func(ctx context.Context) error {
+			return m.sys.RunCmdSudo(ctx, "loginctl", "disable-linger", u.Username)
+		})
+	}
+	return nil
+}
+
+// UserSystemctl runs systemctl --user as u. Started from root or through
+// sudo the process has no session, so the manager is addressed explicitly
+// through XDG_RUNTIME_DIR and DBUS_SESSION_BUS_ADDRESS.
+func (m *Manager) UserSystemctl(ctx context.Context, u *user.User, args ...string) error {
+	runtimeDir := userRuntimeDir(u)
+	script := "XDG_RUNTIME_DIR=" + platform.ShellQuote(runtimeDir) +
+		" DBUS_SESSION_BUS_ADDRESS=" + platform.ShellQuote("unix:path="+runtimeDir+"/bus") +
+		" " + platform.ShellQuote(SystemctlPath()) + " --user"
+	for _, a := range args {
+		script += " " + platform.ShellQuote(a)
+	}
+	if err := m.sys.RunAsUser(ctx, u, script, nil); err != nil {
+		return fmt.Errorf("systemctl --user %s failed: %w", strings.Join(args, " "), err)
+	}
+	return nil
+}
+
+// installUserUnit writes content to o's user unit directory as o's user,
+// enables it with that user's manager and arms it. On failure the unit is
+// removed again.
+func (m *Manager) installUserUnit(ctx context.Context, o *OneShot, content string) error {
+	u := o.user
+	unitPath := o.unitPath("user")
+	script := "umask 022 && mkdir -p " + platform.ShellQuote(filepath.Dir(unitPath)) + " && cat > " + platform.ShellQuote(unitPath)
+	if err := m.sys.RunAsUser(ctx, u, script, strings.NewReader(content)); err != nil {
+		return fmt.Errorf("failed to write %s: %w", unitPath, err)
+	}
+	if err := m.sys.RestoreContexts(ctx, true, unitPath); err != nil {
+		m.sys.RunAsUser(ctx, u, "rm -f "+platform.ShellQuote(unitPath), nil)
+		return err
+	}
+
+	rollback := func(cause error) error {
+		m.sys.Log("Removing " + unitPath + " after failure...")
+		m.UserSystemctl(ctx, u, "disable", o.UnitName())
+		if err := m.sys.RunAsUser(ctx, u, "rm -f "+platform.ShellQuote(unitPath), nil); err != nil {
+			return fmt.Errorf("%w (and removing %s failed: %v)", cause, unitPath, err)
+		}
+		if err := m.UserSystemctl(ctx, u, "daemon-reload"); err != nil {
+			return fmt.Errorf("%w (unit removed, but %v)", cause, err)
+		}
+		return fmt.Errorf("%w (unit removed)", cause)
+	}
+	if err := m.UserSystemctl(ctx, u, "daemon-reload"); err != nil {
+		return rollback(err)
+	}
+	if err := m.UserSystemctl(ctx, u, "enable", o.UnitName()); err != nil {
+		return rollback(err)
+	}
+	if err := m.UserSystemctl(ctx, u, "is-enabled", "--quiet", o.UnitName()); err != nil {
+		return rollback(fmt.Errorf("%s is not enabled after systemctl --user enable: %w", o.UnitName(), err))
+	}
+	if err := m.armUnit(ctx, o); err != nil {
+		return rollback(err)
+	}
+
+	m.sys.RecordUndo("disable and remove "+unitPath, func(ctx context.Context) error {
+		m.UserSystemctl(ctx, u, "disable", o.UnitName())
+		m.sys.RunAsUser(ctx, u, "rm -f "+platform.ShellQuote(o.pendingFlag()), nil)
+		if err := m.sys.RunAsUser(ctx, u, "rm -f "+platform.ShellQuote(unitPath), nil); err != nil {
+			return err
+		}
+		return m.UserSystemctl(ctx, u, "daemon-reload")
+	})
+
+	m.sys.Log("One-shot user service " + o.UnitName() + " created and enabled for " + u.Username + ".")
+	return nil
+}
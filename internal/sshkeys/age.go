@@ -0,0 +1,106 @@
+package sshkeys
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+
+	"filippo.io/age"
+	"github.com/sparkleHazard/bootstrap/internal/platform"
+	"golang.org/x/crypto/ssh"
+)
+
+// ageExportStampName is the file in the state directory recording what the
+// published encrypted key was encrypted from, so that SetupRsyncd does not
+// re-encrypt (and so change) it on every run.
+const ageExportStampName = "age-export.sha256"
+
+// ErrKeyDecrypt is wrapped by the error a key fetch returns when the key
+// was fetched but could not be decrypted with --age-identity-file.
+var ErrKeyDecrypt = errors.New("cannot decrypt the GitHub key")
+
+// decryptGithubKey decrypts the key fetched from the keyserver with the
+// identities in --age-identity-file. The plaintext is only ever held in
+// memory; it must be a private key.
+func (m *Manager) decryptGithubKey(ciphertext []byte) ([]byte, error) {
+	f, err := os.Open(m.cfg.AgeIdentityFile)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrKeyDecrypt, err)
+	}
+	defer f.Close()
+	ids, err := age.ParseIdentities(f)
+	if err != nil {
+		return nil, fmt.Errorf("%w: age-identity-file %s: %v", ErrKeyDecrypt, m.cfg.AgeIdentityFile, err)
+	}
+	r, err := age.Decrypt(bytes.NewReader(ciphertext), ids...)
+	if err != nil {
+		return nil, fmt.Errorf("%w with %s: %v", ErrKeyDecrypt, m.cfg.AgeIdentityFile, err)
+	}
+	plaintext, err := io.ReadAll(r)
+	if err != nil {
+		return nil, fmt.Errorf("%w with %s: %v", ErrKeyDecrypt, m.cfg.AgeIdentityFile, err)
+	}
+	if _, err := ssh.ParsePrivateKey(plaintext); err != nil {
+		return nil, fmt.Errorf("%w: the decrypted key is not a usable private key: %v", ErrKeyDecrypt, err)
+	}
+	return plaintext, nil
+}
+
+// publishEncryptedKey installs key, encrypted to the --age-recipient keys,
+// as dest on the keyserver with root-only mode, and reports whether it
+// changed. age encryption is randomized, so the key is only re-encrypted
+// when it or the recipients changed since the last time.
+func (m *Manager) publishEncryptedKey(ctx context.Context, dest string, key []byte) (bool, error) {
+	recipients := slices.Sorted(slices.Values(m.cfg.AgeRecipients))
+	sum := sha256.Sum256([]byte(string(key) + "\n" + strings.Join(recipients, "\n")))
+	stamp := hex.EncodeToString(sum[:]) + "\n"
+	dir, err := m.sys.StateDir()
+	if err != nil {
+		return false, err
+	}
+	stampPath := filepath.Join(dir, ageExportStampName)
+	if old, err := os.ReadFile(stampPath); err == nil && string(old) == stamp {
+		if _, err := os.Lstat(dest); !os.IsNotExist(err) {
+			return false, nil
+		}
+	}
+
+	var rs []age.Recipient
+	for _, s := range recipients {
+		r, err := age.ParseX25519Recipient(s)
+		if err != nil {
+			return false, err
+		}
+		rs = append(rs, r)
+	}
+	var ciphertext bytes.Buffer
+	w, err := age.Encrypt(&ciphertext, rs...)
+	if err != nil {
+		return false, fmt.Errorf("encrypting the GitHub key: %w", err)
+	}
+	if _, err := w.Write(key); err != nil {
+		return false, fmt.Errorf("encrypting the GitHub key: %w", err)
+	}
+	if err := w.Close(); err != nil {
+		return false, fmt.Errorf("encrypting the GitHub key: %w", err)
+	}
+	if _, err := m.sys.WriteFile(ctx, dest, ciphertext.Bytes(), 0600, platform.RootOwner); err != nil {
+		return false, err
+	}
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return false, err
+	}
+	if _, err := m.sys.WriteFile(ctx, stampPath, []byte(stamp), 0600, ""); err != nil {
+		return false, err
+	}
+	m.sys.Log(fmt.Sprintf("Published the GitHub key encrypted to %d age recipient(s) as %s.", len(recipients), dest))
+	return true, nil
+}
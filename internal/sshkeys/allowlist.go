@@ -0,0 +1,42 @@
+package sshkeys
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"net/netip"
+	"strings"
+)
+
+// ErrHostRefused is wrapped by the error a key fetch returns when the
+// keyserver refuses this host's address.
+var ErrHostRefused = errors.New("keyserver refused this host")
+
+// clientAddr returns the address of the client that made r. With
+// trustProxy it is the last X-Forwarded-For entry, the one the proxy in
+// front of the server added; earlier entries are client-supplied and would
+// let anyone claim an allowed address. Without trustProxy, or without the
+// header, it is the connection's peer address.
+func clientAddr(r *http.Request, trustProxy bool) (netip.Addr, error) {
+	if trustProxy {
+		if xff := r.Header.Values("X-Forwarded-For"); len(xff) > 0 {
+			entries := strings.Split(xff[len(xff)-1], ",")
+			last := strings.TrimSpace(entries[len(entries)-1])
+			addr, err := netip.ParseAddr(last)
+			if err != nil {
+				return netip.Addr{}, fmt.Errorf("invalid X-Forwarded-For address %q", last)
+			}
+			return addr.Unmap(), nil
+		}
+	}
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		host = r.RemoteAddr
+	}
+	addr, err := netip.ParseAddr(host)
+	if err != nil {
+		return netip.Addr{}, fmt.Errorf("invalid remote address %q", r.RemoteAddr)
+	}
+	return addr.Unmap(), nil
+}
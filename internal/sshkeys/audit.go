@@ -0,0 +1,193 @@
+package sshkeys
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/sparkleHazard/bootstrap/internal/platform"
+)
+
+// auditLogKeep is how many rotated audit logs (serve-audit.log.1, .2, ...)
+// are kept besides the current one.
+const auditLogKeep = 5
+
+// Request headers with which the client identifies the machine fetching
+// the key, for the key server's audit log.
+const (
+	clientHostnameHeader  = "X-Bootstrap-Hostname"
+	clientMachineIDHeader = "X-Bootstrap-Machine-Id"
+	clientVersionHeader   = "X-Bootstrap-Version"
+)
+
+// AuditEntry is one line of the key server's audit log.
+type AuditEntry struct {
+	Time      time.Time `json:"time"`
+	Client    string    `json:"client"`
+	Forwarded string    `json:"forwarded_for,omitempty"`
+	Method    string    `json:"method"`
+	Path      string    `json:"path"`
+	Status    int       `json:"status"`
+	Result    string    `json:"result"`
+	Reason    string    `json:"reason,omitempty"`
+	Token     string    `json:"token,omitempty"`
+	TokenID   string    `json:"token_id,omitempty"`
+	Hostname  string    `json:"hostname,omitempty"`
+	MachineID string    `json:"machine_id,omitempty"`
+	Version   string    `json:"version,omitempty"`
+}
+
+// auditLog appends entries as JSON lines to a file, rotating it once it
+// grows past maxSize.
+type auditLog struct {
+	path    string
+	maxSize int64
+
+	mu  sync.Mutex
+	sys *platform.System
+}
+
+// ServeAuditPath returns the key server's audit log: --serve-audit-log or
+// serve-audit.log in the state directory.
+func (m *Manager) ServeAuditPath() (string, error) {
+	if m.cfg.ServeAuditLog != "" {
+		return m.cfg.ServeAuditLog, nil
+	}
+	dir, err := m.sys.StateDir()
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(dir, "serve-audit.log"), nil
+}
+
+// record appends e to the log. A failure is logged rather than returned,
+// since it must not keep the key server from answering.
+func (a *auditLog) record(e AuditEntry) {
+	data, err := json.Marshal(e)
+	if err != nil {
+		a.sys.Log("Warning: audit log: " + err.Error())
+		return
+	}
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if err := a.rotateIfNeeded(int64(len(data) + 1)); err != nil {
+		a.sys.Log("Warning: rotating the audit log: " + err.Error())
+	}
+	f, err := platform.OpenFile(a.path, os.O_WRONLY|os.O_APPEND, 0600)
+	if err != nil {
+		a.sys.Log("Warning: audit log: " + err.Error())
+		return
+	}
+	if _, err := f.Write(append(data, '\n')); err != nil {
+		a.sys.Log("Warning: audit log: " + err.Error())
+	}
+	f.Close()
+}
+
+// rotateIfNeeded shifts the log to .1 (and .1 to .2, and so on, dropping
+// the oldest) when appending n bytes would take it past maxSize.
+func (a *auditLog) rotateIfNeeded(n int64) error {
+	fi, err := os.Stat(a.path)
+	if err != nil || a.maxSize <= 0 || fi.Size()+n <= a.maxSize {
+		return nil
+	}
+	for i := auditLogKeep - 1; i >= 1; i-- {
+		if err := os.Rename(a.path+"."+strconv.Itoa(i), a.path+"."+strconv.Itoa(i+1)); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
+	return os.Rename(a.path, a.path+".1")
+}
+
+// newAuditEntry starts the audit entry for a request r for name.
+func newAuditEntry(r *http.Request, name string) AuditEntry {
+	return AuditEntry{
+		Time:      time.Now().UTC(),
+		Client:    r.RemoteAddr,
+		Forwarded: r.Header.Get("X-Forwarded-For"),
+		Method:    r.Method,
+		Path:      name,
+		Hostname:  headerValue(r, clientHostnameHeader),
+		MachineID: headerValue(r, clientMachineIDHeader),
+		Version:   headerValue(r, clientVersionHeader),
+	}
+}
+
+// headerValue returns the client-supplied header key of r, cut short and
+// stripped of control characters so that it cannot garble the logs.
+func headerValue(r *http.Request, key string) string {
+	v := strings.Map(func(c rune) rune {
+		if c < ' ' || c == 0x7f {
+			return -1
+		}
+		return c
+	}, r.Header.Get(key))
+	if len(v) > 128 {
+		v = v[:128]
+	}
+	return v
+}
+
+// clientIdentityHeaders returns the headers with which this machine
+// identifies itself to the keyserver, as "Name: value" lines.
+func (m *Manager) clientIdentityHeaders() []string {
+	headers := []string{clientVersionHeader + ": " + platform.ToolVersion()}
+	if host, err := os.Hostname(); err == nil {
+		headers = append(headers, clientHostnameHeader+": "+host)
+	}
+	if id := m.MachineID(); id != "" {
+		headers = append(headers, clientMachineIDHeader+": "+id)
+	}
+	return headers
+}
+
+// MachineID returns the systemd/D-Bus machine ID, or "" where there is
+// none.
+func (m *Manager) MachineID() string {
+	for _, p := range []string{"/etc/machine-id", "/var/lib/dbus/machine-id"} {
+		if data, err := m.sys.Host.ReadFile(p); err == nil {
+			if id := strings.TrimSpace(string(data)); id != "" {
+				return id
+			}
+		}
+	}
+	return ""
+}
+
+// AuditTail returns the last n lines of the audit log at path, reaching
+// into the most recently rotated log when the current one has fewer.
+func AuditTail(path string, n int) ([]string, error) {
+	var lines []string
+	for _, p := range []string{path + ".1", path} {
+		f, err := os.Open(p)
+		if os.IsNotExist(err) {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		scanner := bufio.NewScanner(f)
+		scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+		for scanner.Scan() {
+			lines = append(lines, scanner.Text())
+			if len(lines) > n {
+				lines = lines[1:]
+			}
+		}
+		f.Close()
+		if err := scanner.Err(); err != nil {
+			return nil, fmt.Errorf("%s: %w", p, err)
+		}
+	}
+	if lines == nil && !platform.FileExists(path) {
+		return nil, fmt.Errorf("%s does not exist; has bootstrap serve run here?", path)
+	}
+	return lines, nil
+}
@@ -0,0 +1,122 @@
+package sshkeys
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/sparkleHazard/bootstrap/internal/platform"
+)
+
+// keyserverPollInterval is how often WaitForKeyserver checks the keyserver.
+const keyserverPollInterval = 5 * time.Second
+
+// WaitForKeyserver waits, up to --keyserver-wait-timeout, until the
+// keyserver can hand out the key: an https keyserver's /healthz reports
+// ready or, with --wait-for-keyserver, an rsync keyserver lists the key.
+// Without --wait-for-keyserver an rsync keyserver is not waited for. The
+// status returned is how the wait ended, for the keyserver-wait step, or ""
+// when there was none.
+func (m *Manager) WaitForKeyserver(ctx context.Context) (string, error) {
+	src, err := m.cfg.KeyserverURL(m.DiscoveredKeyserver)
+	if err != nil {
+		return "", err
+	}
+	timeout := m.cfg.KeyserverWaitTimeout
+	if timeout <= 0 || (src.Scheme != "https" && !m.cfg.WaitForKeyserver) {
+		return "", nil
+	}
+	var check func() error
+	if src.Scheme == "https" {
+		health := *src
+		health.Path, health.RawQuery = HealthzPath, ""
+		check = func() error { return m.KeyserverHealthy(ctx, health.String()) }
+	} else {
+		token, err := m.BootstrapToken()
+		if err != nil {
+			return "", err
+		}
+		check = func() error { return m.KeyserverListsKey(ctx, src, token) }
+	}
+
+	m.sys.Log(fmt.Sprintf("Waiting up to %s for keyserver %s to be ready...", timeout, src.Redacted()))
+	start := time.Now()
+	last := ""
+	for {
+		err := check()
+		if err == nil {
+			m.sys.Log("Keyserver ready after " + time.Since(start).Round(time.Second).String() + ".")
+			return "ok", nil
+		}
+		var perm *platform.PermanentError
+		if errors.As(err, &perm) {
+			return "failed", perm.Err
+		}
+		if msg := err.Error(); msg != last {
+			m.sys.Log("Keyserver not ready yet: " + msg)
+			last = msg
+		}
+		if time.Since(start)+keyserverPollInterval > timeout {
+			return "timeout", fmt.Errorf("keyserver %s was not ready after %s: %w", src.Redacted(), timeout, err)
+		}
+		m.sys.StepRetries.Add(1)
+		select {
+		case <-ctx.Done():
+			return "interrupted", ctx.Err()
+		case <-time.After(keyserverPollInterval):
+		}
+	}
+}
+
+// KeyserverHealthy asks an https keyserver's health endpoint whether it has
+// keys to serve. A refused host is a permanent error.
+func (m *Manager) KeyserverHealthy(ctx context.Context, healthURL string) error {
+	args := []string{"-sS", "--max-time", "10", "-w", "\n%{http_code}"}
+	if m.cfg.KeyserverPin != "" {
+		args = append(args, "--insecure", "--pinnedpubkey", m.cfg.KeyserverPin)
+	}
+	args = append(args, healthURL)
+	cmd := m.sys.NewCommand(ctx, "curl", args...)
+	var stdout bytes.Buffer
+	stderr := &platform.TailBuffer{Max: platform.InstallOutputMax}
+	cmd.Stdout = &stdout
+	cmd.Stderr = stderr
+	if err := cmd.Run(); err != nil {
+		return fmt.Errorf("%s: %s", healthURL, platform.LastLine(stderr.Bytes(), err))
+	}
+	// The body, then the status code on a line of its own.
+	out := strings.TrimRight(stdout.String(), "\n")
+	i := strings.LastIndex(out, "\n")
+	body, code := out[:max(i, 0)], out[i+1:]
+	switch code {
+	case "200":
+		return nil
+	case "403":
+		return platform.Permanent(fmt.Errorf("%w: %s returned HTTP 403; add this host's address to the key server's --allow-cidr", ErrHostRefused, healthURL))
+	case "404":
+		return platform.Permanent(fmt.Errorf("%s returned HTTP 404; the keyserver has no health endpoint (not bootstrap serve?)", healthURL))
+	default:
+		return fmt.Errorf("%s returned HTTP %s: %s", healthURL, code, strings.TrimSpace(body))
+	}
+}
+
+// KeyserverListsKey checks that an rsync keyserver lists the key at src.
+func (m *Manager) KeyserverListsKey(ctx context.Context, src *url.URL, token string) error {
+	src, env := rsyncAuth(src, token)
+	cmd := m.sys.NewCommand(ctx, "rsync", "--list-only", "--contimeout=10", src.String())
+	cmd.Env = env
+	stderr := &platform.TailBuffer{Max: platform.InstallOutputMax}
+	cmd.Stderr = stderr
+	err := cmd.Run()
+	if err == nil {
+		return nil
+	}
+	if err := rsyncError(src, stderr.Bytes(), err); errors.As(err, new(*platform.PermanentError)) {
+		return err
+	}
+	return fmt.Errorf("%s: %s", src.Redacted(), platform.LastLine(stderr.Bytes(), err))
+}
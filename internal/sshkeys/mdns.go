@@ -0,0 +1,366 @@
+package sshkeys
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"net"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// mdnsService is the DNS-SD service type keyservers advertise.
+const mdnsService = "_bootstrap-keys._tcp.local."
+
+// mdnsGroup is the IPv4 mDNS multicast group and port.
+var mdnsGroup = &net.UDPAddr{IP: net.IPv4(224, 0, 0, 251), Port: 5353}
+
+// mdnsTTL is the TTL of the records the keyserver advertises, in seconds.
+const mdnsTTL = 120
+
+// DNS record types and the class used here.
+const (
+	dnsTypeA   = 1
+	dnsTypePTR = 12
+	dnsTypeTXT = 16
+	dnsTypeSRV = 33
+	dnsTypeANY = 255
+	dnsClassIN = 1
+)
+
+// FetchKeyserver returns the keyserver this host fetches the GitHub key
+// from, or nil for one that fetches none: the keyserver itself, or a host
+// given its key.
+func (m *Manager) FetchKeyserver() *url.URL {
+	if m.cfg.Role == "keyserver" || m.cfg.ProvidedKeySource() != "" {
+		return nil
+	}
+	u, err := m.cfg.KeyserverURL(m.DiscoveredKeyserver)
+	if err != nil {
+		return nil
+	}
+	return u
+}
+
+// ResolveKeyserver looks for a keyserver over mDNS for --keyserver auto,
+// falling back to --keyserver-fallback, with a logged note, when none
+// answers within --mdns-timeout.
+func (m *Manager) ResolveKeyserver(ctx context.Context) error {
+	m.sys.Log(fmt.Sprintf("Looking for a keyserver via mDNS (up to %s)...", m.cfg.MdnsTimeout))
+	loc, err := DiscoverKeyserver(ctx, m.cfg.MdnsTimeout)
+	if err == nil {
+		m.DiscoveredKeyserver = loc
+		if u, err := m.cfg.KeyserverURL(loc); err == nil {
+			m.sys.AllowKeyserver(u.Hostname())
+		}
+		m.sys.Log("Found keyserver " + loc + " via mDNS.")
+		return nil
+	}
+	if ctx.Err() != nil {
+		return ctx.Err()
+	}
+	if m.cfg.KeyserverFallback == "" {
+		return fmt.Errorf("keyserver discovery failed: %w; set keyserver-fallback or an explicit keyserver", err)
+	}
+	m.sys.Log("No keyserver found via mDNS (" + err.Error() + "); falling back to " + m.cfg.KeyserverFallback + ".")
+	return nil
+}
+
+// DiscoverKeyserver sends a one-shot mDNS query for mdnsService and returns
+// the location of the first keyserver that answers within timeout, built
+// from the answer's source address and its SRV and TXT records. The query
+// comes from an ephemeral port, so responders answer it directly (RFC 6762
+// section 6.7) rather than to the group.
+func DiscoverKeyserver(ctx context.Context, timeout time.Duration) (string, error) {
+	conn, err := net.ListenUDP("udp4", &net.UDPAddr{})
+	if err != nil {
+		return "", err
+	}
+	defer conn.Close()
+	deadline := time.Now().Add(timeout)
+	if d, ok := ctx.Deadline(); ok && d.Before(deadline) {
+		deadline = d
+	}
+	conn.SetDeadline(deadline)
+	stop := context.AfterFunc(ctx, func() { conn.SetDeadline(time.Now()) })
+	defer stop()
+
+	query := dnsHeader(0x4b53, 0, 1, 0)
+	query = appendQuestion(query, mdnsService, dnsTypePTR)
+	if _, err := conn.WriteToUDP(query, mdnsGroup); err != nil {
+		return "", fmt.Errorf("sending the query: %w", err)
+	}
+	buf := make([]byte, 9000)
+	for {
+		n, from, err := conn.ReadFromUDP(buf)
+		if err != nil {
+			var ne net.Error
+			if errors.As(err, &ne) && ne.Timeout() {
+				return "", fmt.Errorf("no answer within %s", timeout)
+			}
+			return "", err
+		}
+		if loc, ok := keyserverFromAnswer(buf[:n], from.IP); ok {
+			return loc, nil
+		}
+	}
+}
+
+// keyserverFromAnswer returns the keyserver location in the mDNS response
+// msg sent from ip, if it advertises one.
+func keyserverFromAnswer(msg []byte, ip net.IP) (string, bool) {
+	records, ok := parseDNSRecords(msg)
+	if !ok {
+		return "", false
+	}
+	var instance string
+	for _, r := range records {
+		if r.typ == dnsTypePTR && strings.EqualFold(r.name, mdnsService) {
+			instance, _, _ = readName(msg, r.dataOff)
+			break
+		}
+	}
+	if instance == "" {
+		return "", false
+	}
+	port := 0
+	txt := map[string]string{}
+	for _, r := range records {
+		if !strings.EqualFold(r.name, instance) {
+			continue
+		}
+		switch r.typ {
+		case dnsTypeSRV:
+			if len(r.data) >= 6 {
+				port = int(binary.BigEndian.Uint16(r.data[4:6]))
+			}
+		case dnsTypeTXT:
+			for d := r.data; len(d) > 0 && int(d[0]) < len(d); d = d[1+int(d[0]):] {
+				k, v, _ := strings.Cut(string(d[1:1+int(d[0])]), "=")
+				txt[strings.ToLower(k)] = v
+			}
+		}
+	}
+	scheme := txt["scheme"]
+	if port == 0 || (scheme != "https" && scheme != "rsync") {
+		return "", false
+	}
+	return scheme + "://" + net.JoinHostPort(ip.String(), strconv.Itoa(port)) + "/" + strings.TrimPrefix(txt["path"], "/"), true
+}
+
+// advertiseKeyserver answers mDNS queries for mdnsService on the default
+// interface until ctx is done, pointing clients at scheme://HOST:port/path.
+// It announces the service once on start.
+func (m *Manager) advertiseKeyserver(ctx context.Context, scheme string, port int, path string) error {
+	conn, err := net.ListenMulticastUDP("udp4", nil, mdnsGroup)
+	if err != nil {
+		return err
+	}
+	context.AfterFunc(ctx, func() { conn.Close() })
+
+	host, _ := os.Hostname()
+	host, _, _ = strings.Cut(host, ".")
+	if host == "" {
+		host = "keyserver"
+	}
+	instance := host + "." + mdnsService
+	target := host + ".local."
+	records := func() ([]byte, int) {
+		var rr []byte
+		n := 0
+		rr = appendRecord(rr, mdnsService, dnsTypePTR, encodeName(nil, instance))
+		srv := binary.BigEndian.AppendUint16(make([]byte, 4), uint16(port))
+		rr = appendRecord(rr, instance, dnsTypeSRV, encodeName(srv, target))
+		txt := encodeTXT("scheme="+scheme, "path="+path)
+		rr = appendRecord(rr, instance, dnsTypeTXT, txt)
+		n += 3
+		if addrs, err := net.InterfaceAddrs(); err == nil {
+			for _, a := range addrs {
+				if ipnet, ok := a.(*net.IPNet); ok && !ipnet.IP.IsLoopback() && ipnet.IP.To4() != nil {
+					rr = appendRecord(rr, target, dnsTypeA, ipnet.IP.To4())
+					n++
+				}
+			}
+		}
+		return rr, n
+	}
+
+	rr, n := records()
+	conn.WriteToUDP(append(dnsHeader(0, 0x8400, 0, n), rr...), mdnsGroup)
+	m.sys.Log(fmt.Sprintf("Advertising %s as %s via mDNS.", mdnsService, instance))
+
+	buf := make([]byte, 9000)
+	for {
+		size, from, err := conn.ReadFromUDP(buf)
+		if err != nil {
+			if ctx.Err() != nil {
+				return nil
+			}
+			return err
+		}
+		msg := buf[:size]
+		if !asksFor(msg, mdnsService, instance) {
+			continue
+		}
+		rr, n := records()
+		if from.Port != mdnsGroup.Port {
+			// A legacy one-shot query: answer the sender directly, echoing
+			// its ID and question.
+			resp := dnsHeader(binary.BigEndian.Uint16(msg), 0x8400, 1, n)
+			resp = appendQuestion(resp, mdnsService, dnsTypePTR)
+			conn.WriteToUDP(append(resp, rr...), from)
+			continue
+		}
+		conn.WriteToUDP(append(dnsHeader(0, 0x8400, 0, n), rr...), mdnsGroup)
+	}
+}
+
+// asksFor reports whether msg is a query with a question about one of names.
+func asksFor(msg []byte, names ...string) bool {
+	if len(msg) < 12 || msg[2]&0x80 != 0 {
+		return false
+	}
+	off := 12
+	for i := 0; i < int(binary.BigEndian.Uint16(msg[4:6])); i++ {
+		name, next, ok := readName(msg, off)
+		if !ok || next+4 > len(msg) {
+			return false
+		}
+		typ := binary.BigEndian.Uint16(msg[next:])
+		off = next + 4
+		for _, n := range names {
+			if strings.EqualFold(name, n) && (typ == dnsTypePTR || typ == dnsTypeSRV || typ == dnsTypeTXT || typ == dnsTypeANY) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// dnsRecord is a resource record of a parsed DNS message. dataOff is the
+// offset of its data in the message, for names compressed against it.
+type dnsRecord struct {
+	name    string
+	typ     uint16
+	data    []byte
+	dataOff int
+}
+
+// parseDNSRecords returns the answer, authority and additional records of
+// the DNS response msg.
+func parseDNSRecords(msg []byte) ([]dnsRecord, bool) {
+	if len(msg) < 12 || msg[2]&0x80 == 0 {
+		return nil, false
+	}
+	qd := int(binary.BigEndian.Uint16(msg[4:6]))
+	rrs := int(binary.BigEndian.Uint16(msg[6:8])) + int(binary.BigEndian.Uint16(msg[8:10])) + int(binary.BigEndian.Uint16(msg[10:12]))
+	off := 12
+	for i := 0; i < qd; i++ {
+		_, next, ok := readName(msg, off)
+		if !ok {
+			return nil, false
+		}
+		off = next + 4
+	}
+	var records []dnsRecord
+	for i := 0; i < rrs; i++ {
+		name, next, ok := readName(msg, off)
+		if !ok || next+10 > len(msg) {
+			return nil, false
+		}
+		typ := binary.BigEndian.Uint16(msg[next:])
+		length := int(binary.BigEndian.Uint16(msg[next+8:]))
+		start := next + 10
+		if start+length > len(msg) {
+			return nil, false
+		}
+		records = append(records, dnsRecord{name: name, typ: typ, data: msg[start : start+length], dataOff: start})
+		off = start + length
+	}
+	return records, true
+}
+
+// readName decodes the possibly compressed domain name at off in msg,
+// returning it with a trailing dot and the offset just past it.
+func readName(msg []byte, off int) (string, int, bool) {
+	var labels []string
+	next := -1
+	for hops := 0; hops < 32; hops++ {
+		if off >= len(msg) {
+			return "", 0, false
+		}
+		l := int(msg[off])
+		switch {
+		case l == 0:
+			if next < 0 {
+				next = off + 1
+			}
+			return strings.Join(labels, ".") + ".", next, true
+		case l&0xc0 == 0xc0:
+			if off+1 >= len(msg) {
+				return "", 0, false
+			}
+			if next < 0 {
+				next = off + 2
+			}
+			off = int(binary.BigEndian.Uint16(msg[off:]) & 0x3fff)
+		default:
+			if off+1+l > len(msg) {
+				return "", 0, false
+			}
+			labels = append(labels, string(msg[off+1:off+1+l]))
+			off += 1 + l
+		}
+	}
+	return "", 0, false
+}
+
+// dnsHeader returns a DNS message header.
+func dnsHeader(id, flags uint16, questions, answers int) []byte {
+	h := make([]byte, 12)
+	binary.BigEndian.PutUint16(h[0:], id)
+	binary.BigEndian.PutUint16(h[2:], flags)
+	binary.BigEndian.PutUint16(h[4:], uint16(questions))
+	binary.BigEndian.PutUint16(h[6:], uint16(answers))
+	return h
+}
+
+// encodeName appends the uncompressed wire form of name to b.
+func encodeName(b []byte, name string) []byte {
+	for _, label := range strings.Split(strings.TrimSuffix(name, "."), ".") {
+		b = append(b, byte(len(label)))
+		b = append(b, label...)
+	}
+	return append(b, 0)
+}
+
+// encodeTXT returns TXT record data holding strs.
+func encodeTXT(strs ...string) []byte {
+	var b []byte
+	for _, s := range strs {
+		b = append(b, byte(len(s)))
+		b = append(b, s...)
+	}
+	return b
+}
+
+// appendQuestion appends a question for name and typ to msg.
+func appendQuestion(msg []byte, name string, typ uint16) []byte {
+	msg = encodeName(msg, name)
+	msg = binary.BigEndian.AppendUint16(msg, typ)
+	return binary.BigEndian.AppendUint16(msg, dnsClassIN)
+}
+
+// appendRecord appends a resource record of name and typ holding data.
+func appendRecord(msg []byte, name string, typ uint16, data []byte) []byte {
+	msg = encodeName(msg, name)
+	msg = binary.BigEndian.AppendUint16(msg, typ)
+	msg = binary.BigEndian.AppendUint16(msg, dnsClassIN)
+	msg = binary.BigEndian.AppendUint32(msg, mdnsTTL)
+	msg = binary.BigEndian.AppendUint16(msg, uint16(len(data)))
+	return append(msg, data...)
+}
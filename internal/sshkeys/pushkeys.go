@@ -0,0 +1,172 @@
+package sshkeys
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/sparkleHazard/bootstrap/internal/platform"
+)
+
+// pushHostTimeout bounds the time spent on one host by push-keys, so that a
+// hung connection does not hold up the rest of the fleet.
+const pushHostTimeout = 2 * time.Minute
+
+// PushKeyScript runs on each host under "sh -c", with the key on stdin,
+// after a line setting key to where it goes. It places the key the way
+// FetchGithubPrivateKey does: written to a private temporary file beside it
+// and renamed over the old key only if it differs.
+const PushKeyScript = `set -e
+umask 077
+dir=$(dirname "$key")
+mkdir -p "$dir"
+chmod 700 "$dir"
+tmp=$(mktemp "$dir/.$(basename "$key").XXXXXX")
+trap 'rm -f "$tmp"' EXIT
+cat > "$tmp"
+chmod 600 "$tmp"
+if [ -f "$key" ] && cmp -s "$tmp" "$key"; then
+	echo unchanged
+else
+	mv -f "$tmp" "$key"
+	echo updated
+fi
+`
+
+// PushVerifyScript is appended to PushKeyScript by --verify: the host tries
+// the key against GitHub, like the keyserver role checks its own.
+const PushVerifyScript = `if ssh -T -o BatchMode=yes -o StrictHostKeyChecking=accept-new -i "$key" git@github.com 2>&1 | grep -qi "successfully authenticated"; then
+	echo verified
+else
+	echo verify-failed
+fi
+`
+
+// PushResult is the outcome of pushing the key to one host.
+type PushResult struct {
+	Host   string `json:"host"`
+	Status string `json:"status"` // updated, unchanged or failed
+	Verify string `json:"verify,omitempty"`
+	Error  string `json:"error,omitempty"`
+}
+
+// PushHosts returns the hosts from the comma-separated list and the hosts
+// file, in that order and without duplicates. Blank lines and # comments in
+// the file are ignored.
+func PushHosts(list, file string) ([]string, error) {
+	var hosts []string
+	seen := map[string]bool{}
+	add := func(h string) {
+		if h = strings.TrimSpace(h); h != "" && !seen[h] {
+			seen[h] = true
+			hosts = append(hosts, h)
+		}
+	}
+	for _, h := range strings.Split(list, ",") {
+		add(h)
+	}
+	if file != "" {
+		f, err := os.Open(file)
+		if err != nil {
+			return nil, fmt.Errorf("hosts-file: %w", err)
+		}
+		defer f.Close()
+		scanner := bufio.NewScanner(f)
+		for scanner.Scan() {
+			line, _, _ := strings.Cut(scanner.Text(), "#")
+			add(line)
+		}
+		if err := scanner.Err(); err != nil {
+			return nil, fmt.Errorf("hosts-file: %w", err)
+		}
+	}
+	for _, h := range hosts {
+		if strings.HasPrefix(h, "-") || strings.ContainsAny(h, " \t") {
+			return nil, fmt.Errorf("invalid host %q", h)
+		}
+	}
+	return hosts, nil
+}
+
+// PushKey runs script on host over SSH with key on its stdin, and returns
+// the outcome the script reports.
+func (m *Manager) PushKey(ctx context.Context, host, identity, script string, key []byte) PushResult {
+	res := PushResult{Host: host, Status: "failed"}
+	ctx, cancel := context.WithTimeout(ctx, pushHostTimeout)
+	defer cancel()
+
+	args := []string{"-o", "BatchMode=yes", "-o", "ConnectTimeout=10"}
+	if identity != "" {
+		args = append(args, "-i", identity)
+	}
+	target, port := SplitSSHPort(host)
+	if port != "" {
+		args = append(args, "-p", port)
+	}
+	args = append(args, target, "sh -c "+platform.ShellQuote(script))
+
+	cmd := m.sys.NewCommand(ctx, "ssh", args...)
+	cmd.Stdin = bytes.NewReader(key)
+	var stdout bytes.Buffer
+	stderr := &platform.TailBuffer{Max: platform.InstallOutputMax}
+	cmd.Stdout = &stdout
+	cmd.Stderr = stderr
+	err := cmd.Run()
+	for _, line := range strings.Fields(stdout.String()) {
+		switch line {
+		case "updated", "unchanged":
+			res.Status = line
+		case "verified":
+			res.Verify = "ok"
+		case "verify-failed":
+			res.Verify = "failed"
+			res.Error = "GitHub did not accept the key"
+		}
+	}
+	if err != nil {
+		res.Status = "failed"
+		msg := strings.TrimSpace(string(stderr.Bytes()))
+		if i := strings.LastIndex(msg, "\n"); i >= 0 {
+			msg = msg[i+1:]
+		}
+		if ctx.Err() == context.DeadlineExceeded {
+			msg = "timed out after " + pushHostTimeout.String()
+		} else if msg == "" {
+			msg = err.Error()
+		}
+		res.Error = msg
+	}
+	return res
+}
+
+// Summary describes r in one line for the progress log.
+func (r PushResult) Summary() string {
+	s := r.Status
+	if r.Verify != "" {
+		s += ", verify " + r.Verify
+	}
+	if r.Error != "" {
+		s += ": " + r.Error
+	}
+	return s
+}
+
+// SplitSSHPort splits host, [user@]host[:port] or [user@][v6addr]:port,
+// into the ssh destination and the port, if any.
+func SplitSSHPort(host string) (target, port string) {
+	if at := strings.LastIndex(host, "]:"); strings.Contains(host, "[") && at > 0 {
+		user, addr, _ := strings.Cut(host[:at], "[")
+		return user + addr, host[at+2:]
+	}
+	if h, p, ok := strings.Cut(host, ":"); ok && !strings.Contains(p, ":") {
+		if _, err := strconv.Atoi(p); err == nil {
+			return h, p
+		}
+	}
+	return host, ""
+}
@@ -0,0 +1,198 @@
+package sshkeys
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/sparkleHazard/bootstrap/internal/config"
+	"github.com/sparkleHazard/bootstrap/internal/platform"
+)
+
+// rsyncdConfPath is the rsync daemon configuration --setup-rsyncd manages.
+const rsyncdConfPath = "/etc/rsyncd.conf"
+
+// rsyncdModule is the module the default --keyserver location fetches from.
+const rsyncdModule = "keys"
+
+// rsyncdConfHeader starts the configuration bootstrap writes, and tells a
+// file it manages from one it would be overwriting.
+const rsyncdConfHeader = "# Managed by bootstrap --setup-rsyncd; local changes are overwritten.\n"
+
+// AvahiServicePath is the Avahi service file advertising the rsync daemon
+// for --keyserver auto.
+const AvahiServicePath = "/etc/avahi/services/bootstrap-keys.service"
+
+// avahiRsyncdService advertises the keys module as mdnsService, with the
+// TXT records DiscoverKeyserver expects.
+const avahiRsyncdService = `<?xml version="1.0" standalone='no'?>
+<!DOCTYPE service-group SYSTEM "avahi-service.dtd">
+<service-group>
+  <name replace-wildcards="yes">%h</name>
+  <service>
+    <type>_bootstrap-keys._tcp</type>
+    <port>873</port>
+    <txt-record>scheme=rsync</txt-record>
+    <txt-record>path=` + rsyncdModule + `/` + GithubKeyName + `</txt-record>
+  </service>
+</service-group>
+`
+
+// rsyncdService returns the systemd unit running the rsync daemon on osID,
+// and the package that ships it when the rsync package does not.
+func rsyncdService(osID string) (unit, pkg string, err error) {
+	switch osID {
+	case "ubuntu", "debian":
+		return "rsync.service", "", nil
+	case "fedora", "centos", "redhat":
+		return "rsyncd.service", "rsync-daemon", nil
+	default:
+		return "", "", fmt.Errorf("setting up an rsync daemon is not supported on %q", osID)
+	}
+}
+
+// renderRsyncdConf returns an rsyncd.conf exporting dir, read-only and
+// unlisted, as the keys module to the hosts in allow. The daemon reads the
+// files as root, so they can stay private to root.
+func renderRsyncdConf(dir string, allow config.CIDRList) string {
+	hosts := make([]string, len(allow))
+	for i, p := range allow {
+		hosts[i] = p.String()
+	}
+	var b strings.Builder
+	b.WriteString(rsyncdConfHeader)
+	fmt.Fprintf(&b, "\n[%s]\n", rsyncdModule)
+	fmt.Fprintf(&b, "\tpath = %s\n", dir)
+	b.WriteString("\tcomment = bootstrap keys\n")
+	b.WriteString("\tread only = yes\n")
+	b.WriteString("\tlist = no\n")
+	b.WriteString("\tuse chroot = yes\n")
+	b.WriteString("\tuid = root\n")
+	b.WriteString("\tgid = root\n")
+	fmt.Fprintf(&b, "\thosts allow = %s\n", strings.Join(hosts, " "))
+	b.WriteString("\thosts deny = *\n")
+	return b.String()
+}
+
+// SetupRsyncd makes this keyserver export the GitHub private key, and the
+// vault password file if there is one, over an rsync daemon: it writes
+// rsyncd.conf, copies the files into cfg.ServeDir with root-only modes,
+// and enables and starts the daemon. It is idempotent and reports whether
+// anything changed.
+func (m *Manager) SetupRsyncd(ctx context.Context, osID string) (bool, error) {
+	unit, pkg, err := rsyncdService(osID)
+	if err != nil {
+		return false, err
+	}
+	if m.sys.NewCommand(ctx, "systemctl", "cat", unit).Run() != nil && pkg != "" {
+		m.sys.Log(unit + " not found. Installing " + pkg + "...")
+		manager := "dnf"
+		if osID != "fedora" {
+			manager = "yum"
+		}
+		if err := m.sys.RunPkgCmd(ctx, manager, "install", "-y", pkg); err != nil {
+			return false, fmt.Errorf("installing %s: %w", pkg, err)
+		}
+		m.sys.RecordIrreversible("installed " + pkg)
+	}
+
+	homeDir, err := m.sys.Host.HomeDir()
+	if err != nil {
+		return false, fmt.Errorf("unable to determine home directory: %w", err)
+	}
+	keyPath, err := m.GithubKeyPath(m.sys.Host)
+	if err != nil {
+		return false, err
+	}
+	exports := map[string]string{GithubKeyName: keyPath}
+	if vault := filepath.Join(homeDir, m.cfg.VaultPassFile); platform.FileExists(vault) {
+		exports[filepath.Base(m.cfg.VaultPassFile)] = vault
+	} else if m.cfg.Verbose {
+		m.sys.Log("No vault password file at " + vault + "; not exporting one.")
+	}
+
+	dir := m.cfg.ServeDir
+	_, err = os.Stat(dir)
+	changed := os.IsNotExist(err)
+	for _, args := range [][]string{
+		{"mkdir", "-p", dir},
+		{"chown", "root:root", dir},
+		{"chmod", "0700", dir},
+	} {
+		if err := m.sys.RunCmdSudo(ctx, args[0], args[1:]...); err != nil {
+			return false, fmt.Errorf("%s %s failed: %w", args[0], dir, err)
+		}
+	}
+	for name, src := range exports {
+		data, err := os.ReadFile(src)
+		if err != nil {
+			return false, fmt.Errorf("reading %s: %w", src, err)
+		}
+		if name == GithubKeyName && len(m.cfg.AgeRecipients) > 0 {
+			c, err := m.publishEncryptedKey(ctx, filepath.Join(dir, name+config.AgeSuffix), data)
+			if err != nil {
+				return false, err
+			}
+			changed = changed || c
+			// Only the encrypted key is published.
+			if plain := filepath.Join(dir, name); platform.FileExists(plain) {
+				if err := m.sys.RunCmdSudo(ctx, "rm", "-f", plain); err != nil {
+					return false, fmt.Errorf("removing the unencrypted %s failed: %w", plain, err)
+				}
+				changed = true
+			}
+			continue
+		}
+		c, err := m.sys.WriteFile(ctx, filepath.Join(dir, name), data, 0600, platform.RootOwner)
+		if err != nil {
+			return false, err
+		}
+		changed = changed || c
+	}
+
+	conf := renderRsyncdConf(dir, m.cfg.AllowCIDRs)
+	confPath := m.sys.Host.Path(rsyncdConfPath)
+	if old, err := os.ReadFile(confPath); err == nil && !bytes.HasPrefix(old, []byte(rsyncdConfHeader)) {
+		backup := confPath + ".orig"
+		if !platform.FileExists(backup) {
+			if err := m.sys.RunCmdSudo(ctx, "cp", "-p", confPath, backup); err != nil {
+				return false, fmt.Errorf("backing up %s failed: %w", confPath, err)
+			}
+			m.sys.Log("Saved the existing " + confPath + " as " + backup + ".")
+		}
+	}
+	c, err := m.sys.WriteFile(ctx, confPath, []byte(conf), 0644, platform.RootOwner)
+	if err != nil {
+		return false, err
+	}
+	changed = changed || c
+	if m.cfg.MdnsAdvertise {
+		if fi, err := os.Stat(m.sys.Host.Path(filepath.Dir(AvahiServicePath))); err != nil || !fi.IsDir() {
+			m.sys.Log("Avahi is not installed; not advertising the rsync daemon over mDNS.")
+		} else {
+			c, err := m.sys.WriteFile(ctx, m.sys.Host.Path(AvahiServicePath), []byte(avahiRsyncdService), 0644, platform.RootOwner)
+			if err != nil {
+				return false, err
+			}
+			changed = changed || c
+		}
+	}
+	if changed {
+		m.sys.RecordIrreversible("exported keys over rsync from " + dir)
+	}
+
+	// The daemon rereads its configuration for every connection, so it
+	// needs no restart when the file changes.
+	if err := m.sys.RunCmdSudo(ctx, "systemctl", "enable", "--now", unit); err != nil {
+		return false, fmt.Errorf("systemctl enable --now %s failed: %w", unit, err)
+	}
+	if changed {
+		m.sys.Log(fmt.Sprintf("rsync daemon (%s) exports %s as module %q to %s.", unit, dir, rsyncdModule, m.cfg.AllowCIDRs.String()))
+	} else {
+		m.sys.Log("rsync daemon setup is up to date.")
+	}
+	return changed, nil
+}
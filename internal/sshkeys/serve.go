@@ -0,0 +1,369 @@
+package sshkeys
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/base64"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"math/big"
+	"net"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/sparkleHazard/bootstrap/internal/config"
+	"github.com/sparkleHazard/bootstrap/internal/platform"
+	"github.com/sparkleHazard/bootstrap/internal/service"
+)
+
+// serveShutdownTimeout is how long in-flight requests get to finish after
+// SIGINT or SIGTERM before the key server exits anyway.
+const serveShutdownTimeout = 10 * time.Second
+
+// serveCertValidity is the lifetime of a generated self-signed certificate.
+// Clients pin its public key, so expiry is not what protects them.
+const serveCertValidity = 10 * 365 * 24 * time.Hour
+
+// ServeUnitPath is where "serve --install-unit" writes the server's unit.
+const ServeUnitPath = "/etc/systemd/system/bootstrap-keyserver.service"
+
+// ServeKeys serves cfg.ServeDir over HTTPS on cfg.ServeAddr until ctx is
+// cancelled, then shuts down gracefully.
+func (m *Manager) ServeKeys(ctx context.Context) error {
+	if fi, err := os.Stat(m.cfg.ServeDir); err != nil || !fi.IsDir() {
+		return fmt.Errorf("serve-dir %s is not a directory", m.cfg.ServeDir)
+	}
+	cert, err := m.serveCertificate(ctx)
+	if err != nil {
+		return err
+	}
+	tokens, err := m.serveTokensPath()
+	if err != nil {
+		return err
+	}
+	auditPath, err := m.ServeAuditPath()
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(auditPath), 0755); err != nil {
+		return err
+	}
+	audit := &auditLog{path: auditPath, maxSize: int64(m.cfg.ServeAuditMaxSize), sys: m.sys}
+	m.sys.Log("Recording requests in " + auditPath)
+	if !platform.FileExists(tokens) {
+		m.sys.Log("Warning: " + tokens + " does not exist, so every request will be refused; issue a token with bootstrap serve --issue-token.")
+	}
+	srv := &http.Server{
+		Addr:              m.cfg.ServeAddr,
+		Handler:           m.keyHandler(m.cfg.ServeDir, tokens, m.cfg.AllowCIDRs, m.cfg.TrustProxy, audit),
+		TLSConfig:         &tls.Config{Certificates: []tls.Certificate{cert}, MinVersion: tls.VersionTLS12},
+		ReadHeaderTimeout: 10 * time.Second,
+	}
+
+	if m.cfg.MdnsAdvertise {
+		_, portStr, _ := net.SplitHostPort(m.cfg.ServeAddr)
+		port, _ := strconv.Atoi(portStr)
+		go func() {
+			if err := m.advertiseKeyserver(ctx, "https", port, GithubKeyName); err != nil {
+				m.sys.Log("Warning: mDNS advertisement failed: " + err.Error())
+			}
+		}()
+	}
+
+	shutdownDone := make(chan error, 1)
+	go func() {
+		<-ctx.Done()
+		shutdownCtx, cancel := context.WithTimeout(context.Background(), serveShutdownTimeout)
+		defer cancel()
+		shutdownDone <- srv.Shutdown(shutdownCtx)
+	}()
+
+	if len(m.cfg.AllowCIDRs) > 0 {
+		m.sys.Log("Accepting requests only from " + m.cfg.AllowCIDRs.String())
+	}
+	m.sys.Log("Serving " + m.cfg.ServeDir + " on https://" + m.cfg.ServeAddr + "/")
+	if err := srv.ListenAndServeTLS("", ""); !errors.Is(err, http.ErrServerClosed) {
+		return err
+	}
+	if err := <-shutdownDone; err != nil {
+		return fmt.Errorf("shutting down: %w", err)
+	}
+	m.sys.Log("Key server stopped.")
+	return nil
+}
+
+// keyHandler serves the regular files under dir to clients whose address
+// allow admits that carry a token valid in the tokens file, logging every
+// request with the client's address and recording it in audit. Directories
+// are not listed. HealthzPath answers whether there are keys to serve,
+// without a token, and is not audited.
+func (m *Manager) keyHandler(dir, tokens string, allow config.CIDRList, trustProxy bool, audit *auditLog) http.Handler {
+	root := http.Dir(dir)
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		name := path.Clean("/" + r.URL.Path)
+		entry := newAuditEntry(r, name)
+		client := r.RemoteAddr
+		addr, err := clientAddr(r, trustProxy)
+		if err == nil && trustProxy && r.Header.Get("X-Forwarded-For") != "" {
+			client = addr.String() + " via " + r.RemoteAddr
+		}
+		if entry.Hostname != "" {
+			client += " (" + entry.Hostname + ")"
+		}
+		refuse := func(status int, result, reason string) {
+			entry.Status, entry.Result, entry.Reason = status, result, reason
+			audit.record(entry)
+			m.sys.Log(fmt.Sprintf("%s: %s request for %s: %s", client, result, name, reason))
+			if status == http.StatusUnauthorized {
+				w.Header().Set("WWW-Authenticate", `Bearer realm="bootstrap"`)
+			}
+			http.Error(w, strings.ToLower(http.StatusText(status)), status)
+		}
+
+		if r.Method != http.MethodGet && r.Method != http.MethodHead {
+			w.Header().Set("Allow", "GET, HEAD")
+			refuse(http.StatusMethodNotAllowed, "malformed", "method "+r.Method+" not allowed")
+			return
+		}
+		if err != nil {
+			refuse(http.StatusForbidden, "denied", err.Error())
+			return
+		}
+		if !allow.Allows(addr) {
+			refuse(http.StatusForbidden, "denied", "not in allow-cidr")
+			return
+		}
+		if name == HealthzPath {
+			// Unauthenticated, so that clients can wait for the server
+			// before presenting their token.
+			if err := keysReady(dir); err != nil {
+				http.Error(w, "not ready: "+err.Error(), http.StatusServiceUnavailable)
+				return
+			}
+			fmt.Fprintln(w, "ready")
+			return
+		}
+		token := requestToken(r)
+		if token != "" {
+			entry.TokenID = tokenHash(token)[:12]
+		}
+		label, err := checkToken(tokens, token)
+		entry.Token = label
+		if err != nil {
+			refuse(http.StatusUnauthorized, "unauthorized", err.Error())
+			return
+		}
+		if label != "" {
+			label = " (token " + label + ")"
+		}
+		f, err := root.Open(name)
+		if err != nil {
+			refuse(http.StatusNotFound, "not-found", "no such key")
+			return
+		}
+		defer f.Close()
+		fi, err := f.Stat()
+		if err != nil || fi.IsDir() {
+			refuse(http.StatusNotFound, "not-found", "no such key")
+			return
+		}
+		entry.Status, entry.Result = http.StatusOK, "served"
+		audit.record(entry)
+		m.sys.Log(fmt.Sprintf("%s: serving %s%s", client, name, label))
+		http.ServeContent(w, r, fi.Name(), fi.ModTime(), f)
+	})
+}
+
+// HealthzPath is the key server's readiness endpoint.
+const HealthzPath = "/healthz"
+
+// keysReady reports why dir has no key to serve yet: it must hold at least
+// one regular file that can be opened for reading.
+func keysReady(dir string) error {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return err
+	}
+	for _, e := range entries {
+		if !e.Type().IsRegular() {
+			continue
+		}
+		if f, err := os.Open(filepath.Join(dir, e.Name())); err == nil {
+			f.Close()
+			return nil
+		}
+	}
+	return fmt.Errorf("no readable keys in %s", dir)
+}
+
+// serveCertificate returns the certificate from --serve-cert and
+// --serve-key, or else a self-signed one kept in the state directory and
+// generated on first use, and logs the pin clients pass as --keyserver-pin.
+func (m *Manager) serveCertificate(ctx context.Context) (tls.Certificate, error) {
+	certPath, keyPath := m.cfg.ServeCert, m.cfg.ServeKey
+	if certPath == "" {
+		dir, err := m.sys.StateDir()
+		if err != nil {
+			return tls.Certificate{}, err
+		}
+		certPath = filepath.Join(dir, "serve-cert.pem")
+		keyPath = filepath.Join(dir, "serve-key.pem")
+		if !platform.FileExists(certPath) || !platform.FileExists(keyPath) {
+			if err := m.generateServeCert(ctx, certPath, keyPath); err != nil {
+				return tls.Certificate{}, fmt.Errorf("generating a self-signed certificate: %w", err)
+			}
+			m.sys.Log("Generated a self-signed certificate at " + certPath)
+		}
+	}
+	cert, err := tls.LoadX509KeyPair(certPath, keyPath)
+	if err != nil {
+		return tls.Certificate{}, fmt.Errorf("loading %s: %w", certPath, err)
+	}
+	leaf, err := x509.ParseCertificate(cert.Certificate[0])
+	if err != nil {
+		return tls.Certificate{}, fmt.Errorf("parsing %s: %w", certPath, err)
+	}
+	m.sys.Log("Certificate public key pin: " + publicKeyPin(leaf) + " (clients: --keyserver-pin)")
+	return cert, nil
+}
+
+// publicKeyPin returns the curl --pinnedpubkey form of cert's public key:
+// "sha256//" and the base64 SHA-256 of its SubjectPublicKeyInfo.
+func publicKeyPin(cert *x509.Certificate) string {
+	sum := sha256.Sum256(cert.RawSubjectPublicKeyInfo)
+	return "sha256//" + base64.StdEncoding.EncodeToString(sum[:])
+}
+
+// generateServeCert writes a self-signed ECDSA certificate for this host's
+// name and addresses to certPath, and its key to keyPath.
+func (m *Manager) generateServeCert(ctx context.Context, certPath, keyPath string) error {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return err
+	}
+	serial, err := rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 128))
+	if err != nil {
+		return err
+	}
+	host, _ := os.Hostname()
+	tmpl := &x509.Certificate{
+		SerialNumber: serial,
+		Subject:      pkix.Name{CommonName: host},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(serveCertValidity),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+		DNSNames:     []string{"localhost"},
+	}
+	if host != "" {
+		tmpl.DNSNames = append(tmpl.DNSNames, host)
+	}
+	if addrs, err := net.InterfaceAddrs(); err == nil {
+		for _, a := range addrs {
+			if ipnet, ok := a.(*net.IPNet); ok {
+				tmpl.IPAddresses = append(tmpl.IPAddresses, ipnet.IP)
+			}
+		}
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	if err != nil {
+		return err
+	}
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(certPath), 0755); err != nil {
+		return err
+	}
+	if _, err := m.sys.WriteFile(ctx, keyPath, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER}), 0600, ""); err != nil {
+		return err
+	}
+	_, err = m.sys.WriteFile(ctx, certPath, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0644, "")
+	return err
+}
+
+// InstallServeUnit writes, enables and starts a systemd unit running this
+// binary's key server with the current serve settings. The certificate is
+// prepared first so that its pin is printed here.
+func (m *Manager) InstallServeUnit() error {
+	ctx := context.Background()
+	if m.sys.Host.EUID() != 0 {
+		return platform.WithExitCode(platform.ExitPrivileges, errors.New("--install-unit must be run as root"))
+	}
+	if _, err := m.serveCertificate(ctx); err != nil {
+		return err
+	}
+	exe, err := os.Executable()
+	if err != nil {
+		return err
+	}
+	if resolved, err := filepath.EvalSymlinks(exe); err == nil {
+		exe = resolved
+	}
+
+	args := []string{exe, "serve", "--serve-addr=" + m.cfg.ServeAddr, "--serve-dir=" + m.cfg.ServeDir}
+	if m.cfg.ServeCert != "" {
+		args = append(args, "--serve-cert="+m.cfg.ServeCert, "--serve-key="+m.cfg.ServeKey)
+	}
+	if m.cfg.ServeTokensFile != "" {
+		args = append(args, "--serve-tokens-file="+m.cfg.ServeTokensFile)
+	}
+	if m.cfg.ServeAuditLog != "" {
+		args = append(args, "--serve-audit-log="+m.cfg.ServeAuditLog)
+	}
+	args = append(args, "--serve-audit-max-size="+m.cfg.ServeAuditMaxSize.String())
+	for _, p := range m.cfg.AllowCIDRs {
+		args = append(args, "--allow-cidr="+p.String())
+	}
+	if m.cfg.TrustProxy {
+		args = append(args, "--trust-proxy")
+	}
+	args = append(args, "--mdns-advertise="+strconv.FormatBool(m.cfg.MdnsAdvertise))
+	if m.cfg.ConfigFile != "" && platform.FileExists(m.cfg.ConfigFile) {
+		args = append(args, "--config="+m.cfg.ConfigFile)
+	}
+	for i, a := range args {
+		args[i] = service.SystemdQuote(a)
+	}
+	unit := fmt.Sprintf(`[Unit]
+Description=Bootstrap HTTPS key server
+After=network-online.target
+Wants=network-online.target
+
+[Service]
+ExecStart=%s
+Restart=on-failure
+RestartSec=5s
+
+[Install]
+WantedBy=multi-user.target
+`, strings.Join(args, " "))
+
+	if _, err := m.sys.WriteFile(ctx, m.sys.Host.Path(ServeUnitPath), []byte(unit), 0644, ""); err != nil {
+		return err
+	}
+	if err := m.sys.RestoreContexts(ctx, false, m.sys.Host.Path(ServeUnitPath)); err != nil {
+		return err
+	}
+	if err := m.sys.RunCmd(ctx, "systemctl", "daemon-reload"); err != nil {
+		return fmt.Errorf("systemctl daemon-reload failed: %w", err)
+	}
+	if err := m.sys.RunCmd(ctx, "systemctl", "enable", "--now", filepath.Base(ServeUnitPath)); err != nil {
+		return fmt.Errorf("systemctl enable --now %s failed: %w", filepath.Base(ServeUnitPath), err)
+	}
+	m.sys.Log("Installed and started " + filepath.Base(ServeUnitPath) + ".")
+	return nil
+}
@@ -0,0 +1,354 @@
+// Package sshkeys fetches, installs and publishes the GitHub deploy key:
+// the keyserver client and server, rsyncd, mDNS discovery and push-keys.
+package sshkeys
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io"
+	"net/url"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"regexp"
+	"strings"
+
+	"github.com/sparkleHazard/bootstrap/internal/config"
+	"github.com/sparkleHazard/bootstrap/internal/platform"
+	"github.com/sparkleHazard/bootstrap/internal/secrets"
+	"github.com/sparkleHazard/bootstrap/internal/service"
+	"golang.org/x/crypto/ssh"
+)
+
+// GithubKeyName is the file name of the GitHub private key, in ~/.ssh and
+// as exported by a keyserver.
+const GithubKeyName = "id_ecdsa_github"
+
+// sshDir returns the path of ~/.ssh on h.
+func sshDir(h *platform.HostEnv) (string, error) {
+	homeDir, err := h.HomeDir()
+	if err != nil {
+		return "", fmt.Errorf("unable to find home directory: %w", err)
+	}
+	return filepath.Join(homeDir, ".ssh"), nil
+}
+
+// GithubKeyPath returns the path of the GitHub private key on h: --key-path,
+// relative to the home directory unless it is absolute, or GithubKeyName in
+// ~/.ssh. The public key is the same path with .pub.
+func (m *Manager) GithubKeyPath(h *platform.HostEnv) (string, error) {
+	homeDir, err := h.HomeDir()
+	if err != nil {
+		return "", fmt.Errorf("unable to determine home directory: %w", err)
+	}
+	if m.cfg.KeyPath == "" {
+		return filepath.Join(homeDir, ".ssh", GithubKeyName), nil
+	}
+	p := strings.TrimPrefix(m.cfg.KeyPath, "~/")
+	if filepath.IsAbs(p) {
+		return filepath.Clean(p), nil
+	}
+	return filepath.Join(homeDir, p), nil
+}
+
+// EnsureSSHDirectory ensures that ~/.ssh exists, creating it if necessary.
+func (m *Manager) EnsureSSHDirectory(ctx context.Context) error {
+	sshPath, err := sshDir(m.sys.Host)
+	if err != nil {
+		return err
+	}
+	if _, err := os.Stat(sshPath); os.IsNotExist(err) {
+		m.sys.Log("~/.ssh does not exist; creating...")
+		if err := os.MkdirAll(sshPath, 0700); err != nil {
+			return fmt.Errorf("failed to create ~/.ssh directory: %w", err)
+		}
+	} else {
+		if m.cfg.Verbose {
+			m.sys.Log("~/.ssh directory already exists.")
+		}
+	}
+	if m.cfg.KeyPath == "" {
+		return nil
+	}
+	keyPath, err := m.GithubKeyPath(m.sys.Host)
+	if err != nil {
+		return err
+	}
+	m.sys.Log("Using GitHub key " + keyPath)
+	if err := os.MkdirAll(filepath.Dir(keyPath), 0700); err != nil {
+		return fmt.Errorf("failed to create %s: %w", filepath.Dir(keyPath), err)
+	}
+	return nil
+}
+
+// FetchGithubPrivateKey uses rsync to pull the key from some remote location.
+func (m *Manager) FetchGithubPrivateKey(ctx context.Context) error {
+	src, err := m.cfg.KeyserverURL(m.DiscoveredKeyserver)
+	if err != nil {
+		return err
+	}
+	m.sys.Log("Fetching GitHub SSH private key via " + src.Scheme + "...")
+	keyDest, err := m.GithubKeyPath(m.sys.Host)
+	if err != nil {
+		return err
+	}
+
+	dir, err := m.sys.RunWorkDir()
+	if err != nil {
+		return err
+	}
+	tmpDest := filepath.Join(dir, "github_key")
+	defer os.Remove(tmpDest)
+
+	token, err := m.BootstrapToken()
+	if err != nil {
+		return err
+	}
+	if src.Scheme == "https" {
+		err = m.fetchKeyHTTPS(ctx, src.String(), tmpDest, token)
+	} else {
+		err = m.fetchKeyRsync(ctx, src, tmpDest, token)
+	}
+	if err != nil {
+		return fmt.Errorf("unable to fetch GitHub SSH private key: %w", err)
+	}
+
+	contentTmp, err := os.ReadFile(tmpDest)
+	if err != nil {
+		return fmt.Errorf("error reading temp GitHub key: %w", err)
+	}
+	if m.cfg.AgeIdentityFile != "" {
+		// Decrypted in memory, so that only the key itself is written.
+		if contentTmp, err = m.decryptGithubKey(contentTmp); err != nil {
+			return err
+		}
+		m.sys.Log("Decrypted the GitHub SSH private key with " + m.cfg.AgeIdentityFile + ".")
+	}
+	return m.installGithubKey(ctx, keyDest, contentTmp)
+}
+
+// installGithubKey writes the private key content to keyDest, unless it is
+// already there, and records how to undo that.
+func (m *Manager) installGithubKey(ctx context.Context, keyDest string, content []byte) error {
+	existing, err := os.ReadFile(keyDest)
+	if err == nil {
+		if string(existing) == string(content) {
+			m.sys.Log("GitHub SSH private key is already up-to-date.")
+			return nil
+		}
+	}
+	if _, err := m.sys.WriteFile(ctx, keyDest, content, 0600, ""); err != nil {
+		return fmt.Errorf("error writing GitHub SSH key: %w", err)
+	}
+	if err := m.sys.RestoreContexts(ctx, false, filepath.Dir(keyDest), keyDest); err != nil {
+		return err
+	}
+	if existing != nil {
+		m.sys.RecordUndo("restore the previous key at "+keyDest, func(context.Context) error {
+			_, err := m.sys.WriteFile(ctx, keyDest, existing, 0600, "")
+			return err
+		})
+	} else {
+		m.sys.RecordUndo("remove the fetched key at "+keyDest, func(context.Context) error {
+			return os.Remove(keyDest)
+		})
+	}
+	m.sys.Log("GitHub SSH private key updated at " + keyDest)
+	return nil
+}
+
+// maxProvidedKeySize bounds the key read from stdin; an ECDSA or Ed25519
+// private key is well under 1 KiB, a 4096-bit RSA one about 3.5 KiB.
+const maxProvidedKeySize = 64 << 10
+
+// InstallProvidedKey installs the GitHub private key given by --key-stdin,
+// --key-b64-env or --key-ssm in place of fetching it from the keyserver. It must
+// parse as an unencrypted private key. The key material is never logged,
+// and the environment variable is cleared so that the commands the run
+// executes do not inherit it.
+func (m *Manager) InstallProvidedKey(ctx context.Context) error {
+	src := m.cfg.ProvidedKeySource()
+	var content []byte
+	switch {
+	case m.cfg.KeyStdin:
+		data, err := io.ReadAll(io.LimitReader(os.Stdin, maxProvidedKeySize+1))
+		if err != nil {
+			return fmt.Errorf("reading the GitHub key from stdin: %w", err)
+		}
+		if len(data) > maxProvidedKeySize {
+			return errors.New("the GitHub key on stdin is too large to be a private key")
+		}
+		content = data
+	case m.cfg.KeySSM != "":
+		value, err := m.secrets.SSMParameter(ctx, m.cfg.KeySSM)
+		if err != nil {
+			return fmt.Errorf("reading the GitHub key from SSM: %w", err)
+		}
+		content = []byte(value)
+	default:
+		encoded := os.Getenv(m.cfg.KeyB64Env)
+		os.Unsetenv(m.cfg.KeyB64Env)
+		if encoded == "" {
+			return fmt.Errorf("environment variable %s, named by key-b64-env, is not set or empty", m.cfg.KeyB64Env)
+		}
+		// CI secret stores often wrap long values.
+		data, err := base64.StdEncoding.DecodeString(strings.Join(strings.Fields(encoded), ""))
+		if err != nil {
+			return fmt.Errorf("environment variable %s is not valid base64", m.cfg.KeyB64Env)
+		}
+		content = data
+	}
+	if len(bytes.TrimSpace(content)) == 0 {
+		return fmt.Errorf("no GitHub key was provided on %s", src)
+	}
+	if _, err := ssh.ParsePrivateKey(content); err != nil {
+		return fmt.Errorf("the GitHub key from %s is not a usable private key: %w", src, err)
+	}
+	// ssh rejects an OpenSSH private key without its final newline.
+	if content[len(content)-1] != '\n' {
+		content = append(content, '\n')
+	}
+	keyDest, err := m.GithubKeyPath(m.sys.Host)
+	if err != nil {
+		return err
+	}
+	m.sys.Log("Installing the GitHub SSH private key from " + src + " instead of fetching it from the keyserver.")
+	return m.installGithubKey(ctx, keyDest, content)
+}
+
+// fetchKeyHTTPS downloads the key from an https keyserver (bootstrap serve)
+// to dest with curl, presenting token as a bearer token. With
+// --keyserver-pin the server's certificate is trusted only if its public
+// key matches the pin, which is how the self-signed certificate bootstrap
+// serve generates is checked. A rejected token is not retried.
+func (m *Manager) fetchKeyHTTPS(ctx context.Context, url, dest, token string) error {
+	args := []string{"-sSL", "-o", dest, "-w", "%{http_code}"}
+	if m.cfg.KeyserverPin != "" {
+		args = append(args, "--insecure", "--pinnedpubkey", m.cfg.KeyserverPin)
+	}
+	// The headers identify this machine in the key server's audit log. They
+	// are passed in a file so that the token does not show up in ps.
+	headers := m.clientIdentityHeaders()
+	if token != "" {
+		headers = append(headers, "Authorization: Bearer "+token)
+	}
+	dir, err := m.sys.RunWorkDir()
+	if err != nil {
+		return err
+	}
+	header := filepath.Join(dir, "keyserver-headers")
+	if _, err := m.sys.WriteFile(ctx, header, []byte(strings.Join(headers, "\n")+"\n"), 0600, ""); err != nil {
+		return err
+	}
+	defer os.Remove(header)
+	args = append(args, "-H", "@"+header)
+	args = append(args, url)
+	return m.sys.Retry(ctx, platform.NewRetryPolicy(m.cfg), "download "+url, func() error {
+		if m.cfg.Verbose {
+			m.sys.Log("Running: curl " + strings.Join(args, " "))
+		}
+		out, err := m.sys.CmdOutput(ctx, "curl", args...)
+		if err != nil {
+			return curlError(err)
+		}
+		switch code := strings.TrimSpace(string(out)); code {
+		case "200":
+			return nil
+		case "403":
+			return platform.Permanent(fmt.Errorf("%w: %s returned HTTP 403; add this host's address to the key server's --allow-cidr", ErrHostRefused, url))
+		case "401":
+			if token == "" {
+				return platform.Permanent(fmt.Errorf("%w: %s requires a bootstrap token (HTTP %s); pass --bootstrap-token or --bootstrap-token-file", ErrUnauthorized, url, code))
+			}
+			return platform.Permanent(fmt.Errorf("%w: %s rejected the bootstrap token (HTTP %s)", ErrUnauthorized, url, code))
+		default:
+			return fmt.Errorf("%s returned HTTP %s", url, code)
+		}
+	})
+}
+
+// curlError adds what curl printed to standard error, with -sS only the
+// reason it failed, to err.
+func curlError(err error) error {
+	var exit *exec.ExitError
+	if errors.As(err, &exit) && len(bytes.TrimSpace(exit.Stderr)) > 0 {
+		return fmt.Errorf("%s: %w", bytes.TrimSpace(exit.Stderr), err)
+	}
+	return err
+}
+
+// rsyncAuthRegex matches rsync's message when the daemon rejects the
+// module's user or password.
+var rsyncAuthRegex = regexp.MustCompile(`@ERROR: auth failed`)
+
+// rsyncDeniedRegex matches rsync's message when the daemon's hosts allow or
+// hosts deny settings refuse this host.
+var rsyncDeniedRegex = regexp.MustCompile(`@ERROR: access denied to \S+ from \S+`)
+
+// fetchKeyRsync fetches the key from an rsync keyserver to dest. A token is
+// sent as the rsync daemon password (RSYNC_PASSWORD) of the URL's user,
+// "bootstrap" if it names none; a rejected one is not retried.
+func (m *Manager) fetchKeyRsync(ctx context.Context, src *url.URL, dest, token string) error {
+	src, env := rsyncAuth(src, token)
+	return m.sys.Retry(ctx, platform.NewRetryPolicy(m.cfg), "rsync", func() error {
+		// The key is never written with the mode it has on the keyserver.
+		args := []string{"-avz", "--chmod=F600", src.String(), dest}
+		if m.cfg.Verbose {
+			m.sys.Log("Running: rsync " + strings.Join(args, " "))
+		}
+		out := &platform.TailBuffer{Max: platform.InstallOutputMax}
+		cmd := m.sys.NewCommand(ctx, "rsync", args...)
+		cmd.Env = env
+		cmd.Stdout = m.sys.CommandStdout
+		cmd.Stderr = io.MultiWriter(m.sys.CommandStderr, out)
+		return rsyncError(src, out.Bytes(), cmd.Run())
+	})
+}
+
+// rsyncAuth returns src and the environment for rsync to present token to
+// the daemon: as the password (RSYNC_PASSWORD) of src's user, "bootstrap"
+// if it names none. Without a token both are returned unchanged.
+func rsyncAuth(src *url.URL, token string) (*url.URL, []string) {
+	if token == "" {
+		return src, nil
+	}
+	if src.User == nil {
+		u := *src
+		u.User = url.User("bootstrap")
+		src = &u
+	}
+	return src, append(os.Environ(), "RSYNC_PASSWORD="+token)
+}
+
+// rsyncError marks err, from an rsync of src that wrote stderr, permanent
+// if the daemon rejected the token or refused this host, since retrying
+// cannot help.
+func rsyncError(src *url.URL, stderr []byte, err error) error {
+	if err != nil && rsyncAuthRegex.Match(stderr) {
+		return platform.Permanent(fmt.Errorf("%w: %s rejected the bootstrap token: %v", ErrUnauthorized, src.Redacted(), err))
+	}
+	if err != nil && rsyncDeniedRegex.Match(stderr) {
+		return platform.Permanent(fmt.Errorf("%w: %s: %s", ErrHostRefused, src.Redacted(), rsyncDeniedRegex.Find(stderr)))
+	}
+	return err
+}
+
+// Manager fetches, generates and serves the SSH deploy key.
+type Manager struct {
+	cfg      *config.Config
+	sys      *platform.System
+	secrets  *secrets.Store
+	services *service.Manager
+
+	// DiscoveredKeyserver is the keyserver location mDNS discovery found
+	// for --keyserver auto, or "".
+	DiscoveredKeyserver string
+}
+
+// NewManager returns the key manager of a run on sys.
+func NewManager(sys *platform.System, secrets *secrets.Store, services *service.Manager) *Manager {
+	return &Manager{cfg: sys.Config, sys: sys, secrets: secrets, services: services}
+}
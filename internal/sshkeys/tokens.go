@@ -0,0 +1,146 @@
+package sshkeys
+
+import (
+	"bufio"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/sparkleHazard/bootstrap/internal/platform"
+)
+
+// ErrUnauthorized is wrapped by the error a key fetch returns when the
+// keyserver rejects the bootstrap token, or requires one and none was given.
+var ErrUnauthorized = errors.New("unauthorized")
+
+// serveTokensPath returns the key server's tokens file: --serve-tokens-file
+// or serve-tokens in the state directory.
+func (m *Manager) serveTokensPath() (string, error) {
+	if m.cfg.ServeTokensFile != "" {
+		return m.cfg.ServeTokensFile, nil
+	}
+	dir, err := m.sys.StateDir()
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(dir, "serve-tokens"), nil
+}
+
+// tokenHash returns the hex SHA-256 of token, which is what the tokens file
+// stores so that reading it does not reveal usable tokens.
+func tokenHash(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
+
+// IssueToken generates a new bootstrap token valid for ttl (forever when
+// ttl is 0), appends its hash to the tokens file with label, and returns it.
+func (m *Manager) IssueToken(ttl time.Duration, label string) (string, error) {
+	path, err := m.serveTokensPath()
+	if err != nil {
+		return "", err
+	}
+	buf := make([]byte, 32)
+	if _, err := rand.Read(buf); err != nil {
+		return "", err
+	}
+	token := base64.RawURLEncoding.EncodeToString(buf)
+	expiry := "-"
+	if ttl > 0 {
+		expiry = time.Now().Add(ttl).UTC().Format(time.RFC3339)
+	}
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return "", err
+	}
+	f, err := platform.OpenFile(path, os.O_WRONLY|os.O_APPEND, 0600)
+	if err != nil {
+		return "", err
+	}
+	line := strings.TrimSpace(tokenHash(token) + " " + expiry + " " + strings.Join(strings.Fields(label), "_"))
+	if _, err := fmt.Fprintln(f, line); err != nil {
+		f.Close()
+		return "", err
+	}
+	return token, f.Close()
+}
+
+// checkToken validates token against the tokens file at path, which holds
+// one "HASH EXPIRY [LABEL]" line per token, EXPIRY being RFC 3339 or "-"
+// for none. The file is read on every call so that newly issued tokens
+// work without a restart. It returns the matching token's label, or why
+// the token was refused.
+func checkToken(path, token string) (string, error) {
+	if token == "" {
+		return "", errors.New("no token")
+	}
+	f, err := os.Open(path)
+	if err != nil {
+		return "", fmt.Errorf("no usable tokens file: %v", err)
+	}
+	defer f.Close()
+	want := tokenHash(token)
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) < 2 || strings.HasPrefix(fields[0], "#") {
+			continue
+		}
+		if subtle.ConstantTimeCompare([]byte(fields[0]), []byte(want)) != 1 {
+			continue
+		}
+		label := ""
+		if len(fields) > 2 {
+			label = fields[2]
+		}
+		if fields[1] != "-" {
+			expiry, err := time.Parse(time.RFC3339, fields[1])
+			if err != nil {
+				return label, fmt.Errorf("token has an invalid expiry %q", fields[1])
+			}
+			if time.Now().After(expiry) {
+				return label, fmt.Errorf("token expired at %s", expiry.Format(time.RFC3339))
+			}
+		}
+		return label, nil
+	}
+	if err := scanner.Err(); err != nil {
+		return "", err
+	}
+	return "", errors.New("unknown token")
+}
+
+// requestToken returns the bootstrap token of r, from an "Authorization:
+// Bearer" header or, for clients that cannot set headers, a token query
+// parameter.
+func requestToken(r *http.Request) string {
+	if auth, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer "); ok {
+		return strings.TrimSpace(auth)
+	}
+	return r.URL.Query().Get("token")
+}
+
+// BootstrapToken returns the token the client presents to the keyserver:
+// --bootstrap-token, or the contents of --bootstrap-token-file, or "".
+func (m *Manager) BootstrapToken() (string, error) {
+	if m.cfg.BootstrapToken != "" || m.cfg.BootstrapTokenFile == "" {
+		return m.cfg.BootstrapToken, nil
+	}
+	data, err := os.ReadFile(m.cfg.BootstrapTokenFile)
+	if err != nil {
+		return "", fmt.Errorf("reading bootstrap-token-file: %w", err)
+	}
+	token := strings.TrimSpace(string(data))
+	if token == "" {
+		return "", fmt.Errorf("bootstrap-token-file %s is empty", m.cfg.BootstrapTokenFile)
+	}
+	return token, nil
+}
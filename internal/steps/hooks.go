@@ -0,0 +1,157 @@
+package steps
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/sparkleHazard/bootstrap/internal/report"
+)
+
+// postHookTimeout bounds each post-hook, which also runs after an
+// interrupted run, when the run's context is already cancelled.
+const postHookTimeout = 10 * time.Minute
+
+// hooksFor returns the hooks of kind, "pre" or "post": the executables in
+// kind.d under --hooks-dir in lexical order, then the --pre-hook or
+// --post-hook paths. A missing directory has no hooks; dotfiles and editor
+// backups in it are ignored.
+func (r *Runner) hooksFor(kind string) []string {
+	var out []string
+	if r.cfg.HooksDir != "" {
+		entries, _ := os.ReadDir(filepath.Join(r.cfg.HooksDir, kind+".d"))
+		for _, e := range entries {
+			name := e.Name()
+			if strings.HasPrefix(name, ".") || strings.HasSuffix(name, "~") || e.IsDir() {
+				continue
+			}
+			if fi, err := e.Info(); err == nil && fi.Mode()&0o111 != 0 {
+				out = append(out, filepath.Join(r.cfg.HooksDir, kind+".d", name))
+			}
+		}
+	}
+	if kind == "pre" {
+		return append(out, r.cfg.PreHooks...)
+	}
+	return append(out, r.cfg.PostHooks...)
+}
+
+// hookStep returns the step name of the hook at path, unique in res.
+func hookStep(res *report.Result, kind, path string) string {
+	step := kind + "-hook-" + filepath.Base(path)
+	for i := 2; ; i++ {
+		if _, ok := res.Steps[step]; !ok {
+			return step
+		}
+		step = fmt.Sprintf("%s-hook-%s-%d", kind, filepath.Base(path), i)
+	}
+}
+
+// hookEnv returns the variables a hook of kind is given: the role and OS,
+// BOOTSTRAP_LOG naming a file with the run's output so far, and for a
+// post-hook the outcome, with BOOTSTRAP_RESULT_FILE naming the result JSON.
+func (r *Runner) hookEnv(ctx context.Context, res *report.Result, kind string) ([]string, error) {
+	dir, err := r.sys.RunWorkDir()
+	if err != nil {
+		return nil, err
+	}
+	logFile := filepath.Join(dir, "hook-output.log")
+	if _, err := r.sys.WriteFile(ctx, logFile, []byte(r.sys.RunOutput.String()), 0600, ""); err != nil {
+		return nil, err
+	}
+	env := []string{
+		"BOOTSTRAP_HOOK=" + kind,
+		"BOOTSTRAP_ROLE=" + r.cfg.Role,
+		"BOOTSTRAP_OS=" + res.OS,
+		"BOOTSTRAP_LOG=" + logFile,
+	}
+	if r.cfg.Transcript != "" {
+		env = append(env, "BOOTSTRAP_TRANSCRIPT="+r.cfg.Transcript)
+	}
+	if kind == "post" {
+		resultFile := r.cfg.ResultFile
+		if resultFile == "" {
+			resultFile = filepath.Join(dir, "result.json")
+			if err := r.reporter.WriteResultFile(ctx, resultFile, res); err != nil {
+				return nil, err
+			}
+		}
+		env = append(env,
+			"BOOTSTRAP_STATUS="+res.Status,
+			"BOOTSTRAP_EXIT_CODE="+strconv.Itoa(res.ExitCode),
+			"BOOTSTRAP_FAILED_STEP="+res.FailedStep,
+			"BOOTSTRAP_RESULT_FILE="+resultFile)
+	}
+	return env, nil
+}
+
+// runHook runs the hook at path with env, as its own step.
+func (r *Runner) runHook(ctx context.Context, path string, env []string) error {
+	fi, err := os.Stat(path)
+	if err != nil {
+		return err
+	}
+	if fi.IsDir() || fi.Mode()&0o111 == 0 {
+		return fmt.Errorf("%s is not executable", path)
+	}
+	return r.sys.RunCmd(ctx, "env", append(env, path)...)
+}
+
+// runPreHooks runs the pre-hooks in order, each as its own step; the first
+// to fail fails the run.
+func (r *Runner) runPreHooks(ctx context.Context, res *report.Result) error {
+	for _, path := range r.hooksFor("pre") {
+		step := hookStep(res, "pre", path)
+		r.enterStep(res, step)
+		env, err := r.hookEnv(ctx, res, "pre")
+		if err == nil {
+			err = r.runHook(ctx, path, env)
+		}
+		if err != nil {
+			res.Steps[step] = "failed"
+			return fmt.Errorf("pre-hook %s failed: %w", path, err)
+		}
+		res.Steps[step] = "ok"
+	}
+	return nil
+}
+
+// RunPostHooks runs every post-hook once the outcome of the run is known,
+// whatever it is. A failing post-hook is reported in its step and does not
+// change the outcome.
+func (r *Runner) RunPostHooks(ctx context.Context, res *report.Result) {
+	hooks := r.hooksFor("post")
+	if len(hooks) == 0 {
+		return
+	}
+	if res.Steps == nil {
+		res.Steps = map[string]string{}
+	}
+	for _, path := range hooks {
+		step := hookStep(res, "post", path)
+		r.enterStep(res, step)
+		res.Steps[step] = "ok"
+		hctx, cancel := context.WithTimeout(context.WithoutCancel(ctx), postHookTimeout)
+		env, err := r.hookEnv(ctx, res, "post")
+		if err == nil {
+			err = r.runHook(hctx, path, env)
+		}
+		if errors.Is(hctx.Err(), context.DeadlineExceeded) {
+			err = fmt.Errorf("timed out after %s", postHookTimeout)
+		}
+		cancel()
+		if err != nil {
+			res.Steps[step] = "failed"
+			if r.cfg.Quiet {
+				r.sys.ShowStepOutput(step)
+			}
+			r.sys.Log(fmt.Sprintf("Warning: post-hook %s failed: %v", path, err))
+		}
+	}
+	r.FinishStep(res, report.StepFailed(res.Steps[res.Step]))
+}
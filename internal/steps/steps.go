@@ -0,0 +1,554 @@
+// Package steps runs the provisioning steps of a run in order, recording
+// each step's outcome.
+package steps
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"slices"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/sparkleHazard/bootstrap/internal/ansible"
+	"github.com/sparkleHazard/bootstrap/internal/config"
+	"github.com/sparkleHazard/bootstrap/internal/github"
+	"github.com/sparkleHazard/bootstrap/internal/platform"
+	"github.com/sparkleHazard/bootstrap/internal/release"
+	"github.com/sparkleHazard/bootstrap/internal/report"
+	"github.com/sparkleHazard/bootstrap/internal/secrets"
+	"github.com/sparkleHazard/bootstrap/internal/service"
+	"github.com/sparkleHazard/bootstrap/internal/sshkeys"
+)
+
+// enterStep finishes the current step of res, if any, and notes that the
+// run has moved on to step: should the run fail before the next, step is
+// the one blamed, its output is what failure reports include, and its time
+// and retries are recorded by FinishStep.
+func (r *Runner) enterStep(res *report.Result, step string) {
+	r.FinishStep(res, report.StepFailed(res.Steps[res.Step]))
+	res.Step, res.StepStart = step, time.Now()
+	res.StepOrder = append(res.StepOrder, step)
+	r.sys.Console.SetStep(step)
+	r.sys.Journal.SetStep(step)
+	r.sys.StepOutput.Reset()
+	r.sys.StepRetries.Store(0)
+}
+
+// FinishStep records how long the current step took and how often it
+// retried, and logs both. failed says whether the step failed.
+func (r *Runner) FinishStep(res *report.Result, failed bool) {
+	if res.StepStart.IsZero() {
+		return
+	}
+	took := time.Since(res.StepStart)
+	retries := int(r.sys.StepRetries.Swap(0))
+	res.StepStart = time.Time{}
+	r.sys.Console.SetStep("")
+	if res.StepSeconds == nil {
+		res.StepSeconds = map[string]float64{}
+	}
+	res.StepSeconds[res.Step] = took.Seconds()
+	if retries > 0 {
+		if res.StepRetries == nil {
+			res.StepRetries = map[string]int{}
+		}
+		res.StepRetries[res.Step] = retries
+	}
+	verb, status := "finished in", "ok"
+	if failed {
+		verb, status = "failed after", "failed"
+	}
+	r.sys.LogFields(fmt.Sprintf("Step %s %s %s%s.", res.Step, verb, platform.RoundDuration(took), retriesNote(retries)), platform.JournalFields{
+		"BOOTSTRAP_STATUS":  status,
+		"BOOTSTRAP_RETRIES": strconv.Itoa(retries),
+		"DURATION_MS":       platform.DurationMS(took),
+	})
+	r.sys.Journal.SetStep("")
+}
+
+// LogStepSummary logs a table of the steps res ran, in order, with their
+// status, time and retries.
+func (r *Runner) LogStepSummary(res *report.Result) {
+	if len(res.StepOrder) == 0 {
+		return
+	}
+	var b strings.Builder
+	w := tabwriter.NewWriter(&b, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(w, "STEP\tSTATUS\tTIME\tRETRIES")
+	var total time.Duration
+	for _, step := range res.StepOrder {
+		took := res.StepDuration(step)
+		total += took
+		fmt.Fprintf(w, "%s\t%s\t%s\t%d\n", step, res.StepStatus(step), platform.RoundDuration(took), res.StepRetries[step])
+	}
+	fmt.Fprintf(w, "total\t%s\t%s\t\n", res.Status, platform.RoundDuration(total))
+	w.Flush()
+	r.sys.Log("Step summary:")
+	for _, line := range strings.Split(strings.TrimRight(b.String(), "\n"), "\n") {
+		r.sys.Log("  " + line)
+	}
+	if res.KeyPath != "" {
+		r.sys.Log("GitHub key: " + res.KeyPath)
+	}
+	if res.Steps["ansible-pull"] != "" {
+		ref := ansible.DescribeAnsibleRef(res.AnsibleRef, res.AnsibleRefFrom)
+		if res.AnsibleCommit != "" {
+			ref += ", commit " + res.AnsibleCommit
+		}
+		r.sys.Log("Ansible ref: " + ref)
+	}
+}
+
+// retriesNote returns " (N retries)" for n > 0, and "" otherwise.
+func retriesNote(n int) string {
+	switch n {
+	case 0:
+		return ""
+	case 1:
+		return " (1 retry)"
+	}
+	return fmt.Sprintf(" (%d retries)", n)
+}
+
+// Bootstrap runs every provisioning step in order, stopping at the first
+// failure.
+func (r *Runner) Bootstrap(ctx context.Context, res *report.Result) error {
+	r.sys.Log("Starting Go-based bootstrap...")
+	if r.cfg.DetectDrift {
+		r.sys.Log("Detecting drift: the playbook runs in check mode, and the steps that would reconfigure the host are skipped.")
+	}
+
+	// 2. Ensure ~/.ssh directory
+	r.enterStep(res, "ssh-dir")
+	if err := r.keys.EnsureSSHDirectory(ctx); err != nil {
+		return err
+	}
+	res.KeyPath, _ = r.keys.GithubKeyPath(r.sys.Host)
+
+	// 3. Detect OS
+	osID := platform.DetectOS(r.sys.Host)
+	res.OS = osID
+	r.sys.Log(fmt.Sprintf("Detected OS: %s", osID))
+
+	// What the machine is, for the result and the playbook, before anything
+	// can fail for lack of it.
+	r.enterStep(res, "facts")
+	r.sys.GatheredFacts = r.sys.GatherFacts(ctx, r.sys.Host, osID)
+	res.Facts = r.sys.GatheredFacts
+	if r.cfg.Verbose {
+		for _, line := range r.sys.GatheredFacts.Lines() {
+			r.sys.Log("Fact " + line)
+		}
+	}
+
+	// Before anything changes the host, so that a pre-hook can prepare it,
+	// or veto the run by failing.
+	res.Steps = map[string]string{}
+	if err := r.runPreHooks(ctx, res); err != nil {
+		return err
+	}
+
+	// Close the loop on the units an earlier run left to the reboot.
+	res.PreviousPostReboot = r.services.CheckPreviousOneShots()
+
+	// With --keyserver auto, find the keyserver before the network
+	// preflight, which checks that it is reachable.
+	if r.cfg.Keyserver == config.KeyserverAuto && r.cfg.Role != "keyserver" && r.cfg.ProvidedKeySource() == "" {
+		r.enterStep(res, "keyserver-discovery")
+		if err := r.keys.ResolveKeyserver(ctx); err != nil {
+			return err
+		}
+	}
+
+	// Fail early, before installing anything, if the disk is nearly full or
+	// the network is not usable.
+	r.enterStep(res, "disk-space")
+	if err := r.sys.CheckDiskSpace(); err != nil {
+		return err
+	}
+	r.enterStep(res, "network")
+	if err := r.sys.CheckNetwork(ctx, osID, r.keys.FetchKeyserver()); err != nil {
+		return err
+	}
+
+	// Find out now, not halfway through an install, whether sudo or doas works.
+	r.enterStep(res, "privileges")
+	if err := r.sys.CheckPrivileges(ctx, osID); err != nil {
+		return err
+	}
+
+	// Behind a TLS-intercepting proxy nothing https works until its CA is
+	// trusted.
+	if len(r.cfg.CACerts) > 0 {
+		r.enterStep(res, "ca-certs")
+		status, err := r.sys.InstallCACerts(ctx, osID)
+		if err != nil {
+			res.Steps["ca-certs"] = "failed"
+			return err
+		}
+		res.Steps["ca-certs"] = status
+	}
+
+	// Fix the time before anything, Kerberos and TLS above all, relies on
+	// it; the clock check below then confirms it.
+	if r.cfg.EnsureTimesync && !r.cfg.DetectDrift {
+		r.enterStep(res, "timesync")
+		status, offset, err := r.sys.EnsureTimesync(ctx, osID)
+		if err != nil {
+			res.Steps["timesync"] = "failed"
+			return err
+		}
+		res.Steps["timesync"] = status
+		secs := offset.Seconds()
+		res.TimeOffsetSeconds = &secs
+	}
+
+	// A wrong clock makes every https download and GitHub API call fail
+	// with certificate errors, so check it before any of them.
+	r.enterStep(res, "clock")
+	outcome, err := r.sys.CheckClock(ctx, osID)
+	res.Checks = map[string]string{"clock": outcome}
+	if err != nil {
+		return err
+	}
+
+	// Name the host before anything, the playbook included, keys off it.
+	if !r.cfg.DetectDrift {
+		r.enterStep(res, "hostname")
+		status, err := r.sys.SetHostname(ctx, osID)
+		if err != nil {
+			res.Steps["hostname"] = "failed"
+			return err
+		}
+		res.Steps["hostname"] = status
+		if status == "set" {
+			res.Hostname, _ = os.Hostname()
+		}
+	}
+
+	// Put the binary somewhere that survives the reboot, now that it is
+	// known whether it can go in /usr/local/bin.
+	if r.cfg.InstallSelf && !r.cfg.DetectDrift {
+		r.enterStep(res, "install-self")
+		status, err := r.services.InstallSelf(ctx)
+		if err != nil {
+			res.Steps["install-self"] = "failed"
+			return err
+		}
+		res.Steps["install-self"] = status
+	}
+
+	// Put an existing Homebrew (e.g. Linuxbrew) on PATH for every step.
+	if err := r.sys.LoadBrewEnv(ctx); err != nil {
+		r.sys.Log("Warning: " + err.Error())
+	}
+
+	// For macOS, ensure Homebrew is installed.
+	if osID == "darwin" {
+		r.enterStep(res, "homebrew")
+		if err := r.sys.EnsureHomebrew(ctx); err != nil {
+			return err
+		}
+	}
+
+	// 4. Prerequisite checks, for the role. With --keep-going a failed
+	// install is recorded and the run carries on, failing at the end.
+	builtins, extras := platform.ResolvePrereqs(r.cfg, r.cfg.Role)
+	r.sys.Log("Prerequisites for role " + r.cfg.Role + ": " + strings.Join(platform.PrereqNames(builtins, extras), ", "))
+	var installErrs []error
+	firstFailed := ""
+	prereq := func(name string, ensure func() error) error {
+		r.enterStep(res, "install-"+name)
+		// Every install records itself as irreversible.
+		before := len(r.sys.Irreversible)
+		err := ensure()
+		if err == nil {
+			res.Steps["install-"+name] = "already-installed"
+			if len(r.sys.Irreversible) > before {
+				res.Steps["install-"+name] = "installed"
+			}
+			return nil
+		}
+		res.Steps["install-"+name] = "failed"
+		if !r.cfg.KeepGoing || ctx.Err() != nil {
+			return err
+		}
+		r.sys.Log("Error: " + err.Error())
+		r.sys.Log("Continuing despite the failed install (--keep-going).")
+		installErrs = append(installErrs, err)
+		if firstFailed == "" {
+			firstFailed = "install-" + name
+		}
+		return nil
+	}
+	ensure := map[string]func() error{
+		"sudo":    func() error { return r.sys.EnsureEscalation(ctx, osID) },
+		"python":  func() error { return r.sys.EnsurePython(ctx, osID) },
+		"ansible": func() error { return r.ansible.EnsureAnsible(ctx, osID) },
+		"gh":      func() error { return r.github.EnsureGh(ctx, osID) },
+	}
+	for _, name := range config.BuiltinPrereqs {
+		if !slices.Contains(builtins, name) {
+			r.enterStep(res, "install-"+name)
+			res.Steps["install-"+name] = "not-needed"
+			continue
+		}
+		f := ensure[name]
+		if f == nil {
+			f = func() error { return r.sys.EnsureCommandInstalled(ctx, osID, name) }
+		}
+		if err := prereq(name, f); err != nil {
+			return err
+		}
+	}
+	for _, p := range extras {
+		if err := prereq(p.Name, func() error { return r.sys.EnsureExtraPrereq(ctx, osID, p) }); err != nil {
+			return err
+		}
+	}
+
+	// ansible warns about, and some modules mishandle, non-UTF-8 locales.
+	r.enterStep(res, "locale")
+	res.Steps["locale"] = r.sys.SetupLocale(ctx, osID)
+
+	// 5. If role == keyserver, handle GitHub key; otherwise, fetch private key via rsync.
+	// A drift check uses the key already in place, rotating nothing.
+	if r.cfg.DetectDrift {
+		r.enterStep(res, "fetch-key")
+		if err := r.ansible.CheckExistingKey(); err != nil {
+			return err
+		}
+		res.Steps["fetch-key"] = "existing"
+	} else if r.cfg.Role == "keyserver" {
+		if !r.cfg.Offline {
+			r.enterStep(res, "gh-auth")
+			if err := r.github.EnsureGhAuth(ctx); err != nil {
+				return err
+			}
+		}
+		r.enterStep(res, "github-key")
+		if err := r.github.ManageSSHKeyForGitHub(ctx); err != nil {
+			return err
+		}
+		if r.cfg.ForceKeyRegen {
+			res.Steps["github-key"] = "regenerated"
+		}
+		if r.cfg.SetupRsyncd {
+			r.enterStep(res, "rsyncd")
+			changed, err := r.keys.SetupRsyncd(ctx, osID)
+			if err != nil {
+				res.Steps["rsyncd"] = "failed"
+				return fmt.Errorf("rsync daemon setup failed: %w", err)
+			}
+			res.Steps["rsyncd"] = "unchanged"
+			if changed {
+				res.Steps["rsyncd"] = "configured"
+			}
+		}
+	} else if src := r.cfg.ProvidedKeySource(); src != "" {
+		r.enterStep(res, "fetch-key")
+		if err := r.keys.InstallProvidedKey(ctx); err != nil {
+			return err
+		}
+		res.Steps["fetch-key"] = "provided (" + src + ")"
+	} else {
+		r.enterStep(res, "keyserver-wait")
+		status, err := r.keys.WaitForKeyserver(ctx)
+		if status != "" {
+			res.Steps["keyserver-wait"] = status
+		}
+		if err != nil {
+			return err
+		}
+		r.enterStep(res, "fetch-key")
+		if err := r.keys.FetchGithubPrivateKey(ctx); err != nil {
+			return err
+		}
+	}
+
+	// Read the vault password now, so that a secret manager that is
+	// missing or signed out fails the run before the playbook.
+	if secrets.VaultPassSource(r.cfg) != nil {
+		r.enterStep(res, "vault-pass")
+		src, err := r.secrets.ReadVaultPassword(ctx)
+		if err != nil {
+			res.Steps["vault-pass"] = "failed"
+			return err
+		}
+		res.Steps["vault-pass"] = src
+	}
+
+	// Give the rerun unit and drift service the secrets this run used,
+	// encrypted.
+	if (r.cfg.InstallRerunUnit || r.cfg.DriftTimer != "") && r.services.InstalledBinary() != "" && !r.cfg.DetectDrift {
+		r.enterStep(res, "credentials")
+		status, err := r.services.StoreRerunCredentials(ctx)
+		if err != nil {
+			res.Steps["credentials"] = "failed"
+			return err
+		}
+		res.Steps["credentials"] = status
+	}
+
+	// Check what the playbook is about to apply in a checkout of its own,
+	// before anything else is changed: its signature and its syntax.
+	if r.cfg.RequireSignedTag || r.cfg.SyntaxCheckFirst || r.cfg.RepoInventory() != "" {
+		r.enterStep(res, "checkout")
+		co, err := r.ansible.StageCheckout(ctx)
+		if err != nil {
+			res.Steps["checkout"] = "failed"
+			return err
+		}
+		res.Staged = co
+		res.Steps["checkout"] = co.Commit
+	}
+	if r.cfg.RequireSignedTag {
+		r.enterStep(res, "verify-signature")
+		sig, err := r.ansible.VerifySignedRef(ctx, res.Staged)
+		if err != nil {
+			res.Steps["verify-signature"] = "failed"
+			return err
+		}
+		res.Signature = sig
+		res.Steps["verify-signature"] = "verified"
+	}
+	// ansible only warns about a missing inventory, and runs the playbook
+	// against localhost in no group.
+	if r.cfg.Inventory != "" {
+		r.enterStep(res, "inventory")
+		if err := r.ansible.CheckInventory(res.Staged); err != nil {
+			res.Steps["inventory"] = "failed"
+			return err
+		}
+		res.Steps["inventory"] = "ok"
+	}
+	if r.cfg.SyntaxCheckFirst {
+		r.enterStep(res, "syntax-check")
+		if err := r.ansible.SyntaxCheck(ctx, res.Staged); err != nil {
+			res.Steps["syntax-check"] = "failed"
+			return err
+		}
+		res.Steps["syntax-check"] = "ok"
+	}
+
+	// Install mise before the playbook, which may rely on it.
+	if r.cfg.InstallMise && !r.cfg.DetectDrift {
+		r.enterStep(res, "install-mise")
+		if err := r.sys.EnsureMise(ctx); err != nil {
+			res.Steps["install-mise"] = "failed"
+			return err
+		}
+		res.Steps["install-mise"] = "ok"
+	}
+
+	// Hand the key and vault file to the account later runs use.
+	if r.cfg.CreateAnsibleUser != "" && !r.cfg.DetectDrift {
+		r.enterStep(res, "ansible-user")
+		status, err := r.ansible.EnsureAnsibleUser(ctx, osID)
+		if err != nil {
+			res.Steps["ansible-user"] = "failed"
+			return err
+		}
+		res.Steps["ansible-user"] = status
+	}
+
+	// 6. Run ansible-pull
+	r.enterStep(res, "ansible-pull")
+	pull, err := r.ansible.RunAnsiblePull(ctx, res.Staged, res.Signature)
+	res.AnsibleRef, res.AnsibleRefFrom, res.AnsibleCommit = pull.Ref, pull.RefFrom, pull.Commit
+	res.Approval, res.Drift, res.AnsibleRecap = pull.Approval, pull.Drift, pull.Recap
+	if pull.Status != "" {
+		res.Steps["ansible-pull"] = pull.Status
+	}
+	if err != nil {
+		return err
+	}
+
+	// 7. Optionally run 'mise install' now, and set up one-shot systemd
+	// services that run 'mise install' (unless it just ran) and the
+	// --post-reboot-cmd commands after the reboot at the end of the run.
+	res.Steps["mise-service"] = "skipped"
+	res.Steps["reboot"] = "skipped"
+	if r.cfg.RunMiseNow && !r.cfg.DetectDrift {
+		r.enterStep(res, "mise-run")
+		if err := r.sys.RunMiseNow(ctx); err != nil {
+			res.Steps["mise-run"] = "failed"
+			return fmt.Errorf("mise install failed: %w", err)
+		}
+		res.Steps["mise-run"] = "ok"
+	}
+	var shots []*service.OneShot
+	if !r.cfg.DetectDrift {
+		if shots, err = r.services.PlannedOneShots(r.cfg.RunMiseInstall && !r.cfg.RunMiseNow); err != nil {
+			return err
+		}
+	}
+	if len(shots) > 0 {
+		r.enterStep(res, "post-reboot")
+		if err := r.services.SetupPostReboot(ctx, shots, res.Steps); err != nil {
+			return err
+		}
+		if r.cfg.NoReboot {
+			var units []string
+			for _, o := range shots {
+				units = append(units, o.UnitName())
+			}
+			r.sys.Log("Not rebooting (--no-reboot): " + strings.Join(units, ", ") + " will run at the next boot; reboot when ready.")
+		} else {
+			res.Steps["reboot"] = "pending"
+		}
+	} else if !r.cfg.RunMiseNow {
+		r.sys.Log("Skipping mise install setup.")
+	}
+
+	if len(installErrs) > 0 {
+		// Blame the first failed install rather than the last step.
+		r.FinishStep(res, false)
+		res.Step = firstFailed
+		return fmt.Errorf("%d prerequisite install(s) failed: %w", len(installErrs), errors.Join(installErrs...))
+	}
+	r.sys.Log("Bootstrapping complete.")
+	return nil
+}
+
+// UnwindFailedRun rolls back the failed run's reversible changes when
+// --rollback-on-failure is set, and records what was and was not undone.
+func (r *Runner) UnwindFailedRun(res *report.Result) {
+	if len(r.sys.UndoStack) > 0 && !r.cfg.RollbackOnFailure {
+		r.sys.Log(fmt.Sprintf("%d reversible change(s) were left in place; rerun with --rollback-on-failure to undo them on failure.", len(r.sys.UndoStack)))
+		return
+	}
+	if !r.cfg.RollbackOnFailure {
+		return
+	}
+	res.RolledBack, res.RollbackFailed = r.sys.Rollback()
+	res.NotRolledBack = r.sys.Irreversible
+	for _, desc := range r.sys.Irreversible {
+		r.sys.Log("Not rolled back: " + desc)
+	}
+}
+
+// Runner runs the steps of a bootstrap run in order.
+type Runner struct {
+	cfg      *config.Config
+	sys      *platform.System
+	secrets  *secrets.Store
+	services *service.Manager
+	keys     *sshkeys.Manager
+	github   *github.Client
+	ansible  *ansible.Runner
+	updater  *release.Updater
+	reporter *report.Reporter
+}
+
+// NewRunner returns the step runner of a run on sys, driving the
+// other units.
+func NewRunner(sys *platform.System, secrets *secrets.Store, services *service.Manager, keys *sshkeys.Manager,
+	github *github.Client, ansible *ansible.Runner, updater *release.Updater, reporter *report.Reporter) *Runner {
+	return &Runner{cfg: sys.Config, sys: sys, secrets: secrets, services: services, keys: keys,
+		github: github, ansible: ansible, updater: updater, reporter: reporter}
+}
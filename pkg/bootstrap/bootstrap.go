@@ -0,0 +1,215 @@
+// Package bootstrap provisions a host the way the bootstrap command does:
+// it installs the prerequisites, fetches the GitHub deploy key and runs
+// ansible-pull for the host's role. Run performs a run with a Config, which
+// DefaultConfig and LoadConfig build from the built-in defaults, the config
+// file, the environment and the command line; Main is the command itself.
+package bootstrap
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"io"
+	"os"
+	"time"
+
+	"github.com/sparkleHazard/bootstrap/internal/config"
+	"github.com/sparkleHazard/bootstrap/internal/platform"
+	"github.com/sparkleHazard/bootstrap/internal/report"
+	"github.com/sparkleHazard/bootstrap/internal/service"
+)
+
+// Config is the configuration of a run: the settings of the command's
+// flags, as fields named after them (--repo-url is RepoURL), and the hooks
+// a program running bootstrap can replace.
+type Config struct {
+	config.Config
+
+	// Logger, when set, receives the run's messages instead of the
+	// terminal and journald.
+	Logger Logger
+
+	// Runner, when set, runs the commands of the steps instead of the host.
+	Runner CommandRunner
+
+	// settings are the settings LoadConfig was given, as config file
+	// lines, for the units that run bootstrap again; see settingsOf.
+	settings string
+}
+
+// Logger receives the messages a run logs, with the fields that go with
+// them in the journal, e.g. "BOOTSTRAP_STATUS".
+type Logger interface {
+	Log(msg string, fields map[string]string)
+}
+
+// CommandRunner runs the commands of a run's steps: the package managers,
+// gh, ansible-pull and the rest.
+type CommandRunner interface {
+	// Run runs name with args, streaming its output and copying it to
+	// capture when that is non-nil.
+	Run(ctx context.Context, capture io.Writer, name string, args ...string) error
+
+	// RunSudo is Run as root, through sudo or doas unless the process is
+	// root already.
+	RunSudo(ctx context.Context, capture io.Writer, name string, args ...string) error
+
+	// Output runs name with args and returns its standard output.
+	Output(ctx context.Context, name string, args ...string) ([]byte, error)
+}
+
+// Result is the outcome of a run.
+type Result struct {
+	// Status is "success", "skipped" (the host was bootstrapped already),
+	// "drift" (--detect-drift found changes pending), "failed" or
+	// "interrupted".
+	Status string
+
+	// ExitCode is the exit code of the bootstrap command for the run.
+	ExitCode int
+
+	// FailedStep is the step the run failed in, or "".
+	FailedStep string
+
+	// Steps are the steps the run went through, in order.
+	Steps []StepOutcome
+}
+
+// StepOutcome is what came of one step of a run.
+type StepOutcome struct {
+	Name string
+
+	// Status is "ok", the run's status for the step it stopped in, or
+	// what the step recorded, such as "already-installed".
+	Status string
+
+	Duration time.Duration
+
+	// Retries counts the retries of the step's network operations.
+	Retries int
+}
+
+// DefaultConfig returns the built-in defaults, those of defaults.conf.
+func DefaultConfig() Config {
+	return Config{Config: *newDefaultConfig()}
+}
+
+// LoadConfig returns the configuration of the command line args, which
+// applies them over the environment, the config file and the defaults. The
+// error joins the problems found in them; it is flag.ErrHelp for --help.
+func LoadConfig(args []string) (Config, error) {
+	a := newApp(hostFromEnv())
+	c, fs, problems := a.loadConfig("bootstrap", args, nil)
+	return Config{Config: *c, settings: service.CaptureSettings(fs)}, errors.Join(problems...)
+}
+
+// Run performs a bootstrap run with cfg on this host, and returns its
+// outcome. The error is what stopped the run: invalid settings, the failure
+// of a step, drift found by --detect-drift, or ctx being done.
+func Run(ctx context.Context, cfg Config) (Result, error) {
+	a := newApp(hostFromEnv())
+	if err := a.start(cfg); err != nil {
+		return Result{Status: "failed", ExitCode: platform.ExitConfig}, err
+	}
+	res, err := a.run(ctx)
+	return newResult(res), err
+}
+
+// Main is the bootstrap command: it runs the subcommand args name, or
+// performs a run with the configuration of args, and returns the process's
+// exit code.
+func Main(args []string) int {
+	a := newApp(hostFromEnv())
+	if len(args) > 0 {
+		if cmd, ok := a.commands()[args[0]]; ok {
+			return cmd(args[1:])
+		}
+	}
+
+	c, fs, problems := a.loadConfig("bootstrap", args, nil)
+	if len(problems) == 1 && errors.Is(problems[0], flag.ErrHelp) {
+		return platform.ExitOK
+	}
+	if len(problems) > 0 {
+		for _, p := range append(problems, validateConfig(c)...) {
+			a.sys.Log("Configuration error: " + p.Error())
+		}
+		return platform.ExitConfig
+	}
+	cfg := Config{Config: *c, settings: service.CaptureSettings(fs)}
+	if err := a.start(cfg); err != nil {
+		return platform.ExitConfig
+	}
+	ctx, stop := a.sys.HandleSignals()
+	defer stop()
+	if cfg.NotifyTest {
+		a.addConfigSecrets()
+		return a.runNotifyTest(ctx)
+	}
+	res, _ := a.run(ctx)
+	return res.ExitCode
+}
+
+// start validates cfg, logging its problems, and readies a for a run with
+// it.
+func (a *app) start(cfg Config) error {
+	c := cfg.Config
+	a.configure(&c, a.sys.Host)
+	if cfg.Logger != nil {
+		a.sys.SetLogger(cfg.Logger)
+	}
+	if cfg.Runner != nil {
+		a.sys.SetRunner(cfg.Runner)
+	}
+	if problems := validateConfig(&c); len(problems) > 0 {
+		for _, p := range problems {
+			a.sys.Log("Configuration error: " + p.Error())
+		}
+		return errors.Join(problems...)
+	}
+	a.services.RunSettings = cfg.settings
+	if cfg.settings == "" {
+		a.services.RunSettings = settingsOf(&c)
+	}
+	a.sys.OpenJournal()
+	return nil
+}
+
+// commands returns the subcommands of the bootstrap command by name.
+func (a *app) commands() map[string]func(args []string) int {
+	return map[string]func(args []string) int{
+		"config":        a.runConfigCommand,
+		"init-config":   a.runInitConfigCommand,
+		"clean":         a.runCleanCommand,
+		"serve":         a.runServeCommand,
+		"push-keys":     a.runPushKeysCommand,
+		"remote":        a.runRemoteCommand,
+		"fleet":         a.runFleetCommand,
+		"audit":         a.runAuditCommand,
+		"self-update":   a.runSelfUpdateCommand,
+		"verify":        a.runVerifyCommand,
+		"doctor":        a.runDoctorCommand,
+		"facts":         a.runFactsCommand,
+		"gen-cloudinit": a.runGenCloudInitCommand,
+	}
+}
+
+// hostFromEnv returns the host to run on: this one, or the test root that
+// platform.TestRootEnv names.
+func hostFromEnv() *platform.HostEnv {
+	return platform.NewHostEnv(os.Getenv(platform.TestRootEnv))
+}
+
+// newResult returns the outcome of res for Run's caller.
+func newResult(res *report.Result) Result {
+	out := Result{Status: res.Status, ExitCode: res.ExitCode, FailedStep: res.FailedStep}
+	for _, step := range res.StepOrder {
+		out.Steps = append(out.Steps, StepOutcome{
+			Name:     step,
+			Status:   res.StepStatus(step),
+			Duration: res.StepDuration(step),
+			Retries:  res.StepRetries[step],
+		})
+	}
+	return out
+}
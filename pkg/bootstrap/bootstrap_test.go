@@ -0,0 +1,90 @@
+package bootstrap
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/sparkleHazard/bootstrap/internal/platform"
+	"github.com/sparkleHazard/bootstrap/internal/platform/platformtest"
+	"github.com/sparkleHazard/bootstrap/internal/report"
+)
+
+func TestRunInvalidConfig(t *testing.T) {
+	t.Setenv(platform.TestRootEnv, t.TempDir())
+	log := &platformtest.Logger{}
+	cfg := DefaultConfig()
+	cfg.Role = "no such role!"
+	cfg.TimesyncDaemon = "ntpd"
+	cfg.Logger = log
+	cfg.Runner = &platformtest.Runner{Respond: func(cmd string) (string, error) {
+		t.Errorf("ran %s", cmd)
+		return "", errors.New("no commands")
+	}}
+
+	res, err := Run(context.Background(), cfg)
+	if err == nil || res.ExitCode != platform.ExitConfig || res.Status != "failed" {
+		t.Fatalf("Run = %+v, %v; want exit code %d and an error", res, err, platform.ExitConfig)
+	}
+	want := []string{
+		`Configuration error: role "no such role!" is not a valid role name`,
+		`Configuration error: timesync-daemon "ntpd" must be auto, chrony or timesyncd`,
+	}
+	if strings.Join(log.Messages(), "\n") != strings.Join(want, "\n") {
+		t.Errorf("logged:\n  %s\nwant:\n  %s", strings.Join(log.Messages(), "\n  "), strings.Join(want, "\n  "))
+	}
+}
+
+func TestSettingsOf(t *testing.T) {
+	cfg := DefaultConfig()
+	cfg.Role = "webserver"
+	if err := cfg.ExtraVars.Set("b=2"); err != nil {
+		t.Fatal(err)
+	}
+	if err := cfg.ExtraVars.Set("a=1"); err != nil {
+		t.Fatal(err)
+	}
+	cfg.Force = true
+
+	// Only what differs from the defaults is kept, and not --force, which
+	// is for the run that gave it.
+	want := "extra-var = a=1\nextra-var = b=2\nrole = webserver\n"
+	if got := settingsOf(&cfg.Config); got != want {
+		t.Errorf("settingsOf = %q, want %q", got, want)
+	}
+	defaults := DefaultConfig()
+	if got := settingsOf(&defaults.Config); got != "" {
+		t.Errorf("settingsOf(defaults) = %q, want none", got)
+	}
+}
+
+func TestNewResult(t *testing.T) {
+	res := &report.Result{
+		Status:      "failed",
+		ExitCode:    platform.ExitFailure,
+		FailedStep:  "ansible-pull",
+		Steps:       map[string]string{"prereqs": "installed", "ansible-pull": "failed"},
+		StepOrder:   []string{"preflight", "prereqs", "ansible-pull"},
+		StepSeconds: map[string]float64{"preflight": 0.5, "prereqs": 12, "ansible-pull": 30},
+		StepRetries: map[string]int{"prereqs": 2},
+	}
+	got := newResult(res)
+	want := []StepOutcome{
+		{Name: "preflight", Status: "ok", Duration: 500 * time.Millisecond},
+		{Name: "prereqs", Status: "installed", Duration: 12 * time.Second, Retries: 2},
+		{Name: "ansible-pull", Status: "failed", Duration: 30 * time.Second},
+	}
+	if got.Status != "failed" || got.ExitCode != platform.ExitFailure || got.FailedStep != "ansible-pull" {
+		t.Errorf("newResult = %+v", got)
+	}
+	if len(got.Steps) != len(want) {
+		t.Fatalf("steps = %+v, want %+v", got.Steps, want)
+	}
+	for i := range want {
+		if got.Steps[i] != want[i] {
+			t.Errorf("step %d = %+v, want %+v", i, got.Steps[i], want[i])
+		}
+	}
+}
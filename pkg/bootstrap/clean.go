@@ -0,0 +1,388 @@
+package bootstrap
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"os/user"
+	"path/filepath"
+	"strings"
+
+	"github.com/sparkleHazard/bootstrap/internal/ansible"
+	"github.com/sparkleHazard/bootstrap/internal/platform"
+	"github.com/sparkleHazard/bootstrap/internal/service"
+	"github.com/sparkleHazard/bootstrap/internal/sshkeys"
+)
+
+// legacyTempPaths are fixed temporary paths used by older versions of
+// bootstrap, which could leave them behind (including a copy of the private
+// key) when a run failed.
+var legacyTempPaths = []string{
+	"/tmp/github_key",
+	"/tmp/mise-install-once.service",
+}
+
+// cleanArtifact is something bootstrap created that clean can remove.
+type cleanArtifact struct {
+	desc   string // what it is, in the listing and report
+	remove func(ctx context.Context) error
+}
+
+// runCleanCommand implements "clean [--units] [--keys] [--ansible-user]
+// [--ca-certs] [--state] [--github] [--all] [--dry-run]". Without a category it removes the temporary
+// artifacts left behind by earlier runs, as it always has; the categories
+// add what runs install on purpose, and are removed only after the list has
+// been confirmed, or with --yes.
+func (a *app) runCleanCommand(args []string) int {
+	var dryRun, units, keys, state, github, ansible, caCerts, all bool
+	c, _, problems := a.loadConfig("bootstrap clean", args, func(fs *flag.FlagSet) {
+		fs.BoolVar(&dryRun, "dry-run", false, "List what would be removed without removing anything.")
+		fs.BoolVar(&units, "units", false, "Also remove the systemd units and service files bootstrap installed.")
+		fs.BoolVar(&keys, "keys", false, "Also remove the GitHub key pair in ~/.ssh.")
+		fs.BoolVar(&state, "state", false, "Also remove the state directory: the success marker, report queue and unit logs.")
+		fs.BoolVar(&github, "github", false, "Also delete the GitHub key's registration with the GitHub account, through gh.")
+		fs.BoolVar(&ansible, "ansible-user", false, "Also remove what --create-ansible-user set up: the sudoers rule, and the user and its home if bootstrap created them.")
+		fs.BoolVar(&caCerts, "ca-certs", false, "Also remove the CA certificates --ca-cert added to the system trust store.")
+		fs.BoolVar(&all, "all", false, "Remove units, keys, the ansible user, CA certificates and state; --github must still be given on its own.")
+	})
+	if len(problems) == 1 && errors.Is(problems[0], flag.ErrHelp) {
+		return platform.ExitOK
+	}
+	if len(problems) > 0 {
+		for _, p := range problems {
+			fmt.Fprintln(os.Stderr, "error: "+p.Error())
+		}
+		return platform.ExitConfig
+	}
+	a.configure(c, a.sys.Host)
+	if all {
+		units, keys, ansible, caCerts, state = true, true, true, true, true
+	}
+	if a.sys.Host.EUID() != 0 {
+		a.sys.EscalationCmd = a.sys.EscalationTool()
+	}
+	ctx, stop := a.sys.HandleSignals()
+	defer stop()
+
+	// A running bootstrap's working directory is not a leftover, and its
+	// units and state are in use.
+	lock, err := a.sys.AcquireRunLock(ctx)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err.Error())
+		return platform.ExitCodeFor(err)
+	}
+	defer lock.Release()
+
+	artifacts := leftoverArtifacts()
+	if units {
+		artifacts = append(artifacts, a.unitArtifacts(ctx)...)
+	}
+	// The registration is found through the public key, so it goes first.
+	if github {
+		art, err := a.githubKeyArtifact(ctx)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, "Cannot check the GitHub key registration: "+err.Error())
+			return platform.ExitFailure
+		}
+		artifacts = append(artifacts, art...)
+	}
+	if keys {
+		artifacts = append(artifacts, a.keyArtifacts()...)
+	}
+	// Its record is in the state directory.
+	if ansible {
+		artifacts = append(artifacts, a.ansibleUserArtifacts()...)
+	}
+	if caCerts {
+		artifacts = append(artifacts, a.caCertArtifacts()...)
+	}
+	if state {
+		artifacts = append(artifacts, a.stateArtifacts()...)
+	}
+	if len(artifacts) == 0 {
+		fmt.Println("Nothing to clean.")
+		return platform.ExitOK
+	}
+	if dryRun {
+		for _, art := range artifacts {
+			fmt.Println("Would remove " + art.desc)
+		}
+		return platform.ExitOK
+	}
+	if units || keys || ansible || caCerts || state || github {
+		fmt.Println("bootstrap clean will remove:")
+		for _, art := range artifacts {
+			fmt.Println("  " + art.desc)
+		}
+		if !a.cfg.Yes {
+			if !platform.StdinIsTerminal() {
+				fmt.Fprintln(os.Stderr, "error: not removing anything without --yes")
+				return platform.ExitConfig
+			}
+			if !confirmClean() {
+				fmt.Println("Nothing removed.")
+				return platform.ExitOK
+			}
+		}
+	}
+	status := platform.ExitOK
+	for _, art := range artifacts {
+		if err := art.remove(ctx); err != nil {
+			fmt.Fprintln(os.Stderr, "Failed to remove "+art.desc+": "+err.Error())
+			status = platform.ExitFailure
+			continue
+		}
+		fmt.Println("Removed " + art.desc)
+	}
+	return status
+}
+
+// confirmClean asks on the terminal whether to go ahead.
+func confirmClean() bool {
+	fmt.Print("Remove these? [y/N] ")
+	line, _ := bufio.NewReader(os.Stdin).ReadString('\n')
+	a := strings.ToLower(strings.TrimSpace(line))
+	return a == "y" || a == "yes"
+}
+
+// pathArtifact removes path, a file or directory, if it exists.
+func pathArtifact(path string) []cleanArtifact {
+	if _, err := os.Lstat(path); err != nil {
+		return nil
+	}
+	return []cleanArtifact{{desc: path, remove: func(context.Context) error {
+		return os.RemoveAll(path)
+	}}}
+}
+
+// leftoverArtifacts returns the existing legacy temp paths and working
+// directories of earlier runs.
+func leftoverArtifacts() []cleanArtifact {
+	var out []cleanArtifact
+	for _, p := range legacyTempPaths {
+		out = append(out, pathArtifact(p)...)
+	}
+	matches, _ := filepath.Glob(filepath.Join(os.TempDir(), "bootstrap-*"))
+	for _, p := range matches {
+		if fi, err := os.Lstat(p); err == nil && fi.IsDir() && !strings.HasSuffix(p, ".lock") {
+			out = append(out, pathArtifact(p)...)
+		}
+	}
+	return out
+}
+
+// isOneShotUnit reports whether name is the unit of a service.OneShot: mise-install
+// or a post-reboot command.
+func isOneShotUnit(name string) bool {
+	return name == "mise-install-once.service" ||
+		(strings.HasPrefix(name, "post-reboot-") && strings.HasSuffix(name, "-once.service"))
+}
+
+// unitArtifacts returns the one-shot units still installed, system-wide or
+// for the target user, the keyserver's, rerun and drift units, and the mDNS
+// service file.
+// Units are disabled and stopped before their file is removed, and the
+// manager reloaded after; where there is no systemd, both just fail.
+func (a *app) unitArtifacts(ctx context.Context) []cleanArtifact {
+	var out []cleanArtifact
+	var system []string
+	matches, _ := filepath.Glob(a.sys.Host.Path("/etc/systemd/system/*-once.service"))
+	for _, p := range matches {
+		if isOneShotUnit(filepath.Base(p)) {
+			system = append(system, p)
+		}
+	}
+	// The drift timer goes before the service it starts.
+	for _, p := range []string{a.sys.Host.Path(sshkeys.ServeUnitPath), a.sys.Host.Path(service.RerunUnitPath), a.sys.Host.Path(service.DriftTimerPath), a.sys.Host.Path(service.DriftServicePath)} {
+		if platform.FileExists(p) {
+			system = append(system, p)
+		}
+	}
+	for _, p := range system {
+		out = append(out, cleanArtifact{desc: p, remove: func(ctx context.Context) error {
+			a.sys.RunCmdSudo(ctx, "systemctl", "disable", "--now", filepath.Base(p))
+			if err := a.sys.RunCmdSudo(ctx, "rm", "-f", p); err != nil {
+				return err
+			}
+			a.sys.RunCmdSudo(ctx, "systemctl", "daemon-reload")
+			return nil
+		}})
+	}
+	if u, err := a.sys.TargetUser(); err == nil {
+		dir := filepath.Join(u.HomeDir, ".config", "systemd", "user")
+		matches, _ := filepath.Glob(filepath.Join(dir, "*-once.service"))
+		for _, p := range matches {
+			if !isOneShotUnit(filepath.Base(p)) {
+				continue
+			}
+			out = append(out, cleanArtifact{desc: p, remove: func(ctx context.Context) error {
+				a.services.UserSystemctl(ctx, u, "disable", "--now", filepath.Base(p))
+				if err := a.sys.RunAsUser(ctx, u, "rm -f "+platform.ShellQuote(p), nil); err != nil {
+					return err
+				}
+				a.services.UserSystemctl(ctx, u, "daemon-reload")
+				return nil
+			}})
+		}
+	}
+	if p := a.sys.Host.Path(sshkeys.AvahiServicePath); platform.FileExists(p) {
+		out = append(out, cleanArtifact{desc: p, remove: func(ctx context.Context) error {
+			return a.sys.RunCmdSudo(ctx, "rm", "-f", p)
+		}})
+	}
+	return out
+}
+
+// keyArtifacts returns the GitHub key pair, in ~/.ssh or at --key-path.
+func (a *app) keyArtifacts() []cleanArtifact {
+	key, err := a.keys.GithubKeyPath(a.sys.Host)
+	if err != nil {
+		return nil
+	}
+	return append(pathArtifact(key), pathArtifact(key+".pub")...)
+}
+
+// ansibleUserArtifacts returns what --create-ansible-user recorded setting
+// up: its sudoers rule, then the user and its home if it created the user,
+// or else just the files it installed into the home.
+func (a *app) ansibleUserArtifacts() []cleanArtifact {
+	rec, err := a.ansible.ReadAnsibleUserRecord()
+	if err != nil {
+		return nil
+	}
+	dir, err := a.sys.StateDir()
+	if err != nil {
+		return nil
+	}
+	record := filepath.Join(dir, ansible.UserRecordName)
+	var out []cleanArtifact
+	if p := a.sys.Host.Path(rec.Sudoers); platform.FileExists(p) {
+		out = append(out, cleanArtifact{desc: p, remove: func(ctx context.Context) error {
+			return a.sys.RunCmdSudo(ctx, "rm", "-f", p)
+		}})
+	}
+	if _, err := user.Lookup(rec.User); err == nil && rec.Created {
+		return append(out, cleanArtifact{desc: fmt.Sprintf("user %s and its home %s", rec.User, rec.Home), remove: func(ctx context.Context) error {
+			if err := a.sys.RunCmdSudo(ctx, "userdel", "--remove", rec.User); err != nil {
+				return err
+			}
+			return os.Remove(record)
+		}})
+	}
+	for _, p := range rec.Files {
+		out = append(out, cleanArtifact{desc: p, remove: func(ctx context.Context) error {
+			return a.sys.RunCmdSudo(ctx, "rm", "-f", p)
+		}})
+	}
+	return append(out, pathArtifact(record)...)
+}
+
+// caCertArtifacts returns the certificates --ca-cert recorded installing,
+// each removed from the trust store, which is then rebuilt, and the record.
+func (a *app) caCertArtifacts() []cleanArtifact {
+	rec, err := a.sys.ReadCACertsRecord()
+	if err != nil {
+		return nil
+	}
+	dir, err := a.sys.StateDir()
+	if err != nil {
+		return nil
+	}
+	osID := platform.DetectOS(a.sys.Host)
+	var out []cleanArtifact
+	for _, c := range rec.Certs {
+		if c.SHA1 != "" {
+			out = append(out, cleanArtifact{desc: "CA certificate " + c.Subject + " in " + platform.MacSystemKeychain, remove: func(ctx context.Context) error {
+				return a.sys.RunCmdSudo(ctx, "security", "delete-certificate", "-Z", c.SHA1, "-t", platform.MacSystemKeychain)
+			}})
+			continue
+		}
+		store, ok := platform.CATrustStoreFor(osID)
+		if p := a.sys.Host.Path(c.Path); ok && platform.FileExists(p) {
+			out = append(out, cleanArtifact{desc: p + " (CA certificate " + c.Subject + ")", remove: func(ctx context.Context) error {
+				if err := a.sys.RunCmdSudo(ctx, "rm", "-f", p); err != nil {
+					return err
+				}
+				return a.sys.RunCmdSudo(ctx, store.Update[0], store.Update[1:]...)
+			}})
+		}
+	}
+	return append(out, pathArtifact(filepath.Join(dir, platform.CACertsRecordName))...)
+}
+
+// stateArtifacts returns the state directory and the target user's unit
+// state directory, if that is another one. The lock file stays: clean holds
+// it, and every run creates it anew.
+func (a *app) stateArtifacts() []cleanArtifact {
+	var out []cleanArtifact
+	dir, err := a.sys.StateDir()
+	if err == nil {
+		out = append(out, pathArtifact(dir)...)
+	}
+	if u, err := a.sys.TargetUser(); err == nil && service.UnitStateDir(u) != dir {
+		out = append(out, a.userStateArtifact(u)...)
+	}
+	return out
+}
+
+// userStateArtifact returns u's unit state directory, removed as u.
+func (a *app) userStateArtifact(u *user.User) []cleanArtifact {
+	dir := service.UnitStateDir(u)
+	if _, err := os.Lstat(dir); err != nil {
+		return nil
+	}
+	return []cleanArtifact{{desc: dir, remove: func(ctx context.Context) error {
+		return a.sys.RunAsUser(ctx, u, "rm -rf "+platform.ShellQuote(dir), nil)
+	}}}
+}
+
+// githubKeyArtifact returns the registration of the GitHub public key with
+// the GitHub account gh is logged in to, if there is one. Only a key
+// matching the local one is deleted, whatever its title.
+func (a *app) githubKeyArtifact(ctx context.Context) ([]cleanArtifact, error) {
+	key, err := a.keys.GithubKeyPath(a.sys.Host)
+	if err != nil {
+		return nil, err
+	}
+	pub, err := os.ReadFile(key + ".pub")
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	local := strings.Fields(string(pub))
+	if len(local) < 2 {
+		return nil, fmt.Errorf("%s.pub is not a public key", key)
+	}
+	if err := a.sys.CheckOfflineURL("https://api.github.com/user/keys", "the GitHub key list"); err != nil {
+		return nil, err
+	}
+	out, err := a.sys.CmdOutput(ctx, "gh", "api", "-H", "Accept: application/vnd.github+json",
+		"-H", "X-GitHub-Api-Version: 2022-11-28", "/user/keys")
+	if err != nil {
+		return nil, fmt.Errorf("gh api /user/keys: %w", err)
+	}
+	var registered []struct {
+		ID    int64  `json:"id"`
+		Key   string `json:"key"`
+		Title string `json:"title"`
+	}
+	if err := json.Unmarshal(out, &registered); err != nil {
+		return nil, fmt.Errorf("gh api /user/keys: %w", err)
+	}
+	for _, k := range registered {
+		if f := strings.Fields(k.Key); len(f) < 2 || f[0] != local[0] || f[1] != local[1] {
+			continue
+		}
+		id := fmt.Sprint(k.ID)
+		return []cleanArtifact{{desc: fmt.Sprintf("GitHub key %s (%q)", id, k.Title), remove: func(ctx context.Context) error {
+			return a.github.DeleteGitHubKey(ctx, id)
+		}}}, nil
+	}
+	return nil, nil
+}
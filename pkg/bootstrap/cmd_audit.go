@@ -0,0 +1,79 @@
+package bootstrap
+
+import (
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"text/tabwriter"
+
+	"github.com/sparkleHazard/bootstrap/internal/platform"
+	"github.com/sparkleHazard/bootstrap/internal/sshkeys"
+)
+
+// runAuditCommand implements "audit tail [-n N] [--json]", printing the
+// most recent entries of the key server's audit log.
+func (a *app) runAuditCommand(args []string) int {
+	if len(args) == 0 || args[0] != "tail" {
+		fmt.Fprintln(os.Stderr, "Usage: bootstrap audit tail [-n N] [--json] [flags]")
+		return platform.ExitConfig
+	}
+	var n int
+	var asJSON bool
+	c, _, problems := a.loadConfig("bootstrap audit tail", args[1:], func(fs *flag.FlagSet) {
+		fs.IntVar(&n, "n", 20, "Number of entries to show.")
+		fs.BoolVar(&asJSON, "json", false, "Print the entries as JSON lines, as stored.")
+	})
+	if len(problems) == 1 && errors.Is(problems[0], flag.ErrHelp) {
+		return platform.ExitOK
+	}
+	if len(problems) > 0 {
+		for _, p := range problems {
+			fmt.Fprintln(os.Stderr, "error: "+p.Error())
+		}
+		return platform.ExitConfig
+	}
+	a.configure(c, a.sys.Host)
+
+	path, err := a.keys.ServeAuditPath()
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err.Error())
+		return platform.ExitFailure
+	}
+	lines, err := sshkeys.AuditTail(path, n)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err.Error())
+		return platform.ExitFailure
+	}
+	if asJSON {
+		for _, l := range lines {
+			fmt.Println(l)
+		}
+		return platform.ExitOK
+	}
+	w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(w, "TIME\tCLIENT\tHOST\tTOKEN\tPATH\tRESULT")
+	for _, l := range lines {
+		var e sshkeys.AuditEntry
+		if err := json.Unmarshal([]byte(l), &e); err != nil {
+			continue
+		}
+		client := e.Client
+		if e.Forwarded != "" {
+			client = e.Forwarded + " via " + client
+		}
+		token := e.Token
+		if token == "" {
+			token = e.TokenID
+		}
+		result := e.Result
+		if e.Reason != "" {
+			result += ": " + e.Reason
+		}
+		fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%s\t%s\n", e.Time.Local().Format("2006-01-02 15:04:05"), client,
+			platform.DashIfEmpty(e.Hostname), platform.DashIfEmpty(token), e.Path, result)
+	}
+	w.Flush()
+	return platform.ExitOK
+}
@@ -0,0 +1,44 @@
+package bootstrap
+
+import (
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+
+	"github.com/sparkleHazard/bootstrap/internal/platform"
+)
+
+// runFactsCommand implements "facts [--json]": it prints the facts a run
+// would gather, without changing anything.
+func (a *app) runFactsCommand(args []string) int {
+	var asJSON bool
+	c, _, problems := a.loadConfig("bootstrap facts", args, func(fs *flag.FlagSet) {
+		fs.BoolVar(&asJSON, "json", false, "Print the facts as JSON.")
+	})
+	if len(problems) == 1 && errors.Is(problems[0], flag.ErrHelp) {
+		return platform.ExitOK
+	}
+	if len(problems) > 0 {
+		for _, p := range problems {
+			fmt.Fprintln(os.Stderr, "error: "+p.Error())
+		}
+		return platform.ExitConfig
+	}
+	a.configure(c, a.sys.Host)
+	ctx, stop := a.sys.HandleSignals()
+	defer stop()
+
+	f := a.sys.GatherFacts(ctx, a.sys.Host, platform.DetectOS(a.sys.Host))
+	if asJSON {
+		enc := json.NewEncoder(os.Stdout)
+		enc.SetIndent("", "  ")
+		enc.Encode(f)
+		return platform.ExitOK
+	}
+	for _, line := range f.Lines() {
+		fmt.Println(line)
+	}
+	return platform.ExitOK
+}
@@ -0,0 +1,229 @@
+package bootstrap
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"text/tabwriter"
+	"time"
+
+	"github.com/sparkleHazard/bootstrap/internal/platform"
+	"github.com/sparkleHazard/bootstrap/internal/remote"
+)
+
+// runFleetCommand implements "fleet --hosts FILE": it runs bootstrap on
+// every host of the file, as "remote" does on one, --parallel at a time,
+// each with its overrides and its output in its own log file. A live status
+// table shows them on the terminal, and a report of each host's outcome and
+// exit code is printed and written to the log directory at the end.
+func (a *app) runFleetCommand(args []string) int {
+	var hostsFile, logDir, jump, identity, binary string
+	var parallel int
+	var failFast, asJSON, acceptNew, askSudo bool
+	c, fs, problems := a.loadConfig("bootstrap fleet", args, func(fs *flag.FlagSet) {
+		fs.StringVar(&hostsFile, "hosts", "", "YAML file listing the hosts to bootstrap, each with its own role, jump and extra-vars if given.")
+		fs.IntVar(&parallel, "parallel", 8, "Number of hosts to bootstrap at once.")
+		fs.BoolVar(&failFast, "fail-fast", false, "Once a host fails, stop the runs on the others and start no more.")
+		fs.StringVar(&logDir, "log-dir", "", "Directory for the hosts' logs and result files and the report (default: bootstrap-fleet-TIMESTAMP in the current directory).")
+		fs.BoolVar(&asJSON, "json", false, "Print the report as JSON instead of a table.")
+		fs.StringVar(&jump, "jump", "", "Jump host(s) to reach the hosts through that have no jump of their own, as ssh -J takes them.")
+		fs.StringVar(&identity, "ssh-identity", "", "SSH identity file to log in with (default: ssh's own).")
+		fs.BoolVar(&acceptNew, "accept-new-host-key", false, "Trust a host's key if known_hosts has none for it yet, instead of refusing to connect.")
+		fs.BoolVar(&askSudo, "ask-sudo-password", false, "Ask once for the sudo password the hosts share, for those whose sudo wants one.")
+		fs.StringVar(&binary, "binary", "", "bootstrap binary for the hosts' platform, when it differs from this one's (default: download this release's).")
+	})
+	if len(problems) == 1 && errors.Is(problems[0], flag.ErrHelp) {
+		return platform.ExitOK
+	}
+	a.configure(c, a.sys.Host)
+	problems = append(problems, validateConfig(a.cfg)...)
+	var entries []remote.FleetEntry
+	if hostsFile == "" {
+		problems = append(problems, errors.New("usage: bootstrap fleet --hosts FILE [flags]"))
+	} else if e, err := remote.ReadFleetHosts(hostsFile); err != nil {
+		problems = append(problems, err)
+	} else {
+		entries = e
+	}
+	if rest := fs.Args(); len(rest) > 0 {
+		problems = append(problems, fmt.Errorf("fleet takes its hosts from --hosts, not %s", strings.Join(rest, " ")))
+	}
+	if parallel < 1 {
+		problems = append(problems, errors.New("parallel must be at least 1"))
+	}
+	if a.cfg.KeyStdin || a.cfg.KeyB64Env != "" {
+		problems = append(problems, errors.New("key-stdin and key-b64-env cannot reach a remote run; use key-ssm or the keyserver"))
+	}
+	if askSudo && !platform.StdinIsTerminal() {
+		problems = append(problems, errors.New("ask-sudo-password needs a terminal to ask on"))
+	}
+	if len(problems) > 0 {
+		for _, p := range problems {
+			fmt.Fprintln(os.Stderr, "error: "+p.Error())
+		}
+		return platform.ExitConfig
+	}
+
+	if logDir == "" {
+		logDir = "bootstrap-fleet-" + time.Now().Format("20060102-150405")
+	}
+	// The logs and result files may show secrets the playbook prints.
+	if err := os.MkdirAll(logDir, 0700); err != nil {
+		fmt.Fprintln(os.Stderr, "error: log-dir: "+err.Error())
+		return platform.ExitFailure
+	}
+	f := &remote.Fleet{
+		LogDir:    logDir,
+		Jump:      jump,
+		Identity:  identity,
+		AcceptNew: acceptNew,
+		Binaries:  &remote.FleetBinaries{Binary: binary, ByAsset: map[string]remote.FleetBinary{}, Remote: a.remote},
+		Live:      platform.ProgressEnabled(a.cfg),
+		Remote:    a.remote,
+	}
+	settings := remote.Settings(fs, remote.FleetFlags)
+	for _, e := range entries {
+		h := &remote.FleetHost{FleetEntry: e, Settings: settings + e.Overrides(hostsFile), State: "pending"}
+		h.Result = remote.FleetResult{Host: e.Host, Role: a.cfg.Role, Status: "not-started"}
+		if e.Role != "" {
+			h.Result.Role = e.Role
+		}
+		file, err := platform.OpenFile(filepath.Join(logDir, e.LogName()+".log"), os.O_WRONLY|os.O_TRUNC, 0600)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, "error: "+err.Error())
+			return platform.ExitFailure
+		}
+		defer file.Close()
+		h.File = file
+		f.Hosts = append(f.Hosts, h)
+	}
+	if askSudo {
+		password, err := remote.AskSudoPassword("the hosts")
+		if err != nil {
+			fmt.Fprintln(os.Stderr, "error: "+err.Error())
+			return platform.ExitPrivileges
+		}
+		f.Password = password
+	}
+
+	ctx, stop := a.sys.HandleSignals()
+	defer stop()
+	runCtx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	if !asJSON {
+		a.sys.Log(fmt.Sprintf("Bootstrapping %d host(s) from %s, %d at a time; logs in %s.", len(f.Hosts), hostsFile, parallel, logDir))
+	}
+
+	f.Started = time.Now()
+	drawn := make(chan struct{})
+	if f.Live {
+		go func() {
+			defer close(drawn)
+			for {
+				f.Draw()
+				select {
+				case <-runCtx.Done():
+				case <-time.After(remote.FleetRedrawInterval):
+					continue
+				}
+				if runCtx.Err() != nil {
+					return
+				}
+			}
+		}()
+	} else {
+		close(drawn)
+	}
+
+	sem := make(chan struct{}, parallel)
+	var wg sync.WaitGroup
+	for _, h := range f.Hosts {
+		select {
+		case sem <- struct{}{}:
+		case <-runCtx.Done():
+		}
+		if runCtx.Err() != nil {
+			break
+		}
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			defer func() { <-sem }()
+			f.RunHost(runCtx, h)
+			if !f.Live && !asJSON {
+				a.sys.Log(h.Host + ": " + h.Result.Summary())
+			}
+			if failFast && h.Result.Failed() {
+				f.StopFor(h.Host)
+				cancel()
+			}
+		}()
+	}
+	wg.Wait()
+	cancel()
+	<-drawn
+	f.Erase()
+
+	report := remote.FleetReport{
+		HostsFile:  hostsFile,
+		StartedAt:  f.Started,
+		FinishedAt: time.Now(),
+		Counts:     map[string]int{},
+	}
+	report.DurationSeconds = report.FinishedAt.Sub(report.StartedAt).Seconds()
+	failed, drifted := 0, 0
+	for _, h := range f.Hosts {
+		report.Hosts = append(report.Hosts, h.Result)
+		report.Counts[h.Result.Status]++
+		if h.Result.Failed() {
+			failed++
+		} else if h.Result.Status == "drift" {
+			drifted++
+		}
+	}
+	switch {
+	case ctx.Err() != nil:
+		report.ExitCode = platform.ExitInterrupted
+	case failed > 0:
+		report.ExitCode = platform.ExitFailure
+	case drifted > 0:
+		report.ExitCode = platform.ExitDrift
+	default:
+		report.ExitCode = platform.ExitOK
+	}
+	data, _ := json.MarshalIndent(report, "", "  ")
+	if _, err := a.sys.WriteFile(ctx, filepath.Join(logDir, remote.FleetReportName), append(data, '\n'), 0600, ""); err != nil {
+		a.sys.Log("Warning: writing the report failed: " + err.Error())
+	}
+
+	if asJSON {
+		fmt.Println(string(data))
+	} else {
+		w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+		fmt.Fprintln(w, "HOST\tROLE\tSTATUS\tEXIT\tTIME\tERROR")
+		for _, r := range report.Hosts {
+			exit, took := "-", "-"
+			if r.ExitCode != nil {
+				exit = fmt.Sprint(*r.ExitCode)
+				took = (time.Duration(r.DurationSeconds * float64(time.Second))).Round(time.Second).String()
+			}
+			fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%s\t%s\n", r.Host, r.Role, r.Status, exit, took, platform.DashIfEmpty(r.ErrorText()))
+		}
+		w.Flush()
+		msg := fmt.Sprintf("%d of %d host(s) failed", failed-report.Counts["not-started"], len(report.Hosts))
+		if n := report.Counts["not-started"]; n > 0 {
+			msg += fmt.Sprintf(", %d not started", n)
+		}
+		if f.FailedBy != "" && ctx.Err() == nil {
+			msg += "; the rest were stopped after " + f.FailedBy + " failed (--fail-fast)"
+		}
+		a.sys.Log(msg + ". Logs and " + remote.FleetReportName + " are in " + logDir + ".")
+	}
+	return report.ExitCode
+}
@@ -0,0 +1,100 @@
+package bootstrap
+
+import (
+	"encoding/base64"
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/sparkleHazard/bootstrap/internal/config"
+	"github.com/sparkleHazard/bootstrap/internal/platform"
+	"github.com/sparkleHazard/bootstrap/internal/release"
+)
+
+// runGenCloudInitCommand implements "gen-cloudinit": it prints a
+// #cloud-config document that writes the effective configuration to
+// platform.DefaultConfigPath, then downloads a release binary, checks it against the
+// release's SHA256SUMS, and runs it non-interactively.
+func (a *app) runGenCloudInitCommand(args []string) int {
+	var tag, downloadURL, sumsFile, cloud, roleTag, output string
+	var encode bool
+	c, fs, problems := a.loadConfig("bootstrap gen-cloudinit", args, func(fs *flag.FlagSet) {
+		fs.StringVar(&tag, "release", "", "Release tag whose binary the instance runs (default: this binary's version).")
+		fs.StringVar(&downloadURL, "download-url", "", "URL the release's assets are downloaded from, such as a mirror (default: the GitHub release).")
+		fs.StringVar(&sumsFile, "sums", "", "Take the binaries' digests from this SHA256SUMS file instead of downloading the release's.")
+		fs.StringVar(&cloud, "cloud", "none", "Cloud to read the host name and role from the instance metadata of: none, ec2, gcp or azure.")
+		fs.StringVar(&roleTag, "role-tag", "bootstrap-role", "Instance tag (EC2, Azure) or metadata attribute (GCP) the role is read from, with --cloud.")
+		fs.StringVar(&output, "output", "", "Write the user-data to this file instead of standard output.")
+		fs.BoolVar(&encode, "base64", false, "Encode the user-data in base64, for providers that want it so.")
+	})
+	if len(problems) == 1 && errors.Is(problems[0], flag.ErrHelp) {
+		return platform.ExitOK
+	}
+	a.configure(c, a.sys.Host)
+	problems = append(problems, validateConfig(a.cfg)...)
+	if tag == "" {
+		tag = platform.ToolVersion()
+	}
+	if _, ok := release.ParseVersion(tag); !ok {
+		problems = append(problems, fmt.Errorf("release %q is not a release tag; a development build needs --release", tag))
+	}
+	if _, ok := release.CloudRoleLookups[cloud]; !ok && cloud != "none" {
+		problems = append(problems, fmt.Errorf("cloud must be none, ec2, gcp or azure, not %q", cloud))
+	}
+	if downloadURL != "" && (!strings.HasPrefix(downloadURL, "https://") && !strings.HasPrefix(downloadURL, "http://") || strings.ContainsAny(downloadURL, "\"$`\\ ")) {
+		problems = append(problems, fmt.Errorf("download-url %q is not an http(s) URL", downloadURL))
+	}
+	if !config.RoleNameRegex.MatchString(roleTag) {
+		problems = append(problems, fmt.Errorf("role-tag %q is not a valid tag name", roleTag))
+	}
+	if len(problems) > 0 {
+		for _, p := range problems {
+			fmt.Fprintln(os.Stderr, "error: "+p.Error())
+		}
+		return platform.ExitConfig
+	}
+	ctx, stop := a.sys.HandleSignals()
+	defer stop()
+
+	if downloadURL == "" {
+		downloadURL = release.DownloadURL + tag
+	}
+	downloadURL = strings.TrimSuffix(downloadURL, "/")
+	sums, err := a.updater.ReleaseSums(ctx, downloadURL, sumsFile)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "error: "+err.Error())
+		return platform.ExitFailure
+	}
+	settings := release.GenCloudInitSettings(fs)
+	if cloud != "none" && !a.cfg.HostnameFromMetadata && a.cfg.Hostname == "" {
+		settings = append(settings, "hostname-from-metadata = true")
+	}
+	for _, s := range settings {
+		name, _, _ := strings.Cut(s, " = ")
+		if !strings.HasSuffix(name, "-file") && (strings.Contains(name, "token") || strings.Contains(name, "password") || strings.Contains(name, "secret")) {
+			fmt.Fprintf(os.Stderr, "warning: the user-data includes %s; anyone who can read the instance's metadata can read it\n", name)
+		}
+	}
+	script, err := release.CloudInitScript(tag, downloadURL, sums, cloud, roleTag)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "error: "+err.Error())
+		return platform.ExitFailure
+	}
+
+	doc := release.CloudConfig(tag, settings, script)
+	if encode {
+		doc = base64.StdEncoding.EncodeToString([]byte(doc)) + "\n"
+	}
+	if output == "" {
+		fmt.Print(doc)
+		return platform.ExitOK
+	}
+	// The config can hold secrets, so the file is only for its owner.
+	if _, err := a.sys.WriteFile(ctx, output, []byte(doc), 0600, ""); err != nil {
+		fmt.Fprintln(os.Stderr, "error: "+err.Error())
+		return platform.ExitFailure
+	}
+	return platform.ExitOK
+}
@@ -0,0 +1,125 @@
+package bootstrap
+
+import (
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"text/tabwriter"
+
+	"github.com/sparkleHazard/bootstrap/internal/platform"
+	"github.com/sparkleHazard/bootstrap/internal/sshkeys"
+)
+
+// runPushKeysCommand implements "push-keys", copying this keyserver's
+// GitHub private key to every host of the fleet over SSH.
+func (a *app) runPushKeysCommand(args []string) int {
+	var hostList, hostsFile, identity string
+	var parallel int
+	var verify, asJSON bool
+	c, _, problems := a.loadConfig("bootstrap push-keys", args, func(fs *flag.FlagSet) {
+		fs.StringVar(&hostList, "hosts", "", "Comma-separated hosts to push the key to, each [user@]host[:port].")
+		fs.StringVar(&hostsFile, "hosts-file", "", "File listing hosts to push the key to, one [user@]host[:port] per line.")
+		fs.IntVar(&parallel, "parallel", 8, "Number of hosts to push to at once.")
+		fs.BoolVar(&verify, "verify", false, "After placing the key, check on each host that GitHub accepts it.")
+		fs.StringVar(&identity, "ssh-identity", "", "SSH identity file to log in to the hosts with (default: ssh's own).")
+		fs.BoolVar(&asJSON, "json", false, "Print the per-host results as JSON instead of a table.")
+	})
+	if len(problems) == 1 && errors.Is(problems[0], flag.ErrHelp) {
+		return platform.ExitOK
+	}
+	hosts, err := sshkeys.PushHosts(hostList, hostsFile)
+	if err != nil {
+		problems = append(problems, err)
+	} else if len(hosts) == 0 {
+		problems = append(problems, errors.New("no hosts given; use --hosts or --hosts-file"))
+	}
+	if parallel < 1 {
+		problems = append(problems, errors.New("parallel must be at least 1"))
+	}
+	if len(problems) > 0 {
+		for _, p := range problems {
+			fmt.Fprintln(os.Stderr, "error: "+p.Error())
+		}
+		return platform.ExitConfig
+	}
+	a.configure(c, a.sys.Host)
+
+	homeDir, err := a.sys.Host.HomeDir()
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "unable to determine home directory: "+err.Error())
+		return platform.ExitFailure
+	}
+	keyPath, err := a.keys.GithubKeyPath(a.sys.Host)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err.Error())
+		return platform.ExitFailure
+	}
+	key, err := os.ReadFile(keyPath)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "reading the GitHub key: "+err.Error())
+		return platform.ExitFailure
+	}
+
+	ctx, stop := a.sys.HandleSignals()
+	defer stop()
+	// A key in the home directory goes to the same place in each host's.
+	remoteKey := platform.ShellQuote(keyPath)
+	if rel, err := filepath.Rel(homeDir, keyPath); err == nil && !strings.HasPrefix(rel, "..") {
+		remoteKey = `"$HOME"/` + platform.ShellQuote(rel)
+	}
+	script := "key=" + remoteKey + "\n" + sshkeys.PushKeyScript
+	if verify {
+		script += sshkeys.PushVerifyScript
+	}
+	if !asJSON {
+		a.sys.Log(fmt.Sprintf("Pushing %s to %d host(s), %d at a time...", keyPath, len(hosts), parallel))
+	}
+
+	results := make([]sshkeys.PushResult, len(hosts))
+	sem := make(chan struct{}, parallel)
+	var wg sync.WaitGroup
+	for i, h := range hosts {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			sem <- struct{}{}
+			defer func() { <-sem }()
+			results[i] = a.keys.PushKey(ctx, h, identity, script, key)
+			if !asJSON {
+				a.sys.Log(h + ": " + results[i].Summary())
+			}
+		}()
+	}
+	wg.Wait()
+
+	failed := 0
+	for _, r := range results {
+		if r.Status == "failed" || r.Verify == "failed" {
+			failed++
+		}
+	}
+	if asJSON {
+		data, _ := json.MarshalIndent(results, "", "  ")
+		fmt.Println(string(data))
+	} else {
+		w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+		fmt.Fprintln(w, "HOST\tSTATUS\tVERIFY\tERROR")
+		for _, r := range results {
+			fmt.Fprintf(w, "%s\t%s\t%s\t%s\n", r.Host, r.Status, platform.DashIfEmpty(r.Verify), platform.DashIfEmpty(r.Error))
+		}
+		w.Flush()
+		a.sys.Log(fmt.Sprintf("%d of %d host(s) failed.", failed, len(results)))
+	}
+	if ctx.Err() != nil {
+		return platform.ExitInterrupted
+	}
+	if failed > 0 {
+		return platform.ExitFailure
+	}
+	return platform.ExitOK
+}
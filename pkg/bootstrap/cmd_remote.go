@@ -0,0 +1,84 @@
+package bootstrap
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/sparkleHazard/bootstrap/internal/platform"
+	"github.com/sparkleHazard/bootstrap/internal/remote"
+)
+
+// runRemoteCommand implements "remote [flags] [user@]host[:port] [flags]":
+// it copies a binary for the host's platform there over SSH, runs it with
+// this configuration, streaming its output prefixed with the host, and
+// exits with the remote run's exit code, having copied its result file
+// back to --result-file.
+func (a *app) runRemoteCommand(args []string) int {
+	// The host may come before the flags, as in "remote admin@web1 --jump
+	// bastion", or after them.
+	var host string
+	if len(args) > 0 && !strings.HasPrefix(args[0], "-") {
+		host, args = args[0], args[1:]
+	}
+	var jump, identity, binary string
+	var acceptNew, askSudo bool
+	c, fs, problems := a.loadConfig("bootstrap remote", args, func(fs *flag.FlagSet) {
+		fs.StringVar(&jump, "jump", "", "Jump host(s) to reach the host through, as ssh -J takes them: [user@]host[:port], comma-separated.")
+		fs.StringVar(&identity, "ssh-identity", "", "SSH identity file to log in with (default: ssh's own).")
+		fs.BoolVar(&acceptNew, "accept-new-host-key", false, "Trust the host's key if known_hosts has none for it yet, instead of refusing to connect.")
+		fs.BoolVar(&askSudo, "ask-sudo-password", false, "Ask for the remote user's sudo password here, and run bootstrap there under sudo with it.")
+		fs.StringVar(&binary, "binary", "", "bootstrap binary for the host's platform, when it differs from this one's (default: download this release's).")
+	})
+	if len(problems) == 1 && errors.Is(problems[0], flag.ErrHelp) {
+		return platform.ExitOK
+	}
+	a.configure(c, a.sys.Host)
+	problems = append(problems, validateConfig(a.cfg)...)
+	rest := fs.Args()
+	if host == "" && len(rest) > 0 {
+		host, rest = rest[0], rest[1:]
+	}
+	switch {
+	case host == "":
+		problems = append(problems, errors.New("usage: bootstrap remote [flags] [user@]host[:port]"))
+	case len(rest) > 0:
+		problems = append(problems, fmt.Errorf("remote takes one host, not also %s", strings.Join(rest, " ")))
+	case strings.HasPrefix(host, "-") || strings.ContainsAny(host, " \t"):
+		problems = append(problems, fmt.Errorf("invalid host %q", host))
+	}
+	if a.cfg.KeyStdin || a.cfg.KeyB64Env != "" {
+		problems = append(problems, errors.New("key-stdin and key-b64-env cannot reach a remote run; use key-ssm or the keyserver"))
+	}
+	if askSudo && !platform.StdinIsTerminal() {
+		problems = append(problems, errors.New("ask-sudo-password needs a terminal to ask on"))
+	}
+	if len(problems) > 0 {
+		for _, p := range problems {
+			fmt.Fprintln(os.Stderr, "error: "+p.Error())
+		}
+		return platform.ExitConfig
+	}
+	ctx, stop := a.sys.HandleSignals()
+	defer stop()
+
+	r := a.remote.NewRemoteHost(host, jump, identity, acceptNew)
+	run := remote.Run{
+		Settings: remote.Settings(fs, remote.Flags),
+		Binary: func(ctx context.Context, goos, goarch, asset string) ([]byte, string, error) {
+			return a.remote.RemoteBinary(ctx, goos, goarch, asset, binary, a.sys.Log)
+		},
+		ResultFile: a.cfg.ResultFile,
+	}
+	if askSudo {
+		run.Password = func() ([]byte, error) { return remote.AskSudoPassword(host) }
+	}
+	code, err := r.Bootstrap(ctx, run)
+	if err != nil {
+		a.sys.Log("Remote bootstrap of " + host + " failed: " + err.Error())
+	}
+	return code
+}
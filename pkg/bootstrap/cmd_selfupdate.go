@@ -0,0 +1,62 @@
+package bootstrap
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+
+	"github.com/sparkleHazard/bootstrap/internal/platform"
+	"github.com/sparkleHazard/bootstrap/internal/release"
+)
+
+// runSelfUpdateCommand implements "self-update [--check] [--force]",
+// replacing the running binary with the latest release's. --force, the
+// run's own flag, installs the release even if it is not newer.
+func (a *app) runSelfUpdateCommand(args []string) int {
+	var check bool
+	c, _, problems := a.loadConfig("bootstrap self-update", args, func(fs *flag.FlagSet) {
+		fs.BoolVar(&check, "check", false, "Only report whether a newer release exists.")
+	})
+	if len(problems) == 1 && errors.Is(problems[0], flag.ErrHelp) {
+		return platform.ExitOK
+	}
+	if len(problems) > 0 {
+		for _, p := range problems {
+			fmt.Fprintln(os.Stderr, "error: "+p.Error())
+		}
+		return platform.ExitConfig
+	}
+	a.configure(c, a.sys.Host)
+	ctx, stop := a.sys.HandleSignals()
+	defer stop()
+	ctx, cancel := context.WithTimeout(ctx, release.UpdateTimeout)
+	defer cancel()
+
+	rel, err := a.updater.LatestRelease(ctx)
+	if err != nil {
+		a.sys.Log("Checking for a newer release failed: " + err.Error())
+		return platform.ExitFailure
+	}
+	current := platform.ToolVersion()
+	newer := release.VersionNewer(rel.TagName, current)
+	if check {
+		a.sys.Log(release.UpdateStatus(rel.TagName, current, newer))
+		return platform.ExitOK
+	}
+	if !newer && !a.cfg.Force {
+		if _, ok := release.ParseVersion(current); !ok {
+			a.sys.Log(fmt.Sprintf("This is a development build (%s); use --force to replace it with %s.", current, rel.TagName))
+		} else {
+			a.sys.Log(fmt.Sprintf("bootstrap %s is up to date.", current))
+		}
+		return platform.ExitOK
+	}
+	if err := a.updater.InstallRelease(ctx, rel); err != nil {
+		a.sys.Log("Self-update failed: " + err.Error())
+		return platform.ExitFailure
+	}
+	a.sys.Log(fmt.Sprintf("Updated bootstrap from %s to %s.", current, rel.TagName))
+	return platform.ExitOK
+}
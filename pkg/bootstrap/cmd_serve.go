@@ -0,0 +1,79 @@
+package bootstrap
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"net"
+	"path/filepath"
+	"time"
+
+	"github.com/sparkleHazard/bootstrap/internal/config"
+	"github.com/sparkleHazard/bootstrap/internal/platform"
+)
+
+// runServeCommand implements "serve [--install-unit | --issue-token]", an
+// HTTPS file server for the keys in --serve-dir that other hosts fetch with
+// an https:// --keyserver and a bootstrap token.
+func (a *app) runServeCommand(args []string) int {
+	var installUnit, issue bool
+	var tokenTTL time.Duration
+	var tokenLabel string
+	c, _, problems := a.loadConfig("bootstrap serve", args, func(fs *flag.FlagSet) {
+		fs.BoolVar(&installUnit, "install-unit", false, "Install, enable and start a systemd unit running the key server, then exit.")
+		fs.BoolVar(&issue, "issue-token", false, "Issue a new bootstrap token, print it, and exit.")
+		fs.DurationVar(&tokenTTL, "token-ttl", 24*time.Hour, "How long an issued token is valid (0: forever).")
+		fs.StringVar(&tokenLabel, "token-label", "", "Label recorded with an issued token, e.g. the image or request it is for.")
+	})
+	if len(problems) == 1 && errors.Is(problems[0], flag.ErrHelp) {
+		return platform.ExitOK
+	}
+	problems = append(problems, validateServe(c)...)
+	if len(problems) > 0 {
+		for _, p := range problems {
+			a.sys.Log("Configuration error: " + p.Error())
+		}
+		return platform.ExitConfig
+	}
+	a.configure(c, a.sys.Host)
+
+	if issue {
+		token, err := a.keys.IssueToken(tokenTTL, tokenLabel)
+		if err != nil {
+			a.sys.Log("Issuing a token failed: " + err.Error())
+			return platform.ExitFailure
+		}
+		fmt.Println(token)
+		return platform.ExitOK
+	}
+	if installUnit {
+		if err := a.keys.InstallServeUnit(); err != nil {
+			a.sys.Log("Installing the key server unit failed: " + err.Error())
+			return platform.ExitCodeFor(err)
+		}
+		return platform.ExitOK
+	}
+
+	ctx, stop := a.sys.HandleSignals()
+	defer stop()
+	if err := a.keys.ServeKeys(ctx); err != nil {
+		a.sys.Log("Key server failed: " + err.Error())
+		return platform.ExitFailure
+	}
+	return platform.ExitOK
+}
+
+// validateServe checks the settings the key server uses.
+func validateServe(c *config.Config) []error {
+	var problems []error
+	if _, _, err := net.SplitHostPort(c.ServeAddr); err != nil {
+		problems = append(problems, fmt.Errorf("serve-addr %q: %v", c.ServeAddr, err))
+	}
+	if !filepath.IsAbs(c.ServeDir) {
+		problems = append(problems, fmt.Errorf("serve-dir %q must be an absolute path", c.ServeDir))
+	}
+	if (c.ServeCert == "") != (c.ServeKey == "") {
+		problems = append(problems, errors.New("serve-cert and serve-key must be set together"))
+	}
+	return problems
+}
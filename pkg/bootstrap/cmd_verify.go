@@ -0,0 +1,65 @@
+package bootstrap
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+
+	"github.com/sparkleHazard/bootstrap/internal/platform"
+	"github.com/sparkleHazard/bootstrap/internal/release"
+)
+
+// runVerifyCommand implements "verify": it prints the version and digests
+// of the running executable and exits nonzero if they do not match, or,
+// with --strict-integrity, if it is a development build. --stamp stamps
+// another binary instead, as the release workflow does.
+func (a *app) runVerifyCommand(args []string) int {
+	var stamp string
+	c, _, problems := a.loadConfig("bootstrap verify", args, func(fs *flag.FlagSet) {
+		fs.StringVar(&stamp, "stamp", "", "Stamp the binary at this path with its integrity digest, instead of verifying this one.")
+	})
+	if len(problems) == 1 && errors.Is(problems[0], flag.ErrHelp) {
+		return platform.ExitOK
+	}
+	if len(problems) > 0 {
+		for _, p := range problems {
+			fmt.Fprintln(os.Stderr, "error: "+p.Error())
+		}
+		return platform.ExitConfig
+	}
+	a.configure(c, a.sys.Host)
+
+	if stamp != "" {
+		digest, err := a.updater.StampIntegrity(stamp)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, "error: "+err.Error())
+			return platform.ExitFailure
+		}
+		fmt.Printf("%s: stamped %s\n", stamp, digest)
+		return platform.ExitOK
+	}
+	r, err := release.VerifyIntegrity()
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "error: "+err.Error())
+		return platform.ExitFailure
+	}
+	fmt.Printf("version:    %s\n", platform.ToolVersion())
+	fmt.Printf("executable: %s\n", r.Path)
+	fmt.Printf("sha256:     %s\n", r.SHA256)
+	fmt.Printf("stamped:    %s\n", platform.DashIfEmpty(r.Stamped))
+	fmt.Printf("computed:   %s\n", platform.DashIfEmpty(r.Computed))
+	switch {
+	case r.OK():
+		fmt.Println("integrity:  ok")
+	case r.Stamped == "":
+		fmt.Println("integrity:  unverified (development build)")
+		if a.cfg.StrictIntegrity {
+			return platform.ExitFailure
+		}
+	default:
+		fmt.Println("integrity:  MISMATCH")
+		return platform.ExitFailure
+	}
+	return platform.ExitOK
+}
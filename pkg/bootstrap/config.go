@@ -0,0 +1,778 @@
+package bootstrap
+
+import (
+	"bufio"
+	"context"
+	_ "embed"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"net"
+	"net/mail"
+	"net/url"
+	"os"
+	"path/filepath"
+	"regexp"
+	"slices"
+	"strings"
+
+	"github.com/sparkleHazard/bootstrap/internal/ansible"
+	"github.com/sparkleHazard/bootstrap/internal/config"
+	"github.com/sparkleHazard/bootstrap/internal/github"
+	"github.com/sparkleHazard/bootstrap/internal/platform"
+	"github.com/sparkleHazard/bootstrap/internal/report"
+	"github.com/sparkleHazard/bootstrap/internal/secrets"
+	"github.com/sparkleHazard/bootstrap/internal/service"
+	"github.com/sparkleHazard/bootstrap/internal/sshkeys"
+)
+
+// defaultConfigFile is the commented default configuration. It is the single
+// source of truth for built-in values and is what init-config writes out.
+//
+//go:embed defaults.conf
+var defaultConfigFile string
+
+// newDefaultConfig returns a config populated with the built-in defaults.
+func newDefaultConfig() *config.Config {
+	c := &config.Config{}
+	fs := configFlagSet(c, "defaults")
+	if errs := applyConfig(fs, "defaults.conf", strings.NewReader(defaultConfigFile)); len(errs) > 0 {
+		panic(fmt.Sprintf("embedded defaults.conf: %v", errors.Join(errs...)))
+	}
+	return c
+}
+
+// configFlagSet registers every config field as a flag on a new FlagSet.
+func configFlagSet(c *config.Config, name string) *flag.FlagSet {
+	fs := flag.NewFlagSet(name, flag.ContinueOnError)
+	fs.StringVar(&c.ConfigFile, "config", c.ConfigFile, "Path to a config file (default "+platform.DefaultConfigPath+" if present).")
+	fs.StringVar(&c.Role, "role", c.Role, "Role to use for provisioning (e.g., base, keyserver, webserver).")
+	fs.StringVar(&c.Hostname, "hostname", c.Hostname, "Set the host name to this RFC 1123 name before provisioning.")
+	fs.BoolVar(&c.HostnameFromMetadata, "hostname-from-metadata", c.HostnameFromMetadata, "Set the host name to the one the cloud metadata service (EC2, GCE, Azure, OpenStack) gives the instance.")
+	fs.StringVar(&c.Locale, "locale", c.Locale, "UTF-8 locale to run the playbook in, generated if it is missing.")
+	fs.BoolVar(&c.SkipLocaleSetup, "skip-locale-setup", c.SkipLocaleSetup, "Do not check, generate or export a UTF-8 locale.")
+	fs.BoolVar(&c.NoSELinuxFixup, "no-selinux-fixup", c.NoSELinuxFixup, "Do not restorecon the keys, unit files and configuration a run writes where SELinux is enabled.")
+	fs.Var(&c.ExtraPrereqs, "extra-prereq", "Package (\"pkg[,os-or-manager=name...]\") to install after the built-in prerequisites; repeat for several.")
+	fs.Var(&c.RolePrereqs, "role-prereqs", "Prerequisites (\"ROLE=ITEM ...\", built-in names or extra-prereq packages) replacing ROLE's built-in set; repeat for several roles.")
+	fs.BoolVar(&c.PythonApt, "python-apt", c.PythonApt, "On Debian and Ubuntu, install python3-apt for the playbook's apt modules.")
+	fs.Var(&c.CreateAnsibleUser, "create-ansible-user", "Create a system user (default \""+config.DefaultAnsibleUser+"\", or this `name`) with the GitHub key, the vault password file and a sudoers rule, to run the playbook later.")
+	fs.StringVar(&c.AnsibleSudoersTemplate, "ansible-sudoers-template", c.AnsibleSudoersTemplate, "Template file for create-ansible-user's sudoers rule, with {{.User}} for the user name (default: passwordless root).")
+	fs.BoolVar(&c.Verbose, "verbose", c.Verbose, "Enable verbose output.")
+	fs.BoolVar(&c.RunMiseInstall, "mise-install", c.RunMiseInstall, "Enable one-shot systemd service for 'mise install' after reboot.")
+	fs.StringVar(&c.Keyserver, "keyserver", c.Keyserver, "Location of the GitHub SSH private key: rsync host/module/path, an https:// URL, or auto to discover it over mDNS.")
+	fs.BoolVar(&c.WaitForKeyserver, "wait-for-keyserver", c.WaitForKeyserver, "Wait for an rsync keyserver to list the key before fetching it (https keyservers are always waited for).")
+	fs.DurationVar(&c.KeyserverWaitTimeout, "keyserver-wait-timeout", c.KeyserverWaitTimeout, "How long to wait for the keyserver to be ready (0: do not wait).")
+	fs.StringVar(&c.KeyserverFallback, "keyserver-fallback", c.KeyserverFallback, "Keyserver used with --keyserver auto when mDNS discovery finds none.")
+	fs.DurationVar(&c.MdnsTimeout, "mdns-timeout", c.MdnsTimeout, "How long --keyserver auto waits for a keyserver to answer over mDNS.")
+	fs.BoolVar(&c.MdnsAdvertise, "mdns-advertise", c.MdnsAdvertise, "Advertise the key server (bootstrap serve, --setup-rsyncd) over mDNS for --keyserver auto.")
+	fs.StringVar(&c.KeyserverPin, "keyserver-pin", c.KeyserverPin, "Public key pin (sha256//BASE64) of an https keyserver's certificate, as printed by bootstrap serve.")
+	fs.StringVar(&c.ServeAddr, "serve-addr", c.ServeAddr, "Address the key server (bootstrap serve) listens on.")
+	fs.StringVar(&c.ServeDir, "serve-dir", c.ServeDir, "Directory of keys served by bootstrap serve and exported by --setup-rsyncd.")
+	fs.StringVar(&c.ServeCert, "serve-cert", c.ServeCert, "TLS certificate for bootstrap serve (default: a generated self-signed one).")
+	fs.StringVar(&c.ServeKey, "serve-key", c.ServeKey, "TLS private key for serve-cert.")
+	fs.StringVar(&c.ServeTokensFile, "serve-tokens-file", c.ServeTokensFile, "Bootstrap tokens accepted by bootstrap serve (default: serve-tokens in the state directory).")
+	fs.Var(&c.AllowCIDRs, "allow-cidr", "Address or CIDR prefix bootstrap serve accepts requests from; repeat or comma-separate for several (default: any).")
+	fs.BoolVar(&c.TrustProxy, "trust-proxy", c.TrustProxy, "Take bootstrap serve clients' addresses from X-Forwarded-For, as set by a reverse proxy in front of it.")
+	fs.BoolVar(&c.ForceKeyRegen, "force-key-regen", c.ForceKeyRegen, "On the keyserver role, replace the GitHub key pair with a new one, removing the old key from GitHub once the new one works.")
+	fs.BoolVar(&c.SetupRsyncd, "setup-rsyncd", c.SetupRsyncd, "On the keyserver role, export the GitHub key and vault password from serve-dir over an rsync daemon restricted to allow-cidr.")
+	fs.Var(&c.AgeRecipients, "age-recipient", "With --setup-rsyncd, publish the GitHub key only encrypted to this age public key (age1...); repeat or comma-separate for several.")
+	fs.StringVar(&c.AgeIdentityFile, "age-identity-file", c.AgeIdentityFile, "age identity file to decrypt the GitHub key with; the key is then fetched from the keyserver location with .age appended.")
+	fs.StringVar(&c.ServeAuditLog, "serve-audit-log", c.ServeAuditLog, "JSON-lines audit log of bootstrap serve requests (default: serve-audit.log in the state directory).")
+	fs.Var(&c.ServeAuditMaxSize, "serve-audit-max-size", "Size at which bootstrap serve rotates its audit log.")
+	fs.StringVar(&c.BootstrapToken, "bootstrap-token", c.BootstrapToken, "Token presented to the keyserver when fetching the key.")
+	fs.StringVar(&c.BootstrapTokenFile, "bootstrap-token-file", c.BootstrapTokenFile, "File containing the token presented to the keyserver.")
+	fs.StringVar(&c.RepoURL, "repo-url", c.RepoURL, "Git URL of the ansible repository.")
+	fs.StringVar(&c.VaultPassFile, "vault-pass-file", c.VaultPassFile, "Vault password file, relative to the home directory.")
+	fs.StringVar(&c.VaultPassOp, "vault-pass-op", c.VaultPassOp, "1Password secret reference (op://vault/item/field) to read the vault password from with the op CLI, instead of vault-pass-file.")
+	fs.StringVar(&c.VaultPassBw, "vault-pass-bw", c.VaultPassBw, "Bitwarden item (id or name) whose password is the vault password, read with the bw CLI instead of vault-pass-file.")
+	fs.StringVar(&c.GithubTokenBw, "github-token-bw", c.GithubTokenBw, "On the keyserver role, Bitwarden item (id or name) whose password is the GitHub token gh authenticates with.")
+	fs.StringVar(&c.VaultPassPass, "vault-pass-pass", c.VaultPassPass, "pass (or gopass) entry whose first line is the vault password, instead of vault-pass-file.")
+	fs.StringVar(&c.GithubTokenPass, "github-token-pass", c.GithubTokenPass, "On the keyserver role, pass (or gopass) entry whose first line is the GitHub token gh authenticates with.")
+	fs.StringVar(&c.VaultPassHashicorp, "vault-pass-hashicorp", c.VaultPassHashicorp, "HashiCorp Vault KV secret (API path, then #field, default value) to read the vault password from, instead of vault-pass-file.")
+	fs.StringVar(&c.GithubTokenHashicorp, "github-token-hashicorp", c.GithubTokenHashicorp, "On the keyserver role, HashiCorp Vault KV secret (API path, then #field) to read the GitHub token gh authenticates with from.")
+	fs.StringVar(&c.VaultPassSSM, "vault-pass-ssm", c.VaultPassSSM, "On EC2, AWS SSM parameter (a SecureString) to read the vault password from with the instance's IAM role, instead of vault-pass-file.")
+	fs.StringVar(&c.KeySSM, "key-ssm", c.KeySSM, "On EC2, AWS SSM parameter (a SecureString) holding the GitHub private key, read with the instance's IAM role instead of fetching it from the keyserver.")
+	fs.StringVar(&c.VaultAddr, "vault-addr", c.VaultAddr, "Address of HashiCorp Vault, e.g. https://vault.example.com:8200; defaults to VAULT_ADDR.")
+	fs.StringVar(&c.VaultRoleID, "vault-role-id", c.VaultRoleID, "AppRole role ID to log in to HashiCorp Vault with; without it, VAULT_TOKEN is used.")
+	fs.StringVar(&c.VaultSecretID, "vault-secret-id", c.VaultSecretID, "AppRole secret ID to log in to HashiCorp Vault with.")
+	fs.StringVar(&c.CredentialVaultPass, "credential-vault-pass", c.CredentialVaultPass, "Name of the systemd credential that, when present, is the vault password, and that --install-rerun-unit stores it as.")
+	fs.StringVar(&c.CredentialGithubToken, "credential-github-token", c.CredentialGithubToken, "Name of the systemd credential that, when present, is the GitHub token, and that --install-rerun-unit stores it as.")
+	fs.StringVar(&c.BwPasswordFile, "bw-password-file", c.BwPasswordFile, "File holding the Bitwarden master password, to unlock the vault when BW_SESSION is not set.")
+	fs.StringVar(&c.KeyPath, "key-path", c.KeyPath, "Path of the GitHub private key, relative to the home directory unless absolute (default ~/.ssh/"+sshkeys.GithubKeyName+"); its public key is this path with .pub.")
+	fs.BoolVar(&c.KeyStdin, "key-stdin", c.KeyStdin, "Read the GitHub private key from stdin instead of fetching it from the keyserver.")
+	fs.StringVar(&c.KeyB64Env, "key-b64-env", c.KeyB64Env, "Take the GitHub private key, base64-encoded, from this environment variable instead of fetching it from the keyserver.")
+	fs.StringVar(&c.AnsibleSite, "ansible-site", c.AnsibleSite, "Playbook to run within the ansible repository.")
+	fs.StringVar(&c.Inventory, "inventory", c.Inventory, "Inventory for the playbook instead of localhost in no group: a path within the ansible repository (or an absolute one), or a comma-separated host list.")
+	fs.BoolVar(&c.GenerateInventory, "generate-inventory", c.GenerateInventory, "Run the playbook with a generated inventory that puts localhost in a group named after the role.")
+	fs.Var(&c.ExtraVars, "extra-var", "Variable (\"NAME=VALUE\") to give the playbook, as a string; repeat for several.")
+	fs.StringVar(&c.AnsibleBranch, "ansible-branch", c.AnsibleBranch, "Branch, tag or other ref of the ansible repository to check out, instead of role-branch's or the default branch.")
+	fs.Var(&c.RoleBranches, "role-branch", "Ref (\"ROLE=REF\") of the ansible repository to check out for ROLE when ansible-branch is not set; repeat for several roles.")
+	fs.StringVar(&c.AnsibleRef, "ansible-ref", c.AnsibleRef, "Commit (full or abbreviated SHA) of the ansible repository to check out and verify was applied, instead of a branch.")
+	fs.BoolVar(&c.OnlyIfChanged, "only-if-changed", c.OnlyIfChanged, "Only run the playbook if the ansible repository changed since the last run.")
+	fs.IntVar(&c.CloneDepth, "clone-depth", c.CloneDepth, "History depth of the ansible repository's checkout; 0 clones it fully.")
+	fs.BoolVar(&c.RequireSignedTag, "require-signed-tag", c.RequireSignedTag, "Refuse to run the playbook unless the tag (or ansible-ref commit) to apply has a signature by a trusted signer.")
+	fs.StringVar(&c.AllowedSignersFile, "allowed-signers", c.AllowedSignersFile, "git allowed signers file of the SSH keys trusted by require-signed-tag.")
+	fs.StringVar(&c.GPGKeyring, "gpg-keyring", c.GPGKeyring, "GPG keyring (exported public keys) trusted by require-signed-tag.")
+	fs.BoolVar(&c.SyntaxCheckFirst, "syntax-check-first", c.SyntaxCheckFirst, "Fetch the ansible repository and check the playbook's syntax as soon as the key is in place, stopping the run if it does not parse.")
+	fs.BoolVar(&c.TwoPhase, "two-phase", c.TwoPhase, "Run the playbook in check mode first, and apply it only once its changes are confirmed on the terminal or by auto-approve.")
+	fs.BoolVar(&c.AutoApprove, "auto-approve", c.AutoApprove, "With two-phase, apply the changes the check run found without asking.")
+	fs.BoolVar(&c.DetectDrift, "detect-drift", c.DetectDrift, "Only run the playbook in check mode, changing nothing, and exit with code 4 if it would change anything.")
+	fs.StringVar(&c.MiseCmd, "mise-cmd", c.MiseCmd, "Command run by the one-shot 'mise install' service.")
+	fs.StringVar(&c.MisePath, "mise-path", c.MisePath, "Absolute path of the mise binary (default: auto-detect).")
+	fs.BoolVar(&c.NoReboot, "no-reboot", c.NoReboot, "Create and enable the post-reboot units but do not reboot.")
+	fs.BoolVar(&c.Quiet, "quiet", c.Quiet, "Do not show the output of the commands a run executes, except the end of a failed step's.")
+	fs.BoolVar(&c.NoProgress, "no-progress", c.NoProgress, "Do not show the progress line on a terminal.")
+	fs.StringVar(&c.LogTarget, "log-target", c.LogTarget, "Where messages go: auto (journald when run by systemd), console, or journald.")
+	fs.DurationVar(&c.RebootDelay, "reboot-delay", c.RebootDelay, "Grace period, during which Ctrl-C aborts, before the reboot is scheduled.")
+	fs.BoolVar(&c.Yes, "yes", c.Yes, "Do not ask for confirmation before rebooting, or before clean removes what runs installed.")
+	fs.BoolVar(&c.RunMiseNow, "run-mise-now", c.RunMiseNow, "Run the mise command now as the target user instead of creating the unit and rebooting.")
+	fs.StringVar(&c.MiseUnitMode, "mise-unit-mode", c.MiseUnitMode, "How the mise unit runs only once: flag or self-remove.")
+	fs.StringVar(&c.MiseUnitScope, "mise-unit-scope", c.MiseUnitScope, "Install the mise unit as a system or user service.")
+	fs.Var(&c.PostRebootCmds, "post-reboot-cmd", "Command (\"[user:]command\") to run once after the reboot; repeat to run several in order.")
+	fs.BoolVar(&c.InstallMise, "install-mise", c.InstallMise, "Install mise for the target user if it is missing.")
+	fs.StringVar(&c.MiseInstallerURL, "mise-installer-url", c.MiseInstallerURL, "URL of the official mise install script (e.g. an internal mirror).")
+	fs.StringVar(&c.MiseInstallerSHA, "mise-installer-sha", c.MiseInstallerSHA, "Expected SHA-256 of the mise install script.")
+	fs.StringVar(&c.ResultFile, "result-file", c.ResultFile, "Write the outcome of the run as JSON to this path.")
+	fs.StringVar(&c.Transcript, "transcript", c.Transcript, "Record every command the run executes, with its complete output, as JSON lines in this file.")
+	fs.Var(&c.PreHooks, "pre-hook", "Executable run before the first step; its failure aborts the run. Repeat to run several in order.")
+	fs.Var(&c.PostHooks, "post-hook", "Executable run when the run ends, whatever its outcome; repeat to run several in order.")
+	fs.StringVar(&c.HooksDir, "hooks-dir", c.HooksDir, "Directory whose pre.d and post.d executables run, in lexical order, before the pre-hook and post-hook ones.")
+	fs.StringVar(&c.HealthcheckURL, "healthcheck-url", c.HealthcheckURL, "healthchecks.io-style ping URL: URL/start is pinged when a run starts, URL on success and URL/fail on failure.")
+	fs.StringVar(&c.Pushgateway, "pushgateway", c.Pushgateway, "Prometheus Pushgateway URL to push the run's metrics to when it ends.")
+	fs.StringVar(&c.ReportURL, "report-url", c.ReportURL, "URL to POST the run's result JSON to when it ends; undelivered reports are queued for the next run.")
+	fs.StringVar(&c.ReportToken, "report-token", c.ReportToken, "Bearer token sent with the report to --report-url.")
+	fs.StringVar(&c.ReportTokenFile, "report-token-file", c.ReportTokenFile, "File containing the bearer token sent to --report-url.")
+	fs.StringVar(&c.UploadFailureLogs, "upload-failure-logs", c.UploadFailureLogs, "When a run fails, upload its redacted log tail and result as a secret gist (gist) or to this paste URL.")
+	fs.BoolVar(&c.CheckUpdate, "check-update", c.CheckUpdate, "Log whether a newer bootstrap release exists; the check never fails the run.")
+	fs.BoolVar(&c.InstallSelf, "install-self", c.InstallSelf, "Copy this binary to "+service.SystemBinPath+" (~/.local/bin/bootstrap without root) and record where.")
+	fs.BoolVar(&c.InstallRerunUnit, "install-rerun-unit", c.InstallRerunUnit, "With install-self, install "+filepath.Base(service.RerunUnitPath)+", which reruns bootstrap with this run's settings when started.")
+	fs.Var(&c.DriftTimer, "enable-drift-timer", "With install-self, install and enable "+filepath.Base(service.DriftTimerPath)+", which runs bootstrap --detect-drift with this run's settings on this systemd calendar `schedule` (default "+config.DefaultDriftSchedule+").")
+	fs.BoolVar(&c.StrictIntegrity, "strict-integrity", c.StrictIntegrity, "Refuse to run unless this binary matches the digest stamped into it at release.")
+	fs.StringVar(&c.NotifyNtfy, "notify-ntfy", c.NotifyNtfy, "ntfy topic, or URL of a topic on a self-hosted server, to notify of the run's outcome.")
+	fs.StringVar(&c.NotifyEmail, "notify-email", c.NotifyEmail, "Comma-separated addresses to email when a run fails.")
+	fs.BoolVar(&c.NotifyEmailOnSuccess, "notify-email-on-success", c.NotifyEmailOnSuccess, "Email --notify-email when a run succeeds, too.")
+	fs.BoolVar(&c.NotifyTest, "notify-test", c.NotifyTest, "Send a test email to --notify-email and exit without bootstrapping.")
+	fs.StringVar(&c.SMTPHost, "smtp-host", c.SMTPHost, "SMTP server to send --notify-email mail through.")
+	fs.IntVar(&c.SMTPPort, "smtp-port", c.SMTPPort, "Port of --smtp-host.")
+	fs.StringVar(&c.SMTPTLS, "smtp-tls", c.SMTPTLS, "How to encrypt the SMTP connection: starttls, tls, or none.")
+	fs.StringVar(&c.SMTPUser, "smtp-user", c.SMTPUser, "User to authenticate to --smtp-host as (default: no authentication).")
+	fs.StringVar(&c.SMTPPassword, "smtp-password", c.SMTPPassword, "Password for --smtp-user; prefer BOOTSTRAP_SMTP_PASSWORD.")
+	fs.StringVar(&c.SMTPFrom, "smtp-from", c.SMTPFrom, "Sender address of notification emails (default: bootstrap@<hostname>).")
+	fs.StringVar(&c.ErrorReportDSN, "error-report-dsn", c.ErrorReportDSN, "Sentry-compatible DSN to send an error report to when a run fails (opt-in).")
+	fs.DurationVar(&c.PackageLockTimeout, "package-lock-timeout", c.PackageLockTimeout, "How long to wait for another process to release the package manager lock.")
+	fs.BoolVar(&c.ForceRefresh, "force-refresh", c.ForceRefresh, "Always refresh the package index, even if it was updated recently.")
+	fs.DurationVar(&c.PackageIndexMaxAge, "package-index-max-age", c.PackageIndexMaxAge, "Skip apt-get update when the package index is younger than this.")
+	fs.IntVar(&c.RetryAttempts, "retry-attempts", c.RetryAttempts, "Maximum attempts for network steps such as the key fetch.")
+	fs.DurationVar(&c.RetryInitialDelay, "retry-initial-delay", c.RetryInitialDelay, "Delay before the first retry of a network step.")
+	fs.DurationVar(&c.RetryMaxDelay, "retry-max-delay", c.RetryMaxDelay, "Upper bound on the delay between retries.")
+	fs.Float64Var(&c.RetryMultiplier, "retry-multiplier", c.RetryMultiplier, "Factor by which the retry delay grows after each attempt.")
+	fs.DurationVar(&c.NetworkWait, "network-wait", c.NetworkWait, "How long to wait for the network preflight checks to pass.")
+	fs.BoolVar(&c.SkipSpaceCheck, "skip-space-check", c.SkipSpaceCheck, "Skip the free disk space preflight check.")
+	fs.Var(&c.MinFreeRoot, "min-free-root", "Minimum free space required on /.")
+	fs.Var(&c.MinFreeVar, "min-free-var", "Minimum free space required on /var.")
+	fs.Var(&c.MinFreeTmp, "min-free-tmp", "Minimum free space required on /tmp.")
+	fs.Var(&c.MinFreeHome, "min-free-home", "Minimum free space required on the home directory.")
+	fs.BoolVar(&c.SkipClockCheck, "skip-clock-check", c.SkipClockCheck, "Skip the system clock skew check.")
+	fs.StringVar(&c.ClockCheckURL, "clock-check-url", c.ClockCheckURL, "HTTPS URL whose Date header the system clock is compared against.")
+	fs.DurationVar(&c.MaxClockSkew, "max-clock-skew", c.MaxClockSkew, "Largest tolerated difference between the system clock and clock-check-url.")
+	fs.BoolVar(&c.FixClock, "fix-clock", c.FixClock, "Try to sync the system clock when it is skewed instead of failing.")
+	fs.Var(&c.CACerts, "ca-cert", "CA certificate (\"PATH\" or \"URL[#sha256=DIGEST]\") to add to the system trust store before any TLS; repeat for several.")
+	fs.StringVar(&c.CACheckURL, "ca-check-url", c.CACheckURL, "HTTPS URL connected to after ca-cert, trusting only the rebuilt store, to check the certificates work (empty: no check).")
+	fs.BoolVar(&c.EnsureTimesync, "ensure-timesync", c.EnsureTimesync, "Install and enable a time daemon, step the clock and check its offset before the clock check.")
+	fs.StringVar(&c.TimesyncDaemon, "timesync-daemon", c.TimesyncDaemon, "Time daemon ensure-timesync sets up on Linux: auto, chrony or timesyncd.")
+	fs.Var(&c.NTPServers, "ntp-server", "NTP server for ensure-timesync to use; repeat or comma-separate for several.")
+	fs.DurationVar(&c.LockWait, "lock-wait", c.LockWait, "How long to wait for another running bootstrap to finish (0 exits immediately).")
+	fs.Var(&c.SkipIfBootstrapped, "skip-if-bootstrapped", "Exit successfully without doing anything if a previous run with the same configuration succeeded (optionally: within this `duration`).")
+	fs.BoolVar(&c.Force, "force", c.Force, "Run even if skip-if-bootstrapped would skip.")
+	fs.StringVar(&c.Escalation, "escalation", c.Escalation, "Privilege escalation tool: auto, sudo, doas, or none.")
+	fs.StringVar(&c.HomebrewInstallerURL, "homebrew-installer-url", c.HomebrewInstallerURL, "URL of the Homebrew install script (e.g. an internal mirror).")
+	fs.StringVar(&c.HomebrewInstallerSHA, "homebrew-installer-sha", c.HomebrewInstallerSHA, "Expected SHA-256 of the Homebrew install script.")
+	fs.StringVar(&c.GhKeyringFingerprint, "gh-keyring-fingerprint", c.GhKeyringFingerprint, "Expected fingerprint of the GitHub CLI apt signing key.")
+	fs.BoolVar(&c.Offline, "offline", c.Offline, "Air-gapped mode: only contact the keyserver and allow-hosts, and add no external package repositories.")
+	fs.StringVar(&c.AllowHosts, "allow-hosts", c.AllowHosts, "Comma-separated hosts (host, host:port, or .domain) that may be contacted in offline mode.")
+	fs.BoolVar(&c.RollbackOnFailure, "rollback-on-failure", c.RollbackOnFailure, "Undo reversible changes (unit files, apt sources, replaced keys) when the run fails.")
+	fs.BoolVar(&c.KeepGoing, "keep-going", c.KeepGoing, "Continue past failed package installs, exiting nonzero at the end.")
+	return fs
+}
+
+// loadConfig builds the effective configuration from defaults, the config
+// file, the environment, and args, in that order of precedence. extra, if
+// non-nil, may register additional subcommand-specific flags. Problems in the
+// config file and environment are collected and returned rather than
+// stopping at the first; a flag parse error is returned as the sole problem.
+func (a *app) loadConfig(name string, args []string, extra func(*flag.FlagSet)) (*config.Config, *flag.FlagSet, []error) {
+	c := newDefaultConfig()
+	fs := configFlagSet(c, name)
+	if extra != nil {
+		extra(fs)
+	}
+
+	var problems []error
+
+	path, explicit := a.configPath(args)
+	if path != "" {
+		c.ConfigFile = path
+		if _, err := os.Stat(path); err == nil || explicit {
+			problems = append(problems, applyConfigFile(fs, path)...)
+		}
+	}
+
+	fs.VisitAll(func(f *flag.Flag) {
+		if f.Name == "config" {
+			return
+		}
+		envName := platform.EnvPrefix + strings.ToUpper(strings.ReplaceAll(f.Name, "-", "_"))
+		if v, ok := os.LookupEnv(envName); ok {
+			if err := fs.Set(f.Name, v); err != nil {
+				problems = append(problems, fmt.Errorf("%s: %v", envName, err))
+			}
+		}
+	})
+
+	if err := fs.Parse(args); err != nil {
+		return c, fs, []error{err}
+	}
+	return c, fs, problems
+}
+
+// settingsOf returns the settings of c that differ from the built-in
+// defaults, as config file lines, for a configuration LoadConfig did not
+// read.
+func settingsOf(c *config.Config) string {
+	given := configFlagSet(c, "bootstrap")
+	fs := configFlagSet(newDefaultConfig(), "bootstrap")
+	given.VisitAll(func(f *flag.Flag) {
+		value := f.Value.String()
+		if value == fs.Lookup(f.Name).Value.String() {
+			return
+		}
+		values := []string{value}
+		if r, ok := f.Value.(interface{ Entries() []string }); ok {
+			values = r.Entries()
+		}
+		for _, v := range values {
+			fs.Set(f.Name, v)
+		}
+	})
+	return service.CaptureSettings(fs)
+}
+
+// configPath returns the config file to read and whether it was requested
+// explicitly (via flag or environment) rather than being the default.
+func (a *app) configPath(args []string) (string, bool) {
+	for i := 0; i < len(args); i++ {
+		arg := args[i]
+		if arg == "--" {
+			break
+		}
+		name := strings.TrimLeft(arg, "-")
+		if name == arg {
+			continue
+		}
+		if v, ok := strings.CutPrefix(name, "config="); ok {
+			return v, true
+		}
+		if name == "config" && i+1 < len(args) {
+			return args[i+1], true
+		}
+	}
+	if v := os.Getenv(platform.EnvPrefix + "CONFIG"); v != "" {
+		return v, true
+	}
+	return a.sys.Host.Path(platform.DefaultConfigPath), false
+}
+
+// applyConfigFile reads the config file at path and applies it to fs.
+func applyConfigFile(fs *flag.FlagSet, path string) []error {
+	f, err := os.Open(path)
+	if err != nil {
+		return []error{fmt.Errorf("config file: %w", err)}
+	}
+	defer f.Close()
+	return applyConfig(fs, path, f)
+}
+
+// applyConfig reads "key = value" lines from r and sets the flag of the same
+// name. Blank lines and lines starting with '#' are ignored. Every bad line is
+// reported, prefixed with path.
+func applyConfig(fs *flag.FlagSet, path string, r io.Reader) []error {
+	var errs []error
+	scanner := bufio.NewScanner(r)
+	lineNo := 0
+	for scanner.Scan() {
+		lineNo++
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		key, value, ok := strings.Cut(line, "=")
+		if !ok {
+			errs = append(errs, fmt.Errorf("%s:%d: expected key = value", path, lineNo))
+			continue
+		}
+		key = strings.TrimSpace(key)
+		value = strings.Trim(strings.TrimSpace(value), `"`)
+		if key == "config" || fs.Lookup(key) == nil {
+			errs = append(errs, fmt.Errorf("%s:%d: unknown setting %q", path, lineNo, key))
+			continue
+		}
+		if err := fs.Set(key, value); err != nil {
+			errs = append(errs, fmt.Errorf("%s:%d: %s: %v", path, lineNo, key, err))
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		errs = append(errs, fmt.Errorf("%s: %w", path, err))
+	}
+	return errs
+}
+
+// validateConfig performs every static check on c and returns all problems
+// found.
+func validateConfig(c *config.Config) []error {
+	var problems []error
+	if !config.RoleNameRegex.MatchString(c.Role) {
+		problems = append(problems, fmt.Errorf("role %q is not a valid role name", c.Role))
+	}
+	if c.Hostname != "" && !config.ValidHostname(c.Hostname) {
+		problems = append(problems, fmt.Errorf("hostname %q is not a valid RFC 1123 host name", c.Hostname))
+	}
+	if c.Hostname != "" && c.HostnameFromMetadata {
+		problems = append(problems, errors.New("hostname and hostname-from-metadata are mutually exclusive"))
+	}
+	for _, role := range platform.SortedKeys(c.RolePrereqs) {
+		for _, p := range []string{"git", "ansible"} {
+			if !slices.Contains(c.RolePrereqs[role], p) {
+				problems = append(problems, fmt.Errorf("role-prereqs for %s must include %s, which ansible-pull needs", role, p))
+			}
+		}
+	}
+	if !platform.LocaleRegex.MatchString(c.Locale) {
+		problems = append(problems, fmt.Errorf("locale %q is not a UTF-8 locale such as en_US.UTF-8 or C.UTF-8", c.Locale))
+	}
+	switch c.TimesyncDaemon {
+	case "auto", "chrony", "timesyncd":
+	default:
+		problems = append(problems, fmt.Errorf("timesync-daemon %q must be auto, chrony or timesyncd", c.TimesyncDaemon))
+	}
+	if c.HooksDir != "" && !filepath.IsAbs(c.HooksDir) {
+		problems = append(problems, fmt.Errorf("hooks-dir %q is not an absolute path", c.HooksDir))
+	}
+	if c.AnsibleSudoersTemplate != "" {
+		if c.CreateAnsibleUser == "" {
+			problems = append(problems, errors.New("ansible-sudoers-template requires create-ansible-user"))
+		} else if _, err := ansible.Sudoers(c.AnsibleSudoersTemplate, string(c.CreateAnsibleUser)); err != nil {
+			problems = append(problems, fmt.Errorf("ansible-sudoers-template: %w", err))
+		}
+	}
+	if c.BootstrapToken != "" && c.BootstrapTokenFile != "" {
+		problems = append(problems, errors.New("bootstrap-token and bootstrap-token-file are mutually exclusive"))
+	}
+	if c.Keyserver == config.KeyserverAuto {
+		// The scheme is only known once discovery has run.
+		if c.KeyserverFallback != "" {
+			if _, err := config.ParseKeyserver(c.KeyserverFallback); err != nil {
+				problems = append(problems, fmt.Errorf("keyserver-fallback: %w", err))
+			}
+		}
+		if c.MdnsTimeout <= 0 {
+			problems = append(problems, errors.New("mdns-timeout must be positive"))
+		}
+		if c.KeyserverPin != "" && !keyPinRegex.MatchString(c.KeyserverPin) {
+			problems = append(problems, fmt.Errorf("keyserver-pin %q must be sha256// followed by a base64 SHA-256 digest", c.KeyserverPin))
+		}
+	} else if u, err := config.ParseKeyserver(c.Keyserver); err != nil {
+		problems = append(problems, err)
+	} else if c.KeyserverPin != "" {
+		if u.Scheme != "https" {
+			problems = append(problems, errors.New("keyserver-pin needs an https:// keyserver"))
+		} else if !keyPinRegex.MatchString(c.KeyserverPin) {
+			problems = append(problems, fmt.Errorf("keyserver-pin %q must be sha256// followed by a base64 SHA-256 digest", c.KeyserverPin))
+		}
+	}
+	if c.HealthcheckURL != "" {
+		if u, err := url.Parse(c.HealthcheckURL); err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			problems = append(problems, fmt.Errorf("healthcheck-url %q must be an http:// or https:// URL", c.HealthcheckURL))
+		}
+	}
+	if c.Pushgateway != "" {
+		if u, err := url.Parse(c.Pushgateway); err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			problems = append(problems, fmt.Errorf("pushgateway %q must be an http:// or https:// URL", c.Pushgateway))
+		}
+	}
+	if c.ReportURL != "" {
+		if u, err := url.Parse(c.ReportURL); err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			problems = append(problems, fmt.Errorf("report-url %q must be an http:// or https:// URL", c.ReportURL))
+		}
+	}
+	if c.ReportToken != "" && c.ReportTokenFile != "" {
+		problems = append(problems, errors.New("report-token and report-token-file are mutually exclusive"))
+	}
+	if c.UploadFailureLogs != "" {
+		if err := report.ParseUploadTarget(c.UploadFailureLogs); err != nil {
+			problems = append(problems, fmt.Errorf("upload-failure-logs %v", err))
+		}
+	}
+	if c.InstallRerunUnit && !c.InstallSelf {
+		problems = append(problems, errors.New("install-rerun-unit requires install-self"))
+	}
+	if c.DriftTimer != "" && !c.InstallSelf {
+		problems = append(problems, errors.New("enable-drift-timer requires install-self"))
+	}
+	if c.NotifyNtfy != "" {
+		if _, err := report.NtfyURL(c.NotifyNtfy); err != nil {
+			problems = append(problems, fmt.Errorf("notify-ntfy %v", err))
+		}
+	}
+	if c.NotifyEmail != "" {
+		if _, err := mail.ParseAddressList(c.NotifyEmail); err != nil {
+			problems = append(problems, fmt.Errorf("notify-email %q: %v", c.NotifyEmail, err))
+		}
+		if c.SMTPHost == "" {
+			problems = append(problems, errors.New("notify-email requires smtp-host"))
+		}
+	}
+	if c.SMTPFrom != "" {
+		if _, err := mail.ParseAddress(c.SMTPFrom); err != nil {
+			problems = append(problems, fmt.Errorf("smtp-from %q: %v", c.SMTPFrom, err))
+		}
+	}
+	if c.SMTPPort < 1 || c.SMTPPort > 65535 {
+		problems = append(problems, fmt.Errorf("smtp-port %d is not a valid port", c.SMTPPort))
+	}
+	if !slices.Contains(report.SMTPTLSModes, c.SMTPTLS) {
+		problems = append(problems, fmt.Errorf("smtp-tls must be one of %s, not %q", strings.Join(report.SMTPTLSModes, ", "), c.SMTPTLS))
+	} else if c.SMTPTLS == "none" && c.SMTPUser != "" && !report.IsLoopbackHost(c.SMTPHost) {
+		problems = append(problems, errors.New("smtp-user with smtp-tls none would send the SMTP password unencrypted; use starttls or tls"))
+	}
+	if c.ErrorReportDSN != "" {
+		if _, err := report.ParseSentryDSN(c.ErrorReportDSN); err != nil {
+			problems = append(problems, fmt.Errorf("error-report-dsn %v", err))
+		}
+	}
+	if c.KeyserverWaitTimeout < 0 {
+		problems = append(problems, errors.New("keyserver-wait-timeout must not be negative"))
+	}
+	if c.ForceKeyRegen {
+		if c.Role != "keyserver" {
+			problems = append(problems, errors.New("force-key-regen needs role keyserver"))
+		}
+		if c.Offline {
+			problems = append(problems, errors.New("force-key-regen needs GitHub, and cannot be used offline"))
+		}
+	}
+	if c.SetupRsyncd {
+		if c.Role != "keyserver" {
+			problems = append(problems, errors.New("setup-rsyncd needs role keyserver"))
+		}
+		if len(c.AllowCIDRs) == 0 {
+			problems = append(problems, errors.New("setup-rsyncd needs allow-cidr, the networks the rsync daemon may serve"))
+		}
+		if !filepath.IsAbs(c.ServeDir) {
+			problems = append(problems, fmt.Errorf("serve-dir %q must be an absolute path", c.ServeDir))
+		}
+	} else if len(c.AgeRecipients) > 0 {
+		problems = append(problems, errors.New("age-recipient needs setup-rsyncd, which publishes the key"))
+	}
+	if c.AgeIdentityFile != "" && (c.Role == "keyserver" || c.ProvidedKeySource() != "") {
+		problems = append(problems, errors.New("age-identity-file only applies to a key fetched from the keyserver"))
+	}
+	if _, err := platform.RepoHost(c.RepoURL); err != nil {
+		problems = append(problems, err)
+	}
+	if c.VaultPassFile == "" {
+		problems = append(problems, errors.New("vault-pass-file must not be empty"))
+	}
+	if c.VaultPassOp != "" && !strings.HasPrefix(c.VaultPassOp, "op://") {
+		problems = append(problems, fmt.Errorf("vault-pass-op %q must be a secret reference, op://vault/item/field", c.VaultPassOp))
+	}
+	if c.VaultSecretID != "" && c.VaultRoleID == "" {
+		problems = append(problems, errors.New("vault-secret-id needs vault-role-id"))
+	}
+	if c.VaultAddr != "" {
+		if u, err := url.Parse(c.VaultAddr); err != nil || (u.Scheme != "https" && u.Scheme != "http") || u.Host == "" {
+			problems = append(problems, fmt.Errorf("vault-addr %q must be an http or https URL", c.VaultAddr))
+		}
+	}
+	for _, opts := range [][]secrets.Option{secrets.VaultPassOptions(c), secrets.GithubTokenOptions(c)} {
+		if err := secrets.ValidateSecretOptions(opts); err != nil {
+			problems = append(problems, err)
+		}
+	}
+	for _, o := range secrets.GithubTokenOptions(c) {
+		if o.Value != "" && c.Role != "keyserver" {
+			problems = append(problems, fmt.Errorf("%s needs role keyserver, which authenticates gh", o.Flag))
+		}
+	}
+	if c.KeyPath != "" {
+		base := filepath.Base(c.KeyPath)
+		if strings.HasSuffix(c.KeyPath, "/") || base == "." || base == ".." || strings.HasSuffix(base, ".pub") {
+			problems = append(problems, fmt.Errorf("key-path %q must name the private key file", c.KeyPath))
+		}
+	}
+	var keySources []string
+	for name, set := range map[string]bool{"key-stdin": c.KeyStdin, "key-b64-env": c.KeyB64Env != "", "key-ssm": c.KeySSM != ""} {
+		if set {
+			keySources = append(keySources, name)
+		}
+	}
+	if len(keySources) > 1 {
+		slices.Sort(keySources)
+		problems = append(problems, fmt.Errorf("%s are mutually exclusive", strings.Join(keySources, " and ")))
+	}
+	if c.KeyB64Env != "" && !envNameRegex.MatchString(c.KeyB64Env) {
+		problems = append(problems, fmt.Errorf("key-b64-env %q is not an environment variable name", c.KeyB64Env))
+	}
+	if c.ProvidedKeySource() != "" && c.Role == "keyserver" {
+		problems = append(problems, errors.New("key-stdin, key-b64-env and key-ssm cannot be used with role keyserver, which generates its key"))
+	}
+	if c.AnsibleSite == "" {
+		problems = append(problems, errors.New("ansible-site must not be empty"))
+	}
+	if p := c.RepoInventory(); p == ".." || strings.HasPrefix(p, "../") {
+		problems = append(problems, fmt.Errorf("inventory %q must be within the ansible repository, or an absolute path", c.Inventory))
+	}
+	if c.Inventory != "" && c.GenerateInventory {
+		problems = append(problems, errors.New("inventory and generate-inventory are mutually exclusive"))
+	}
+	if c.AnsibleBranch != "" && !config.ValidGitRef(c.AnsibleBranch) {
+		problems = append(problems, fmt.Errorf("ansible-branch %q is not a git ref", c.AnsibleBranch))
+	}
+	if c.AnsibleRef != "" && !ansible.CommitSHARegex.MatchString(c.AnsibleRef) {
+		problems = append(problems, fmt.Errorf("ansible-ref %q must be a commit SHA, of 7 to 40 hex digits", c.AnsibleRef))
+	}
+	if c.AutoApprove && !c.TwoPhase {
+		problems = append(problems, errors.New("auto-approve needs two-phase"))
+	}
+	if c.DetectDrift && c.TwoPhase {
+		problems = append(problems, errors.New("detect-drift and two-phase are mutually exclusive"))
+	}
+	if c.CloneDepth < 0 {
+		problems = append(problems, errors.New("clone-depth must not be negative"))
+	}
+	if c.AnsibleRef != "" && c.AnsibleBranch != "" {
+		problems = append(problems, errors.New("ansible-ref and ansible-branch are mutually exclusive"))
+	}
+	if c.RequireSignedTag {
+		if (c.AllowedSignersFile == "") == (c.GPGKeyring == "") {
+			problems = append(problems, errors.New("require-signed-tag needs one of allowed-signers and gpg-keyring"))
+		}
+		if ref, _ := c.EffectiveAnsibleRef(); ref == "" {
+			problems = append(problems, fmt.Errorf("require-signed-tag needs a tag to verify, from ansible-branch or a role-branch for role %s, or an ansible-ref", c.Role))
+		}
+	}
+	if c.RunMiseInstall && c.MiseCmd == "" {
+		problems = append(problems, errors.New("mise-install requires mise-cmd"))
+	}
+	if !slices.Contains(service.MiseUnitModes, c.MiseUnitMode) {
+		problems = append(problems, fmt.Errorf("mise-unit-mode %q must be one of %s", c.MiseUnitMode, strings.Join(service.MiseUnitModes, ", ")))
+	}
+	if c.MiseUnitScope != "system" && c.MiseUnitScope != "user" {
+		problems = append(problems, fmt.Errorf("mise-unit-scope %q must be system or user", c.MiseUnitScope))
+	} else if c.MiseUnitScope == "user" && c.MiseUnitMode == "self-remove" {
+		problems = append(problems, errors.New("mise-unit-mode self-remove needs mise-unit-scope system"))
+	}
+	if c.RebootDelay < 0 {
+		problems = append(problems, errors.New("reboot-delay must not be negative"))
+	}
+	if c.RunMiseNow && c.MiseCmd == "" {
+		problems = append(problems, errors.New("run-mise-now requires mise-cmd"))
+	}
+	if c.MisePath != "" && !filepath.IsAbs(c.MisePath) {
+		problems = append(problems, fmt.Errorf("mise-path %q must be an absolute path", c.MisePath))
+	}
+	if u, err := url.Parse(c.MiseInstallerURL); err != nil || (u.Scheme != "https" && u.Scheme != "http") || u.Host == "" {
+		problems = append(problems, fmt.Errorf("mise-installer-url %q must be an http or https URL", c.MiseInstallerURL))
+	}
+	if c.MiseInstallerSHA != "" && !config.SHA256Regex.MatchString(c.MiseInstallerSHA) {
+		problems = append(problems, fmt.Errorf("mise-installer-sha %q is not a hex SHA-256 digest", c.MiseInstallerSHA))
+	}
+	if c.PackageLockTimeout < 0 {
+		problems = append(problems, errors.New("package-lock-timeout must not be negative"))
+	}
+	if c.PackageIndexMaxAge < 0 {
+		problems = append(problems, errors.New("package-index-max-age must not be negative"))
+	}
+	if c.RetryAttempts < 1 {
+		problems = append(problems, errors.New("retry-attempts must be at least 1"))
+	}
+	if c.RetryInitialDelay <= 0 {
+		problems = append(problems, errors.New("retry-initial-delay must be positive"))
+	}
+	if c.RetryMaxDelay < c.RetryInitialDelay {
+		problems = append(problems, errors.New("retry-max-delay must not be less than retry-initial-delay"))
+	}
+	if c.RetryMultiplier < 1 {
+		problems = append(problems, errors.New("retry-multiplier must be at least 1"))
+	}
+	if c.NetworkWait < 0 {
+		problems = append(problems, errors.New("network-wait must not be negative"))
+	}
+	if !slices.Contains(platform.LogTargets, c.LogTarget) {
+		problems = append(problems, fmt.Errorf("log-target %q must be one of %s", c.LogTarget, strings.Join(platform.LogTargets, ", ")))
+	}
+	if !slices.Contains(platform.EscalationModes, c.Escalation) {
+		problems = append(problems, fmt.Errorf("escalation %q must be one of %s", c.Escalation, strings.Join(platform.EscalationModes, ", ")))
+	}
+	if c.LockWait < 0 {
+		problems = append(problems, errors.New("lock-wait must not be negative"))
+	}
+	if u, err := url.Parse(c.HomebrewInstallerURL); err != nil || (u.Scheme != "https" && u.Scheme != "http") || u.Host == "" {
+		problems = append(problems, fmt.Errorf("homebrew-installer-url %q must be an http or https URL", c.HomebrewInstallerURL))
+	}
+	if c.HomebrewInstallerSHA != "" && !config.SHA256Regex.MatchString(c.HomebrewInstallerSHA) {
+		problems = append(problems, fmt.Errorf("homebrew-installer-sha %q is not a hex SHA-256 digest", c.HomebrewInstallerSHA))
+	}
+	if !github.FingerprintRegex.MatchString(github.NormalizeFingerprint(c.GhKeyringFingerprint)) {
+		problems = append(problems, fmt.Errorf("gh-keyring-fingerprint %q is not a 40-digit hex fingerprint", c.GhKeyringFingerprint))
+	}
+	if c.Offline {
+		var keyserver string
+		if u, err := c.KeyserverURL(""); err == nil {
+			keyserver = u.Hostname()
+		}
+		if h, err := platform.RepoHost(c.RepoURL); err == nil && !c.HostAllowed(h, keyserver) {
+			problems = append(problems, fmt.Errorf("offline: repo-url host %s is not in allow-hosts", h))
+		}
+		if u, err := url.Parse(c.CACheckURL); err == nil && len(c.CACerts) > 0 && c.CACheckURL != "" && !c.HostAllowed(u.Hostname(), keyserver) {
+			problems = append(problems, fmt.Errorf("offline: ca-check-url host %s is not in allow-hosts; point it at an internal https server or leave it empty", u.Hostname()))
+		}
+		if u, err := url.Parse(c.ClockCheckURL); err == nil && !c.SkipClockCheck && !c.HostAllowed(u.Hostname(), keyserver) {
+			problems = append(problems, fmt.Errorf("offline: clock-check-url host %s is not in allow-hosts; point it at an internal https server or set skip-clock-check", u.Hostname()))
+		}
+	}
+	for _, entry := range c.AllowedHosts() {
+		if strings.ContainsAny(entry, "/@ ") {
+			problems = append(problems, fmt.Errorf("allow-hosts entry %q must be a host, host:port, or .domain", entry))
+		}
+	}
+	if c.CACheckURL != "" {
+		if u, err := url.Parse(c.CACheckURL); err != nil || u.Scheme != "https" || u.Host == "" {
+			problems = append(problems, fmt.Errorf("ca-check-url %q must be an https URL", c.CACheckURL))
+		}
+	}
+	if !c.SkipClockCheck {
+		if u, err := url.Parse(c.ClockCheckURL); err != nil || u.Scheme != "https" || u.Host == "" {
+			problems = append(problems, fmt.Errorf("clock-check-url %q must be an https URL", c.ClockCheckURL))
+		}
+		if c.MaxClockSkew <= 0 {
+			problems = append(problems, errors.New("max-clock-skew must be positive"))
+		}
+	}
+	return problems
+}
+
+// probeConfig performs read-only reachability checks (DNS lookups) for the
+// hosts c depends on.
+func (a *app) probeConfig(c *config.Config) []error {
+	var problems []error
+	var hosts []string
+	if c.Role != "keyserver" {
+		if u, err := c.KeyserverURL(""); err == nil {
+			hosts = append(hosts, u.Hostname())
+		}
+	}
+	if h, err := platform.RepoHost(c.RepoURL); err == nil {
+		hosts = append(hosts, h)
+	}
+	for _, h := range hosts {
+		if _, err := net.LookupHost(h); err != nil {
+			problems = append(problems, fmt.Errorf("cannot resolve %s: %v", h, err))
+		} else if c.Verbose {
+			a.sys.Log("Resolved " + h)
+		}
+	}
+	return problems
+}
+
+// envNameRegex matches the environment variable names --key-b64-env accepts.
+var envNameRegex = regexp.MustCompile(`^[A-Za-z_][A-Za-z0-9_]*$`)
+
+// keyPinRegex matches a curl public key pin of one SHA-256 digest.
+var keyPinRegex = regexp.MustCompile(`^sha256//[A-Za-z0-9+/]{43}=$`)
+
+// runConfigCommand implements the "config" subcommand.
+func (a *app) runConfigCommand(args []string) int {
+	if len(args) == 0 || args[0] != "validate" {
+		fmt.Fprintln(os.Stderr, "Usage: bootstrap config validate [--probe] [flags]")
+		return 2
+	}
+	var probe bool
+	c, _, problems := a.loadConfig("bootstrap config validate", args[1:], func(fs *flag.FlagSet) {
+		fs.BoolVar(&probe, "probe", false, "Also perform read-only DNS checks for the keyserver and git host.")
+	})
+	if len(problems) == 1 && errors.Is(problems[0], flag.ErrHelp) {
+		return 0
+	}
+	a.configure(c, a.sys.Host)
+	problems = append(problems, validateConfig(c)...)
+	if probe {
+		problems = append(problems, a.probeConfig(c)...)
+	}
+	if len(problems) > 0 {
+		for _, p := range problems {
+			fmt.Fprintln(os.Stderr, "error: "+p.Error())
+		}
+		fmt.Fprintf(os.Stderr, "%d problem(s) found.\n", len(problems))
+		return 1
+	}
+	fmt.Println("Configuration is valid.")
+	fmt.Println("Prerequisites for role " + c.Role + ": " + strings.Join(platform.PrereqNames(platform.ResolvePrereqs(c, c.Role)), ", "))
+	if key, err := a.keys.GithubKeyPath(a.sys.Host); err == nil {
+		fmt.Println("GitHub key: " + key)
+	}
+	ref, from := c.EffectiveAnsibleRef()
+	fmt.Println("Ansible ref: " + ansible.DescribeAnsibleRef(ref, from))
+	return 0
+}
+
+// runInitConfigCommand implements "init-config [--force] [path]", writing the
+// embedded default configuration to path (platform.DefaultConfigPath if omitted).
+func (a *app) runInitConfigCommand(args []string) int {
+	fs := flag.NewFlagSet("bootstrap init-config", flag.ContinueOnError)
+	force := fs.Bool("force", false, "Overwrite the file if it already exists.")
+	fs.Usage = func() {
+		fmt.Fprintln(fs.Output(), "Usage: bootstrap init-config [--force] [path]")
+		fs.PrintDefaults()
+	}
+	if err := fs.Parse(args); err != nil {
+		if errors.Is(err, flag.ErrHelp) {
+			return 0
+		}
+		return 2
+	}
+	if fs.NArg() > 1 {
+		fs.Usage()
+		return 2
+	}
+	path := a.sys.Host.Path(platform.DefaultConfigPath)
+	if fs.NArg() == 1 {
+		path = fs.Arg(0)
+	}
+
+	if _, err := os.Stat(path); err == nil && !*force {
+		fmt.Fprintf(os.Stderr, "%s already exists; use --force to overwrite.\n", path)
+		return 1
+	}
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		fmt.Fprintln(os.Stderr, "Failed to create config directory: "+err.Error())
+		return 1
+	}
+	if _, err := a.sys.WriteFile(context.Background(), path, []byte(a.generatedConfig()), 0644, ""); err != nil {
+		fmt.Fprintln(os.Stderr, "Failed to write config file: "+err.Error())
+		return 1
+	}
+	fmt.Println("Wrote default configuration to " + path)
+	return 0
+}
+
+// generatedConfig returns the embedded defaults prefixed with a header
+// recording the host it was generated on.
+func (a *app) generatedConfig() string {
+	hostname, err := os.Hostname()
+	if err != nil {
+		hostname = "unknown"
+	}
+	header := fmt.Sprintf("# Generated by bootstrap init-config on %s (OS: %s).\n#\n", hostname, platform.DetectOS(a.sys.Host))
+	return header + defaultConfigFile
+}
@@ -0,0 +1,110 @@
+package bootstrap
+
+import (
+	"go/ast"
+	"go/parser"
+	"go/token"
+	"io/fs"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+// keyNameUses are the declarations allowed to use sshkeys.GithubKeyName
+// directly, by file and function. Everything else finds the key through
+// GithubKeyPath, so that --key-path is honoured everywhere.
+var keyNameUses = map[string]string{
+	"internal/sshkeys/sshkeys.go:":              "its declaration",
+	"internal/sshkeys/sshkeys.go:GithubKeyPath": "the default of --key-path",
+	"internal/sshkeys/rsyncd.go:":               "the name the keyserver serves the key under",
+	"internal/sshkeys/rsyncd.go:SetupRsyncd":    "the name the keyserver serves the key under",
+	"internal/sshkeys/serve.go:ServeKeys":       "the name the keyserver serves the key under",
+	"pkg/bootstrap/config.go:configFlagSet":     "the --key-path help",
+}
+
+// defaultLiterals are the string literals allowed to equal the default of
+// a setting, by file and value.
+var defaultLiterals = map[string]string{
+	"internal/service/oneshot.go:mise install": "the description of the mise-install unit",
+}
+
+// TestNoDirectConstants fails when code outside config loading uses a
+// setting's default in place of the setting: the GitHub key's file name, or
+// a literal equal to the built-in keyserver, repo URL, vault password file,
+// playbook or mise command. With --repo-url given, a literal would still
+// win wherever it is used.
+func TestNoDirectConstants(t *testing.T) {
+	d := DefaultConfig()
+	defaults := map[string]string{
+		d.Keyserver:         "keyserver",
+		d.KeyserverFallback: "keyserver-fallback",
+		d.RepoURL:           "repo-url",
+		d.VaultPassFile:     "vault-pass-file",
+		d.AnsibleSite:       "ansible-site",
+		d.MiseCmd:           "mise-cmd",
+	}
+	root, err := filepath.Abs("../..")
+	if err != nil {
+		t.Fatal(err)
+	}
+	fset := token.NewFileSet()
+	err = filepath.WalkDir(root, func(path string, e fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if e.IsDir() && (e.Name() == "testdata" || strings.HasPrefix(e.Name(), ".")) {
+			return filepath.SkipDir
+		}
+		if e.IsDir() || !strings.HasSuffix(path, ".go") || strings.HasSuffix(path, "_test.go") {
+			return nil
+		}
+		rel, _ := filepath.Rel(root, path)
+		f, err := parser.ParseFile(fset, path, nil, 0)
+		if err != nil {
+			return err
+		}
+		for _, decl := range f.Decls {
+			name := ""
+			if fn, ok := decl.(*ast.FuncDecl); ok {
+				name = fn.Name.Name
+			}
+			ast.Inspect(decl, func(n ast.Node) bool {
+				switch n := n.(type) {
+				case *ast.Ident:
+					if n.Name == "GithubKeyName" {
+						if _, ok := keyNameUses[rel+":"+name]; !ok {
+							t.Errorf("%s: %s uses GithubKeyName; find the key with GithubKeyPath", fset.Position(n.Pos()), funcName(name))
+						}
+					}
+				case *ast.BasicLit:
+					if n.Kind != token.STRING {
+						return true
+					}
+					s, err := strconv.Unquote(n.Value)
+					if err != nil {
+						return true
+					}
+					if setting, ok := defaults[s]; ok {
+						if _, ok := defaultLiterals[rel+":"+s]; !ok {
+							t.Errorf("%s: %q is the default of --%s; use the setting", fset.Position(n.Pos()), s, setting)
+						}
+					}
+				}
+				return true
+			})
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+// funcName describes the declaration called name for a test failure.
+func funcName(name string) string {
+	if name == "" {
+		return "a declaration"
+	}
+	return name
+}
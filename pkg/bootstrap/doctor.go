@@ -0,0 +1,472 @@
+package bootstrap
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io/fs"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/sparkleHazard/bootstrap/internal/config"
+	"github.com/sparkleHazard/bootstrap/internal/platform"
+	"github.com/sparkleHazard/bootstrap/internal/report"
+	"github.com/sparkleHazard/bootstrap/internal/secrets"
+	"github.com/sparkleHazard/bootstrap/internal/service"
+	"github.com/sparkleHazard/bootstrap/internal/sshkeys"
+)
+
+// doctorTimeout bounds a whole doctor run; each network check has its own,
+// shorter timeout.
+const doctorTimeout = 2 * time.Minute
+
+// Statuses of a doctor check.
+const (
+	doctorPass = "pass"
+	doctorWarn = "warn"
+	doctorFail = "fail"
+)
+
+// doctorCheck is one item of the doctor's checklist.
+type doctorCheck struct {
+	Name   string `json:"name"`
+	Status string `json:"status"`
+	Detail string `json:"detail"`
+}
+
+// doctor collects the checklist.
+type doctor struct {
+	checks []doctorCheck
+	app    *app
+}
+
+func (d *doctor) add(name, status, detail string) {
+	d.checks = append(d.checks, doctorCheck{Name: name, Status: status, Detail: detail})
+}
+
+// count returns how many checks have status.
+func (d *doctor) count(status string) int {
+	n := 0
+	for _, c := range d.checks {
+		if c.Status == status {
+			n++
+		}
+	}
+	return n
+}
+
+// runDoctorCommand implements "doctor [--json]": it checks the host for
+// the problems that usually keep a run from succeeding, without changing
+// anything, and exits 1 if any check failed.
+func (a *app) runDoctorCommand(args []string) int {
+	var asJSON bool
+	c, _, problems := a.loadConfig("bootstrap doctor", args, func(fs *flag.FlagSet) {
+		fs.BoolVar(&asJSON, "json", false, "Print the checklist as JSON.")
+	})
+	if len(problems) == 1 && errors.Is(problems[0], flag.ErrHelp) {
+		return platform.ExitOK
+	}
+	if len(problems) > 0 {
+		for _, p := range problems {
+			fmt.Fprintln(os.Stderr, "error: "+p.Error())
+		}
+		return platform.ExitConfig
+	}
+	a.configure(c, a.sys.Host)
+	ctx, stop := a.sys.HandleSignals()
+	defer stop()
+	ctx, cancel := context.WithTimeout(ctx, doctorTimeout)
+	defer cancel()
+
+	d := &doctor{app: a}
+	osID := d.checkOS()
+	d.checkCommands(ctx)
+	d.checkPrivileges(ctx, osID)
+	key := d.checkSSH(ctx)
+	d.checkGitSSH(ctx, key)
+	d.checkNetwork(ctx, osID)
+	d.checkKeyserver(ctx)
+	d.checkVaultFile()
+	d.checkClock(ctx)
+	d.checkDiskSpace()
+	d.checkSystemd(ctx, osID)
+	d.checkLastRun()
+
+	failed, warned := d.count(doctorFail), d.count(doctorWarn)
+	if asJSON {
+		enc := json.NewEncoder(os.Stdout)
+		enc.SetIndent("", "  ")
+		enc.Encode(struct {
+			Checks   []doctorCheck `json:"checks"`
+			Failed   int           `json:"failed"`
+			Warnings int           `json:"warnings"`
+		}{d.checks, failed, warned})
+	} else {
+		for _, c := range d.checks {
+			fmt.Printf("[%s] %s: %s\n", c.Status, c.Name, c.Detail)
+		}
+		fmt.Printf("%d checks: %d passed, %d warnings, %d failed.\n", len(d.checks), d.count(doctorPass), warned, failed)
+	}
+	if failed > 0 {
+		return platform.ExitFailure
+	}
+	return platform.ExitOK
+}
+
+// checkOS reports the detected OS and returns its ID.
+func (d *doctor) checkOS() string {
+	osID := platform.DetectOS(d.app.sys.Host)
+	switch osID {
+	case "unknown":
+		d.add("os", doctorFail, "could not detect the OS from /etc/os-release")
+	case "darwin", "debian", "ubuntu", "fedora", "centos", "redhat":
+		d.add("os", doctorPass, osID)
+	default:
+		d.add("os", doctorWarn, osID+" is not supported; a run cannot install missing packages on it")
+	}
+	return osID
+}
+
+// checkCommands reports the commands a run needs and their versions.
+// Those a run installs itself are only a warning when missing.
+func (d *doctor) checkCommands(ctx context.Context) {
+	builtins, _ := platform.ResolvePrereqs(d.app.cfg, d.app.cfg.Role)
+	for _, c := range []struct {
+		name   string
+		args   []string
+		prereq string // the prerequisite that installs it, if any
+	}{
+		{"ssh", []string{"-V"}, ""},
+		{"ssh-keygen", nil, ""},
+		{"curl", []string{"--version"}, "curl"},
+		{"git", []string{"--version"}, "git"},
+		{"rsync", []string{"--version"}, "rsync"},
+		{"jq", []string{"--version"}, "jq"},
+		{"ansible-pull", []string{"--version"}, "ansible"},
+		{"gh", []string{"--version"}, "gh"},
+	} {
+		name := "command " + c.name
+		path, err := exec.LookPath(c.name)
+		if err != nil && c.prereq != "" && !slices.Contains(builtins, c.prereq) {
+			d.add(name, doctorPass, "not installed; not needed for role "+d.app.cfg.Role)
+			continue
+		}
+		if err != nil {
+			if c.prereq != "" {
+				d.add(name, doctorWarn, "not installed; a run installs it")
+			} else {
+				d.add(name, doctorFail, "not installed")
+			}
+			continue
+		}
+		if c.args == nil {
+			d.add(name, doctorPass, path)
+			continue
+		}
+		out, _ := d.app.sys.NewCommand(ctx, c.name, c.args...).CombinedOutput()
+		first, _, _ := strings.Cut(strings.TrimSpace(string(out)), "\n")
+		d.add(name, doctorPass, path+" ("+platform.DashIfEmpty(first)+")")
+	}
+}
+
+// checkPrivileges reports whether privileged commands would work, without
+// prompting for a password.
+func (d *doctor) checkPrivileges(ctx context.Context, osID string) {
+	if d.app.sys.Host.EUID() == 0 {
+		d.add("privileges", doctorPass, "running as root")
+		return
+	}
+	tool := d.app.sys.EscalationTool()
+	needs := d.app.sys.PrivilegedWork(ctx, osID)
+	switch {
+	case tool == "" && len(needs) == 0:
+		d.add("privileges", doctorWarn, "no sudo or doas, but nothing this run does needs root")
+	case tool == "":
+		d.add("privileges", doctorFail, "no sudo or doas, and a run needs root for: "+strings.Join(needs, ", "))
+	case d.app.sys.NewCommand(ctx, tool, platform.EscalationArgs(tool, false)...).Run() == nil:
+		d.add("privileges", doctorPass, tool+" works without a password")
+	default:
+		d.add("privileges", doctorWarn, tool+" needs a password; a run on a terminal asks for it once, any other run fails")
+	}
+}
+
+// checkSSH reports the permissions of the GitHub key's directory (~/.ssh
+// unless --key-path puts it elsewhere) and the key's permissions and
+// fingerprint, and returns the key's path if it exists.
+func (d *doctor) checkSSH(ctx context.Context) string {
+	key, err := d.app.keys.GithubKeyPath(d.app.sys.Host)
+	if err != nil {
+		d.add("ssh dir", doctorFail, err.Error())
+		return ""
+	}
+	dir := filepath.Dir(key)
+	fi, err := os.Stat(dir)
+	switch {
+	case errors.Is(err, fs.ErrNotExist):
+		d.add("ssh dir", doctorWarn, dir+" does not exist; a run creates it")
+		return ""
+	case err != nil:
+		d.add("ssh dir", doctorFail, err.Error())
+		return ""
+	case fi.Mode().Perm()&0o022 != 0:
+		d.add("ssh dir", doctorFail, fmt.Sprintf("%s is writable by others (mode %04o); ssh ignores keys in it", dir, fi.Mode().Perm()))
+	case fi.Mode().Perm()&0o077 != 0:
+		d.add("ssh dir", doctorWarn, fmt.Sprintf("%s is accessible by others (mode %04o); 0700 is expected", dir, fi.Mode().Perm()))
+	default:
+		d.add("ssh dir", doctorPass, fmt.Sprintf("%s (mode %04o)", dir, fi.Mode().Perm()))
+	}
+
+	fi, err = os.Stat(key)
+	if errors.Is(err, fs.ErrNotExist) {
+		what := "fetches it from the keyserver"
+		if d.app.cfg.Role == "keyserver" {
+			what = "generates it"
+		}
+		d.add("github key", doctorWarn, key+" does not exist; a run "+what)
+		return ""
+	}
+	if err != nil {
+		d.add("github key", doctorFail, err.Error())
+		return ""
+	}
+	if fi.Mode().Perm()&0o077 != 0 {
+		d.add("github key", doctorFail, fmt.Sprintf("%s is accessible by others (mode %04o); ssh refuses to use it", key, fi.Mode().Perm()))
+		return key
+	}
+	fpFile := key
+	if platform.FileExists(key + ".pub") {
+		fpFile = key + ".pub"
+	}
+	out, err := d.app.sys.NewCommand(ctx, "ssh-keygen", "-l", "-f", fpFile).CombinedOutput()
+	if err != nil {
+		d.add("github key", doctorFail, key+" is not a usable key: "+platform.LastLine(out, err))
+		return key
+	}
+	d.add("github key", doctorPass, fmt.Sprintf("%s (mode %04o, %s)", key, fi.Mode().Perm(), strings.TrimSpace(string(out))))
+	return key
+}
+
+// checkGitSSH reports whether the repository's SSH host accepts the key.
+// Host keys are neither checked nor recorded, so that known_hosts is left
+// as it is.
+func (d *doctor) checkGitSSH(ctx context.Context, key string) {
+	host, err := platform.RepoHost(d.app.cfg.RepoURL)
+	if err != nil || platform.RepoPort(d.app.cfg.RepoURL) == "443" || platform.RepoPort(d.app.cfg.RepoURL) == "80" {
+		return
+	}
+	name := "ssh " + host
+	if key == "" {
+		d.add(name, doctorWarn, "not checked: there is no key yet")
+		return
+	}
+	ctx, cancel := context.WithTimeout(ctx, 20*time.Second)
+	defer cancel()
+	out, err := d.app.sys.NewCommand(ctx, "ssh", "-T", "-o", "BatchMode=yes", "-o", "ConnectTimeout=10",
+		"-o", "StrictHostKeyChecking=no", "-o", "UserKnownHostsFile=/dev/null", "-o", "LogLevel=ERROR",
+		"-p", platform.RepoPort(d.app.cfg.RepoURL), "-i", key, "git@"+host).CombinedOutput()
+	text := strings.TrimSpace(string(out))
+	switch {
+	case strings.Contains(strings.ToLower(text), "successfully authenticated"):
+		d.add(name, doctorPass, platform.LastLine(out, err))
+	case strings.Contains(text, "Permission denied"):
+		d.add(name, doctorFail, "the key is not accepted: "+platform.LastLine(out, err))
+	case err == nil:
+		d.add(name, doctorPass, "the key is accepted")
+	default:
+		d.add(name, doctorFail, platform.LastLine(out, err))
+	}
+}
+
+// checkNetwork runs the run's network preflight checks once.
+func (d *doctor) checkNetwork(ctx context.Context, osID string) {
+	for _, c := range d.app.sys.NetworkChecks(osID, d.app.keys.FetchKeyserver()) {
+		cctx, cancel := context.WithTimeout(ctx, platform.DialTimeout)
+		err := c.Check(cctx)
+		cancel()
+		if err != nil {
+			d.add("network "+c.Name, doctorFail, err.Error())
+		} else {
+			d.add("network "+c.Name, doctorPass, "ok")
+		}
+	}
+}
+
+// checkKeyserver reports whether the keyserver would hand out the key.
+func (d *doctor) checkKeyserver(ctx context.Context) {
+	if d.app.cfg.Role == "keyserver" {
+		return
+	}
+	if d.app.cfg.Keyserver == config.KeyserverAuto {
+		loc, err := sshkeys.DiscoverKeyserver(ctx, d.app.cfg.MdnsTimeout)
+		if err != nil {
+			d.add("keyserver discovery", doctorWarn, err.Error()+"; a run falls back to "+platform.DashIfEmpty(d.app.cfg.KeyserverFallback))
+		} else {
+			d.app.keys.DiscoveredKeyserver = loc
+			d.add("keyserver discovery", doctorPass, "found "+loc+" via mDNS")
+		}
+	}
+	src, err := d.app.cfg.KeyserverURL(d.app.keys.DiscoveredKeyserver)
+	if err != nil {
+		d.add("keyserver", doctorFail, err.Error())
+		return
+	}
+	var check error
+	if src.Scheme == "https" {
+		health := *src
+		health.Path, health.RawQuery = sshkeys.HealthzPath, ""
+		check = d.app.keys.KeyserverHealthy(ctx, health.String())
+	} else {
+		token, err := d.app.keys.BootstrapToken()
+		if err != nil {
+			d.add("keyserver", doctorFail, err.Error())
+			return
+		}
+		if _, err := exec.LookPath("rsync"); err != nil {
+			d.add("keyserver", doctorWarn, "not checked: rsync is not installed")
+			return
+		}
+		check = d.app.keys.KeyserverListsKey(ctx, src, token)
+	}
+	var perm *platform.PermanentError
+	if errors.As(check, &perm) {
+		check = perm.Err
+	}
+	if check != nil {
+		d.add("keyserver", doctorFail, check.Error())
+		return
+	}
+	d.add("keyserver", doctorPass, src.Redacted()+" is ready")
+}
+
+// checkVaultFile reports whether the vault password file exists, unless
+// the password comes from a secret source.
+func (d *doctor) checkVaultFile() {
+	if src := secrets.VaultPassSource(d.app.cfg); src != nil {
+		d.add("vault file", doctorPass, "read from "+src.String()+" at run time")
+		return
+	}
+	homeDir, err := d.app.sys.Host.HomeDir()
+	if err != nil {
+		d.add("vault file", doctorFail, err.Error())
+		return
+	}
+	path := filepath.Join(homeDir, d.app.cfg.VaultPassFile)
+	fi, err := os.Stat(path)
+	switch {
+	case err != nil:
+		d.add("vault file", doctorWarn, path+" does not exist; the playbook cannot decrypt vaulted data without it")
+	case fi.Mode().Perm()&0o077 != 0:
+		d.add("vault file", doctorWarn, fmt.Sprintf("%s is accessible by others (mode %04o)", path, fi.Mode().Perm()))
+	default:
+		d.add("vault file", doctorPass, path)
+	}
+}
+
+// checkClock reports the clock's skew against --clock-check-url.
+func (d *doctor) checkClock(ctx context.Context) {
+	if d.app.cfg.SkipClockCheck {
+		d.add("clock", doctorPass, "not checked (skip-clock-check)")
+		return
+	}
+	skew, err := d.app.sys.ClockSkew(ctx, d.app.cfg.ClockCheckURL)
+	switch {
+	case err != nil:
+		d.add("clock", doctorWarn, "could not measure the skew: "+err.Error())
+	case platform.Abs(skew) > d.app.cfg.MaxClockSkew:
+		d.add("clock", doctorFail, fmt.Sprintf("off by %s (allowed %s); fix the clock or run with --fix-clock", skew.Round(time.Second), d.app.cfg.MaxClockSkew))
+	default:
+		d.add("clock", doctorPass, fmt.Sprintf("within %s of %s", platform.Abs(skew).Round(time.Second), d.app.cfg.ClockCheckURL))
+	}
+}
+
+// checkDiskSpace reports each filesystem's free space against its minimum.
+func (d *doctor) checkDiskSpace() {
+	usage, err := d.app.sys.DiskUsage()
+	if err != nil {
+		d.add("disk space", doctorFail, err.Error())
+		return
+	}
+	for _, u := range usage {
+		name := "disk space " + strings.Join(u.Paths, ", ")
+		detail := fmt.Sprintf("%s free, need %s", config.FormatBytes(u.Free), config.FormatBytes(u.Min))
+		if u.Free < u.Min {
+			d.add(name, doctorFail, detail)
+		} else {
+			d.add(name, doctorPass, detail)
+		}
+	}
+}
+
+// checkSystemd reports whether systemd is running, which the one-shot
+// units after the reboot need.
+func (d *doctor) checkSystemd(ctx context.Context, osID string) {
+	if osID == "darwin" {
+		return
+	}
+	shots, _ := d.app.services.PlannedOneShots(d.app.cfg.RunMiseInstall && !d.app.cfg.RunMiseNow)
+	if !d.app.sys.Host.SystemdRunning() {
+		if len(shots) > 0 {
+			d.add("systemd", doctorFail, "systemd is not running, but a run sets up units to run after the reboot")
+		} else {
+			d.add("systemd", doctorWarn, "systemd is not running")
+		}
+		return
+	}
+	out, err := d.app.sys.NewCommand(ctx, service.SystemctlPath(), "--version").Output()
+	first, _, _ := strings.Cut(string(out), "\n")
+	if err != nil {
+		first = err.Error()
+	}
+	d.add("systemd", doctorPass, strings.TrimSpace(first))
+}
+
+// checkLastRun reports the success marker, the last result file and the
+// one-shot units' last runs.
+func (d *doctor) checkLastRun() {
+	ok, reason := d.app.sys.AlreadyBootstrapped(d.app.cfg.ConfigHash())
+	if ok {
+		d.add("success marker", doctorPass, reason)
+	} else {
+		d.add("success marker", doctorWarn, reason)
+	}
+
+	if d.app.cfg.ResultFile != "" {
+		data, err := os.ReadFile(d.app.cfg.ResultFile)
+		var res report.Result
+		switch {
+		case errors.Is(err, fs.ErrNotExist):
+			d.add("last result", doctorWarn, "no result file at "+d.app.cfg.ResultFile)
+		case err != nil:
+			d.add("last result", doctorWarn, err.Error())
+		case json.Unmarshal(data, &res) != nil:
+			d.add("last result", doctorWarn, d.app.cfg.ResultFile+" is not a result file")
+		case res.Status == "success" || res.Status == "skipped":
+			d.add("last result", doctorPass, fmt.Sprintf("%s at %s", res.Status, res.FinishedAt.Format(time.RFC3339)))
+		default:
+			d.add("last result", doctorWarn, fmt.Sprintf("%s at %s in step %s: %s", res.Status, res.FinishedAt.Format(time.RFC3339), platform.DashIfEmpty(res.FailedStep), platform.DashIfEmpty(res.Error)))
+		}
+	}
+
+	shots, err := d.app.services.PlannedOneShots(true)
+	if err != nil {
+		return
+	}
+	for _, o := range shots {
+		outcome := service.PreviousOneShot(o)
+		if outcome == nil {
+			continue
+		}
+		detail := fmt.Sprintf("%s at %s (exit status %s)", outcome.Result, outcome.FinishedAt.Format(time.RFC3339), platform.DashIfEmpty(outcome.ExitStatus))
+		if outcome.Result == "success" {
+			d.add("last "+o.Desc, doctorPass, detail)
+		} else {
+			d.add("last "+o.Desc, doctorWarn, detail+"; see "+o.LogFile())
+		}
+	}
+}
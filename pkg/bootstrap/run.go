@@ -0,0 +1,279 @@
+package bootstrap
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"strconv"
+	"time"
+
+	"github.com/sparkleHazard/bootstrap/internal/ansible"
+	"github.com/sparkleHazard/bootstrap/internal/config"
+	"github.com/sparkleHazard/bootstrap/internal/github"
+	"github.com/sparkleHazard/bootstrap/internal/platform"
+	"github.com/sparkleHazard/bootstrap/internal/release"
+	"github.com/sparkleHazard/bootstrap/internal/remote"
+	"github.com/sparkleHazard/bootstrap/internal/report"
+	"github.com/sparkleHazard/bootstrap/internal/secrets"
+	"github.com/sparkleHazard/bootstrap/internal/service"
+	"github.com/sparkleHazard/bootstrap/internal/sshkeys"
+	"github.com/sparkleHazard/bootstrap/internal/steps"
+)
+
+// run performs a full bootstrap, writes the result file, and returns the
+// outcome. The error is what stopped the run, if anything did.
+func (a *app) run(ctx context.Context) (*report.Result, error) {
+	a.addConfigSecrets()
+	if u, err := a.cfg.KeyserverURL(""); err == nil {
+		a.sys.AllowKeyserver(u.Hostname())
+	}
+
+	// Only one run at a time. A run that never got the lock must not touch
+	// the result file, which belongs to the instance holding it.
+	lock, err := a.sys.AcquireRunLock(ctx)
+	if err != nil {
+		if ctx.Err() != nil {
+			a.sys.Log("Bootstrap interrupted.")
+			return stoppedEarly("interrupted", platform.ExitInterrupted, err)
+		}
+		a.sys.Log("Bootstrap failed: " + err.Error())
+		return stoppedEarly("failed", platform.ExitCodeFor(err), err)
+	}
+	defer lock.Release()
+	defer a.sys.RemoveWorkDir()
+	if a.cfg.Transcript != "" {
+		// A run that cannot keep its transcript does not run at all.
+		t, err := a.sys.OpenTranscript(a.cfg.Transcript)
+		if err != nil {
+			a.sys.Log("Bootstrap failed: transcript: " + err.Error())
+			return stoppedEarly("failed", platform.ExitFailure, fmt.Errorf("transcript: %w", err))
+		}
+		a.sys.Transcript.Store(t)
+		defer func() {
+			a.sys.Transcript.Store(nil)
+			if err := t.Close(); err != nil {
+				a.sys.Log("Warning: closing the transcript: " + err.Error())
+			}
+		}()
+	}
+
+	if err := a.updater.CheckIntegrity(); err != nil {
+		a.sys.Log("Bootstrap failed: " + err.Error())
+		return stoppedEarly("failed", platform.ExitFailure, err)
+	}
+
+	res := &report.Result{Role: a.cfg.Role, StartedAt: time.Now(), MachineID: a.keys.MachineID(), Version: platform.ToolVersion()}
+	res.Hostname, _ = os.Hostname()
+	a.reporter.PingHealthcheck(ctx, "start", "")
+	a.updater.CheckForUpdate(ctx)
+
+	skip := false
+	// A drift check is for hosts that are bootstrapped.
+	if a.cfg.SkipIfBootstrapped.Enabled && !a.cfg.DetectDrift {
+		if a.cfg.Force {
+			a.sys.Log("--force given; ignoring any success marker.")
+		} else {
+			var reason string
+			skip, reason = a.sys.AlreadyBootstrapped(a.cfg.ConfigHash())
+			a.sys.Log(reason)
+		}
+	}
+	if !skip {
+		err = a.steps.Bootstrap(ctx, res)
+		a.steps.FinishStep(res, err != nil)
+	}
+
+	res.FinishedAt = time.Now()
+	res.DurationSeconds = res.FinishedAt.Sub(res.StartedAt).Seconds()
+	res.ExitCode = platform.ExitCodeFor(err)
+	if skip {
+		res.Status = "skipped"
+		a.sys.Log("Host already bootstrapped; nothing to do.")
+	} else if ctx.Err() != nil {
+		res.Status = "interrupted"
+		res.ExitCode = platform.ExitInterrupted
+		res.FailedStep = res.Step
+		if err != nil {
+			res.Error = err.Error()
+		}
+		a.sys.Log("Bootstrap interrupted.")
+		a.steps.UnwindFailedRun(res)
+	} else if errors.Is(err, ansible.ErrDrift) {
+		// Not a failure: nothing was changed, so nothing is unwound.
+		res.Status = "drift"
+		res.Error = err.Error()
+		a.sys.Log("Drift detected: " + res.Drift.Summary())
+	} else if err != nil {
+		res.Status = "failed"
+		res.Error = err.Error()
+		res.FailedStep = res.Step
+		if a.cfg.Quiet {
+			a.sys.ShowStepOutput(res.FailedStep)
+		}
+		a.sys.Log("Bootstrap failed: " + err.Error())
+		a.steps.UnwindFailedRun(res)
+	} else {
+		res.Status = "success"
+		// A drift check applies nothing, so it does not make the host
+		// bootstrapped.
+		if !a.cfg.DetectDrift {
+			if werr := a.sys.WriteSuccessMarker(ctx, res.FinishedAt, res.AnsibleCommit, a.cfg.ConfigHash()); werr != nil {
+				a.sys.Log("Failed to write success marker: " + werr.Error())
+			}
+		}
+	}
+	a.logOutcome(res)
+
+	// Only a fully successful run reboots.
+	reboot := res.Steps["reboot"] == "pending"
+	if reboot && res.Status != "success" {
+		res.Steps["reboot"] = "skipped"
+		reboot = false
+	}
+	writeResult := func() {
+		if a.cfg.ResultFile != "" {
+			if werr := a.reporter.WriteResultFile(ctx, a.cfg.ResultFile, res); werr != nil {
+				a.sys.Log("Failed to write result file: " + werr.Error())
+			}
+		}
+	}
+	// The result file is written before rebooting, recording the reboot
+	// as pending, and rewritten with its outcome.
+	writeResult()
+	if res.Status == "success" || res.Status == "skipped" {
+		a.reporter.PingHealthcheck(ctx, "", "")
+	} else {
+		a.reporter.PingHealthcheck(ctx, "fail", report.HealthcheckFailureBody(res))
+	}
+	a.reporter.PushMetrics(ctx, res)
+	a.reporter.SendReport(ctx, res)
+	a.reporter.SendErrorReport(ctx, res, err)
+	a.reporter.NotifyNtfy(ctx, res)
+	a.reporter.NotifyEmail(ctx, res)
+	// After the notifications, which report the failed step's output, and
+	// before the summary, which lists the hooks with the other steps.
+	a.steps.RunPostHooks(ctx, res)
+	writeResult()
+	// Last, so that it is not part of the failing step's output reported
+	// above.
+	if !skip {
+		a.steps.LogStepSummary(res)
+	}
+	// After everything else, so that its URL is the last line of output.
+	a.reporter.UploadFailureLogs(ctx, res)
+	if reboot {
+		res.Steps["reboot"] = a.services.RebootHost(ctx)
+		writeResult()
+	}
+	if res.Status == "interrupted" && err == nil {
+		err = ctx.Err()
+	}
+	return res, err
+}
+
+// stoppedEarly returns the outcome of a run that err stopped before it
+// started on the steps, with status and exit code.
+func stoppedEarly(status string, code int, err error) (*report.Result, error) {
+	return &report.Result{Status: status, ExitCode: code, Error: err.Error()}, err
+}
+
+// logOutcome sends the outcome of res to the journal, as a record of its
+// own with the status, exit code and duration as fields.
+func (a *app) logOutcome(res *report.Result) {
+	took := res.FinishedAt.Sub(res.StartedAt)
+	fields := platform.JournalFields{
+		"BOOTSTRAP_STATUS": res.Status,
+		"EXIT_CODE":        strconv.Itoa(res.ExitCode),
+		"DURATION_MS":      platform.DurationMS(took),
+	}
+	if res.FailedStep != "" {
+		fields["BOOTSTRAP_STEP"] = res.FailedStep
+	}
+	switch res.Status {
+	case "failed":
+		fields["PRIORITY"] = "3"
+	case "interrupted", "drift":
+		fields["PRIORITY"] = "4"
+	}
+	a.sys.Journal.Send(fmt.Sprintf("Run finished: %s (exit code %d) after %s.", res.Status, res.ExitCode, platform.RoundDuration(took)), fields)
+}
+
+// addConfigSecrets has the tokens and passwords of the configuration and
+// environment redacted from the run's reports and transcript.
+func (a *app) addConfigSecrets() {
+	a.sys.AddSecret(a.cfg.SMTPPassword, os.Getenv(report.PushgatewayPasswordEnv), os.Getenv(report.NtfyTokenEnv),
+		os.Getenv(report.UploadTokenEnv), os.Getenv("GH_TOKEN"), os.Getenv("GITHUB_TOKEN"))
+	if t, err := a.keys.BootstrapToken(); err == nil {
+		a.sys.AddSecret(t)
+	}
+	if t, err := a.reporter.ReportToken(); err == nil {
+		a.sys.AddSecret(t)
+	}
+}
+
+// runNotifyTest implements --notify-test, sending a test email with the
+// --notify-email settings instead of running bootstrap.
+func (a *app) runNotifyTest(ctx context.Context) int {
+	if a.cfg.NotifyEmail == "" {
+		a.sys.Log("Configuration error: --notify-test needs --notify-email")
+		return platform.ExitConfig
+	}
+	host := report.HostnameOr("unknown host")
+	body := fmt.Sprintf("This is a test message from bootstrap %s on %s.\n\nIf you can read it, failure notifications from this host will reach you.\n", platform.ToolVersion(), host)
+	if err := a.reporter.SendEmail(ctx, "bootstrap test message from "+host, body); err != nil {
+		a.sys.Log("Sending the test email failed: " + err.Error())
+		return platform.ExitFailure
+	}
+	a.sys.Log("Sent a test email to " + a.cfg.NotifyEmail + ".")
+	return platform.ExitOK
+}
+
+// app is what a bootstrap command works with: its configuration and the
+// units built from it.
+type app struct {
+	cfg      *config.Config
+	sys      *platform.System
+	secrets  *secrets.Store
+	services *service.Manager
+	keys     *sshkeys.Manager
+	github   *github.Client
+	ansible  *ansible.Runner
+	updater  *release.Updater
+	reporter *report.Reporter
+	steps    *steps.Runner
+	remote   *remote.Client
+}
+
+// newApp returns the app of a command on host, with the zero
+// configuration until configure is given the command's.
+func newApp(host *platform.HostEnv) *app {
+	a := &app{}
+	a.configure(&config.Config{}, host)
+	return a
+}
+
+// configure builds the units of a from cfg, for a command on host.
+func (a *app) configure(cfg *config.Config, host *platform.HostEnv) {
+	sys := platform.NewSystem(cfg, host)
+	secrets := secrets.NewStore(sys)
+	services := service.NewManager(sys, secrets)
+	keys := sshkeys.NewManager(sys, secrets, services)
+	github := github.NewClient(sys, secrets, keys)
+	ansible := ansible.NewRunner(sys, secrets, services, keys, github)
+	updater := release.NewUpdater(sys, services)
+	reporter := report.NewReporter(sys, secrets, keys, ansible)
+	*a = app{
+		cfg:      cfg,
+		sys:      sys,
+		secrets:  secrets,
+		services: services,
+		keys:     keys,
+		github:   github,
+		ansible:  ansible,
+		updater:  updater,
+		reporter: reporter,
+		steps:    steps.NewRunner(sys, secrets, services, keys, github, ansible, updater, reporter),
+		remote:   remote.NewClient(sys, updater),
+	}
+}
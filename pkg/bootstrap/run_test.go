@@ -0,0 +1,111 @@
+package bootstrap
+
+import (
+	"context"
+	"errors"
+	"os"
+	"slices"
+	"strings"
+	"testing"
+
+	"github.com/sparkleHazard/bootstrap/internal/platform"
+	"github.com/sparkleHazard/bootstrap/internal/platform/platformtest"
+)
+
+// newInstallHost readies a Debian host in a test root for a run whose
+// commands go to the returned runner. sudo is on PATH; every other package
+// is missing until apt-get installs it, which fails for the packages in
+// broken. curl fetches the GitHub key.
+func newInstallHost(t *testing.T, broken ...string) *platformtest.Runner {
+	t.Helper()
+	h := platformtest.NewHost(t, platformtest.DebianRelease)
+	h.Setenv(t)
+	key, err := os.ReadFile(h.Key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	install := func(names ...string) {
+		for _, name := range names {
+			h.Install(t, name, "")
+		}
+	}
+	install("sudo")
+	commands := map[string][]string{"ansible": {"ansible", "ansible-playbook", "ansible-pull"}}
+	return &platformtest.Runner{Respond: func(cmd string) (string, error) {
+		f := strings.Fields(cmd)
+		switch {
+		case cmd == "apt-get --version":
+			return "apt 2.6.1 (amd64)", nil
+		case slices.Contains(f, "install"):
+			pkg := f[len(f)-1]
+			if slices.Contains(broken, pkg) {
+				return "E: Unable to locate package " + pkg, errors.New("exit status 100")
+			}
+			if cmds, ok := commands[pkg]; ok {
+				install(cmds...)
+			} else {
+				install(pkg)
+			}
+		case f[0] == "curl":
+			dest := f[slices.Index(f, "-o")+1]
+			if err := os.WriteFile(dest, key, 0600); err != nil {
+				return "", err
+			}
+			return "200", nil
+		case strings.HasSuffix(cmd, "rev-parse HEAD"):
+			return "0123456789abcdef0123456789abcdef01234567", nil
+		}
+		return "", nil
+	}}
+}
+
+func TestRunInstallFailure(t *testing.T) {
+	for _, keepGoing := range []bool{false, true} {
+		name := "stops"
+		if keepGoing {
+			name = "keeps going"
+		}
+		t.Run(name, func(t *testing.T) {
+			runner := newInstallHost(t, "jq")
+			cfg := DefaultConfig()
+			cfg.Role = "base"
+			cfg.Keyserver = "https://keys.example.com/id_ecdsa_github"
+			cfg.KeepGoing = keepGoing
+			cfg.NoProgress = true
+			cfg.SkipClockCheck = true
+			cfg.SkipSpaceCheck = true
+			cfg.SkipLocaleSetup = true
+			cfg.RetryAttempts = 1
+			cfg.KeyserverWaitTimeout = 0
+			cfg.ResultFile = ""
+			cfg.Logger = &platformtest.Logger{}
+			cfg.Runner = runner
+
+			res, err := Run(context.Background(), cfg)
+			if err == nil || !strings.Contains(err.Error(), "installing jq") {
+				t.Fatalf("Run error = %v, want the failed jq install", err)
+			}
+			if res.Status != "failed" || res.ExitCode != platform.ExitFailure || res.FailedStep != "install-jq" {
+				t.Errorf("Run = %+v, want install-jq failed with exit code %d", res, platform.ExitFailure)
+			}
+			steps := map[string]string{}
+			for _, s := range res.Steps {
+				steps[s.Name] = s.Status
+			}
+			if steps["install-jq"] != "failed" {
+				t.Errorf("install-jq is %q, want failed", steps["install-jq"])
+			}
+
+			// Without --keep-going nothing runs after the failed install;
+			// with it, the rest of the run does and still fails.
+			pulled := slices.ContainsFunc(runner.Commands(), func(c string) bool { return strings.HasPrefix(c, "ansible-pull ") })
+			if pulled != keepGoing || (steps["ansible-pull"] == "ok") != keepGoing {
+				t.Errorf("ansible-pull ran: %v, step %q; want it run only with --keep-going:\n  %s",
+					pulled, steps["ansible-pull"], strings.Join(runner.Commands(), "\n  "))
+			}
+			if keepGoing && steps["install-python"] != "installed" {
+				t.Errorf("install-python is %q after the failed jq install, want installed", steps["install-python"])
+			}
+		})
+	}
+}